@@ -0,0 +1,218 @@
+// Package addon installs add-ons from a registry. A registry is a plain
+// HTTP directory serving, for every add-on, "<name>.tar.gz" with the add-on
+// directory (its addon.yaml, overlay files and scripts) and
+// "<name>.tar.gz.sig" with the base64 Ed25519 signature of that archive.
+package addon
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fetch"
+)
+
+// RegistryEnv names the environment variable holding the registry URL used
+// when none is given on the command line.
+const RegistryEnv = "DISTRORUN_ADDON_REGISTRY"
+
+// DefaultKeyDir holds the public keys of trusted registries, one base64
+// Ed25519 key per *.pub file.
+const DefaultKeyDir = "/etc/distrorun/addon-keys"
+
+// maxArchiveSize bounds downloads and extracted contents; add-ons are
+// definitions and small overlays, not packages.
+const maxArchiveSize = 32 << 20
+
+// LoadKeys reads the trusted public keys from files or directories of
+// *.pub files.
+func LoadKeys(paths ...string) ([]ed25519.PublicKey, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("reading keys: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(p, "*.pub"))
+		files = append(files, matches...)
+	}
+
+	var keys []ed25519.PublicKey
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading key: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s is not a base64 Ed25519 public key", f)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted add-on keys in %s", strings.Join(paths, ", "))
+	}
+	return keys, nil
+}
+
+// Fetch downloads an add-on archive and its signature from the registry.
+func Fetch(registry, name string) (archive, sig []byte, err error) {
+	if err := config.CheckAddonName(name); err != nil {
+		return nil, nil, err
+	}
+	base := strings.TrimSuffix(registry, "/") + "/" + name + ".tar.gz"
+	if archive, err = get(base); err != nil {
+		return nil, nil, err
+	}
+	if sig, err = get(base + ".sig"); err != nil {
+		return nil, nil, err
+	}
+	return archive, sig, nil
+}
+
+// get downloads a registry file.
+func get(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 60 * time.Second, Transport: fetch.Transport(nil)}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: not found in the registry", url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: HTTP %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxArchiveSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", url, err)
+	}
+	if len(data) > maxArchiveSize {
+		return nil, fmt.Errorf("%s is larger than %d MB", url, maxArchiveSize>>20)
+	}
+	return data, nil
+}
+
+// Verify checks that one of the trusted keys signed the archive. The
+// signature covers the addon.yaml in it, so its name and version too;
+// Install checks that the name is the one asked for.
+func Verify(archive, sig []byte, keys []ed25519.PublicKey) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return errors.New("malformed add-on signature")
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, archive, raw) {
+			return nil
+		}
+	}
+	return errors.New("add-on signature does not match any trusted key")
+}
+
+// Install unpacks a verified archive into dir/name, replacing an earlier
+// version of the add-on. The archive holds the add-on files at its root;
+// only regular files and directories inside it are accepted.
+func Install(archive []byte, name, dir string) (*config.Addon, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", dir, err)
+	}
+	tmp, err := os.MkdirTemp(dir, "."+name+"-")
+	if err != nil {
+		return nil, fmt.Errorf("creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	staged := filepath.Join(tmp, name)
+	if err := extract(archive, staged); err != nil {
+		return nil, err
+	}
+	a, err := config.LoadAddon(staged)
+	if err != nil {
+		return nil, fmt.Errorf("invalid add-on: %w", err)
+	}
+
+	dest := filepath.Join(dir, name)
+	if err := os.RemoveAll(dest); err != nil {
+		return nil, fmt.Errorf("removing previous version: %w", err)
+	}
+	if err := os.Rename(staged, dest); err != nil {
+		return nil, fmt.Errorf("installing add-on: %w", err)
+	}
+	return a, nil
+}
+
+// extract unpacks a gzip-compressed tarball into the new directory root.
+func extract(archive []byte, root string) error {
+	if err := os.Mkdir(root, 0755); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("reading add-on archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading add-on archive: %w", err)
+		}
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("add-on archive entry %q escapes the add-on directory", hdr.Name)
+		}
+		p := filepath.Join(root, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if total += hdr.Size; total > maxArchiveSize {
+				return fmt.Errorf("add-on archive unpacks to more than %d MB", maxArchiveSize>>20)
+			}
+			mode := os.FileMode(0644)
+			if hdr.Mode&0111 != 0 {
+				mode = 0755
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("extracting %s: %w", hdr.Name, err)
+			}
+		default:
+			return fmt.Errorf("add-on archive entry %q is not a regular file or directory", hdr.Name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package addon
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// archive returns a gzip-compressed tarball of the named files.
+func archive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestInstall(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	data := archive(t, map[string]string{
+		"addon.yaml":         "name: netdata\nversion: 1.2.0\ndescription: Monitoring\npackages: [netdata]\nservices: [netdata]\n",
+		"files/netdata.conf": "[global]\n",
+	})
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/netdata.tar.gz":
+			w.Write(data)
+		case "/netdata.tar.gz.sig":
+			w.Write([]byte(sig + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "registry.pub")
+	os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(pub)), 0644)
+	keys, err := LoadKeys(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotArchive, gotSig, err := Fetch(srv.URL+"/", "netdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(gotArchive, gotSig, keys); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := Verify(append(gotArchive, 0), gotSig, keys); err == nil {
+		t.Error("Verify accepted a modified archive")
+	}
+	if _, _, err := Fetch(srv.URL, "tailscale"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error, got: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "addons")
+	a, err := Install(gotArchive, "netdata", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != "1.2.0" || a.Description != "Monitoring" {
+		t.Errorf("Version = %q, Description = %q", a.Version, a.Description)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "netdata", "files", "netdata.conf")); err != nil {
+		t.Error(err)
+	}
+	// Reinstalling replaces the add-on and leaves no staging directory.
+	if _, err := Install(gotArchive, "netdata", dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("add-on directory has %d entries, want 1", len(entries))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	data := archive(t, map[string]string{"addon.yaml": "name: netdata\nversion: 1.2.0\n"})
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+
+	for name, tc := range map[string]struct {
+		archive []byte
+		sig     []byte
+		keys    []ed25519.PublicKey
+		wantErr string
+	}{
+		"signed": {data, sig, []ed25519.PublicKey{other, pub}, ""},
+		// Archives from before add-ons had versions still verify.
+		"unversioned": {archive(t, map[string]string{"addon.yaml": "name: netdata\n"}), nil, []ed25519.PublicKey{pub}, ""},
+		"other key":   {data, sig, []ed25519.PublicKey{other}, "does not match"},
+		"modified":    {append(slices.Clone(data), 0), sig, []ed25519.PublicKey{pub}, "does not match"},
+		"malformed":   {data, []byte("not base64"), []ed25519.PublicKey{pub}, "malformed"},
+	} {
+		if tc.sig == nil {
+			tc.sig = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, tc.archive)))
+		}
+		err := Verify(tc.archive, tc.sig, tc.keys)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: Verify = %v", name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: Verify = %v, want an error saying %q", name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestInstallRejectsUnsafeArchives(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"escape":   {"addon.yaml": "name: evil\n", "../outside": "x"},
+		"absolute": {"addon.yaml": "name: evil\n", "/etc/passwd": "x"},
+		"name":     {"addon.yaml": "name: other\n"},
+	} {
+		dir := t.TempDir()
+		if _, err := Install(archive(t, files), "evil", dir); err == nil {
+			t.Errorf("%s: Install succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+			t.Errorf("%s: add-on was installed", name)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package apkindex reads Alpine repository indexes (APKINDEX.tar.gz) and
+// answers what installing packages would pull in, without apk: the
+// dependency closure of a package set and its installed size.
+package apkindex
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Package is what an index records about a package.
+type Package struct {
+	Name    string
+	Version string
+	Size    int64    // installed size in bytes
+	Depends []string // package names, so:, cmd: and pc: names, without versions
+}
+
+// Index is the packages of one or more repositories.
+type Index struct {
+	packages map[string]*Package
+	provides map[string]string // provided name → package
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{packages: map[string]*Package{}, provides: map[string]string{}}
+}
+
+// Read adds the packages of an APKINDEX.tar.gz to the index. A package
+// already in the index, from a repository read before, is kept, as apk
+// prefers the first repository.
+func (ix *Index) Read(r io.Reader) error {
+	// The signature and the index are two gzip streams, read as one.
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("reading APKINDEX: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("reading APKINDEX: no APKINDEX in the archive")
+		}
+		if err != nil {
+			return fmt.Errorf("reading APKINDEX: %w", err)
+		}
+		if h.Name == "APKINDEX" {
+			return ix.parse(tr)
+		}
+	}
+}
+
+// parse reads the text of an APKINDEX: one "K:value" line per field,
+// packages separated by blank lines.
+func (ix *Index) parse(r io.Reader) error {
+	var cur *Package
+	var provides []string
+	done := func() {
+		if cur != nil && ix.packages[cur.Name] == nil {
+			ix.packages[cur.Name] = cur
+			for _, p := range provides {
+				if _, ok := ix.provides[p]; !ok {
+					ix.provides[p] = cur.Name
+				}
+			}
+		}
+		cur, provides = nil, nil
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			done()
+			continue
+		}
+		if cur == nil {
+			cur = &Package{}
+		}
+		switch key {
+		case "P":
+			cur.Name = value
+		case "V":
+			cur.Version = value
+		case "I":
+			cur.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "D":
+			for _, d := range strings.Fields(value) {
+				// "!name" is a conflict, not a dependency.
+				if !strings.HasPrefix(d, "!") {
+					cur.Depends = append(cur.Depends, stripVersion(d))
+				}
+			}
+		case "p":
+			for _, p := range strings.Fields(value) {
+				provides = append(provides, stripVersion(p))
+			}
+		}
+	}
+	done()
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading APKINDEX: %w", err)
+	}
+	return nil
+}
+
+// stripVersion returns the name of a dependency such as "musl>=1.2" or a
+// provided name such as "cmd:curl=8.5.0-r0".
+func stripVersion(s string) string {
+	if i := strings.IndexAny(s, "<>=~"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Package returns the package called name, or the one providing it.
+func (ix *Index) Package(name string) (*Package, bool) {
+	if p, ok := ix.packages[name]; ok {
+		return p, true
+	}
+	if p, ok := ix.provides[name]; ok {
+		return ix.packages[p], true
+	}
+	return nil, false
+}
+
+// Closure returns the packages installing names pulls in, names included,
+// as name → package. Names the index does not know are skipped.
+func (ix *Index) Closure(names []string) map[string]*Package {
+	set := map[string]*Package{}
+	queue := append([]string(nil), names...)
+	for len(queue) > 0 {
+		p, ok := ix.Package(queue[0])
+		queue = queue[1:]
+		if !ok || set[p.Name] != nil {
+			continue
+		}
+		set[p.Name] = p
+		queue = append(queue, p.Depends...)
+	}
+	return set
+}
+
+// Size returns the installed size of packages.
+func Size(packages map[string]*Package) int64 {
+	var n int64
+	for _, p := range packages {
+		n += p.Size
+	}
+	return n
+}
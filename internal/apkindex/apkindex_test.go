@@ -0,0 +1,56 @@
+package apkindex
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/apkindex/apkindextest"
+)
+
+const testIndex = `C:Q1abc=
+P:musl
+V:1.2.5-r0
+I:700000
+p:so:libc.musl-x86_64.so.1=1
+
+P:libcurl
+V:8.9.0-r0
+I:500000
+D:so:libc.musl-x86_64.so.1 !libcurl-old
+p:so:libcurl.so.4=4.8.0
+
+P:curl
+V:8.9.0-r0
+I:250000
+D:libcurl=8.9.0-r0 so:libc.musl-x86_64.so.1 so:libcurl.so.4
+p:cmd:curl=8.9.0-r0
+`
+
+func TestIndex(t *testing.T) {
+	ix := New()
+	if err := ix.Read(bytes.NewReader(apkindextest.Archive(t, testIndex))); err != nil {
+		t.Fatal(err)
+	}
+	// A later repository does not replace a package.
+	if err := ix.Read(bytes.NewReader(apkindextest.Archive(t, "P:curl\nV:1.0-r0\nI:1\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	curl, ok := ix.Package("cmd:curl")
+	if !ok || curl.Name != "curl" || curl.Version != "8.9.0-r0" {
+		t.Fatalf("cmd:curl = %+v", curl)
+	}
+	if want := []string{"libcurl", "so:libc.musl-x86_64.so.1", "so:libcurl.so.4"}; !slices.Equal(curl.Depends, want) {
+		t.Errorf("Depends = %q, want %q", curl.Depends, want)
+	}
+
+	closure := ix.Closure([]string{"curl", "unknown"})
+	if got := slices.Sorted(maps.Keys(closure)); !slices.Equal(got, []string{"curl", "libcurl", "musl"}) {
+		t.Errorf("Closure = %q", got)
+	}
+	if got := Size(closure); got != 1450000 {
+		t.Errorf("Size = %d", got)
+	}
+}
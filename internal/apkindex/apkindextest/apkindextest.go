@@ -0,0 +1,31 @@
+// Package apkindextest builds Alpine package indexes for tests.
+package apkindextest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// Archive returns an APKINDEX.tar.gz of index, with the signature as a
+// gzip stream of its own in front, as Alpine's repositories have it.
+func Archive(t testing.TB, index string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, f := range []struct{ name, body string }{{".SIGN.RSA.key.rsa.pub", "sig"}, {"APKINDEX", index}} {
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.body))
+		if f.name == "APKINDEX" {
+			tw.Close()
+		} else {
+			tw.Flush()
+		}
+		gz.Close()
+	}
+	return buf.Bytes()
+}
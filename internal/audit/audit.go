@@ -0,0 +1,402 @@
+// Package audit keeps a trail of the privileged operations a build performs:
+// the commands it runs (mount, chroot, package managers, ...) and every file
+// it writes, creates, moves or removes. Each operation is appended to the log
+// as one JSON line. Nothing is recorded until Open is called.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	mu      sync.Mutex
+	logFile *os.File
+	tools   = map[string]bool{} // see Tools
+)
+
+// Entry is one audit log record. Only the fields relevant to Op are set.
+type Entry struct {
+	Time   string   `json:"time"`
+	Op     string   `json:"op"` // exec, mount, umount, chroot, write, create, mkdir, remove, rename, chmod, chtimes, symlink
+	Argv   []string `json:"argv,omitempty"`
+	Path   string   `json:"path,omitempty"`
+	Target string   `json:"target,omitempty"` // rename destination or symlink target
+	Mode   string   `json:"mode,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Open starts recording to path. The file is opened append-only, so
+// entries written by earlier runs are never rewritten.
+func Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	mu.Lock()
+	logFile = f
+	mu.Unlock()
+	return nil
+}
+
+// Close stops recording.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if logFile == nil {
+		return nil
+	}
+	err := logFile.Close()
+	logFile = nil
+	return err
+}
+
+// record appends e to the log, if one is open.
+func record(e Entry, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if logFile == nil {
+		return
+	}
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	data, _ := json.Marshal(e)
+	logFile.Write(append(data, '\n'))
+}
+
+// abs returns path as an absolute path for the log.
+func abs(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// Cmd is an exec.Cmd whose Run, Output and CombinedOutput are recorded
+// with their result.
+type Cmd struct {
+	*exec.Cmd
+
+	// Starter, if set, starts the process in place of exec.Cmd.Start, as
+	// package limits does to lower its priority.
+	Starter func(*exec.Cmd) error
+
+	closeAfterStart []io.Closer // see CloseAfterStart
+}
+
+// CloseAfterStart arranges for f, such as this process's copy of a pipe end
+// passed to the command in ExtraFiles, to be closed once the command has
+// started or failed to start by Run, Output or CombinedOutput.
+func (c *Cmd) CloseAfterStart(f io.Closer) {
+	c.closeAfterStart = append(c.closeAfterStart, f)
+}
+
+// direct reports whether exec.Cmd can run the command by itself: there is
+// neither a Starter nor anything to close after the start.
+func (c *Cmd) direct() bool {
+	return c.Starter == nil && len(c.closeAfterStart) == 0
+}
+
+// start starts the process with Starter if set, then closes the files
+// registered with CloseAfterStart.
+func (c *Cmd) start() error {
+	var err error
+	if c.Starter != nil {
+		err = c.Starter(c.Cmd)
+	} else {
+		err = c.Cmd.Start()
+	}
+	for _, f := range c.closeAfterStart {
+		f.Close()
+	}
+	c.closeAfterStart = nil
+	return err
+}
+
+// Command returns a Cmd like exec.Command.
+func Command(name string, arg ...string) *Cmd {
+	return &Cmd{Cmd: exec.Command(name, arg...)}
+}
+
+// CommandContext returns a Cmd like exec.CommandContext: the process is
+// killed when ctx is done, and a canceled ctx keeps it from starting.
+func CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	return &Cmd{Cmd: exec.CommandContext(ctx, name, arg...)}
+}
+
+// Run runs the command and records it.
+func (c *Cmd) Run() error {
+	err := c.run()
+	c.record(err)
+	return err
+}
+
+// run is exec.Cmd.Run, started with start unless direct.
+func (c *Cmd) run() error {
+	if c.direct() {
+		return c.Cmd.Run()
+	}
+	if err := c.start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the command, records it and returns its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.direct() {
+		out, err := c.Cmd.Output()
+		c.record(err)
+		return out, err
+	}
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var out bytes.Buffer
+	c.Stdout = &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// CombinedOutput runs the command, records it and returns its combined
+// standard output and standard error.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.direct() {
+		out, err := c.Cmd.CombinedOutput()
+		c.record(err)
+		return out, err
+	}
+	if c.Stdout != nil || c.Stderr != nil {
+		return nil, errors.New("exec: Stdout or Stderr already set")
+	}
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// wrappers run the command after their "--" in another namespace or with
+// fewer privileges: nsenter for build.network, unshare for build -offline
+// and setpriv for confined helpers.
+var wrappers = []string{"nsenter", "setpriv", "unshare"}
+
+// record logs the command, classifying mounts and chroots, also when run
+// through one of wrappers, and notes the host programs it ran. A command
+// that never started, e.g. as its program is not installed, ran none.
+func (c *Cmd) record(err error) {
+	args := c.Args
+	var programs []string
+	if c.Process != nil {
+		programs = append(programs, c.Path)
+	}
+	for slices.Contains(wrappers, filepath.Base(args[0])) {
+		i := slices.Index(args, "--")
+		if i < 0 || i+1 >= len(args) {
+			break
+		}
+		args = args[i+1:]
+		if p, err := exec.LookPath(args[0]); err == nil {
+			programs = append(programs, p)
+		}
+	}
+	op := "exec"
+	switch filepath.Base(args[0]) {
+	case "mount", "umount", "chroot":
+		op = filepath.Base(args[0])
+	}
+	mu.Lock()
+	for _, p := range programs {
+		tools[abs(p)] = true
+	}
+	mu.Unlock()
+	record(Entry{Op: op, Argv: c.Args}, err)
+}
+
+// Tools returns the host programs commands were run with since the
+// process started, whether or not a log was open, as sorted absolute
+// paths. Commands run in a chroot count as chroot.
+func Tools() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Sorted(maps.Keys(tools))
+}
+
+// WriteFile is os.WriteFile, recorded.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	err := os.WriteFile(name, data, perm)
+	record(Entry{Op: "write", Path: abs(name), Mode: fmt.Sprintf("%04o", perm)}, err)
+	return err
+}
+
+// Create is os.Create, recorded.
+func Create(name string) (*os.File, error) {
+	f, err := os.Create(name)
+	record(Entry{Op: "create", Path: abs(name)}, err)
+	return f, err
+}
+
+// OpenFile is os.OpenFile, recorded when it can modify the file.
+func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		record(Entry{Op: "write", Path: abs(name), Mode: fmt.Sprintf("%04o", perm)}, err)
+	}
+	return f, err
+}
+
+// MkdirAll is os.MkdirAll, recorded.
+func MkdirAll(path string, perm os.FileMode) error {
+	err := os.MkdirAll(path, perm)
+	record(Entry{Op: "mkdir", Path: abs(path), Mode: fmt.Sprintf("%04o", perm)}, err)
+	return err
+}
+
+// Remove is os.Remove, recorded.
+func Remove(name string) error {
+	err := os.Remove(name)
+	record(Entry{Op: "remove", Path: abs(name)}, err)
+	return err
+}
+
+// RemoveAll is os.RemoveAll, recorded.
+func RemoveAll(path string) error {
+	err := os.RemoveAll(path)
+	record(Entry{Op: "remove", Path: abs(path)}, err)
+	return err
+}
+
+// Rename is os.Rename, recorded.
+func Rename(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	record(Entry{Op: "rename", Path: abs(oldpath), Target: abs(newpath)}, err)
+	return err
+}
+
+// Chmod is os.Chmod, recorded.
+func Chmod(name string, mode os.FileMode) error {
+	err := os.Chmod(name, mode)
+	record(Entry{Op: "chmod", Path: abs(name), Mode: fmt.Sprintf("%04o", mode)}, err)
+	return err
+}
+
+// MkdirTemp is os.MkdirTemp, recorded.
+func MkdirTemp(dir, pattern string) (string, error) {
+	name, err := os.MkdirTemp(dir, pattern)
+	if err != nil {
+		name = tempPattern(dir, pattern)
+	}
+	record(Entry{Op: "mkdir", Path: abs(name), Mode: "0700"}, err)
+	return name, err
+}
+
+// CreateTemp is os.CreateTemp, recorded.
+func CreateTemp(dir, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	name := tempPattern(dir, pattern)
+	if err == nil {
+		name = f.Name()
+	}
+	record(Entry{Op: "create", Path: abs(name)}, err)
+	return f, err
+}
+
+// tempPattern names the file MkdirTemp or CreateTemp failed to create.
+func tempPattern(dir, pattern string) string {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, pattern)
+}
+
+// Chtimes is os.Chtimes, recorded.
+func Chtimes(name string, atime, mtime time.Time) error {
+	err := os.Chtimes(name, atime, mtime)
+	record(Entry{Op: "chtimes", Path: abs(name)}, err)
+	return err
+}
+
+// Symlink is os.Symlink, recorded.
+func Symlink(oldname, newname string) error {
+	err := os.Symlink(oldname, newname)
+	record(Entry{Op: "symlink", Path: abs(newname), Target: oldname}, err)
+	return err
+}
+
+// Root is an os.Root whose file writes, directory creation, removals,
+// mode changes and symlinks are recorded like the functions above. Names
+// are resolved inside the root, so neither ".." nor symlinks can take an
+// operation outside it.
+type Root struct {
+	*os.Root
+}
+
+// OpenRoot is os.OpenRoot, returning a recorded Root.
+func OpenRoot(dir string) (*Root, error) {
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Root{r}, nil
+}
+
+// path returns the host path of name for the log.
+func (r *Root) path(name string) string {
+	return abs(filepath.Join(r.Name(), name))
+}
+
+// WriteFile is os.Root.WriteFile, recorded.
+func (r *Root) WriteFile(name string, data []byte, perm os.FileMode) error {
+	err := r.Root.WriteFile(name, data, perm)
+	record(Entry{Op: "write", Path: r.path(name), Mode: fmt.Sprintf("%04o", perm)}, err)
+	return err
+}
+
+// OpenFile is os.Root.OpenFile, recorded when it can modify the file.
+func (r *Root) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := r.Root.OpenFile(name, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		record(Entry{Op: "write", Path: r.path(name), Mode: fmt.Sprintf("%04o", perm)}, err)
+	}
+	return f, err
+}
+
+// MkdirAll is os.Root.MkdirAll, recorded.
+func (r *Root) MkdirAll(name string, perm os.FileMode) error {
+	err := r.Root.MkdirAll(name, perm)
+	record(Entry{Op: "mkdir", Path: r.path(name), Mode: fmt.Sprintf("%04o", perm)}, err)
+	return err
+}
+
+// Remove is os.Root.Remove, recorded.
+func (r *Root) Remove(name string) error {
+	err := r.Root.Remove(name)
+	record(Entry{Op: "remove", Path: r.path(name)}, err)
+	return err
+}
+
+// Chmod is os.Root.Chmod, recorded.
+func (r *Root) Chmod(name string, mode os.FileMode) error {
+	err := r.Root.Chmod(name, mode)
+	record(Entry{Op: "chmod", Path: r.path(name), Mode: fmt.Sprintf("%04o", mode)}, err)
+	return err
+}
+
+// Symlink is os.Root.Symlink, recorded.
+func (r *Root) Symlink(oldname, newname string) error {
+	err := r.Root.Symlink(oldname, newname)
+	record(Entry{Op: "symlink", Path: r.path(newname), Target: oldname}, err)
+	return err
+}
@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "audit.jsonl")
+
+	// Nothing is recorded before Open.
+	if err := WriteFile(filepath.Join(dir, "before"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Open(logPath); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "etc", "hostname")
+	if err := MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(file, []byte("demo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Command("true").Run()
+	Command("false").Run()
+	Remove(filepath.Join(dir, "missing"))
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("got %d entries, want 5:\n%s", len(entries), data)
+	}
+	if e := entries[1]; e.Op != "write" || e.Path != file || e.Mode != "0644" {
+		t.Errorf("unexpected write entry: %+v", e)
+	}
+	if e := entries[2]; e.Op != "exec" || e.Argv[0] != "true" || e.Error != "" {
+		t.Errorf("unexpected exec entry: %+v", e)
+	}
+	if e := entries[3]; e.Error == "" {
+		t.Errorf("failed command should record its error: %+v", e)
+	}
+	if e := entries[4]; e.Op != "remove" || e.Error == "" {
+		t.Errorf("unexpected remove entry: %+v", e)
+	}
+}
+
+func TestTools(t *testing.T) {
+	Command("setpriv", "--no-new-privs", "--", "true").Run()
+	tools := Tools()
+	for _, name := range []string{"setpriv", "true"} {
+		p, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("%s not found", name)
+		}
+		if !slices.Contains(tools, p) {
+			t.Errorf("Tools() = %q, should contain %s", tools, p)
+		}
+	}
+}
+
+func TestCommandContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := CommandContext(ctx, "true").Run(); err == nil {
+		t.Fatal("command started after its context was canceled")
+	}
+}
+
+func TestCloseAfterStart(t *testing.T) {
+	for name, run := range map[string]func(*Cmd) error{
+		"Run":            (*Cmd).Run,
+		"Output":         func(c *Cmd) error { _, err := c.Output(); return err },
+		"CombinedOutput": func(c *Cmd) error { _, err := c.CombinedOutput(); return err },
+		"Starter": func(c *Cmd) error {
+			c.Starter = (*exec.Cmd).Start
+			return c.Run()
+		},
+		"failed start": func(c *Cmd) error {
+			c.Path = "/nonexistent"
+			c.Run()
+			return nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			cmd := Command("true")
+			cmd.ExtraFiles = []*os.File{r}
+			cmd.CloseAfterStart(r)
+			if err := run(cmd); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err == nil {
+				t.Error("the read end was left open")
+			}
+		})
+	}
+}
+
+// auditedPackages are the packages that build the image as root; every
+// file they modify must show up in the audit log.
+var auditedPackages = []string{"bootloader", "disk", "iso", "netboot", "oci", "rootfs"}
+
+// TestNoRawMutations fails when an audited package modifies the file
+// system with a function of package os instead of its recorded
+// counterpart in this package.
+func TestNoRawMutations(t *testing.T) {
+	mutating := map[string]bool{
+		"WriteFile": true, "Create": true, "OpenFile": true, "Mkdir": true, "MkdirAll": true,
+		"MkdirTemp": true, "CreateTemp": true, "Remove": true, "RemoveAll": true, "Rename": true,
+		"Chmod": true, "Chown": true, "Lchown": true, "Chtimes": true, "Symlink": true,
+		"Link": true, "Truncate": true,
+	}
+	for _, pkg := range auditedPackages {
+		files, err := filepath.Glob(filepath.Join("..", pkg, "*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, file, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				if id, ok := sel.X.(*ast.Ident); ok && id.Name == "os" && mutating[sel.Sel.Name] {
+					t.Errorf("%s: os.%s is not recorded; use audit.%[2]s", fset.Position(sel.Pos()), sel.Sel.Name)
+				}
+				return true
+			})
+		}
+	}
+}
+
+func TestToolsNotStarted(t *testing.T) {
+	missing := "distrorun-no-such-program"
+	Command(missing).Run()
+	Command("./" + missing).Run()
+	for _, p := range Tools() {
+		if filepath.Base(p) == missing {
+			t.Errorf("Tools() = %q, should not contain %s, which never ran", Tools(), p)
+		}
+	}
+}
+
+func TestWrappers(t *testing.T) {
+	for _, name := range []string{"unshare", "chroot"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := Open(logPath); err != nil {
+		t.Fatal(err)
+	}
+	// As build -offline runs commands: the chroot is recorded as one,
+	// whether or not unshare may create the namespace here.
+	Command("unshare", "--net", "--", "chroot", "/nonexistent", "true").Run()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Op != "chroot" || e.Argv[0] != "unshare" {
+		t.Errorf("entry = %+v, want a chroot run through unshare", e)
+	}
+	chroot, _ := exec.LookPath("chroot")
+	if !slices.Contains(Tools(), chroot) {
+		t.Errorf("Tools() = %q, should contain %s", Tools(), chroot)
+	}
+}
@@ -0,0 +1,99 @@
+package bootloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// bootConfigs are the boot configurations Setup and SetupGrub write,
+// relative to the staging directory.
+var bootConfigs = []string{
+	"isolinux/isolinux.cfg",
+	"boot/grub2/grub.cfg",
+}
+
+// SetCmdline replaces the kernel parameters in the boot configuration of
+// an existing staging directory, such as the files of an unpacked ISO, and
+// returns the parameters of the default entry it replaced. The parameters
+// that tell menu entries apart (the keymap= and font= of live.input,
+// distrorun.toram and the serial console of boot.serial_console) stay with
+// their entries. ISOs booting with isolinux and
+// UEFI have both configurations.
+func SetCmdline(stagingDir, cmdline string) (string, error) {
+	var old string
+	updated := false
+	for _, rel := range bootConfigs {
+		p := filepath.Join(stagingDir, rel)
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		lines := strings.Split(string(data), "\n")
+		found := false
+		for i, line := range lines {
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			fields := strings.Fields(line)
+			var params []string
+			switch {
+			case len(fields) >= 1 && fields[0] == "APPEND":
+				params = fields[1:]
+				lines[i] = indent + "APPEND " + cmdline + entryParams(params)
+			case len(fields) >= 2 && fields[0] == "linux":
+				// grubCfg appends selinux=0, which stays whatever the
+				// command line.
+				params = fields[2:]
+				if n := len(params); n > 0 && params[n-1] == "selinux=0" {
+					params = params[:n-1]
+				}
+				lines[i] = indent + "linux  " + fields[1] + " " + cmdline + entryParams(params) + " selinux=0"
+			default:
+				continue
+			}
+			if !found && !updated {
+				old = strings.Join(slices.DeleteFunc(params, isEntryParam), " ")
+			}
+			found = true
+		}
+		if !found {
+			return "", fmt.Errorf("%s has no kernel command line", rel)
+		}
+		if err := audit.WriteFile(p, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+			return "", fmt.Errorf("writing %s: %w", rel, err)
+		}
+		updated = true
+	}
+	if !updated {
+		return "", fmt.Errorf("no isolinux.cfg or grub.cfg found: not an ISO built by distrorun")
+	}
+	return old, nil
+}
+
+// isEntryParam reports whether a kernel parameter belongs to one boot menu
+// entry rather than to the command line of every entry.
+func isEntryParam(p string) bool {
+	return strings.HasPrefix(p, "keymap=") || strings.HasPrefix(p, "font=") || p == "distrorun.toram" || p == "console=ttyS0,115200"
+}
+
+// entryParams returns the entry parameters among params, each preceded by
+// a space.
+func entryParams(params []string) string {
+	var s string
+	for _, p := range params {
+		if isEntryParam(p) {
+			s += " " + p
+		}
+	}
+	return s
+}
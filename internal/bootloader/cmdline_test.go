@@ -0,0 +1,70 @@
+package bootloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetCmdline(t *testing.T) {
+	m := Menu{Entries: []Entry{
+		{Label: "DistroRun Live (us)", Cmdline: "quiet distrorun.persist keymap=us"},
+		{Label: "DistroRun Live (de)", Cmdline: "quiet distrorun.persist keymap=de font=lat9w-16"},
+		{Label: "DistroRun Live (us, copy to RAM)", Cmdline: "quiet distrorun.persist keymap=us distrorun.toram"},
+		{Label: "DistroRun Live (us, serial console)", Cmdline: "quiet distrorun.persist keymap=us console=ttyS0,115200", Serial: true},
+	}}
+	dir := t.TempDir()
+	isolinux, err := isolinuxCfg("lts", m, true, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grub, err := grubCfg("lts", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, data := range map[string]string{"isolinux/isolinux.cfg": isolinux, "boot/grub2/grub.cfg": grub} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(dir, rel), []byte(data), 0644)
+	}
+
+	old, err := SetCmdline(dir, "console=tty0 nomodeset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != "quiet distrorun.persist" {
+		t.Errorf("old command line = %q, want %q", old, "quiet distrorun.persist")
+	}
+	for rel, want := range map[string][]string{
+		"isolinux/isolinux.cfg": {
+			"    APPEND console=tty0 nomodeset keymap=us",
+			"    APPEND console=tty0 nomodeset keymap=de font=lat9w-16",
+			"    APPEND console=tty0 nomodeset keymap=us distrorun.toram",
+			"    APPEND console=tty0 nomodeset keymap=us console=ttyS0,115200",
+		},
+		"boot/grub2/grub.cfg": {
+			"    linux  /boot/vmlinuz-lts console=tty0 nomodeset keymap=us selinux=0",
+			"    linux  /boot/vmlinuz-lts console=tty0 nomodeset keymap=de font=lat9w-16 selinux=0",
+			"    linux  /boot/vmlinuz-lts console=tty0 nomodeset keymap=us distrorun.toram selinux=0",
+			"    linux  /boot/vmlinuz-lts console=tty0 nomodeset keymap=us console=ttyS0,115200 selinux=0",
+		},
+	} {
+		data, _ := os.ReadFile(filepath.Join(dir, rel))
+		for _, line := range want {
+			if !strings.Contains(string(data), line+"\n") {
+				t.Errorf("%s lacks %q:\n%s", rel, line, data)
+			}
+		}
+		if strings.Contains(string(data), "quiet") {
+			t.Errorf("%s keeps the old command line:\n%s", rel, data)
+		}
+	}
+
+	if _, err := SetCmdline(t.TempDir(), "quiet"); err == nil || !strings.Contains(err.Error(), "not an ISO built by distrorun") {
+		t.Errorf("SetCmdline without boot configurations = %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "isolinux", "isolinux.cfg"), []byte("DEFAULT linux\n"), 0644)
+	if _, err := SetCmdline(dir, "quiet"); err == nil || !strings.Contains(err.Error(), "isolinux/isolinux.cfg has no kernel command line") {
+		t.Errorf("SetCmdline without APPEND = %v", err)
+	}
+}
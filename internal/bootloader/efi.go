@@ -0,0 +1,118 @@
+package bootloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// EFIImage is the El Torito EFI system partition image, relative to the
+// staging directory.
+const EFIImage = "boot/efiboot.img"
+
+// efiModuleDir holds the host's GRUB modules for x86_64 UEFI.
+const efiModuleDir = "/usr/lib/grub/x86_64-efi"
+
+// efiModules are built into the GRUB EFI image, which loads no modules
+// from the ISO.
+var efiModules = []string{
+	"part_gpt", "part_msdos", "fat", "iso9660",
+	"linux", "normal", "configfile", "search", "search_fs_file",
+	"echo", "test", "gzio", "all_video", "efi_gop",
+	"serial", "terminal",
+}
+
+// efiEarlyConfig makes the GRUB EFI image, which starts on the EFI system
+// partition, find the ISO by its squashfs and load its grub.cfg.
+const efiEarlyConfig = `search --no-floppy --file --set=root /rootfs.squashfs
+set prefix=($root)/boot/grub2
+configfile $prefix/grub.cfg
+`
+
+// CheckEFIDeps verifies the host tools UEFI boot images are made with.
+func CheckEFIDeps() error {
+	if findGrub2Mkimage() == "" {
+		return fmt.Errorf("required tool not found: grub2-mkimage or grub-mkimage, for boot.uefi")
+	}
+	if _, err := os.Stat(efiModuleDir); err != nil {
+		return fmt.Errorf("GRUB x86_64-efi modules not found in %s, for boot.uefi (install grub-efi-amd64-bin or grub2-efi-x64-modules)", efiModuleDir)
+	}
+	for _, tool := range []string{"mkfs.vfat", "mmd", "mcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("required tool not found: %s, for boot.uefi (install dosfstools and mtools)", tool)
+		}
+	}
+	return nil
+}
+
+// SetupEFI adds UEFI boot to a staging directory prepared by Setup or
+// SetupGrub: a GRUB EFI image, as EFI/BOOT/BOOTX64.EFI on the FAT image
+// EFIImage, that boots the entries of boot/grub2/grub.cfg. SetupGrub has
+// written that file already; after Setup it is written here with menu m,
+// booting isolinux's kernel and initramfs.
+func SetupEFI(ctx context.Context, stagingDir string, kernelFiles KernelFiles, m Menu) error {
+	grubCfgPath := filepath.Join(stagingDir, "boot", "grub2", "grub.cfg")
+	if _, err := os.Stat(grubCfgPath); os.IsNotExist(err) {
+		if err := audit.MkdirAll(filepath.Dir(grubCfgPath), 0755); err != nil {
+			return fmt.Errorf("creating grub dir: %w", err)
+		}
+		cfg, err := grubMenu("/boot/vmlinuz-"+kernelFiles.Version, "/boot/initramfs-"+kernelFiles.Version, m)
+		if err != nil {
+			return err
+		}
+		if err := audit.WriteFile(grubCfgPath, []byte(cfg), 0644); err != nil {
+			return fmt.Errorf("writing grub.cfg: %w", err)
+		}
+	}
+
+	workDir, err := audit.MkdirTemp("", "distrorun-efi-")
+	if err != nil {
+		return err
+	}
+	defer audit.RemoveAll(workDir)
+	early := filepath.Join(workDir, "early.cfg")
+	if err := audit.WriteFile(early, []byte(efiEarlyConfig), 0644); err != nil {
+		return err
+	}
+	efiBin := filepath.Join(workDir, "BOOTX64.EFI")
+	args := append([]string{
+		"-O", "x86_64-efi",
+		"-d", efiModuleDir,
+		"-o", efiBin,
+		"-p", "/boot/grub2",
+		"-c", early,
+	}, efiModules...)
+	cmd := audit.CommandContext(ctx, findGrub2Mkimage(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("grub2-mkimage (x86_64-efi): %w", err)
+	}
+	for _, m := range efiModules {
+		hostFiles = append(hostFiles, filepath.Join(efiModuleDir, m+".mod"))
+	}
+
+	// The FAT image holds the EFI binary with a MiB to spare.
+	info, err := os.Stat(efiBin)
+	if err != nil {
+		return err
+	}
+	img := filepath.Join(stagingDir, EFIImage)
+	for _, c := range [][]string{
+		{"mkfs.vfat", "-C", img, fmt.Sprint(info.Size()/1024 + 1024)},
+		{"mmd", "-i", img, "::/EFI", "::/EFI/BOOT"},
+		{"mcopy", "-i", img, efiBin, "::/EFI/BOOT/BOOTX64.EFI"},
+	} {
+		cmd := audit.CommandContext(ctx, c[0], c[1:]...)
+		cmd.Stdout = nil
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", c[0], err)
+		}
+	}
+	return nil
+}
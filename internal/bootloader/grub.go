@@ -1,11 +1,16 @@
-// Package bootloader — GRUB2 BIOS bootloader setup for Fedora ISOs.
+// Package bootloader — GRUB2 BIOS bootloader setup for Fedora and Debian ISOs.
 package bootloader
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/templates"
 )
 
 // grub2MkimageCandidates — command name varies by host distro.
@@ -13,39 +18,42 @@ var grub2MkimageCandidates = []string{"grub2-mkimage", "grub-mkimage"}
 
 // SetupGrub creates the GRUB2 BIOS bootloader staging directory.
 // It copies the kernel and initramfs from the rootfs, generates the El Torito
-// boot image with grub2-mkimage, and writes grub.cfg.
-func SetupGrub(rootfsPath, stagingDir string, kernelFiles KernelFiles) error {
+// boot image with grub2-mkimage, and writes grub.cfg with menu m.
+func SetupGrub(ctx context.Context, rootfsPath, stagingDir string, kernelFiles KernelFiles, m Menu) error {
 	grubDir := filepath.Join(stagingDir, "boot", "grub2", "i386-pc")
 	bootDir := filepath.Join(stagingDir, "boot")
 
-	if err := os.MkdirAll(grubDir, 0755); err != nil {
+	if err := audit.MkdirAll(grubDir, 0755); err != nil {
 		return fmt.Errorf("creating grub dir: %w", err)
 	}
-	if err := os.MkdirAll(bootDir, 0755); err != nil {
+	if err := audit.MkdirAll(bootDir, 0755); err != nil {
 		return fmt.Errorf("creating boot dir: %w", err)
 	}
 
 	// Copy kernel
 	vmlinuzDst := filepath.Join(bootDir, "vmlinuz-"+kernelFiles.Version)
-	if err := copyFile(kernelFiles.Vmlinuz, vmlinuzDst); err != nil {
+	if err := fsutil.CopyFile(kernelFiles.Vmlinuz, vmlinuzDst); err != nil {
 		return fmt.Errorf("copying vmlinuz: %w", err)
 	}
 
 	// Copy initramfs
 	initramfsDst := filepath.Join(bootDir, "initramfs-"+kernelFiles.Version+".img")
-	if err := copyFile(kernelFiles.Initramfs, initramfsDst); err != nil {
+	if err := fsutil.CopyFile(kernelFiles.Initramfs, initramfsDst); err != nil {
 		return fmt.Errorf("copying initramfs: %w", err)
 	}
 
 	// Generate El Torito boot image
 	elToritoPath := filepath.Join(grubDir, "eltorito.img")
-	if err := grub2Mkimage(elToritoPath); err != nil {
+	if err := grub2Mkimage(ctx, elToritoPath); err != nil {
 		return fmt.Errorf("grub2-mkimage: %w", err)
 	}
 
 	// Write grub.cfg
-	cfg := grubCfg(kernelFiles.Version)
-	if err := os.WriteFile(filepath.Join(stagingDir, "boot", "grub2", "grub.cfg"), []byte(cfg), 0644); err != nil {
+	cfg, err := grubCfg(kernelFiles.Version, m)
+	if err != nil {
+		return err
+	}
+	if err := audit.WriteFile(filepath.Join(stagingDir, "boot", "grub2", "grub.cfg"), []byte(cfg), 0644); err != nil {
 		return fmt.Errorf("writing grub.cfg: %w", err)
 	}
 
@@ -54,13 +62,13 @@ func SetupGrub(rootfsPath, stagingDir string, kernelFiles KernelFiles) error {
 
 // KernelFiles holds the kernel version and absolute paths for vmlinuz and initramfs.
 type KernelFiles struct {
-	Version   string
+	Version   string // kernel release; on Alpine the flavor, e.g. "lts"
 	Vmlinuz   string
 	Initramfs string
 }
 
 // grub2Mkimage runs grub2-mkimage (or grub-mkimage) to produce the El Torito image.
-func grub2Mkimage(outputPath string) error {
+func grub2Mkimage(ctx context.Context, outputPath string) error {
 	bin := findGrub2Mkimage()
 	if bin == "" {
 		return fmt.Errorf("grub2-mkimage not found (install grub2-tools or grub-common)")
@@ -70,6 +78,7 @@ func grub2Mkimage(outputPath string) error {
 		"biosdisk", "part_msdos", "part_gpt",
 		"iso9660", "all_video",
 		"linux", "normal", "echo", "search", "test",
+		"serial", "terminal",
 	}
 
 	args := []string{
@@ -79,22 +88,35 @@ func grub2Mkimage(outputPath string) error {
 	}
 	args = append(args, modules...)
 
-	cmd := exec.Command(bin, args...)
+	cmd := audit.CommandContext(ctx, bin, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-// grubCfg returns the grub.cfg content for live CD boot.
-func grubCfg(kver string) string {
-	return fmt.Sprintf(`set timeout=5
-set default=0
+// grubCfgTemplate is the built-in grub.cfg. SELinux stays disabled
+// whatever the command line: the live rootfs carries no labels. With a
+// serial console entry the menu is on ttyS0 as well as the screen.
+const grubCfgTemplate = `{{if .Serial}}serial --unit=0 --speed=115200
+terminal_input console serial
+terminal_output console serial
+{{end}}set timeout={{or .Timeout 5}}
+set default={{.Default.Index}}
+{{range .Entries}}
+menuentry "{{.Label}}" {
+    linux  {{$.Kernel}} {{.Cmdline}} selinux=0
+    initrd {{$.Initrd}}
+}
+{{end}}`
 
-menuentry "DistroRun Live" {
-    linux  /boot/vmlinuz-%s quiet selinux=0
-    initrd /boot/initramfs-%s.img
+// grubCfg returns the grub.cfg content for live CD boot.
+func grubCfg(kver string, m Menu) (string, error) {
+	return grubMenu("/boot/vmlinuz-"+kver, "/boot/initramfs-"+kver+".img", m)
 }
-`, kver, kver)
+
+// grubMenu returns a grub.cfg booting kernel and initrd with menu m.
+func grubMenu(kernel, initrd string, m Menu) (string, error) {
+	return templates.Render(templates.Grub, grubCfgTemplate, newMenuData(kernel, initrd, m, true))
 }
 
 // findGrub2Mkimage searches PATH for the grub2-mkimage binary.
@@ -0,0 +1,50 @@
+package bootloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGrubCfg(t *testing.T) {
+	live := Entry{Label: "DistroRun Live", Cmdline: "quiet"}
+	safe := Entry{Label: "Safe graphics", Cmdline: "quiet nomodeset"}
+	for name, tc := range map[string]struct {
+		m       Menu
+		want    []string // lines of grub.cfg
+		wantNot []string
+	}{
+		"defaults": {
+			m: Menu{Entries: []Entry{live}},
+			want: []string{"set timeout=5", "set default=0", `menuentry "DistroRun Live" {`,
+				"    linux  /boot/vmlinuz-6.9.1 quiet selinux=0", "    initrd /boot/initramfs-6.9.1.img"},
+			wantNot: []string{"serial --unit=0 --speed=115200"},
+		},
+		"default and timeout": {
+			m:    Menu{Entries: []Entry{live, safe}, Default: 1, Timeout: 30},
+			want: []string{"set timeout=30", "set default=1", `menuentry "Safe graphics" {`, "    linux  /boot/vmlinuz-6.9.1 quiet nomodeset selinux=0"},
+		},
+		"serial console": {
+			m:    Menu{Entries: []Entry{live, {Label: "Serial", Cmdline: "console=ttyS0,115200", Serial: true}}},
+			want: []string{"serial --unit=0 --speed=115200", "terminal_input console serial", "terminal_output console serial"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := grubCfg("6.9.1", tc.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(cfg, "\n")
+			for _, want := range tc.want {
+				if !slices.Contains(lines, want) {
+					t.Errorf("grub.cfg lacks %q:\n%s", want, cfg)
+				}
+			}
+			for _, unwanted := range tc.wantNot {
+				if slices.Contains(lines, unwanted) {
+					t.Errorf("grub.cfg has %q:\n%s", unwanted, cfg)
+				}
+			}
+		})
+	}
+}
@@ -3,9 +3,14 @@ package bootloader
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/templates"
+	"github.com/talfaza/distrorun/internal/ui"
 )
 
 // syslinux file search paths (varies by distro)
@@ -16,6 +21,12 @@ var syslinuxSearchPaths = []string{
 	"/usr/lib/ISOLINUX",
 }
 
+// extraSearchPaths are searched before syslinuxSearchPaths; see AddSearchPath.
+var extraSearchPaths []string
+
+// hostFiles are the files of the host put into images so far; see HostFiles.
+var hostFiles []string
+
 // required syslinux/isolinux files
 var requiredFiles = []string{
 	"isolinux.bin",
@@ -29,27 +40,157 @@ var optionalFiles = []string{
 	"menu.c32",
 }
 
-// isolinuxCfgTemplate is the boot configuration.
-const isolinuxCfgTemplate = `DEFAULT linux
-PROMPT 0
-TIMEOUT 30
+// vesamenuFile shows branded menus; see Menu.Splash.
+const vesamenuFile = "vesamenu.c32"
+
+// Entry is a boot menu entry. Menu.Default picks the one booted by default.
+type Entry struct {
+	Label   string // menu label, e.g. "DistroRun Live"
+	Cmdline string // kernel command line
+	Serial  bool   // boots on the serial console, so the menu is shown there too
+}
+
+// Menu is a boot menu: its entries and how they are offered.
+type Menu struct {
+	Entries []Entry
+	Default int    // index of the entry booted by default
+	Title   string // isolinux only: shown above the entries
+	Timeout int    // seconds before the default entry boots; 0 for the bootloader's default
+
+	// Splash is the host path of the menu background, and Colors the menu
+	// colors, isolinux only. Either one shows the menu in vesamenu.c32.
+	Splash string
+	Colors Colors
+}
+
+// Colors are the colors of the isolinux menu as "#rrggbb"; empty ones keep
+// the default.
+type Colors struct {
+	Title              string
+	Text               string
+	Selected           string
+	SelectedBackground string
+}
+
+// branded reports whether m shows in vesamenu.c32.
+func (m Menu) branded() bool {
+	return m.Splash != "" || m.Colors != Colors{}
+}
+
+// menuEntry is an Entry as the boot menu templates see it, with the
+// isolinux label it boots by: "linux", "linux2" and so on, and its index
+// for GRUB.
+type menuEntry struct {
+	Name  string
+	Index int
+	Entry
+}
+
+// menuData is what the boot menu templates are executed with.
+type menuData struct {
+	Kernel  string
+	Initrd  string
+	Entries []menuEntry
+	Default menuEntry
+	Title   string
+	Timeout int  // seconds; 0 for the template's default
+	Menu    bool // isolinux only: menu.c32 was found
+	Serial  bool // an entry boots on the serial console
 
-LABEL linux
-    KERNEL /boot/vmlinuz-lts
-    INITRD /boot/initramfs-lts
-    APPEND quiet
-`
+	// isolinux only: the menu is shown in vesamenu.c32, with the background
+	// Splash, an ISO path, and the MENU COLOR lines Colors.
+	Vesa   bool
+	Splash string
+	Colors []string
+}
+
+func newMenuData(kernel, initrd string, m Menu, menu bool) menuData {
+	d := menuData{Kernel: kernel, Initrd: initrd, Title: m.Title, Timeout: m.Timeout, Menu: menu}
+	for i, e := range m.Entries {
+		name := "linux"
+		if i > 0 {
+			name = fmt.Sprintf("linux%d", i+1)
+		}
+		d.Entries = append(d.Entries, menuEntry{Name: name, Index: i, Entry: e})
+		d.Serial = d.Serial || e.Serial
+	}
+	if m.Default < len(d.Entries) {
+		d.Default = d.Entries[m.Default]
+	}
+	return d
+}
+
+// isolinuxCfgTemplate is the built-in isolinux.cfg. A single entry boots
+// without a prompt; several are offered in menu.c32 when it was found, and
+// at the boot: prompt otherwise. A branded menu is always shown, in
+// vesamenu.c32. With a serial console entry the menu is on ttyS0 as well as
+// the screen. TIMEOUT counts tenths of a second.
+const isolinuxCfgTemplate = `{{if .Serial}}SERIAL 0 115200
+{{end}}DEFAULT {{.Default.Name}}
+{{if .Vesa}}UI vesamenu.c32{{else if eq (len .Entries) 1}}PROMPT 0{{else if .Menu}}UI menu.c32{{else}}PROMPT 1{{end}}
+{{if .Title}}MENU TITLE {{.Title}}
+{{end}}{{if .Splash}}MENU BACKGROUND {{.Splash}}
+{{end}}{{range .Colors}}MENU COLOR {{.}}
+{{end}}TIMEOUT {{or .Timeout 3}}0
+{{range .Entries}}
+LABEL {{.Name}}
+{{if or $.Vesa (gt (len $.Entries) 1)}}    MENU LABEL {{.Label}}
+{{end}}    KERNEL {{$.Kernel}}
+    INITRD {{$.Initrd}}
+    APPEND {{.Cmdline}}
+{{end}}`
+
+// isolinuxCfg returns the boot configuration booting the kernel and
+// initramfs of flavor with menu m. With vesa, m is shown in vesamenu.c32
+// with its background at the ISO path splash, if any.
+func isolinuxCfg(flavor string, m Menu, menu, vesa bool, splash string) (string, error) {
+	d := newMenuData("/boot/vmlinuz-"+flavor, "/boot/initramfs-"+flavor, m, menu)
+	if vesa {
+		d.Vesa, d.Splash = true, splash
+		for _, c := range []struct{ area, fg, bg string }{
+			{"title", m.Colors.Title, ""},
+			{"unsel", m.Colors.Text, ""},
+			{"sel", m.Colors.Selected, m.Colors.SelectedBackground},
+		} {
+			if c.fg != "" || c.bg != "" {
+				d.Colors = append(d.Colors, fmt.Sprintf("%s * %s %s *", c.area, argb(c.fg), argb(c.bg)))
+			}
+		}
+	}
+	return templates.Render(templates.Isolinux, isolinuxCfgTemplate, d)
+}
+
+// argb returns the "#rrggbb" color c as vesamenu.c32 takes it, opaque, or
+// "*" to keep the default for an empty one.
+func argb(c string) string {
+	if c == "" {
+		return "*"
+	}
+	return "#ff" + strings.TrimPrefix(c, "#")
+}
+
+// Templates returns the boot menu templates in use, built-in or
+// overridden, by name. Lock files record their checksums, so a change to
+// any of them is noticed like a package update.
+func Templates() map[string]string {
+	return map[string]string{
+		templates.Isolinux: templates.Text(templates.Isolinux, isolinuxCfgTemplate),
+		templates.Grub:     templates.Text(templates.Grub, grubCfgTemplate),
+		"efi-early.cfg":    efiEarlyConfig,
+	}
+}
 
 // Setup creates the bootloader staging directory with all required files.
-// It copies kernel, initramfs, isolinux binaries, and writes isolinux.cfg.
-func Setup(rootfsPath, stagingDir string) error {
+// It copies kernel, initramfs, isolinux binaries, and writes isolinux.cfg
+// with menu m.
+func Setup(rootfsPath, stagingDir string, kernelFiles KernelFiles, m Menu) error {
 	isolinuxDir := filepath.Join(stagingDir, "isolinux")
 	bootDir := filepath.Join(stagingDir, "boot")
 
-	if err := os.MkdirAll(isolinuxDir, 0755); err != nil {
+	if err := audit.MkdirAll(isolinuxDir, 0755); err != nil {
 		return fmt.Errorf("creating isolinux dir: %w", err)
 	}
-	if err := os.MkdirAll(bootDir, 0755); err != nil {
+	if err := audit.MkdirAll(bootDir, 0755); err != nil {
 		return fmt.Errorf("creating boot dir: %w", err)
 	}
 
@@ -59,53 +200,77 @@ func Setup(rootfsPath, stagingDir string) error {
 		if src == "" {
 			return fmt.Errorf("required syslinux file not found: %s (searched: %v)", name, syslinuxSearchPaths)
 		}
-		if err := copyFile(src, filepath.Join(isolinuxDir, name)); err != nil {
+		if err := fsutil.CopyFile(src, filepath.Join(isolinuxDir, name)); err != nil {
 			return fmt.Errorf("copying %s: %w", name, err)
 		}
+		hostFiles = append(hostFiles, src)
 	}
 	// Copy optional syslinux files (non-fatal if missing)
+	menu := true
 	for _, name := range optionalFiles {
 		src := findFile(name)
-		if src != "" {
-			copyFile(src, filepath.Join(isolinuxDir, name))
+		if src == "" || fsutil.CopyFile(src, filepath.Join(isolinuxDir, name)) != nil {
+			menu = false
+			continue
 		}
+		hostFiles = append(hostFiles, src)
 	}
-
-	// Copy kernel and initramfs from rootfs /boot/
-	kernelFiles := map[string]string{
-		"vmlinuz-lts":   "vmlinuz-lts",
-		"initramfs-lts": "initramfs-lts",
-	}
-
-	rootfsBoot := filepath.Join(rootfsPath, "boot")
-	for src, dst := range kernelFiles {
-		srcPath := filepath.Join(rootfsBoot, src)
-		dstPath := filepath.Join(bootDir, dst)
-
-		// Try to find the actual file (might have a version suffix)
-		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-			// Look for files matching the pattern
-			matches, _ := filepath.Glob(filepath.Join(rootfsBoot, src+"*"))
-			if len(matches) == 0 {
-				return fmt.Errorf("kernel file not found: %s in %s", src, rootfsBoot)
+	if !menu && len(m.Entries) > 1 {
+		ui.Degrade("boot menu", "menu.c32 or its libraries not found (install syslinux): the entries are offered at the boot: prompt by label")
+	}
+	// A branded menu needs vesamenu.c32 and the libraries of menu.c32.
+	vesa, splash := false, ""
+	if m.branded() {
+		if src := findFile(vesamenuFile); src == "" || !menu {
+			ui.Degrade("boot menu branding", "vesamenu.c32 or its libraries not found (install syslinux): the menu keeps the default look")
+		} else {
+			if err := fsutil.CopyFile(src, filepath.Join(isolinuxDir, "vesamenu.c32")); err != nil {
+				return fmt.Errorf("copying vesamenu.c32: %w", err)
 			}
-			srcPath = matches[0]
+			hostFiles = append(hostFiles, src)
+			vesa = true
 		}
-
-		if err := copyFile(srcPath, dstPath); err != nil {
-			return fmt.Errorf("copying kernel file %s: %w", src, err)
+		if vesa && m.Splash != "" {
+			name := "splash" + strings.ToLower(filepath.Ext(m.Splash))
+			if err := fsutil.CopyFile(m.Splash, filepath.Join(isolinuxDir, name)); err != nil {
+				return fmt.Errorf("copying splash: %w", err)
+			}
+			splash = "/isolinux/" + name
 		}
 	}
+	// iso.Build puts the isohybrid MBR in front of the image.
+	if p := IsohdpfxPath(); p != "" {
+		hostFiles = append(hostFiles, p)
+	}
+
+	// Copy kernel and initramfs from rootfs /boot/
+	if err := fsutil.CopyFile(kernelFiles.Vmlinuz, filepath.Join(bootDir, "vmlinuz-"+kernelFiles.Version)); err != nil {
+		return fmt.Errorf("copying vmlinuz: %w", err)
+	}
+	if err := fsutil.CopyFile(kernelFiles.Initramfs, filepath.Join(bootDir, "initramfs-"+kernelFiles.Version)); err != nil {
+		return fmt.Errorf("copying initramfs: %w", err)
+	}
 
 	// Write isolinux.cfg
 	cfgPath := filepath.Join(isolinuxDir, "isolinux.cfg")
-	if err := os.WriteFile(cfgPath, []byte(isolinuxCfgTemplate), 0644); err != nil {
+	cfg, err := isolinuxCfg(kernelFiles.Version, m, menu, vesa, splash)
+	if err != nil {
+		return err
+	}
+	if err := audit.WriteFile(cfgPath, []byte(cfg), 0644); err != nil {
 		return fmt.Errorf("writing isolinux.cfg: %w", err)
 	}
 
 	return nil
 }
 
+// HostFiles returns the files of the host that Setup and SetupEFI put into
+// images: the syslinux files and the GRUB EFI modules. Which ones a host
+// has can differ between build machines, unlike the rootfs.
+func HostFiles() []string {
+	return hostFiles
+}
+
 // IsohdpfxPath returns the path to isohdpfx.bin for isohybrid MBR.
 func IsohdpfxPath() string {
 	paths := []string{
@@ -114,6 +279,9 @@ func IsohdpfxPath() string {
 		"/usr/share/syslinux/isohdpfx.bin",
 		"/usr/lib/ISOLINUX/isohdpfx.bin",
 	}
+	for i := len(extraSearchPaths) - 1; i >= 0; i-- {
+		paths = append([]string{filepath.Join(extraSearchPaths[i], "isohdpfx.bin")}, paths...)
+	}
 	for _, p := range paths {
 		if _, err := os.Stat(p); err == nil {
 			return p
@@ -122,9 +290,48 @@ func IsohdpfxPath() string {
 	return ""
 }
 
+// AddSearchPath makes dir the first place syslinux files are looked up,
+// so builds can use assets shipped in a bundle instead of the host's.
+func AddSearchPath(dir string) {
+	extraSearchPaths = append(extraSearchPaths, dir)
+}
+
+// SyslinuxAssets returns the host paths of every syslinux file an ISO build
+// may use, keyed by file name. Missing optional files are omitted.
+func SyslinuxAssets() (map[string]string, error) {
+	assets := make(map[string]string)
+	for _, name := range requiredFiles {
+		src := findFile(name)
+		if src == "" {
+			return nil, fmt.Errorf("required syslinux file not found: %s (searched: %v)", name, syslinuxSearchPaths)
+		}
+		assets[name] = src
+	}
+	for _, name := range append(optionalFiles, vesamenuFile) {
+		if src := findFile(name); src != "" {
+			assets[name] = src
+		}
+	}
+	if p := IsohdpfxPath(); p != "" {
+		assets["isohdpfx.bin"] = p
+	}
+	return assets, nil
+}
+
+// Available reports whether every syslinux file an ISO build needs,
+// including isohdpfx.bin, is found on the host or in an added search path.
+func Available() bool {
+	for _, name := range requiredFiles {
+		if findFile(name) == "" {
+			return false
+		}
+	}
+	return IsohdpfxPath() != ""
+}
+
 // findFile searches for a syslinux file in known paths.
 func findFile(name string) string {
-	for _, dir := range syslinuxSearchPaths {
+	for _, dir := range append(append([]string{}, extraSearchPaths...), syslinuxSearchPaths...) {
 		p := filepath.Join(dir, name)
 		if _, err := os.Stat(p); err == nil {
 			return p
@@ -132,23 +339,3 @@ func findFile(name string) string {
 	}
 	return ""
 }
-
-// copyFile copies src to dst.
-func copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, in); err != nil {
-		return err
-	}
-	return out.Close()
-}
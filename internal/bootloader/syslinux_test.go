@@ -0,0 +1,69 @@
+package bootloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIsolinuxCfg(t *testing.T) {
+	live := Entry{Label: "DistroRun Live", Cmdline: "quiet"}
+	toram := Entry{Label: "DistroRun Live (copy to RAM)", Cmdline: "quiet distrorun.toram"}
+	serial := Entry{Label: "DistroRun Live (serial console)", Cmdline: "quiet console=ttyS0,115200", Serial: true}
+	for name, tc := range map[string]struct {
+		m       Menu
+		menu    bool
+		vesa    bool
+		want    []string // lines of isolinux.cfg
+		wantNot []string
+	}{
+		"single entry": {
+			m:       Menu{Entries: []Entry{live}},
+			menu:    true,
+			want:    []string{"DEFAULT linux", "PROMPT 0", "TIMEOUT 30", "LABEL linux", "    KERNEL /boot/vmlinuz-lts", "    INITRD /boot/initramfs-lts", "    APPEND quiet"},
+			wantNot: []string{"UI menu.c32", "MENU LABEL DistroRun Live", "SERIAL 0 115200"},
+		},
+		"menu with default": {
+			m:    Menu{Entries: []Entry{live, toram}, Default: 1, Title: "Example OS", Timeout: 10},
+			menu: true,
+			want: []string{"DEFAULT linux2", "UI menu.c32", "MENU TITLE Example OS", "TIMEOUT 100",
+				"LABEL linux", "    MENU LABEL DistroRun Live", "LABEL linux2", "    MENU LABEL DistroRun Live (copy to RAM)", "    APPEND quiet distrorun.toram"},
+		},
+		"no menu.c32": {
+			m:       Menu{Entries: []Entry{live, toram}},
+			want:    []string{"DEFAULT linux", "PROMPT 1"},
+			wantNot: []string{"UI menu.c32"},
+		},
+		"serial console": {
+			m:    Menu{Entries: []Entry{live, serial}},
+			menu: true,
+			want: []string{"SERIAL 0 115200", "    APPEND quiet console=ttyS0,115200"},
+		},
+		"branded": {
+			m:    Menu{Entries: []Entry{live}, Colors: Colors{Title: "#ffffff", Selected: "#000000", SelectedBackground: "#ff8000"}},
+			menu: true,
+			vesa: true,
+			want: []string{"UI vesamenu.c32", "MENU BACKGROUND /isolinux/splash.png", "MENU COLOR title * #ffffffff * *",
+				"MENU COLOR sel * #ff000000 #ffff8000 *", "    MENU LABEL DistroRun Live"},
+			wantNot: []string{"PROMPT 0", "MENU COLOR unsel"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := isolinuxCfg("lts", tc.m, tc.menu, tc.vesa, "/isolinux/splash.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(cfg, "\n")
+			for _, want := range tc.want {
+				if !slices.Contains(lines, want) {
+					t.Errorf("isolinux.cfg lacks %q:\n%s", want, cfg)
+				}
+			}
+			for _, unwanted := range tc.wantNot {
+				if slices.Contains(lines, unwanted) {
+					t.Errorf("isolinux.cfg has %q:\n%s", unwanted, cfg)
+				}
+			}
+		})
+	}
+}
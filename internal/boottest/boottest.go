@@ -0,0 +1,196 @@
+// Package boottest boots a built ISO headlessly under QEMU and checks that it
+// reaches a login prompt (or a custom marker) on the serial console.
+package boottest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// DefaultMarker is the serial console output that marks a successful boot.
+const DefaultMarker = "login:"
+
+// DefaultTimeout is how long a boot may take before the test fails.
+const DefaultTimeout = 3 * time.Minute
+
+// failureMarkers end the test early: the boot cannot succeed after them.
+var failureMarkers = []string{
+	"Kernel panic",
+	"Dropping to emergency shell",
+}
+
+// Options controls a boot test.
+type Options struct {
+	RAM     string        // guest memory in MB
+	Timeout time.Duration // 0 means DefaultTimeout
+	Marker  string        // "" means DefaultMarker
+	LogPath string        // serial console log; "" discards it
+
+	// PersistDisk is a qcow2 disk attached to the guest, booted with
+	// distrorun.persist so the live init keeps changes on it; "" for none.
+	PersistDisk string
+}
+
+// Run boots isoPath and waits for the marker on the serial console. The
+// ISO's kernel and initramfs are booted directly so "console=ttyS0" can be
+// added to the command line; the live init then starts a getty on it.
+func Run(isoPath string, opts Options) error {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Marker == "" {
+		opts.Marker = DefaultMarker
+	}
+	if opts.RAM == "" {
+		opts.RAM = "512"
+	}
+
+	qemuBin, err := exec.LookPath("qemu-system-x86_64")
+	if err != nil {
+		return fmt.Errorf("qemu-system-x86_64 not found (install qemu-system-x86)")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "distrorun-boottest-")
+	if err != nil {
+		return fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	kernel, initrd, err := extractBootFiles(isoPath, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	cmdline := "console=tty0 console=ttyS0,115200 selinux=0"
+	if opts.PersistDisk != "" {
+		cmdline += " distrorun.persist"
+	}
+	args := []string{
+		"-machine", "accel=kvm:tcg",
+		"-m", opts.RAM,
+		"-cdrom", isoPath,
+		"-kernel", kernel,
+		"-initrd", initrd,
+		"-append", cmdline,
+		"-display", "none",
+		"-serial", "stdio",
+		"-monitor", "none",
+		"-no-reboot",
+	}
+	if opts.PersistDisk != "" {
+		args = append(args, "-drive", "file="+opts.PersistDisk+",format=qcow2,media=disk")
+	}
+	cmd := exec.Command(qemuBin, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+
+	var log io.Writer = io.Discard
+	if opts.LogPath != "" {
+		f, err := os.Create(opts.LogPath)
+		if err != nil {
+			return fmt.Errorf("creating console log: %w", err)
+		}
+		defer f.Close()
+		log = f
+	}
+
+	ui.SubStep(fmt.Sprintf("Booting %s (timeout %s, waiting for %q)...", filepath.Base(isoPath), opts.Timeout, opts.Marker))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting qemu: %w", err)
+	}
+	defer cmd.Process.Kill()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	var console bytes.Buffer
+	go func() {
+		result <- watch(stdout, io.MultiWriter(log, &console), opts.Marker)
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("%w\n%s", err, tail(console.String(), 20))
+		}
+		ui.SubStep(fmt.Sprintf("Reached %q after %s", opts.Marker, time.Since(start).Round(time.Second)))
+		return nil
+	case <-time.After(opts.Timeout):
+		cmd.Process.Kill()
+		<-result
+		return fmt.Errorf("timed out after %s waiting for %q\n%s", opts.Timeout, opts.Marker, tail(console.String(), 20))
+	}
+}
+
+// watch copies the console to w until marker or a failure marker appears,
+// or the stream ends. It returns nil only when marker was seen.
+func watch(r io.Reader, w io.Writer, marker string) error {
+	// Only the last few KB need to be searched: markers are short, and a
+	// marker split across two reads is still within the window.
+	var window []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			window = append(window, buf[:n]...)
+			if len(window) > 8192 {
+				window = window[len(window)-8192:]
+			}
+			if bytes.Contains(window, []byte(marker)) {
+				return nil
+			}
+			for _, f := range failureMarkers {
+				if bytes.Contains(window, []byte(f)) {
+					return fmt.Errorf("boot failed: %q on console", f)
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("qemu exited before %q appeared", marker)
+		}
+	}
+}
+
+// extractBootFiles copies /boot out of the ISO and returns the kernel and
+// initramfs paths inside dir.
+func extractBootFiles(isoPath, dir string) (kernel, initrd string, err error) {
+	cmd := exec.Command("xorriso", "-osirrox", "on", "-indev", isoPath, "-extract", "/boot", filepath.Join(dir, "boot"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", "", fmt.Errorf("extracting /boot from %s: %w: %s", isoPath, err, strings.TrimSpace(string(out)))
+	}
+
+	find := func(patterns ...string) string {
+		for _, p := range patterns {
+			if m, _ := filepath.Glob(filepath.Join(dir, "boot", p)); len(m) > 0 {
+				return m[0]
+			}
+		}
+		return ""
+	}
+	kernel = find("vmlinuz*")
+	initrd = find("initramfs*", "initrd*")
+	if kernel == "" || initrd == "" {
+		return "", "", fmt.Errorf("kernel or initramfs not found in %s:/boot", isoPath)
+	}
+	return kernel, initrd, nil
+}
+
+// tail returns the last n lines of s, indented for error output.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return "  | " + strings.Join(lines, "\n  | ")
+}
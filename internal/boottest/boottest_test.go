@@ -0,0 +1,41 @@
+package boottest
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		console string
+		wantErr string
+	}{
+		{"login prompt", "Welcome to Alpine Linux\n\nlocalhost login: ", ""},
+		{"kernel panic", "Kernel panic - not syncing: VFS: Unable to mount root fs\n", "Kernel panic"},
+		{"emergency shell", "ERROR: rootfs.squashfs not found\nDropping to emergency shell...\n", "emergency shell"},
+		{"qemu exited", "SeaBIOS\nBooting from DVD/CD...\n", "exited before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := watch(strings.NewReader(tt.console), io.Discard, DefaultMarker)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWatch_MarkerSplitAcrossReads(t *testing.T) {
+	r := io.MultiReader(strings.NewReader("boot ok, log"), strings.NewReader("in: "))
+	if err := watch(r, io.Discard, DefaultMarker); err != nil {
+		t.Errorf("marker split across reads not found: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Package bundle packs everything an offline build needs into a single
+// verified archive, and unpacks it again on the air-gapped side.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// Layout of a bundle archive. CacheDir has the same structure as the
+// persistent build cache, so it can be passed to the rootfs as-is.
+const (
+	ManifestName = "manifest.json"
+	CacheDir     = "cache"
+	SyslinuxDir  = "assets/syslinux"
+	OVMFDir      = "assets/ovmf"
+)
+
+// ovmfSearchPaths are the host locations of UEFI firmware for QEMU.
+var ovmfSearchPaths = []string{
+	"/usr/share/OVMF/OVMF_CODE.fd",
+	"/usr/share/OVMF/OVMF_VARS.fd",
+	"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+	"/usr/share/edk2/ovmf/OVMF_VARS.fd",
+	"/usr/share/qemu/OVMF.fd",
+}
+
+// Manifest records what a bundle was made for and the SHA-256 of every file.
+type Manifest struct {
+	Name    string            `json:"name"`
+	Distro  string            `json:"distro"`
+	Created string            `json:"created"`
+	Files   map[string]string `json:"files"` // path relative to the bundle root → sha256
+}
+
+// CopyAssets copies the given files into dir under their map key names.
+func CopyAssets(dir string, files map[string]string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", dir, err)
+	}
+	for name, src := range files {
+		if err := fsutil.CopyFile(src, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("copying %s: %w", src, err)
+		}
+		ui.Detail(name)
+	}
+	return nil
+}
+
+// OVMFAssets returns the UEFI firmware files found on the host, keyed by
+// file name. UEFI boot testing is optional, so none being found is not an error.
+func OVMFAssets() map[string]string {
+	assets := make(map[string]string)
+	for _, p := range ovmfSearchPaths {
+		if _, ok := assets[filepath.Base(p)]; ok {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			assets[filepath.Base(p)] = p
+		}
+	}
+	return assets
+}
+
+// Create hashes every file below stageDir, writes the manifest next to them
+// and packs the directory into a gzip-compressed tarball at outputPath. The
+// archive's own checksum is written to outputPath.sha256.
+func Create(stageDir, outputPath string, m Manifest) error {
+	ui.SubStep("Hashing bundle contents...")
+	files, err := hashTree(stageDir)
+	if err != nil {
+		return err
+	}
+	delete(files, ManifestName)
+	m.Files = files
+	if m.Created == "" {
+		m.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(stageDir, ManifestName), data, 0644); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	ui.SubStep(fmt.Sprintf("Packing %d files...", len(files)))
+	cmd := exec.Command("tar", "czf", outputPath, "-C", stageDir, ".")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("creating archive: %w", err)
+	}
+
+	sum, err := fsutil.SHA256File(outputPath)
+	if err != nil {
+		return fmt.Errorf("hashing archive: %w", err)
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(outputPath))
+	if err := os.WriteFile(outputPath+".sha256", []byte(line), 0644); err != nil {
+		return fmt.Errorf("writing checksum: %w", err)
+	}
+	return nil
+}
+
+// Extract verifies a bundle and unpacks it into destDir. The archive is
+// checked against its .sha256 sidecar when one is present, and every file
+// in it against the manifest; files missing from or unknown to the manifest
+// are rejected. Nothing is unpacked until both checks pass.
+func Extract(bundlePath, destDir string) (*Manifest, error) {
+	if data, err := os.ReadFile(bundlePath + ".sha256"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty checksum file %s.sha256", bundlePath)
+		}
+		got, err := fsutil.SHA256File(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("hashing bundle: %w", err)
+		}
+		if !strings.EqualFold(got, fields[0]) {
+			return nil, fmt.Errorf("bundle checksum mismatch: got %s, want %s", got, fields[0])
+		}
+		ui.SubStep("Bundle checksum verified")
+	} else {
+		ui.Warn("No " + filepath.Base(bundlePath) + ".sha256 next to the bundle — verifying contents only")
+	}
+
+	m, got, err := readArchive(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	for name, want := range m.Files {
+		sum, ok := got[name]
+		if !ok {
+			return nil, fmt.Errorf("bundle is missing %s", name)
+		}
+		if sum != want {
+			return nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+		delete(got, name)
+	}
+	if len(got) > 0 {
+		return nil, fmt.Errorf("bundle contains files not in its manifest: %s", strings.Join(sortedKeys(got), ", "))
+	}
+	ui.SubStep(fmt.Sprintf("%d files verified against manifest", len(m.Files)))
+
+	cmd := exec.Command("tar", "xzf", bundlePath, "-C", destDir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("extracting bundle: %w", err)
+	}
+	return m, nil
+}
+
+// readArchive reads the manifest of the bundle at bundlePath and the SHA-256
+// of every other regular file in it, keyed like Manifest.Files, without
+// unpacking anything.
+func readArchive(bundlePath string) (*Manifest, map[string]string, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening bundle: %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading bundle: %w", err)
+	}
+
+	var m *Manifest
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if name == ManifestName {
+			m = new(Manifest)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, nil, fmt.Errorf("parsing manifest: %w", err)
+			}
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, nil, fmt.Errorf("reading %s from bundle: %w", name, err)
+		}
+		files[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if m == nil {
+		return nil, nil, fmt.Errorf("bundle has no %s", ManifestName)
+	}
+	return m, files, nil
+}
+
+// hashTree returns the SHA-256 of every regular file below root, keyed by
+// slash-separated path relative to root.
+func hashTree(root string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		sum, err := fsutil.SHA256File(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", root, err)
+	}
+	return files, nil
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+package bundle
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeStage(t *testing.T) string {
+	t.Helper()
+	stage := t.TempDir()
+	for name, content := range map[string]string{
+		"cache/minirootfs/x86_64/alpine-minirootfs-3.20.0-x86_64.tar.gz": "tarball",
+		"cache/apk/x86_64/busybox-1.36.1-r29.apk":                        "apk",
+		"assets/syslinux/isolinux.bin":                                   "isolinux",
+	} {
+		p := filepath.Join(stage, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stage
+}
+
+func TestCreateExtract(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "os-bundle.tar.gz")
+	if err := Create(writeStage(t), out, Manifest{Name: "os", Distro: "alpine"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	dest := t.TempDir()
+	m, err := Extract(out, dest)
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if m.Name != "os" || len(m.Files) != 3 {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+	if _, err := os.Stat(filepath.Join(dest, SyslinuxDir, "isolinux.bin")); err != nil {
+		t.Errorf("asset not extracted: %v", err)
+	}
+}
+
+func TestExtract_ChecksumMismatch(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "os-bundle.tar.gz")
+	if err := Create(writeStage(t), out, Manifest{Name: "os"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := os.WriteFile(out+".sha256", []byte(strings.Repeat("0", 64)+"  os-bundle.tar.gz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Extract(out, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got: %v", err)
+	}
+}
+
+func TestExtract_TamperedNotUnpacked(t *testing.T) {
+	stage := writeStage(t)
+	out := filepath.Join(t.TempDir(), "os-bundle.tar.gz")
+	if err := Create(stage, out, Manifest{Name: "os"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Repack with a changed asset but the original manifest, and without
+	// the sidecar, so only the manifest check can catch it.
+	os.WriteFile(filepath.Join(stage, SyslinuxDir, "isolinux.bin"), []byte("tampered"), 0644)
+	if msg, err := exec.Command("tar", "czf", out, "-C", stage, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v: %s", err, msg)
+	}
+	os.Remove(out + ".sha256")
+
+	dest := t.TempDir()
+	_, err := Extract(out, dest)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for "+SyslinuxDir+"/isolinux.bin") {
+		t.Errorf("expected checksum mismatch for isolinux.bin, got: %v", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) > 0 {
+		t.Errorf("unverified bundle was unpacked: %v", entries)
+	}
+}
@@ -0,0 +1,214 @@
+// Package compress compresses the archives DistroRun writes itself, such
+// as initramfs images and OCI layers, on several CPUs. Formats are
+// registered by name so a new one only needs an entry in formats.
+//
+// Output does not depend on the number of workers, so builds with
+// SOURCE_DATE_EPOCH stay byte-identical on any machine. For gzip, data is
+// cut into blocks of a fixed size, which are compressed in parallel with the
+// end of the previous block as dictionary and joined into one stream. The
+// zstd encoder of github.com/klauspost/compress compresses its blocks in
+// parallel itself, with the same guarantee.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// BlockSize is the amount of input gzip compresses as one unit. Blocks
+// must be small enough to keep every worker busy on small archives such as
+// an initramfs, and large enough that the sync flush ending each one costs
+// nothing measurable. BenchmarkGzipBlockSize shows the ratio flat from 128
+// KiB to 4 MiB; 1 MiB still cuts an 8 MiB initramfs into eight blocks.
+const BlockSize = 1 << 20
+
+// gzipLevel is the deflate level of gzip output. In BenchmarkGzipLevel,
+// level 9 gains 2% of ratio for four times the time, and level 1 loses 4%
+// for twice the speed.
+const gzipLevel = flate.DefaultCompression
+
+// zstdLevel is the level of zstd output. In BenchmarkZstdLevel, the default
+// level is about twice as fast as gzipLevel at a similar ratio, while
+// SpeedBetterCompression gains under 1% for over twice the time.
+const zstdLevel = zstd.SpeedDefault
+
+// dictSize is the deflate window, which each block is primed with.
+const dictSize = 32 << 10
+
+// workers is the number of blocks compressed at a time.
+var workers = runtime.NumCPU()
+
+// SetWorkers sets the number of CPUs compression uses; n <= 0 uses every
+// CPU.
+func SetWorkers(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	workers = n
+}
+
+// formats are the supported formats and their writers.
+var formats = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return newGzipWriter(w, gzipLevel, BlockSize, workers), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) { return newZstdWriter(w, zstdLevel, workers) },
+}
+
+// Formats returns the names of the supported formats.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewWriter returns a writer compressing to w in the named format. Close
+// must be called to write the end of the stream; it does not close w.
+func NewWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	newWriter, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q: must be one of %s", format, strings.Join(Formats(), ", "))
+	}
+	return newWriter(w)
+}
+
+// newZstdWriter returns a zstd writer to w compressing on workers CPUs.
+// Frames carry a checksum, as zstd(1) writes them.
+func newZstdWriter(w io.Writer, level zstd.EncoderLevel, workers int) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(max(workers, 1)), zstd.WithEncoderCRC(true))
+}
+
+// block is one block being compressed.
+type block struct {
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// gzipWriter writes a single gzip member whose deflate stream is the
+// concatenation of independently compressed blocks, each but the last
+// ended with a sync flush. Any gzip reader decompresses it.
+type gzipWriter struct {
+	w       io.Writer
+	level   int
+	block   int // input size of each block
+	workers int
+	buf     []byte // input of the next block
+	dict    []byte // end of the previous block
+	pending []*block
+	crc     uint32
+	size    uint32 // input size modulo 2^32, as gzip records it
+	err     error
+	closed  bool
+}
+
+func newGzipWriter(w io.Writer, level, block, workers int) *gzipWriter {
+	z := &gzipWriter{w: w, level: level, block: block, workers: max(workers, 1)}
+	// The header of compress/gzip without a name or time: ID, deflate,
+	// no flags, no mtime, no extra flags, unknown OS.
+	_, z.err = w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff})
+	return z
+}
+
+func (z *gzipWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errors.New("compress: write after Close")
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+	n := len(p)
+	for len(p) > 0 {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, z.block)
+		}
+		k := min(len(p), z.block-len(z.buf))
+		z.buf = append(z.buf, p[:k]...)
+		p = p[k:]
+		if len(z.buf) == z.block {
+			z.compress(false)
+			if err := z.drain(z.workers); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// compress starts compressing the buffered input as the next block.
+func (z *gzipWriter) compress(final bool) {
+	data, dict := z.buf, z.dict
+	z.buf = nil
+	z.dict = data[max(len(data)-dictSize, 0):]
+	b := &block{done: make(chan struct{})}
+	z.pending = append(z.pending, b)
+	go func() {
+		defer close(b.done)
+		fw, err := flate.NewWriterDict(&b.out, z.level, dict)
+		if err != nil {
+			b.err = err
+			return
+		}
+		if _, err := fw.Write(data); err != nil {
+			b.err = err
+			return
+		}
+		if final {
+			b.err = fw.Close()
+		} else {
+			b.err = fw.Flush()
+		}
+	}()
+}
+
+// drain writes finished blocks in order until at most keep are pending.
+func (z *gzipWriter) drain(keep int) error {
+	for len(z.pending) > keep {
+		b := z.pending[0]
+		z.pending = z.pending[1:]
+		<-b.done
+		if z.err == nil {
+			z.err = b.err
+		}
+		if z.err == nil {
+			_, z.err = z.w.Write(b.out.Bytes())
+		}
+	}
+	return z.err
+}
+
+// Close compresses the remaining input and writes the gzip trailer.
+func (z *gzipWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err != nil {
+		z.drain(0)
+		return z.err
+	}
+	z.compress(true)
+	if err := z.drain(0); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, z.err = z.w.Write(trailer[:])
+	return z.err
+}
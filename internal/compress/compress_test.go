@@ -0,0 +1,175 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sample returns n bytes compressing about as well as a root filesystem:
+// text-like runs mixed with random data.
+func sample(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < n {
+		if rng.Intn(8) == 0 {
+			chunk := make([]byte, rng.Intn(512))
+			rng.Read(chunk)
+			b.Write(chunk)
+		} else {
+			fmt.Fprintf(&b, "/usr/lib/libfoo.so.%d: symbol %x version %d\n", rng.Intn(100), rng.Int63(), rng.Intn(10))
+		}
+	}
+	return b.Bytes()[:n]
+}
+
+func TestGzip(t *testing.T) {
+	data := sample(3*BlockSize + 12345)
+	var outputs [][]byte
+	for _, n := range []int{1, 4} {
+		for _, size := range []int{0, 10, BlockSize, len(data)} {
+			var buf bytes.Buffer
+			z := newGzipWriter(&buf, 6, BlockSize, n)
+			// Uneven writes, so blocks fill across several of them.
+			for p := data[:size]; len(p) > 0; {
+				k := min(len(p), 70000)
+				if _, err := z.Write(p[:k]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[k:]
+			}
+			if err := z.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data[:size]) {
+				t.Errorf("%d workers, %d bytes: read back %d bytes, %v", n, size, len(got), err)
+			}
+			if size == len(data) {
+				outputs = append(outputs, buf.Bytes())
+			}
+		}
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("output depends on the number of workers")
+	}
+}
+
+func TestZstd(t *testing.T) {
+	data := sample(3*BlockSize + 12345)
+	var outputs [][]byte
+	for _, n := range []int{1, 4} {
+		var buf bytes.Buffer
+		w, err := newZstdWriter(&buf, zstdLevel, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p := data; len(p) > 0; {
+			k := min(len(p), 70000)
+			if _, err := w.Write(p[:k]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[k:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d workers: read back %d bytes, %v", n, len(got), err)
+		}
+		outputs = append(outputs, buf.Bytes())
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("output depends on the number of workers")
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	if _, err := NewWriter(io.Discard, "lzma"); err == nil {
+		t.Error("unknown format accepted")
+	}
+	w, err := NewWriter(io.Discard, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("write after Close accepted")
+	}
+}
+
+// benchmark compresses data with each loop, reporting the compression
+// ratio as well as the speed.
+func benchmark(b *testing.B, data []byte, newWriter func(io.Writer) io.WriteCloser) {
+	b.SetBytes(int64(len(data)))
+	var buf bytes.Buffer
+	for b.Loop() {
+		buf.Reset()
+		w := newWriter(&buf)
+		w.Write(data)
+		w.Close()
+	}
+	b.ReportMetric(float64(len(data))/float64(buf.Len()), "ratio")
+}
+
+// BenchmarkGzip compares compress/gzip with this package by worker count.
+func BenchmarkGzip(b *testing.B) {
+	data := sample(32 << 20)
+	b.Run("stdlib", func(b *testing.B) {
+		benchmark(b, data, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	})
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			benchmark(b, data, func(w io.Writer) io.WriteCloser { return newGzipWriter(w, gzipLevel, BlockSize, n) })
+		})
+	}
+}
+
+// BenchmarkGzipLevel measures the deflate levels gzipLevel is chosen from.
+func BenchmarkGzipLevel(b *testing.B) {
+	data := sample(32 << 20)
+	for _, level := range []int{1, 4, 6, 9} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			benchmark(b, data, func(w io.Writer) io.WriteCloser { return newGzipWriter(w, level, BlockSize, 4) })
+		})
+	}
+}
+
+// BenchmarkGzipBlockSize measures the block sizes BlockSize is chosen from,
+// on an initramfs-sized input, where large blocks leave workers idle.
+func BenchmarkGzipBlockSize(b *testing.B) {
+	data := sample(8 << 20)
+	for _, size := range []int{128 << 10, 256 << 10, 512 << 10, 1 << 20, 2 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("block=%dK", size>>10), func(b *testing.B) {
+			benchmark(b, data, func(w io.Writer) io.WriteCloser { return newGzipWriter(w, gzipLevel, size, 4) })
+		})
+	}
+}
+
+// BenchmarkZstdLevel measures the zstd levels zstdLevel is chosen from.
+func BenchmarkZstdLevel(b *testing.B) {
+	data := sample(32 << 20)
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBetterCompression, zstd.SpeedBestCompression} {
+		b.Run(level.String(), func(b *testing.B) {
+			benchmark(b, data, func(w io.Writer) io.WriteCloser {
+				z, _ := newZstdWriter(w, level, 4)
+				return z
+			})
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AddonDir is the directory next to the config file that add-ons are
+// installed into and loaded from, one subdirectory per add-on.
+const AddonDir = "addons"
+
+// AddonFile is the definition at the root of an add-on directory.
+const AddonFile = "addon.yaml"
+
+// addonName matches an add-on name; it is used as a directory and URL path
+// component.
+var addonName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// addonVersion matches an add-on version, e.g. "1.2.0" or "2024.05-1".
+var addonVersion = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+~_-]*$`)
+
+// Addon is a reusable piece of configuration, e.g. "tailscale": packages,
+// services, overlay files and hooks merged into every config that lists it
+// under "addons". Sources and scripts are relative to the add-on directory.
+type Addon struct {
+	Name        string   `yaml:"name"`
+	Version     string   `yaml:"version"`
+	Description string   `yaml:"description"`
+	Packages    []string `yaml:"packages"`
+	Services    []string `yaml:"services"` // enabled at boot
+	Files       []File   `yaml:"files"`
+	Hooks       *Hooks   `yaml:"hooks"`
+}
+
+// CheckAddonName reports whether name can be used as an add-on name.
+func CheckAddonName(name string) error {
+	if !addonName.MatchString(name) {
+		return fmt.Errorf("add-on name %q is invalid: use lowercase letters, digits and dashes", name)
+	}
+	return nil
+}
+
+// LoadAddon reads the add-on definition in dir. The add-on must be named
+// after its directory and may only refer to files inside it.
+func LoadAddon(dir string) (*Addon, error) {
+	data, err := os.ReadFile(filepath.Join(dir, AddonFile))
+	if err != nil {
+		return nil, err
+	}
+	a, err := ParseAddon(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filepath.Join(dir, AddonFile), err)
+	}
+	if a.Name != filepath.Base(dir) {
+		return nil, fmt.Errorf("add-on in %s is named %q, not %q", dir, a.Name, filepath.Base(dir))
+	}
+	if errs := validateFiles(a.Files); len(errs) > 0 {
+		return nil, fmt.Errorf("add-on %s: %s", a.Name, errs[0])
+	}
+	refs := make([]string, 0, len(a.Files))
+	for _, f := range a.Files {
+		if f.Source != "" {
+			refs = append(refs, f.Source)
+		}
+	}
+	if a.Hooks != nil {
+		for _, stage := range [][]Hook{a.Hooks.PostPackages, a.Hooks.PreISO, a.Hooks.PostBuild} {
+			for _, h := range stage {
+				if h.Script != "" {
+					refs = append(refs, h.Script)
+				}
+			}
+		}
+	}
+	for _, ref := range refs {
+		if !filepath.IsLocal(ref) {
+			return nil, fmt.Errorf("add-on %s: %q must be a path inside the add-on", a.Name, ref)
+		}
+	}
+	return a, nil
+}
+
+// ParseAddon parses an add-on definition without looking at the files it
+// refers to, as when checking the definition in a downloaded archive.
+func ParseAddon(data []byte) (*Addon, error) {
+	var a Addon
+	if err := yaml.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	if a.Version != "" && !addonVersion.MatchString(a.Version) {
+		return nil, fmt.Errorf("add-on version %q is invalid: use letters, digits and . + ~ _ -", a.Version)
+	}
+	return &a, nil
+}
+
+// applyAddons merges the add-ons listed in the config, installed below
+// configDir. Their files and hooks come before the config's own, so the
+// config can override an add-on's files and run its hooks last.
+func (c *Config) applyAddons(configDir string) error {
+	var files []File
+	var hooks Hooks
+	for _, name := range c.Addons {
+		if err := CheckAddonName(name); err != nil {
+			return err
+		}
+		rel := filepath.Join(AddonDir, name)
+		a, err := LoadAddon(filepath.Join(configDir, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("add-on %q is not installed in %s; run 'distrorun add-on install %s' there",
+				name, filepath.Join(configDir, AddonDir), name)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, p := range a.Packages {
+			if !slices.Contains(c.Packages, p) {
+				c.Packages = append(c.Packages, p)
+			}
+		}
+		if len(a.Services) > 0 && c.Services == nil {
+			c.Services = &Services{}
+		}
+		for _, s := range a.Services {
+			if !slices.Contains(c.Services.Enable, s) {
+				c.Services.Enable = append(c.Services.Enable, s)
+			}
+		}
+		// Paths are made relative to the config file, which LoadConfig
+		// resolves them against.
+		for _, f := range a.Files {
+			if f.Source != "" {
+				f.Source = filepath.Join(rel, f.Source)
+			}
+			files = append(files, f)
+		}
+		if a.Hooks != nil {
+			for _, st := range []struct {
+				dst *[]Hook
+				src []Hook
+			}{
+				{&hooks.PostPackages, a.Hooks.PostPackages},
+				{&hooks.PreISO, a.Hooks.PreISO},
+				{&hooks.PostBuild, a.Hooks.PostBuild},
+			} {
+				for _, h := range st.src {
+					if h.Script != "" {
+						h.Script = filepath.Join(rel, h.Script)
+					}
+					*st.dst = append(*st.dst, h)
+				}
+			}
+		}
+	}
+
+	c.Files = append(files, c.Files...)
+	if len(hooks.PostPackages)+len(hooks.PreISO)+len(hooks.PostBuild) > 0 {
+		if c.Hooks == nil {
+			c.Hooks = &Hooks{}
+		}
+		c.Hooks.PostPackages = append(hooks.PostPackages, c.Hooks.PostPackages...)
+		c.Hooks.PreISO = append(hooks.PreISO, c.Hooks.PreISO...)
+		c.Hooks.PostBuild = append(hooks.PostBuild, c.Hooks.PostBuild...)
+	}
+	return nil
+}
@@ -3,59 +3,911 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config is the top-level DistroRun configuration.
 type Config struct {
-	Version  string    `yaml:"version"`
-	Name     string    `yaml:"name"`
-	Distro   Distro    `yaml:"distro"`
-	Packages []string  `yaml:"packages"`
-	Users    []User    `yaml:"users"`
-	Services *Services `yaml:"services"`
-	Build    *Build    `yaml:"build"`
+	Version    string      `yaml:"version"` // schema version, see SchemaVersion
+	Name       string      `yaml:"name"`
+	Profile    string      `yaml:"profile"` // preset the config builds on, e.g. "rescue"
+	Target     string      `yaml:"target"`  // "vm" tunes kernel, drivers and console for virtual machines
+	Distro     Distro      `yaml:"distro"`
+	Packages   []string    `yaml:"packages"`
+	Addons     []string    `yaml:"addons"` // add-ons installed in AddonDir next to the config file
+	Users      []User      `yaml:"users"`
+	Services   *Services   `yaml:"services"`
+	Files      []File      `yaml:"files"`
+	Hooks      *Hooks      `yaml:"hooks"`
+	Build      *Build      `yaml:"build"`
+	Publish    []Target    `yaml:"publish"`
+	Firstboot  *Firstboot  `yaml:"firstboot"`
+	Provision  *Provision  `yaml:"provision"`
+	System     *System     `yaml:"system"`
+	Network    *Network    `yaml:"network"`
+	AP         *AP         `yaml:"ap"`
+	VPN        *VPN        `yaml:"vpn"`
+	Boot       *Boot       `yaml:"boot"`
+	Live       *Live       `yaml:"live"`
+	Management *Management `yaml:"management"`
+	CloudInit  *CloudInit  `yaml:"cloud_init"`
+	Updates    *Updates    `yaml:"updates"`
+	Assertions *Assertions `yaml:"assertions"`
+	BaseData   *BaseData   `yaml:"base_data"`
+	Branding   *Branding   `yaml:"branding"`
+	Lint       *Lint       `yaml:"lint"`
+
+	// ImageVersion is the release of the image, e.g. "1.4": {version} in
+	// publish paths and the version of channel manifests and branding
+	// templates. Before config version 2, "version" held it.
+	ImageVersion string `yaml:"image_version"`
+
+	// PackageAliases names packages per distro.base, e.g. {"editor":
+	// {"alpine": "vim", "debian": "vim-nox"}}, before the built-in aliases;
+	// an empty name leaves the package out on that distribution.
+	PackageAliases map[string]map[string]string `yaml:"package_aliases"`
+
+	schemaVersion  int      // version of the file before it was upgraded
+	migrationNotes []string // changes made while upgrading it
+}
+
+// Outdated reports whether the config file uses an older schema version,
+// and the changes 'distrorun migrate' would make to it.
+func (c *Config) Outdated() (int, []string, bool) {
+	return c.schemaVersion, c.migrationNotes, c.schemaVersion != 0 && c.schemaVersion < CurrentVersion
+}
+
+// VPN configures VPN clients started at boot.
+type VPN struct {
+	WireGuard *WireGuard `yaml:"wireguard"`
+}
+
+// WireGuard is a wg-quick interface. Either ConfigFile names a complete
+// wg-quick configuration on the build host, or the interface is described
+// inline, with the private key preferably read from PrivateKeyFile so it
+// stays out of the config.
+type WireGuard struct {
+	Interface      string          `yaml:"interface"`        // defaults to "wg0"
+	ConfigFile     string          `yaml:"config_file"`      // wg-quick .conf, relative to the config file
+	PrivateKey     string          `yaml:"private_key"`      // inline private key
+	PrivateKeyFile string          `yaml:"private_key_file"` // file holding the private key, relative to the config file
+	Address        []string        `yaml:"address"`          // interface addresses in CIDR notation
+	DNS            []string        `yaml:"dns"`              // DNS servers used while the tunnel is up
+	ListenPort     int             `yaml:"listen_port"`      // optional fixed UDP port
+	Peers          []WireGuardPeer `yaml:"peers"`
+}
+
+// WireGuardPeer is a [Peer] section of a wg-quick configuration.
+type WireGuardPeer struct {
+	PublicKey           string   `yaml:"public_key"`
+	Endpoint            string   `yaml:"endpoint"`    // "host:port"
+	AllowedIPs          []string `yaml:"allowed_ips"` // e.g. ["10.8.0.0/24"] or ["0.0.0.0/0"]
+	PersistentKeepalive int      `yaml:"persistent_keepalive"`
+}
+
+// InterfaceName returns the WireGuard interface name, defaulting to "wg0".
+func (w WireGuard) InterfaceName() string {
+	if w.Interface == "" {
+		return "wg0"
+	}
+	return w.Interface
+}
+
+// AP turns the image into a WiFi access point with hostapd, handing out
+// addresses on the wireless interface with dnsmasq.
+type AP struct {
+	SSID       string `yaml:"ssid"`
+	Passphrase string `yaml:"passphrase"` // WPA2-PSK, 8 to 63 characters
+	Channel    int    `yaml:"channel"`    // defaults to 6; 36 and above select 5 GHz
+	Interface  string `yaml:"interface"`  // defaults to "wlan0"
+	Country    string `yaml:"country"`    // ISO 3166-1 country code for regulatory limits, e.g. "DE"
+	Address    string `yaml:"address"`    // AP address in CIDR notation; defaults to "192.168.4.1/24"
+	DHCPRange  string `yaml:"dhcp_range"` // "first-last"; defaults to "192.168.4.10-192.168.4.100"
+}
+
+// WirelessInterface returns the AP interface, defaulting to "wlan0".
+func (a AP) WirelessInterface() string {
+	if a.Interface == "" {
+		return "wlan0"
+	}
+	return a.Interface
+}
+
+// WirelessChannel returns the AP channel, defaulting to 6.
+func (a AP) WirelessChannel() int {
+	if a.Channel == 0 {
+		return 6
+	}
+	return a.Channel
+}
+
+// CIDR returns the AP address, defaulting to "192.168.4.1/24".
+func (a AP) CIDR() string {
+	if a.Address == "" {
+		return "192.168.4.1/24"
+	}
+	return a.Address
+}
+
+// Range returns the first and last DHCP address. The default range matches
+// the default address.
+func (a AP) Range() (first, last string) {
+	r := a.DHCPRange
+	if r == "" {
+		r = "192.168.4.10-192.168.4.100"
+	}
+	first, last, _ = strings.Cut(r, "-")
+	return strings.TrimSpace(first), strings.TrimSpace(last)
+}
+
+// Network replaces the default DHCP on eth0 with explicit interfaces and
+// sets the DNS servers.
+type Network struct {
+	Interfaces []Interface `yaml:"interfaces"`
+	DNS        []string    `yaml:"dns"` // nameserver addresses; DHCP then leaves resolv.conf alone
+}
+
+// Interface is one stanza of /etc/network/interfaces. It is configured by
+// DHCP when DHCP is set, statically when Address is set, and brought up
+// without an address otherwise (e.g. bond members and bridge ports).
+type Interface struct {
+	Name    string `yaml:"name"`    // e.g. "eth0", "bond0", "br0", "eth0.100", "wlan0"
+	Type    string `yaml:"type"`    // "ethernet" (default), "bond", "bridge", "vlan" or "wireless"
+	DHCP    bool   `yaml:"dhcp"`    // configure by DHCP
+	Address string `yaml:"address"` // static address in CIDR notation, e.g. "192.168.1.10/24"
+	Gateway string `yaml:"gateway"` // static default gateway
+
+	BondMembers []string `yaml:"bond_members"` // bond: enslaved interfaces
+	BondMode    string   `yaml:"bond_mode"`    // bond: e.g. "802.3ad"; defaults to "active-backup"
+	BridgePorts []string `yaml:"bridge_ports"` // bridge: member interfaces; may be empty
+	VLANID      int      `yaml:"vlan_id"`      // vlan: tag, 1-4094
+	VLANLink    string   `yaml:"vlan_link"`    // vlan: parent interface
+	SSID        string   `yaml:"ssid"`         // wireless: network to join
+	Passphrase  string   `yaml:"passphrase"`   // wireless: WPA2 passphrase; empty for an open network
+}
+
+// InterfaceType returns the interface type, defaulting to "ethernet".
+func (i Interface) InterfaceType() string {
+	if i.Type == "" {
+		return "ethernet"
+	}
+	return i.Type
+}
+
+// Mode returns the bond mode, defaulting to "active-backup".
+func (i Interface) Mode() string {
+	if i.BondMode == "" {
+		return "active-backup"
+	}
+	return i.BondMode
+}
+
+// Updates controls how the installed system receives package upgrades, or
+// with mode "image" whole new releases of the image.
+type Updates struct {
+	Mode     string `yaml:"mode"`     // "frozen", "unattended" or "image"
+	Schedule string `yaml:"schedule"` // unattended, image: "daily" (default), "weekly" or a cron expression
+	Reboot   string `yaml:"reboot"`   // unattended, image: "if-needed" (default), "always" or "never"
+	// Manifest is the URL of the channel.json the image follows and
+	// PublicKey the base64 Ed25519 key it must be signed with (image).
+	Manifest  string `yaml:"manifest"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// CronSchedule returns the cron expression for unattended upgrades. Named
+// schedules run at 03:00, daily or on Sundays.
+func (u Updates) CronSchedule() string {
+	switch u.Schedule {
+	case "", "daily":
+		return "0 3 * * *"
+	case "weekly":
+		return "0 3 * * 0"
+	}
+	return u.Schedule
+}
+
+// RebootPolicy returns the reboot policy, defaulting to "if-needed".
+func (u Updates) RebootPolicy() string {
+	if u.Reboot == "" {
+		return "if-needed"
+	}
+	return u.Reboot
+}
+
+// Assertions are acceptance criteria for the image, checked on the
+// finished root filesystem before it is packaged. Paths are absolute
+// inside the image and may be shell patterns such as "/root/.ssh/id_*".
+type Assertions struct {
+	RequireFiles []string           `yaml:"require_files"` // each must match at least one file
+	ForbidFiles  []string           `yaml:"forbid_files"`  // none may match a file
+	Packages     []PackageAssertion `yaml:"packages"`      // must be installed
+	MaxSize      string             `yaml:"max_size"`      // total size of the rootfs, e.g. "512M"
+}
+
+// PackageAssertion requires an installed package, optionally at a version
+// such as "3.3.2-r0" (exactly) or ">=3.3" (compared as package versions).
+type PackageAssertion struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+}
+
+// VersionConstraint splits Version into a comparison operator ("=", "<",
+// "<=", ">" or ">=") and the version compared against.
+func (p PackageAssertion) VersionConstraint() (op, version string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if v, ok := strings.CutPrefix(p.Version, op); ok {
+			return op, strings.TrimSpace(v)
+		}
+	}
+	return "=", p.Version
+}
+
+// ParseSize parses a size such as "512M" or "2G" into bytes. The suffixes
+// K, M, G and T are powers of 1024, as for qemu-img; no suffix means bytes.
+func ParseSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if n := len(num); n > 0 && units[num[n-1]] != 0 {
+		mult = units[num[n-1]]
+		num = num[:n-1]
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v <= 0 || v > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is invalid: use a positive number with an optional K, M, G or T suffix", s)
+	}
+	return v * mult, nil
+}
+
+// BaseDataPackages are the packages base_data keeps current: the CA
+// certificates TLS clients trust and the time zone database. They have the
+// same names on every supported distribution.
+var BaseDataPackages = []string{"ca-certificates", "tzdata"}
+
+// BaseData keeps the CA certificates and time zone database of the image
+// from going stale in long-lived configurations.
+type BaseData struct {
+	// Refresh installs or upgrades both packages to the newest version on
+	// the mirror in every build, even one reusing a rootfs snapshot.
+	Refresh bool `yaml:"refresh"`
+
+	// Versions pins either package to an exact version, e.g.
+	// tzdata: "2024b-r0", installed whether or not Refresh is set.
+	Versions map[string]string `yaml:"versions"`
+
+	// MaxAge fails the build when an installed package was built longer
+	// ago, e.g. "365d".
+	MaxAge string `yaml:"max_age"`
+}
+
+// ParseAge parses a Go duration, additionally accepting a "d" (days) suffix.
+func ParseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Management makes headless devices discoverable and manageable on the LAN
+// as soon as they boot.
+type Management struct {
+	MDNS     bool `yaml:"mdns"`      // announce <hostname>.local with avahi
+	SSH      bool `yaml:"ssh"`       // run an SSH server
+	WebAdmin bool `yaml:"web_admin"` // Cockpit on Fedora and Debian, ACF on Alpine
+}
+
+// CloudInit prepares the image for cloud platforms such as OpenStack and
+// Proxmox, which pass it users, keys and network settings at boot.
+// "cloud_init: true" is short for "cloud_init: {enabled: true}".
+type CloudInit struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Tool is "tiny-cloud" (the default on Alpine) or "cloud-init" (the
+	// only choice on Fedora and Debian).
+	Tool string `yaml:"tool"`
+
+	// Datasources are searched in order, named as cloud-init names them;
+	// default NoCloud, ConfigDrive, OpenStack. tiny-cloud uses only the
+	// first, which must be one it supports.
+	Datasources []string `yaml:"datasources"`
+
+	// Seed builds a NoCloud seed ISO (volume label "cidata") next to the
+	// image, to attach as a second drive.
+	Seed *CloudInitSeed `yaml:"seed"`
+}
+
+// CloudInitSeed holds the files of a NoCloud seed ISO. meta-data is
+// generated from the config name and hostname.
+type CloudInitSeed struct {
+	UserData      string `yaml:"user_data"`      // cloud-config file, relative to the config file
+	NetworkConfig string `yaml:"network_config"` // optional network config (version 2) file
+}
+
+// UnmarshalYAML accepts a boolean as well as a mapping.
+func (c *CloudInit) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&c.Enabled)
+	}
+	type plain CloudInit
+	return n.Decode((*plain)(c))
+}
+
+// cloudInitDatasources maps the datasources tiny-cloud supports to its
+// names for them.
+var cloudInitDatasources = map[string]string{
+	"NoCloud":     "nocloud",
+	"ConfigDrive": "",
+	"OpenStack":   "",
+	"Ec2":         "aws",
+	"Azure":       "azure",
+	"GCE":         "gcp",
+	"Oracle":      "oci",
+	"Hetzner":     "hetzner",
+	"Scaleway":    "scaleway",
+	"None":        "",
+}
+
+// CloudTool returns the tool reading the cloud metadata: "tiny-cloud" or
+// "cloud-init".
+func (c *Config) CloudTool() string {
+	if c.CloudInit.Tool != "" {
+		return c.CloudInit.Tool
+	}
+	if c.Distro.Base == "alpine" {
+		return "tiny-cloud"
+	}
+	return "cloud-init"
+}
+
+// CloudDatasources returns the datasources cloud_init searches.
+func (c *CloudInit) CloudDatasources() []string {
+	if len(c.Datasources) == 0 {
+		return []string{"NoCloud", "ConfigDrive", "OpenStack"}
+	}
+	return c.Datasources
+}
+
+// TinyCloudName returns the tiny-cloud name of a datasource, or "" if
+// tiny-cloud does not support it.
+func TinyCloudName(datasource string) string {
+	return cloudInitDatasources[datasource]
+}
+
+// Boot configures how the image's kernel is started.
+type Boot struct {
+	// Cmdline replaces the default kernel parameters ("quiet") in every
+	// generated boot configuration, e.g. "console=ttyS0,115200 nomodeset".
+	Cmdline string `yaml:"cmdline"`
+
+	// Persistence makes live images keep their changes on an ext4 partition
+	// labeled "distrorun-persis" when one is present at boot.
+	Persistence bool `yaml:"persistence"`
+
+	// Toram adds a boot menu entry that copies the root filesystem into
+	// memory, so the boot medium can be removed once the system is up.
+	Toram bool `yaml:"toram"`
+
+	// SerialConsole adds a boot menu entry with the console on the first
+	// serial port, and shows the boot menu there too, for headless
+	// machines.
+	SerialConsole bool `yaml:"serial_console"`
+
+	// UEFI makes ISOs boot on UEFI firmware as well as on BIOS, with a
+	// GRUB EFI image on an El Torito EFI system partition.
+	UEFI bool `yaml:"uefi"`
+
+	// Menu customizes the boot menu of ISOs.
+	Menu *BootMenu `yaml:"menu"`
+
+	// InitramfsFeatures are mkinitfs features added to the initramfs of
+	// Alpine images, e.g. "nvme", "lvm" or "raid". Those of tools such as
+	// LVM need the tools' package in packages.
+	InitramfsFeatures []string `yaml:"initramfs_features"`
+}
+
+// BootMenu customizes the boot menu of ISOs, in isolinux.cfg and grub.cfg.
+type BootMenu struct {
+	Title   string      `yaml:"title"`   // isolinux: shown above the entries
+	Timeout int         `yaml:"timeout"` // seconds before the default entry boots; defaults to 3 (isolinux) or 5 (GRUB)
+	Default string      `yaml:"default"` // label of the entry booted by default; defaults to the first
+	Entries []MenuEntry `yaml:"entries"` // added after the built-in entries
+}
+
+// MenuEntry is an extra boot menu entry.
+type MenuEntry struct {
+	Label   string `yaml:"label"`
+	Cmdline string `yaml:"cmdline"` // added to the kernel command line of the image, e.g. "nomodeset"
+}
+
+// Branding white-labels an image: the background and colors of the ISO boot
+// menu, and the login banner and message of the day.
+type Branding struct {
+	Splash string      `yaml:"splash"` // boot menu background, relative to the config file: a 640x480 PNG or JPEG
+	Colors *MenuColors `yaml:"colors"`
+	Issue  string      `yaml:"issue"` // /etc/issue, a template; agetty escapes such as \n and \l are kept
+	Motd   string      `yaml:"motd"`  // /etc/motd, a template
+}
+
+// MenuColors are the colors of the ISO boot menu, as "#rrggbb". Empty ones
+// keep the default.
+type MenuColors struct {
+	Title              string `yaml:"title"`
+	Text               string `yaml:"text"` // entries not selected
+	Selected           string `yaml:"selected"`
+	SelectedBackground string `yaml:"selected_background"`
+}
+
+// BrandingData is what the branding.issue and branding.motd templates are
+// executed with.
+type BrandingData struct {
+	Name     string // the image name
+	Hostname string
+	Version  string // image_version
+	Distro   string // distro.base
+}
+
+// Banners returns branding.issue and branding.motd executed for c, "" for
+// those not set.
+func (c *Config) Banners() (issue, motd string, err error) {
+	if c.Branding == nil {
+		return "", "", nil
+	}
+	data := BrandingData{Name: c.Name, Hostname: c.Hostname(), Version: c.ImageVersion, Distro: c.Distro.Base}
+	var out [2]string
+	for i, name := range []string{"issue", "motd"} {
+		text := []string{c.Branding.Issue, c.Branding.Motd}[i]
+		if text == "" {
+			continue
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", "", fmt.Errorf("branding.%s: %w", name, err)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", "", fmt.Errorf("branding.%s: %w", name, err)
+		}
+		out[i] = b.String()
+	}
+	return out[0], out[1], nil
+}
+
+// Lint configures "distrorun lint" for this config.
+type Lint struct {
+	Disable []string `yaml:"disable"` // rules not checked, e.g. "large-package-set"
+}
+
+// System configures runtime behaviour of the built image.
+type System struct {
+	Hostname  string    `yaml:"hostname"`  // defaults to the name of the first user
+	Timezone  string    `yaml:"timezone"`  // IANA zone, e.g. "Europe/Berlin"; defaults to UTC
+	Keymap    string    `yaml:"keymap"`    // console keymap, e.g. "de" or "fr-latin1"; defaults to "us"
+	Autologin string    `yaml:"autologin"` // user logged in on tty1 without a password, e.g. "root"
+	Watchdog  *Watchdog `yaml:"watchdog"`
+}
+
+// Watchdog makes unattended machines recover by themselves: a watchdog timer
+// reboots the machine when it hangs, kernel panics reboot it, and crashed
+// services can be restarted by their supervisor.
+type Watchdog struct {
+	Enabled bool   `yaml:"enabled"`
+	Module  string `yaml:"module"`  // kernel watchdog driver, e.g. "iTCO_wdt", "i6300esb"; defaults to "softdog"
+	Timeout int    `yaml:"timeout"` // seconds without a heartbeat before the reset; defaults to 60
+
+	// RestartServices restarts the services in services.enable when they
+	// crash: supervise-daemon on OpenRC, Restart=on-failure on systemd.
+	RestartServices bool `yaml:"restart_services"`
+}
+
+// KernelModule returns the watchdog driver, defaulting to "softdog".
+func (w Watchdog) KernelModule() string {
+	if w.Module == "" {
+		return "softdog"
+	}
+	return w.Module
+}
+
+// TimeoutSeconds returns the watchdog timeout, defaulting to 60 seconds.
+func (w Watchdog) TimeoutSeconds() int {
+	if w.Timeout == 0 {
+		return 60
+	}
+	return w.Timeout
+}
+
+// Live configures live ISO images.
+type Live struct {
+	// Input offers one boot menu entry per keyboard layout; the first
+	// boots by default.
+	Input []InputLocale `yaml:"input"`
+}
+
+// InputLocale is a boot menu entry loading a console keymap and font. The
+// entry passes them on the kernel command line as keymap= and font=.
+type InputLocale struct {
+	Keymap string `yaml:"keymap"` // e.g. "de"; on Alpine a kbd-bkeymaps name such as "fr-latin1"
+	Font   string `yaml:"font"`   // console font, e.g. "ter-v16n"; default: the distribution's
+	Label  string `yaml:"label"`  // menu label; defaults to the keymap
+}
+
+// MenuLabel returns the boot menu label of the entry.
+func (in InputLocale) MenuLabel() string {
+	if in.Label != "" {
+		return in.Label
+	}
+	return in.Keymap
+}
+
+// Firstboot configures interactive setup on the image's first boot.
+type Firstboot struct {
+	Wizard   bool   `yaml:"wizard"`   // ask for hostname, password, network and keyboard on tty1
+	Language string `yaml:"language"` // wizard language: "en" (default), "de", "fr" or "es"
+}
+
+// Provision holds user scripts the image runs on its own.
+type Provision struct {
+	FirstBoot []ProvisionScript `yaml:"first_boot"` // run once, in order, on the first boot
+}
+
+// ProvisionScript is a shell script installed into the image.
+type ProvisionScript struct {
+	Script  string `yaml:"script"`  // path to the script, relative to the config file
+	Network bool   `yaml:"network"` // run once the network is up
 }
 
 // Distro defines the target operating system.
 type Distro struct {
-	Base string `yaml:"base"` // "alpine" or "fedora"
-	Type string `yaml:"type"` // "server" or "workstation" (fedora only)
+	Base    string `yaml:"base"`    // "alpine", "fedora" or "debian"
+	Type    string `yaml:"type"`    // "server" or "workstation" (fedora and debian only)
+	Version string `yaml:"version"` // alpine only: "3.20", "edge"; default latest-stable
+	Kernel  string `yaml:"kernel"`  // alpine only: "lts", "virt" or "edge"; default lts, or virt with target vm
+
+	Mirror       string       `yaml:"mirror"`       // alpine only: mirror base URL; default https://dl-cdn.alpinelinux.org/alpine
+	Repositories []Repository `yaml:"repositories"` // alpine only: apk repositories added after main and community
+	// LocalMirror is a directory laid out like an Alpine mirror
+	// (<branch>/main/<arch>/APKINDEX.tar.gz, ...), relative to the config.
+	// Builds install the main and community packages from it instead of
+	// Mirror, which the image's repositories still name; alpine only.
+	LocalMirror string `yaml:"local_mirror"`
+}
+
+// Repository is an extra apk repository, such as a private one. Key names
+// the public key its indexes and packages are signed with; apk finds the
+// key by its file name, so it must keep the name it was generated with.
+type Repository struct {
+	URL string `yaml:"url"`
+	Key string `yaml:"key"` // e.g. "keys/builder-6543a1b2.rsa.pub"; not needed for mirrors of Alpine's repositories
+}
+
+// AlpineBranch returns the Alpine mirror branch directory for the pinned
+// version: "v3.20", "edge", or "latest-stable" when no version is set.
+func (d Distro) AlpineBranch() string {
+	switch {
+	case d.Version == "":
+		return "latest-stable"
+	case d.Version == "edge" || strings.HasPrefix(d.Version, "v"):
+		return d.Version
+	default:
+		return "v" + d.Version
+	}
 }
 
 // User defines a system user to create.
 type User struct {
-	Name     string `yaml:"name"`
-	Password string `yaml:"password"`
+	Name              string   `yaml:"name"`
+	Password          string   `yaml:"password"`            // optional when ssh_authorized_keys is set
+	PasswordHash      string   `yaml:"password_hash"`       // crypt(3) hash, e.g. from "mkpasswd -m sha-512"
+	PasswordEnv       string   `yaml:"password_env"`        // environment variable holding the password
+	PasswordFile      string   `yaml:"password_file"`       // file holding the password, relative to the config file
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"` // written to ~/.ssh/authorized_keys
+	Shell             string   `yaml:"shell"`               // login shell; defaults to /bin/bash
+	Groups            []string `yaml:"groups"`              // supplementary groups, created if missing
+	Sudo              bool     `yaml:"sudo"`                // grant root via doas (Alpine) or sudo
+}
+
+// HasPassword reports whether the user has a password in any of the ways
+// one can be given.
+func (u User) HasPassword() bool {
+	return u.Password != "" || u.PasswordHash != "" || u.PasswordEnv != "" || u.PasswordFile != ""
+}
+
+// LoginShell returns the user's login shell, defaulting to /bin/bash.
+func (u User) LoginShell() string {
+	if u.Shell == "" {
+		return "/bin/bash"
+	}
+	return u.Shell
+}
+
+// File is a file or directory tree copied into the rootfs after package
+// installation. Exactly one of Source or Content must be set.
+type File struct {
+	Path    string `yaml:"path"`    // absolute destination inside the rootfs
+	Source  string `yaml:"source"`  // host file or directory, relative to the config file
+	Content string `yaml:"content"` // inline file contents
+	Mode    string `yaml:"mode"`    // octal permissions, e.g. "0644"
+	Owner   string `yaml:"owner"`   // "user[:group]", resolved inside the rootfs
+}
+
+// Hooks are user scripts run at fixed stages of the build pipeline.
+type Hooks struct {
+	PostPackages []Hook `yaml:"post_packages"` // after package installation
+	PreISO       []Hook `yaml:"pre_iso"`       // before the rootfs is packaged
+	PostBuild    []Hook `yaml:"post_build"`    // after the artifact is written (host only)
+}
+
+// Hook is a single shell script run by a build stage.
+type Hook struct {
+	Script string `yaml:"script"` // path to the script, relative to the config file
+	Chroot bool   `yaml:"chroot"` // run inside the rootfs instead of on the host
 }
 
 // Services controls which services are enabled at boot.
 type Services struct {
-	Enable []string `yaml:"enable"`
+	Enable  []string `yaml:"enable"`
+	Disable []string `yaml:"disable"` // services installed enabled by their packages
+	// Runlevels puts services of Enable in an OpenRC runlevel other than
+	// "default" (Alpine only), e.g. {"dmesg": "sysinit"}.
+	Runlevels map[string]string `yaml:"runlevels"`
+}
+
+// ServiceRunlevels are the OpenRC runlevels services.runlevels accepts.
+var ServiceRunlevels = []string{"sysinit", "boot", "default"}
+
+// Runlevel returns the OpenRC runlevel service is enabled in, defaulting
+// to "default".
+func (s Services) Runlevel(service string) string {
+	if rl := s.Runlevels[service]; rl != "" {
+		return rl
+	}
+	return "default"
 }
 
 // Build controls engine behaviour during artifact generation.
 type Build struct {
-	SBOM     bool   `yaml:"sbom"`
-	Output   string `yaml:"output"`    // "iso" (default) or "disk" (qcow2)
-	DiskSize string `yaml:"disk_size"` // e.g. "8G"; defaults to "4G"
+	SBOM      bool   `yaml:"sbom"`
+	SBOMFiles bool   `yaml:"sbom_files"` // list each package's files with hashes (alpine only); implies sbom
+	VulnScan  bool   `yaml:"vulnscan"`   // report known CVEs in installed packages (alpine only)
+	FailOn    string `yaml:"fail_on"`    // abort on CVEs of this severity or worse; implies vulnscan
+	Output    string `yaml:"output"`     // "iso" (default), "qcow2", "raw", "disk" (= qcow2), "netboot" or "oci"
+	DiskSize  string `yaml:"disk_size"`  // e.g. "8G"; defaults to "4G"
+
+	// Filesystem selects the root filesystem for disk outputs:
+	// "ext4" (default) or "btrfs" (with @ and @var subvolumes).
+	Filesystem string `yaml:"filesystem"`
+	// Compression is the btrfs transparent compression algorithm
+	// (e.g. "zstd", "lzo", "zlib"). Empty disables compression.
+	Compression string `yaml:"compression"`
+
+	// Squashfs tunes the compression of the root filesystem of iso and
+	// netboot outputs.
+	Squashfs *Squashfs `yaml:"squashfs"`
+	// CompressThreads is the number of CPUs DistroRun compresses the
+	// initramfs and OCI layers with; 0 uses every CPU.
+	CompressThreads int `yaml:"compress_threads"`
+
+	// Limits lowers the priority of the processes doing the heavy lifting:
+	// mksquashfs, xorriso and the package managers.
+	Limits *Limits `yaml:"limits"`
+
+	// Network runs the build's network access through a logging proxy in a
+	// network namespace of its own.
+	Network *BuildNetwork `yaml:"network"`
+
+	// KeepIdentity disables clearing /etc/machine-id, SSH host keys and
+	// random seeds from the image. Leave false unless the image is only ever
+	// deployed to a single machine.
+	KeepIdentity bool `yaml:"keep_identity"`
+
+	// NetbootBaseURL is the HTTP URL the netboot output directory is served
+	// under. It may reference iPXE settings, e.g. "http://${next-server}/os".
+	NetbootBaseURL string `yaml:"netboot_base_url"`
+	// NetbootEmbed puts the root filesystem of netboot outputs in the
+	// initramfs instead of having the live init fetch it over HTTP.
+	NetbootEmbed bool `yaml:"netboot_embed"`
+
+	// Image is the OCI image reference for oci outputs, e.g.
+	// "registry.example.com/team/os:1.0". Defaults to "<name>:latest".
+	Image string `yaml:"image"`
+	// Push uploads the OCI image to the registry named in Image.
+	Push bool `yaml:"push"`
+	// LayerCompression compresses the layer of oci outputs: "gzip" (the
+	// default) or "zstd", which is faster to write and needs docker 23 or
+	// podman 4 to load.
+	LayerCompression string `yaml:"layer_compression"`
+
+	// NonfatalScripts lists apk packages whose install scripts and triggers
+	// may fail without failing the build (alpine only).
+	NonfatalScripts []string `yaml:"nonfatal_scripts"`
+
+	// Reproducible builds from the lock file written by "distrorun lock":
+	// the same config and lock produce a byte-identical image.
+	Reproducible bool `yaml:"reproducible"`
+}
+
+// Squashfs configures mksquashfs. zstd compresses several times faster
+// than xz and decompresses faster at boot, for a slightly larger image.
+type Squashfs struct {
+	Compression string `yaml:"compression"` // "xz" (default), "zstd", "gzip" or "lz4"
+	Level       int    `yaml:"level"`       // zstd 1-22, gzip 1-9; 0 keeps the mksquashfs default
+	Threads     int    `yaml:"threads"`     // compressor threads; 0 uses every CPU
+}
+
+// Limits keeps a build from starving other workloads on a shared host.
+// Fields left empty leave that resource unrestricted.
+type Limits struct {
+	Nice   int    `yaml:"nice"`   // scheduling niceness, 1-19
+	CPUs   string `yaml:"cpus"`   // CPUs to run on, e.g. "0-3,6"
+	Memory string `yaml:"memory"` // memory limit, e.g. "4G"; needs cgroup v2
+	IO     string `yaml:"io"`     // I/O priority: "idle" or "low"
+}
+
+// LimitIOClasses are the values of build.limits.io: "idle" only uses the
+// disk when nothing else does, "low" is the lowest best-effort priority.
+var LimitIOClasses = []string{"idle", "low"}
+
+// BuildNetwork makes a build's network access reviewable: the package
+// managers, hooks and downloads of the build reach the network only
+// through a proxy that logs every request, and with Allow only the hosts
+// listed.
+type BuildNetwork struct {
+	Capture bool     `yaml:"capture"` // log every request to <output>-network.jsonl
+	Allow   []string `yaml:"allow"`   // hosts the build may reach, e.g. "dl-cdn.alpinelinux.org" or "*.debian.org"; implies capture
+}
+
+// maxCPU is the highest CPU number a CPU list may name.
+const maxCPU = 1023
+
+// ParseCPUList parses a CPU list such as "0-3,6", the format of taskset -c
+// and cpusets, into CPU numbers.
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 0 || last < first || last > maxCPU {
+			return nil, fmt.Errorf("CPU list %q is invalid: use CPU numbers from 0 to %d and ranges such as \"0-3,6\"", s, maxCPU)
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// SquashfsCompressions are the values of build.squashfs.compression.
+var SquashfsCompressions = []string{"xz", "zstd", "gzip", "lz4"}
+
+// squashfsMaxLevel is the highest build.squashfs.level of each compression;
+// xz and lz4 have no levels in mksquashfs.
+var squashfsMaxLevel = map[string]int{"zstd": 22, "gzip": 9}
+
+// Target is a destination that build artifacts are uploaded to after a
+// successful build. Credentials are never read from the config file.
+type Target struct {
+	Type string `yaml:"type"` // "s3", "sftp" or "http"
+	// URL is the S3 endpoint (e.g. "https://s3.eu-west-1.amazonaws.com"),
+	// the SFTP destination ("user@host") or the HTTP base URL.
+	URL    string `yaml:"url"`
+	Bucket string `yaml:"bucket"` // s3 only
+	Region string `yaml:"region"` // s3 only; defaults to "us-east-1"
+	// Path is the remote path template. Supported placeholders are {name},
+	// {version}, {channel}, {date} and {file}. Defaults to "{name}/{file}".
+	Path string `yaml:"path"`
+	// TokenEnv names an environment variable holding a bearer token for
+	// http targets.
+	TokenEnv string `yaml:"token_env"`
+	Retries  int    `yaml:"retries"` // attempts per file; defaults to 3
+	// PublicURL is the base URL clients download the published files
+	// from, listed in the channel manifest. Defaults to URL for http
+	// targets.
+	PublicURL string `yaml:"public_url"`
+	// SigningKey is a file holding the base64 Ed25519 private key the
+	// channel manifest is signed with, relative to the config file;
+	// SigningKeyEnv names an environment variable holding it instead.
+	SigningKey    string `yaml:"signing_key"`
+	SigningKeyEnv string `yaml:"signing_key_env"`
+}
+
+// DownloadURL returns the base URL the files of t are downloaded from,
+// or "" when it is not known.
+func (t Target) DownloadURL() string {
+	if t.PublicURL != "" {
+		return t.PublicURL
+	}
+	if t.Type == "http" {
+		return t.URL
+	}
+	return ""
 }
 
 // SBOMEnabled returns true if the user requested SBOM generation.
 func (c *Config) SBOMEnabled() bool {
-	return c.Build != nil && c.Build.SBOM
+	return c.Build != nil && (c.Build.SBOM || c.Build.SBOMFiles)
+}
+
+// SBOMFiles reports whether the SBOM lists the hashed files of each package.
+func (c *Config) SBOMFiles() bool {
+	return c.Build != nil && c.Build.SBOMFiles
+}
+
+// NonfatalScripts returns the packages whose script failures are ignored.
+func (c *Config) NonfatalScripts() []string {
+	if c.Build == nil {
+		return nil
+	}
+	return c.Build.NonfatalScripts
+}
+
+// Reproducible returns true if the build must follow the config's lock file.
+func (c *Config) Reproducible() bool {
+	return c.Build != nil && c.Build.Reproducible
+}
+
+// VulnScanEnabled returns true if a vulnerability scan was requested, either
+// directly or through a build.fail_on policy.
+func (c *Config) VulnScanEnabled() bool {
+	return c.Build != nil && (c.Build.VulnScan || c.Build.FailOn != "")
 }
 
 // OutputMode returns the resolved output mode, defaulting to "iso".
+// The "qcow2" and "raw" formats both resolve to "disk".
 func (c *Config) OutputMode() string {
-	if c.Build != nil && c.Build.Output == "disk" {
+	if c.Build == nil {
+		return "iso"
+	}
+	switch c.Build.Output {
+	case "disk", "qcow2", "raw":
 		return "disk"
+	case "netboot":
+		return "netboot"
+	case "oci":
+		return "oci"
 	}
 	return "iso"
 }
 
+// LayerCompression returns build.layer_compression, defaulting to "gzip".
+func (c *Config) LayerCompression() string {
+	if c.Build == nil || c.Build.LayerCompression == "" {
+		return "gzip"
+	}
+	return c.Build.LayerCompression
+}
+
+// ImageRef returns the OCI image reference, defaulting to "<name>:latest"
+// with the name lower-cased as registries require.
+func (c *Config) ImageRef() string {
+	if c.Build != nil && c.Build.Image != "" {
+		return c.Build.Image
+	}
+	return strings.ToLower(c.Name) + ":latest"
+}
+
+// DiskFormat returns the disk image format for disk outputs: "raw" or "qcow2".
+func (c *Config) DiskFormat() string {
+	if c.Build != nil && c.Build.Output == "raw" {
+		return "raw"
+	}
+	return "qcow2"
+}
+
 // DiskSize returns the configured disk size, defaulting to "4G".
 func (c *Config) DiskSize() string {
 	if c.Build != nil && c.Build.DiskSize != "" {
@@ -64,6 +916,92 @@ func (c *Config) DiskSize() string {
 	return "4G"
 }
 
+// RootFilesystem returns the root filesystem for disk outputs, defaulting to "ext4".
+func (c *Config) RootFilesystem() string {
+	if c.Build != nil && c.Build.Filesystem != "" {
+		return c.Build.Filesystem
+	}
+	return "ext4"
+}
+
+// RootCompression returns the btrfs compression algorithm, or "" when disabled.
+func (c *Config) RootCompression() string {
+	if c.Build != nil && c.RootFilesystem() == "btrfs" {
+		return c.Build.Compression
+	}
+	return ""
+}
+
+// SquashfsSettings returns build.squashfs with the compression defaulted
+// to xz.
+func (c *Config) SquashfsSettings() Squashfs {
+	var sq Squashfs
+	if c.Build != nil && c.Build.Squashfs != nil {
+		sq = *c.Build.Squashfs
+	}
+	if sq.Compression == "" {
+		sq.Compression = "xz"
+	}
+	return sq
+}
+
+// ResetIdentity returns true unless the user opted out of per-machine identity
+// regeneration with build.keep_identity.
+func (c *Config) ResetIdentity() bool {
+	return c.Build == nil || !c.Build.KeepIdentity
+}
+
+// WizardEnabled returns true when the first-boot wizard is requested.
+func (c *Config) WizardEnabled() bool {
+	return c.Firstboot != nil && c.Firstboot.Wizard
+}
+
+// WatchdogEnabled returns true when system.watchdog is enabled.
+func (c *Config) WatchdogEnabled() bool {
+	return c.System != nil && c.System.Watchdog != nil && c.System.Watchdog.Enabled
+}
+
+// Hostname returns system.hostname, defaulting to the name of the first
+// user.
+func (c *Config) Hostname() string {
+	if c.System != nil && c.System.Hostname != "" {
+		return c.System.Hostname
+	}
+	if len(c.Users) > 0 {
+		return c.Users[0].Name
+	}
+	return c.Name
+}
+
+// CloudInitEnabled returns true when cloud_init is enabled.
+func (c *Config) CloudInitEnabled() bool {
+	return c.CloudInit != nil && c.CloudInit.Enabled
+}
+
+// ManagementEnabled returns true when the management block enables anything.
+func (c *Config) ManagementEnabled() bool {
+	m := c.Management
+	return m != nil && (m.MDNS || m.SSH || m.WebAdmin)
+}
+
+// KernelCmdline returns the kernel parameters for the boot configuration,
+// defaulting to "quiet". boot.persistence adds "distrorun.persist", which
+// tells the live init to look for a persistence partition.
+func (c *Config) KernelCmdline() string {
+	cmdline := "quiet"
+	if c.Boot != nil && c.Boot.Cmdline != "" {
+		cmdline = c.Boot.Cmdline
+	}
+	if c.Boot != nil && c.Boot.Persistence {
+		cmdline += " distrorun.persist"
+	}
+	if c.Target == "vm" && !strings.Contains(cmdline, "console=") {
+		// The serial console last, so it is /dev/console.
+		cmdline += " console=tty0 console=ttyS0,115200"
+	}
+	return cmdline
+}
+
 // LoadConfig reads a YAML file at path and returns a parsed Config.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -71,14 +1009,102 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	// Older schema versions are upgraded before the document is decoded.
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
 		return nil, fmt.Errorf("parsing YAML: %w", err)
 	}
+	var cfg Config
+	if len(root.Content) > 0 {
+		var version string
+		if v := mappingValue(root.Content[0], "version"); v != nil {
+			version = v.Value
+		}
+		var e edits
+		from, err := migrate(root.Content[0], &e)
+		if err != nil {
+			return nil, err
+		}
+		if err := root.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("parsing YAML: %w", err)
+		}
+		// Version keeps the value written in the file.
+		cfg.Version = version
+		cfg.schemaVersion, cfg.migrationNotes = from, e.notes
+	}
+	if err := cfg.applyAddons(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	cfg.applyProfile()
+	cfg.translatePackages()
+	if cfg.Services != nil {
+		cfg.Services.translate(cfg.Distro.Base)
+	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
+	// Resolve overlay sources relative to the config file so builds do not
+	// depend on the caller's working directory.
+	for i, f := range cfg.Files {
+		if f.Source != "" && !filepath.IsAbs(f.Source) {
+			cfg.Files[i].Source = filepath.Join(filepath.Dir(path), f.Source)
+		}
+	}
+	for i, t := range cfg.Publish {
+		if t.SigningKey != "" && !filepath.IsAbs(t.SigningKey) {
+			cfg.Publish[i].SigningKey = filepath.Join(filepath.Dir(path), t.SigningKey)
+		}
+	}
+	for i, u := range cfg.Users {
+		if u.PasswordFile != "" && !filepath.IsAbs(u.PasswordFile) {
+			cfg.Users[i].PasswordFile = filepath.Join(filepath.Dir(path), u.PasswordFile)
+		}
+	}
+	if cfg.VPN != nil && cfg.VPN.WireGuard != nil {
+		wg := cfg.VPN.WireGuard
+		for _, p := range []*string{&wg.ConfigFile, &wg.PrivateKeyFile} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(filepath.Dir(path), *p)
+			}
+		}
+	}
+	if m := cfg.Distro.LocalMirror; m != "" && !filepath.IsAbs(m) {
+		cfg.Distro.LocalMirror = filepath.Join(filepath.Dir(path), m)
+	}
+	for i, r := range cfg.Distro.Repositories {
+		if r.Key != "" && !filepath.IsAbs(r.Key) {
+			cfg.Distro.Repositories[i].Key = filepath.Join(filepath.Dir(path), r.Key)
+		}
+	}
+	if cfg.Hooks != nil {
+		for _, stage := range [][]Hook{cfg.Hooks.PostPackages, cfg.Hooks.PreISO, cfg.Hooks.PostBuild} {
+			for i, h := range stage {
+				if h.Script != "" && !filepath.IsAbs(h.Script) {
+					stage[i].Script = filepath.Join(filepath.Dir(path), h.Script)
+				}
+			}
+		}
+	}
+	if cfg.CloudInit != nil && cfg.CloudInit.Seed != nil {
+		seed := cfg.CloudInit.Seed
+		for _, p := range []*string{&seed.UserData, &seed.NetworkConfig} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(filepath.Dir(path), *p)
+			}
+		}
+	}
+	if cfg.Branding != nil && cfg.Branding.Splash != "" && !filepath.IsAbs(cfg.Branding.Splash) {
+		cfg.Branding.Splash = filepath.Join(filepath.Dir(path), cfg.Branding.Splash)
+	}
+	if cfg.Provision != nil {
+		for i, ps := range cfg.Provision.FirstBoot {
+			if ps.Script != "" && !filepath.IsAbs(ps.Script) {
+				cfg.Provision.FirstBoot[i].Script = filepath.Join(filepath.Dir(path), ps.Script)
+			}
+		}
+	}
+
 	return &cfg, nil
 }
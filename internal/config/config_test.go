@@ -1,10 +1,13 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func writeTemp(t *testing.T, content string) string {
@@ -80,21 +83,417 @@ func TestLoadConfig_UnsupportedDistro(t *testing.T) {
 version: "1"
 name: test
 distro:
-  base: fedora
-  type: server
+  base: gentoo
 users:
   - name: root
     password: toor
 `
 	_, err := LoadConfig(writeTemp(t, yaml))
 	if err == nil {
-		t.Fatal("expected error for fedora, got nil")
+		t.Fatal("expected error for gentoo, got nil")
 	}
 	if !strings.Contains(err.Error(), "unsupported distro") {
 		t.Errorf("error should mention unsupported distro, got: %v", err)
 	}
 }
 
+func TestLoadConfig_Debian(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: debian
+  type: workstation
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Distro.Base != "debian" {
+		t.Errorf("expected base 'debian', got %q", cfg.Distro.Base)
+	}
+}
+
+func TestLoadConfig_AlpineVersion(t *testing.T) {
+	for version, want := range map[string]string{
+		"":      "latest-stable",
+		"3.20":  "v3.20",
+		"v3.19": "v3.19",
+		"edge":  "edge",
+	} {
+		d := Distro{Base: "alpine", Version: version}
+		if got := d.AlpineBranch(); got != want {
+			t.Errorf("AlpineBranch(%q) = %q, want %q", version, got, want)
+		}
+	}
+
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+  version: "3"
+users:
+  - name: root
+    password: toor
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil || !strings.Contains(err.Error(), "distro.version") {
+		t.Errorf("expected distro.version error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_DistroKernel(t *testing.T) {
+	base := `
+version: "1"
+name: test
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"distro:\n  base: alpine\n  kernel: virt\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Distro.Kernel != "virt" {
+		t.Errorf("Kernel = %q, want virt", cfg.Distro.Kernel)
+	}
+
+	for extra, want := range map[string]string{
+		"distro:\n  base: alpine\n  kernel: rt\n":                          `distro.kernel "rt" is invalid: must be one of lts, virt, edge`,
+		"distro:\n  base: debian\n  kernel: lts\n":                         `distro.kernel is only supported for distro.base "alpine"`,
+		"distro:\n  base: alpine\n  kernel: edge\nbuild:\n  output: oci\n": `distro.kernel is not supported for build.output "oci"`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+extra))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Firstboot(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+firstboot:
+  wizard: true
+  language: de
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.WizardEnabled() || cfg.Firstboot.Language != "de" {
+		t.Errorf("firstboot not parsed: %+v", cfg.Firstboot)
+	}
+
+	_, err = LoadConfig(writeTemp(t, strings.Replace(yaml, "language: de", "language: xx", 1)))
+	if err == nil || !strings.Contains(err.Error(), "firstboot.language") {
+		t.Errorf("expected firstboot.language error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Watchdog(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+system:
+  watchdog:
+    enabled: true
+    restart_services: true
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := cfg.System.Watchdog
+	if !cfg.WatchdogEnabled() || w.KernelModule() != "softdog" || w.TimeoutSeconds() != 60 || !w.RestartServices {
+		t.Errorf("watchdog not parsed: %+v", w)
+	}
+
+	_, err = LoadConfig(writeTemp(t, yaml+"    module: \"soft dog\"\n    timeout: -5\n"))
+	if err == nil || !strings.Contains(err.Error(), "system.watchdog.module") || !strings.Contains(err.Error(), "system.watchdog.timeout") {
+		t.Errorf("expected module and timeout errors, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Network(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+network:
+  interfaces:
+    - name: eth0
+    - name: eth1
+    - name: bond0
+      type: bond
+      bond_members: [eth0, eth1]
+    - name: br0
+      type: bridge
+      bridge_ports: [bond0]
+      address: 192.168.1.10/24
+      gateway: 192.168.1.1
+    - name: br0.100
+      type: vlan
+      vlan_id: 100
+      vlan_link: br0
+      dhcp: true
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ifaces := cfg.Network.Interfaces
+	if len(ifaces) != 5 || ifaces[0].InterfaceType() != "ethernet" || ifaces[2].Mode() != "active-backup" || ifaces[4].VLANID != 100 {
+		t.Errorf("interfaces not parsed: %+v", ifaces)
+	}
+
+	invalid := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+network:
+  interfaces:
+    - name: bond0
+      type: bond
+      bond_mode: fastest
+      dhcp: true
+      address: 10.0.0.1
+    - name: eth0.5000
+      type: vlan
+      vlan_id: 5000
+    - name: eth1
+      bridge_ports: [eth2]
+`
+	_, err = LoadConfig(writeTemp(t, invalid))
+	if err == nil {
+		t.Fatal("expected error for invalid interfaces, got nil")
+	}
+	for _, want := range []string{"bond_members", "bond_mode", "mutually exclusive", "CIDR", "vlan_id", "vlan_link", "bridge_ports requires"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_NetworkWirelessDNS(t *testing.T) {
+	base := `
+version: "2"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+network:
+`
+	cfg, err := LoadConfig(writeTemp(t, base+`  interfaces:
+    - name: wlan0
+      type: wireless
+      ssid: office
+      passphrase: correct-horse
+      dhcp: true
+  dns: [1.1.1.1, "2606:4700:4700::1111"]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w := cfg.Network.Interfaces[0]; w.SSID != "office" || len(cfg.Network.DNS) != 2 {
+		t.Errorf("network not parsed: %+v", cfg.Network)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`  interfaces:
+    - name: wlan0
+      type: wireless
+      passphrase: short
+    - name: wlan1
+      type: wireless
+      ssid: "a\"b"
+    - name: eth0
+      ssid: office
+  dns: [dns.example.com]
+`))
+	for _, want := range []string{
+		`network.interfaces[0]: wireless requires an "ssid"`,
+		"network.interfaces[0]: passphrase must be 8 to 63 characters",
+		"network.interfaces[1]: ssid and passphrase must not contain quotes",
+		"network.interfaces[2]: ssid and passphrase require type: wireless",
+		"only one wireless interface is supported",
+		`network.dns[0]: "dns.example.com" is not an IP address`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_FailOn(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  fail_on: critical
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.VulnScanEnabled() {
+		t.Error("fail_on should enable the vulnerability scan")
+	}
+
+	_, err = LoadConfig(writeTemp(t, strings.Replace(yaml, "critical", "severe", 1)))
+	if err == nil || !strings.Contains(err.Error(), "build.fail_on") {
+		t.Errorf("expected build.fail_on error, got: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, strings.Replace(yaml, "base: alpine", "base: debian", 1)))
+	if err == nil || !strings.Contains(err.Error(), "only supported for distro.base") {
+		t.Errorf("expected alpine-only error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_AP(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+ap:
+  ssid: testap
+  passphrase: secret123
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, last := cfg.AP.Range()
+	if cfg.AP.WirelessInterface() != "wlan0" || cfg.AP.WirelessChannel() != 6 || first != "192.168.4.10" || last != "192.168.4.100" {
+		t.Errorf("ap defaults not applied: %+v", cfg.AP)
+	}
+
+	invalid := strings.Replace(yaml, "passphrase: secret123", "passphrase: short\n  channel: 20\n  address: 10.0.0.1/24\n  dhcp_range: 10.0.1.10-10.0.1.20", 1)
+	_, err = LoadConfig(writeTemp(t, invalid))
+	if err == nil {
+		t.Fatal("expected error for invalid ap, got nil")
+	}
+	for _, want := range []string{"ap.passphrase", "ap.channel", "ap.dhcp_range"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_OCI(t *testing.T) {
+	yaml := `
+version: "1"
+name: TestOS
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  output: oci
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.OutputMode() != "oci" || cfg.ImageRef() != "testos:latest" || cfg.LayerCompression() != "gzip" {
+		t.Errorf("got output %q, image %q, layer compression %q", cfg.OutputMode(), cfg.ImageRef(), cfg.LayerCompression())
+	}
+	cfg, err = LoadConfig(writeTemp(t, yaml+"  layer_compression: zstd\n"))
+	if err != nil || cfg.LayerCompression() != "zstd" {
+		t.Errorf("layer_compression: zstd: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, yaml+"  layer_compression: xz\n"))
+	if err == nil || !strings.Contains(err.Error(), `build.layer_compression "xz" is invalid`) {
+		t.Errorf("expected build.layer_compression error, got: %v", err)
+	}
+
+	_, err = LoadConfig(writeTemp(t, yaml+"  push: true\n"))
+	if err == nil || !strings.Contains(err.Error(), "build.push requires build.image") {
+		t.Errorf("expected build.push error, got: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, strings.Replace(yaml, "output: oci", "image: os:1.0", 1)))
+	if err == nil || !strings.Contains(err.Error(), "require build.output: oci") {
+		t.Errorf("expected build.image error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_WireGuard(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+vpn:
+  wireguard:
+    private_key_file: secrets/wg0.key
+    address: [10.8.0.2/24]
+    peers:
+      - public_key: xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+        endpoint: vpn.example.com:51820
+        allowed_ips: [10.8.0.0/24]
+`
+	path := writeTemp(t, yaml)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wg := cfg.VPN.WireGuard
+	if wg.InterfaceName() != "wg0" || wg.PrivateKeyFile != filepath.Join(filepath.Dir(path), "secrets/wg0.key") {
+		t.Errorf("wireguard not parsed: %+v", wg)
+	}
+
+	invalid := strings.NewReplacer(
+		"private_key_file: secrets/wg0.key", "config_file: wg0.conf",
+		"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "not-a-key",
+	).Replace(yaml)
+	_, err = LoadConfig(writeTemp(t, invalid))
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+		t.Errorf("expected config_file conflict, got: %v", err)
+	}
+	invalid = strings.Replace(yaml, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "not-a-key", 1)
+	_, err = LoadConfig(writeTemp(t, invalid))
+	if err == nil || !strings.Contains(err.Error(), "public_key is not a WireGuard key") {
+		t.Errorf("expected public_key error, got: %v", err)
+	}
+}
+
 func TestLoadConfig_EmptyUsers(t *testing.T) {
 	yaml := `
 version: "1"
@@ -129,3 +528,1711 @@ users:
 		t.Errorf("error should mention password, got: %v", err)
 	}
 }
+
+func TestLoadConfig_UserKeysGroupsSudo(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: admin
+    ssh_authorized_keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ3x admin@laptop
+    shell: /bin/ash
+    groups: [wheel, netdev]
+    sudo: true
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	u := cfg.Users[0]
+	if !u.Sudo || len(u.Groups) != 2 || len(u.SSHAuthorizedKeys) != 1 {
+		t.Errorf("user fields not parsed: %+v", u)
+	}
+	if u.LoginShell() != "/bin/ash" {
+		t.Errorf("expected shell /bin/ash, got %q", u.LoginShell())
+	}
+}
+
+func TestLoadConfig_UserInvalid(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: admin
+    ssh_authorized_keys: ["not-a-key"]
+    shell: bash
+    groups: ["Bad Group"]
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for invalid user, got nil")
+	}
+	for _, want := range []string{"OpenSSH public key", "must be an absolute path", "not a valid group name"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_BtrfsFilesystem(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: fedora
+users:
+  - name: root
+    password: toor
+build:
+  output: disk
+  filesystem: btrfs
+  compression: zstd
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RootFilesystem() != "btrfs" {
+		t.Errorf("RootFilesystem() = %q, want %q", cfg.RootFilesystem(), "btrfs")
+	}
+	if cfg.RootCompression() != "zstd" {
+		t.Errorf("RootCompression() = %q, want %q", cfg.RootCompression(), "zstd")
+	}
+}
+
+func TestLoadConfig_CompressionRequiresBtrfs(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  compression: zstd
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for compression without btrfs, got nil")
+	}
+	if !strings.Contains(err.Error(), "requires build.filesystem: btrfs") {
+		t.Errorf("error should mention btrfs requirement, got: %v", err)
+	}
+}
+
+func TestLoadConfig_FilesystemRequiresDisk(t *testing.T) {
+	for _, output := range []string{"iso", "netboot"} {
+		yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  output: ` + output + `
+  filesystem: ext4
+`
+		_, err := LoadConfig(writeTemp(t, yaml))
+		if err == nil {
+			t.Fatalf("output %s: expected error for build.filesystem, got nil", output)
+		}
+		if !strings.Contains(err.Error(), "build.filesystem is only supported for disk outputs") {
+			t.Errorf("output %s: error should reject build.filesystem, got: %v", output, err)
+		}
+	}
+}
+
+func TestLoadConfig_Squashfs(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SquashfsSettings().Compression; got != "xz" {
+		t.Errorf("default compression = %q, want xz", got)
+	}
+
+	cfg, err = LoadConfig(writeTemp(t, base+"build:\n  squashfs:\n    compression: zstd\n    level: 19\n    threads: 4\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.SquashfsSettings(); got != (Squashfs{Compression: "zstd", Level: 19, Threads: 4}) {
+		t.Errorf("SquashfsSettings() = %+v", got)
+	}
+
+	for yaml, want := range map[string]string{
+		"compression: brotli":              `build.squashfs.compression "brotli" is invalid`,
+		"compression: gzip\n    level: 12": "build.squashfs.level 12 is out of range for gzip: must be 1-9",
+		"level: 6":                         "build.squashfs.level is not supported for xz compression",
+		"threads: -1":                      "build.squashfs.threads -1 must not be negative",
+	} {
+		_, err := LoadConfig(writeTemp(t, base+"build:\n  squashfs:\n    "+yaml+"\n"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+	_, err = LoadConfig(writeTemp(t, base+"build:\n  output: qcow2\n  squashfs:\n    compression: zstd\n"))
+	if err == nil || !strings.Contains(err.Error(), "build.squashfs is only supported for iso and netboot outputs") {
+		t.Errorf("error should reject squashfs for disk images, got: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, base+"build:\n  compress_threads: -2\n"))
+	if err == nil || !strings.Contains(err.Error(), "build.compress_threads -2 must not be negative") {
+		t.Errorf("error should reject negative compress_threads, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Limits(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  limits:
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"    nice: 10\n    cpus: 0-3,6\n    memory: 4G\n    io: idle\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := *cfg.Build.Limits; got != (Limits{Nice: 10, CPUs: "0-3,6", Memory: "4G", IO: "idle"}) {
+		t.Errorf("Limits = %+v", got)
+	}
+
+	for yaml, want := range map[string]string{
+		"nice: 20":     "build.limits.nice 20 is out of range: must be 1-19",
+		"cpus: 3-1":    `build.limits.cpus: CPU list "3-1" is invalid`,
+		"cpus: 1024":   `build.limits.cpus: CPU list "1024" is invalid`,
+		"memory: 128M": `build.limits.memory "128M" is too small`,
+		"memory: lots": `build.limits.memory: size "lots" is invalid`,
+		"io: realtime": `build.limits.io "realtime" is invalid: must be one of idle, low`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+"    "+yaml+"\n"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+}
+
+func TestLoadConfig_BuildNetwork(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  network:
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"    allow: [dl-cdn.alpinelinux.org, \"*.debian.org\"]\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Build.Network.Allow; !slices.Equal(got, []string{"dl-cdn.alpinelinux.org", "*.debian.org"}) {
+		t.Errorf("Allow = %q", got)
+	}
+
+	for yaml, want := range map[string]string{
+		"capture: false":            "build.network needs capture: true or a list of hosts in allow",
+		"allow: [\"http://a.org\"]": `build.network.allow: "http://a.org" is not a hostname`,
+		"allow: [\"a.*.org\"]":      `build.network.allow: "a.*.org" is not a hostname`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+"    "+yaml+"\n"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	got, err := ParseCPUList("0-2, 5,7-7")
+	if err != nil || !slices.Equal(got, []int{0, 1, 2, 5, 7}) {
+		t.Errorf("ParseCPUList = %v, %v", got, err)
+	}
+	for _, s := range []string{"", "a", "-1", "2-", "1,,2"} {
+		if _, err := ParseCPUList(s); err == nil {
+			t.Errorf("ParseCPUList(%q) should fail", s)
+		}
+	}
+}
+
+func TestLoadConfig_PasswordSources(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+`
+	path := writeTemp(t, base+"    password_file: root.pass\n  - name: ops\n    password_hash: $6$salt$hash\n  - name: ci\n    password_env: CI_PASSWORD\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(path), "root.pass"); cfg.Users[0].PasswordFile != want {
+		t.Errorf("password_file = %q, want %q", cfg.Users[0].PasswordFile, want)
+	}
+	for _, u := range cfg.Users {
+		if !u.HasPassword() {
+			t.Errorf("%s: HasPassword() = false", u.Name)
+		}
+	}
+
+	for yaml, want := range map[string]string{
+		"password: a\n    password_env: B": "only one of",
+		"password_hash: plain":             "password_hash is not a crypt(3) hash",
+		"password_hash: $6$a:b":            "password_hash is not a crypt(3) hash",
+		"password_env: 1BAD":               `password_env "1BAD" is not a valid environment variable name`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+"    "+yaml+"\n"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+}
+
+func TestLoadConfig_ArgumentNames(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+`
+	for yaml, want := range map[string]string{
+		"users:\n  - name: -froot\n    password: x\n":                                    "name \"-froot\" is not a valid user name",
+		"users:\n  - name: \"a b\"\n    password: x\n":                                   "name \"a b\" is not a valid user name",
+		"users:\n  - name: root\n    password: x\nservices:\n  enable: [\"--root=/\"]\n": "\"--root=/\" is not a valid service name",
+	} {
+		_, err := LoadConfig(writeTemp(t, base+yaml))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+	_, err := LoadConfig(writeTemp(t, base+"users:\n  - name: Ops_1.x\n    password: x\nservices:\n  enable: [getty@tty2, sshd]\n"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfig_Services(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: %s
+users:
+  - name: root
+    password: toor
+services:
+`
+	cfg, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, "alpine")+"  enable: [sshd, dmesg]\n  disable: [crond]\n  runlevels:\n    dmesg: sysinit\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Services.Runlevel("dmesg"); got != "sysinit" {
+		t.Errorf("Runlevel(dmesg) = %q, want sysinit", got)
+	}
+	if got := cfg.Services.Runlevel("sshd"); got != "default" {
+		t.Errorf("Runlevel(sshd) = %q, want default", got)
+	}
+
+	for yaml, want := range map[string]string{
+		"  enable: [sshd]\n  disable: [sshd]\n":                "sshd is both enabled and disabled",
+		"  enable: [sshd]\n  runlevels:\n    crond: boot\n":    "services.runlevels: crond is not in services.enable",
+		"  enable: [sshd]\n  runlevels:\n    sshd: shutdown\n": `runlevel "shutdown" of sshd is invalid`,
+		"  disable: [\"-a\"]\n":                                `services.disable: "-a" is not a valid service name`,
+	} {
+		_, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, "alpine")+yaml))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+	_, err = LoadConfig(writeTemp(t, fmt.Sprintf(base, "fedora")+"  enable: [sshd]\n  runlevels:\n    sshd: boot\n"))
+	if err == nil || !strings.Contains(err.Error(), "services.runlevels is only supported for alpine") {
+		t.Errorf("error should reject runlevels on fedora, got: %v", err)
+	}
+}
+
+func TestLoadConfig_ServiceNames(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: %s
+users:
+  - name: root
+    password: toor
+services:
+  enable: [ssh, sshd, cron, docker, myapp]
+  disable: [syslog]
+`
+	for distro, want := range map[string][]string{
+		"alpine": {"sshd", "crond", "docker", "myapp", "syslog"},
+		"fedora": {"sshd", "crond", "docker", "myapp", "rsyslog"},
+		"debian": {"ssh", "cron", "docker", "myapp", "rsyslog"},
+	} {
+		cfg, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, distro)))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", distro, err)
+		}
+		if got := slices.Concat(cfg.Services.Enable, cfg.Services.Disable); !slices.Equal(got, want) {
+			t.Errorf("%s: services = %q, want %q", distro, got, want)
+		}
+		if got := cfg.UnknownServices(); !slices.Equal(got, []string{"myapp"}) {
+			t.Errorf("%s: UnknownServices() = %q, want [myapp]", distro, got)
+		}
+	}
+
+	cfg, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, "alpine")+"  runlevels:\n    cron: boot\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Services.Runlevel("crond"); got != "boot" {
+		t.Errorf("Runlevel(crond) = %q, want boot", got)
+	}
+}
+
+func TestLoadConfig_PackageAliases(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: %s
+users:
+  - name: root
+    password: toor
+packages: [curl, iproute2, iproute, py3-requests, editor, sysstat]
+package_aliases:
+  editor:
+    alpine: vim
+    debian: vim-nox
+  sysstat:
+    fedora: ""
+assertions:
+  packages:
+    - name: bind-utils
+`
+	for distro, want := range map[string][]string{
+		"alpine": {"curl", "iproute2", "py3-requests", "vim", "sysstat"},
+		"fedora": {"curl", "iproute", "python3-requests", "editor"},
+		"debian": {"curl", "iproute2", "python3-requests", "vim-nox", "sysstat"},
+	} {
+		cfg, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, distro)))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", distro, err)
+		}
+		if !slices.Equal(cfg.Packages, want) {
+			t.Errorf("%s: packages = %q, want %q", distro, cfg.Packages, want)
+		}
+		if distro == "debian" && cfg.Assertions.Packages[0].Name != "bind9-dnsutils" {
+			t.Errorf("assertion package = %q, want bind9-dnsutils", cfg.Assertions.Packages[0].Name)
+		}
+	}
+
+	_, err := LoadConfig(writeTemp(t, strings.Replace(fmt.Sprintf(base, "alpine"), "alpine: vim", "arch: vim", 1)))
+	if err == nil || !strings.Contains(err.Error(), `package_aliases.editor: unsupported distro base "arch"`) {
+		t.Errorf("expected an unsupported distro error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_SBOMFiles(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: %s
+users:
+  - name: root
+    password: toor
+build:
+  sbom_files: true
+`
+	cfg, err := LoadConfig(writeTemp(t, fmt.Sprintf(base, "alpine")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.SBOMEnabled() || !cfg.SBOMFiles() {
+		t.Errorf("sbom_files: SBOMEnabled() = %v, SBOMFiles() = %v", cfg.SBOMEnabled(), cfg.SBOMFiles())
+	}
+	_, err = LoadConfig(writeTemp(t, fmt.Sprintf(base, "debian")))
+	if err == nil || !strings.Contains(err.Error(), "build.sbom_files is only supported") {
+		t.Errorf("error should reject sbom_files on debian, got: %v", err)
+	}
+}
+
+func TestLoadConfig_PublishSigning(t *testing.T) {
+	base := "version: \"1\"\nname: test\ndistro:\n  base: alpine\nusers:\n  - name: root\n    password: toor\npublish:\n"
+	cfg, err := LoadConfig(writeTemp(t, base+"  - type: s3\n    url: https://s3.example.com\n    bucket: b\n    path: \"{name}/{channel}/{file}\"\n    public_url: https://images.example.com\n    signing_key: keys/channel.key\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tg := cfg.Publish[0]; !filepath.IsAbs(tg.SigningKey) || tg.DownloadURL() != "https://images.example.com" {
+		t.Errorf("target = %+v, want an absolute signing_key and the public_url", tg)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"  - type: http\n    url: https://up.example.com\n    public_url: images.example.com\n    signing_key: k\n    signing_key_env: K\n"))
+	if err == nil {
+		t.Fatal("expected error for invalid signing settings, got nil")
+	}
+	for _, expected := range []string{"public_url \"images.example.com\"", "only one of signing_key and signing_key_env", "needs {channel} in path"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+  flavour: edge
+users:
+  - name: root
+    password: toor
+    shel: /bin/sh
+build:
+  sbom: true
+  isoo: out.iso
+extra: true
+`
+	unknown, err := UnknownKeys(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"distro.flavour", "users[0].shel", "build.isoo", "extra"}
+	if strings.Join(unknown, ",") != strings.Join(want, ",") {
+		t.Errorf("UnknownKeys() = %v, want %v", unknown, want)
+	}
+}
+
+func TestLoadConfig_Files(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+files:
+  - path: /etc/nginx/nginx.conf
+    source: overlay/nginx.conf
+  - path: /etc/motd
+    content: "hello\n"
+    mode: "0640"
+    owner: root:root
+`
+	p := writeTemp(t, yaml)
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(filepath.Dir(p), "overlay", "nginx.conf")
+	if cfg.Files[0].Source != want {
+		t.Errorf("files[0].source = %q, want %q", cfg.Files[0].Source, want)
+	}
+}
+
+func TestLoadConfig_FilesInvalid(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+files:
+  - path: etc/motd
+    source: motd
+    content: hi
+    mode: "rw"
+  - path: /etc/../../root/.ssh/authorized_keys
+    content: key
+    owner: --reference=/etc/shadow
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for invalid files, got nil")
+	}
+	for _, expected := range []string{"must be absolute", "exactly one of", "not an octal permission",
+		`files[1]: path "/etc/../../root/.ssh/authorized_keys" must not contain ".."`,
+		`files[1]: owner "--reference=/etc/shadow" must not start with "-"`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfig_Hooks(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+hooks:
+  post_packages:
+    - script: hooks/setup.sh
+      chroot: true
+  post_build:
+    - script: /opt/upload.sh
+      chroot: true
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for chroot post_build hook, got nil")
+	}
+	if !strings.Contains(err.Error(), "hooks.post_build[0]: chroot") {
+		t.Errorf("error should mention post_build chroot, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Provision(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+provision:
+  first_boot:
+    - script: provision/register.sh
+      network: true
+    - network: true
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil || !strings.Contains(err.Error(), "provision.first_boot[1]: \"script\" is required") {
+		t.Fatalf("expected missing script error, got: %v", err)
+	}
+
+	path := writeTemp(t, strings.Replace(yaml, "    - network: true\n", "", 1))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(filepath.Dir(path), "provision", "register.sh")
+	if got := cfg.Provision.FirstBoot[0].Script; got != want {
+		t.Errorf("script = %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfig_BaseData(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+base_data:
+  refresh: true
+  versions:
+    tzdata: 2024b-r0
+    openssl: 3.3.2-r0
+  max_age: a year
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected errors for base_data, got nil")
+	}
+	for _, want := range []string{
+		`base_data.versions: "openssl" is invalid`,
+		`base_data.max_age "a year" is invalid`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+
+	yaml = strings.Replace(yaml, "    openssl: 3.3.2-r0\n", "", 1)
+	cfg, err := LoadConfig(writeTemp(t, strings.Replace(yaml, "a year", "365d", 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d, _ := ParseAge(cfg.BaseData.MaxAge); d != 365*24*time.Hour {
+		t.Errorf("max_age = %v, want 8760h", d)
+	}
+}
+
+func TestLoadConfig_LiveInput(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+live:
+  input:
+    - keymap: us
+    - keymap: de
+      label: Deutsch
+    - keymap: "fr latin1"
+      font: "ter v16n"
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected errors for live.input, got nil")
+	}
+	for _, want := range []string{
+		`live.input[2]: keymap "fr latin1"`,
+		`live.input[2]: font "ter v16n"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+
+	cfg, err := LoadConfig(writeTemp(t, yaml[:strings.Index(yaml, "    - keymap: \"fr")]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Live.Input[0].MenuLabel(); got != "us" {
+		t.Errorf("MenuLabel = %q, want us", got)
+	}
+	if got := cfg.Live.Input[1].MenuLabel(); got != "Deutsch" {
+		t.Errorf("MenuLabel = %q, want Deutsch", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, strings.Replace(yaml, "live:", "build:\n  output: qcow2\nlive:", 1)))
+	if err == nil || !strings.Contains(err.Error(), `live.input is only supported for build.output "iso"`) {
+		t.Errorf("expected error for live.input on a disk image, got: %v", err)
+	}
+}
+
+func TestLoadConfig_CloudInit(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"cloud_init: true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.CloudInitEnabled() || cfg.CloudTool() != "tiny-cloud" {
+		t.Errorf("cloud_init: true should enable tiny-cloud, got enabled=%v tool=%q", cfg.CloudInitEnabled(), cfg.CloudTool())
+	}
+	if got := cfg.CloudInit.CloudDatasources(); got[0] != "NoCloud" {
+		t.Errorf("default datasources = %v", got)
+	}
+
+	path := writeTemp(t, base+`cloud_init:
+  enabled: true
+  tool: cloud-init
+  datasources: [ConfigDrive, OpenStack]
+  seed:
+    user_data: cloud/user-data
+`)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(path), "cloud", "user-data"); cfg.CloudInit.Seed.UserData != want {
+		t.Errorf("user_data = %q, want %q", cfg.CloudInit.Seed.UserData, want)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`cloud_init:
+  enabled: true
+  datasources: [ConfigDrive, Bogus]
+  seed: {}
+`))
+	if err == nil {
+		t.Fatal("expected errors for cloud_init, got nil")
+	}
+	for _, want := range []string{
+		`cloud_init.datasources[1]: "Bogus" is invalid`,
+		"tiny-cloud does not support ConfigDrive",
+		`cloud_init.seed: "user_data" is required`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_ProfileRescue(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"profile: rescue\npackages: [htop]\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"htop", "cryptsetup", "ddrescue"} {
+		if !slices.Contains(cfg.Packages, want) {
+			t.Errorf("packages should contain %q, got %v", want, cfg.Packages)
+		}
+	}
+	if cfg.System.Autologin != "root" {
+		t.Errorf("autologin = %q, want root", cfg.System.Autologin)
+	}
+	if !cfg.Boot.Toram || !cfg.Boot.UEFI {
+		t.Errorf("rescue ISO should set boot.toram and boot.uefi, got %+v", cfg.Boot)
+	}
+
+	cfg, err = LoadConfig(writeTemp(t, base+"profile: rescue\nbuild:\n  output: disk\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Boot != nil && (cfg.Boot.Toram || cfg.Boot.UEFI) {
+		t.Errorf("rescue disk image should not set ISO boot options, got %+v", cfg.Boot)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`profile: forensics
+system:
+  autologin: alice
+boot:
+  toram: true
+build:
+  output: disk
+`))
+	if err == nil {
+		t.Fatal("expected errors, got nil")
+	}
+	for _, want := range []string{
+		`profile "forensics" is invalid`,
+		`system.autologin "alice" is neither root nor a user`,
+		`boot.toram is only supported for build.output "iso"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_SerialConsole(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+boot:
+  serial_console: true
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Boot.SerialConsole {
+		t.Error("boot.serial_console should be set")
+	}
+
+	for yaml, want := range map[string]string{
+		"build:\n  output: disk\n": `boot.serial_console is only supported for build.output "iso", not "disk"`,
+		"target: vm\n":             `boot.serial_console is redundant with target "vm"`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+yaml))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error should contain %q, got: %v", yaml, want, err)
+		}
+	}
+}
+
+func TestLoadConfig_BootMenu(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+`boot:
+  menu:
+    title: Acme OS
+    timeout: 10
+    default: Safe graphics
+    entries:
+      - label: Safe graphics
+        cmdline: nomodeset
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := cfg.Boot.Menu
+	if m.Title != "Acme OS" || m.Timeout != 10 || m.Default != "Safe graphics" || !slices.Equal(m.Entries, []MenuEntry{{Label: "Safe graphics", Cmdline: "nomodeset"}}) {
+		t.Errorf("Menu = %+v", m)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`build:
+  output: disk
+boot:
+  menu:
+    timeout: -1
+    entries:
+      - cmdline: nomodeset
+      - label: Debug
+        cmdline: debug "x"
+      - label: Debug
+`))
+	if err == nil {
+		t.Fatal("expected errors, got nil")
+	}
+	for _, want := range []string{
+		`boot.menu is only supported for build.output "iso", not "disk"`,
+		"boot.menu.timeout -1 is out of range",
+		"boot.menu.entries[0]: label is required",
+		"boot.menu.entries[1]: cmdline must be a single line without double quotes",
+		`boot.menu.entries[2]: label "Debug" is used twice`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Branding(t *testing.T) {
+	base := `
+version: "1"
+name: acme
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	path := writeTemp(t, base+`branding:
+  splash: art/splash.png
+  colors:
+    title: "#ffcc00"
+    selected_background: "#003366"
+  issue: "{{.Name}} {{.Version}} on {{.Distro}} \\l\n"
+  motd: Welcome to {{.Hostname}}
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(path), "art/splash.png"); cfg.Branding.Splash != want {
+		t.Errorf("Splash = %q, want %q", cfg.Branding.Splash, want)
+	}
+	if c := cfg.Branding.Colors; c.Title != "#ffcc00" || c.SelectedBackground != "#003366" || c.Text != "" {
+		t.Errorf("Colors = %+v", c)
+	}
+	issue, motd, err := cfg.Banners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue != "acme 1 on alpine \\l\n" || motd != "Welcome to "+cfg.Hostname() {
+		t.Errorf("Banners = %q, %q", issue, motd)
+	}
+
+	_, err = LoadConfig(writeTemp(t, strings.Replace(base, "alpine", "debian", 1)+`branding:
+  splash: splash.bmp
+  colors:
+    text: red
+  motd: "{{.Kernel}}"
+  issue: "{{.Name"
+`))
+	if err == nil {
+		t.Fatal("expected errors, got nil")
+	}
+	for _, want := range []string{
+		`branding.splash and branding.colors are only supported for alpine with build.output "iso", not debian`,
+		`branding.splash "splash.bmp" must be a PNG or JPEG image`,
+		`branding.colors.text "red" is invalid`,
+		"branding.issue:",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_InitramfsFeatures(t *testing.T) {
+	base := `
+version: "1"
+name: test
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"distro:\n  base: alpine\nboot:\n  initramfs_features: [nvme, lvm]\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.Boot.InitramfsFeatures, []string{"nvme", "lvm"}) {
+		t.Errorf("InitramfsFeatures = %q", cfg.Boot.InitramfsFeatures)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"distro:\n  base: debian\nboot:\n  initramfs_features: [nvme, \"a b\"]\n"))
+	if err == nil {
+		t.Fatal("expected errors, got nil")
+	}
+	for _, want := range []string{
+		`boot.initramfs_features is only supported for distro.base "alpine"`,
+		`boot.initramfs_features[1]: "a b" is not a mkinitfs feature name`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_TargetVM(t *testing.T) {
+	base := `
+version: "1"
+name: test
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"distro:\n  base: alpine\ntarget: vm\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.KernelCmdline(); got != "quiet console=tty0 console=ttyS0,115200" {
+		t.Errorf("KernelCmdline() = %q", got)
+	}
+	cfg, err = LoadConfig(writeTemp(t, base+"distro:\n  base: alpine\ntarget: vm\nboot:\n  cmdline: console=hvc0\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.KernelCmdline(); got != "console=hvc0" {
+		t.Errorf("KernelCmdline() with a console = %q", got)
+	}
+
+	for yaml, want := range map[string]string{
+		"distro:\n  base: alpine\ntarget: cloud\n":                     `target "cloud" is invalid`,
+		"distro:\n  base: debian\ntarget: vm\n":                        `target "vm" is only supported for alpine`,
+		"distro:\n  base: alpine\ntarget: vm\nbuild:\n  output: oci\n": `target "vm" is not supported for build.output "oci"`,
+	} {
+		_, err := LoadConfig(writeTemp(t, base+yaml))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_NetbootRequiresAlpine(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: fedora
+users:
+  - name: root
+    password: toor
+build:
+  output: netboot
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for fedora netboot, got nil")
+	}
+	if !strings.Contains(err.Error(), "only supported for distro.base \"alpine\"") {
+		t.Errorf("error should mention alpine requirement, got: %v", err)
+	}
+}
+
+func TestLoadConfig_NetbootEmbedRequiresNetboot(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  netboot_embed: true
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil || !strings.Contains(err.Error(), "build.netboot_embed requires build.output: netboot") {
+		t.Errorf("expected netboot_embed error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_PublishInvalid(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+publish:
+  - type: s3
+    url: https://s3.example.com
+  - type: ftp
+    url: ftp.example.com
+`
+	_, err := LoadConfig(writeTemp(t, yaml))
+	if err == nil {
+		t.Fatal("expected error for invalid publish targets, got nil")
+	}
+	for _, expected := range []string{"publish[0]: \"bucket\" is required", "publish[1]: type \"ftp\" is invalid"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+}
+
+func TestConfig_DiskFormat(t *testing.T) {
+	for _, tc := range []struct {
+		output, mode, format string
+	}{
+		{"", "iso", "qcow2"},
+		{"disk", "disk", "qcow2"},
+		{"qcow2", "disk", "qcow2"},
+		{"raw", "disk", "raw"},
+		{"netboot", "netboot", "qcow2"},
+	} {
+		cfg := &Config{Build: &Build{Output: tc.output}}
+		if got := cfg.OutputMode(); got != tc.mode {
+			t.Errorf("output %q: OutputMode() = %q, want %q", tc.output, got, tc.mode)
+		}
+		if got := cfg.DiskFormat(); got != tc.format {
+			t.Errorf("output %q: DiskFormat() = %q, want %q", tc.output, got, tc.format)
+		}
+	}
+}
+
+func TestLoadConfig_BootCmdline(t *testing.T) {
+	yaml := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+boot:
+  cmdline: console=ttyS0,115200 nomodeset
+`
+	cfg, err := LoadConfig(writeTemp(t, yaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.KernelCmdline(); got != "console=ttyS0,115200 nomodeset" {
+		t.Errorf("KernelCmdline() = %q", got)
+	}
+	if got := (&Config{}).KernelCmdline(); got != "quiet" {
+		t.Errorf("default KernelCmdline() = %q, want \"quiet\"", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, yaml+"    init=\"/bin/sh\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "boot.cmdline") {
+		t.Errorf("expected boot.cmdline error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Management(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"management:\n  mdns: true\n  ssh: true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.ManagementEnabled() || cfg.Management.WebAdmin {
+		t.Errorf("unexpected management: %+v", cfg.Management)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"management:\n  mdns: false\n"))
+	if err == nil || !strings.Contains(err.Error(), "enable at least one") {
+		t.Errorf("expected empty management error, got: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, base+"build:\n  output: oci\nmanagement:\n  ssh: true\n"))
+	if err == nil || !strings.Contains(err.Error(), "management is not supported") {
+		t.Errorf("expected oci management error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Updates(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  output: disk
+`
+	cfg, err := LoadConfig(writeTemp(t, base+"updates:\n  mode: unattended\n  schedule: weekly\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Updates.CronSchedule(); got != "0 3 * * 0" {
+		t.Errorf("CronSchedule() = %q", got)
+	}
+	if got := cfg.Updates.RebootPolicy(); got != "if-needed" {
+		t.Errorf("RebootPolicy() = %q, want \"if-needed\"", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"updates:\n  mode: unattended\n  schedule: \"0 3 * *\"\n  reboot: sometimes\n"))
+	if err == nil {
+		t.Fatal("expected error for invalid updates, got nil")
+	}
+	for _, expected := range []string{"updates.schedule \"0 3 * *\" is invalid", "updates.reboot \"sometimes\" is invalid"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+
+	iso := strings.Replace(base, "output: disk", "output: iso", 1)
+	_, err = LoadConfig(writeTemp(t, iso+"updates:\n  mode: unattended\n"))
+	if err == nil || !strings.Contains(err.Error(), "requires build.output \"disk\"") {
+		t.Errorf("expected live image error, got: %v", err)
+	}
+	if _, err := LoadConfig(writeTemp(t, iso+"updates:\n  mode: frozen\n")); err != nil {
+		t.Errorf("frozen live image: unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfig_ImageUpdates(t *testing.T) {
+	base := `
+version: "2"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  output: iso
+`
+	key := "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	image := "updates:\n  mode: image\n  manifest: https://updates.example.com/stable/channel.json\n  public_key: " + key + "\n"
+	_, err := LoadConfig(writeTemp(t, base+"boot:\n  persistence: true\n"+image))
+	if err == nil || !strings.Contains(err.Error(), "requires image_version") {
+		t.Errorf("expected image_version error, got: %v", err)
+	}
+	base += "image_version: \"1.0\"\n"
+	cfg, err := LoadConfig(writeTemp(t, base+"boot:\n  persistence: true\n"+image))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Updates.Manifest != "https://updates.example.com/stable/channel.json" || cfg.Updates.PublicKey != key {
+		t.Errorf("Updates = %+v", cfg.Updates)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+image))
+	if err == nil || !strings.Contains(err.Error(), "requires build.output \"iso\" and boot.persistence") {
+		t.Errorf("expected persistence error, got: %v", err)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"boot:\n  persistence: true\nupdates:\n  mode: image\n  manifest: ftp://example.com/channel.json\n  public_key: c2hvcnQ=\n"))
+	if err == nil {
+		t.Fatal("expected error for invalid image updates, got nil")
+	}
+	for _, expected := range []string{"updates.manifest must be", "updates.public_key must be"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+
+	disk := strings.Replace(base, "output: iso", "output: disk", 1)
+	_, err = LoadConfig(writeTemp(t, disk+"updates:\n  mode: unattended\n  public_key: "+key+"\n"))
+	if err == nil || !strings.Contains(err.Error(), "require updates.mode \"image\"") {
+		t.Errorf("expected image mode error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_BootPersistence(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+boot:
+  persistence: true
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.KernelCmdline(); got != "quiet distrorun.persist" {
+		t.Errorf("KernelCmdline() = %q, want \"quiet distrorun.persist\"", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"build:\n  output: disk\n"))
+	if err == nil || !strings.Contains(err.Error(), "boot.persistence is only supported for live images") {
+		t.Errorf("expected disk persistence error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Reproducible(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  reproducible: true
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Reproducible() {
+		t.Error("Reproducible() = false, want true")
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"  output: qcow2\n"))
+	if err == nil || !strings.Contains(err.Error(), "only supported for iso and netboot outputs") {
+		t.Errorf("expected disk output error, got: %v", err)
+	}
+	fedora := strings.Replace(base, "base: alpine", "base: fedora", 1)
+	_, err = LoadConfig(writeTemp(t, fedora))
+	if err == nil || !strings.Contains(err.Error(), "build.reproducible is only supported for distro.base \"alpine\"") {
+		t.Errorf("expected fedora error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_NonfatalScripts(t *testing.T) {
+	base := `
+version: "1"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  nonfatal_scripts: [mkinitfs, lighttpd]
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(cfg.NonfatalScripts(), ","); got != "mkinitfs,lighttpd" {
+		t.Errorf("NonfatalScripts() = %q", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, strings.Replace(base, "base: alpine", "base: debian", 1)))
+	if err == nil || !strings.Contains(err.Error(), "build.nonfatal_scripts is only supported") {
+		t.Errorf("expected debian error, got: %v", err)
+	}
+	_, err = LoadConfig(writeTemp(t, strings.Replace(base, "[mkinitfs, lighttpd]", `["", lighttpd]`, 1)))
+	if err == nil || !strings.Contains(err.Error(), "build.nonfatal_scripts[0]: package name is empty") {
+		t.Errorf("expected empty name error, got: %v", err)
+	}
+}
+
+func TestLoadConfig_Addons(t *testing.T) {
+	p := writeTemp(t, `
+version: "1"
+name: test
+distro:
+  base: alpine
+packages: [curl]
+addons: [tailscale]
+users:
+  - name: root
+    password: toor
+files:
+  - path: /etc/motd
+    content: hello
+hooks:
+  post_packages:
+    - script: setup.sh
+`)
+	dir := filepath.Join(filepath.Dir(p), AddonDir, "tailscale")
+	if _, err := LoadConfig(p); err == nil || !strings.Contains(err.Error(), "distrorun add-on install tailscale") {
+		t.Errorf("expected not installed error, got: %v", err)
+	}
+
+	os.MkdirAll(dir, 0755)
+	addon := `
+name: tailscale
+packages: [tailscale, curl]
+services: [tailscale]
+files:
+  - path: /etc/default/tailscaled
+    source: files/tailscaled
+hooks:
+  post_packages:
+    - script: up.sh
+      chroot: true
+`
+	os.WriteFile(filepath.Join(dir, AddonFile), []byte(addon), 0644)
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(cfg.Packages, ","); got != "curl,tailscale" {
+		t.Errorf("Packages = %q, want curl,tailscale", got)
+	}
+	if cfg.Services == nil || strings.Join(cfg.Services.Enable, ",") != "tailscale" {
+		t.Errorf("Services = %+v, want tailscale", cfg.Services)
+	}
+	if len(cfg.Files) != 2 || cfg.Files[0].Source != filepath.Join(dir, "files", "tailscaled") || cfg.Files[1].Path != "/etc/motd" {
+		t.Errorf("Files = %+v, want the add-on file first", cfg.Files)
+	}
+	if h := cfg.Hooks.PostPackages; len(h) != 2 || h[0].Script != filepath.Join(dir, "up.sh") || !h[0].Chroot {
+		t.Errorf("PostPackages = %+v, want the add-on hook first", h)
+	}
+
+	os.WriteFile(filepath.Join(dir, AddonFile), []byte(strings.Replace(addon, "files/tailscaled", "../../secret", 1)), 0644)
+	if _, err := LoadConfig(p); err == nil || !strings.Contains(err.Error(), "must be a path inside the add-on") {
+		t.Errorf("expected escaping source error, got: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, AddonFile), []byte(strings.Replace(addon, "/etc/default/tailscaled", "/etc/../../tailscaled", 1)), 0644)
+	if _, err := LoadConfig(p); err == nil || !strings.Contains(err.Error(), `must not contain ".."`) {
+		t.Errorf("expected escaping path error, got: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, AddonFile), []byte(strings.Replace(addon, "name: tailscale", "name: netdata", 1)), 0644)
+	if _, err := LoadConfig(p); err == nil || !strings.Contains(err.Error(), `named "netdata"`) {
+		t.Errorf("expected name mismatch error, got: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, AddonFile), []byte(strings.Replace(addon, "name: tailscale", "name: tailscale\nversion: \"1.0\\nsha256 00\"", 1)), 0644)
+	if _, err := LoadConfig(p); err == nil || !strings.Contains(err.Error(), "add-on version") {
+		t.Errorf("expected invalid version error, got: %v", err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	for v, want := range map[string]int{"1": 1, "1.0": 1, "v0.1.0": 1, "2": 2} {
+		if got, err := SchemaVersion(v); err != nil || got != want {
+			t.Errorf("SchemaVersion(%q) = %d, %v; want %d", v, got, err, want)
+		}
+	}
+	if _, err := SchemaVersion("3"); err == nil || !strings.Contains(err.Error(), "newer than this distrorun supports") {
+		t.Errorf("expected newer version error, got: %v", err)
+	}
+	if _, err := SchemaVersion("latest"); err == nil {
+		t.Error("SchemaVersion accepted \"latest\"")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	old := `# my server
+version: "1.0"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+build:
+  output: disk # boots on the hypervisor
+`
+	p := writeTemp(t, old)
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if from, notes, outdated := cfg.Outdated(); !outdated || from != 1 || len(notes) != 1 {
+		t.Errorf("Outdated() = %d, %q, %v", from, notes, outdated)
+	}
+	if cfg.Build.Output != "disk" || cfg.Version != "1.0" || cfg.ImageVersion != "1.0" {
+		t.Errorf("output %q version %q image_version %q, want disk and the file's 1.0", cfg.Build.Output, cfg.Version, cfg.ImageVersion)
+	}
+
+	data, from, notes, err := Migrate([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 || len(notes) != 1 {
+		t.Errorf("Migrate from %d with notes %q", from, notes)
+	}
+	for _, want := range []string{"# my server", `version: "2" # migrated from "1.0"` + "\n" + `image_version: "1.0" # was "version" before config version 2` + "\nname: test\n", "output: disk # boots on the hypervisor\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("missing %q in:\n%s", want, data)
+		}
+	}
+
+	os.WriteFile(p, data, 0644)
+	cfg, err = LoadConfig(p)
+	if err != nil {
+		t.Fatalf("migrated config: %v", err)
+	}
+	if _, _, outdated := cfg.Outdated(); outdated {
+		t.Error("migrated config is still outdated")
+	}
+	if cfg.ImageVersion != "1.0" {
+		t.Errorf("migrated image_version = %q, want 1.0", cfg.ImageVersion)
+	}
+	if again, _, notes, _ := Migrate(data); string(again) != string(data) || notes != nil {
+		t.Error("migrating a current config changed it")
+	}
+
+	// Keys inside flow collections cannot be patched in place.
+	flow := "# my server\n{version: \"1.0\", name: test}\n"
+	if data, _, _, err := Migrate([]byte(flow)); err != nil || !strings.Contains(string(data), `image_version: "1.0"`) {
+		t.Errorf("flow mapping migrated to:\n%s (%v)", data, err)
+	}
+}
+
+func TestLoadConfig_SystemIdentity(t *testing.T) {
+	base := `
+version: "2"
+name: test
+distro:
+  base: alpine
+users:
+  - name: admin
+    password: secret
+`
+	cfg, err := LoadConfig(writeTemp(t, base))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Hostname(); got != "admin" {
+		t.Errorf("default Hostname() = %q, want the first user's name", got)
+	}
+
+	cfg, err = LoadConfig(writeTemp(t, base+"system:\n  hostname: web01.lan\n  timezone: America/Argentina/Buenos_Aires\n  keymap: fr-latin1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Hostname(); got != "web01.lan" {
+		t.Errorf("Hostname() = %q, want web01.lan", got)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+"system:\n  hostname: -web_01\n  timezone: ../../etc/shadow\n  keymap: de/../x\n"))
+	for _, want := range []string{
+		`system.hostname "-web_01" is not a valid hostname`,
+		`system.timezone "../../etc/shadow" is not a time zone name`,
+		`system.keymap "de/../x" is not a keymap name`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_InvalidName(t *testing.T) {
+	tmpl := `
+version: "2"
+name: %s
+distro:
+  base: alpine
+users:
+  - name: root
+    password: secret
+`
+	for _, name := range []string{"web-01", "testOS", "edge_3.20"} {
+		if _, err := LoadConfig(writeTemp(t, fmt.Sprintf(tmpl, name))); err != nil {
+			t.Errorf("name %q: unexpected error: %v", name, err)
+		}
+	}
+	for name, want := range map[string]string{
+		`"my server"`:           `name "my server" is invalid`,
+		"web/prod":              `name "web/prod" is invalid`,
+		"../etc":                `name "../etc" is invalid`,
+		`"-o"`:                  `name "-o" is invalid`,
+		strings.Repeat("a", 65): "is too long: 65 characters, the limit is 64",
+	} {
+		_, err := LoadConfig(writeTemp(t, fmt.Sprintf(tmpl, name)))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("name %s: expected %q, got: %v", name, want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Repositories(t *testing.T) {
+	base := `
+version: "2"
+name: test
+users:
+  - name: root
+    password: toor
+`
+	path := writeTemp(t, base+`distro:
+  base: alpine
+  mirror: https://mirror.example.com/alpine
+  local_mirror: mirror
+  repositories:
+    - url: https://packages.example.com/alpine/main
+      key: keys/builder-6543a1b2.rsa.pub
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(filepath.Dir(path), "keys", "builder-6543a1b2.rsa.pub")
+	if got := cfg.Distro.Repositories[0].Key; got != want {
+		t.Errorf("key = %q, want %q resolved next to the config", got, want)
+	}
+	if want := filepath.Join(filepath.Dir(path), "mirror"); cfg.Distro.LocalMirror != want {
+		t.Errorf("local_mirror = %q, want %q resolved next to the config", cfg.Distro.LocalMirror, want)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`distro:
+  base: fedora
+  mirror: mirror.example.com
+  local_mirror: https://mirror.example.com/alpine
+  repositories:
+    - url: /srv/repo
+      key: builder.rsa
+`))
+	for _, want := range []string{
+		"distro.mirror and distro.repositories are only supported for distro.base \"alpine\"",
+		"distro.local_mirror is only supported for distro.base \"alpine\"",
+		`distro.local_mirror "https://mirror.example.com/alpine" must be a directory, not a URL (see distro.mirror)`,
+		`distro.mirror "mirror.example.com" must be an http:// or https:// URL`,
+		`distro.repositories[0]: url "/srv/repo" must be an http:// or https:// URL`,
+		`distro.repositories[0]: key "builder.rsa" must be a public key file named *.pub`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestLoadPatch(t *testing.T) {
+	path := writeTemp(t, `
+files:
+  - path: /etc/motd
+    source: motd
+packages: [htop]
+cmdline: "console=ttyS0 quiet"
+`)
+	p, err := LoadPatch(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(path), "motd"); p.Files[0].Source != want {
+		t.Errorf("source = %q, want %q resolved next to the patch", p.Files[0].Source, want)
+	}
+	if !p.ChangesRootfs() || p.Cmdline != "console=ttyS0 quiet" {
+		t.Errorf("unexpected patch: %+v", p)
+	}
+
+	for yaml, want := range map[string]string{
+		"":                               "the patch changes nothing",
+		"cmdline: quiet\npackage: [vim]": "field package not found",
+		"cmdline: \"a \\\"b\\\"\"":       "cmdline must be a single line without double quotes",
+		"files:\n  - path: etc/motd\n":   `files[0]: path "etc/motd" must be absolute`,
+		"packages: [\"htop vim\"]":       `packages[0]: "htop vim" is not a package name`,
+	} {
+		if _, err := LoadPatch(writeTemp(t, yaml)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected %q, got: %v", yaml, want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Assertions(t *testing.T) {
+	base := `
+version: "2"
+name: test
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	cfg, err := LoadConfig(writeTemp(t, base+`assertions:
+  require_files: [/usr/sbin/nginx]
+  forbid_files: ["/root/.ssh/id_*"]
+  packages:
+    - name: openssl
+      version: ">= 3.3"
+  max_size: 512M
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op, v := cfg.Assertions.Packages[0].VersionConstraint(); op != ">=" || v != "3.3" {
+		t.Errorf("constraint = %q %q, want >= 3.3", op, v)
+	}
+
+	_, err = LoadConfig(writeTemp(t, base+`assertions:
+  require_files: [usr/sbin/nginx]
+  forbid_files: ["/root/[id"]
+  packages:
+    - version: ">="
+  max_size: 12X
+`))
+	for _, want := range []string{
+		`assertions.require_files[0]: path "usr/sbin/nginx" must be absolute`,
+		`assertions.forbid_files[0]: pattern "/root/[id" is malformed`,
+		`assertions.packages[0]: "name" is required`,
+		`assertions.packages[0]: version ">=" has no version after the operator`,
+		`assertions.max_size: size "12X" is invalid`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{"4096": 4096, "512M": 512 << 20, "2g": 2 << 30, "1GB": 1 << 30} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1G", "1.5G", "99999999999T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) should fail", s)
+		}
+	}
+}
+
+func TestLoadConfig_Sample(t *testing.T) {
+	// The sample is what users start from; it must load as shipped.
+	const sample = "../../sample.distrorun.yaml"
+	if _, err := LoadConfig(sample); err != nil {
+		t.Fatalf("LoadConfig(%s): %v", sample, err)
+	}
+	unknown, err := UnknownKeys(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) > 0 {
+		t.Errorf("the sample has unknown keys: %q", unknown)
+	}
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the newest config schema version. 'distrorun init' and
+// 'distrorun migrate' write it, and older configs are upgraded to it when
+// they are loaded.
+const CurrentVersion = 2
+
+// SchemaVersion returns the schema version selected by the value of the
+// "version" key: its major number. Configs written before the schema was
+// versioned carry free-form values such as "1.0" or "v0.1.0"; major
+// versions 0 and 1 both select schema 1.
+func SchemaVersion(v string) (int, error) {
+	major, _, _ := strings.Cut(strings.TrimPrefix(v, "v"), ".")
+	n, err := strconv.Atoi(major)
+	switch {
+	case err != nil || n < 0:
+		return 0, fmt.Errorf("version %q is invalid: use %q", v, strconv.Itoa(CurrentVersion))
+	case n > CurrentVersion:
+		return 0, fmt.Errorf("config version %d is newer than this distrorun supports (%d); upgrade distrorun", n, CurrentVersion)
+	case n == 0:
+		return 1, nil
+	}
+	return n, nil
+}
+
+// migration upgrades a document from schema version from to from+1.
+type migration struct {
+	from  int
+	apply func(doc *yaml.Node, e *edits)
+}
+
+// migrations are applied in order.
+var migrations = []migration{
+	{1, migrateV1},
+}
+
+// migrateV1 upgrades to version 2, which makes "version" the schema
+// version: the free-form release it held, such as "1.0", moves to
+// "image_version" so publish paths keep it.
+func migrateV1(doc *yaml.Node, e *edits) {
+	if v := mappingValue(doc, "version"); v != nil && mappingValue(doc, "image_version") == nil {
+		e.add(doc, "version", "image_version", v.Value, `was "version" before config version 2`)
+		e.notes = append(e.notes, fmt.Sprintf("version %q is now image_version", v.Value))
+	}
+}
+
+// edits records the scalars the migrations change and the keys they add,
+// so the file can be patched line by line instead of re-encoded, which
+// would drop its blank lines.
+type edits struct {
+	changes []edit
+	added   []*yaml.Node // key nodes of added keys, each after its predecessor
+	notes   []string     // one line per change, for the user
+}
+
+// edit is one changed scalar and what its line held before.
+type edit struct {
+	node       *yaml.Node
+	oldValue   string
+	oldComment string
+}
+
+// set changes the value of a scalar and adds comment to its line comment,
+// after any comment it already has.
+func (e *edits) set(n *yaml.Node, value, comment string) {
+	e.changes = append(e.changes, edit{n, n.Value, n.LineComment})
+	n.Value = value
+	if n.LineComment == "" {
+		n.LineComment = "# " + comment
+	} else {
+		n.LineComment += "; " + comment
+	}
+}
+
+// add inserts key with a string value into the mapping n, after the key
+// after, with comment on its line.
+func (e *edits) add(n *yaml.Node, after, key, value, comment string) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != after {
+			continue
+		}
+		prev := n.Content[i]
+		k := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: prev.Line, Column: prev.Column}
+		if n.Style&yaml.FlowStyle != 0 || n.Content[i+1].Kind != yaml.ScalarNode || n.Content[i+1].Line != prev.Line {
+			k.Line = 0 // not a line of its own: re-encode
+		}
+		v := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, Style: yaml.DoubleQuotedStyle, LineComment: "# " + comment}
+		n.Content = slices.Insert(n.Content, i+2, k, v)
+		e.added = append(e.added, k, v)
+		return
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// migrate upgrades a parsed document to CurrentVersion in place. It returns
+// the schema version the document had. A document without a version is left
+// for validation to reject.
+func migrate(doc *yaml.Node, e *edits) (int, error) {
+	version := mappingValue(doc, "version")
+	if version == nil || version.Value == "" {
+		return CurrentVersion, nil
+	}
+	from, err := SchemaVersion(version.Value)
+	if err != nil || from == CurrentVersion {
+		return from, err
+	}
+
+	for _, m := range migrations {
+		if m.from >= from {
+			m.apply(doc, e)
+		}
+	}
+	e.set(version, strconv.Itoa(CurrentVersion), fmt.Sprintf("migrated from %q", version.Value))
+	version.Style = yaml.DoubleQuotedStyle
+	return from, nil
+}
+
+// Migrate upgrades the contents of a config file to CurrentVersion, keeping
+// its layout and comments. It returns the upgraded file, the version it had
+// and one note per change. A config already at CurrentVersion is returned as
+// is.
+func Migrate(data []byte) ([]byte, int, []string, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, 0, nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	if len(root.Content) == 0 || mappingValue(root.Content[0], "version") == nil {
+		return nil, 0, nil, fmt.Errorf("\"version\" is required")
+	}
+	var e edits
+	from, err := migrate(root.Content[0], &e)
+	if err != nil || from == CurrentVersion {
+		return data, from, nil, err
+	}
+
+	if out, ok := patchLines(data, e.changes, e.added); ok {
+		return out, from, e.notes, nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, 0, nil, err
+	}
+	return buf.Bytes(), from, e.notes, nil
+}
+
+// patchLines replaces the value and comment of every changed scalar in the
+// file, and writes each added key and value on a line of its own after
+// the line of the key it follows. It fails unless each scalar ends its
+// line, optionally followed by its comment, so values inside flow
+// collections are re-encoded instead.
+func patchLines(data []byte, changes []edit, added []*yaml.Node) ([]byte, bool) {
+	lines := strings.SplitAfter(string(data), "\n")
+	for _, c := range changes {
+		n := c.node
+		if n.Line < 1 || n.Line > len(lines) {
+			return nil, false
+		}
+		line := lines[n.Line-1]
+		body := strings.TrimRight(line, "\r\n")
+		if n.Column < 1 || n.Column > len(body) {
+			return nil, false
+		}
+		old, ok := strings.CutSuffix(strings.TrimSpace(body[n.Column-1:]), c.oldComment)
+		if !ok || !slices.Contains([]string{c.oldValue, `"` + c.oldValue + `"`, "'" + c.oldValue + "'"}, strings.TrimSpace(old)) {
+			return nil, false
+		}
+		value := n.Value
+		if n.Style == yaml.DoubleQuotedStyle {
+			value = strconv.Quote(value)
+		}
+		lines[n.Line-1] = body[:n.Column-1] + value + " " + n.LineComment + line[len(body):]
+	}
+	// Bottom up, so the lines of earlier insertions do not move.
+	pairs := slices.Collect(slices.Chunk(added, 2))
+	slices.SortStableFunc(pairs, func(a, b []*yaml.Node) int { return b[0].Line - a[0].Line })
+	for _, p := range pairs {
+		k, v := p[0], p[1]
+		if k.Line < 1 || k.Line > len(lines) || !strings.HasSuffix(lines[k.Line-1], "\n") {
+			return nil, false
+		}
+		line := strings.Repeat(" ", k.Column-1) + k.Value + ": " + strconv.Quote(v.Value) + " " + v.LineComment + "\n"
+		lines = slices.Insert(lines, k.Line, line)
+	}
+	return []byte(strings.Join(lines, "")), true
+}
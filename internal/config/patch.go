@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Patch is the delta 'distrorun patch' applies to an existing image:
+// files copied into its root filesystem, packages installed into it and a
+// new kernel command line. Sources are relative to the patch file.
+type Patch struct {
+	Files    []File   `yaml:"files"`
+	Packages []string `yaml:"packages"`
+
+	// Cmdline replaces the kernel parameters of the image's boot
+	// configuration; empty keeps them.
+	Cmdline string `yaml:"cmdline"`
+}
+
+// ChangesRootfs reports whether the patch modifies the root filesystem,
+// which then has to be unpacked and compressed again.
+func (p *Patch) ChangesRootfs() bool {
+	return len(p.Files) > 0 || len(p.Packages) > 0
+}
+
+// LoadPatch reads and validates the patch file at path. Unlike a config,
+// unknown keys are errors: a misspelled key would silently patch nothing.
+func LoadPatch(path string) (*Patch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading patch file: %w", err)
+	}
+	var p Patch
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	for i, f := range p.Files {
+		if f.Source != "" && !filepath.IsAbs(f.Source) {
+			p.Files[i].Source = filepath.Join(filepath.Dir(path), f.Source)
+		}
+	}
+	return &p, nil
+}
+
+// Validate checks the patch, returning all errors found.
+func (p *Patch) Validate() error {
+	errs := validateFiles(p.Files)
+	for i, pkg := range p.Packages {
+		if pkg == "" || strings.ContainsAny(pkg, " \t\n") {
+			errs = append(errs, fmt.Sprintf("packages[%d]: %q is not a package name", i, pkg))
+		}
+	}
+	if strings.ContainsAny(p.Cmdline, "\n\r\"") {
+		errs = append(errs, "cmdline must be a single line without double quotes")
+	}
+	if !p.ChangesRootfs() && p.Cmdline == "" {
+		errs = append(errs, "the patch changes nothing: set files, packages or cmdline")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("patch validation failed:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import "slices"
+
+// Profiles are the values of "profile".
+var Profiles = []string{"rescue"}
+
+// rescuePackages are the disk, filesystem and network repair tools of the
+// rescue profile, by distribution.
+var rescuePackages = map[string][]string{
+	"alpine": {
+		"e2fsprogs", "e2fsprogs-extra", "dosfstools", "ntfs-3g-progs", "xfsprogs", "btrfs-progs",
+		"lvm2", "mdadm", "cryptsetup", "parted", "sfdisk", "sgdisk", "testdisk", "ddrescue",
+		"smartmontools", "nvme-cli", "hdparm", "pciutils", "usbutils", "util-linux", "efibootmgr",
+		"rsync", "openssh-client", "curl", "iproute2", "ethtool", "tcpdump", "mtr", "bind-tools", "iperf3",
+		"vim", "less", "tmux",
+	},
+	"fedora": {
+		"e2fsprogs", "dosfstools", "ntfs-3g", "ntfsprogs", "xfsprogs", "btrfs-progs",
+		"lvm2", "mdadm", "cryptsetup", "parted", "gdisk", "testdisk", "ddrescue",
+		"smartmontools", "nvme-cli", "hdparm", "pciutils", "usbutils", "efibootmgr",
+		"rsync", "openssh-clients", "curl", "iproute", "ethtool", "tcpdump", "mtr", "bind-utils", "iperf3",
+		"vim-minimal", "less", "tmux",
+	},
+	"debian": {
+		"e2fsprogs", "dosfstools", "ntfs-3g", "xfsprogs", "btrfs-progs",
+		"lvm2", "mdadm", "cryptsetup", "parted", "fdisk", "gdisk", "testdisk", "gddrescue",
+		"smartmontools", "nvme-cli", "hdparm", "pciutils", "usbutils", "efibootmgr",
+		"rsync", "openssh-client", "curl", "iproute2", "ethtool", "tcpdump", "mtr-tiny", "bind9-dnsutils", "iperf3",
+		"vim-tiny", "less", "tmux",
+	},
+}
+
+// ProfilePackages returns the packages the profile of c adds to those
+// listed.
+func (c *Config) ProfilePackages() []string {
+	if c.Profile != "rescue" {
+		return nil
+	}
+	return rescuePackages[c.Distro.Base]
+}
+
+// applyProfile adds what the profile provides to the config. The rescue
+// profile adds its repair tools to the packages, logs root in on tty1
+// unless system.autologin names another user, and gives ISOs a
+// copy-to-RAM boot entry and UEFI boot.
+func (c *Config) applyProfile() {
+	if c.Profile != "rescue" {
+		return
+	}
+	for _, p := range c.ProfilePackages() {
+		if !slices.Contains(c.Packages, p) {
+			c.Packages = append(c.Packages, p)
+		}
+	}
+	if c.System == nil {
+		c.System = &System{}
+	}
+	if c.System.Autologin == "" {
+		c.System.Autologin = "root"
+	}
+	if c.OutputMode() == "iso" {
+		if c.Boot == nil {
+			c.Boot = &Boot{}
+		}
+		c.Boot.Toram = true
+		c.Boot.UEFI = true
+	}
+}
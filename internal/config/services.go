@@ -0,0 +1,166 @@
+package config
+
+import (
+	"slices"
+	"strings"
+)
+
+// nameAlias is a package or service: the names it goes by, and its name on
+// each distribution. An empty name leaves a package out on that
+// distribution.
+type nameAlias struct {
+	names []string
+	base  map[string]string
+}
+
+// serviceAliases maps the names a service goes by to its init script or
+// unit on each distribution, so services can be listed the same way
+// whatever distro.base is: "ssh" is sshd on Alpine and Fedora and ssh on
+// Debian. Only these names are translated; the name a distribution uses
+// itself, such as Alpine's "rsyslog" next to its "syslog", stays as is.
+var serviceAliases = []nameAlias{
+	{[]string{"ssh", "sshd"}, map[string]string{"alpine": "sshd", "fedora": "sshd", "debian": "ssh"}},
+	{[]string{"cron", "crond"}, map[string]string{"alpine": "crond", "fedora": "crond", "debian": "cron"}},
+	{[]string{"chrony", "chronyd"}, map[string]string{"alpine": "chronyd", "fedora": "chronyd", "debian": "chrony"}},
+	{[]string{"syslog"}, map[string]string{"alpine": "syslog", "fedora": "rsyslog", "debian": "rsyslog"}},
+	{[]string{"network", "networking"}, map[string]string{"alpine": "networking", "fedora": "NetworkManager", "debian": "networking"}},
+	{[]string{"apache", "apache2", "httpd"}, map[string]string{"alpine": "apache2", "fedora": "httpd", "debian": "apache2"}},
+	{[]string{"mysql", "mariadb"}, map[string]string{"alpine": "mariadb", "fedora": "mariadb", "debian": "mariadb"}},
+	{[]string{"bind", "bind9", "named"}, map[string]string{"alpine": "named", "fedora": "named", "debian": "named"}},
+	{[]string{"samba", "smb", "smbd"}, map[string]string{"alpine": "samba", "fedora": "smb", "debian": "smbd"}},
+	{[]string{"nfs", "nfs-server", "nfs-kernel-server"}, map[string]string{"alpine": "nfs", "fedora": "nfs-server", "debian": "nfs-kernel-server"}},
+	{[]string{"cups", "cupsd"}, map[string]string{"alpine": "cupsd", "fedora": "cups", "debian": "cups"}},
+	{[]string{"avahi", "avahi-daemon"}, map[string]string{"alpine": "avahi-daemon", "fedora": "avahi-daemon", "debian": "avahi-daemon"}},
+}
+
+// portableServices are named the same on every distribution.
+var portableServices = []string{
+	"containerd", "dbus", "docker", "haproxy", "libvirtd", "nginx", "postgresql",
+	"qemu-guest-agent", "redis", "tailscale",
+}
+
+// ServiceName returns the name of service on distribution base.
+func ServiceName(base, service string) string {
+	for _, a := range serviceAliases {
+		if name, ok := a.base[base]; ok && slices.Contains(a.names, service) {
+			return name
+		}
+	}
+	return service
+}
+
+// knownService reports whether service, on base, is a name distrorun
+// knows to be right there.
+func knownService(base, service string) bool {
+	if slices.Contains(portableServices, service) {
+		return true
+	}
+	return slices.ContainsFunc(serviceAliases, func(a nameAlias) bool { return a.base[base] == service })
+}
+
+// translate renames the services of s to their names on base, in Enable,
+// Disable and the keys of Runlevels. A service listed under two names is
+// kept once.
+func (s *Services) translate(base string) {
+	s.Enable = translateServices(base, s.Enable)
+	s.Disable = translateServices(base, s.Disable)
+	if len(s.Runlevels) > 0 {
+		runlevels := make(map[string]string, len(s.Runlevels))
+		for svc, rl := range s.Runlevels {
+			runlevels[ServiceName(base, svc)] = rl
+		}
+		s.Runlevels = runlevels
+	}
+}
+
+func translateServices(base string, services []string) []string {
+	var out []string
+	for _, svc := range services {
+		if name := ServiceName(base, svc); !slices.Contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// packageAliases maps the names a package goes by to its name on each
+// distribution, so packages can be listed the same way whatever
+// distro.base is. Packages named the same everywhere, such as curl, need
+// no entry.
+var packageAliases = []nameAlias{
+	{[]string{"apache2", "httpd"}, map[string]string{"alpine": "apache2", "fedora": "httpd", "debian": "apache2"}},
+	{[]string{"bind-tools", "bind-utils", "dnsutils", "bind9-dnsutils"}, map[string]string{"alpine": "bind-tools", "fedora": "bind-utils", "debian": "bind9-dnsutils"}},
+	{[]string{"docker", "docker.io", "moby-engine"}, map[string]string{"alpine": "docker", "fedora": "moby-engine", "debian": "docker.io"}},
+	{[]string{"gnupg", "gnupg2"}, map[string]string{"alpine": "gnupg", "fedora": "gnupg2", "debian": "gnupg"}},
+	{[]string{"iproute2", "iproute"}, map[string]string{"alpine": "iproute2", "fedora": "iproute", "debian": "iproute2"}},
+	{[]string{"iputils", "iputils-ping"}, map[string]string{"alpine": "iputils", "fedora": "iputils", "debian": "iputils-ping"}},
+	{[]string{"linux-firmware", "firmware-linux"}, map[string]string{"alpine": "linux-firmware", "fedora": "linux-firmware", "debian": "firmware-linux"}},
+	{[]string{"mariadb", "mariadb-server"}, map[string]string{"alpine": "mariadb", "fedora": "mariadb-server", "debian": "mariadb-server"}},
+	{[]string{"netcat", "netcat-openbsd", "nmap-ncat"}, map[string]string{"alpine": "netcat-openbsd", "fedora": "nmap-ncat", "debian": "netcat-openbsd"}},
+	{[]string{"nfs-utils", "nfs-common"}, map[string]string{"alpine": "nfs-utils", "fedora": "nfs-utils", "debian": "nfs-common"}},
+	{[]string{"openssh", "openssh-server"}, map[string]string{"alpine": "openssh", "fedora": "openssh-server", "debian": "openssh-server"}},
+	{[]string{"openssh-client", "openssh-clients"}, map[string]string{"alpine": "openssh-client", "fedora": "openssh-clients", "debian": "openssh-client"}},
+	{[]string{"procps", "procps-ng"}, map[string]string{"alpine": "procps-ng", "fedora": "procps-ng", "debian": "procps"}},
+	{[]string{"shadow", "shadow-utils", "passwd"}, map[string]string{"alpine": "shadow", "fedora": "shadow-utils", "debian": "passwd"}},
+	{[]string{"vim-tiny", "vim-minimal"}, map[string]string{"alpine": "vim", "fedora": "vim-minimal", "debian": "vim-tiny"}},
+	{[]string{"xz", "xz-utils"}, map[string]string{"alpine": "xz", "fedora": "xz", "debian": "xz-utils"}},
+}
+
+// PackageName returns the name of package on distribution base, and false
+// when the package is left out there. aliases, from package_aliases, come
+// before the built-in table. Alpine's py3- Python packages are python3- on
+// Fedora and Debian; the other way round is not translated, as Alpine has
+// python3- packages of its own.
+func PackageName(base, pkg string, aliases map[string]map[string]string) (string, bool) {
+	if names, ok := aliases[pkg]; ok {
+		if name, ok := names[base]; ok {
+			return name, name != ""
+		}
+		return pkg, true
+	}
+	for _, a := range packageAliases {
+		if name, ok := a.base[base]; ok && slices.Contains(a.names, pkg) {
+			return name, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(pkg, "py3-"); ok && (base == "fedora" || base == "debian") {
+		return "python3-" + rest, true
+	}
+	return pkg, true
+}
+
+// translatePackages renames packages to their names on base, leaving out
+// those package_aliases leaves out there. A package listed under two
+// names is kept once.
+func (c *Config) translatePackages() {
+	var packages []string
+	for _, p := range c.Packages {
+		if name, ok := PackageName(c.Distro.Base, p, c.PackageAliases); ok && !slices.Contains(packages, name) {
+			packages = append(packages, name)
+		}
+	}
+	c.Packages = packages
+	if c.Assertions != nil {
+		for i, a := range c.Assertions.Packages {
+			if name, ok := PackageName(c.Distro.Base, a.Name, c.PackageAliases); ok {
+				c.Assertions.Packages[i].Name = name
+			}
+		}
+	}
+}
+
+// UnknownServices returns the services of c that distrorun does not know
+// the name of across distributions. They are used as they are written, so
+// they must be the init script or unit name of distro.base.
+func (c *Config) UnknownServices() []string {
+	if c.Services == nil {
+		return nil
+	}
+	var unknown []string
+	for _, svc := range slices.Concat(c.Services.Enable, c.Services.Disable) {
+		if !knownService(c.Distro.Base, svc) && !slices.Contains(unknown, svc) {
+			unknown = append(unknown, svc)
+		}
+	}
+	return unknown
+}
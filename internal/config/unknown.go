@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UnknownKeys reads the YAML file at path and returns the dotted paths of all
+// mapping keys that do not correspond to a Config field (e.g. "build.isoo").
+// Unknown keys are silently ignored by LoadConfig, so they usually indicate a typo.
+func UnknownKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("parsing YAML: %w", err)
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+
+	var unknown []string
+	walkKeys(root.Content[0], reflect.TypeOf(Config{}), "", &unknown)
+	return unknown, nil
+}
+
+// walkKeys compares a YAML node against the struct type t and records keys
+// that have no matching `yaml` tag.
+func walkKeys(n *yaml.Node, t reflect.Type, prefix string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, item := range n.Content {
+			walkKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i), unknown)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			p := key
+			if prefix != "" {
+				p = prefix + "." + key
+			}
+			ft, ok := fields[key]
+			if !ok {
+				*unknown = append(*unknown, p)
+				continue
+			}
+			walkKeys(n.Content[i+1], ft, p, unknown)
+		}
+	}
+}
+
+// yamlFields maps each yaml tag name of struct type t to its field type.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
@@ -1,10 +1,89 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// alpineVersion matches an Alpine release branch ("3.20", "v3.20") or "edge".
+var alpineVersion = regexp.MustCompile(`^(v?[0-9]+\.[0-9]+|edge)$`)
+
+// kernelFlavors are the Alpine kernel flavors distro.kernel offers.
+var kernelFlavors = []string{"lts", "virt", "edge"}
+
+// mkinitfsFeature matches a mkinitfs feature name, e.g. "nvme" or "lvm".
+var mkinitfsFeature = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// wizardLanguages lists the first-boot wizard translations; keep in sync
+// with the message catalog in internal/rootfs/wizard.go.
+var wizardLanguages = []string{"de", "en", "es", "fr"}
+
+// kernelModule matches a kernel module name.
+var kernelModule = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// bondModes are the Linux bonding driver modes.
+var bondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+
+// countryCode matches an ISO 3166-1 alpha-2 country code.
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// wgInterface matches a Linux interface name usable by wg-quick.
+var wgInterface = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// wgKey matches a base64-encoded 32-byte WireGuard key.
+var wgKey = regexp.MustCompile(`^[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=$`)
+
+// failOnLevels are the severities accepted by build.fail_on.
+var failOnLevels = []string{"critical", "high", "medium", "low"}
+
+// rebootPolicies are the values accepted by updates.reboot.
+var rebootPolicies = []string{"if-needed", "always", "never"}
+
+// cronField matches one field of a cron expression.
+var cronField = regexp.MustCompile(`^[0-9*,/-]+$`)
+
+// hostnameLabel matches one dot-separated label of a hostname (RFC 1123).
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// timezoneName matches an IANA time zone name such as "America/New_York".
+var timezoneName = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+// keymapName matches a console keymap name such as "de" or "fr-latin1".
+var keymapName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// fontName matches a console font name such as "ter-v16n" or "Lat2-Terminus16".
+var fontName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// imageName matches a config name. The name becomes part of output file
+// names, the build lock and the workdir under /tmp, so it may not contain
+// spaces or slashes, nor start with a dot or a dash.
+var imageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// maxNameLength bounds the name so that the longest derived file name,
+// "<name>-netboot-audit.jsonl", stays well below the 255-byte limit.
+const maxNameLength = 64
+
+// groupName matches the portable POSIX user/group name subset used by shadow.
+var groupName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// userName matches the user names useradd and BusyBox adduser both accept.
+// They are passed to those tools as arguments, so they must not look like
+// options.
+var userName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// serviceName matches OpenRC service and systemd unit names, including
+// template instances such as "getty@tty2".
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9@._:-]*$`)
+
 // Validate checks all required fields and constraints.
 // Returns all errors collected, not just the first one.
 func (c *Config) Validate() error {
@@ -12,18 +91,77 @@ func (c *Config) Validate() error {
 
 	if c.Version == "" {
 		errs = append(errs, "\"version\" is required")
+	} else if _, err := SchemaVersion(c.Version); err != nil {
+		errs = append(errs, err.Error())
 	}
 	if c.Name == "" {
 		errs = append(errs, "\"name\" is required")
+	} else if !imageName.MatchString(c.Name) {
+		errs = append(errs, fmt.Sprintf("name %q is invalid: use letters, digits, dots, dashes and underscores, starting with a letter or digit", c.Name))
+	} else if len(c.Name) > maxNameLength {
+		errs = append(errs, fmt.Sprintf("name %q is too long: %d characters, the limit is %d", c.Name, len(c.Name), maxNameLength))
+	}
+	// It is a component of publish paths, like the name of output files.
+	if c.ImageVersion != "" && !imageName.MatchString(c.ImageVersion) {
+		errs = append(errs, fmt.Sprintf("image_version %q is invalid: use letters, digits, dots, dashes and underscores, starting with a letter or digit", c.ImageVersion))
 	}
 
 	// Distro validation
 	if c.Distro.Base == "" {
 		errs = append(errs, "\"distro.base\" is required")
-	} else if c.Distro.Base != "alpine" && c.Distro.Base != "fedora" {
-		errs = append(errs, fmt.Sprintf("unsupported distro base %q: supported values are \"alpine\", \"fedora\"", c.Distro.Base))
+	} else if c.Distro.Base != "alpine" && c.Distro.Base != "fedora" && c.Distro.Base != "debian" {
+		errs = append(errs, fmt.Sprintf("unsupported distro base %q: supported values are \"alpine\", \"fedora\", \"debian\"", c.Distro.Base))
+	}
+	for _, pkg := range slices.Sorted(maps.Keys(c.PackageAliases)) {
+		for _, base := range slices.Sorted(maps.Keys(c.PackageAliases[pkg])) {
+			if base != "alpine" && base != "fedora" && base != "debian" {
+				errs = append(errs, fmt.Sprintf("package_aliases.%s: unsupported distro base %q", pkg, base))
+			} else if name := c.PackageAliases[pkg][base]; strings.ContainsAny(name, " \t\n") {
+				errs = append(errs, fmt.Sprintf("package_aliases.%s.%s: %q is not a package name", pkg, base, name))
+			}
+		}
+	}
+	if c.Distro.Version != "" {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "distro.version is only supported for distro.base \"alpine\"")
+		} else if !alpineVersion.MatchString(c.Distro.Version) {
+			errs = append(errs, fmt.Sprintf("distro.version %q is invalid: must be a major.minor release such as \"3.20\" or \"edge\"", c.Distro.Version))
+		}
+	}
+	if c.Distro.Kernel != "" {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "distro.kernel is only supported for distro.base \"alpine\"")
+		} else if !slices.Contains(kernelFlavors, c.Distro.Kernel) {
+			errs = append(errs, fmt.Sprintf("distro.kernel %q is invalid: must be one of %s", c.Distro.Kernel, strings.Join(kernelFlavors, ", ")))
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "distro.kernel is not supported for build.output \"oci\": containers run on the host's kernel")
+		}
+	}
+	if c.Distro.Mirror != "" || len(c.Distro.Repositories) > 0 {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "distro.mirror and distro.repositories are only supported for distro.base \"alpine\"")
+		}
+		if c.Distro.Mirror != "" && !httpURL(c.Distro.Mirror) {
+			errs = append(errs, fmt.Sprintf("distro.mirror %q must be an http:// or https:// URL", c.Distro.Mirror))
+		}
+		for i, r := range c.Distro.Repositories {
+			if !httpURL(r.URL) {
+				errs = append(errs, fmt.Sprintf("distro.repositories[%d]: url %q must be an http:// or https:// URL", i, r.URL))
+			}
+			if r.Key != "" && !strings.HasSuffix(r.Key, ".pub") {
+				errs = append(errs, fmt.Sprintf("distro.repositories[%d]: key %q must be a public key file named *.pub", i, r.Key))
+			}
+		}
+	}
+	if c.Distro.LocalMirror != "" {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "distro.local_mirror is only supported for distro.base \"alpine\"")
+		}
+		if strings.Contains(c.Distro.LocalMirror, "://") {
+			errs = append(errs, fmt.Sprintf("distro.local_mirror %q must be a directory, not a URL (see distro.mirror)", c.Distro.LocalMirror))
+		}
 	}
-	if c.Distro.Base == "fedora" {
+	if c.Distro.Base == "fedora" || c.Distro.Base == "debian" {
 		if c.Distro.Type != "" && c.Distro.Type != "server" && c.Distro.Type != "workstation" {
 			errs = append(errs, fmt.Sprintf("distro.type %q is invalid: must be \"server\" or \"workstation\"", c.Distro.Type))
 		}
@@ -36,15 +174,376 @@ func (c *Config) Validate() error {
 	for i, u := range c.Users {
 		if u.Name == "" {
 			errs = append(errs, fmt.Sprintf("users[%d]: \"name\" is required", i))
+		} else if !userName.MatchString(u.Name) || len(u.Name) > 32 {
+			errs = append(errs, fmt.Sprintf("users[%d]: name %q is not a valid user name: use up to 32 letters, digits, dots, dashes and underscores, not starting with a digit, dot or dash", i, u.Name))
 		}
-		if u.Password == "" {
-			errs = append(errs, fmt.Sprintf("users[%d]: \"password\" is required", i))
+		if !u.HasPassword() && len(u.SSHAuthorizedKeys) == 0 {
+			errs = append(errs, fmt.Sprintf("users[%d]: \"password\" is required unless \"ssh_authorized_keys\" is set", i))
 		}
+		errs = append(errs, u.validatePassword(i)...)
+		if u.Shell != "" && !path.IsAbs(u.Shell) {
+			errs = append(errs, fmt.Sprintf("users[%d]: shell %q must be an absolute path", i, u.Shell))
+		}
+		for j, k := range u.SSHAuthorizedKeys {
+			if len(strings.Fields(k)) < 2 {
+				errs = append(errs, fmt.Sprintf("users[%d]: ssh_authorized_keys[%d] is not an OpenSSH public key", i, j))
+			}
+		}
+		for _, g := range u.Groups {
+			if !groupName.MatchString(g) {
+				errs = append(errs, fmt.Sprintf("users[%d]: group %q is not a valid group name", i, g))
+			}
+		}
+	}
+
+	if c.Services != nil {
+		errs = append(errs, c.Services.validate(c.Distro.Base)...)
+	}
+
+	// Overlay files validation
+	errs = append(errs, validateFiles(c.Files)...)
+
+	// Hooks validation
+	if c.Hooks != nil {
+		stages := []struct {
+			name  string
+			hooks []Hook
+		}{
+			{"post_packages", c.Hooks.PostPackages},
+			{"pre_iso", c.Hooks.PreISO},
+			{"post_build", c.Hooks.PostBuild},
+		}
+		for _, st := range stages {
+			for i, h := range st.hooks {
+				if h.Script == "" {
+					errs = append(errs, fmt.Sprintf("hooks.%s[%d]: \"script\" is required", st.name, i))
+				}
+				if h.Chroot && st.name == "post_build" {
+					errs = append(errs, fmt.Sprintf("hooks.post_build[%d]: chroot is not available after the rootfs is packaged", i))
+				}
+			}
+		}
+	}
+
+	// cloud-init validation
+	if c.CloudInit != nil {
+		errs = append(errs, c.validateCloudInit()...)
+	}
+
+	// Provisioning validation
+	if c.Provision != nil {
+		for i, ps := range c.Provision.FirstBoot {
+			if ps.Script == "" {
+				errs = append(errs, fmt.Sprintf("provision.first_boot[%d]: \"script\" is required", i))
+			}
+		}
+		if len(c.Provision.FirstBoot) > 0 && c.OutputMode() == "oci" {
+			errs = append(errs, "provision.first_boot is not supported for build.output \"oci\"")
+		}
+	}
+
+	// Live input validation
+	if c.Live != nil {
+		for i, in := range c.Live.Input {
+			if !keymapName.MatchString(in.Keymap) {
+				errs = append(errs, fmt.Sprintf("live.input[%d]: keymap %q is not a keymap name such as \"de\"", i, in.Keymap))
+			}
+			if in.Font != "" && !fontName.MatchString(in.Font) {
+				errs = append(errs, fmt.Sprintf("live.input[%d]: font %q is not a console font name such as \"ter-v16n\"", i, in.Font))
+			}
+			if strings.ContainsAny(in.Label, "\"\n") {
+				errs = append(errs, fmt.Sprintf("live.input[%d]: label may not contain quotes or newlines", i))
+			}
+		}
+		if len(c.Live.Input) > 0 && c.OutputMode() != "iso" {
+			errs = append(errs, fmt.Sprintf("live.input is only supported for build.output \"iso\", not %q", c.OutputMode()))
+		}
+	}
+
+	// First-boot wizard validation
+	if c.Firstboot != nil && c.Firstboot.Language != "" {
+		if !slices.Contains(wizardLanguages, c.Firstboot.Language) {
+			errs = append(errs, fmt.Sprintf("firstboot.language %q is invalid: supported values are %s", c.Firstboot.Language, strings.Join(wizardLanguages, ", ")))
+		}
+	}
+
+	// Kernel command line validation
+	if c.Boot != nil && strings.ContainsAny(c.Boot.Cmdline, "\n\r\"") {
+		errs = append(errs, "boot.cmdline must be a single line without double quotes")
+	}
+	if c.Boot != nil && c.Boot.Persistence && c.OutputMode() != "iso" && c.OutputMode() != "netboot" {
+		errs = append(errs, fmt.Sprintf("boot.persistence is only supported for live images, not build.output %q", c.Build.Output))
+	}
+	if c.Boot != nil && c.Boot.Toram && c.OutputMode() != "iso" {
+		errs = append(errs, fmt.Sprintf("boot.toram is only supported for build.output \"iso\", not %q", c.OutputMode()))
+	}
+	if c.Boot != nil && c.Boot.SerialConsole {
+		if c.OutputMode() != "iso" {
+			errs = append(errs, fmt.Sprintf("boot.serial_console is only supported for build.output \"iso\", not %q", c.OutputMode()))
+		}
+		if c.Target == "vm" {
+			errs = append(errs, "boot.serial_console is redundant with target \"vm\", which boots on the serial console already")
+		}
+	}
+	if c.Boot != nil && c.Boot.Menu != nil {
+		errs = append(errs, c.Boot.Menu.validate(c.OutputMode())...)
+	}
+	if c.Branding != nil {
+		errs = append(errs, c.Branding.validate(c)...)
+	}
+	if c.Boot != nil && len(c.Boot.InitramfsFeatures) > 0 {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "boot.initramfs_features is only supported for distro.base \"alpine\"")
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "boot.initramfs_features is not supported for build.output \"oci\"")
+		}
+		for i, f := range c.Boot.InitramfsFeatures {
+			if !mkinitfsFeature.MatchString(f) {
+				errs = append(errs, fmt.Sprintf("boot.initramfs_features[%d]: %q is not a mkinitfs feature name", i, f))
+			}
+		}
+	}
+	if c.Boot != nil && c.Boot.UEFI && c.OutputMode() != "iso" {
+		errs = append(errs, fmt.Sprintf("boot.uefi is only supported for build.output \"iso\", not %q", c.OutputMode()))
+	}
+	if c.Target != "" {
+		if c.Target != "vm" {
+			errs = append(errs, fmt.Sprintf("target %q is invalid: must be \"vm\"", c.Target))
+		} else if c.Distro.Base != "alpine" {
+			errs = append(errs, fmt.Sprintf("target \"vm\" is only supported for alpine, not %s", c.Distro.Base))
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "target \"vm\" is not supported for build.output \"oci\"")
+		}
+	}
+	if c.Profile != "" && !slices.Contains(Profiles, c.Profile) {
+		errs = append(errs, fmt.Sprintf("profile %q is invalid: supported values are %s", c.Profile, strings.Join(Profiles, ", ")))
+	}
+
+	// Management validation
+	if c.Management != nil {
+		if !c.ManagementEnabled() {
+			errs = append(errs, "management: enable at least one of \"mdns\", \"ssh\" or \"web_admin\"")
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "management is not supported for build.output \"oci\"")
+		}
+	}
+
+	// Updates validation
+	if c.Updates != nil {
+		errs = append(errs, c.validateUpdates()...)
 	}
 
-	if c.Build != nil && c.Build.Output != "" &&
-		c.Build.Output != "iso" && c.Build.Output != "disk" {
-		errs = append(errs, fmt.Sprintf("build.output %q is invalid: must be \"iso\" or \"disk\"", c.Build.Output))
+	// Assertions validation
+	if c.Assertions != nil {
+		errs = append(errs, c.validateAssertions()...)
+	}
+
+	// Base data validation
+	if c.BaseData != nil {
+		for _, name := range slices.Sorted(maps.Keys(c.BaseData.Versions)) {
+			v := c.BaseData.Versions[name]
+			if !slices.Contains(BaseDataPackages, name) {
+				errs = append(errs, fmt.Sprintf("base_data.versions: %q is invalid: only %s can be pinned", name, strings.Join(BaseDataPackages, " and ")))
+			} else if v == "" {
+				errs = append(errs, fmt.Sprintf("base_data.versions.%s: version is empty", name))
+			}
+		}
+		if c.BaseData.MaxAge != "" {
+			if d, err := ParseAge(c.BaseData.MaxAge); err != nil || d <= 0 {
+				errs = append(errs, fmt.Sprintf("base_data.max_age %q is invalid: use a positive duration such as \"365d\"", c.BaseData.MaxAge))
+			}
+		}
+	}
+
+	// System identity validation
+	if c.System != nil {
+		errs = append(errs, c.validateSystem()...)
+	}
+
+	// Watchdog validation
+	if c.System != nil && c.System.Watchdog != nil {
+		w := c.System.Watchdog
+		if w.Module != "" && !kernelModule.MatchString(w.Module) {
+			errs = append(errs, fmt.Sprintf("system.watchdog.module %q is not a kernel module name", w.Module))
+		}
+		if w.Timeout < 0 || w.Timeout > 3600 {
+			errs = append(errs, fmt.Sprintf("system.watchdog.timeout %d is invalid: must be between 1 and 3600 seconds", w.Timeout))
+		}
+	}
+
+	// Network validation
+	if c.Network != nil {
+		if len(c.Network.Interfaces) > 0 && c.Distro.Base != "alpine" {
+			errs = append(errs, "network.interfaces is only supported for distro.base \"alpine\"")
+		}
+		if len(c.Network.DNS) > 0 && c.Distro.Base != "alpine" {
+			errs = append(errs, "network.dns is only supported for distro.base \"alpine\"")
+		}
+		seen := make(map[string]bool)
+		wireless := 0
+		for i, iface := range c.Network.Interfaces {
+			errs = append(errs, validateInterface(i, iface, seen)...)
+			if iface.InterfaceType() == "wireless" {
+				wireless++
+			}
+		}
+		if wireless > 1 {
+			errs = append(errs, "network.interfaces: only one wireless interface is supported")
+		}
+		for i, ns := range c.Network.DNS {
+			if net.ParseIP(ns) == nil {
+				errs = append(errs, fmt.Sprintf("network.dns[%d]: %q is not an IP address", i, ns))
+			}
+		}
+	}
+
+	// Access point validation
+	if c.AP != nil {
+		errs = append(errs, c.validateAP()...)
+	}
+
+	// WireGuard validation
+	if c.VPN != nil && c.VPN.WireGuard != nil {
+		errs = append(errs, validateWireGuard(c.VPN.WireGuard)...)
+	}
+
+	// Publish targets validation
+	for i, t := range c.Publish {
+		switch t.Type {
+		case "s3":
+			if t.Bucket == "" {
+				errs = append(errs, fmt.Sprintf("publish[%d]: \"bucket\" is required for s3 targets", i))
+			}
+		case "sftp", "http":
+		default:
+			errs = append(errs, fmt.Sprintf("publish[%d]: type %q is invalid: must be \"s3\", \"sftp\" or \"http\"", i, t.Type))
+		}
+		if t.URL == "" {
+			errs = append(errs, fmt.Sprintf("publish[%d]: \"url\" is required", i))
+		}
+		if t.Retries < 0 {
+			errs = append(errs, fmt.Sprintf("publish[%d]: retries must not be negative", i))
+		}
+		if t.PublicURL != "" && !httpURL(t.PublicURL) {
+			errs = append(errs, fmt.Sprintf("publish[%d]: public_url %q must be an http or https URL", i, t.PublicURL))
+		}
+		if t.SigningKey != "" && t.SigningKeyEnv != "" {
+			errs = append(errs, fmt.Sprintf("publish[%d]: set only one of signing_key and signing_key_env", i))
+		}
+		if t.SigningKeyEnv != "" && !envName.MatchString(t.SigningKeyEnv) {
+			errs = append(errs, fmt.Sprintf("publish[%d]: signing_key_env %q is not a valid environment variable name", i, t.SigningKeyEnv))
+		}
+		if (t.SigningKey != "" || t.SigningKeyEnv != "") && !strings.Contains(t.Path, "{channel}") {
+			errs = append(errs, fmt.Sprintf("publish[%d]: signing_key signs the channel manifest, which needs {channel} in path", i))
+		}
+	}
+
+	if c.Build != nil {
+		switch c.Build.Output {
+		case "", "iso", "disk", "qcow2", "raw", "netboot", "oci":
+		default:
+			errs = append(errs, fmt.Sprintf("build.output %q is invalid: must be \"iso\", \"qcow2\", \"raw\", \"disk\", \"netboot\" or \"oci\"", c.Build.Output))
+		}
+		if (c.Build.Image != "" || c.Build.Push || c.Build.LayerCompression != "") && c.OutputMode() != "oci" {
+			errs = append(errs, "build.image, build.push and build.layer_compression require build.output: oci")
+		}
+		if c.Build.Push && c.Build.Image == "" {
+			errs = append(errs, "build.push requires build.image with the registry to push to")
+		}
+	}
+	if c.Build != nil && c.Build.FailOn != "" && !slices.Contains(failOnLevels, c.Build.FailOn) {
+		errs = append(errs, fmt.Sprintf("build.fail_on %q is invalid: supported values are %s", c.Build.FailOn, strings.Join(failOnLevels, ", ")))
+	}
+	if c.SBOMFiles() && c.Distro.Base != "alpine" {
+		errs = append(errs, "build.sbom_files is only supported for distro.base \"alpine\"")
+	}
+	if c.VulnScanEnabled() && c.Distro.Base != "alpine" {
+		errs = append(errs, "build.vulnscan and build.fail_on are only supported for distro.base \"alpine\"")
+	}
+	if c.OutputMode() == "oci" && c.Distro.Base != "alpine" {
+		errs = append(errs, "build.output \"oci\" is only supported for distro.base \"alpine\"")
+	}
+	if c.OutputMode() == "netboot" && c.Distro.Base != "alpine" {
+		errs = append(errs, "build.output \"netboot\" is only supported for distro.base \"alpine\"")
+	}
+	if len(c.NonfatalScripts()) > 0 && c.Distro.Base != "alpine" {
+		errs = append(errs, "build.nonfatal_scripts is only supported for distro.base \"alpine\"")
+	}
+	for i, p := range c.NonfatalScripts() {
+		if strings.TrimSpace(p) == "" {
+			errs = append(errs, fmt.Sprintf("build.nonfatal_scripts[%d]: package name is empty", i))
+		}
+	}
+	if c.Reproducible() {
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "build.reproducible is only supported for distro.base \"alpine\"")
+		}
+		if m := c.OutputMode(); m != "iso" && m != "netboot" {
+			errs = append(errs, fmt.Sprintf("build.reproducible is only supported for iso and netboot outputs, not %s", m))
+		}
+	}
+	if c.Build != nil && c.Build.NetbootBaseURL != "" && c.OutputMode() != "netboot" {
+		errs = append(errs, "build.netboot_base_url requires build.output: netboot")
+	}
+	if c.Build != nil && c.Build.NetbootEmbed && c.OutputMode() != "netboot" {
+		errs = append(errs, "build.netboot_embed requires build.output: netboot")
+	}
+
+	if c.Build != nil {
+		switch c.Build.Filesystem {
+		case "", "ext4", "btrfs":
+		case "zfs":
+			errs = append(errs, "build.filesystem \"zfs\" is not supported: neither Alpine nor Fedora ship ZFS kernel modules in their base repositories")
+		default:
+			errs = append(errs, fmt.Sprintf("build.filesystem %q is invalid: must be \"ext4\" or \"btrfs\"", c.Build.Filesystem))
+		}
+		if m := c.OutputMode(); c.Build.Filesystem != "" && m != "disk" {
+			errs = append(errs, fmt.Sprintf("build.filesystem is only supported for disk outputs, not %s", m))
+		}
+		if c.Build.Compression != "" {
+			if c.RootFilesystem() != "btrfs" {
+				errs = append(errs, "build.compression requires build.filesystem: btrfs")
+			} else if c.Build.Compression != "zstd" && c.Build.Compression != "lzo" && c.Build.Compression != "zlib" {
+				errs = append(errs, fmt.Sprintf("build.compression %q is invalid: must be \"zstd\", \"lzo\" or \"zlib\"", c.Build.Compression))
+			}
+		}
+		if sq := c.Build.Squashfs; sq != nil {
+			if m := c.OutputMode(); m != "iso" && m != "netboot" {
+				errs = append(errs, fmt.Sprintf("build.squashfs is only supported for iso and netboot outputs, not %s", m))
+			}
+			comp := c.SquashfsSettings().Compression
+			if !slices.Contains(SquashfsCompressions, comp) {
+				errs = append(errs, fmt.Sprintf("build.squashfs.compression %q is invalid: must be one of %s", comp, strings.Join(SquashfsCompressions, ", ")))
+			} else if sq.Level != 0 {
+				if top, ok := squashfsMaxLevel[comp]; !ok {
+					errs = append(errs, fmt.Sprintf("build.squashfs.level is not supported for %s compression", comp))
+				} else if sq.Level < 1 || sq.Level > top {
+					errs = append(errs, fmt.Sprintf("build.squashfs.level %d is out of range for %s: must be 1-%d", sq.Level, comp, top))
+				}
+			}
+			if sq.Threads < 0 {
+				errs = append(errs, fmt.Sprintf("build.squashfs.threads %d must not be negative", sq.Threads))
+			}
+		}
+		if comp := c.Build.LayerCompression; comp != "" && comp != "gzip" && comp != "zstd" {
+			errs = append(errs, fmt.Sprintf("build.layer_compression %q is invalid: must be \"gzip\" or \"zstd\"", comp))
+		}
+		if c.Build.CompressThreads < 0 {
+			errs = append(errs, fmt.Sprintf("build.compress_threads %d must not be negative", c.Build.CompressThreads))
+		}
+		if l := c.Build.Limits; l != nil {
+			errs = append(errs, l.validate()...)
+		}
+		if n := c.Build.Network; n != nil {
+			if !n.Capture && len(n.Allow) == 0 {
+				errs = append(errs, "build.network needs capture: true or a list of hosts in allow")
+			}
+			for _, h := range n.Allow {
+				if !validHostPattern(h) {
+					errs = append(errs, fmt.Sprintf("build.network.allow: %q is not a hostname or a pattern such as \"*.example.com\"", h))
+				}
+			}
+		}
 	}
 
 	if len(errs) > 0 {
@@ -52,3 +551,554 @@ func (c *Config) Validate() error {
 	}
 	return nil
 }
+
+// validHostPattern reports whether h is a hostname, optionally behind "*."
+// to match its subdomains.
+func validHostPattern(h string) bool {
+	h = strings.TrimPrefix(h, "*.")
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(h, ".") {
+		if !hostnameLabel.MatchString(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks boot.menu. Whether default names an entry is only known
+// once the built-in entries are, at build time.
+func (m *BootMenu) validate(output string) []string {
+	var errs []string
+	if output != "iso" {
+		errs = append(errs, fmt.Sprintf("boot.menu is only supported for build.output \"iso\", not %q", output))
+	}
+	if m.Timeout < 0 || m.Timeout > 3600 {
+		errs = append(errs, fmt.Sprintf("boot.menu.timeout %d is out of range: must be 0-3600 seconds", m.Timeout))
+	}
+	if strings.ContainsAny(m.Title, "\n\r") {
+		errs = append(errs, "boot.menu.title must be a single line")
+	}
+	labels := map[string]bool{}
+	for i, e := range m.Entries {
+		switch {
+		case e.Label == "":
+			errs = append(errs, fmt.Sprintf("boot.menu.entries[%d]: label is required", i))
+		case strings.ContainsAny(e.Label, "\n\r\""):
+			errs = append(errs, fmt.Sprintf("boot.menu.entries[%d]: label must be a single line without double quotes", i))
+		case labels[e.Label]:
+			errs = append(errs, fmt.Sprintf("boot.menu.entries[%d]: label %q is used twice", i, e.Label))
+		}
+		labels[e.Label] = true
+		if strings.ContainsAny(e.Cmdline, "\n\r\"") {
+			errs = append(errs, fmt.Sprintf("boot.menu.entries[%d]: cmdline must be a single line without double quotes", i))
+		}
+	}
+	return errs
+}
+
+// hexColor matches a "#rrggbb" color.
+var hexColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// validate checks branding for the image of c.
+func (b *Branding) validate(c *Config) []string {
+	var errs []string
+	// Only the isolinux menu of Alpine ISOs can be branded; GRUB draws its
+	// own.
+	if b.Splash != "" || b.Colors != nil {
+		if c.OutputMode() != "iso" || c.Distro.Base != "alpine" {
+			errs = append(errs, fmt.Sprintf("branding.splash and branding.colors are only supported for alpine with build.output \"iso\", not %s with %q", c.Distro.Base, c.OutputMode()))
+		}
+	}
+	if b.Splash != "" {
+		switch strings.ToLower(path.Ext(b.Splash)) {
+		case ".png", ".jpg", ".jpeg":
+		default:
+			errs = append(errs, fmt.Sprintf("branding.splash %q must be a PNG or JPEG image", b.Splash))
+		}
+	}
+	if b.Colors != nil {
+		for name, color := range map[string]string{
+			"title":               b.Colors.Title,
+			"text":                b.Colors.Text,
+			"selected":            b.Colors.Selected,
+			"selected_background": b.Colors.SelectedBackground,
+		} {
+			if color != "" && !hexColor.MatchString(color) {
+				errs = append(errs, fmt.Sprintf("branding.colors.%s %q is invalid: must be \"#rrggbb\"", name, color))
+			}
+		}
+	}
+	if _, _, err := c.Banners(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
+
+// validate checks build.limits.
+func (l *Limits) validate() []string {
+	var errs []string
+	if l.Nice < 0 || l.Nice > 19 {
+		errs = append(errs, fmt.Sprintf("build.limits.nice %d is out of range: must be 1-19", l.Nice))
+	}
+	if l.CPUs != "" {
+		if _, err := ParseCPUList(l.CPUs); err != nil {
+			errs = append(errs, "build.limits.cpus: "+err.Error())
+		}
+	}
+	if l.Memory != "" {
+		if n, err := ParseSize(l.Memory); err != nil {
+			errs = append(errs, "build.limits.memory: "+err.Error())
+		} else if n < 256<<20 {
+			errs = append(errs, fmt.Sprintf("build.limits.memory %q is too small: package managers and mksquashfs need at least 256M", l.Memory))
+		}
+	}
+	if l.IO != "" && !slices.Contains(LimitIOClasses, l.IO) {
+		errs = append(errs, fmt.Sprintf("build.limits.io %q is invalid: must be one of %s", l.IO, strings.Join(LimitIOClasses, ", ")))
+	}
+	return errs
+}
+
+// httpURL reports whether s is an absolute http or https URL.
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateCloudInit checks the cloud_init block.
+func (c *Config) validateCloudInit() []string {
+	var errs []string
+	ci := c.CloudInit
+	if !ci.Enabled {
+		if ci.Tool != "" || len(ci.Datasources) > 0 || ci.Seed != nil {
+			errs = append(errs, "cloud_init: tool, datasources and seed require enabled: true")
+		}
+		return errs
+	}
+	if c.OutputMode() == "oci" {
+		errs = append(errs, "cloud_init is not supported for build.output \"oci\"")
+	}
+	switch ci.Tool {
+	case "", "cloud-init":
+	case "tiny-cloud":
+		if c.Distro.Base != "alpine" {
+			errs = append(errs, "cloud_init.tool \"tiny-cloud\" is only supported for distro.base \"alpine\"")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("cloud_init.tool %q is invalid: must be \"tiny-cloud\" or \"cloud-init\"", ci.Tool))
+	}
+	for i, ds := range ci.Datasources {
+		if _, ok := cloudInitDatasources[ds]; !ok {
+			errs = append(errs, fmt.Sprintf("cloud_init.datasources[%d]: %q is invalid: supported values are %s", i, ds, strings.Join(slices.Sorted(maps.Keys(cloudInitDatasources)), ", ")))
+		}
+	}
+	ds := ci.CloudDatasources()[0]
+	if name, known := cloudInitDatasources[ds]; known && name == "" && c.CloudTool() == "tiny-cloud" {
+		errs = append(errs, fmt.Sprintf("cloud_init.datasources: tiny-cloud does not support %s; put a supported datasource first or set tool: cloud-init", ds))
+	}
+	if ci.Seed != nil && ci.Seed.UserData == "" {
+		errs = append(errs, "cloud_init.seed: \"user_data\" is required")
+	}
+	return errs
+}
+
+// validateAssertions checks the assertions block.
+func (c *Config) validateAssertions() []string {
+	var errs []string
+	a := c.Assertions
+	for _, list := range []struct {
+		key   string
+		paths []string
+	}{{"require_files", a.RequireFiles}, {"forbid_files", a.ForbidFiles}} {
+		for i, p := range list.paths {
+			if !path.IsAbs(p) {
+				errs = append(errs, fmt.Sprintf("assertions.%s[%d]: path %q must be absolute", list.key, i, p))
+			} else if _, err := path.Match(p, ""); err != nil {
+				errs = append(errs, fmt.Sprintf("assertions.%s[%d]: pattern %q is malformed", list.key, i, p))
+			}
+		}
+	}
+	for i, p := range a.Packages {
+		if p.Name == "" {
+			errs = append(errs, fmt.Sprintf("assertions.packages[%d]: \"name\" is required", i))
+		}
+		if _, v := p.VersionConstraint(); p.Version != "" && v == "" {
+			errs = append(errs, fmt.Sprintf("assertions.packages[%d]: version %q has no version after the operator", i, p.Version))
+		}
+	}
+	if a.MaxSize != "" {
+		if _, err := ParseSize(a.MaxSize); err != nil {
+			errs = append(errs, "assertions.max_size: "+err.Error())
+		}
+	}
+	return errs
+}
+
+// validateFiles checks the entries of a files list.
+func validateFiles(files []File) []string {
+	var errs []string
+	for i, f := range files {
+		if f.Path == "" {
+			errs = append(errs, fmt.Sprintf("files[%d]: \"path\" is required", i))
+		} else if !path.IsAbs(f.Path) {
+			errs = append(errs, fmt.Sprintf("files[%d]: path %q must be absolute", i, f.Path))
+		} else if slices.Contains(strings.Split(f.Path, "/"), "..") {
+			errs = append(errs, fmt.Sprintf("files[%d]: path %q must not contain \"..\"", i, f.Path))
+		}
+		if (f.Source == "") == (f.Content == "") {
+			errs = append(errs, fmt.Sprintf("files[%d]: exactly one of \"source\" or \"content\" must be set", i))
+		}
+		if f.Mode != "" {
+			if _, err := strconv.ParseUint(f.Mode, 8, 32); err != nil {
+				errs = append(errs, fmt.Sprintf("files[%d]: mode %q is not an octal permission", i, f.Mode))
+			}
+		}
+		if strings.HasPrefix(f.Owner, "-") {
+			errs = append(errs, fmt.Sprintf("files[%d]: owner %q must not start with \"-\"", i, f.Owner))
+		}
+	}
+	return errs
+}
+
+// validateInterface checks a network.interfaces entry. seen collects the
+// names of the interfaces validated so far to catch duplicates.
+func validateInterface(i int, iface Interface, seen map[string]bool) []string {
+	var errs []string
+	prefix := fmt.Sprintf("network.interfaces[%d]", i)
+	if iface.Name == "" {
+		errs = append(errs, prefix+": \"name\" is required")
+	} else if seen[iface.Name] {
+		errs = append(errs, fmt.Sprintf("%s: duplicate interface %q", prefix, iface.Name))
+	}
+	seen[iface.Name] = true
+
+	if iface.DHCP && iface.Address != "" {
+		errs = append(errs, prefix+": \"dhcp\" and \"address\" are mutually exclusive")
+	}
+	if iface.Address != "" {
+		if _, _, err := net.ParseCIDR(iface.Address); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: address %q must be in CIDR notation, e.g. 192.168.1.10/24", prefix, iface.Address))
+		}
+	}
+	if iface.Gateway != "" {
+		if iface.Address == "" {
+			errs = append(errs, prefix+": \"gateway\" requires a static \"address\"")
+		} else if net.ParseIP(iface.Gateway) == nil {
+			errs = append(errs, fmt.Sprintf("%s: gateway %q is not an IP address", prefix, iface.Gateway))
+		}
+	}
+
+	typ := iface.InterfaceType()
+	switch typ {
+	case "ethernet", "bridge":
+	case "bond":
+		if len(iface.BondMembers) == 0 {
+			errs = append(errs, prefix+": bond requires \"bond_members\"")
+		}
+		if iface.BondMode != "" && !slices.Contains(bondModes, iface.BondMode) {
+			errs = append(errs, fmt.Sprintf("%s: bond_mode %q is invalid: supported values are %s", prefix, iface.BondMode, strings.Join(bondModes, ", ")))
+		}
+	case "vlan":
+		if iface.VLANID < 1 || iface.VLANID > 4094 {
+			errs = append(errs, fmt.Sprintf("%s: vlan_id %d is invalid: must be between 1 and 4094", prefix, iface.VLANID))
+		}
+		if iface.VLANLink == "" {
+			errs = append(errs, prefix+": vlan requires \"vlan_link\"")
+		}
+	case "wireless":
+		if iface.SSID == "" || len(iface.SSID) > 32 {
+			errs = append(errs, prefix+": wireless requires an \"ssid\" of at most 32 bytes")
+		}
+		if n := len(iface.Passphrase); n > 0 && (n < 8 || n > 63) {
+			errs = append(errs, prefix+": passphrase must be 8 to 63 characters (WPA2-PSK)")
+		}
+		if strings.ContainsAny(iface.SSID+iface.Passphrase, "\"\r\n") {
+			errs = append(errs, prefix+": ssid and passphrase must not contain quotes or line breaks")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("%s: type %q is invalid: must be \"ethernet\", \"bond\", \"bridge\", \"vlan\" or \"wireless\"", prefix, iface.Type))
+	}
+	if typ != "bond" && (len(iface.BondMembers) > 0 || iface.BondMode != "") {
+		errs = append(errs, prefix+": bond_members and bond_mode require type: bond")
+	}
+	if typ != "bridge" && len(iface.BridgePorts) > 0 {
+		errs = append(errs, prefix+": bridge_ports requires type: bridge")
+	}
+	if typ != "vlan" && (iface.VLANID != 0 || iface.VLANLink != "") {
+		errs = append(errs, prefix+": vlan_id and vlan_link require type: vlan")
+	}
+	if typ != "wireless" && (iface.SSID != "" || iface.Passphrase != "") {
+		errs = append(errs, prefix+": ssid and passphrase require type: wireless")
+	}
+	return errs
+}
+
+// validateAP checks the ap block.
+func (c *Config) validateAP() []string {
+	var errs []string
+	ap := c.AP
+	if c.Distro.Base != "alpine" {
+		errs = append(errs, "ap is only supported for distro.base \"alpine\"")
+	}
+	if ap.SSID == "" || len(ap.SSID) > 32 {
+		errs = append(errs, "ap.ssid is required and must be at most 32 bytes")
+	}
+	if n := len(ap.Passphrase); n < 8 || n > 63 {
+		errs = append(errs, "ap.passphrase must be 8 to 63 characters (WPA2-PSK)")
+	}
+	if strings.ContainsAny(ap.SSID+ap.Passphrase, "\r\n") {
+		errs = append(errs, "ap.ssid and ap.passphrase must not contain line breaks")
+	}
+	if ch := ap.WirelessChannel(); ch < 1 || (ch > 14 && ch < 36) || ch > 177 {
+		errs = append(errs, fmt.Sprintf("ap.channel %d is invalid: must be 1-14 (2.4 GHz) or 36-177 (5 GHz)", ch))
+	}
+	if ap.Country != "" && !countryCode.MatchString(ap.Country) {
+		errs = append(errs, fmt.Sprintf("ap.country %q must be a two-letter upper-case country code", ap.Country))
+	}
+	if ap.Address != "" && ap.DHCPRange == "" {
+		errs = append(errs, "ap.dhcp_range is required when ap.address is set")
+	}
+	_, subnet, err := net.ParseCIDR(ap.CIDR())
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("ap.address %q must be in CIDR notation, e.g. 192.168.4.1/24", ap.Address))
+	} else {
+		first, last := ap.Range()
+		for _, a := range []string{first, last} {
+			if ip := net.ParseIP(a); ip == nil || !subnet.Contains(ip) {
+				errs = append(errs, fmt.Sprintf("ap.dhcp_range %q must be \"first-last\" with both addresses in %s", ap.DHCPRange, subnet))
+				break
+			}
+		}
+	}
+	if c.Network != nil {
+		for _, iface := range c.Network.Interfaces {
+			if iface.Name == ap.WirelessInterface() {
+				errs = append(errs, fmt.Sprintf("ap.interface %q is also configured in network.interfaces", iface.Name))
+			}
+		}
+	}
+	return errs
+}
+
+// validateUpdates checks the updates block.
+func (c *Config) validateUpdates() []string {
+	var errs []string
+	u := c.Updates
+	if c.Distro.Base != "alpine" {
+		errs = append(errs, "updates is only supported for distro.base \"alpine\"")
+	}
+	switch u.Mode {
+	case "frozen":
+		if u.Schedule != "" || u.Reboot != "" {
+			errs = append(errs, "updates.schedule and updates.reboot require updates.mode \"unattended\" or \"image\"")
+		}
+	case "unattended":
+		// A live system keeps its upgrades in RAM and loses them at reboot.
+		if c.OutputMode() != "disk" {
+			errs = append(errs, "updates.mode \"unattended\" requires build.output \"disk\"")
+		}
+		errs = append(errs, u.validateSchedule()...)
+	case "image":
+		// The agent stages new root filesystems on the persistence
+		// partition, which the live init boots them from.
+		if c.OutputMode() != "iso" || c.Boot == nil || !c.Boot.Persistence {
+			errs = append(errs, "updates.mode \"image\" requires build.output \"iso\" and boot.persistence")
+		}
+		// The agent only installs releases newer than the running one.
+		if c.ImageVersion == "" {
+			errs = append(errs, "updates.mode \"image\" requires image_version, which releases are compared by")
+		}
+		if !httpURL(u.Manifest) {
+			errs = append(errs, "updates.manifest must be the http or https URL of a channel.json")
+		}
+		if raw, err := base64.StdEncoding.DecodeString(u.PublicKey); err != nil || len(raw) != ed25519.PublicKeySize {
+			errs = append(errs, "updates.public_key must be the base64 Ed25519 public key the channel manifest is signed with")
+		}
+		errs = append(errs, u.validateSchedule()...)
+	case "":
+		errs = append(errs, "updates.mode is required: \"frozen\", \"unattended\" or \"image\"")
+	default:
+		errs = append(errs, fmt.Sprintf("updates.mode %q is invalid: must be \"frozen\", \"unattended\" or \"image\"", u.Mode))
+	}
+	if u.Mode != "image" && (u.Manifest != "" || u.PublicKey != "") {
+		errs = append(errs, "updates.manifest and updates.public_key require updates.mode \"image\"")
+	}
+	return errs
+}
+
+// validateSchedule checks updates.schedule and updates.reboot.
+func (u *Updates) validateSchedule() []string {
+	var errs []string
+	if u.Schedule != "daily" && u.Schedule != "weekly" && u.Schedule != "" {
+		fields := strings.Fields(u.Schedule)
+		valid := len(fields) == 5
+		for _, f := range fields {
+			valid = valid && cronField.MatchString(f)
+		}
+		if !valid {
+			errs = append(errs, fmt.Sprintf("updates.schedule %q is invalid: must be \"daily\", \"weekly\" or a five-field cron expression", u.Schedule))
+		}
+	}
+	if u.Reboot != "" && !slices.Contains(rebootPolicies, u.Reboot) {
+		errs = append(errs, fmt.Sprintf("updates.reboot %q is invalid: supported values are %s", u.Reboot, strings.Join(rebootPolicies, ", ")))
+	}
+	return errs
+}
+
+// validateWireGuard checks the vpn.wireguard block.
+func validateWireGuard(wg *WireGuard) []string {
+	var errs []string
+	if !wgInterface.MatchString(wg.InterfaceName()) {
+		errs = append(errs, fmt.Sprintf("vpn.wireguard.interface %q is not a valid interface name", wg.Interface))
+	}
+	if wg.ConfigFile != "" {
+		if wg.PrivateKey != "" || wg.PrivateKeyFile != "" || len(wg.Address) > 0 || len(wg.DNS) > 0 || wg.ListenPort != 0 || len(wg.Peers) > 0 {
+			errs = append(errs, "vpn.wireguard.config_file cannot be combined with an inline interface configuration")
+		}
+		return errs
+	}
+
+	if (wg.PrivateKey == "") == (wg.PrivateKeyFile == "") {
+		errs = append(errs, "vpn.wireguard: exactly one of \"config_file\", \"private_key\" or \"private_key_file\" must be set")
+	}
+	if wg.PrivateKey != "" && !wgKey.MatchString(wg.PrivateKey) {
+		errs = append(errs, "vpn.wireguard.private_key is not a WireGuard key")
+	}
+	if len(wg.Address) == 0 {
+		errs = append(errs, "vpn.wireguard.address is required")
+	}
+	for _, a := range wg.Address {
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			errs = append(errs, fmt.Sprintf("vpn.wireguard.address %q must be in CIDR notation", a))
+		}
+	}
+	for _, d := range wg.DNS {
+		if net.ParseIP(d) == nil {
+			errs = append(errs, fmt.Sprintf("vpn.wireguard.dns %q is not an IP address", d))
+		}
+	}
+	if wg.ListenPort < 0 || wg.ListenPort > 65535 {
+		errs = append(errs, fmt.Sprintf("vpn.wireguard.listen_port %d is out of range", wg.ListenPort))
+	}
+	if len(wg.Peers) == 0 {
+		errs = append(errs, "vpn.wireguard: at least one peer is required")
+	}
+	for i, p := range wg.Peers {
+		if !wgKey.MatchString(p.PublicKey) {
+			errs = append(errs, fmt.Sprintf("vpn.wireguard.peers[%d]: public_key is not a WireGuard key", i))
+		}
+		if p.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				errs = append(errs, fmt.Sprintf("vpn.wireguard.peers[%d]: endpoint %q must be \"host:port\"", i, p.Endpoint))
+			}
+		}
+		if len(p.AllowedIPs) == 0 {
+			errs = append(errs, fmt.Sprintf("vpn.wireguard.peers[%d]: allowed_ips is required", i))
+		}
+		for _, a := range p.AllowedIPs {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				errs = append(errs, fmt.Sprintf("vpn.wireguard.peers[%d]: allowed_ips entry %q must be in CIDR notation", i, a))
+			}
+		}
+		if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+			errs = append(errs, fmt.Sprintf("vpn.wireguard.peers[%d]: persistent_keepalive %d is out of range", i, p.PersistentKeepalive))
+		}
+	}
+	return errs
+}
+
+// validateSystem checks the hostname, time zone and keymap settings.
+func (c *Config) validateSystem() []string {
+	var errs []string
+	s := c.System
+	if h := s.Hostname; h != "" {
+		labels := strings.Split(h, ".")
+		valid := len(h) <= 253
+		for _, l := range labels {
+			valid = valid && hostnameLabel.MatchString(l)
+		}
+		if !valid {
+			errs = append(errs, fmt.Sprintf("system.hostname %q is not a valid hostname", h))
+		}
+	}
+	if s.Timezone != "" && !timezoneName.MatchString(s.Timezone) {
+		errs = append(errs, fmt.Sprintf("system.timezone %q is not a time zone name such as \"Europe/Berlin\"", s.Timezone))
+	}
+	if s.Autologin != "" {
+		if s.Autologin != "root" && !slices.ContainsFunc(c.Users, func(u User) bool { return u.Name == s.Autologin }) {
+			errs = append(errs, fmt.Sprintf("system.autologin %q is neither root nor a user in \"users\"", s.Autologin))
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "system.autologin is not supported for build.output \"oci\"")
+		}
+	}
+	if s.Keymap != "" {
+		if !keymapName.MatchString(s.Keymap) {
+			errs = append(errs, fmt.Sprintf("system.keymap %q is not a keymap name such as \"de\"", s.Keymap))
+		} else if c.OutputMode() == "oci" {
+			errs = append(errs, "system.keymap is not supported for build.output \"oci\"")
+		}
+	}
+	return errs
+}
+
+// envName matches the environment variable names password_env and
+// signing_key_env accept.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validatePassword checks that user i gives its password at most one way,
+// and that a pre-hashed one is a crypt(3) hash /etc/shadow can hold.
+func (u User) validatePassword(i int) []string {
+	var errs []string
+	set := 0
+	for _, v := range []string{u.Password, u.PasswordHash, u.PasswordEnv, u.PasswordFile} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		errs = append(errs, fmt.Sprintf("users[%d]: only one of \"password\", \"password_hash\", \"password_env\" and \"password_file\" may be set", i))
+	}
+	if h := u.PasswordHash; h != "" && (!strings.HasPrefix(h, "$") || strings.ContainsAny(h, ": \t\n")) {
+		errs = append(errs, fmt.Sprintf("users[%d]: password_hash is not a crypt(3) hash such as \"mkpasswd -m sha-512\" prints", i))
+	}
+	if u.PasswordEnv != "" && !envName.MatchString(u.PasswordEnv) {
+		errs = append(errs, fmt.Sprintf("users[%d]: password_env %q is not a valid environment variable name", i, u.PasswordEnv))
+	}
+	if strings.Contains(u.Password, "\n") {
+		errs = append(errs, fmt.Sprintf("users[%d]: password must not contain a newline", i))
+	}
+	return errs
+}
+
+// validate checks services for distro base.
+func (s *Services) validate(base string) []string {
+	var errs []string
+	for _, list := range []struct {
+		key   string
+		names []string
+	}{{"enable", s.Enable}, {"disable", s.Disable}} {
+		for _, svc := range list.names {
+			if !serviceName.MatchString(svc) {
+				errs = append(errs, fmt.Sprintf("services.%s: %q is not a valid service name", list.key, svc))
+			}
+		}
+	}
+	for _, svc := range s.Disable {
+		if slices.Contains(s.Enable, svc) {
+			errs = append(errs, fmt.Sprintf("services: %s is both enabled and disabled", svc))
+		}
+	}
+	if len(s.Runlevels) > 0 && base != "alpine" {
+		errs = append(errs, "services.runlevels is only supported for alpine (OpenRC); systemd has no runlevels")
+	}
+	for _, svc := range slices.Sorted(maps.Keys(s.Runlevels)) {
+		if !slices.Contains(s.Enable, svc) {
+			errs = append(errs, fmt.Sprintf("services.runlevels: %s is not in services.enable", svc))
+		}
+		if rl := s.Runlevels[svc]; !slices.Contains(ServiceRunlevels, rl) {
+			errs = append(errs, fmt.Sprintf("services.runlevels: runlevel %q of %s is invalid: must be one of %s", rl, svc, strings.Join(ServiceRunlevels, ", ")))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,158 @@
+// Package confine runs third-party helper tools (xorriso, mksquashfs)
+// with fewer privileges than the engine itself. The engine runs as root and
+// needs most of root's capabilities for chroots and mounts; the helpers only
+// read and write files. Each helper runs under setpriv(1) with its bounding
+// set cut down to the capabilities it needs, no_new_privs set and, where
+// setpriv and the architecture allow, a seccomp filter refusing mount,
+// module, kexec and similar system-wide operations. Without setpriv the
+// helpers run unconfined.
+package confine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// capabilities maps the capability names used here to their numbers.
+var capabilities = map[string]uint{
+	"chown":           0,
+	"dac_override":    1,
+	"dac_read_search": 2,
+	"fowner":          3,
+	"fsetid":          4,
+	"setgid":          6,
+	"setuid":          7,
+	"setpcap":         8,
+	"sys_chroot":      18,
+	"sys_admin":       21,
+	"mknod":           27,
+	"setfcap":         31,
+}
+
+// Engine is the capability set a build needs: sys_admin for mounts and
+// loop devices, sys_chroot for chroot, setuid/setgid for package scripts
+// switching users, setpcap to confine helpers, and the file capabilities
+// for unpacking packages owned by other users, with device nodes and file
+// capabilities of their own.
+var Engine = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid",
+	"setgid", "setuid", "setpcap", "sys_chroot", "sys_admin", "mknod", "setfcap",
+}
+
+// Writer is the capability set of helpers that read the rootfs and write an
+// image: files owned by other users are readable, and the image can be
+// written into a directory root does not own, as root could. Nothing else.
+var Writer = []string{"dac_read_search", "dac_override"}
+
+// CheckEngine returns an error naming the capabilities in Engine that the
+// process lacks, e.g. when running as root in an unprivileged container.
+func CheckEngine() error {
+	eff, err := effectiveCaps()
+	if err != nil {
+		return err
+	}
+	if missing := missingCaps(eff, Engine); len(missing) > 0 {
+		return fmt.Errorf("missing capabilities: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// effectiveCaps returns the effective capability mask of the process.
+func effectiveCaps() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("reading capabilities: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("reading capabilities: no CapEff in /proc/self/status")
+}
+
+// missingCaps returns the names in want that are not set in mask.
+func missingCaps(mask uint64, want []string) []string {
+	var missing []string
+	for _, name := range want {
+		if mask&(1<<capabilities[name]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+var (
+	probeOnce sync.Once
+	setpriv   string // path to setpriv; "" when not installed
+	seccompOK bool   // setpriv supports --seccomp-filter
+)
+
+// probe looks for setpriv and its seccomp support once per process.
+func probe() {
+	probeOnce.Do(func() {
+		path, err := exec.LookPath("setpriv")
+		if err != nil {
+			ui.Degrade("helper confinement", "setpriv not found (install util-linux): xorriso and mksquashfs run with every capability")
+			return
+		}
+		setpriv = path
+		help, _ := exec.Command(path, "--help").Output()
+		seccompOK = strings.Contains(string(help), "--seccomp-filter") && filter() != nil
+	})
+}
+
+// Command returns a command running name with only the capabilities in
+// keep. It is bound to ctx like audit.CommandContext.
+func Command(ctx context.Context, keep []string, name string, arg ...string) *audit.Cmd {
+	probe()
+	if setpriv == "" {
+		return audit.CommandContext(ctx, name, arg...)
+	}
+	// The filter is a few hundred bytes, well within the pipe buffer, so it
+	// is written up front; setpriv reads it from the read end as fd 3. The
+	// child has its own copy of the read end once started, so ours is
+	// closed then.
+	var extra []*os.File
+	if seccompOK {
+		if r, w, err := os.Pipe(); err == nil {
+			w.Write(filter())
+			w.Close()
+			extra = append(extra, r)
+		}
+	}
+	args := wrapArgs(keep, len(extra) > 0)
+	args = append(append(args, "--", name), arg...)
+	cmd := audit.CommandContext(ctx, setpriv, args...)
+	cmd.ExtraFiles = extra
+	for _, f := range extra {
+		cmd.CloseAfterStart(f)
+	}
+	return cmd
+}
+
+// wrapArgs returns the setpriv options keeping only the capabilities in
+// keep. Root regains its bounding set on exec, so the bounding set is what
+// limits the helper; the inheritable set is cleared so nothing is added back.
+func wrapArgs(keep []string, seccomp bool) []string {
+	bounding := "-all"
+	for _, c := range keep {
+		bounding += ",+" + c
+	}
+	args := []string{"--no-new-privs", "--inh-caps=-all", "--bounding-set=" + bounding}
+	if seccomp {
+		args = append(args, "--seccomp-filter=/dev/fd/3")
+	}
+	return args
+}
@@ -0,0 +1,90 @@
+package confine
+
+import (
+	"encoding/binary"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMissingCaps(t *testing.T) {
+	// Docker's default set: chown, dac_override, fowner, fsetid, kill,
+	// setgid, setuid, setpcap, net_bind_service, net_raw, sys_chroot, mknod,
+	// audit_write, setfcap.
+	missing := missingCaps(0xa80425fb, Engine)
+	if got := strings.Join(missing, ","); got != "dac_read_search,sys_admin" {
+		t.Errorf("missing = %q, want dac_read_search,sys_admin", got)
+	}
+	if missing := missingCaps(0x1ffffffffff, Engine); len(missing) != 0 {
+		t.Errorf("full set reported missing %v", missing)
+	}
+}
+
+func TestWrapArgs(t *testing.T) {
+	got := strings.Join(wrapArgs(Writer, true), " ")
+	want := "--no-new-privs --inh-caps=-all --bounding-set=-all,+dac_read_search,+dac_override --seccomp-filter=/dev/fd/3"
+	if got != want {
+		t.Errorf("wrapArgs = %q, want %q", got, want)
+	}
+	if got := strings.Join(wrapArgs(nil, false), " "); strings.Contains(got, "seccomp") || !strings.HasSuffix(got, "--bounding-set=-all") {
+		t.Errorf("wrapArgs without caps or seccomp = %q", got)
+	}
+}
+
+// run interprets the filter for one system call, as the kernel would.
+func run(t *testing.T, prog []byte, arch, nr uint32) uint32 {
+	t.Helper()
+	var acc uint32
+	for pc := 0; pc*8 < len(prog); pc++ {
+		ins := prog[pc*8:]
+		code, jt, jf, k := binary.LittleEndian.Uint16(ins), int(ins[2]), int(ins[3]), binary.LittleEndian.Uint32(ins[4:])
+		switch code {
+		case bpfLdAbs:
+			acc = map[uint32]uint32{0: nr, 4: arch}[k]
+		case bpfJeq:
+			if acc == k {
+				pc += jt
+			} else {
+				pc += jf
+			}
+		case bpfJge:
+			if acc >= k {
+				pc += jt
+			} else {
+				pc += jf
+			}
+		case bpfRet:
+			return k
+		default:
+			t.Fatalf("unexpected opcode %#x at %d", code, pc)
+		}
+	}
+	t.Fatal("filter fell off the end")
+	return 0
+}
+
+func TestFilter(t *testing.T) {
+	prog := filter()
+	if runtime.GOARCH != "amd64" {
+		if prog != nil {
+			t.Fatal("filter built for a non-x86_64 architecture")
+		}
+		return
+	}
+	for _, nr := range deniedSyscalls {
+		if got := run(t, prog, auditArch, nr); got != retEPERM {
+			t.Errorf("syscall %d: got %#x, want EPERM", nr, got)
+		}
+	}
+	for _, nr := range []uint32{0, 1, 2, 59, 92, 133, 257} { // read write open execve chown mknod openat
+		if got := run(t, prog, auditArch, nr); got != retAllow {
+			t.Errorf("syscall %d: got %#x, want allow", nr, got)
+		}
+	}
+	if got := run(t, prog, auditArch, x32Bit|165); got != retEPERM {
+		t.Errorf("x32 mount: got %#x, want EPERM", got)
+	}
+	if got := run(t, prog, 0x40000003, 1); got != retEPERM { // i386
+		t.Errorf("i386 call: got %#x, want EPERM", got)
+	}
+}
@@ -0,0 +1,89 @@
+package confine
+
+import (
+	"encoding/binary"
+	"runtime"
+)
+
+// deniedSyscalls are the x86_64 system calls a helper never needs: they
+// change mounts, namespaces, the kernel, the clock or other processes.
+var deniedSyscalls = []uint32{
+	101, // ptrace
+	155, // pivot_root
+	161, // chroot
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	170, // sethostname
+	171, // setdomainname
+	172, // iopl
+	173, // ioperm
+	175, // init_module
+	176, // delete_module
+	227, // clock_settime
+	246, // kexec_load
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	272, // unshare
+	298, // perf_event_open
+	304, // open_by_handle_at
+	308, // setns
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	432, // fsmount
+}
+
+// Classic BPF opcodes and seccomp constants (linux/filter.h, linux/seccomp.h).
+const (
+	bpfLdAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeq    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJge    = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRet    = 0x06 // BPF_RET | BPF_K
+	auditArch = 0xc000003e
+	x32Bit    = 0x40000000
+	retAllow  = 0x7fff0000
+	retEPERM  = 0x00050001 // SECCOMP_RET_ERRNO | EPERM
+)
+
+// filter returns the seccomp program refusing deniedSyscalls with EPERM,
+// as the raw struct sock_filter array setpriv --seccomp-filter loads, or
+// nil on architectures other than x86_64. Calls through another ABI (i386,
+// x32) are refused as a whole so the list cannot be bypassed.
+func filter() []byte {
+	if runtime.GOARCH != "amd64" {
+		return nil
+	}
+	n := len(deniedSyscalls)
+	// Instruction indexes: 0-4 header, 5..5+n-1 checks, then allow, deny.
+	allow := 5 + n
+	deny := allow + 1
+	prog := [][4]uint32{
+		{bpfLdAbs, 0, 0, 4}, // seccomp_data.arch
+		{bpfJeq, 1, 0, auditArch},
+		{bpfRet, 0, 0, retEPERM},
+		{bpfLdAbs, 0, 0, 0}, // seccomp_data.nr
+		{bpfJge, uint32(deny - 5), 0, x32Bit},
+	}
+	for i, nr := range deniedSyscalls {
+		prog = append(prog, [4]uint32{bpfJeq, uint32(deny - (5 + i) - 1), 0, nr})
+	}
+	prog = append(prog, [4]uint32{bpfRet, 0, 0, retAllow}, [4]uint32{bpfRet, 0, 0, retEPERM})
+
+	out := make([]byte, 0, 8*len(prog))
+	for _, ins := range prog {
+		out = binary.LittleEndian.AppendUint16(out, uint16(ins[0]))
+		out = append(out, byte(ins[1]), byte(ins[2]))
+		out = binary.LittleEndian.AppendUint32(out, ins[3])
+	}
+	return out
+}
@@ -0,0 +1,221 @@
+// Package cpio reads and writes cpio archives in the newc format, the
+// format of Linux initramfs images.
+package cpio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Trailer is the name of the entry that ends an archive.
+const Trailer = "TRAILER!!!"
+
+// maxNameSize bounds entry names, including the terminating NUL.
+const maxNameSize = 4096
+
+// File type bits of Header.Mode, as in st_mode.
+const (
+	TypeMask    = 0o170000
+	TypeDir     = 0o040000
+	TypeRegular = 0o100000
+	TypeSymlink = 0o120000
+)
+
+// Header is one newc entry. A symlink's target is its data.
+type Header struct {
+	Name      string
+	Ino       uint32
+	Mode      uint32 // file type and permission bits
+	UID, GID  uint32
+	Nlink     uint32
+	Mtime     int64
+	Size      int64
+	DevMajor  uint32
+	DevMinor  uint32
+	RdevMajor uint32
+	RdevMinor uint32
+}
+
+// Type returns the file type bits of the mode.
+func (h *Header) Type() uint32 {
+	return h.Mode & TypeMask
+}
+
+// Reader reads the entries of one archive.
+type Reader struct {
+	r    *bufio.Reader
+	left int64 // data of the current entry not yet read
+	pad  int   // padding after it
+	done bool
+}
+
+// NewReader returns a Reader reading from r. When r is a *bufio.Reader it
+// is read no further than the end of the archive, so another archive
+// following it, as in an initramfs, can be read next.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br}
+}
+
+// Next advances to the next entry, skipping what is left of the current
+// one. It returns io.EOF at the trailer.
+func (r *Reader) Next() (*Header, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if _, err := r.r.Discard(int(r.left) + r.pad); err != nil {
+		return nil, unexpected(err)
+	}
+	r.left, r.pad = 0, 0
+
+	var raw [110]byte
+	if _, err := io.ReadFull(r.r, raw[:]); err != nil {
+		return nil, fmt.Errorf("reading cpio header: %w", unexpected(err))
+	}
+	if m := string(raw[:6]); m != "070701" && m != "070702" {
+		return nil, fmt.Errorf("unsupported cpio format %q (only newc is)", m)
+	}
+	var fields [13]uint32
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed cpio header: %w", err)
+		}
+		fields[i] = uint32(v)
+	}
+	h := &Header{
+		Ino: fields[0], Mode: fields[1], UID: fields[2], GID: fields[3],
+		Nlink: fields[4], Mtime: int64(fields[5]), Size: int64(fields[6]),
+		DevMajor: fields[7], DevMinor: fields[8], RdevMajor: fields[9], RdevMinor: fields[10],
+	}
+	nameSize := int(fields[11])
+	if nameSize == 0 || nameSize > maxNameSize {
+		return nil, errors.New("malformed cpio header: bad name size")
+	}
+	name := make([]byte, nameSize)
+	if _, err := io.ReadFull(r.r, name); err != nil {
+		return nil, unexpected(err)
+	}
+	if _, err := r.r.Discard(pad4(110 + nameSize)); err != nil {
+		return nil, unexpected(err)
+	}
+	h.Name = strings.TrimRight(string(name), "\x00")
+	if h.Name == Trailer {
+		r.done = true
+		return nil, io.EOF
+	}
+	r.left, r.pad = h.Size, pad4(int(h.Size))
+	return h, nil
+}
+
+// Read reads the data of the current entry.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// unexpected turns io.EOF inside an archive into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer writes one archive.
+type Writer struct {
+	w       io.Writer
+	left    int64 // data of the current entry not yet written
+	pad     int
+	written int64
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader starts a new entry; its Size bytes of data follow with Write.
+func (w *Writer) WriteHeader(h *Header) error {
+	if w.left > 0 {
+		return fmt.Errorf("cpio: %d bytes of the previous entry missing", w.left)
+	}
+	if err := w.padding(); err != nil {
+		return err
+	}
+	if len(h.Name)+1 > maxNameSize {
+		return fmt.Errorf("cpio: name too long: %s", h.Name)
+	}
+	if h.Size < 0 || h.Size > 0xFFFFFFFF {
+		return fmt.Errorf("cpio: %s: size %d does not fit the newc format", h.Name, h.Size)
+	}
+	var b strings.Builder
+	b.WriteString("070701")
+	for _, v := range []uint32{
+		h.Ino, h.Mode, h.UID, h.GID, h.Nlink, uint32(h.Mtime), uint32(h.Size),
+		h.DevMajor, h.DevMinor, h.RdevMajor, h.RdevMinor, uint32(len(h.Name) + 1), 0,
+	} {
+		fmt.Fprintf(&b, "%08X", v)
+	}
+	b.WriteString(h.Name)
+	b.WriteByte(0)
+	b.WriteString(strings.Repeat("\x00", pad4(b.Len())))
+	n, err := io.WriteString(w.w, b.String())
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	w.left, w.pad = h.Size, pad4(int(h.Size))
+	return nil
+}
+
+// Write writes data of the current entry.
+func (w *Writer) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.left {
+		return 0, errors.New("cpio: write past the size in the header")
+	}
+	n, err := w.w.Write(p)
+	w.left -= int64(n)
+	w.written += int64(n)
+	return n, err
+}
+
+// padding writes the padding after the data of the last entry.
+func (w *Writer) padding() error {
+	n, err := w.w.Write(make([]byte, w.pad))
+	w.pad = 0
+	w.written += int64(n)
+	return err
+}
+
+// Close writes the trailer, padded to a multiple of 512 bytes as cpio(1)
+// does. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.WriteHeader(&Header{Name: Trailer, Nlink: 1}); err != nil {
+		return err
+	}
+	_, err := w.w.Write(make([]byte, (512-w.written%512)%512))
+	return err
+}
+
+// pad4 returns the padding after n bytes to the next multiple of 4.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
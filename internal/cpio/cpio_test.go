@@ -0,0 +1,77 @@
+package cpio
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	entries := []struct {
+		h    Header
+		data string
+	}{
+		{Header{Name: "bin", Mode: TypeDir | 0755, Nlink: 2, Mtime: 1700000000}, ""},
+		{Header{Name: "bin/sh", Mode: TypeSymlink | 0777, Nlink: 1}, "busybox"},
+		{Header{Name: "init", Ino: 7, Mode: TypeRegular | 0755, UID: 1, GID: 2, Nlink: 1}, "#!/bin/sh\n"},
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, e := range entries {
+		h := e.h
+		h.Size = int64(len(e.data))
+		if err := w.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%512 != 0 {
+		t.Errorf("archive of %d bytes is not padded to 512", buf.Len())
+	}
+
+	// A second archive follows, as in an initramfs with early microcode.
+	buf.WriteString("next")
+	br := bufio.NewReader(&buf)
+	r := NewReader(br)
+	for _, e := range entries {
+		h, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := e.h
+		want.Size = int64(len(e.data))
+		if *h != want {
+			t.Errorf("header = %+v, want %+v", *h, want)
+		}
+		if data, err := io.ReadAll(r); err != nil || string(data) != e.data {
+			t.Errorf("%s: data %q, %v; want %q", h.Name, data, err, e.data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last entry: %v, want io.EOF", err)
+	}
+	// The padding after the trailer is left to the caller to skip.
+	if rest, _ := io.ReadAll(br); string(bytes.TrimLeft(rest, "\x00")) != "next" {
+		t.Errorf("read past the archive: %q left", rest)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteHeader(&Header{Name: "init", Mode: TypeRegular | 0755, Size: 100})
+	w.Write(make([]byte, 100))
+	r := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-20]))
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading a truncated entry: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
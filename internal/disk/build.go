@@ -1,7 +1,8 @@
-// Package disk builds bootable qcow2 disk images from a rootfs directory.
+// Package disk builds bootable raw or qcow2 disk images from a rootfs directory.
 package disk
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +10,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
@@ -16,31 +18,56 @@ import (
 var grubInstallCandidates = []string{"grub2-install", "grub-install"}
 var grubMkconfigCandidates = []string{"grub2-mkconfig", "grub-mkconfig"}
 
+// Options controls how the disk image is laid out.
+type Options struct {
+	Format      string // "qcow2" (default) or "raw"
+	Size        string // passed directly to qemu-img (e.g. "4G", "8G")
+	Filesystem  string // "ext4" or "btrfs"
+	Compression string // btrfs compression algorithm; "" disables it
+}
+
+// btrfsSubvolumes maps each btrfs subvolume to its mount point inside the rootfs.
+// Keeping /var separate lets root snapshots be rolled back without losing logs.
+var btrfsSubvolumes = []struct{ name, mountpoint string }{
+	{"@", "/"},
+	{"@var", "/var"},
+}
+
 // CheckDiskDeps verifies all host tools required for disk image builds.
-func CheckDiskDeps() error {
-	tools := []string{"qemu-img", "sfdisk", "losetup", "mkfs.ext4"}
+// GRUB is not among them: Build runs grub-install and grub-mkconfig from the
+// rootfs and checks for them there.
+func CheckDiskDeps(filesystem string) error {
+	tools := []string{"qemu-img", "sfdisk", "losetup", "mkfs." + filesystem}
+	if filesystem == "btrfs" {
+		tools = append(tools, "btrfs")
+	}
 	for _, t := range tools {
 		if _, err := exec.LookPath(t); err != nil {
 			return fmt.Errorf("required tool not found: %s (install with your package manager)", t)
 		}
 	}
-	if resolvebin(grubInstallCandidates) == "" {
-		return fmt.Errorf("grub2-install not found (install grub2-tools or grub-pc)")
-	}
-	if resolvebin(grubMkconfigCandidates) == "" {
-		return fmt.Errorf("grub2-mkconfig not found (install grub2-tools or grub-pc)")
-	}
 	return nil
 }
 
-// Build creates a bootable qcow2 disk image from rootfsPath.
-// diskSize is passed directly to qemu-img (e.g. "4G", "8G").
-// outputPath should end in .qcow2.
-func Build(rootfsPath, outputPath, diskSize string) error {
+// Build creates a bootable disk image from rootfsPath. GRUB is installed with
+// the grub tools from inside the rootfs, so the image must contain them.
+// outputPath should end in .qcow2 or .img to match opts.Format.
+func Build(ctx context.Context, rootfsPath, outputPath string, opts Options) error {
 	workDir := filepath.Dir(rootfsPath) // e.g. /tmp/distrorun-<name>
 	rawImg := filepath.Join(workDir, "disk.img")
 	mntDir := filepath.Join(workDir, "mnt")
 
+	// GRUB is run from the rootfs: make sure it is there before spending
+	// time on the image, as CheckDiskDeps does for the host tools.
+	grubInstall := chrootBin(rootfsPath, grubInstallCandidates)
+	if grubInstall == "" {
+		return fmt.Errorf("grub-install not found in rootfs (install grub2-pc or grub-bios)")
+	}
+	grubMkconfig := chrootBin(rootfsPath, grubMkconfigCandidates)
+	if grubMkconfig == "" {
+		return fmt.Errorf("grub-mkconfig not found in rootfs")
+	}
+
 	loopDev := ""
 	mntActive := false
 
@@ -50,21 +77,21 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 			unmountAll(mntDir)
 		}
 		if loopDev != "" {
-			exec.Command("losetup", "-d", loopDev).Run()
+			audit.Command("losetup", "-d", loopDev).Run()
 		}
-		os.Remove(rawImg)
+		audit.Remove(rawImg)
 	}()
 
 	// 1. Create raw disk image
-	ui.SubStep(fmt.Sprintf("Creating raw disk image (%s)...", diskSize))
-	if err := run("qemu-img", "create", "-f", "raw", rawImg, diskSize); err != nil {
+	ui.SubStep(fmt.Sprintf("Creating raw disk image (%s)...", opts.Size))
+	if err := run(ctx, "qemu-img", "create", "-f", "raw", rawImg, opts.Size); err != nil {
 		return fmt.Errorf("qemu-img create: %w", err)
 	}
 
-	// 2. Partition: single ext4 partition, 1 MB BIOS boot gap for GRUB
+	// 2. Partition: single root partition, 1 MB BIOS boot gap for GRUB
 	ui.SubStep("Partitioning disk...")
 	sfdiskInput := "label: dos\n\nstart=2048, type=83, bootable\n"
-	cmd := exec.Command("sfdisk", rawImg)
+	cmd := audit.CommandContext(ctx, "sfdisk", rawImg)
 	cmd.Stdin = strings.NewReader(sfdiskInput)
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -73,7 +100,7 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 
 	// 3. Attach loop device (with partition scan)
 	ui.SubStep("Attaching loop device...")
-	out, err := exec.Command("losetup", "-fP", "--show", rawImg).Output()
+	out, err := audit.CommandContext(ctx, "losetup", "-fP", "--show", rawImg).Output()
 	if err != nil {
 		return fmt.Errorf("losetup: %w", err)
 	}
@@ -81,30 +108,34 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 	partition := loopDev + "p1"
 
 	// 4. Format partition
-	ui.SubStep("Formatting ext4 partition...")
-	if err := run("mkfs.ext4", "-L", "DISTRORUN", partition); err != nil {
-		return fmt.Errorf("mkfs.ext4: %w", err)
+	ui.SubStep(fmt.Sprintf("Formatting %s partition...", opts.Filesystem))
+	if err := run(ctx, "mkfs."+opts.Filesystem, "-L", "DISTRORUN", partition); err != nil {
+		return fmt.Errorf("mkfs.%s: %w", opts.Filesystem, err)
 	}
 
 	// 5. Get UUID for fstab
-	uuidOut, err := exec.Command("blkid", "-s", "UUID", "-o", "value", partition).Output()
+	uuidOut, err := audit.CommandContext(ctx, "blkid", "-s", "UUID", "-o", "value", partition).Output()
 	if err != nil {
 		return fmt.Errorf("blkid: %w", err)
 	}
 	uuid := strings.TrimSpace(string(uuidOut))
 
 	// 6. Mount partition
-	if err := os.MkdirAll(mntDir, 0755); err != nil {
+	if err := audit.MkdirAll(mntDir, 0755); err != nil {
 		return fmt.Errorf("creating mount dir: %w", err)
 	}
-	if err := run("mount", partition, mntDir); err != nil {
+	if opts.Filesystem == "btrfs" {
+		if err := mountBtrfs(ctx, partition, mntDir, opts.Compression); err != nil {
+			return err
+		}
+	} else if err := run(ctx, "mount", partition, mntDir); err != nil {
 		return fmt.Errorf("mounting partition: %w", err)
 	}
 	mntActive = true
 
 	// 7. Copy rootfs
 	ui.SubStep("Copying rootfs to disk (this may take a while)...")
-	cmd = exec.Command("cp", "-a", rootfsPath+"/.", mntDir+"/")
+	cmd = audit.CommandContext(ctx, "cp", "-a", rootfsPath+"/.", mntDir+"/")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -112,8 +143,8 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 	}
 
 	// 8. Write /etc/fstab
-	fstab := fmt.Sprintf("UUID=%s  /  ext4  defaults,errors=remount-ro  0  1\n", uuid)
-	if err := os.WriteFile(filepath.Join(mntDir, "etc", "fstab"), []byte(fstab), 0644); err != nil {
+	fstab := fstabEntries(uuid, opts)
+	if err := audit.WriteFile(filepath.Join(mntDir, "etc", "fstab"), []byte(fstab), 0644); err != nil {
 		return fmt.Errorf("writing fstab: %w", err)
 	}
 
@@ -124,21 +155,20 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 		{"/sys", filepath.Join(mntDir, "sys"), ""},
 		{"/dev", filepath.Join(mntDir, "dev"), ""},
 	} {
-		os.MkdirAll(m.dst, 0755)
-		if err := run("mount", "--bind", m.src, m.dst); err != nil {
+		audit.MkdirAll(m.dst, 0755)
+		if err := run(ctx, "mount", "--bind", m.src, m.dst); err != nil {
 			return fmt.Errorf("bind-mounting %s: %w", m.src, err)
 		}
 	}
 	runDir := filepath.Join(mntDir, "run")
-	os.MkdirAll(runDir, 0755)
-	if err := run("mount", "-t", "tmpfs", "tmpfs", runDir); err != nil {
+	audit.MkdirAll(runDir, 0755)
+	if err := run(ctx, "mount", "-t", "tmpfs", "tmpfs", runDir); err != nil {
 		return fmt.Errorf("mounting /run: %w", err)
 	}
 
 	// 10. Install GRUB to MBR
 	ui.SubStep("Installing GRUB2 to MBR...")
-	grubInstall := resolvebin(grubInstallCandidates)
-	cmd = exec.Command("chroot", mntDir, grubInstall, "--target=i386-pc", loopDev)
+	cmd = audit.CommandContext(ctx, "chroot", mntDir, grubInstall, "--target=i386-pc", loopDev)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -147,8 +177,12 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 
 	// 11. Generate grub.cfg
 	ui.SubStep("Generating grub.cfg...")
-	grubMkconfig := resolvebin(grubMkconfigCandidates)
-	cmd = exec.Command("chroot", mntDir, grubMkconfig, "-o", "/boot/grub2/grub.cfg")
+	// grub2-* tools (Fedora) read /boot/grub2, upstream grub-* tools /boot/grub
+	grubCfg := "/boot/grub/grub.cfg"
+	if strings.Contains(grubMkconfig, "grub2-") {
+		grubCfg = "/boot/grub2/grub.cfg"
+	}
+	cmd = audit.CommandContext(ctx, "chroot", mntDir, grubMkconfig, "-o", grubCfg)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -161,41 +195,106 @@ func Build(rootfsPath, outputPath, diskSize string) error {
 	mntActive = false
 
 	// 13. Detach loop device
-	if err := run("losetup", "-d", loopDev); err != nil {
+	if err := run(ctx, "losetup", "-d", loopDev); err != nil {
 		return fmt.Errorf("losetup -d: %w", err)
 	}
 	loopDev = ""
 
-	// 14. Convert raw → qcow2
-	ui.SubStep("Converting to qcow2...")
-	if err := run("qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawImg, outputPath); err != nil {
-		return fmt.Errorf("qemu-img convert: %w", err)
+	// 14. Convert raw → qcow2, or move the raw image into place
+	if opts.Format == "raw" {
+		if err := audit.Rename(rawImg, outputPath); err != nil {
+			// Different filesystem: fall back to a sparse-aware copy
+			if err := run(ctx, "cp", "--sparse=always", rawImg, outputPath); err != nil {
+				return fmt.Errorf("copying raw image: %w", err)
+			}
+		}
+	} else {
+		ui.SubStep("Converting to qcow2...")
+		if err := run(ctx, "qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawImg, outputPath); err != nil {
+			return fmt.Errorf("qemu-img convert: %w", err)
+		}
 	}
 
-	os.Remove(rawImg)
+	audit.Remove(rawImg)
 
 	// Make the image readable by the invoking user (build runs as root)
-	os.Chmod(outputPath, 0644)
+	audit.Chmod(outputPath, 0644)
 
 	if info, err := os.Stat(outputPath); err == nil {
-		ui.SizeInfo("qcow2", float64(info.Size())/1024/1024)
+		ui.SizeInfo(opts.Format, float64(info.Size())/1024/1024)
 	}
 
 	return nil
 }
 
+// mountBtrfs creates the root and /var subvolumes on partition and mounts them
+// at mntDir the same way the booted system will.
+func mountBtrfs(ctx context.Context, partition, mntDir, compression string) error {
+	ui.SubStep("Creating btrfs subvolumes...")
+	if err := run(ctx, "mount", partition, mntDir); err != nil {
+		return fmt.Errorf("mounting partition: %w", err)
+	}
+	for _, sv := range btrfsSubvolumes {
+		if err := run(ctx, "btrfs", "subvolume", "create", filepath.Join(mntDir, sv.name)); err != nil {
+			audit.Command("umount", mntDir).Run()
+			return fmt.Errorf("creating subvolume %s: %w", sv.name, err)
+		}
+	}
+	if err := run(ctx, "umount", mntDir); err != nil {
+		return fmt.Errorf("unmounting top-level subvolume: %w", err)
+	}
+
+	for _, sv := range btrfsSubvolumes {
+		target := filepath.Join(mntDir, sv.mountpoint)
+		audit.MkdirAll(target, 0755)
+		if err := run(ctx, "mount", "-o", btrfsMountOptions(sv.name, compression), partition, target); err != nil {
+			// Build only unmounts what it knows it mounted: drop the
+			// subvolumes mounted so far here.
+			unmountAll(mntDir)
+			return fmt.Errorf("mounting subvolume %s: %w", sv.name, err)
+		}
+	}
+	return nil
+}
+
+// btrfsMountOptions returns the mount options for a subvolume.
+func btrfsMountOptions(subvol, compression string) string {
+	o := "subvol=" + subvol
+	if compression != "" {
+		o += ",compress=" + compression
+	}
+	return o
+}
+
+// fstabEntries renders /etc/fstab for the root partition identified by uuid.
+func fstabEntries(uuid string, opts Options) string {
+	if opts.Filesystem != "btrfs" {
+		return fmt.Sprintf("UUID=%s  /  ext4  defaults,errors=remount-ro  0  1\n", uuid)
+	}
+	var b strings.Builder
+	for _, sv := range btrfsSubvolumes {
+		fmt.Fprintf(&b, "UUID=%s  %s  btrfs  defaults,%s  0  0\n",
+			uuid, sv.mountpoint, btrfsMountOptions(sv.name, opts.Compression))
+	}
+	return b.String()
+}
+
 // run executes a command, printing stderr to os.Stderr.
-func run(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+func run(ctx context.Context, name string, args ...string) error {
+	cmd := audit.CommandContext(ctx, name, args...)
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-// resolvebin returns the first binary from candidates found in PATH.
-func resolvebin(candidates []string) string {
+// chrootBin returns the in-chroot path of the first binary from candidates
+// found in the usual bin directories of root.
+func chrootBin(root string, candidates []string) string {
 	for _, c := range candidates {
-		if p, err := exec.LookPath(c); err == nil {
-			return p
+		for _, dir := range []string{"/usr/sbin", "/usr/bin", "/sbin", "/bin"} {
+			p := dir + "/" + c
+			if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+				return p
+			}
 		}
 	}
 	return ""
@@ -220,6 +319,6 @@ func unmountAll(dir string) {
 	}
 	sort.Sort(sort.Reverse(sort.StringSlice(mps)))
 	for _, mp := range mps {
-		exec.Command("umount", mp).Run()
+		audit.Command("umount", mp).Run()
 	}
 }
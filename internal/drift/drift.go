@@ -0,0 +1,188 @@
+// Package drift compares a deployed system with the image it was built
+// from: the packages installed on it and the hashes of the image's files,
+// against the image's SBOM. Appliances in the field that were changed by
+// hand, or by an attacker, show up as drift.
+package drift
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/sbom"
+)
+
+// State is what drift compares: the installed packages as name → version,
+// and files as absolute path → SHA-256.
+type State struct {
+	Packages map[string]string
+	Files    map[string]string
+}
+
+// Expected returns the state of the image whose SBOM is at sbomPath. Only
+// files under one of prefixes are kept, or all with no prefixes; an SBOM
+// generated without file hashes gives none.
+func Expected(sbomPath string, prefixes []string) (*State, error) {
+	pkgs, err := sbom.ReadPackages(sbomPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := sbom.ReadFiles(sbomPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes) > 0 {
+		for path := range files {
+			if !slices.ContainsFunc(prefixes, func(p string) bool { return underPrefix(path, p) }) {
+				delete(files, path)
+			}
+		}
+	}
+	return &State{Packages: pkgs, Files: files}, nil
+}
+
+// underPrefix reports whether path is prefix or a file under it.
+func underPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// remoteScript prints the packages of the system it runs on as
+// "pkg <name> <version>" lines, from whichever package database it has,
+// and the SHA-256 of the files listed on its standard input after it as
+// "file <sha256>  <path>" lines. Missing files print nothing. The file
+// list and the DISTRORUN_FILES line that ends it follow the script.
+const remoteScript = `if [ -f /lib/apk/db/installed ]; then
+	awk '/^P:/ { p = substr($0, 3) } /^V:/ { print "pkg " p " " substr($0, 3) }' /lib/apk/db/installed
+elif command -v dpkg-query >/dev/null 2>&1; then
+	dpkg-query -W -f '${db:Status-Abbrev} ${Package} ${Version}\n' | awk '$1 == "ii" { print "pkg " $2 " " $3 }'
+elif command -v rpm >/dev/null 2>&1; then
+	rpm -qa --qf 'pkg %{NAME} %{VERSION}-%{RELEASE}\n'
+else
+	echo "no apk, dpkg or rpm package database" >&2
+	exit 3
+fi
+tr '\n' '\0' <<'DISTRORUN_FILES' | xargs -0 -r sha256sum 2>/dev/null | sed 's/^/file /'
+`
+
+// CollectSSH returns the state of host, reached with ssh as in "ssh host"
+// (a user@ prefix and ~/.ssh/config apply), with the hashes of files. It
+// needs a shell, awk, xargs and sha256sum on the host, which every
+// supported distribution has.
+func CollectSSH(ctx context.Context, host string, files []string) (*State, error) {
+	cmd := exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", "--", host, "sh", "-s")
+	cmd.Stdin = strings.NewReader(script(files))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ssh %s: %s", host, msg)
+		}
+		return nil, fmt.Errorf("ssh %s: %w", host, err)
+	}
+	state := parse(out)
+	if len(state.Packages) == 0 {
+		return nil, errors.New("ssh " + host + ": no packages reported")
+	}
+	return state, nil
+}
+
+// script returns remoteScript with the absolute paths among files to hash.
+func script(files []string) string {
+	var b strings.Builder
+	b.WriteString(remoteScript)
+	for _, f := range files {
+		if strings.HasPrefix(f, "/") && !strings.ContainsAny(f, "\n\x00") {
+			b.WriteString(f + "\n")
+		}
+	}
+	b.WriteString("DISTRORUN_FILES\n")
+	return b.String()
+}
+
+// parse reads the output of remoteScript.
+func parse(out []byte) *State {
+	s := &State{Packages: map[string]string{}, Files: map[string]string{}}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		kind, rest, _ := strings.Cut(sc.Text(), " ")
+		switch kind {
+		case "pkg":
+			if name, version, ok := strings.Cut(rest, " "); ok {
+				s.Packages[name] = version
+			}
+		case "file":
+			if sum, path, ok := strings.Cut(rest, "  "); ok {
+				s.Files[path] = sum
+			}
+		}
+	}
+	return s
+}
+
+// Change is a package whose version on the system differs from the image.
+type Change struct {
+	Name   string
+	Image  string // version in the image
+	System string // version on the system
+}
+
+// Report is the drift of a system from its image.
+type Report struct {
+	Added    []string // packages installed since, as "name version"
+	Removed  []string // packages of the image the system lacks, as "name version"
+	Changed  []Change
+	Modified []string // files of the image whose contents differ
+	Missing  []string // files of the image the system lacks
+}
+
+// Compare returns the drift of the system got from the image want. Only
+// the files of want are compared.
+func Compare(want, got *State) Report {
+	var r Report
+	for _, name := range sortedKeys(want.Packages) {
+		v, ok := got.Packages[name]
+		switch {
+		case !ok:
+			r.Removed = append(r.Removed, name+" "+want.Packages[name])
+		case v != want.Packages[name]:
+			r.Changed = append(r.Changed, Change{Name: name, Image: want.Packages[name], System: v})
+		}
+	}
+	for _, name := range sortedKeys(got.Packages) {
+		if _, ok := want.Packages[name]; !ok {
+			r.Added = append(r.Added, name+" "+got.Packages[name])
+		}
+	}
+	for _, path := range sortedKeys(want.Files) {
+		sum, ok := got.Files[path]
+		switch {
+		case !ok:
+			r.Missing = append(r.Missing, path)
+		case sum != want.Files[path]:
+			r.Modified = append(r.Modified, path)
+		}
+	}
+	return r
+}
+
+// Empty reports whether r shows no drift.
+func (r Report) Empty() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Changed)+len(r.Modified)+len(r.Missing) == 0
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,101 @@
+package drift
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	out := "pkg musl 1.2.5-r0\n" +
+		"pkg busybox 1.36.1-r29\n" +
+		"file 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  /etc/a b\n" +
+		"garbage\n"
+	got := parse([]byte(out))
+	want := &State{
+		Packages: map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.1-r29"},
+		Files:    map[string]string{"/etc/a b": "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parse = %+v, want %+v", got, want)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	image := &State{
+		Packages: map[string]string{"musl": "1.2.5-r0", "openssl": "3.3.1-r0", "curl": "8.9.0-r0"},
+		Files:    map[string]string{"/etc/motd": "aa", "/etc/issue": "bb", "/usr/bin/curl": "cc"},
+	}
+	system := &State{
+		Packages: map[string]string{"musl": "1.2.5-r0", "openssl": "3.3.2-r0", "nmap": "7.95-r0"},
+		Files:    map[string]string{"/etc/motd": "aa", "/etc/issue": "b2", "/etc/extra": "dd"},
+	}
+	r := Compare(image, system)
+	want := Report{
+		Added:    []string{"nmap 7.95-r0"},
+		Removed:  []string{"curl 8.9.0-r0"},
+		Changed:  []Change{{Name: "openssl", Image: "3.3.1-r0", System: "3.3.2-r0"}},
+		Modified: []string{"/etc/issue"},
+		Missing:  []string{"/usr/bin/curl"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Compare = %+v, want %+v", r, want)
+	}
+	if r.Empty() || !Compare(image, image).Empty() {
+		t.Error("Empty is wrong")
+	}
+}
+
+// TestScript runs the remote script on this machine, as ssh would on a
+// device.
+func TestScript(t *testing.T) {
+	for _, tool := range []string{"sh", "awk", "xargs", "sha256sum"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not found")
+		}
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "motd")
+	os.WriteFile(file, []byte("foo"), 0644)
+	cmd := exec.Command("sh", "-s")
+	cmd.Stdin = strings.NewReader(script([]string{file, filepath.Join(dir, "missing"), "relative"}))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("no package database on this machine: %v", err)
+	}
+	s := parse(out)
+	if len(s.Packages) == 0 {
+		t.Error("no packages")
+	}
+	// sha256 of "foo"
+	want := map[string]string{file: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"}
+	if !reflect.DeepEqual(s.Files, want) {
+		t.Errorf("Files = %v, want %v", s.Files, want)
+	}
+}
+
+func TestExpected(t *testing.T) {
+	doc := `{"packages": [
+  {"SPDXID": "SPDXRef-operating-system", "name": "alpine", "versionInfo": "3.20.3", "primaryPackagePurpose": "OPERATING-SYSTEM"},
+  {"SPDXID": "SPDXRef-Package-busybox", "name": "busybox", "versionInfo": "1.36.1-r29"}],
+ "files": [
+  {"fileName": "./etc/motd", "checksums": [{"algorithm": "SHA1", "checksumValue": "11"}, {"algorithm": "SHA256", "checksumValue": "aa"}]},
+  {"fileName": "./bin/busybox", "checksums": [{"algorithm": "SHA256", "checksumValue": "bb"}]}]}`
+	path := filepath.Join(t.TempDir(), "sbom.spdx.json")
+	os.WriteFile(path, []byte(doc), 0644)
+
+	s, err := Expected(path, []string{"/etc/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &State{
+		Packages: map[string]string{"busybox": "1.36.1-r29"},
+		Files:    map[string]string{"/etc/motd": "aa"},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Expected = %+v, want %+v", s, want)
+	}
+}
@@ -0,0 +1,186 @@
+// Package fetch makes the downloads distrorun does itself survive flaky
+// mirrors. Its transport retries failed requests with exponential backoff
+// and, when a response body breaks off, resumes it with a Range request
+// instead of starting over. Proxies come from the wrapped transport, which
+// for http.DefaultTransport means HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// Retries is how often a failed request or broken body is retried. The
+// first retry waits Backoff, each further one twice as long as the last.
+var (
+	Retries = 4
+	Backoff = time.Second
+)
+
+// Offline makes every request fail without reaching the network, for
+// builds that must not use it (build -offline).
+var Offline bool
+
+// maxBackoff caps the wait between retries, and any Retry-After.
+const maxBackoff = 30 * time.Second
+
+// transport retries the GET and HEAD requests of base.
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport wraps base, or http.DefaultTransport when nil, with retries
+// and resumption.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+// retryable reports whether a response with status may succeed if the
+// request is repeated.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before retry number attempt, counted from 0.
+func backoff(attempt int) time.Duration {
+	d := Backoff << attempt
+	if d > maxBackoff || d <= 0 {
+		return maxBackoff
+	}
+	return d
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if Offline {
+		return nil, fmt.Errorf("offline: not fetching %s", req.URL.Redacted())
+	}
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		return t.base.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= Retries || (err == nil && !retryable(resp.StatusCode)) {
+			if err == nil && resp.StatusCode == http.StatusOK && req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+				resp.Body = &resumeBody{t: t, req: req, body: resp.Body, validator: validator(resp)}
+			}
+			return resp, err
+		}
+		wait := backoff(attempt)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				wait = min(time.Duration(s)*time.Second, maxBackoff)
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		ui.Warn(fmt.Sprintf("%s: %s, retrying in %s (%d/%d)", req.URL.Redacted(), reason, wait, attempt+1, Retries))
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// validator returns what identifies the version of a response for an
+// If-Range header: a strong ETag, or the modification time. Without one,
+// a resumed body could splice two versions of the file and is not resumed.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// resumeBody is the body of a GET response that, when reading it fails,
+// requests the rest of it and continues from there.
+type resumeBody struct {
+	t         *transport
+	req       *http.Request
+	body      io.ReadCloser
+	validator string
+	read      int64
+	retries   int
+}
+
+func (b *resumeBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+	if err == nil || err == io.EOF || b.validator == "" {
+		return n, err
+	}
+	for b.retries < Retries && b.req.Context().Err() == nil {
+		wait := backoff(b.retries)
+		b.retries++
+		ui.Warn(fmt.Sprintf("%s: %v after %d bytes, resuming in %s (%d/%d)", b.req.URL.Redacted(), err, b.read, wait, b.retries, Retries))
+		if sleep(b.req.Context(), wait) != nil {
+			break
+		}
+		resumed, again := b.resume()
+		if resumed {
+			return n, nil
+		}
+		if !again {
+			break
+		}
+	}
+	return n, err
+}
+
+// resume requests the bytes after those read so far and, if the server
+// sends exactly them, continues with its body. Otherwise it reports
+// whether trying again could help: not when the file changed or the server
+// ignores ranges.
+func (b *resumeBody) resume() (resumed, again bool) {
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	req.Header.Set("If-Range", b.validator)
+	resp, err := b.t.base.RoundTrip(req)
+	if err != nil {
+		return false, true
+	}
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.read)) {
+		resp.Body.Close()
+		return false, retryable(resp.StatusCode)
+	}
+	b.body.Close()
+	b.body = resp.Body
+	return true, false
+}
+
+func (b *resumeBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,127 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	Backoff = time.Millisecond
+}
+
+func TestRetry(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "index")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: Transport(nil)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "index" || requests != 3 {
+		t.Errorf("got HTTP %d %q after %d requests, want HTTP 200 \"index\" after 3", resp.StatusCode, body, requests)
+	}
+
+	requests = -10
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || requests != -10+Retries+1 {
+		t.Errorf("got HTTP %d after %d requests, want the last 503 after %d", resp.StatusCode, requests+10, Retries+1)
+	}
+}
+
+func TestResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	modTime := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Break off after the first half.
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			return
+		}
+		http.ServeContent(w, r, "file", modTime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	resp, err := (&http.Client{Transport: Transport(nil)}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want the %d of the file", len(got), len(data))
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes="+strconv.Itoa(len(data)/2)+"-" {
+		t.Errorf("requested ranges %q, want the second half once", ranges)
+	}
+}
+
+func TestResumeChanged(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// Each request sees a new version of the file.
+		w.Header().Set("ETag", `"v`+strconv.Itoa(requests)+`"`)
+		if requests == 1 {
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, strings.Repeat("a", 50))
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(strings.Repeat("b", 100)))
+	}))
+	defer server.Close()
+
+	resp, err := (&http.Client{Transport: Transport(nil)}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Error("a body resumed from a changed file was accepted")
+	}
+	if requests != 2 {
+		t.Errorf("%d requests, want no retry once the file changed", requests)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	Offline = true
+	defer func() { Offline = false }()
+	if _, err := (&http.Client{Transport: Transport(nil)}).Get(server.URL); err == nil || requests != 0 {
+		t.Errorf("offline GET: %v after %d requests, want an error before any", err, requests)
+	}
+}
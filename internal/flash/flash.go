@@ -0,0 +1,494 @@
+// Package flash writes a built ISO to a USB stick or other block device,
+// verifies the copy and can add a persistence partition behind it.
+package flash
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PersistLabel is the label of the ext4 partition the live init uses as
+// the writable overlay layer with boot.persistence. It must fit the 16
+// bytes of an ext4 label: mkfs.ext4 truncates longer ones, and findfs
+// would then never find the partition.
+const PersistLabel = "distrorun-persis"
+
+// chunkSize is how much is written or read between progress reports.
+const chunkSize = 4 << 20
+
+// blkflsbuf is the BLKFLSBUF ioctl, which drops a device's buffered pages
+// so verification reads what reached the device.
+const blkflsbuf = 0x1261
+
+// Paths read to list devices; variables so tests can use a fake tree.
+var (
+	sysBlock   = "/sys/block"
+	procMounts = "/proc/mounts"
+	procSwaps  = "/proc/swaps"
+)
+
+// skipPrefixes are kernel block devices that are never USB sticks or disks.
+var skipPrefixes = []string{"loop", "ram", "zram", "dm-", "md", "sr", "nbd", "fd"}
+
+// Device is a whole-disk block device.
+type Device struct {
+	Path      string // e.g. "/dev/sdb"
+	Name      string // e.g. "sdb"
+	Size      int64  // in bytes
+	Model     string // vendor and model, if the kernel reports them
+	Removable bool   // removable media or connected over USB
+	Mounts    []string
+}
+
+// Describe returns a one-line description such as
+// "/dev/sdb  14.9 GiB  SanDisk Ultra  (removable)".
+func (d Device) Describe() string {
+	s := fmt.Sprintf("%-14s %9s  %s", d.Path, humanSize(d.Size), d.Model)
+	if d.Removable {
+		s += "  (removable)"
+	}
+	if len(d.Mounts) > 0 {
+		s += "  mounted on " + strings.Join(d.Mounts, ", ")
+	}
+	return strings.TrimRight(s, " ")
+}
+
+// ListDevices returns the disks of the host, without loop, RAM, optical
+// and device-mapper devices, or empty card readers.
+func ListDevices() ([]Device, error) {
+	entries, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return nil, fmt.Errorf("listing block devices: %w", err)
+	}
+	mounts, err := mountedDevices()
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	for _, e := range entries {
+		name := e.Name()
+		if skipped(name) {
+			continue
+		}
+		d, err := device(name, mounts)
+		if err != nil {
+			return nil, err
+		}
+		if d.Size == 0 {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// Lookup returns the whole-disk device at path, e.g. "/dev/sdb", following
+// symlinks such as /dev/disk/by-id names.
+func Lookup(path string) (Device, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return Device{}, err
+	}
+	name := filepath.Base(real)
+	if _, err := os.Stat(filepath.Join(sysBlock, name)); err != nil || skipped(name) {
+		disks, _ := os.ReadDir(sysBlock)
+		for _, d := range disks {
+			if slices.Contains(partitions(d.Name()), name) {
+				return Device{}, fmt.Errorf("%s is a partition of /dev/%s: write to the whole disk", path, d.Name())
+			}
+		}
+		return Device{}, fmt.Errorf("%s is not a disk", path)
+	}
+	mounts, err := mountedDevices()
+	if err != nil {
+		return Device{}, err
+	}
+	return device(name, mounts)
+}
+
+func skipped(name string) bool {
+	for _, p := range skipPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// device reads the sysfs attributes of the disk name. mounts maps device
+// names to where they or their partitions are mounted.
+func device(name string, mounts map[string][]string) (Device, error) {
+	dir := filepath.Join(sysBlock, name)
+	d := Device{Path: "/dev/" + name, Name: name}
+	sectors, err := readInt(filepath.Join(dir, "size"))
+	if err != nil {
+		return d, err
+	}
+	d.Size = sectors * 512 // sysfs counts 512-byte sectors whatever the device
+	vendor, _ := os.ReadFile(filepath.Join(dir, "device", "vendor"))
+	model, _ := os.ReadFile(filepath.Join(dir, "device", "model"))
+	d.Model = strings.Join(strings.Fields(string(vendor)+" "+string(model)), " ")
+	removable, _ := readInt(filepath.Join(dir, "removable"))
+	target, _ := filepath.EvalSymlinks(dir)
+	d.Removable = removable == 1 || strings.Contains(target, "/usb")
+
+	d.Mounts = mounts[name]
+	for _, part := range partitions(name) {
+		d.Mounts = append(d.Mounts, mounts[part]...)
+	}
+	return d, nil
+}
+
+// partitions returns the partitions of the disk name, such as "sdb1".
+func partitions(name string) []string {
+	entries, _ := os.ReadDir(filepath.Join(sysBlock, name))
+	var parts []string
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(sysBlock, name, e.Name(), "partition")); err == nil {
+			parts = append(parts, e.Name())
+		}
+	}
+	return parts
+}
+
+// mountedDevices maps the names of mounted block devices and active swap
+// devices to their mount points.
+func mountedDevices() (map[string][]string, error) {
+	mounts := map[string][]string{}
+	for _, f := range []struct {
+		path  string
+		swaps bool
+	}{{procMounts, false}, {procSwaps, true}} {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			if f.swaps && os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("reading mounts: %w", err)
+		}
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+				continue
+			}
+			src := fields[0]
+			if real, err := filepath.EvalSymlinks(src); err == nil {
+				src = real
+			}
+			where := fields[1]
+			if f.swaps {
+				where = "[swap]"
+			}
+			name := filepath.Base(src)
+			mounts[name] = append(mounts[name], where)
+		}
+	}
+	return mounts, nil
+}
+
+// Write copies the ISO at isoPath to the start of dev, reporting the bytes
+// written so far to progress, and flushes the device.
+func Write(ctx context.Context, isoPath string, dev Device, progress func(done, total int64)) error {
+	src, err := os.Open(isoPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > dev.Size {
+		return fmt.Errorf("%s (%s) does not fit on %s (%s)", isoPath, humanSize(info.Size()), dev.Path, humanSize(dev.Size))
+	}
+	// O_EXCL makes the kernel refuse a device that is mounted after all.
+	dst, err := os.OpenFile(dev.Path, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", dev.Path, err)
+	}
+	defer dst.Close()
+
+	buf := make([]byte, chunkSize)
+	var done int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, rerr := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return fmt.Errorf("writing %s: %w", dev.Path, err)
+			}
+			done += int64(n)
+			progress(done, info.Size())
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("reading %s: %w", isoPath, rerr)
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return fmt.Errorf("flushing %s: %w", dev.Path, err)
+	}
+	return dst.Close()
+}
+
+// Verify reads back the start of dev and compares it with the ISO at
+// isoPath, reporting the bytes compared so far to progress.
+func Verify(ctx context.Context, isoPath string, dev Device, progress func(done, total int64)) error {
+	want, size, err := hashFile(isoPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(dev.Path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", dev.Path, err)
+	}
+	defer f.Close()
+	// Without this the reads are served from the pages just written.
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkflsbuf, 0); errno != 0 {
+		return fmt.Errorf("flushing the buffers of %s: %w", dev.Path, errno)
+	}
+
+	h := sha256.New()
+	buf := make([]byte, chunkSize)
+	var done int64
+	for done < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := min(int64(len(buf)), size-done)
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return fmt.Errorf("reading %s: %w", dev.Path, err)
+		}
+		h.Write(buf[:n])
+		done += n
+		progress(done, size)
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("%s does not hold the ISO: the data read back differs (faulty or fake-capacity device?)", dev.Path)
+	}
+	return nil
+}
+
+func hashFile(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return h.Sum(nil), n, nil
+}
+
+// CheckPersistDeps verifies the tools AddPersistence needs.
+func CheckPersistDeps() error {
+	for _, t := range []string{"sfdisk", "mkfs.ext4"} {
+		if _, err := exec.LookPath(t); err != nil {
+			return fmt.Errorf("required tool not found: %s, for -persist (install with your package manager)", t)
+		}
+	}
+	return nil
+}
+
+// AddPersistence creates an ext4 partition labeled PersistLabel in the
+// space behind the isoSize bytes of ISO written to dev, and returns its
+// device path.
+func AddPersistence(ctx context.Context, dev Device, isoSize int64) (string, error) {
+	// The ISO's isohybrid MBR describes an image of its own size, padded
+	// to a whole MiB: the native ISO writer puts the image and, for UEFI,
+	// the EFI system partition in the first two slots and leaves the rest
+	// free for the partition appended here. Only the xorriso fallback adds
+	// a GPT, for UEFI images; its backup header must move to the end of
+	// the disk before the table can grow.
+	gpt, err := hasGPT(dev.Path)
+	if err != nil {
+		return "", err
+	}
+	if gpt {
+		if err := run(ctx, nil, "sfdisk", "--relocate", "gpt-bak-std", dev.Path); err != nil {
+			return "", fmt.Errorf("sfdisk --relocate: %w", err)
+		}
+	}
+	start := persistStart(isoSize)
+	if start+(64<<20)/512 > dev.Size/512 {
+		return "", fmt.Errorf("%s has no room for a persistence partition behind the ISO", dev.Path)
+	}
+	before := partitions(dev.Name)
+	input := fmt.Sprintf("start=%d, type=L\n", start)
+	if err := run(ctx, strings.NewReader(input), "sfdisk", "--append", "--quiet", dev.Path); err != nil {
+		return "", fmt.Errorf("sfdisk --append: %w", err)
+	}
+	if _, err := exec.LookPath("udevadm"); err == nil {
+		run(ctx, nil, "udevadm", "settle")
+	}
+	part := newPartition(before, partitions(dev.Name))
+	if part == "" {
+		return "", fmt.Errorf("the kernel did not pick up the new partition on %s (replug the device and retry)", dev.Path)
+	}
+	path := "/dev/" + part
+	if err := run(ctx, nil, "mkfs.ext4", "-F", "-q", "-L", PersistLabel, path); err != nil {
+		return "", fmt.Errorf("mkfs.ext4: %w", err)
+	}
+	return path, nil
+}
+
+// CheckPersistDiskDeps verifies the tools CreatePersistDisk needs.
+func CheckPersistDiskDeps() error {
+	for _, t := range []string{"mkfs.ext4", "qemu-img"} {
+		if _, err := exec.LookPath(t); err != nil {
+			return fmt.Errorf("required tool not found: %s, for -persistent-disk (install with your package manager)", t)
+		}
+	}
+	return nil
+}
+
+// CreatePersistDisk creates a qcow2 disk image of size bytes at path with
+// one ext4 partition labeled PersistLabel, for testing boot.persistence in
+// a virtual machine. It needs no root: the partition table is written here
+// and the filesystem into the image file.
+func CreatePersistDisk(ctx context.Context, path string, size int64) error {
+	raw := path + ".raw"
+	defer os.Remove(raw)
+	if err := writePersistImage(ctx, raw, size); err != nil {
+		return err
+	}
+	if err := run(ctx, nil, "qemu-img", "convert", "-f", "raw", "-O", "qcow2", raw, path); err != nil {
+		return fmt.Errorf("qemu-img convert: %w", err)
+	}
+	return nil
+}
+
+// writePersistImage writes a sparse raw disk image of size bytes at path
+// with an MBR partition table holding one Linux partition from the first
+// MiB to the end, formatted ext4 and labeled PersistLabel.
+func writePersistImage(ctx context.Context, path string, size int64) error {
+	const mib = 1 << 20
+	size = size / mib * mib
+	if size < 64*mib {
+		return fmt.Errorf("a persistence disk needs at least 64M")
+	}
+	if size/512 > 1<<32-1 {
+		return fmt.Errorf("a persistence disk can be at most 2T")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(mbr(mib/512, (size-mib)/512), 0); err != nil {
+		return fmt.Errorf("writing partition table: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	args := []string{"-F", "-q", "-L", PersistLabel, "-E", fmt.Sprintf("offset=%d", mib), path, fmt.Sprintf("%dk", (size-mib)/1024)}
+	if err := run(ctx, nil, "mkfs.ext4", args...); err != nil {
+		return fmt.Errorf("mkfs.ext4: %w", err)
+	}
+	return nil
+}
+
+// mbr returns a master boot record with one Linux partition of sectors
+// 512-byte sectors from sector start, addressed by LBA only.
+func mbr(start, sectors int64) []byte {
+	b := make([]byte, 512)
+	p := b[446:462]
+	copy(p[1:4], []byte{0xfe, 0xff, 0xff}) // CHS start: beyond CHS addressing
+	p[4] = 0x83                            // Linux
+	copy(p[5:8], []byte{0xfe, 0xff, 0xff}) // CHS end
+	binary.LittleEndian.PutUint32(p[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(p[12:16], uint32(sectors))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// persistStart returns the first sector of the persistence partition: the
+// first MiB boundary behind the ISO.
+func persistStart(isoSize int64) int64 {
+	const mib = 1 << 20
+	return (isoSize + mib - 1) / mib * (mib / 512)
+}
+
+// newPartition returns the partition in after that is not in before.
+func newPartition(before, after []string) string {
+	for _, p := range after {
+		if !slices.Contains(before, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// hasGPT reports whether the device has a GPT header in its second sector.
+func hasGPT(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sig := make([]byte, 8)
+	if _, err := f.ReadAt(sig, 512); err != nil {
+		return false, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return string(sig) == "EFI PART", nil
+}
+
+func run(ctx context.Context, stdin io.Reader, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// humanSize formats n bytes like "14.9 GiB".
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
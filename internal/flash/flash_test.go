@@ -0,0 +1,201 @@
+package flash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeSys builds a sysfs tree with a USB stick sdb (one partition, mounted),
+// an internal disk nvme0n1, an empty card reader sdc and a loop device.
+func fakeSys(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"block/sdb/size":             "31260672\n",
+		"block/sdb/removable":        "1\n",
+		"block/sdb/device/vendor":    "SanDisk \n",
+		"block/sdb/device/model":     "Ultra           \n",
+		"block/sdb/sdb1/partition":   "1\n",
+		"block/nvme0n1/size":         "1000215216\n",
+		"block/nvme0n1/removable":    "0\n",
+		"block/nvme0n1/device/model": "Samsung SSD 980\n",
+		"block/sdc/size":             "0\n",
+		"block/sdc/removable":        "1\n",
+		"block/loop0/size":           "2048\n",
+		"mounts":                     "/dev/sdb1 /media/stick vfat rw 0 0\nproc /proc proc rw 0 0\n",
+		"swaps":                      "Filename Type Size Used Priority\n/dev/nvme0n1p3 partition 8388604 0 -2\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sysBlock, procMounts, procSwaps = filepath.Join(dir, "block"), filepath.Join(dir, "mounts"), filepath.Join(dir, "swaps")
+	t.Cleanup(func() { sysBlock, procMounts, procSwaps = "/sys/block", "/proc/mounts", "/proc/swaps" })
+}
+
+func TestListDevices(t *testing.T) {
+	fakeSys(t)
+	devices, err := ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want nvme0n1 and sdb: %+v", len(devices), devices)
+	}
+	nvme, sdb := devices[0], devices[1]
+	if nvme.Removable || nvme.Model != "Samsung SSD 980" {
+		t.Errorf("nvme0n1 = %+v", nvme)
+	}
+	if !sdb.Removable || sdb.Model != "SanDisk Ultra" || sdb.Size != 31260672*512 {
+		t.Errorf("sdb = %+v", sdb)
+	}
+	if len(sdb.Mounts) != 1 || sdb.Mounts[0] != "/media/stick" {
+		t.Errorf("sdb mounts = %v, want the mount of sdb1", sdb.Mounts)
+	}
+	if got := sdb.Describe(); !strings.Contains(got, "14.9 GiB") || !strings.Contains(got, "(removable)") {
+		t.Errorf("Describe() = %q", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fakeSys(t)
+	// Lookup resolves symlinks, so point a link at a path named like the device.
+	link := func(name string) string {
+		dir := t.TempDir()
+		target := filepath.Join(dir, name)
+		os.WriteFile(target, nil, 0644)
+		l := filepath.Join(dir, "link")
+		os.Symlink(target, l)
+		return l
+	}
+	if _, err := Lookup(link("sdb1")); err == nil || !strings.Contains(err.Error(), "partition of /dev/sdb") {
+		t.Errorf("Lookup(sdb1) error = %v", err)
+	}
+	if _, err := Lookup(link("loop0")); err == nil || !strings.Contains(err.Error(), "not a disk") {
+		t.Errorf("Lookup(loop0) error = %v", err)
+	}
+	d, err := Lookup(link("sdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/dev/sdb" {
+		t.Errorf("Path = %q", d.Path)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "os.iso")
+	data := bytes.Repeat([]byte("distrorun"), chunkSize/4)
+	os.WriteFile(iso, data, 0644)
+	devPath := filepath.Join(dir, "dev")
+	os.WriteFile(devPath, make([]byte, 2*len(data)), 0644)
+
+	var calls int
+	var last int64
+	err := Write(context.Background(), iso, Device{Path: devPath, Size: int64(2 * len(data))}, func(done, total int64) {
+		calls++
+		last = done
+		if total != int64(len(data)) {
+			t.Errorf("total = %d, want %d", total, len(data))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || last != int64(len(data)) {
+		t.Errorf("progress called %d times, last with %d", calls, last)
+	}
+	got, _ := os.ReadFile(devPath)
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Error("device does not start with the ISO")
+	}
+
+	err = Write(context.Background(), iso, Device{Path: devPath, Size: 1024}, func(int64, int64) {})
+	if err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("error = %v, want does not fit", err)
+	}
+}
+
+func TestPersistStart(t *testing.T) {
+	for size, want := range map[int64]int64{
+		1 << 20:       2048,
+		1<<20 + 1:     4096,
+		300*1<<20 - 7: 300 * 2048,
+	} {
+		if got := persistStart(size); got != want {
+			t.Errorf("persistStart(%d) = %d, want %d", size, got, want)
+		}
+	}
+	if got := newPartition([]string{"sdb1", "sdb2"}, []string{"sdb1", "sdb2", "sdb3"}); got != "sdb3" {
+		t.Errorf("newPartition = %q", got)
+	}
+}
+
+func TestWritePersistImage(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	path := filepath.Join(t.TempDir(), "persist.raw")
+	if err := writePersistImage(context.Background(), path, 64<<20+5); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 64<<20 {
+		t.Errorf("size = %d, want %d", len(data), 64<<20)
+	}
+	if !bytes.Equal(data[510:512], []byte{0x55, 0xaa}) || data[446+4] != 0x83 {
+		t.Error("no MBR with a Linux partition")
+	}
+	if start, sectors := binary.LittleEndian.Uint32(data[454:]), binary.LittleEndian.Uint32(data[458:]); start != 2048 || sectors != 63*2048 {
+		t.Errorf("partition = %d+%d sectors, want 2048+%d", start, sectors, 63*2048)
+	}
+	// The ext4 superblock is 1024 bytes into the partition; its volume
+	// name is at offset 120.
+	sb := data[1<<20+1024:]
+	if !bytes.Equal(sb[56:58], []byte{0x53, 0xef}) || !bytes.HasPrefix(sb[120:136], []byte(PersistLabel)) {
+		t.Errorf("no ext4 filesystem labeled %s in the partition", PersistLabel)
+	}
+
+	if err := writePersistImage(context.Background(), path, 10<<20); err == nil {
+		t.Error("expected an error for a disk below 64M")
+	}
+}
+
+func TestPersistLabel(t *testing.T) {
+	// mkfs.ext4 truncates longer labels, which findfs then never matches.
+	if len(PersistLabel) > 16 {
+		t.Errorf("PersistLabel %q is %d bytes; ext4 labels hold 16", PersistLabel, len(PersistLabel))
+	}
+
+	// The documentation tells users to make the partition themselves, so
+	// it must name the label mkfs.ext4 actually writes.
+	longer := regexp.MustCompile(regexp.QuoteMeta(PersistLabel) + `[a-z0-9]`)
+	for _, doc := range []string{"../../distrorun.1", "../../sample.distrorun.yaml"} {
+		data, err := os.ReadFile(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), PersistLabel) {
+			t.Errorf("%s does not mention the %s label", doc, PersistLabel)
+		}
+		if m := longer.Find(data); m != nil {
+			t.Errorf("%s names the partition %q, longer than an ext4 label", doc, m)
+		}
+	}
+}
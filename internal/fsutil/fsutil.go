@@ -0,0 +1,47 @@
+// Package fsutil holds the small file helpers shared by the packages that
+// stage, package and publish build artifacts.
+package fsutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// SHA256File returns the hex-encoded SHA-256 digest of the file at path.
+func SHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CopyFile copies the contents of src to dst, creating or truncating dst
+// with audit.Create so the copy shows up in the audit log of a build.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := audit.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
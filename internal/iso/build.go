@@ -2,74 +2,277 @@
 package iso
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
 	"github.com/talfaza/distrorun/internal/bootloader"
+	"github.com/talfaza/distrorun/internal/confine"
+	"github.com/talfaza/distrorun/internal/limits"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
+// VolumeLabel is the ISO9660 volume label. The live init looks for it to
+// find the boot medium.
+const VolumeLabel = "DISTRORUN"
+
 // Build creates the final bootable ISO image.
-// It creates a squashfs from the rootfs, then uses xorriso to produce the ISO.
-func Build(rootfsPath, stagingDir, outputPath string) error {
+// It creates a squashfs from the rootfs, then writes the ISO around it.
+func Build(ctx context.Context, rootfsPath, stagingDir, outputPath string, sq SquashfsOptions) error {
 	// Step 1: Create squashfs image from rootfs
-	squashfsPath := filepath.Join(stagingDir, "rootfs.squashfs")
-	ui.SubStep("Creating squashfs image (xz compression)...")
-
-	cmd := exec.Command("mksquashfs", rootfsPath, squashfsPath,
-		"-comp", "xz", "-no-xattrs", "-noappend")
-	cmd.Stdout = nil
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mksquashfs: %w", err)
+	if err := MakeSquashfs(ctx, rootfsPath, filepath.Join(stagingDir, "rootfs.squashfs"), sq); err != nil {
+		return err
 	}
 
-	// Print squashfs size
-	if info, err := os.Stat(squashfsPath); err == nil {
-		ui.SizeInfo("Squashfs", float64(info.Size())/1024/1024)
+	// Step 2: Build the ISO
+	return assemble(ctx, stagingDir, outputPath, isolinuxBoot())
+}
+
+// isolinuxBoot returns the boot options of an ISO booting with isolinux.
+func isolinuxBoot() bootOptions {
+	boot := bootOptions{
+		image:   "isolinux/isolinux.bin",
+		catalog: "isolinux/boot.cat",
+		// Add isohybrid MBR if available (makes ISO bootable from USB too)
+		hybridMBR: bootloader.IsohdpfxPath(),
+	}
+	if boot.hybridMBR == "" {
+		ui.Degrade("isohybrid", "isohdpfx.bin not found (install syslinux): the ISO boots from CDs and in virtual machines, not from USB sticks")
 	}
+	return boot
+}
+
+// grubBoot are the boot options of an ISO booting the GRUB2 El Torito image.
+var grubBoot = bootOptions{image: "boot/grub2/i386-pc/eltorito.img"}
 
-	// Step 2: Build ISO with xorriso
+// assemble writes the ISO image of stagingDir booting as boot describes,
+// adding UEFI boot when SetupEFI prepared it. The image is written natively;
+// xorriso, when installed, takes over trees the native writer cannot
+// represent.
+func assemble(ctx context.Context, stagingDir, outputPath string, boot bootOptions) error {
 	ui.SubStep("Assembling ISO image...")
+	if err := CheckNames(stagingDir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, bootloader.EFIImage)); err == nil {
+		// UEFI boot from the EFI system partition image; on USB sticks
+		// too when the ISO is isohybrid.
+		boot.efiImage = bootloader.EFIImage
+	}
 
-	xorrisoArgs := []string{
-		"-as", "mkisofs",
-		"-o", outputPath,
-		"-b", "isolinux/isolinux.bin",
-		"-c", "isolinux/boot.cat",
-		"-no-emul-boot",
-		"-boot-load-size", "4",
-		"-boot-info-table",
+	err := writeISO(stagingDir, outputPath, VolumeLabel, &boot)
+	if errors.Is(err, errUnsupported) {
+		if _, lookErr := exec.LookPath("xorriso"); lookErr != nil {
+			return fmt.Errorf("%w (installing xorriso builds it instead)", err)
+		}
+		ui.Warn(fmt.Sprintf("%v; using xorriso", err))
+		err = xorriso(ctx, stagingDir, outputPath, VolumeLabel, boot.xorrisoArgs())
+	}
+	if err != nil {
+		return err
 	}
 
-	// Add isohybrid MBR if available (makes ISO bootable from USB too)
-	isohdpfx := bootloader.IsohdpfxPath()
-	if isohdpfx != "" {
-		xorrisoArgs = append(xorrisoArgs, "-isohybrid-mbr", isohdpfx)
+	// Print ISO size
+	if info, err := os.Stat(outputPath); err == nil {
+		ui.SizeInfo("ISO", float64(info.Size())/1024/1024)
 	}
 
+	return nil
+}
+
+// xorriso writes the ISO image of stagingDir with xorriso, passing it the
+// extra mkisofs-style arguments args.
+func xorriso(ctx context.Context, stagingDir, outputPath, label string, args []string) error {
+	xorrisoArgs := []string{
+		"-as", "mkisofs",
+		"-o", outputPath,
+		"-V", label,
+		"-input-charset", inputCharset,
+		"-iso-level", "3", // files of 4 GiB or more
+	}
+	xorrisoArgs = append(xorrisoArgs, args...)
 	xorrisoArgs = append(xorrisoArgs, stagingDir)
 
-	cmd = exec.Command("xorriso", xorrisoArgs...)
+	cmd := limits.Apply(confine.Command(ctx, confine.Writer, "xorriso", xorrisoArgs...))
 	cmd.Stdout = nil
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("xorriso: %w", err)
 	}
+	return nil
+}
 
-	// Print ISO size
-	if info, err := os.Stat(outputPath); err == nil {
-		ui.SizeInfo("ISO", float64(info.Size())/1024/1024)
+// Repack writes the files of an unpacked ISO back into an ISO image,
+// booting it the way it was built: with isolinux or with GRUB2.
+func Repack(ctx context.Context, stagingDir, outputPath string) error {
+	if _, err := os.Stat(filepath.Join(stagingDir, "isolinux", "isolinux.bin")); err == nil {
+		// The boot catalog is written anew.
+		if err := audit.Remove(filepath.Join(stagingDir, "isolinux", "boot.cat")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return assemble(ctx, stagingDir, outputPath, isolinuxBoot())
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "boot", "grub2", "i386-pc", "eltorito.img")); err == nil {
+		return assemble(ctx, stagingDir, outputPath, grubBoot)
+	}
+	return fmt.Errorf("no isolinux or GRUB2 boot image found: not an ISO built by distrorun")
+}
+
+// SquashfsOptions controls the compression of the squashfs image.
+type SquashfsOptions struct {
+	Compression string // mksquashfs compressor; "" means xz
+	Level       int    // compression level for zstd and gzip; 0 keeps the default
+	Threads     int    // compressor threads; 0 uses every CPU
+}
+
+func (o SquashfsOptions) compression() string {
+	if o.Compression == "" {
+		return "xz"
+	}
+	return o.Compression
+}
+
+// args returns the mksquashfs options for o.
+func (o SquashfsOptions) args() []string {
+	args := []string{"-comp", o.compression()}
+	if o.Level > 0 {
+		args = append(args, "-Xcompression-level", strconv.Itoa(o.Level))
+	}
+	if o.Threads > 0 {
+		args = append(args, "-processors", strconv.Itoa(o.Threads))
 	}
+	return args
+}
+
+// squashfsCompressors are the compression ids of the squashfs superblock.
+var squashfsCompressors = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
 
+// SquashfsCompression returns the compressor of the squashfs image at path,
+// so a repacked image keeps it.
+func SquashfsCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sb := make([]byte, 22)
+	if _, err := io.ReadFull(f, sb); err != nil {
+		return "", fmt.Errorf("reading squashfs superblock: %w", err)
+	}
+	if string(sb[:4]) != "hsqs" {
+		return "", fmt.Errorf("%s is not a squashfs image", path)
+	}
+	comp, ok := squashfsCompressors[binary.LittleEndian.Uint16(sb[20:])]
+	if !ok {
+		return "", fmt.Errorf("%s uses an unknown compression", path)
+	}
+	return comp, nil
+}
+
+// MakeSquashfs compresses rootfsPath into a read-only squashfs image at squashfsPath.
+func MakeSquashfs(ctx context.Context, rootfsPath, squashfsPath string, opts SquashfsOptions) error {
+	if comps := mksquashfsCompressors(); comps != nil && !slices.Contains(comps, opts.compression()) && slices.Contains(comps, "xz") {
+		ui.Degrade("squashfs "+opts.compression()+" compression",
+			"the host mksquashfs is built without it; using xz, which is slower to compress and to boot")
+		opts.Compression, opts.Level = "xz", 0
+	}
+	ui.SubStep("Creating squashfs image (" + opts.compression() + " compression)...")
+
+	args := append([]string{rootfsPath, squashfsPath}, opts.args()...)
+	args = append(args, "-no-xattrs", "-noappend")
+	// xorriso reads SOURCE_DATE_EPOCH itself; older mksquashfs releases
+	// only take it as options.
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		args = append(args, "-mkfs-time", epoch, "-all-time", epoch)
+	}
+	cmd := limits.Apply(confine.Command(ctx, confine.Writer, "mksquashfs", args...))
+	progress := ui.NewPercentage()
+	cmd.Stdout = &squashfsProgress{set: progress.Set}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mksquashfs: %w", err)
+	}
+	progress.Done()
+
+	// Print squashfs size
+	if info, err := os.Stat(squashfsPath); err == nil {
+		ui.SizeInfo("Squashfs", float64(info.Size())/1024/1024)
+	}
+	return nil
+}
+
+// squashfsPercent matches the end of a mksquashfs progress bar line, e.g.
+// "[=====/      ]  234/5678   4%".
+var squashfsPercent = regexp.MustCompile(`\]\s*\d+/\s*\d+\s+(\d+)%$`)
+
+// squashfsProgress reads the output of mksquashfs, which redraws its
+// progress bar with carriage returns, and reports the percent done to set.
+// The rest of the output, a summary of the filesystem, is dropped.
+type squashfsProgress struct {
+	set  func(percent int64)
+	line []byte
+}
+
+func (p *squashfsProgress) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if c != '\r' && c != '\n' {
+			p.line = append(p.line, c)
+			continue
+		}
+		if m := squashfsPercent.FindSubmatch(bytes.TrimSpace(p.line)); m != nil {
+			pct, _ := strconv.ParseInt(string(m[1]), 10, 64)
+			p.set(pct)
+		}
+		p.line = p.line[:0]
+	}
+	return len(b), nil
+}
+
+// mksquashfsCompressors returns the compressors the host mksquashfs was
+// built with, as its help lists them, or nil when it does not list them.
+func mksquashfsCompressors() []string {
+	for _, flag := range []string{"-help", "-help-all"} {
+		out, _ := exec.Command("mksquashfs", flag).CombinedOutput()
+		if comps := parseCompressors(string(out)); comps != nil {
+			return comps
+		}
+	}
 	return nil
 }
 
+// parseCompressors returns the compressors of a mksquashfs help text: the
+// lines indented by a single tab after "Compressors available", their
+// options being indented further.
+func parseCompressors(help string) []string {
+	_, list, ok := strings.Cut(help, "Compressors available")
+	if !ok {
+		return nil
+	}
+	var comps []string
+	for line := range strings.Lines(list) {
+		rest, ok := strings.CutPrefix(line, "\t")
+		if !ok || strings.HasPrefix(rest, "\t") || strings.HasPrefix(rest, " ") || strings.TrimSpace(rest) == "" {
+			continue
+		}
+		comps = append(comps, strings.Fields(rest)[0])
+	}
+	return comps
+}
+
 // CheckHostDeps verifies that all required host tools are installed for Alpine builds.
 func CheckHostDeps() error {
-	tools := []string{"xorriso", "mksquashfs"}
+	tools := []string{"mksquashfs"}
 
 	for _, tool := range tools {
 		if _, err := exec.LookPath(tool); err != nil {
@@ -77,17 +280,12 @@ func CheckHostDeps() error {
 		}
 	}
 
-	// Check for syslinux files
-	if bootloader.IsohdpfxPath() == "" {
-		ui.Warn("isohdpfx.bin not found — ISO will not be USB bootable")
-	}
-
 	return nil
 }
 
 // CheckFedoraDeps verifies host tools required for Fedora builds.
 func CheckFedoraDeps() error {
-	tools := []string{"xorriso", "mksquashfs", "dnf"}
+	tools := []string{"mksquashfs", "dnf"}
 
 	for _, tool := range tools {
 		if _, err := exec.LookPath(tool); err != nil {
@@ -102,48 +300,29 @@ func CheckFedoraDeps() error {
 	return nil
 }
 
-// BuildFedora creates the final bootable Fedora ISO image using GRUB2 El Torito.
-func BuildFedora(rootfsPath, stagingDir, outputPath string) error {
-	// Create squashfs from rootfs (same as Build)
-	squashfsPath := filepath.Join(stagingDir, "rootfs.squashfs")
-	ui.SubStep("Creating squashfs image (xz compression)...")
-
-	cmd := exec.Command("mksquashfs", rootfsPath, squashfsPath,
-		"-comp", "xz", "-no-xattrs", "-noappend")
-	cmd.Stdout = nil
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mksquashfs: %w", err)
-	}
-
-	if info, err := os.Stat(squashfsPath); err == nil {
-		ui.SizeInfo("Squashfs", float64(info.Size())/1024/1024)
+// CheckDebianDeps verifies host tools required for Debian builds.
+func CheckDebianDeps() error {
+	for _, tool := range []string{"mksquashfs", "debootstrap"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("required tool not found: %s (install with your package manager)", tool)
+		}
 	}
 
-	// Assemble ISO with GRUB2 El Torito and a volume label for rd.live.image
-	ui.SubStep("Assembling ISO image...")
-
-	xorrisoArgs := []string{
-		"-as", "mkisofs",
-		"-o", outputPath,
-		"-V", "DISTRORUN",
-		"-b", "boot/grub2/i386-pc/eltorito.img",
-		"-no-emul-boot",
-		"-boot-load-size", "4",
-		"-boot-info-table",
-		stagingDir,
+	if !bootloader.Grub2MkimageAvailable() {
+		return fmt.Errorf("grub-mkimage not found (install grub-common or grub2-tools)")
 	}
 
-	cmd = exec.Command("xorriso", xorrisoArgs...)
-	cmd.Stdout = nil
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("xorriso: %w", err)
-	}
+	return nil
+}
 
-	if info, err := os.Stat(outputPath); err == nil {
-		ui.SizeInfo("ISO", float64(info.Size())/1024/1024)
+// BuildGrub creates the final bootable ISO image using GRUB2 El Torito.
+// Used for the systemd-based distros (Fedora, Debian).
+func BuildGrub(ctx context.Context, rootfsPath, stagingDir, outputPath string, sq SquashfsOptions) error {
+	// Create squashfs from rootfs (same as Build)
+	if err := MakeSquashfs(ctx, rootfsPath, filepath.Join(stagingDir, "rootfs.squashfs"), sq); err != nil {
+		return err
 	}
 
-	return nil
+	// Assemble ISO with GRUB2 El Torito and a volume label for rd.live.image
+	return assemble(ctx, stagingDir, outputPath, grubBoot)
 }
@@ -0,0 +1,157 @@
+package iso
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/unpack"
+)
+
+func TestParseCompressors(t *testing.T) {
+	help := "SYNTAX:mksquashfs source1 source2 ...  FILESYSTEM [OPTIONS]\n" +
+		"\t-comp <comp>\t\tselect <comp> compression\n" +
+		"\nCompressors available and compressor specific options:\n" +
+		"\tgzip (default)\n" +
+		"\t  -Xcompression-level <compression-level>\n" +
+		"\t\t<compression-level> should be 1 .. 9 (default 9)\n" +
+		"\tlzo\n" +
+		"\txz\n" +
+		"\t  -Xbcj filter1,filter2,...,filterN\n" +
+		"\n"
+	if got := parseCompressors(help); !slices.Equal(got, []string{"gzip", "lzo", "xz"}) {
+		t.Errorf("parseCompressors = %q", got)
+	}
+	if got := parseCompressors("mksquashfs: invalid option\n"); got != nil {
+		t.Errorf("parseCompressors without a list = %q, want nil", got)
+	}
+}
+
+func TestSquashfsProgress(t *testing.T) {
+	var got []int64
+	p := &squashfsProgress{set: func(pct int64) { got = append(got, pct) }}
+	for _, chunk := range []string{
+		"Parallel mksquashfs: Using 8 processors\nCreating 4.0 filesystem on rootfs.squashfs, block size 131072.\n",
+		"\r[/                 ]  200/5678   3%\r[====|",
+		"            ] 2800/5678  49%",
+		"\r[=================-] 5678/5678 100%\n\nExportable Squashfs 4.0 filesystem\n",
+	} {
+		p.Write([]byte(chunk))
+	}
+	if !slices.Equal(got, []int64{3, 49, 100}) {
+		t.Errorf("percents = %v, want [3 49 100]", got)
+	}
+}
+
+func TestRepack(t *testing.T) {
+	t.Run("isolinux", func(t *testing.T) {
+		dir := stage(t)
+		// The catalog of the unpacked image is written anew.
+		os.WriteFile(filepath.Join(dir, "isolinux", "boot.cat"), []byte("stale catalog"), 0644)
+		os.WriteFile(filepath.Join(dir, "isolinux", "isolinux.cfg"), []byte("DEFAULT linux\nAPPEND nomodeset\n"), 0644)
+		out := filepath.Join(t.TempDir(), "patched.iso")
+		if err := Repack(context.Background(), dir, out); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(t.TempDir(), "out")
+		if err := unpack.Files(out, dest); err != nil {
+			t.Fatalf("reading the image back: %v", err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dest, "isolinux", "isolinux.cfg")); string(data) != "DEFAULT linux\nAPPEND nomodeset\n" {
+			t.Errorf("isolinux.cfg = %q, want the patched one", data)
+		}
+		if fi, err := os.Stat(filepath.Join(dest, "isolinux", "boot.cat")); err != nil || fi.Size() != sectorSize {
+			t.Errorf("boot catalog was not written anew: %v", err)
+		}
+	})
+
+	t.Run("grub", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, data := range map[string][]byte{
+			"boot/grub2/i386-pc/eltorito.img": bytes.Repeat([]byte("grub"), 1000),
+			"boot/grub2/grub.cfg":             []byte("set default=0\n"),
+			"boot/vmlinuz-6.9.1":              []byte("kernel"),
+		} {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+			os.WriteFile(filepath.Join(dir, name), data, 0644)
+		}
+		out := filepath.Join(t.TempDir(), "patched.iso")
+		if err := Repack(context.Background(), dir, out); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(t.TempDir(), "out")
+		if err := unpack.Files(out, dest); err != nil {
+			t.Fatalf("reading the image back: %v", err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dest, "boot", "grub2", "grub.cfg")); string(data) != "set default=0\n" {
+			t.Errorf("grub.cfg = %q", data)
+		}
+	})
+
+	t.Run("not distrorun", func(t *testing.T) {
+		err := Repack(context.Background(), t.TempDir(), filepath.Join(t.TempDir(), "out.iso"))
+		if err == nil || !strings.Contains(err.Error(), "not an ISO built by distrorun") {
+			t.Errorf("Repack = %v", err)
+		}
+	})
+}
+
+func TestBuildReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	files := []struct{ name, data string }{
+		{"isolinux/isolinux.bin", strings.Repeat("isolinux", 1000)},
+		{"isolinux/isolinux.cfg", "DEFAULT linux\n"},
+		{"boot/vmlinuz-lts", "kernel"},
+		{"boot/initramfs-lts", "initramfs"},
+		{"rootfs/etc/hostname", "testos\n"},
+		{"rootfs/usr/bin/tool", "binary"},
+	}
+	// build writes the files in the given order at the given time, as two
+	// builds would at different moments, and returns the image.
+	build := func(order []int, mtime time.Time) []byte {
+		dir := t.TempDir()
+		for _, i := range order {
+			p := filepath.Join(dir, files[i].name)
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, []byte(files[i].data), 0644)
+		}
+		filepath.WalkDir(dir, func(p string, _ os.DirEntry, _ error) error {
+			return os.Chtimes(p, mtime, mtime)
+		})
+
+		rootfs, staging := filepath.Join(dir, "rootfs"), filepath.Join(dir, "staging")
+		os.Mkdir(staging, 0755)
+		for _, sub := range []string{"isolinux", "boot"} {
+			os.Rename(filepath.Join(dir, sub), filepath.Join(staging, sub))
+		}
+		out := filepath.Join(dir, "os.iso")
+		if _, err := exec.LookPath("mksquashfs"); err == nil {
+			if err := Build(context.Background(), rootfs, staging, out, SquashfsOptions{Compression: "gzip"}); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			// Without mksquashfs only the ISO itself is compared.
+			os.WriteFile(filepath.Join(staging, "rootfs.squashfs"), []byte("squashfs"), 0644)
+			if err := assemble(context.Background(), staging, out, bootOptions{image: "isolinux/isolinux.bin", catalog: "isolinux/boot.cat"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := build([]int{0, 1, 2, 3, 4, 5}, time.Unix(1710000000, 0))
+	second := build([]int{5, 3, 4, 1, 2, 0}, time.Unix(1720000000, 0))
+	if !bytes.Equal(first, second) {
+		t.Error("two builds of the same files differ despite SOURCE_DATE_EPOCH")
+	}
+}
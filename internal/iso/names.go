@@ -0,0 +1,68 @@
+package iso
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The ISO carries every file twice over: under an ISO9660 name, shortened
+// and upper-cased, and under its Rock Ridge name, which is the original name
+// and the one Linux, isolinux and GRUB read. The native writer stores Rock
+// Ridge names byte for byte, but xorriso, which takes over the trees it
+// cannot write, keeps them only if it can read them in the input character
+// set; anything else is rewritten without notice, so a file the boot
+// configuration refers to would no longer be found. CheckNames holds both
+// writers to the same names.
+
+// inputCharset is the character set xorriso reads file names in. It is
+// pinned instead of taken from the host locale, which is often "C" under
+// sudo. The ISO is built at level 3, the only level that holds files of
+// 4 GiB or more; the squashfs of a workstation image easily grows past it.
+const inputCharset = "utf-8"
+
+// maxNameProblems bounds how many offending names CheckNames lists.
+const maxNameProblems = 10
+
+// CheckNames walks the tree that becomes the ISO and reports, in one error,
+// the names xorriso would rewrite: names that are not valid UTF-8 and names
+// with control characters such as line breaks.
+func CheckNames(root string) error {
+	var problems []string
+	count := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		var reason string
+		switch name := d.Name(); {
+		case !utf8.ValidString(name):
+			reason = "is not valid UTF-8"
+		case strings.ContainsFunc(name, unicode.IsControl):
+			reason = "contains control characters"
+		default:
+			return nil
+		}
+		if count++; count <= maxNameProblems {
+			problems = append(problems, fmt.Sprintf("%q %s", "/"+filepath.ToSlash(rel), reason))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("checking ISO file names: %w", err)
+	}
+	if count == 0 {
+		return nil
+	}
+	if count > maxNameProblems {
+		problems = append(problems, fmt.Sprintf("and %d more", count-maxNameProblems))
+	}
+	return fmt.Errorf("file names that cannot be stored in the ISO unchanged:\n  %s", strings.Join(problems, "\n  "))
+}
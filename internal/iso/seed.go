@@ -0,0 +1,32 @@
+package iso
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// SeedLabel is the volume label cloud-init's NoCloud datasource looks for.
+const SeedLabel = "cidata"
+
+// BuildSeed writes a NoCloud seed ISO holding files, such as "user-data"
+// and "meta-data", to outputPath. workDir holds its staging directory.
+func BuildSeed(workDir string, files map[string][]byte, outputPath string) error {
+	ui.SubStep("Writing cloud-init seed ISO...")
+	dir := filepath.Join(workDir, "seed")
+	if err := audit.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating seed directory: %w", err)
+	}
+	for name, data := range files {
+		if err := audit.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+	if err := writeISO(dir, outputPath, SeedLabel, nil); err != nil {
+		return fmt.Errorf("writing seed ISO: %w", err)
+	}
+	ui.Detail(outputPath)
+	return nil
+}
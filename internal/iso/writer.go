@@ -0,0 +1,867 @@
+package iso
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// The native writer produces the same kind of image xorriso does for
+// distrorun: ISO9660 level 3 with Rock Ridge names, modes and symlinks, an
+// El Torito catalog booting BIOS and, when present, UEFI, and an isohybrid
+// MBR so the image boots from USB sticks too. Trees it cannot represent
+// fail with errUnsupported, and assemble hands them to xorriso instead.
+
+const sectorSize = 2048
+
+// maxExtent is the largest extent of a file, a whole number of sectors;
+// larger files continue in further directory records.
+const maxExtent = 0xFFFFF800
+
+// maxDepth is the deepest directory level ISO9660 allows, the root being
+// the first. Rock Ridge relocates deeper directories; this writer does not.
+const maxDepth = 8
+
+// errUnsupported marks trees the native writer cannot represent.
+var errUnsupported = errors.New("not supported by the native ISO writer")
+
+// bootOptions describes how an image boots.
+type bootOptions struct {
+	image     string // El Torito BIOS boot image, relative to the ISO root
+	catalog   string // path the boot catalog is listed under; "" hides it
+	hybridMBR string // isohybrid MBR template (isohdpfx.bin); "" writes none
+	efiImage  string // EFI system partition image; "" boots BIOS only
+}
+
+// xorrisoArgs returns the mkisofs-style arguments of xorriso for o.
+func (o *bootOptions) xorrisoArgs() []string {
+	args := []string{"-b", o.image}
+	if o.catalog != "" {
+		args = append(args, "-c", o.catalog)
+	}
+	args = append(args, "-no-emul-boot", "-boot-load-size", "4", "-boot-info-table")
+	if o.hybridMBR != "" {
+		args = append(args, "-isohybrid-mbr", o.hybridMBR)
+	}
+	if o.efiImage != "" {
+		args = append(args, "-eltorito-alt-boot", "-e", o.efiImage, "-no-emul-boot")
+		if o.hybridMBR != "" {
+			args = append(args, "-isohybrid-gpt-basdat")
+		}
+	}
+	return args
+}
+
+// isoNode is a file or directory of the image.
+type isoNode struct {
+	name     string // Rock Ridge name, the name on the host
+	id       string // ISO9660 identifier
+	path     string // host path; "" for the boot catalog
+	mode     fs.FileMode
+	mtime    time.Time
+	size     int64
+	link     string // symlink target
+	parent   *isoNode
+	children []*isoNode
+	lba      uint32 // of the directory records or the file data
+	dirSize  uint32 // of directories: their records, in whole sectors
+	num      uint16 // of directories: the number in the path table
+}
+
+// isoWriter lays out and writes one image.
+type isoWriter struct {
+	label   string
+	boot    *bootOptions
+	epoch   *time.Time // SOURCE_DATE_EPOCH, replacing every timestamp
+	created time.Time
+
+	root    *isoNode
+	dirs    []*isoNode // breadth first, the order of the path table
+	files   []*isoNode // in the order of their data
+	catalog *isoNode   // the boot catalog
+	image   *isoNode   // the BIOS boot image
+	efi     *isoNode   // the EFI system partition image
+
+	pathTable uint32 // size of each path table, in bytes
+	lTable    uint32 // LBA of the little-endian path table
+	mTable    uint32 // LBA of the big-endian path table
+	sectors   uint32 // size of the image
+}
+
+// writeISO writes the tree at dir as an ISO image with volume label label
+// to outputPath, bootable as boot describes unless boot is nil.
+func writeISO(dir, outputPath, label string, boot *bootOptions) error {
+	w := &isoWriter{label: label, boot: boot, created: time.Now().UTC()}
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SOURCE_DATE_EPOCH: %w", err)
+		}
+		t := time.Unix(sec, 0).UTC()
+		w.epoch, w.created = &t, t
+	}
+	if err := w.scan(dir); err != nil {
+		return err
+	}
+	if err := w.layout(); err != nil {
+		return err
+	}
+
+	f, err := audit.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	if err := w.write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// scan reads the tree at dir and finds the boot files in it.
+func (w *isoWriter) scan(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	w.root = &isoNode{path: dir, mode: info.Mode(), mtime: info.ModTime()}
+	w.root.parent = w.root
+	if err := w.scanDir(w.root, 1); err != nil {
+		return err
+	}
+	if w.boot == nil {
+		return nil
+	}
+
+	w.catalog = &isoNode{size: sectorSize, mode: 0444, mtime: w.created}
+	if w.boot.catalog != "" {
+		parent, name := w.lookup(filepath.Dir(w.boot.catalog)), filepath.Base(w.boot.catalog)
+		if parent == nil || !parent.mode.IsDir() {
+			return fmt.Errorf("boot catalog %s: directory not found", w.boot.catalog)
+		}
+		if w.lookup(w.boot.catalog) != nil {
+			return fmt.Errorf("boot catalog %s: file exists", w.boot.catalog)
+		}
+		w.catalog.name, w.catalog.parent = name, parent
+		parent.children = append(parent.children, w.catalog)
+	}
+	if w.image = w.lookup(w.boot.image); w.image == nil || !w.image.mode.IsRegular() {
+		return fmt.Errorf("boot image %s not found", w.boot.image)
+	}
+	if w.image.size < 64 || w.image.size > maxExtent {
+		return fmt.Errorf("boot image %s: unexpected size %d", w.boot.image, w.image.size)
+	}
+	if w.boot.efiImage != "" {
+		if w.efi = w.lookup(w.boot.efiImage); w.efi == nil || !w.efi.mode.IsRegular() {
+			return fmt.Errorf("EFI image %s not found", w.boot.efiImage)
+		}
+	}
+	return nil
+}
+
+// scanDir adds the entries of the directory n, at depth depth, to the tree.
+func (w *isoWriter) scanDir(n *isoNode, depth int) error {
+	entries, err := os.ReadDir(n.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(n.path, e.Name())
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		c := &isoNode{name: e.Name(), path: p, mode: info.Mode(), mtime: info.ModTime(), parent: n}
+		switch {
+		case info.IsDir():
+			if depth == maxDepth {
+				return fmt.Errorf("%s: directories nested more than %d levels: %w", p, maxDepth, errUnsupported)
+			}
+			if err := w.scanDir(c, depth+1); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			c.size = info.Size()
+		case info.Mode()&fs.ModeSymlink != 0:
+			if c.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: %s files: %w", p, info.Mode().Type(), errUnsupported)
+		}
+		n.children = append(n.children, c)
+	}
+	return nil
+}
+
+// lookup returns the node at the slash-separated path rel, or nil.
+func (w *isoWriter) lookup(rel string) *isoNode {
+	n := w.root
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		var next *isoNode
+		for _, c := range n.children {
+			if c.name == name {
+				next = c
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// layout assigns identifiers and sectors: the volume descriptors from
+// sector 16, the path tables, the directories, the boot catalog and the
+// file data.
+func (w *isoWriter) layout() error {
+	next := uint32(16 + 2) // primary volume descriptor and terminator
+	if w.boot != nil {
+		next++ // El Torito boot record
+	}
+
+	// Directories, breadth first.
+	w.dirs = []*isoNode{w.root}
+	for i := 0; i < len(w.dirs); i++ {
+		d := w.dirs[i]
+		d.num = uint16(i + 1)
+		if i+1 > 0xFFFF {
+			return fmt.Errorf("more than 65535 directories: %w", errUnsupported)
+		}
+		assignIDs(d.children)
+		for _, c := range d.children {
+			if c.mode.IsDir() {
+				w.dirs = append(w.dirs, c)
+			}
+		}
+	}
+	for _, d := range w.dirs {
+		w.pathTable += uint32(pathRecordLen(d))
+	}
+	w.lTable = next
+	next += sectors(int64(w.pathTable))
+	w.mTable = next
+	next += sectors(int64(w.pathTable))
+
+	for _, d := range w.dirs {
+		size, err := w.dirLen(d)
+		if err != nil {
+			return err
+		}
+		d.lba, d.dirSize = next, size
+		next += size / sectorSize
+	}
+	if w.boot != nil {
+		w.catalog.lba = next
+		next++
+	}
+
+	// File data, depth first in identifier order.
+	var walk func(d *isoNode)
+	walk = func(d *isoNode) {
+		for _, c := range d.children {
+			switch {
+			case c.mode.IsDir():
+				walk(c)
+			case c.mode.IsRegular() && c != w.catalog:
+				w.files = append(w.files, c)
+			}
+		}
+	}
+	walk(w.root)
+	for _, f := range w.files {
+		f.lba = next
+		n := uint64(next) + uint64(sectors(f.size))
+		if n > 0xFFFFFFFF {
+			return fmt.Errorf("image larger than 8 TiB: %w", errUnsupported)
+		}
+		next = uint32(n)
+	}
+	w.sectors = next
+	if w.boot != nil && w.boot.hybridMBR != "" {
+		// isohybrid images end on a whole 1 MiB, a cylinder of the MBR's
+		// 64 heads and 32 sectors.
+		w.sectors = (next + 511) / 512 * 512
+	}
+	return nil
+}
+
+// sectors returns the number of sectors size bytes take.
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+// assignIDs gives the nodes of one directory unique ISO9660 identifiers and
+// sorts them by identifier.
+func assignIDs(nodes []*isoNode) {
+	used := map[string]bool{}
+	for _, n := range nodes {
+		base, ext := isoName(n.name, n.mode.IsDir())
+		id := joinID(base, ext, n.mode.IsDir())
+		for i := 1; used[id]; i++ {
+			suffix := strconv.Itoa(i)
+			b := base
+			if len(b)+len(suffix) > maxNameLen(ext, n.mode.IsDir()) {
+				b = b[:max(0, maxNameLen(ext, n.mode.IsDir())-len(suffix))]
+			}
+			id = joinID(b+suffix, ext, n.mode.IsDir())
+		}
+		used[id] = true
+		n.id = id
+	}
+	sort.Slice(nodes, func(i, j int) bool { return idLess(nodes[i].id, nodes[j].id) })
+}
+
+// isoName returns the d-character name and extension of a host name.
+func isoName(name string, dir bool) (base, ext string) {
+	upper := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.' && !dir:
+			return r
+		}
+		return '_'
+	}, name)
+	base = upper
+	if i := strings.LastIndexByte(upper, '.'); i >= 0 && !dir {
+		base, ext = upper[:i], upper[i+1:]
+	}
+	base = strings.ReplaceAll(base, ".", "_")
+	if len(ext) > 29 {
+		ext = ext[:29]
+	}
+	if base == "" && ext == "" {
+		base = "_"
+	}
+	if n := maxNameLen(ext, dir); len(base) > n {
+		base = base[:n]
+	}
+	return base, ext
+}
+
+// maxNameLen is the longest name next to ext: 30 characters for name and
+// extension together, 31 for directories.
+func maxNameLen(ext string, dir bool) int {
+	if dir {
+		return 31
+	}
+	return 30 - len(ext)
+}
+
+func joinID(base, ext string, dir bool) string {
+	if dir {
+		return base
+	}
+	return base + "." + ext + ";1"
+}
+
+// idLess orders identifiers as ECMA-119 sorts directory records: by name,
+// then extension, each padded with spaces.
+func idLess(a, b string) bool {
+	split := func(id string) (string, string) {
+		id = strings.TrimSuffix(id, ";1")
+		name, ext, _ := strings.Cut(id, ".")
+		return name, ext
+	}
+	an, ae := split(a)
+	bn, be := split(b)
+	if c := comparePadded(an, bn); c != 0 {
+		return c < 0
+	}
+	return comparePadded(ae, be) < 0
+}
+
+func comparePadded(a, b string) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		ca, cb := byte(' '), byte(' ')
+		if i < len(a) {
+			ca = a[i]
+		}
+		if i < len(b) {
+			cb = b[i]
+		}
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return 0
+}
+
+// dirLen returns the size of the records of directory d, in whole sectors.
+// Records do not cross sector boundaries.
+func (w *isoWriter) dirLen(d *isoNode) (uint32, error) {
+	var size uint32
+	add := func(rec []byte) {
+		if size%sectorSize+uint32(len(rec)) > sectorSize {
+			size = (size/sectorSize + 1) * sectorSize
+		}
+		size += uint32(len(rec))
+	}
+	recs, err := w.records(d)
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range recs {
+		add(rec)
+	}
+	return (size + sectorSize - 1) / sectorSize * sectorSize, nil
+}
+
+// records returns the directory records of d: ".", ".." and one or more
+// for each entry.
+func (w *isoWriter) records(d *isoNode) ([][]byte, error) {
+	recs := [][]byte{
+		w.record(d, "\x00", d.lba, d.dirSize, 0x02, w.rockRidge(d, "", d == w.root)),
+		w.record(d.parent, "\x01", d.parent.lba, d.parent.dirSize, 0x02, w.rockRidge(d.parent, "", false)),
+	}
+	for _, c := range d.children {
+		su := w.rockRidge(c, c.name, false)
+		switch {
+		case c.mode.IsDir():
+			recs = append(recs, w.record(c, c.id, c.lba, c.dirSize, 0x02, su))
+		case c.mode.IsRegular():
+			lba, left := c.lba, c.size
+			for {
+				n := min(left, maxExtent)
+				flags := byte(0)
+				if left > n {
+					flags = 0x80 // continued in the next record
+				}
+				recs = append(recs, w.record(c, c.id, lba, uint32(n), flags, su))
+				left -= n
+				lba += sectors(n)
+				if left == 0 {
+					break
+				}
+			}
+		default:
+			recs = append(recs, w.record(c, c.id, 0, 0, 0, su))
+		}
+	}
+	for _, rec := range recs {
+		if len(rec) > 255 {
+			return nil, fmt.Errorf("%s: name or symlink target too long: %w", d.path, errUnsupported)
+		}
+	}
+	return recs, nil
+}
+
+// record encodes a directory record; the length byte wraps for records
+// over 255 bytes, which records rejects.
+func (w *isoWriter) record(n *isoNode, id string, lba, size uint32, flags byte, su []byte) []byte {
+	l := 33 + len(id)
+	if l%2 == 1 {
+		l++
+	}
+	rec := make([]byte, l, l+len(su)+1)
+	rec[0] = byte(l + len(su) + len(su)%2)
+	putBoth32(rec[2:], lba)
+	putBoth32(rec[10:], size)
+	copy(rec[18:25], recordDate(w.mtime(n)))
+	rec[25] = flags
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(id))
+	copy(rec[33:], id)
+	rec = append(rec, su...)
+	if len(rec)%2 == 1 {
+		rec = append(rec, 0)
+	}
+	return rec
+}
+
+func (w *isoWriter) mtime(n *isoNode) time.Time {
+	if w.epoch != nil {
+		return *w.epoch
+	}
+	return n.mtime
+}
+
+// rockRidge returns the Rock Ridge entries of n under name; the "." record
+// of the root carries the SP and ER entries announcing them.
+func (w *isoWriter) rockRidge(n *isoNode, name string, root bool) []byte {
+	var su []byte
+	if root {
+		su = append(su, 'S', 'P', 7, 1, 0xBE, 0xEF, 0)
+		const id, desc = "RRIP_1991A", "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+		su = append(su, 'E', 'R', byte(8+len(id)+len(desc)), 1, byte(len(id)), byte(len(desc)), 0, 1)
+		su = append(su, id+desc...)
+	}
+
+	mode, nlink := uint32(n.mode.Perm()), uint32(1)
+	switch {
+	case n.mode.IsDir():
+		mode |= 0o040000
+		nlink = 2
+		for _, c := range n.children {
+			if c.mode.IsDir() {
+				nlink++
+			}
+		}
+	case n.mode&fs.ModeSymlink != 0:
+		mode |= 0o120000
+	default:
+		mode |= 0o100000
+	}
+	if n.mode&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if n.mode&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if n.mode&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	px := make([]byte, 36)
+	copy(px, "PX")
+	px[2], px[3] = 36, 1
+	putBoth32(px[4:], mode)
+	putBoth32(px[12:], nlink)
+	su = append(su, px...)
+
+	if name != "" {
+		su = append(su, 'N', 'M', byte(5+len(name)), 1, 0)
+		su = append(su, name...)
+	}
+	if n.link != "" {
+		su = append(su, symlinkEntry(n.link)...)
+	}
+	su = append(su, 'T', 'F', 5+7, 1, 0x02) // modification time
+	su = append(su, recordDate(w.mtime(n))...)
+	return su
+}
+
+// symlinkEntry encodes target as an SL entry.
+func symlinkEntry(target string) []byte {
+	var comps []byte
+	if strings.HasPrefix(target, "/") {
+		comps = append(comps, 0x08, 0) // root
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "":
+		case ".":
+			comps = append(comps, 0x02, 0)
+		case "..":
+			comps = append(comps, 0x04, 0)
+		default:
+			comps = append(comps, 0, byte(len(c)))
+			comps = append(comps, c...)
+		}
+	}
+	return append([]byte{'S', 'L', byte(5 + len(comps)), 1, 0}, comps...)
+}
+
+// pathRecordLen returns the size of the path table record of d.
+func pathRecordLen(d *isoNode) int {
+	n := 8 + len(pathID(d))
+	return n + n%2
+}
+
+func pathID(d *isoNode) string {
+	if d.parent == d {
+		return "\x00"
+	}
+	return d.id
+}
+
+// pathTable encodes the path table in the byte order order.
+func (w *isoWriter) pathTableData(order binary.ByteOrder) []byte {
+	var t []byte
+	for _, d := range w.dirs {
+		rec := make([]byte, pathRecordLen(d))
+		id := pathID(d)
+		rec[0] = byte(len(id))
+		order.PutUint32(rec[2:], d.lba)
+		order.PutUint16(rec[6:], d.parent.num)
+		copy(rec[8:], id)
+		t = append(t, rec...)
+	}
+	return t
+}
+
+// write writes the image laid out by layout to out.
+func (w *isoWriter) write(out io.Writer) error {
+	system := make([]byte, 16*sectorSize)
+	if w.boot != nil && w.boot.hybridMBR != "" {
+		mbr, err := w.hybridMBR()
+		if err != nil {
+			return err
+		}
+		copy(system, mbr)
+	}
+	if _, err := out.Write(system); err != nil {
+		return err
+	}
+
+	descriptors := [][]byte{w.primaryDescriptor()}
+	if w.boot != nil {
+		descriptors = append(descriptors, w.bootRecord())
+	}
+	descriptors = append(descriptors, descriptor(255))
+	for _, d := range descriptors {
+		if _, err := out.Write(d); err != nil {
+			return err
+		}
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if _, err := out.Write(pad(w.pathTableData(order))); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range w.dirs {
+		recs, err := w.records(d)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, 0, d.dirSize)
+		for _, rec := range recs {
+			if len(data)%sectorSize+len(rec) > sectorSize {
+				data = pad(data)
+			}
+			data = append(data, rec...)
+		}
+		if _, err := out.Write(pad(data)); err != nil {
+			return err
+		}
+	}
+	if w.boot != nil {
+		if _, err := out.Write(w.bootCatalog()); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range w.files {
+		if err := w.writeFile(out, f); err != nil {
+			return err
+		}
+	}
+	written := uint32(16+len(descriptors)) + 2*sectors(int64(w.pathTable))
+	for _, d := range w.dirs {
+		written += d.dirSize / sectorSize
+	}
+	if w.boot != nil {
+		written++
+	}
+	for _, f := range w.files {
+		written += sectors(f.size)
+	}
+	if _, err := out.Write(make([]byte, int64(w.sectors-written)*sectorSize)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeFile copies the data of f, padded to a whole sector, patching the
+// boot info table into the BIOS boot image.
+func (w *isoWriter) writeFile(out io.Writer, f *isoNode) error {
+	if f == w.image {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != f.size {
+			return fmt.Errorf("%s changed while writing the ISO", f.path)
+		}
+		w.bootInfoTable(data)
+		_, err = out.Write(pad(data))
+		return err
+	}
+
+	in, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	n, err := io.Copy(out, io.LimitReader(in, f.size))
+	if err != nil {
+		return err
+	}
+	if n != f.size {
+		return fmt.Errorf("%s changed while writing the ISO", f.path)
+	}
+	_, err = out.Write(make([]byte, int64(sectors(f.size))*sectorSize-f.size))
+	return err
+}
+
+// bootInfoTable patches the boot info table -boot-info-table writes into
+// the boot image data: where the volume descriptors and the image are, and
+// a checksum of the image past the table.
+func (w *isoWriter) bootInfoTable(data []byte) {
+	var sum uint32
+	for i := 64; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.LittleEndian.Uint32(word[:])
+	}
+	binary.LittleEndian.PutUint32(data[8:], 16)
+	binary.LittleEndian.PutUint32(data[12:], w.image.lba)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[20:], sum)
+	clear(data[24:64])
+}
+
+// descriptor returns a volume descriptor of type typ with its header filled in.
+func descriptor(typ byte) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = typ
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	return d
+}
+
+// primaryDescriptor encodes the primary volume descriptor.
+func (w *isoWriter) primaryDescriptor() []byte {
+	d := descriptor(1)
+	fill := func(off, n int, s string) {
+		copy(d[off:off+n], s+strings.Repeat(" ", n))
+	}
+	fill(8, 32, "LINUX")
+	fill(40, 32, w.label)
+	putBoth32(d[80:], w.sectors)
+	putBoth16(d[120:], 1) // volume set size
+	putBoth16(d[124:], 1) // volume sequence number
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], w.pathTable)
+	binary.LittleEndian.PutUint32(d[140:], w.lTable)
+	binary.BigEndian.PutUint32(d[148:], w.mTable)
+	copy(d[156:190], w.record(w.root, "\x00", w.root.lba, w.root.dirSize, 0x02, nil))
+	fill(190, 128, "")
+	fill(318, 128, "")
+	fill(446, 128, "")
+	fill(574, 128, "DISTRORUN")
+	fill(702, 37*3, "")
+	copy(d[813:], volumeDate(&w.created))
+	copy(d[830:], volumeDate(&w.created))
+	copy(d[847:], volumeDate(nil))
+	copy(d[864:], volumeDate(nil))
+	d[881] = 1 // file structure version
+	return d
+}
+
+// bootRecord encodes the El Torito boot record volume descriptor.
+func (w *isoWriter) bootRecord() []byte {
+	d := descriptor(0)
+	copy(d[7:], "EL TORITO SPECIFICATION")
+	binary.LittleEndian.PutUint32(d[71:], w.catalog.lba)
+	return d
+}
+
+// bootCatalog encodes the El Torito boot catalog: the validation entry, the
+// BIOS image as default entry and the EFI image in a section of its own.
+func (w *isoWriter) bootCatalog() []byte {
+	c := make([]byte, sectorSize)
+	c[0] = 1 // validation entry, platform x86
+	c[30], c[31] = 0x55, 0xAA
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(c[i:])
+	}
+	binary.LittleEndian.PutUint16(c[28:], -sum)
+
+	entry := func(e []byte, n *isoNode, count uint16) {
+		e[0] = 0x88 // bootable, no emulation
+		binary.LittleEndian.PutUint16(e[6:], count)
+		binary.LittleEndian.PutUint32(e[8:], n.lba)
+	}
+	entry(c[32:64], w.image, 4)
+	if w.efi != nil {
+		c[64] = 0x91 // final section header
+		c[65] = 0xEF // platform UEFI
+		binary.LittleEndian.PutUint16(c[66:], 1)
+		entry(c[96:128], w.efi, uint16(min((w.efi.size+511)/512, 0xFFFF)))
+	}
+	return c
+}
+
+// hybridMBR returns the isohybrid master boot record: the isohdpfx boot
+// code, pointed at the BIOS boot image, and a partition table with one
+// partition covering the image and, for UEFI, one for the EFI image.
+func (w *isoWriter) hybridMBR() ([]byte, error) {
+	code, err := os.ReadFile(w.boot.hybridMBR)
+	if err != nil {
+		return nil, err
+	}
+	mbr := make([]byte, 512)
+	copy(mbr[:432], code)
+	binary.LittleEndian.PutUint32(mbr[432:], w.image.lba*4)
+	binary.LittleEndian.PutUint32(mbr[440:], crc32.ChecksumIEEE(volumeDate(&w.created)))
+	partition(mbr[446:462], 0x80, 0x17, 0, w.sectors*4)
+	if w.efi != nil {
+		partition(mbr[462:478], 0, 0xEF, w.efi.lba*4, uint32((w.efi.size+511)/512))
+	}
+	mbr[510], mbr[511] = 0x55, 0xAA
+	return mbr, nil
+}
+
+// partition encodes an MBR partition entry of size 512-byte sectors from
+// start, with CHS addresses for 64 heads of 32 sectors.
+func partition(p []byte, status, typ byte, start, size uint32) {
+	chs := func(b []byte, lba uint32) {
+		c, h, s := lba/(64*32), lba/32%64, lba%32+1
+		if c > 1023 {
+			c, h, s = 1023, 63, 32
+		}
+		b[0], b[1], b[2] = byte(h), byte(s)|byte(c>>8)<<6, byte(c)
+	}
+	p[0], p[4] = status, typ
+	chs(p[1:4], start)
+	chs(p[5:8], start+size-1)
+	binary.LittleEndian.PutUint32(p[8:], start)
+	binary.LittleEndian.PutUint32(p[12:], size)
+}
+
+// recordDate encodes t as the date of a directory record, in UTC.
+func recordDate(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// volumeDate encodes t as a volume descriptor date; nil is "not specified".
+func volumeDate(t *time.Time) []byte {
+	if t == nil {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+	u := t.UTC()
+	return append([]byte(fmt.Sprintf("%04d%02d%02d%02d%02d%02d00", u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second())), 0)
+}
+
+// pad extends b to a whole number of sectors.
+func pad(b []byte) []byte {
+	if n := len(b) % sectorSize; n != 0 {
+		b = append(b, make([]byte, sectorSize-n)...)
+	}
+	return b
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
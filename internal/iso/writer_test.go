@@ -0,0 +1,175 @@
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/unpack"
+)
+
+// stage writes a staging tree like the one of an isolinux build, with
+// enough files in isolinux/ that its records span several sectors.
+func stage(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	bootImage := bytes.Repeat([]byte("isolinux"), 1000)
+	files := map[string][]byte{
+		"isolinux/isolinux.bin":       bootImage,
+		"isolinux/isolinux.cfg":       []byte("DEFAULT linux\n"),
+		"boot/vmlinuz-lts":            []byte("kernel"),
+		"boot/initramfs-lts":          []byte("initramfs"),
+		"Read me first.txt":           []byte("built by distrorun\n"),
+		"rootfs.squashfs":             bytes.Repeat([]byte{0xAB}, 3*sectorSize+5),
+		"efi/boot/empty":              nil,
+		"isolinux/README.very.long.x": []byte("dots"),
+	}
+	for i := range 60 {
+		files[fmt.Sprintf("isolinux/a-rather-long-module-name-%02d.c32", i)] = []byte{byte(i)}
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chmod(filepath.Join(dir, "Read me first.txt"), 0600)
+	os.Symlink("boot/vmlinuz-lts", filepath.Join(dir, "vmlinuz"))
+	os.Symlink("/boot/../boot/./initramfs-lts", filepath.Join(dir, "boot", "initrd"))
+	return dir
+}
+
+func TestWriteISO(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	dir := stage(t)
+	mbr := filepath.Join(t.TempDir(), "isohdpfx.bin")
+	os.WriteFile(mbr, bytes.Repeat([]byte{0xFA}, 432), 0644)
+
+	out := filepath.Join(t.TempDir(), "os.iso")
+	boot := &bootOptions{image: "isolinux/isolinux.bin", catalog: "isolinux/boot.cat", hybridMBR: mbr, efiImage: "boot/initramfs-lts"}
+	if err := writeISO(dir, out, VolumeLabel, boot); err != nil {
+		t.Fatal(err)
+	}
+	img, _ := os.ReadFile(out)
+	if len(img)%(1<<20) != 0 {
+		t.Errorf("isohybrid image of %d bytes does not end on a whole MiB", len(img))
+	}
+	again := filepath.Join(t.TempDir(), "again.iso")
+	if err := writeISO(dir, again, VolumeLabel, boot); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(again); !bytes.Equal(data, img) {
+		t.Error("images differ despite SOURCE_DATE_EPOCH")
+	}
+
+	// The tree reads back with its Rock Ridge names, modes and symlinks.
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := unpack.Files(out, dest); err != nil {
+		t.Fatalf("reading the image back: %v", err)
+	}
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		rel, _ := filepath.Rel(dir, p)
+		got := filepath.Join(dest, rel)
+		switch {
+		case d.Type()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(p)
+			if target, err := os.Readlink(got); err != nil || filepath.Clean(target) != filepath.Clean(want) {
+				t.Errorf("%s -> %q, %v; want %q", rel, target, err, want)
+			}
+		case d.Type().IsRegular():
+			want, _ := os.ReadFile(p)
+			data, err := os.ReadFile(got)
+			if err != nil || !bytes.Equal(data, want) && rel != boot.image {
+				t.Errorf("%s: %d bytes, %v; want %d", rel, len(data), err, len(want))
+			}
+		}
+		return nil
+	})
+	if fi, err := os.Stat(filepath.Join(dest, "Read me first.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode of Read me first.txt = %v, %v", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "isolinux", "boot.cat")); err != nil || fi.Size() != sectorSize {
+		t.Errorf("boot catalog not listed: %v", err)
+	}
+
+	// El Torito: the catalog the boot record points at, and the boot info
+	// table patched into the image.
+	br := img[17*sectorSize:]
+	if br[0] != 0 || !strings.HasPrefix(string(br[7:]), "EL TORITO SPECIFICATION") {
+		t.Fatal("no El Torito boot record at sector 17")
+	}
+	cat := img[binary.LittleEndian.Uint32(br[71:])*sectorSize:]
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(cat[i:])
+	}
+	if sum != 0 || cat[30] != 0x55 || cat[31] != 0xAA {
+		t.Error("invalid validation entry")
+	}
+	if cat[32] != 0x88 || cat[64] != 0x91 || cat[65] != 0xEF || cat[96] != 0x88 {
+		t.Errorf("unexpected catalog entries % x", cat[32:128])
+	}
+	bootLBA := binary.LittleEndian.Uint32(cat[40:])
+	loaded, _ := os.ReadFile(filepath.Join(dest, boot.image))
+	if got := img[bootLBA*sectorSize:][:len(loaded)]; !bytes.Equal(got, loaded) {
+		t.Error("default entry does not point at the boot image")
+	}
+	if binary.LittleEndian.Uint32(loaded[8:]) != 16 || binary.LittleEndian.Uint32(loaded[12:]) != bootLBA || binary.LittleEndian.Uint32(loaded[16:]) != 8000 {
+		t.Errorf("boot info table = % x", loaded[8:24])
+	}
+
+	// isohybrid: the boot code, pointed at the boot image, and the partitions.
+	if img[0] != 0xFA || binary.LittleEndian.Uint32(img[432:]) != bootLBA*4 || img[510] != 0x55 || img[511] != 0xAA {
+		t.Error("invalid isohybrid MBR")
+	}
+	if img[446] != 0x80 || img[450] != 0x17 || binary.LittleEndian.Uint32(img[458:]) != uint32(len(img)/512) {
+		t.Errorf("first partition = % x", img[446:462])
+	}
+	if img[466] != 0xEF {
+		t.Errorf("second partition = % x", img[462:478])
+	}
+	// flash -persist appends its partition behind the image: that needs a
+	// free slot and, with no GPT to relocate, nothing but the MBR.
+	if !bytes.Equal(img[478:510], make([]byte, 32)) || string(img[512:520]) == "EFI PART" {
+		t.Error("isohybrid image leaves no MBR slot free or has a GPT")
+	}
+}
+
+func TestWriteISOUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "1/2/3/4/5/6/7/8"), 0755)
+	err := writeISO(dir, filepath.Join(t.TempDir(), "os.iso"), VolumeLabel, nil)
+	if !errors.Is(err, errUnsupported) {
+		t.Errorf("nine levels: error = %v, want errUnsupported", err)
+	}
+
+	dir = t.TempDir()
+	os.Symlink(strings.Repeat("x/", 150), filepath.Join(dir, "link"))
+	err = writeISO(dir, filepath.Join(t.TempDir(), "os.iso"), VolumeLabel, nil)
+	if !errors.Is(err, errUnsupported) {
+		t.Errorf("long symlink: error = %v, want errUnsupported", err)
+	}
+}
+
+func TestAssignIDs(t *testing.T) {
+	var nodes []*isoNode
+	for _, name := range []string{"vmlinuz-lts", "VMLINUZ_LTS", "initramfs-lts.img", ".hidden", "a.b.c", "boot"} {
+		nodes = append(nodes, &isoNode{name: name})
+	}
+	nodes = append(nodes, &isoNode{name: "efi.d", mode: os.ModeDir})
+	assignIDs(nodes)
+	var ids []string
+	for _, n := range nodes {
+		ids = append(ids, n.id)
+	}
+	want := ".HIDDEN;1 A_B.C;1 BOOT.;1 EFI_D INITRAMFS_LTS.IMG;1 VMLINUZ_LTS.;1 VMLINUZ_LTS1.;1"
+	if got := strings.Join(ids, " "); got != want {
+		t.Errorf("ids = %s\nwant   %s", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+// Package limits lowers the priority of the processes doing a build's heavy
+// lifting (mksquashfs, xorriso and the package managers) so builds on
+// shared servers leave CPU time, memory and disk bandwidth to the other
+// workloads there. Niceness, CPU affinity and I/O priority are set on a
+// locked OS thread that then starts the process, which inherits them; the
+// rest of distrorun keeps its own. The memory limit is a cgroup v2 the
+// processes are cloned into.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// Limits are the restrictions applied to each process. Zero values leave
+// that resource unrestricted.
+type Limits struct {
+	Nice   int    // niceness, 1-19
+	CPUs   []int  // CPUs the process may run on
+	Memory int64  // memory limit in bytes
+	IO     string // I/O priority: "idle" or "low"
+}
+
+// ioPriorities are the ioprio_set values of Limits.IO: the idle class, and
+// the lowest level of the best-effort class.
+var ioPriorities = map[string]uintptr{
+	"idle": 3 << 13,
+	"low":  2<<13 | 7,
+}
+
+// ioprioWhoProcess makes ioprio_set apply to one thread.
+const ioprioWhoProcess = 1
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+var (
+	active *Limits
+	cgroup *os.File // the memory cgroup, open for clone
+)
+
+// Set makes Apply prepare processes with l until Close, creating the
+// cgroup when l limits memory.
+func Set(l Limits) error {
+	if l.Memory > 0 {
+		if err := newCgroup(l.Memory); err != nil {
+			return fmt.Errorf("memory limit: %w", err)
+		}
+	}
+	active = &l
+	return nil
+}
+
+// newCgroup creates the cgroup with memory.max set to max below the root
+// of the hierarchy: the cgroup distrorun runs in usually holds processes,
+// and cgroup v2 only lets the root hold processes and have children with
+// controllers.
+func newCgroup(max int64) error {
+	controllers, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	if !slices.Contains(strings.Fields(string(controllers)), "memory") {
+		return errors.New("the cgroup v2 memory controller is not available")
+	}
+	subtree := filepath.Join(cgroupRoot, "cgroup.subtree_control")
+	if enabled, err := os.ReadFile(subtree); err != nil || !slices.Contains(strings.Fields(string(enabled)), "memory") {
+		if err := audit.WriteFile(subtree, []byte("+memory"), 0644); err != nil {
+			return fmt.Errorf("enabling the memory controller: %w", err)
+		}
+	}
+
+	dir := filepath.Join(cgroupRoot, fmt.Sprintf("distrorun-%d", os.Getpid()))
+	if err := audit.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := audit.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(max, 10)), 0644); err != nil {
+		audit.Remove(dir)
+		return err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		audit.Remove(dir)
+		return err
+	}
+	cgroup = f
+	return nil
+}
+
+// Close stops applying limits and removes the cgroup. A process still
+// running in it keeps it from being removed.
+func Close() error {
+	active = nil
+	if cgroup == nil {
+		return nil
+	}
+	dir := cgroup.Name()
+	cgroup.Close()
+	cgroup = nil
+	return audit.Remove(dir)
+}
+
+// Apply prepares cmd to start with the limits of Set and returns it;
+// without them cmd is returned unchanged.
+func Apply(cmd *audit.Cmd) *audit.Cmd {
+	if active == nil {
+		return cmd
+	}
+	if cgroup != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	l := *active
+	cmd.Starter = func(c *exec.Cmd) error { return start(c, l) }
+	return cmd
+}
+
+// start starts cmd from a thread of its own with the priorities of l. The
+// thread is never unlocked, so it exits with the goroutine instead of
+// going back to run other goroutines at a lowered priority.
+func start(cmd *exec.Cmd, l Limits) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := l.applyThread(); err != nil {
+			errc <- err
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+// applyThread sets the priorities of l on the calling thread.
+func (l Limits) applyThread() error {
+	if l.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, l.Nice); err != nil {
+			return fmt.Errorf("setting niceness: %w", err)
+		}
+	}
+	if len(l.CPUs) > 0 {
+		var mask [16]uint64 // 1024 CPUs, as glibc's cpu_set_t
+		for _, c := range l.CPUs {
+			mask[c/64] |= 1 << (c % 64)
+		}
+		if _, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); e != 0 {
+			return fmt.Errorf("setting CPU affinity: %w", e)
+		}
+	}
+	if prio, ok := ioPriorities[l.IO]; ok {
+		if _, _, e := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); e != 0 {
+			return fmt.Errorf("setting I/O priority: %w", e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package limits
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+func TestApply(t *testing.T) {
+	script := "nice; grep Cpus_allowed_list /proc/self/status"
+	if out, err := Apply(audit.Command("sh", "-c", script)).Output(); err != nil || !strings.HasPrefix(string(out), "0\n") {
+		t.Fatalf("without Set: %q, %v", out, err)
+	}
+
+	before, _ := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err := Set(Limits{Nice: 7, CPUs: []int{0}, IO: "idle"}); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	out, err := Apply(audit.Command("sh", "-c", script)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || lines[0] != "7" || strings.Fields(lines[1])[1] != "0" {
+		t.Errorf("child reported %q, want niceness 7 on CPU 0", out)
+	}
+	if after, _ := syscall.Getpriority(syscall.PRIO_PROCESS, 0); after != before {
+		t.Errorf("niceness of the calling thread changed from %d to %d", before, after)
+	}
+
+	out, err = Apply(audit.Command("sh", "-c", "echo out; echo err >&2")).CombinedOutput()
+	if err != nil || string(out) != "out\nerr\n" {
+		t.Errorf("CombinedOutput = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,243 @@
+// Package lint checks a configuration against best practices that go
+// beyond validation: a valid configuration can still build an image that
+// is insecure or hard to maintain. Each rule can be disabled on its own.
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/apkindex"
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+// Options are what the rules know besides the configuration.
+type Options struct {
+	// Locked reports whether the configuration has a lock file.
+	Locked bool
+
+	// Disable lists rules not checked, besides those of lint.disable.
+	Disable []string
+
+	// Index is the Alpine package index of the configuration's
+	// repositories, and Base the packages every build installs. Without an
+	// index, large-dependencies is not checked. The package rules leave
+	// out the packages of Base and of the profile: the user did not list
+	// them.
+	Index *apkindex.Index
+	Base  []string
+}
+
+// Rule is a best-practice check.
+type Rule struct {
+	Name        string
+	Description string
+	check       func(c *config.Config, opts Options) []string
+}
+
+// Finding is a rule a configuration breaks.
+type Finding struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// maxPackages is the size of package set large-package-set warns about.
+const maxPackages = 150
+
+// maxDependencySize is the installed size a package may add to the base
+// system, dependencies included, before large-dependencies warns.
+const maxDependencySize = 100 << 20
+
+// Rules are the rules lint checks, in order.
+var Rules = []Rule{
+	{"weak-root-password", "root has a short or well-known plaintext password", weakRootPassword},
+	{"ssh-password-auth", "the SSH server accepts the passwords of users who have one", sshPasswordAuth},
+	{"no-firewall", "an image serving on the network has no firewall package", noFirewall},
+	{"unpinned-edge", "Alpine edge is used without a lock file", unpinnedEdge},
+	{"large-package-set", fmt.Sprintf("more than %d packages are listed", maxPackages), largePackageSet},
+	{"lighter-alternative", "an Alpine package has a lighter alternative", lighterAlternative},
+	{"large-dependencies", fmt.Sprintf("an Alpine package adds over %d MiB with its dependencies (with -resolve)", maxDependencySize>>20), largeDependencies},
+}
+
+// Run returns the findings of every rule not disabled, by opts or by the
+// lint section of c. Naming an unknown rule is an error.
+func Run(c *config.Config, opts Options) ([]Finding, error) {
+	disabled := slices.Clone(opts.Disable)
+	if c.Lint != nil {
+		disabled = append(disabled, c.Lint.Disable...)
+	}
+	for _, name := range disabled {
+		if !slices.ContainsFunc(Rules, func(r Rule) bool { return r.Name == name }) {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+	}
+	var findings []Finding
+	for _, r := range Rules {
+		if slices.Contains(disabled, r.Name) {
+			continue
+		}
+		for _, msg := range r.check(c, opts) {
+			findings = append(findings, Finding{Rule: r.Name, Message: msg})
+		}
+	}
+	return findings, nil
+}
+
+// commonPasswords are passwords guessed first.
+var commonPasswords = []string{
+	"123456", "12345678", "admin", "alpine", "changeme", "debian", "distrorun",
+	"fedora", "letmein", "linux", "password", "qwerty", "root", "toor",
+}
+
+func weakRootPassword(c *config.Config, _ Options) []string {
+	for _, u := range c.Users {
+		if u.Name != "root" || u.Password == "" {
+			continue
+		}
+		if len(u.Password) < 12 || slices.Contains(commonPasswords, strings.ToLower(u.Password)) {
+			return []string{"root's password is short or well known: use a strong one through password_hash, password_env or password_file, or ssh_authorized_keys only"}
+		}
+	}
+	return nil
+}
+
+// sshServer reports whether the image of c runs an SSH server: Fedora and
+// Debian have one in their base system.
+func sshServer(c *config.Config) bool {
+	if c.Distro.Base == "fedora" || c.Distro.Base == "debian" {
+		return true
+	}
+	if c.Management != nil && c.Management.SSH {
+		return true
+	}
+	if c.Services != nil && slices.ContainsFunc(c.Services.Enable, func(s string) bool { return s == "sshd" || s == "ssh" }) {
+		return true
+	}
+	return slices.ContainsFunc(c.Packages, func(p string) bool { return p == "openssh" || p == "openssh-server" })
+}
+
+func sshPasswordAuth(c *config.Config, _ Options) []string {
+	if !sshServer(c) {
+		return nil
+	}
+	// A drop-in or a replaced sshd_config is taken to set
+	// PasswordAuthentication.
+	for _, f := range c.Files {
+		if f.Path == "/etc/ssh/sshd_config" || strings.HasPrefix(f.Path, "/etc/ssh/sshd_config.d/") {
+			return nil
+		}
+	}
+	var users []string
+	for _, u := range c.Users {
+		if u.HasPassword() {
+			users = append(users, u.Name)
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("the SSH server accepts password logins for users with a password (%s): log in with ssh_authorized_keys and set \"PasswordAuthentication no\" in /etc/ssh/sshd_config.d/ through files", strings.Join(users, ", "))}
+}
+
+// firewallPackages are the firewalls no-firewall knows.
+var firewallPackages = []string{"awall", "firewalld", "iptables", "nftables", "ufw"}
+
+func noFirewall(c *config.Config, _ Options) []string {
+	if c.OutputMode() == "oci" {
+		return nil
+	}
+	server := c.Distro.Type == "server" || (c.Distro.Type == "" && c.Distro.Base != "alpine") ||
+		sshServer(c) || (c.Management != nil && c.Management.WebAdmin)
+	if !server || slices.ContainsFunc(c.Packages, func(p string) bool { return slices.Contains(firewallPackages, p) }) {
+		return nil
+	}
+	return []string{fmt.Sprintf("the image serves on the network without a firewall: add one of %s to packages", strings.Join(firewallPackages, ", "))}
+}
+
+func unpinnedEdge(c *config.Config, opts Options) []string {
+	if opts.Locked || c.Distro.Base != "alpine" {
+		return nil
+	}
+	var edge []string
+	if c.Distro.Version == "edge" {
+		edge = append(edge, "distro.version")
+	}
+	for i, r := range c.Distro.Repositories {
+		if strings.Contains(r.URL, "/edge/") {
+			edge = append(edge, fmt.Sprintf("distro.repositories[%d]", i))
+		}
+	}
+	if len(edge) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("Alpine edge, which changes daily, is used without a lock file (%s): pin the packages with distrorun lock", strings.Join(edge, ", "))}
+}
+
+// listedPackages returns the packages of c the user listed, without those
+// every build or the profile adds.
+func listedPackages(c *config.Config, opts Options) []string {
+	added := c.ProfilePackages()
+	return slices.DeleteFunc(slices.Clone(c.Packages), func(p string) bool {
+		return slices.Contains(opts.Base, p) || slices.Contains(added, p)
+	})
+}
+
+func largePackageSet(c *config.Config, opts Options) []string {
+	n := len(listedPackages(c, opts))
+	if n <= maxPackages {
+		return nil
+	}
+	return []string{fmt.Sprintf("%d packages are listed, over %d: large images build, boot and patch slowly; move optional tools into add-ons", n, maxPackages)}
+}
+
+// alternatives are lighter replacements for Alpine packages that are often
+// listed out of habit. Packages distrorun installs itself, such as bash,
+// curl and vim of the rescue profile or openssh of management.ssh, are
+// not among them.
+var alternatives = map[string]string{
+	"build-base": "compilers rarely belong in an image: build in a hook or another image and install the result",
+	"coreutils":  "busybox provides the common tools already",
+	"gcc":        "compilers rarely belong in an image: build in a hook or another image and install the result",
+	"python3":    "full CPython with its standard library; micropython runs small scripts in a fraction of the size",
+}
+
+// openJDK matches the full Java development kits of Alpine.
+var openJDK = regexp.MustCompile(`^openjdk(\d+)(-jdk)?$`)
+
+func lighterAlternative(c *config.Config, opts Options) []string {
+	if c.Distro.Base != "alpine" {
+		return nil
+	}
+	var msgs []string
+	for _, p := range listedPackages(c, opts) {
+		switch m := openJDK.FindStringSubmatch(p); {
+		case alternatives[p] != "":
+			msgs = append(msgs, fmt.Sprintf("%s: %s", p, alternatives[p]))
+		case m != nil:
+			msgs = append(msgs, fmt.Sprintf("%s: running Java programs only needs openjdk%s-jre-headless", p, m[1]))
+		case strings.HasSuffix(p, "-doc"):
+			msgs = append(msgs, fmt.Sprintf("%s: documentation is rarely read on an image", p))
+		}
+	}
+	return msgs
+}
+
+func largeDependencies(c *config.Config, opts Options) []string {
+	if opts.Index == nil || c.Distro.Base != "alpine" {
+		return nil
+	}
+	base := opts.Index.Closure(opts.Base)
+	var msgs []string
+	for _, p := range listedPackages(c, opts) {
+		added := opts.Index.Closure([]string{p})
+		for name := range base {
+			delete(added, name)
+		}
+		if size := apkindex.Size(added); size > maxDependencySize {
+			msgs = append(msgs, fmt.Sprintf("%s adds %d packages and %d MiB to the base system", p, len(added), size>>20))
+		}
+	}
+	return msgs
+}
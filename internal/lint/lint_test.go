@@ -0,0 +1,108 @@
+package lint
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/apkindex"
+	"github.com/talfaza/distrorun/internal/apkindex/apkindextest"
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+func rules(findings []Finding) []string {
+	var names []string
+	for _, f := range findings {
+		names = append(names, f.Rule)
+	}
+	return names
+}
+
+func TestRun(t *testing.T) {
+	c := &config.Config{
+		Distro:     config.Distro{Base: "alpine", Version: "edge"},
+		Management: &config.Management{SSH: true},
+		Users:      []config.User{{Name: "root", Password: "toor"}},
+		Packages:   make([]string, maxPackages+1),
+	}
+	findings, err := Run(c, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"weak-root-password", "ssh-password-auth", "no-firewall", "unpinned-edge", "large-package-set"}
+	if got := rules(findings); !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+
+	// Fixing the config, locking it and disabling a rule silences them.
+	c.Users = []config.User{{Name: "root", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA"}}}
+	c.Packages = []string{"nftables"}
+	c.Lint = &config.Lint{Disable: []string{"no-firewall"}}
+	if findings, _ := Run(c, Options{Locked: true}); len(findings) != 0 {
+		t.Errorf("unexpected findings: %+v", findings)
+	}
+
+	c.Users = []config.User{{Name: "admin", PasswordHash: "$6$x"}}
+	findings, _ = Run(c, Options{Locked: true})
+	if got := rules(findings); !reflect.DeepEqual(got, []string{"ssh-password-auth"}) || !strings.Contains(findings[0].Message, "(admin)") {
+		t.Errorf("findings = %+v", findings)
+	}
+	c.Files = []config.File{{Path: "/etc/ssh/sshd_config.d/50-keys.conf", Content: "PasswordAuthentication no\n"}}
+	if findings, _ := Run(c, Options{Locked: true}); len(findings) != 0 {
+		t.Errorf("an sshd_config drop-in should silence ssh-password-auth: %+v", findings)
+	}
+
+	if _, err := Run(c, Options{Disable: []string{"no-such-rule"}}); err == nil {
+		t.Error("expected an error for an unknown rule")
+	}
+}
+
+func TestPackageRules(t *testing.T) {
+	c := &config.Config{
+		Distro:   config.Distro{Base: "alpine"},
+		Packages: []string{"coreutils", "openjdk21", "man-pages-doc", "gtk+3.0", "nano"},
+	}
+	findings, err := Run(c, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules(findings); !reflect.DeepEqual(got, []string{"lighter-alternative", "lighter-alternative", "lighter-alternative"}) {
+		t.Fatalf("rules = %q", got)
+	}
+	if !strings.Contains(findings[1].Message, "openjdk21-jre-headless") {
+		t.Errorf("message = %q", findings[1].Message)
+	}
+
+	// gtk+3.0 pulls in 150 MiB, of which musl is in the base system.
+	index := "P:musl\nV:1\nI:1000000\n\nP:gtk+3.0\nV:1\nI:52428800\nD:so:libX11.so.6 musl\n\n" +
+		"P:libx11\nV:1\nI:104857600\nD:musl\np:so:libX11.so.6=6\n\nP:nano\nV:1\nI:1000000\nD:musl\n"
+	ix := apkindex.New()
+	if err := ix.Read(bytes.NewReader(apkindextest.Archive(t, index))); err != nil {
+		t.Fatal(err)
+	}
+	findings, _ = Run(c, Options{Index: ix, Base: []string{"musl"}, Disable: []string{"lighter-alternative"}})
+	if len(findings) != 1 || findings[0].Message != "gtk+3.0 adds 2 packages and 150 MiB to the base system" {
+		t.Errorf("findings = %+v", findings)
+	}
+}
+
+func TestPackageRulesListedOnly(t *testing.T) {
+	// The rescue profile adds curl and vim, and every build bash: none of
+	// them is the user's choice to lint.
+	c := &config.Config{
+		Distro:   config.Distro{Base: "alpine"},
+		Profile:  "rescue",
+		Packages: []string{"bash", "nano"},
+	}
+	c.Packages = append(c.Packages, c.ProfilePackages()...)
+	if findings, _ := Run(c, Options{Base: []string{"bash"}}); len(findings) != 0 {
+		t.Errorf("findings = %+v", findings)
+	}
+
+	// The large-package-set count leaves them out as well.
+	c.Packages = append(c.Packages, make([]string, maxPackages-1)...)
+	if findings, _ := Run(c, Options{Base: []string{"bash"}}); len(findings) != 0 {
+		t.Errorf("findings = %+v", findings)
+	}
+}
@@ -0,0 +1,123 @@
+// Package lockfile reads and writes the lock file of a reproducible build:
+// the exact minirootfs and apk package versions a configuration resolved
+// to, the timestamp every build from it is stamped with, and the distrorun
+// version and built-in templates that wrote it.
+package lockfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is the content of a lock file.
+type File struct {
+	Branch           string            `json:"branch"`            // Alpine release branch, e.g. "v3.20"
+	Minirootfs       string            `json:"minirootfs"`        // minirootfs tarball file name
+	MinirootfsSHA256 string            `json:"minirootfs_sha256"` // checksum of that tarball
+	SourceDateEpoch  int64             `json:"source_date_epoch"` // timestamp of every file in the image
+	Packages         map[string]string `json:"packages"`          // apk package name → version
+	// DistroRun is the version of distrorun that wrote the lock, and
+	// Templates the SHA-256 of each of its built-in templates (the live
+	// init script, isolinux.cfg and so on), which end up in the image as
+	// much as the packages do. Lock files of older versions have neither.
+	DistroRun string            `json:"distrorun,omitempty"`
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// Path returns the lock file path of a configuration: the config path with
+// its extension replaced by ".lock", e.g. "web.yaml" → "web.lock".
+func Path(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".lock"
+}
+
+// Read loads a lock file.
+func Read(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading lock file: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing lock file %s: %w", path, err)
+	}
+	if f.Minirootfs == "" || f.SourceDateEpoch <= 0 || len(f.Packages) == 0 {
+		return nil, fmt.Errorf("lock file %s is incomplete; regenerate it with 'distrorun lock'", path)
+	}
+	return &f, nil
+}
+
+// Write saves the lock file. Packages are written in name order, so
+// regenerating an unchanged lock produces an identical file.
+func (f *File) Write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Diff compares installed packages against the lock and returns one line
+// per difference, in name order.
+func (f *File) Diff(installed map[string]string) []string {
+	var diffs []string
+	for name, v := range installed {
+		switch locked, ok := f.Packages[name]; {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s %s is not in the lock", name, v))
+		case locked != v:
+			diffs = append(diffs, fmt.Sprintf("%s is %s, lock has %s", name, v, locked))
+		}
+	}
+	for name, v := range f.Packages {
+		if _, ok := installed[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s %s is locked but not installed", name, v))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// HashTemplates returns the SHA-256 of each template, by name.
+func HashTemplates(templates map[string]string) map[string]string {
+	sums := make(map[string]string, len(templates))
+	for name, content := range templates {
+		sum := sha256.Sum256([]byte(content))
+		sums[name] = hex.EncodeToString(sum[:])
+	}
+	return sums
+}
+
+// CheckEngine compares the distrorun version and template checksums of
+// the lock against those of the running engine and returns one line per
+// difference, in name order. A lock without an engine version matches any.
+func (f *File) CheckEngine(version string, templates map[string]string) []string {
+	if f.DistroRun == "" {
+		return nil
+	}
+	var diffs []string
+	if f.DistroRun != version {
+		diffs = append(diffs, fmt.Sprintf("locked with distrorun %s, this is %s", f.DistroRun, version))
+	}
+	var changed []string
+	for name, sum := range templates {
+		switch locked, ok := f.Templates[name]; {
+		case !ok:
+			changed = append(changed, fmt.Sprintf("template %s is not in the lock", name))
+		case locked != sum:
+			changed = append(changed, fmt.Sprintf("template %s changed", name))
+		}
+	}
+	for name := range f.Templates {
+		if _, ok := templates[name]; !ok {
+			changed = append(changed, fmt.Sprintf("template %s is locked but no longer exists", name))
+		}
+	}
+	sort.Strings(changed)
+	return append(diffs, changed...)
+}
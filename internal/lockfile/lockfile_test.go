@@ -0,0 +1,87 @@
+package lockfile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	if got := Path("configs/web.yaml"); got != "configs/web.lock" {
+		t.Errorf("Path = %q, want configs/web.lock", got)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.lock")
+	f := &File{
+		Branch:           "v3.20",
+		Minirootfs:       "alpine-minirootfs-3.20.3-x86_64.tar.gz",
+		MinirootfsSHA256: "abc123",
+		SourceDateEpoch:  1700000000,
+		Packages:         map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.1-r29"},
+	}
+	if err := f.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("Read = %+v, want %+v", got, f)
+	}
+
+	// Packages are written in name order.
+	data, _ := os.ReadFile(path)
+	if strings.Index(string(data), "busybox") > strings.Index(string(data), "musl") {
+		t.Errorf("packages not sorted:\n%s", data)
+	}
+
+	os.WriteFile(path, []byte(`{"branch": "v3.20"}`), 0644)
+	if _, err := Read(path); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Errorf("expected incomplete lock error, got: %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	f := &File{Packages: map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.1-r29", "zlib": "1.3.1-r1"}}
+	diffs := f.Diff(map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.1-r30", "curl": "8.9.1-r0"})
+	want := []string{
+		"busybox is 1.36.1-r30, lock has 1.36.1-r29",
+		"curl 8.9.1-r0 is not in the lock",
+		"zlib 1.3.1-r1 is locked but not installed",
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("Diff = %q, want %q", diffs, want)
+	}
+}
+
+func TestCheckEngine(t *testing.T) {
+	templates := map[string]string{"init": "#!/bin/sh\n", "isolinux.cfg": "DEFAULT linux\n", "grub.cfg": "set timeout=5\n"}
+	f := &File{DistroRun: "0.1.0", Templates: HashTemplates(templates)}
+	if diffs := f.CheckEngine("0.1.0", HashTemplates(templates)); len(diffs) != 0 {
+		t.Errorf("CheckEngine = %q, want no differences", diffs)
+	}
+
+	templates["init"] = "#!/bin/sh\nexec /sbin/init\n"
+	delete(templates, "grub.cfg")
+	templates["efi.cfg"] = "search\n"
+	diffs := f.CheckEngine("0.2.0", HashTemplates(templates))
+	want := []string{
+		"locked with distrorun 0.1.0, this is 0.2.0",
+		"template efi.cfg is not in the lock",
+		"template grub.cfg is locked but no longer exists",
+		"template init changed",
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("CheckEngine = %q, want %q", diffs, want)
+	}
+
+	// Lock files written before engine pinning match any engine.
+	if diffs := (&File{}).CheckEngine("0.2.0", HashTemplates(templates)); len(diffs) != 0 {
+		t.Errorf("CheckEngine without a locked version = %q, want none", diffs)
+	}
+}
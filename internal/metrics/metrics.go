@@ -0,0 +1,175 @@
+// Package metrics records build results as Prometheus metrics in the text
+// exposition format, for node_exporter's textfile collector or any other
+// scraper that reads metric files.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// counters are the metrics accumulated across builds; every other metric
+// describes the last build only.
+var counters = map[string]string{
+	"distrorun_builds_total":        "Builds finished, by result.",
+	"distrorun_step_failures_total": "Failed builds, by the step that failed.",
+}
+
+// Recorder collects the results of one build and writes them to a metrics
+// file. Counters already in the file are carried over, so the file keeps
+// build counts and failures across runs.
+type Recorder struct {
+	path   string
+	config string
+	start  time.Time
+	steps  []step
+	failed string
+}
+
+// step is the outcome of one pipeline step.
+type step struct {
+	name    string
+	elapsed time.Duration
+}
+
+// NewRecorder returns a Recorder writing to path when the build ends.
+// config names the configuration being built and labels every metric.
+func NewRecorder(path, config string) *Recorder {
+	return &Recorder{path: path, config: config, start: time.Now()}
+}
+
+// StepEnd records a finished step.
+func (r *Recorder) StepEnd(name, status string, elapsed time.Duration) {
+	name = strings.TrimSuffix(name, "...")
+	r.steps = append(r.steps, step{name, elapsed})
+	if status != "ok" {
+		r.failed = name
+	}
+}
+
+// BuildEnd writes the metrics file. Errors are reported on stderr only: a
+// metrics file must never fail a build.
+func (r *Recorder) BuildEnd(status string, artifacts map[string]string) {
+	if err := r.write(status, artifacts); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: writing metrics: %v\n", err)
+	}
+}
+
+// write renders the metrics and replaces the file atomically, so a scraper
+// never reads a partial file.
+func (r *Recorder) write(status string, artifacts map[string]string) error {
+	totals, err := readCounters(r.path)
+	if err != nil {
+		return err
+	}
+	result, success := "failure", 0
+	if status == "ok" {
+		result, success = "success", 1
+	}
+	totals[fmt.Sprintf("distrorun_builds_total{config=%q,result=%q}", r.config, result)]++
+	if r.failed != "" {
+		totals[fmt.Sprintf("distrorun_step_failures_total{config=%q,step=%q}", r.config, r.failed)]++
+	}
+
+	var b strings.Builder
+	for _, name := range sortedKeys(counters) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, counters[name], name)
+		for _, series := range sortedKeys(totals) {
+			if strings.HasPrefix(series, name+"{") {
+				fmt.Fprintf(&b, "%s %s\n", series, strconv.FormatFloat(totals[series], 'f', -1, 64))
+			}
+		}
+	}
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	gauge("distrorun_last_build_timestamp_seconds", "Unix time the last build finished.")
+	fmt.Fprintf(&b, "distrorun_last_build_timestamp_seconds{config=%q} %d\n", r.config, time.Now().Unix())
+	gauge("distrorun_last_build_success", "Whether the last build succeeded.")
+	fmt.Fprintf(&b, "distrorun_last_build_success{config=%q} %d\n", r.config, success)
+	gauge("distrorun_last_build_duration_seconds", "Duration of the last build.")
+	fmt.Fprintf(&b, "distrorun_last_build_duration_seconds{config=%q} %.3f\n", r.config, time.Since(r.start).Seconds())
+	gauge("distrorun_last_build_step_duration_seconds", "Duration of each step of the last build.")
+	for _, s := range r.steps {
+		fmt.Fprintf(&b, "distrorun_last_build_step_duration_seconds{config=%q,step=%q} %.3f\n", r.config, s.name, s.elapsed.Seconds())
+	}
+	if len(artifacts) > 0 {
+		gauge("distrorun_last_build_artifact_bytes", "Size of each artifact of the last successful build.")
+		for _, kind := range sortedKeys(artifacts) {
+			if size, err := artifactSize(artifacts[kind]); err == nil {
+				fmt.Fprintf(&b, "distrorun_last_build_artifact_bytes{config=%q,artifact=%q} %d\n", r.config, kind, size)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("creating metrics directory: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// readCounters returns the counter series in an existing metrics file.
+func readCounters(path string) (map[string]float64, error) {
+	totals := make(map[string]float64)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return totals, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.LastIndexByte(line, ' ')
+		name, _, _ := strings.Cut(line, "{")
+		if i < 0 || strings.HasPrefix(line, "#") || counters[name] == "" {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			totals[line[:i]] = v
+		}
+	}
+	return totals, sc.Err()
+}
+
+// artifactSize returns the size of a file, or the total size of the files
+// in a directory (netboot layouts).
+func artifactSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
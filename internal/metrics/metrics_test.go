@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "distrorun.prom")
+	iso := filepath.Join(dir, "demo.iso")
+	if err := os.WriteFile(iso, make([]byte, 1234), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRecorder(path, "demo")
+	r.StepEnd("Parsing configuration...", "ok", time.Second)
+	r.StepEnd("Building ISO...", "ok", 2*time.Second)
+	r.BuildEnd("ok", map[string]string{"output": iso})
+
+	r = NewRecorder(path, "demo")
+	r.StepEnd("Installing packages...", "failed", time.Second)
+	r.BuildEnd("failed", nil)
+
+	r = NewRecorder(path, "demo")
+	r.BuildEnd("ok", map[string]string{"output": iso})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		`distrorun_builds_total{config="demo",result="success"} 2`,
+		`distrorun_builds_total{config="demo",result="failure"} 1`,
+		`distrorun_step_failures_total{config="demo",step="Installing packages"} 1`,
+		`distrorun_last_build_success{config="demo"} 1`,
+		`distrorun_last_build_artifact_bytes{config="demo",artifact="output"} 1234`,
+		"# TYPE distrorun_builds_total counter",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `step="Building ISO"`) {
+		t.Errorf("step durations of earlier builds should not be kept:\n%s", out)
+	}
+}
@@ -0,0 +1,207 @@
+// Package netboot lays out kernel, initramfs and squashfs for HTTP network
+// boot and generates the matching iPXE script and an example dnsmasq
+// configuration.
+package netboot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/cpio"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// DefaultBaseURL is used when no base URL is configured: the artifacts are
+// expected to be served over HTTP by the same host that answered PXE.
+const DefaultBaseURL = "http://${next-server}"
+
+// Artifacts are the boot files to publish.
+type Artifacts struct {
+	Kernel    string // path to vmlinuz
+	Initramfs string // path to the live initramfs
+	Squashfs  string // path to rootfs.squashfs
+
+	// Embed appends the squashfs to the initramfs rather than publishing
+	// it: the machine boots without fetching anything but the two boot
+	// files, at the cost of holding the squashfs in memory twice while
+	// the kernel unpacks it.
+	Embed bool
+}
+
+// Build copies the artifacts into outputDir using a content-addressed layout
+// (blobs/<sha256>/<file>) and writes boot.ipxe pointing at them, and
+// dnsmasq.conf.example chaining to boot.ipxe. Because every
+// URL contains the file hash, the layout can be cached forever by HTTP proxies
+// and several builds can share one web root. baseURL is the URL outputDir is
+// served under; it may contain iPXE settings such as ${next-server}. cmdline
+// is appended to the kernel parameters.
+func Build(a Artifacts, outputDir, name, baseURL, cmdline string) error {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	if err := audit.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("creating netboot dir: %w", err)
+	}
+
+	ui.SubStep("Publishing content-addressed boot files...")
+	kernel, err := addBlob(outputDir, a.Kernel, "vmlinuz")
+	if err != nil {
+		return err
+	}
+	var initrd, squashfs string
+	if a.Embed {
+		ui.SubStep("Embedding the squashfs in the initramfs...")
+		embedded := filepath.Join(outputDir, ".initramfs")
+		if err := embed(embedded, a.Initramfs, a.Squashfs); err != nil {
+			audit.Remove(embedded)
+			return fmt.Errorf("embedding the squashfs: %w", err)
+		}
+		initrd, err = addBlob(outputDir, embedded, "initramfs")
+		audit.Remove(embedded)
+	} else {
+		initrd, err = addBlob(outputDir, a.Initramfs, "initramfs")
+		if err == nil {
+			squashfs, err = addBlob(outputDir, a.Squashfs, "rootfs.squashfs")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	script := iPXEScript(name, baseURL, kernel, initrd, squashfs, cmdline)
+	if err := audit.WriteFile(filepath.Join(outputDir, "boot.ipxe"), []byte(script), 0644); err != nil {
+		return fmt.Errorf("writing boot.ipxe: %w", err)
+	}
+	ui.InfoPath("iPXE", filepath.Join(outputDir, "boot.ipxe"))
+
+	conf := dnsmasqConfig(name, baseURL)
+	if err := audit.WriteFile(filepath.Join(outputDir, "dnsmasq.conf.example"), []byte(conf), 0644); err != nil {
+		return fmt.Errorf("writing dnsmasq.conf.example: %w", err)
+	}
+	ui.InfoPath("dnsmasq", filepath.Join(outputDir, "dnsmasq.conf.example"))
+
+	return nil
+}
+
+// iPXEScript renders boot.ipxe. The squashfs URL is passed to the live init
+// on the kernel command line as distrorun.squashfs=<url>; an empty squashfs
+// is embedded in the initramfs and passes none.
+func iPXEScript(name, baseURL, kernel, initrd, squashfs, cmdline string) string {
+	params := "initrd=initramfs"
+	if squashfs != "" {
+		params += " distrorun.squashfs=${base-url}/" + squashfs
+	}
+	return fmt.Sprintf(`#!ipxe
+# %s — generated by DistroRun
+
+set base-url %s
+
+kernel ${base-url}/%s %s %s
+initrd --name initramfs ${base-url}/%s
+boot
+`, name, baseURL, kernel, params, cmdline, initrd)
+}
+
+// dnsmasqConfig renders an example dnsmasq configuration that answers PXE
+// requests: firmware without iPXE is chained to iPXE over TFTP, and iPXE
+// itself is given boot.ipxe. iPXE expands settings such as ${next-server}
+// in the boot file name, so the default base URL works as is.
+func dnsmasqConfig(name, baseURL string) string {
+	return fmt.Sprintf(`# dnsmasq example for network booting %s — generated by DistroRun
+#
+# Serve this directory over HTTP as %s, put
+# undionly.kpxe and ipxe.efi from https://boot.ipxe.org in tftp-root, adjust
+# the DHCP range to the boot network and include this file from
+# /etc/dnsmasq.conf (conf-file=...).
+
+# Hand out addresses; on a network with a DHCP server already, use
+# "dhcp-range=192.168.1.0,proxy" instead to answer PXE requests only.
+dhcp-range=192.168.1.100,192.168.1.200,12h
+
+enable-tftp
+tftp-root=/srv/tftp
+
+# Firmware PXE loads iPXE: legacy BIOS and x86-64 UEFI.
+dhcp-match=set:efi-x86_64,option:client-arch,7
+dhcp-match=set:efi-x86_64,option:client-arch,9
+dhcp-userclass=set:ipxe,iPXE
+dhcp-boot=tag:!ipxe,tag:!efi-x86_64,undionly.kpxe
+dhcp-boot=tag:!ipxe,tag:efi-x86_64,ipxe.efi
+
+# iPXE runs the boot script.
+dhcp-boot=tag:ipxe,%s/boot.ipxe
+`, name, baseURL, baseURL)
+}
+
+// embed writes the initramfs at initramfs to dst with the squashfs appended
+// as /rootfs.squashfs, in a second, uncompressed cpio archive. The kernel
+// unpacks concatenated archives in turn; an uncompressed one must start at
+// a multiple of 4 bytes.
+func embed(dst, initramfs, squashfs string) error {
+	out, err := audit.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	in, err := os.Open(initramfs)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(make([]byte, (4-n%4)%4)); err != nil {
+		return err
+	}
+
+	sq, err := os.Open(squashfs)
+	if err != nil {
+		return err
+	}
+	defer sq.Close()
+	info, err := sq.Stat()
+	if err != nil {
+		return err
+	}
+	w := cpio.NewWriter(out)
+	if err := w.WriteHeader(&cpio.Header{Name: "rootfs.squashfs", Mode: cpio.TypeRegular | 0o644, Nlink: 1, Size: info.Size()}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, sq); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addBlob copies src to outputDir/blobs/<sha256>/<name> and returns the
+// path relative to outputDir.
+func addBlob(outputDir, src, name string) (string, error) {
+	sum, err := fsutil.SHA256File(src)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", src, err)
+	}
+	rel := filepath.ToSlash(filepath.Join("blobs", sum, name))
+	dst := filepath.Join(outputDir, rel)
+
+	if err := audit.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("creating blob dir: %w", err)
+	}
+	if err := fsutil.CopyFile(src, dst); err != nil {
+		return "", fmt.Errorf("copying %s: %w", name, err)
+	}
+	ui.Detail(rel)
+	return rel, nil
+}
@@ -0,0 +1,60 @@
+package netboot
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/cpio"
+)
+
+func TestEmbed(t *testing.T) {
+	dir := t.TempDir()
+	initramfs := filepath.Join(dir, "initramfs")
+	squashfs := filepath.Join(dir, "rootfs.squashfs")
+	if err := os.WriteFile(initramfs, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(squashfs, []byte("hsqs root filesystem"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "embedded")
+	if err := embed(dst, initramfs, squashfs); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second archive starts at the next multiple of 4.
+	if !bytes.HasPrefix(data, []byte("first\x00\x00\x00070701")) {
+		t.Fatalf("embedded initramfs starts with %q", data[:16])
+	}
+	r := cpio.NewReader(bytes.NewReader(data[8:]))
+	h, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(r)
+	if h.Name != "rootfs.squashfs" || h.Mode != cpio.TypeRegular|0o644 || string(body) != "hsqs root filesystem" {
+		t.Errorf("entry %s mode %o = %q", h.Name, h.Mode, body)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected the trailer, got %v", err)
+	}
+}
+
+func TestIPXEScript(t *testing.T) {
+	fetched := iPXEScript("lab", "http://boot", "blobs/a/vmlinuz", "blobs/b/initramfs", "blobs/c/rootfs.squashfs", "quiet")
+	if !strings.Contains(fetched, "kernel ${base-url}/blobs/a/vmlinuz initrd=initramfs distrorun.squashfs=${base-url}/blobs/c/rootfs.squashfs quiet\n") {
+		t.Errorf("script:\n%s", fetched)
+	}
+	embedded := iPXEScript("lab", "http://boot", "blobs/a/vmlinuz", "blobs/b/initramfs", "", "quiet")
+	if !strings.Contains(embedded, "kernel ${base-url}/blobs/a/vmlinuz initrd=initramfs quiet\n") {
+		t.Errorf("script:\n%s", embedded)
+	}
+}
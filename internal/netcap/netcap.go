@@ -0,0 +1,398 @@
+// Package netcap makes the network access of a build reviewable. The
+// package managers and hooks of the build run in a network namespace of
+// their own whose only peer is an HTTP proxy on the host end of a veth
+// pair; the proxy logs every request and, with an allowlist, refuses hosts
+// not on it. A program that ignores the proxy variables gets no network at
+// all rather than an unlogged one. Downloads distrorun makes itself go
+// through the same proxy.
+package netcap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/fetch"
+)
+
+// Entry is one request in the network log. HTTPS requests are tunneled
+// with CONNECT, so only their host and port are known.
+type Entry struct {
+	Time   string `json:"time"` // RFC 3339
+	Method string `json:"method"`
+	URL    string `json:"url"` // "https://host:port" for CONNECT
+	Status int    `json:"status,omitempty"`
+	Bytes  int64  `json:"bytes"` // received from the server
+	Denied bool   `json:"denied,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Capture is the namespace and proxy of a build.
+type Capture struct {
+	ns     string // network namespace, under /run/netns
+	proxy  string // proxy URL, e.g. "http://169.254.12.1:41234"
+	allow  []string
+	srv    *http.Server
+	client *http.Client
+
+	mu       sync.Mutex
+	log      *os.File
+	requests int
+	denied   int
+	hosts    map[string]bool
+}
+
+var (
+	active  *Capture
+	nsenter string
+	unshare string // set by Offline
+
+	// direct is the client of downloads without Start: through the
+	// proxies of the environment, if any.
+	direct = &http.Client{Transport: fetch.Transport(nil)}
+)
+
+// hopHeaders are the headers of one connection, which a proxy drops.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// CheckDeps verifies the host tools the namespace is set up with.
+func CheckDeps() error {
+	for _, tool := range []string{"ip", "nsenter"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("required tool not found: %s, for build.network (install iproute2 and util-linux)", tool)
+		}
+	}
+	return nil
+}
+
+// Start creates the network namespace and the proxy, logging to logPath,
+// and makes Apply and Client use them until Close. With allow, only the
+// hosts it lists (or, for "*.example.com", subdomains of) can be reached.
+func Start(logPath string, allow []string) (*Capture, error) {
+	var err error
+	if nsenter, err = exec.LookPath("nsenter"); err != nil {
+		return nil, err
+	}
+	hostIP, nsIP, err := subnet()
+	if err != nil {
+		return nil, err
+	}
+	pid := os.Getpid()
+	c := &Capture{ns: fmt.Sprintf("distrorun-%d", pid), allow: allow, hosts: map[string]bool{}}
+	hostIf, nsIf := fmt.Sprintf("drh%d", pid), fmt.Sprintf("drn%d", pid)
+	steps := [][]string{
+		{"netns", "add", c.ns},
+		{"link", "add", hostIf, "type", "veth", "peer", "name", nsIf},
+		{"link", "set", nsIf, "netns", c.ns},
+		{"addr", "add", hostIP + "/30", "dev", hostIf},
+		{"link", "set", hostIf, "up"},
+		{"-n", c.ns, "addr", "add", nsIP + "/30", "dev", nsIf},
+		{"-n", c.ns, "link", "set", nsIf, "up"},
+		{"-n", c.ns, "link", "set", "lo", "up"},
+	}
+	for _, args := range steps {
+		if out, err := audit.Command("ip", args...).CombinedOutput(); err != nil {
+			c.removeNamespace()
+			return nil, fmt.Errorf("setting up the build network namespace: ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(hostIP, "0"))
+	if err != nil {
+		c.removeNamespace()
+		return nil, fmt.Errorf("starting the build proxy: %w", err)
+	}
+	if c.log, err = os.Create(logPath); err != nil {
+		ln.Close()
+		c.removeNamespace()
+		return nil, fmt.Errorf("creating network log: %w", err)
+	}
+	c.proxy = "http://" + ln.Addr().String()
+	proxyURL, _ := url.Parse(c.proxy)
+	c.client = &http.Client{Transport: fetch.Transport(&http.Transport{Proxy: http.ProxyURL(proxyURL)})}
+	c.srv = &http.Server{Handler: c}
+	go c.srv.Serve(ln)
+	active = c
+	return c, nil
+}
+
+// subnet picks a /30 of 169.254.0.0/16 that no interface of the host
+// uses, starting from one derived from the process ID so concurrent builds
+// start apart, and returns the addresses of its host and namespace ends.
+// 169.254.169.0/24, home of cloud metadata services, is left alone.
+func subnet() (hostIP, nsIP string, err error) {
+	used := map[string]bool{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			used[n.IP.Mask(net.CIDRMask(30, 32)).String()] = true
+		}
+	}
+	const subnets = 1 << 14 // /30s in a /16
+	for i := range subnets {
+		n := (os.Getpid() + i) % subnets
+		third, fourth := byte(n>>6), byte(n&63)<<2
+		if third == 0 || third == 169 || third == 255 {
+			continue
+		}
+		if !used[net.IPv4(169, 254, third, fourth).String()] {
+			return net.IPv4(169, 254, third, fourth+1).String(), net.IPv4(169, 254, third, fourth+2).String(), nil
+		}
+	}
+	return "", "", errors.New("no free link-local subnet for the build network namespace")
+}
+
+// removeNamespace deletes the namespace, which takes the veth pair along.
+func (c *Capture) removeNamespace() error {
+	if out, err := audit.Command("ip", "netns", "del", c.ns).CombinedOutput(); err != nil {
+		return fmt.Errorf("removing network namespace %s: %w: %s", c.ns, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Close stops the proxy, removes the namespace and closes the log. Safe
+// to call more than once.
+func (c *Capture) Close() error {
+	if active != c {
+		return nil
+	}
+	active = nil
+	c.srv.Close()
+	err := c.removeNamespace()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return errors.Join(err, c.log.Close())
+}
+
+// Summary returns the number of requests made, how many of them were
+// refused, and the hosts requested, sorted.
+func (c *Capture) Summary() (requests, denied int, hosts []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests, c.denied, slices.Sorted(maps.Keys(c.hosts))
+}
+
+// Offline cuts the build off the network instead: from now on, Apply
+// runs commands in a network namespace of their own without interfaces,
+// and the requests of Client fail.
+func Offline() error {
+	var err error
+	if unshare, err = exec.LookPath("unshare"); err != nil {
+		return fmt.Errorf("required tool not found: unshare, for build -offline (install util-linux)")
+	}
+	fetch.Offline = true
+	return nil
+}
+
+// Apply makes cmd run in the namespace of Start, with the proxy in its
+// environment, or in an empty one after Offline, and returns it; without
+// either cmd is returned unchanged.
+func Apply(cmd *audit.Cmd) *audit.Cmd {
+	if unshare != "" {
+		cmd.Args = append([]string{"unshare", "--net", "--"}, cmd.Args...)
+		cmd.Path = unshare
+		return cmd
+	}
+	if active == nil {
+		return cmd
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env,
+		"http_proxy="+active.proxy, "https_proxy="+active.proxy,
+		"HTTP_PROXY="+active.proxy, "HTTPS_PROXY="+active.proxy,
+		"no_proxy=", "NO_PROXY=")
+	cmd.Args = append([]string{"nsenter", "--net=/run/netns/" + active.ns, "--"}, cmd.Args...)
+	cmd.Path = nsenter
+	return cmd
+}
+
+// Client returns the HTTP client for downloads of the build: through the
+// proxy of Start, or the proxies of the environment without it. Failed
+// requests are retried and broken downloads resumed (see package fetch);
+// after Offline, all of them fail.
+func Client() *http.Client {
+	if active == nil {
+		return direct
+	}
+	return active.client
+}
+
+// allowed reports whether the allowlist lets the build reach host.
+func (c *Capture) allowed(host string) bool {
+	if len(c.allow) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range c.allow {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP proxies one request: plain HTTP is forwarded, HTTPS tunneled.
+func (c *Capture) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e := Entry{Time: time.Now().UTC().Format(time.RFC3339), Method: req.Method}
+	host := req.URL.Hostname()
+	if req.Method == http.MethodConnect {
+		e.URL = "https://" + req.Host
+		if host, _, _ = net.SplitHostPort(req.Host); host == "" {
+			host = req.Host
+		}
+	} else {
+		e.URL = req.URL.String()
+		if !req.URL.IsAbs() {
+			http.Error(w, "distrorun: not a proxy request", http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case !c.allowed(host):
+		e.Denied, e.Status = true, http.StatusForbidden
+		http.Error(w, fmt.Sprintf("distrorun: %s is not in build.network.allow", host), http.StatusForbidden)
+	case req.Method == http.MethodConnect:
+		c.tunnel(w, req, &e)
+	default:
+		c.forward(w, req, &e)
+	}
+	c.record(e, host)
+}
+
+// forward sends a plain HTTP request on to its server.
+func (c *Capture) forward(w http.ResponseWriter, req *http.Request, e *Entry) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		e.Status, e.Error = http.StatusBadGateway, err.Error()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	maps.Copy(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	e.Status = resp.StatusCode
+	e.Bytes, err = io.Copy(w, resp.Body)
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// tunnel connects the client of a CONNECT request to its server.
+func (c *Capture) tunnel(w http.ResponseWriter, req *http.Request, e *Entry) {
+	server, err := dialTunnel(req.Host)
+	if err != nil {
+		e.Status, e.Error = http.StatusBadGateway, err.Error()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer server.Close()
+	client, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		e.Status, e.Error = http.StatusInternalServerError, err.Error()
+		return
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		e.Error = err.Error()
+		return
+	}
+	e.Status = http.StatusOK
+	sent := make(chan struct{})
+	go func() {
+		io.Copy(server, buf)
+		if tcp, ok := server.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(sent)
+	}()
+	e.Bytes, _ = io.Copy(client, server)
+	client.Close()
+	<-sent
+}
+
+// dialTunnel connects to host, through the HTTPS proxy of the
+// environment when it names one for host.
+func dialTunnel(host string) (net.Conn, error) {
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: host}})
+	if err != nil || proxy == nil {
+		return net.DialTimeout("tcp", host, 30*time.Second)
+	}
+	proxyHost := proxy.Host
+	if proxy.Port() == "" {
+		proxyHost = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", proxyHost, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+	}
+	connect := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: host}, Host: host, Header: http.Header{}}
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		connect.SetBasicAuth(u.Username(), pass)
+		connect.Header["Proxy-Authorization"] = connect.Header["Authorization"]
+		delete(connect.Header, "Authorization")
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	br := bufio.NewReader(conn)
+	if err := connect.Write(conn); err == nil {
+		var resp *http.Response
+		if resp, err = http.ReadResponse(br, connect); err == nil && resp.StatusCode != http.StatusOK {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %w", proxy.Redacted(), host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: data after CONNECT response", proxy.Redacted())
+	}
+	return conn, nil
+}
+
+// record appends e to the log and counts it.
+func (c *Capture) record(e Entry, host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if e.Denied {
+		c.denied++
+	}
+	c.hosts[host] = true
+	data, _ := json.Marshal(e)
+	c.log.Write(append(data, '\n'))
+}
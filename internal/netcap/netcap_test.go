@@ -0,0 +1,103 @@
+package netcap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	c := &Capture{allow: []string{"dl-cdn.alpinelinux.org", "*.debian.org"}}
+	for host, want := range map[string]bool{
+		"dl-cdn.alpinelinux.org":  true,
+		"DL-CDN.alpinelinux.org.": true,
+		"deb.debian.org":          true,
+		"security.debian.org":     true,
+		"debian.org":              false,
+		"notdebian.org":           false,
+		"alpinelinux.org":         false,
+	} {
+		if got := c.allowed(host); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if !(&Capture{}).allowed("example.com") {
+		t.Error("an empty allowlist should allow every host")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "index")
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	logPath := filepath.Join(t.TempDir(), "network.jsonl")
+	log, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Capture{allow: []string{serverURL.Hostname()}, log: log, hosts: map[string]bool{}}
+	proxy := httptest.NewServer(c)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(server.URL + "/APKINDEX.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "index" {
+		t.Errorf("forwarded request = %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = client.Get("http://mirror.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request to a host not allowed = %d, want 403", resp.StatusCode)
+	}
+	log.Close()
+
+	requests, denied, hosts := c.Summary()
+	if requests != 2 || denied != 1 || !slices.Equal(hosts, []string{serverURL.Hostname(), "mirror.example.com"}) {
+		t.Errorf("Summary = %d, %d, %q", requests, denied, hosts)
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Method != "GET" || !strings.HasSuffix(e.URL, "/APKINDEX.tar.gz") || e.Status != 200 || e.Bytes != 5 || e.Denied {
+		t.Errorf("forwarded entry = %+v", e)
+	}
+	if e := entries[1]; !e.Denied || e.Status != http.StatusForbidden || e.URL != "http://mirror.example.com/" {
+		t.Errorf("denied entry = %+v", e)
+	}
+}
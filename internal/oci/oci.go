@@ -0,0 +1,241 @@
+// Package oci packages a rootfs as a single-layer OCI image archive and
+// pushes it to a container registry.
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/compress"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// Media types of the OCI image spec.
+const (
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+" // and the compression
+)
+
+// descriptor references a blob by digest.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// imageConfig is the OCI image configuration.
+type imageConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Env []string `json:"Env"`
+		Cmd []string `json:"Cmd"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []history `json:"history"`
+}
+
+// history describes how a layer was created.
+type history struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+// CheckPushDeps verifies that skopeo, which pushes images, is installed.
+func CheckPushDeps() error {
+	if _, err := exec.LookPath("skopeo"); err != nil {
+		return fmt.Errorf("skopeo not found (needed for build.push)")
+	}
+	return nil
+}
+
+// Build writes rootfsPath as an OCI image archive (an OCI image layout in a
+// tar file) at outputPath, tagged as ref, e.g. "registry.example.com/os:1.0".
+// The layer is compressed with compression, "gzip" or "zstd". The archive
+// can be loaded with "docker load" or "podman load".
+func Build(ctx context.Context, rootfsPath, outputPath, ref, compression string) error {
+	layoutDir, err := audit.MkdirTemp(filepath.Dir(outputPath), ".oci-")
+	if err != nil {
+		return fmt.Errorf("creating layout directory: %w", err)
+	}
+	defer audit.RemoveAll(layoutDir)
+	blobs := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := audit.MkdirAll(blobs, 0755); err != nil {
+		return fmt.Errorf("creating layout directory: %w", err)
+	}
+
+	ui.SubStep("Creating image layer...")
+	layerTar := filepath.Join(layoutDir, "layer.tar")
+	cmd := audit.CommandContext(ctx, "tar", "--numeric-owner", "--xattrs", "--xattrs-include=*", "-C", rootfsPath, "-cf", layerTar, ".")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("creating layer: %w", err)
+	}
+	diffID, layer, err := compressLayer(layerTar, blobs, compression)
+	if err != nil {
+		return err
+	}
+	audit.Remove(layerTar)
+	ui.Detail(fmt.Sprintf("Layer %s (%.1f MB)", layer.Digest[:19], float64(layer.Size)/1024/1024))
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var cfg imageConfig
+	cfg.Created = now
+	cfg.Architecture = runtime.GOARCH
+	cfg.OS = "linux"
+	cfg.Config.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	cfg.Config.Cmd = []string{"/bin/sh"}
+	cfg.RootFS.Type = "layers"
+	cfg.RootFS.DiffIDs = []string{diffID}
+	cfg.History = []history{{Created: now, CreatedBy: "distrorun"}}
+	config, err := writeBlob(blobs, mediaTypeConfig, cfg)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := writeBlob(blobs, mediaTypeManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeManifest,
+		"config":        config,
+		"layers":        []descriptor{layer},
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": tag(ref),
+		"io.containerd.image.name":          ref,
+	}
+
+	index := map[string]any{
+		"schemaVersion": 2,
+		"manifests":     []descriptor{manifest},
+	}
+	if err := writeJSON(filepath.Join(layoutDir, "index.json"), index); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(layoutDir, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return err
+	}
+
+	ui.SubStep("Writing image archive...")
+	cmd = audit.CommandContext(ctx, "tar", "-C", layoutDir, "-cf", outputPath, "oci-layout", "index.json", "blobs")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("writing image archive: %w", err)
+	}
+	ui.Detail("Image " + ref)
+	return nil
+}
+
+// Push copies the image archive to the registry as ref. Registry credentials
+// come from skopeo's usual auth file (see "skopeo login").
+func Push(ctx context.Context, archivePath, ref string) error {
+	ui.SubStep("Pushing " + ref + "...")
+	cmd := audit.CommandContext(ctx, "skopeo", "copy", "oci-archive:"+archivePath, "docker://"+ref)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pushing %s: %w", ref, err)
+	}
+	return nil
+}
+
+// compressLayer compresses the layer tarball into the blob directory. It
+// returns the diff ID (digest of the uncompressed tar) and the layer
+// descriptor.
+func compressLayer(tarPath, blobs, compression string) (string, descriptor, error) {
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return "", descriptor{}, fmt.Errorf("opening layer: %w", err)
+	}
+	defer in.Close()
+	tmp, err := audit.CreateTemp(blobs, ".layer-")
+	if err != nil {
+		return "", descriptor{}, fmt.Errorf("creating layer blob: %w", err)
+	}
+	defer tmp.Close()
+
+	rawHash, gzHash := sha256.New(), sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, gzHash)}
+	gz, err := compress.NewWriter(counter, compression)
+	if err != nil {
+		return "", descriptor{}, err
+	}
+	if _, err := io.Copy(gz, io.TeeReader(in, rawHash)); err != nil {
+		return "", descriptor{}, fmt.Errorf("compressing layer: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", descriptor{}, fmt.Errorf("compressing layer: %w", err)
+	}
+
+	digest := "sha256:" + hex.EncodeToString(gzHash.Sum(nil))
+	if err := audit.Rename(tmp.Name(), filepath.Join(blobs, strings.TrimPrefix(digest, "sha256:"))); err != nil {
+		return "", descriptor{}, fmt.Errorf("storing layer blob: %w", err)
+	}
+	return "sha256:" + hex.EncodeToString(rawHash.Sum(nil)), descriptor{MediaType: mediaTypeLayer + compression, Digest: digest, Size: counter.n}, nil
+}
+
+// writeBlob stores v as a JSON blob and returns its descriptor.
+func writeBlob(blobs, mediaType string, v any) (descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("marshaling %s: %w", mediaType, err)
+	}
+	sum := sha256.Sum256(data)
+	hexSum := hex.EncodeToString(sum[:])
+	if err := audit.WriteFile(filepath.Join(blobs, hexSum), data, 0644); err != nil {
+		return descriptor{}, fmt.Errorf("writing blob: %w", err)
+	}
+	return descriptor{MediaType: mediaType, Digest: "sha256:" + hexSum, Size: int64(len(data))}, nil
+}
+
+// writeJSON writes v as JSON to path.
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshaling %s: %w", filepath.Base(path), err)
+	}
+	if err := audit.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// tag returns the tag of an image reference, or "latest" if it has none.
+func tag(ref string) string {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return "latest" // no tag; the colon belongs to a registry port
+	}
+	return ref[i+1:]
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
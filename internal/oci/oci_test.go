@@ -0,0 +1,93 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "os-release"), []byte("NAME=test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			testBuild(t, root, compression)
+		})
+	}
+}
+
+func testBuild(t *testing.T, root, compression string) {
+	out := filepath.Join(t.TempDir(), "test-oci.tar")
+	if err := Build(context.Background(), root, out, "registry.example.com:5000/team/test:1.0", compression); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	layout := t.TempDir()
+	if err := exec.Command("tar", "-xf", out, "-C", layout).Run(); err != nil {
+		t.Fatalf("extracting archive: %v", err)
+	}
+	var index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations["org.opencontainers.image.ref.name"] != "1.0" {
+		t.Fatalf("unexpected index: %s", data)
+	}
+
+	// Every referenced blob must exist with the recorded digest.
+	var manifest struct {
+		Config descriptor   `json:"config"`
+		Layers []descriptor `json:"layers"`
+	}
+	json.Unmarshal(readBlob(t, layout, index.Manifests[0]), &manifest)
+	readBlob(t, layout, manifest.Config)
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected one layer, got %d", len(manifest.Layers))
+	}
+	readBlob(t, layout, manifest.Layers[0])
+	if want := "application/vnd.oci.image.layer.v1.tar+" + compression; manifest.Layers[0].MediaType != want {
+		t.Errorf("layer media type %q, want %q", manifest.Layers[0].MediaType, want)
+	}
+}
+
+func readBlob(t *testing.T, layout string, d descriptor) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(layout, "blobs", "sha256", d.Digest[len("sha256:"):]))
+	if err != nil {
+		t.Fatalf("blob %s: %v", d.Digest, err)
+	}
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != d.Digest || int64(len(data)) != d.Size {
+		t.Fatalf("blob %s does not match its descriptor", d.Digest)
+	}
+	return data
+}
+
+func TestTag(t *testing.T) {
+	for ref, want := range map[string]string{
+		"os:1.0":                       "1.0",
+		"os":                           "latest",
+		"registry.example.com:5000/os": "latest",
+	} {
+		if got := tag(ref); got != want {
+			t.Errorf("tag(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package policy checks the assertions of a configuration — required and
+// forbidden files, installed package versions, a size limit — against a
+// finished root filesystem.
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/vulnscan"
+)
+
+// Check returns one message per assertion the root filesystem at
+// rootfsPath fails; none means the image is acceptable. Errors are
+// reserved for a rootfs that cannot be read.
+func Check(rootfsPath string, a config.Assertions) ([]string, error) {
+	var failures []string
+	for _, p := range a.RequireFiles {
+		matches, err := glob(rootfsPath, p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			failures = append(failures, fmt.Sprintf("required file %s is missing", p))
+		}
+	}
+	for _, p := range a.ForbidFiles {
+		matches, err := glob(rootfsPath, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			failures = append(failures, fmt.Sprintf("forbidden file %s is present (matches %s)", m, p))
+		}
+	}
+
+	if len(a.Packages) > 0 {
+		installed, err := installedPackages(rootfsPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range a.Packages {
+			v, ok := installed[p.Name]
+			switch {
+			case !ok:
+				failures = append(failures, fmt.Sprintf("package %s is not installed", p.Name))
+			case p.Version != "" && !satisfies(v, p):
+				failures = append(failures, fmt.Sprintf("package %s is at version %s, not %s", p.Name, v, p.Version))
+			}
+		}
+	}
+
+	if a.MaxSize != "" {
+		limit, err := config.ParseSize(a.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		size, err := treeSize(rootfsPath)
+		if err != nil {
+			return nil, err
+		}
+		if size > limit {
+			failures = append(failures, fmt.Sprintf("rootfs is %.1f MiB, over max_size %s", float64(size)/(1<<20), a.MaxSize))
+		}
+	}
+	return failures, nil
+}
+
+// glob returns the image paths matching the absolute pattern inside the
+// rootfs.
+func glob(rootfsPath, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(rootfsPath, pattern))
+	if err != nil {
+		return nil, fmt.Errorf("pattern %s: %w", pattern, err)
+	}
+	for i, m := range matches {
+		rel, _ := filepath.Rel(rootfsPath, m)
+		matches[i] = "/" + rel
+	}
+	return matches, nil
+}
+
+// satisfies reports whether the installed version meets the constraint of
+// p. A constraint without a release ("3.3" rather than "3.3.2-r0") or an
+// epoch is compared with the upstream version only, so ">=3.3" holds for
+// Alpine's 3.3.2-r0, Debian's 1:3.3.2-1 and Fedora's 3.3.2-1.fc40 alike.
+func satisfies(installed string, p config.PackageAssertion) bool {
+	op, want := p.VersionConstraint()
+	if !strings.Contains(want, ":") {
+		if _, v, ok := strings.Cut(installed, ":"); ok {
+			installed = v
+		}
+	}
+	if !strings.Contains(want, "-") {
+		if i := strings.LastIndex(installed, "-"); i > 0 {
+			installed = installed[:i]
+		}
+	}
+	c := vulnscan.CompareVersions(installed, want)
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return c == 0
+}
+
+// installedPackages returns the version of every package installed in the
+// rootfs, from the apk or dpkg database or, on Fedora, the host's rpm.
+func installedPackages(rootfsPath string) (map[string]string, error) {
+	if _, err := os.Stat(filepath.Join(rootfsPath, "lib", "apk", "db", "installed")); err == nil {
+		return readDatabase(filepath.Join(rootfsPath, "lib", "apk", "db", "installed"), "P:", "V:", "")
+	}
+	if _, err := os.Stat(filepath.Join(rootfsPath, "var", "lib", "dpkg", "status")); err == nil {
+		return readDatabase(filepath.Join(rootfsPath, "var", "lib", "dpkg", "status"), "Package: ", "Version: ", "Status: ")
+	}
+	out, err := exec.Command("rpm", "--root", rootfsPath, "-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing installed packages: no apk or dpkg database, and rpm failed: %w", err)
+	}
+	pkgs := make(map[string]string)
+	for line := range strings.SplitSeq(strings.TrimSpace(string(out)), "\n") {
+		if name, version, ok := strings.Cut(line, "\t"); ok {
+			pkgs[name] = version
+		}
+	}
+	return pkgs, nil
+}
+
+// readDatabase parses a package database of blank-line separated stanzas
+// with the name and version on lines starting with nameKey and versionKey.
+// With statusKey, only packages whose status ends in "installed" count, as
+// dpkg keeps removed packages in its status file.
+func readDatabase(path, nameKey, versionKey, statusKey string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading package database: %w", err)
+	}
+	defer f.Close()
+
+	pkgs := make(map[string]string)
+	var name, version string
+	installed := statusKey == ""
+	flush := func() {
+		if name != "" && installed {
+			pkgs[name] = version
+		}
+		name, version, installed = "", "", statusKey == ""
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, nameKey):
+			name = strings.TrimPrefix(line, nameKey)
+		case strings.HasPrefix(line, versionKey):
+			version = strings.TrimPrefix(line, versionKey)
+		case statusKey != "" && strings.HasPrefix(line, statusKey):
+			installed = strings.HasSuffix(line, " installed")
+		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading package database: %w", err)
+	}
+	return pkgs, nil
+}
+
+// treeSize returns the bytes used by the files below root, counting hard
+// links once.
+func treeSize(root string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !d.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measuring rootfs: %w", err)
+	}
+	return size, nil
+}
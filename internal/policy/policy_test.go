@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+// testRootfs returns an Alpine-like rootfs with a busybox, an SSH key and
+// an apk database.
+func testRootfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"bin/busybox":          "#!busybox",
+		"root/.ssh/id_ed25519": "key",
+		"lib/apk/db/installed": "P:busybox\nV:1.36.1-r29\n\nP:libcrypto3\nV:3.3.2-r0\n\n",
+	} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestCheck(t *testing.T) {
+	root := testRootfs(t)
+
+	failures, err := Check(root, config.Assertions{
+		RequireFiles: []string{"/bin/busybox", "/etc/ssh/sshd_config"},
+		ForbidFiles:  []string{"/root/.ssh/id_*", "/usr/bin/gcc"},
+		Packages: []config.PackageAssertion{
+			{Name: "busybox", Version: "1.36.1-r29"},
+			{Name: "libcrypto3", Version: ">=3.3"},
+			{Name: "libcrypto3", Version: "<3.3.2"},
+			{Name: "openssh"},
+		},
+		MaxSize: "1M",
+	})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	want := []string{
+		"required file /etc/ssh/sshd_config is missing",
+		"forbidden file /root/.ssh/id_ed25519 is present (matches /root/.ssh/id_*)",
+		"package libcrypto3 is at version 3.3.2-r0, not <3.3.2",
+		"package openssh is not installed",
+	}
+	if !slices.Equal(failures, want) {
+		t.Errorf("failures = %q\nwant %q", failures, want)
+	}
+
+	failures, err = Check(root, config.Assertions{MaxSize: "100"})
+	if err != nil || len(failures) != 1 {
+		t.Errorf("a rootfs over max_size should fail, got %q, %v", failures, err)
+	}
+}
+
+func TestSatisfiesDpkgAndRpmVersions(t *testing.T) {
+	for _, tt := range []struct {
+		installed, constraint string
+		want                  bool
+	}{
+		{"1:3.0.11-1~deb12u2", ">=3.0", true},
+		{"1:3.0.11-1~deb12u2", "3.0.11", true},
+		{"3.2.1-1.fc40", "<3.2", false},
+		{"3.2.1-1.fc40", "3.2.1-1.fc40", true},
+	} {
+		p := config.PackageAssertion{Name: "openssl", Version: tt.constraint}
+		if got := satisfies(tt.installed, p); got != tt.want {
+			t.Errorf("satisfies(%q, %q) = %v, want %v", tt.installed, tt.constraint, got, tt.want)
+		}
+	}
+}
+
+func TestReadDatabaseDpkgStatus(t *testing.T) {
+	status := filepath.Join(t.TempDir(), "status")
+	content := "Package: openssl\nStatus: install ok installed\nVersion: 3.0.11-1\n\n" +
+		"Package: telnet\nStatus: deinstall ok config-files\nVersion: 0.17-44\n"
+	if err := os.WriteFile(status, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := readDatabase(status, "Package: ", "Version: ", "Status: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs["openssl"] != "3.0.11-1" {
+		t.Errorf("unexpected packages: %v", pkgs)
+	}
+}
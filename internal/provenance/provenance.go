@@ -0,0 +1,173 @@
+// Package provenance records the bill of tooling of a build: the host
+// programs it ran with their versions and checksums, the host files it put
+// into the image, the kernel of the build host, and the optional features
+// skipped for lack of host support. Two builds of the same config and lock
+// on different machines differ only through these, so the record is what
+// explains artifacts that differ.
+package provenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// Provenance is the bill of tooling of one build.
+type Provenance struct {
+	Distrorun string `json:"distrorun"` // version
+	Host      Host   `json:"host"`
+	Tools     []Tool `json:"tools"`
+	Files     []File `json:"files,omitempty"`
+
+	// ImageVersion is the image_version of the config built, which the
+	// artifact keeps when it is promoted after the config moved on.
+	ImageVersion string `json:"image_version"`
+
+	// Degradations are the optional features the build skipped because
+	// the host lacked what they need.
+	Degradations []ui.Degradation `json:"degradations,omitempty"`
+}
+
+// Host describes the build host.
+type Host struct {
+	Kernel string `json:"kernel"`          // release, e.g. "6.8.0-45-generic"
+	Build  string `json:"build,omitempty"` // e.g. "#45-Ubuntu SMP PREEMPT_DYNAMIC ..."
+	Arch   string `json:"arch"`            // GOARCH
+}
+
+// Tool is a host program the build ran.
+type Tool struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"` // first line of its version output
+	SHA256  string `json:"sha256"`
+}
+
+// File is a host file the build put into the image.
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// versionFlags are the flags the known tools print their version with.
+// Other tools are identified by their checksum alone: running an unknown
+// program with a guessed flag could do anything.
+var versionFlags = map[string]string{
+	"apk":           "--version",
+	"blkid":         "--version",
+	"chcon":         "--version",
+	"chroot":        "--version",
+	"cp":            "--version",
+	"debootstrap":   "--version",
+	"dnf":           "--version",
+	"grub-mkimage":  "--version",
+	"grub2-mkimage": "--version",
+	"ip":            "-V",
+	"losetup":       "--version",
+	"mcopy":         "--version",
+	"mkfs.ext4":     "-V",
+	"mksquashfs":    "-version",
+	"mmd":           "--version",
+	"mount":         "--version",
+	"nsenter":       "--version",
+	"rpm":           "--version",
+	"setpriv":       "--version",
+	"sfdisk":        "--version",
+	"skopeo":        "--version",
+	"tar":           "--version",
+	"umount":        "--version",
+	"unshare":       "--version",
+	"xorriso":       "-version",
+}
+
+// Collect returns the provenance of a build by distrorun version that ran
+// the programs tools and put the host files files into its image, all
+// absolute paths.
+func Collect(version string, tools, files []string) (*Provenance, error) {
+	p := &Provenance{Distrorun: version, Host: host()}
+	for _, path := range tools {
+		sum, err := fsutil.SHA256File(path)
+		if err != nil {
+			return nil, fmt.Errorf("hashing %s: %w", path, err)
+		}
+		name := filepath.Base(path)
+		p.Tools = append(p.Tools, Tool{Name: name, Path: path, Version: toolVersion(path, name), SHA256: sum})
+	}
+	seen := map[string]bool{}
+	for _, path := range files {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		sum, err := fsutil.SHA256File(path)
+		if err != nil {
+			return nil, fmt.Errorf("hashing %s: %w", path, err)
+		}
+		p.Files = append(p.Files, File{Path: path, SHA256: sum})
+	}
+	return p, nil
+}
+
+// host returns the kernel and architecture of the build host.
+func host() Host {
+	h := Host{Arch: runtime.GOARCH}
+	if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		h.Kernel = strings.TrimSpace(string(data))
+	}
+	if data, err := os.ReadFile("/proc/sys/kernel/version"); err == nil {
+		h.Build = strings.TrimSpace(string(data))
+	}
+	return h
+}
+
+// toolVersion returns the first line the tool at path prints with its
+// version flag, or "" for tools without a known one.
+func toolVersion(path, name string) string {
+	flag, ok := versionFlags[name]
+	if !ok {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, path, flag).CombinedOutput()
+	for line := range strings.Lines(string(out)) {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// Write writes p to path as indented JSON.
+func (p *Provenance) Write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing provenance: %w", err)
+	}
+	return nil
+}
+
+// Read reads the provenance written to path by Write.
+func Read(path string) (*Provenance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading provenance: %w", err)
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing provenance %s: %w", path, err)
+	}
+	return &p, nil
+}
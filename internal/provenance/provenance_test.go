@@ -0,0 +1,62 @@
+package provenance
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCollect(t *testing.T) {
+	tar, err := exec.LookPath("tar")
+	if err != nil {
+		t.Skip("tar not found")
+	}
+	file := filepath.Join(t.TempDir(), "isolinux.bin")
+	os.WriteFile(file, []byte("boot"), 0644)
+
+	p, err := Collect("0.1.0", []string{tar}, []string{file, file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Distrorun != "0.1.0" || p.Host.Arch == "" {
+		t.Errorf("unexpected provenance: %+v", p)
+	}
+	if len(p.Tools) != 1 || p.Tools[0].Name != "tar" || len(p.Tools[0].SHA256) != 64 || !strings.Contains(p.Tools[0].Version, "tar") {
+		t.Errorf("Tools = %+v", p.Tools)
+	}
+	// sha256 of "boot"
+	want := []File{{Path: file, SHA256: "4509beb0ab401d71fa4a5cd94a55c9a74f13332776ae4019c5bfc4c2005157ff"}}
+	if !reflect.DeepEqual(p.Files, want) {
+		t.Errorf("Files = %+v, want %+v", p.Files, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "provenance.json")
+	if err := p.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("Read = %+v, want %+v", got, p)
+	}
+}
+
+func TestCollectUnknownTool(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "helper")
+	os.WriteFile(script, []byte("#!/bin/sh\necho ran >&2\nexit 1\n"), 0755)
+	p, err := Collect("0.1.0", []string{script}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Tools[0].Version != "" {
+		t.Errorf("a tool without a known version flag should not be run, got version %q", p.Tools[0].Version)
+	}
+	if _, err := Collect("0.1.0", []string{filepath.Join(t.TempDir(), "missing")}, nil); err == nil {
+		t.Error("expected an error for a missing tool")
+	}
+}
@@ -0,0 +1,222 @@
+// Package prune applies retention policies to build output and cache directories.
+package prune
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PinSuffix marks an artifact as pinned: "<artifact><PinSuffix>" next to it
+// protects the artifact from pruning. Its content is a free-form tag.
+const PinSuffix = ".pin"
+
+// sidecarSuffixes are files that belong to the artifact named by the rest
+// of their file name and are kept or removed together with it.
+var sidecarSuffixes = []string{PinSuffix, ".sha256", "-sbom.spdx.json"}
+
+// artifactExts are the extensions of the artifacts a build writes: ISOs,
+// raw and qcow2 disk images, OCI archives, bundles and initramfs images.
+var artifactExts = []string{".iso", ".img", ".qcow2", ".tar", ".tar.gz", ".cpio.gz"}
+
+// buildSidecars are the files a build writes next to its artifact, named
+// after it without its extension.
+var buildSidecars = []string{"-sbom.spdx.json", "-provenance.json", "-audit.jsonl", "-network.jsonl", "-vulns.json", "-console.log", "-seed.iso"}
+
+// netbootSuffix names the directory a netboot build writes.
+const netbootSuffix = "-netboot"
+
+// Policy decides which artifacts to keep. An artifact is kept if any rule
+// matches: it is among the KeepLast newest, younger than MaxAge, pinned by a
+// sidecar file, or its name matches one of the Pins glob patterns.
+type Policy struct {
+	KeepLast int
+	MaxAge   time.Duration
+	Pins     []string
+}
+
+// Group is one artifact together with its sidecar files.
+type Group struct {
+	Name    string    // artifact name without sidecar suffixes
+	Paths   []string  // every file or directory in the group
+	ModTime time.Time // newest modification time in the group
+	Pinned  bool
+	Size    int64
+}
+
+// Plan returns the groups in the build output directory dir that the policy
+// would remove, oldest first. Only files named like the artifacts distrorun
+// writes and their checksum, pin and report files are considered; anything
+// else in dir is left alone.
+func Plan(dir string, p Policy, now time.Time) ([]Group, error) {
+	return plan(dir, p, now, buildArtifactName)
+}
+
+// PlanCache is Plan for a directory of the download cache, which only
+// distrorun writes to: every entry is an artifact or a sidecar of one.
+func PlanCache(dir string, p Policy, now time.Time) ([]Group, error) {
+	return plan(dir, p, now, func(file string, _ bool) (string, string, bool) {
+		name, suffix := artifactName(file)
+		return name, suffix, true
+	})
+}
+
+// plan is Plan with the entries of dir named by name, see scan.
+func plan(dir string, p Policy, now time.Time, name func(file string, isDir bool) (string, string, bool)) ([]Group, error) {
+	if p.KeepLast <= 0 && p.MaxAge <= 0 && len(p.Pins) == 0 {
+		return nil, fmt.Errorf("refusing to prune %s without a retention rule", dir)
+	}
+
+	groups, err := scan(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first, so the first KeepLast groups are the ones to keep.
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ModTime.After(groups[j].ModTime) })
+
+	var remove []Group
+	for i, g := range groups {
+		switch {
+		case g.Pinned, matchesAny(p.Pins, g.Name):
+		case p.KeepLast > 0 && i < p.KeepLast:
+		case p.MaxAge > 0 && now.Sub(g.ModTime) < p.MaxAge:
+		default:
+			remove = append(remove, g)
+		}
+	}
+
+	// Report oldest first
+	for i, j := 0, len(remove)-1; i < j; i, j = i+1, j-1 {
+		remove[i], remove[j] = remove[j], remove[i]
+	}
+	return remove, nil
+}
+
+// Remove deletes every path of every group.
+func Remove(groups []Group) error {
+	for _, g := range groups {
+		for _, p := range g.Paths {
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("removing %s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scan groups the entries of dir by the artifact name returns for them,
+// skipping those it does not recognize.
+func scan(dir string, artifact func(file string, isDir bool) (name, suffix string, ok bool)) ([]Group, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dir, err)
+	}
+
+	byName := make(map[string]*Group)
+	var order []string
+	for _, e := range entries {
+		name, suffix, ok := artifact(e.Name(), e.IsDir())
+		if !ok {
+			continue
+		}
+		g, ok := byName[name]
+		if !ok {
+			g = &Group{Name: name}
+			byName[name] = g
+			order = append(order, name)
+		}
+
+		p := filepath.Join(dir, e.Name())
+		g.Paths = append(g.Paths, p)
+		if suffix == PinSuffix {
+			g.Pinned = true
+		}
+		if info, err := e.Info(); err == nil {
+			if info.ModTime().After(g.ModTime) {
+				g.ModTime = info.ModTime()
+			}
+			g.Size += diskUsage(p, info)
+		}
+	}
+
+	groups := make([]Group, 0, len(order))
+	for _, name := range order {
+		groups = append(groups, *byName[name])
+	}
+	return groups, nil
+}
+
+// artifactName strips a sidecar suffix and the file extension from a file
+// name, so "os.iso", "os.iso.sha256" and "os-sbom.spdx.json" all map to "os".
+func artifactName(file string) (name, suffix string) {
+	name = file
+	for _, s := range sidecarSuffixes {
+		if strings.HasSuffix(name, s) && name != s {
+			name = strings.TrimSuffix(name, s)
+			suffix = s
+			break
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)), suffix
+}
+
+// buildArtifactName is artifactName for build output: it recognizes only
+// artifacts with one of artifactExts, netboot directories, and the
+// sidecars of both, and strips the whole extension, so "os.iso",
+// "os.iso.sha256", "os-audit.jsonl" and "os-seed.iso" all map to "os".
+func buildArtifactName(file string, isDir bool) (name, suffix string, ok bool) {
+	if isDir {
+		return file, "", strings.HasSuffix(file, netbootSuffix) && file != netbootSuffix
+	}
+	name = file
+	for _, s := range []string{PinSuffix, ".sha256"} {
+		if n, found := strings.CutSuffix(name, s); found {
+			name, suffix = n, s
+			break
+		}
+	}
+	if suffix == "" {
+		for _, s := range buildSidecars {
+			if n, found := strings.CutSuffix(name, s); found && n != "" {
+				return n, s, true
+			}
+		}
+	} else if strings.HasSuffix(name, netbootSuffix) && name != netbootSuffix {
+		return name, suffix, true // os-netboot.sha256 or os-netboot.pin
+	}
+	for _, ext := range artifactExts {
+		if n, found := strings.CutSuffix(name, ext); found && n != "" {
+			return n, suffix, true
+		}
+	}
+	return "", "", false
+}
+
+// matchesAny reports whether name matches one of the glob patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// diskUsage returns the size of a file, or of all files below a directory.
+func diskUsage(p string, info os.FileInfo) int64 {
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var total int64
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total
+}
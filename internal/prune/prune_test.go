@@ -0,0 +1,115 @@
+package prune
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func touch(t *testing.T, dir, name string, mtime time.Time) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(groups []Group) string {
+	var n []string
+	for _, g := range groups {
+		n = append(n, g.Name)
+	}
+	return strings.Join(n, ",")
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	day := 24 * time.Hour
+
+	touch(t, dir, "os-1.iso", now.Add(-10*day))
+	touch(t, dir, "os-1.iso.sha256", now.Add(-10*day))
+	touch(t, dir, "os-1-sbom.spdx.json", now.Add(-10*day))
+	touch(t, dir, "os-2.iso", now.Add(-5*day))
+	touch(t, dir, "os-2.iso.pin", now.Add(-5*day))
+	touch(t, dir, "os-3.iso", now.Add(-3*day))
+	touch(t, dir, "os-4.iso", now.Add(-1*day))
+
+	remove, err := Plan(dir, Policy{KeepLast: 1}, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := names(remove); got != "os-1,os-3" {
+		t.Errorf("KeepLast=1 removes %q, want %q", got, "os-1,os-3")
+	}
+	if len(remove[0].Paths) != 3 {
+		t.Errorf("os-1 group has %d paths, want 3 (artifact, checksum, SBOM)", len(remove[0].Paths))
+	}
+
+	remove, err = Plan(dir, Policy{MaxAge: 4 * day, Pins: []string{"os-1"}}, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := names(remove); got != "" {
+		t.Errorf("MaxAge=4d with pin removes %q, want nothing", got)
+	}
+}
+
+func TestPlan_RequiresRule(t *testing.T) {
+	if _, err := Plan(t.TempDir(), Policy{}, time.Now()); err == nil {
+		t.Fatal("expected error without retention rule, got nil")
+	}
+}
+
+func TestPlan_OnlyArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	day := 24 * time.Hour
+
+	for _, name := range []string{"os-1.iso", "os-1.iso.sha256", "os-1-audit.jsonl", "os-1-provenance.json", "os-1-seed.iso",
+		"vm-1.qcow2", "img-1-oci.tar", "README.md", "notes.txt", "build.sh", "distrorun.yaml", "old.sha256"} {
+		touch(t, dir, name, now.Add(-10*day))
+	}
+	os.Mkdir(filepath.Join(dir, "src"), 0755)
+	os.Mkdir(filepath.Join(dir, "os-1-netboot"), 0755)
+	for _, d := range []string{"src", "os-1-netboot"} {
+		os.Chtimes(filepath.Join(dir, d), now.Add(-10*day), now.Add(-10*day))
+	}
+	touch(t, dir, "os-2.iso", now)
+
+	remove, err := Plan(dir, Policy{KeepLast: 1}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(remove); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if got, want := strings.Join(left, ","), "README.md,build.sh,distrorun.yaml,notes.txt,old.sha256,os-2.iso,src"; got != want {
+		t.Errorf("left after prune: %s, want %s", got, want)
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	touch(t, dir, "alpine-minirootfs-3.19.1-x86_64.tar.gz", now.Add(-time.Hour))
+	touch(t, dir, "alpine-minirootfs-3.20.3-x86_64.tar.gz", now)
+
+	remove, err := PlanCache(dir, Policy{KeepLast: 1}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(remove); got != "alpine-minirootfs-3.19.1-x86_64.tar" {
+		t.Errorf("PlanCache removes %q", got)
+	}
+}
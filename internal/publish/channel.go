@@ -0,0 +1,314 @@
+package publish
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fetch"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/provenance"
+	"github.com/talfaza/distrorun/internal/sbom"
+	"github.com/talfaza/distrorun/internal/ui"
+	"github.com/talfaza/distrorun/internal/unpack"
+)
+
+// ManifestName is the file name of channel manifests.
+const ManifestName = "channel.json"
+
+// channelName matches the names of release channels, such as "dev" or
+// "prod".
+var channelName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// CheckChannel returns an error unless name is a valid channel name.
+func CheckChannel(name string) error {
+	if !channelName.MatchString(name) {
+		return fmt.Errorf("channel %q is invalid: use lower-case letters, digits, dots, dashes and underscores", name)
+	}
+	return nil
+}
+
+// ChannelTargets returns the targets whose path has a {channel}
+// placeholder, which are the ones that keep channels apart.
+func ChannelTargets(targets []config.Target) []config.Target {
+	var out []config.Target
+	for _, t := range targets {
+		if strings.Contains(t.Path, "{channel}") {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// PromoteVars returns the placeholder values of promoting a build of cfg
+// to channel. {version} is the image_version recorded in the build's
+// provenance at provenancePath, as cfg may have moved on since; without
+// one, from a build by an older distrorun, it is cfg's, with a warning.
+func PromoteVars(cfg *config.Config, channel, provenancePath string) map[string]string {
+	vars := Vars(cfg, channel)
+	version, err := builtVersion(provenancePath)
+	if err != nil {
+		ui.Warn(fmt.Sprintf("Promoting as version %q of the config: %v", vars["version"], err))
+		return vars
+	}
+	if version != vars["version"] {
+		ui.Info("Version", fmt.Sprintf("%s, as built (the config is at %s now)", version, vars["version"]))
+	}
+	vars["version"] = version
+	return vars
+}
+
+// builtVersion returns the image_version recorded in the provenance at
+// path.
+func builtVersion(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading the image version the artifact was built as: %w", err)
+	}
+	var p struct {
+		ImageVersion *string `json:"image_version"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if p.ImageVersion == nil {
+		return "", fmt.Errorf("%s does not record the image version", path)
+	}
+	return *p.ImageVersion, nil
+}
+
+// Manifest is the channel manifest update clients poll: the release a
+// channel currently carries, where its files are, and what changed since
+// the release it replaced.
+type Manifest struct {
+	Name      string            `json:"name"`
+	Version   string            `json:"version,omitempty"`
+	Channel   string            `json:"channel"`
+	Published string            `json:"published"` // RFC 3339
+	Files     []ManifestFile    `json:"files"`
+	Packages  map[string]string `json:"packages,omitempty"` // name → version, from the SBOM
+	Notes     string            `json:"notes,omitempty"`    // Markdown release notes
+
+	// Provenance is the bill of tooling of the build: the host tools,
+	// host files and kernel the release was built with.
+	Provenance *provenance.Provenance `json:"provenance,omitempty"`
+}
+
+// ManifestFile is one file of the release in a channel manifest.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`          // relative to the manifest
+	URL    string `json:"url,omitempty"` // when the target has a download URL
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// RootfsSHA256 is the SHA-256 of the rootfs.squashfs inside an ISO,
+	// which the update agent of updates.mode "image" installs.
+	RootfsSHA256 string `json:"rootfs_sha256,omitempty"`
+}
+
+// UploadManifest writes the manifest of the release of files to the
+// channel vars["channel"] on each of targets, after the files were
+// uploaded there with Upload. The manifest sits at the path of the
+// channel with {version} and {date} left out, e.g. "os/prod/channel.json"
+// for "{name}/{channel}/{version}/{file}", so clients find it at a fixed
+// URL.
+//
+// When files include an SBOM, the manifest lists its packages, and on
+// targets with a download URL its release notes diff them against the
+// manifest the channel had before. When they include the provenance of the
+// build, the manifest carries it. Targets with a signing key get the
+// base64 Ed25519 signature of the manifest next to it, in
+// "channel.json.sig", uploaded before the manifest.
+func UploadManifest(targets []config.Target, files []File, vars map[string]string) error {
+	keys := make([]ed25519.PrivateKey, len(targets))
+	for i, t := range targets {
+		var err error
+		if keys[i], err = signingKey(t); err != nil {
+			return err
+		}
+	}
+
+	var entries []ManifestFile
+	var pkgs map[string]string
+	var prov *provenance.Provenance
+	for _, f := range files {
+		sum, err := fsutil.SHA256File(f.Path)
+		if err != nil {
+			return fmt.Errorf("hashing %s: %w", f.Path, err)
+		}
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		e := ManifestFile{Name: f.Name, SHA256: sum, Size: fi.Size()}
+		if strings.HasSuffix(f.Name, ".iso") {
+			h := sha256.New()
+			switch err := unpack.CopyISOFile(f.Path, "rootfs.squashfs", h); {
+			case err == nil:
+				e.RootfsSHA256 = hex.EncodeToString(h.Sum(nil))
+			case !errors.Is(err, fs.ErrNotExist):
+				return err
+			}
+		}
+		entries = append(entries, e)
+		if strings.HasSuffix(f.Name, "-sbom.spdx.json") {
+			if pkgs, err = sbom.ReadPackages(f.Path); err != nil {
+				return err
+			}
+		}
+		if strings.HasSuffix(f.Name, "-provenance.json") {
+			if prov, err = provenance.Read(f.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	fixed := map[string]string{"name": vars["name"], "channel": vars["channel"], "version": "", "date": ""}
+	for i, t := range targets {
+		remote := remotePath(t.Path, fixed, ManifestName)
+		base := strings.TrimSuffix(t.DownloadURL(), "/")
+		m := Manifest{
+			Name:       vars["name"],
+			Version:    vars["version"],
+			Channel:    vars["channel"],
+			Published:  time.Now().UTC().Format(time.RFC3339),
+			Packages:   pkgs,
+			Provenance: prov,
+		}
+		for j, f := range files {
+			e := entries[j]
+			filePath := remotePath(t.Path, vars, f.Name)
+			rel, err := filepath.Rel(path.Dir(remote), filePath)
+			if err != nil {
+				return err
+			}
+			e.Path = filepath.ToSlash(rel)
+			if base != "" {
+				e.URL = base + "/" + filePath
+			}
+			m.Files = append(m.Files, e)
+		}
+		if pkgs != nil && base != "" {
+			prev, err := fetchManifest(base + "/" + remote)
+			switch {
+			case err != nil:
+				ui.Warn(fmt.Sprintf("No release notes for %s: reading the current manifest: %v", t.URL, err))
+			case prev != nil && prev.Version == m.Version && prev.Notes != "":
+				// Published again: the notes still describe the release
+				// this one replaced.
+				m.Notes = prev.Notes
+			case prev != nil:
+				m.Notes = sbom.PackageNotes(prev.Packages, pkgs)
+			default:
+				m.Notes = sbom.PackageNotes(nil, pkgs)
+			}
+		}
+
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		// The signature goes first: a client reading the pair in between
+		// finds the old manifest failing the new signature and tries
+		// again, rather than trusting a manifest without its signature.
+		if keys[i] != nil {
+			sig := base64.StdEncoding.EncodeToString(ed25519.Sign(keys[i], data)) + "\n"
+			if err := uploadData(t, []byte(sig), remote+".sig"); err != nil {
+				return fmt.Errorf("publishing the %s manifest signature to %s: %w", vars["channel"], t.URL, err)
+			}
+			ui.Detail(remote + ".sig")
+		}
+		if err := uploadData(t, data, remote); err != nil {
+			return fmt.Errorf("publishing the %s manifest to %s: %w", vars["channel"], t.URL, err)
+		}
+		ui.Detail(remote)
+	}
+	return nil
+}
+
+// uploadData uploads data to remote on t, through a temporary file.
+func uploadData(t config.Target, data []byte, remote string) error {
+	tmp, err := os.CreateTemp("", "distrorun-channel-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return withRetries(t.Retries, func() error { return uploadFile(t, tmp.Name(), remote) })
+}
+
+// signingKey returns the manifest signing key of t, or nil when it has
+// none. The key is the base64 Ed25519 private key or its 32-byte seed.
+func signingKey(t config.Target) (ed25519.PrivateKey, error) {
+	var encoded, source string
+	switch {
+	case t.SigningKey != "":
+		data, err := os.ReadFile(t.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key: %w", err)
+		}
+		encoded, source = string(data), t.SigningKey
+	case t.SigningKeyEnv != "":
+		encoded, source = os.Getenv(t.SigningKeyEnv), "$"+t.SigningKeyEnv
+		if encoded == "" {
+			return nil, fmt.Errorf("signing key: %s is not set", t.SigningKeyEnv)
+		}
+	default:
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	switch {
+	case err != nil:
+	case len(raw) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case len(raw) == ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("%s is not a base64 Ed25519 private key", source)
+}
+
+// maxManifestSize bounds the manifest read back from a channel.
+const maxManifestSize = 16 << 20
+
+// fetchManifest downloads the manifest at url, or returns nil when the
+// channel has none yet.
+func fetchManifest(url string) (*Manifest, error) {
+	client := &http.Client{Timeout: 30 * time.Second, Transport: fetch.Transport(nil)}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	var m Manifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", url, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,273 @@
+package publish
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+// server is an HTTP publish target keeping what is PUT to it, in order.
+type server struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+	puts  []string
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{files: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			s.files[name] = data
+			s.puts = append(s.puts, name)
+		case http.MethodGet:
+			data, ok := s.files[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) manifest(t *testing.T, name string) Manifest {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m Manifest
+	if err := json.Unmarshal(s.files[name], &m); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return m
+}
+
+func TestCheckChannel(t *testing.T) {
+	for name, valid := range map[string]bool{"prod": true, "v1.2_rc-1": true, "": false, "Prod": false, "../prod": false, "-dev": false} {
+		if err := CheckChannel(name); (err == nil) != valid {
+			t.Errorf("CheckChannel(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestChannelTargets(t *testing.T) {
+	targets := []config.Target{
+		{URL: "https://a.example", Path: "{name}/{channel}/{file}"},
+		{URL: "https://b.example", Path: "{name}/{version}/{file}"},
+		{URL: "https://c.example"},
+	}
+	got := ChannelTargets(targets)
+	if len(got) != 1 || got[0].URL != "https://a.example" {
+		t.Errorf("ChannelTargets = %+v, want the target with {channel}", got)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	var files []File
+	for _, name := range []string{"demo.iso", "demo-audit.jsonl"} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(name), 0644)
+		files = append(files, File{Path: p, Name: name})
+	}
+	sums, err := WriteChecksums(files, filepath.Join(dir, "demo.iso.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChecksums(sums.Path, files); err != nil {
+		t.Fatalf("VerifyChecksums of unchanged files: %v", err)
+	}
+
+	extra := filepath.Join(dir, "demo-provenance.json")
+	os.WriteFile(extra, []byte("{}"), 0644)
+	if err := VerifyChecksums(sums.Path, append(files, File{Path: extra, Name: "demo-provenance.json"})); err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("unlisted file: error = %v", err)
+	}
+	os.WriteFile(files[0].Path, []byte("tampered"), 0644)
+	if err := VerifyChecksums(sums.Path, files); err == nil || !strings.Contains(err.Error(), "demo.iso has changed") {
+		t.Errorf("changed file: error = %v", err)
+	}
+	if err := VerifyChecksums(filepath.Join(dir, "missing.sha256"), files); err == nil {
+		t.Error("expected an error for a missing checksum file")
+	}
+}
+
+func TestPromoteVars(t *testing.T) {
+	cfg := &config.Config{Name: "demo", ImageVersion: "1.3"}
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		provenance string // "" for none
+		want       string
+	}{
+		"built as an older version": {`{"distrorun": "dev", "image_version": "1.2"}`, "1.2"},
+		"built without a version":   {`{"distrorun": "dev", "image_version": ""}`, ""},
+		"older provenance":          {`{"distrorun": "dev"}`, "1.3"},
+		"no provenance":             {"", "1.3"},
+	} {
+		p := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".json")
+		if tc.provenance != "" {
+			os.WriteFile(p, []byte(tc.provenance), 0644)
+		}
+		vars := PromoteVars(cfg, "prod", p)
+		if vars["version"] != tc.want || vars["channel"] != "prod" || vars["name"] != "demo" {
+			t.Errorf("%s: vars = %v, want version %q", name, vars, tc.want)
+		}
+	}
+}
+
+func TestUploadManifest(t *testing.T) {
+	srv := newServer(t)
+	dir := t.TempDir()
+	var files []File
+	for _, name := range []string{"demo.img", "demo-provenance.json"} {
+		p := filepath.Join(dir, name)
+		content := "image"
+		if strings.HasSuffix(name, ".json") {
+			content = `{"distrorun": "dev", "image_version": "1.2"}`
+		}
+		os.WriteFile(p, []byte(content), 0644)
+		files = append(files, File{Path: p, Name: name})
+	}
+	targets := []config.Target{{Type: "http", URL: srv.URL, Path: "{name}/{channel}/{version}/{file}"}}
+	vars := map[string]string{"name": "demo", "channel": "prod", "version": "1.2", "date": "20261015"}
+	if err := Upload(targets, files, vars); err != nil {
+		t.Fatal(err)
+	}
+	if err := UploadManifest(targets, files, vars); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest sits at the channel's fixed path and points at the
+	// release's files relative to it.
+	m := srv.manifest(t, "demo/prod/channel.json")
+	if m.Name != "demo" || m.Channel != "prod" || m.Version != "1.2" || len(m.Files) != 2 {
+		t.Fatalf("manifest = %+v", m)
+	}
+	img := m.Files[0]
+	if img.Name != "demo.img" || img.Path != "1.2/demo.img" || img.URL != srv.URL+"/demo/prod/1.2/demo.img" || img.Size != 5 {
+		t.Errorf("file = %+v", img)
+	}
+	if img.SHA256 != "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Errorf("sha256 = %s", img.SHA256)
+	}
+	if m.Provenance == nil || m.Provenance.ImageVersion != "1.2" {
+		t.Errorf("provenance = %+v", m.Provenance)
+	}
+	if _, ok := srv.files["demo/prod/channel.json.sig"]; ok {
+		t.Error("a target without a signing key got a signature")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	priv := ed25519.NewKeyFromSeed(seed)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(content), 0600)
+		return p
+	}
+	t.Setenv("DISTRORUN_TEST_KEY", base64.StdEncoding.EncodeToString(priv))
+	for name, tc := range map[string]struct {
+		target config.Target
+		want   ed25519.PrivateKey
+		err    string
+	}{
+		"none":       {target: config.Target{}},
+		"seed file":  {target: config.Target{SigningKey: write("seed", base64.StdEncoding.EncodeToString(seed)+"\n")}, want: priv},
+		"key file":   {target: config.Target{SigningKey: write("key", base64.StdEncoding.EncodeToString(priv))}, want: priv},
+		"env":        {target: config.Target{SigningKeyEnv: "DISTRORUN_TEST_KEY"}, want: priv},
+		"env unset":  {target: config.Target{SigningKeyEnv: "DISTRORUN_TEST_UNSET"}, err: "DISTRORUN_TEST_UNSET is not set"},
+		"missing":    {target: config.Target{SigningKey: filepath.Join(dir, "missing")}, err: "reading signing key"},
+		"not base64": {target: config.Target{SigningKey: write("text", "not a key")}, err: "is not a base64 Ed25519 private key"},
+		"wrong size": {target: config.Target{SigningKey: write("short", base64.StdEncoding.EncodeToString(seed[:16]))}, err: "is not a base64 Ed25519 private key"},
+	} {
+		key, err := signingKey(tc.target)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error = %v, want %q", name, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", name, err)
+		case !key.Equal(tc.want):
+			t.Errorf("%s: wrong key", name)
+		}
+	}
+}
+
+func TestFetchManifest(t *testing.T) {
+	srv := newServer(t)
+	srv.files["demo/prod/channel.json"] = []byte(`{"name": "demo", "version": "1.1", "packages": {"musl": "1.2.5-r0"}}`)
+	srv.files["demo/bad/channel.json"] = []byte(`<html>`)
+
+	m, err := fetchManifest(srv.URL + "/demo/prod/channel.json")
+	if err != nil || m == nil || m.Version != "1.1" || m.Packages["musl"] != "1.2.5-r0" {
+		t.Errorf("fetchManifest = %+v, %v", m, err)
+	}
+	// A channel without a manifest yet is not an error.
+	if m, err := fetchManifest(srv.URL + "/demo/new/channel.json"); m != nil || err != nil {
+		t.Errorf("missing manifest = %+v, %v; want nil, nil", m, err)
+	}
+	if _, err := fetchManifest(srv.URL + "/demo/bad/channel.json"); err == nil {
+		t.Error("expected an error for an invalid manifest")
+	}
+}
+
+func TestUploadManifestSigned(t *testing.T) {
+	srv := newServer(t)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key")
+	os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(priv)), 0600)
+	sbomPath := filepath.Join(dir, "demo-sbom.spdx.json")
+	os.WriteFile(sbomPath, []byte(`{"packages": [{"name": "musl", "versionInfo": "1.2.5-r1"}, {"name": "curl", "versionInfo": "8.9.0-r0"}]}`), 0644)
+	files := []File{{Path: sbomPath, Name: "demo-sbom.spdx.json"}}
+	srv.files["demo/prod/channel.json"] = []byte(`{"name": "demo", "version": "1.1", "packages": {"musl": "1.2.5-r0"}}`)
+
+	targets := []config.Target{{Type: "http", URL: srv.URL, Path: "{name}/{channel}/{version}/{file}", SigningKey: keyPath}}
+	vars := map[string]string{"name": "demo", "channel": "prod", "version": "1.2"}
+	if err := UploadManifest(targets, files, vars); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signature goes up before the manifest it signs.
+	if want := []string{"demo/prod/channel.json.sig", "demo/prod/channel.json"}; !slices.Equal(srv.puts, want) {
+		t.Errorf("uploads = %q, want %q", srv.puts, want)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(srv.files["demo/prod/channel.json.sig"])))
+	if err != nil || !ed25519.Verify(pub, srv.files["demo/prod/channel.json"], sig) {
+		t.Errorf("the signature does not verify the manifest: %v", err)
+	}
+	// The release notes diff the packages against the manifest replaced.
+	m := srv.manifest(t, "demo/prod/channel.json")
+	if !strings.Contains(m.Notes, "musl 1.2.5-r0 → 1.2.5-r1") || !strings.Contains(m.Notes, "curl 8.9.0-r0") {
+		t.Errorf("notes = %q", m.Notes)
+	}
+
+	// A target whose key cannot be read publishes nothing.
+	srv.puts = nil
+	targets[0].SigningKey = filepath.Join(dir, "missing")
+	if err := UploadManifest(targets, files, vars); err == nil || len(srv.puts) != 0 {
+		t.Errorf("error = %v, uploads = %q", err, srv.puts)
+	}
+}
@@ -0,0 +1,255 @@
+// Package publish uploads build artifacts to remote storage after a build.
+package publish
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// defaultPathTemplate is used when a target does not set "path".
+const defaultPathTemplate = "{name}/{file}"
+
+// defaultRetries is the number of attempts per file when a target does not set "retries".
+const defaultRetries = 3
+
+// File is a local artifact and the name it is published under ({file}).
+type File struct {
+	Path string // local path
+	Name string // relative name, may contain "/" for directory outputs
+}
+
+// Collect returns the files to publish for an output path (a file or a
+// directory) plus any extra files such as the SBOM. Missing extras are skipped.
+func Collect(outputPath string, extra ...string) ([]File, error) {
+	var files []File
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", outputPath, err)
+	}
+	if info.IsDir() {
+		err := filepath.Walk(outputPath, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(outputPath, p)
+			files = append(files, File{Path: p, Name: filepath.ToSlash(rel)})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walking %s: %w", outputPath, err)
+		}
+	} else {
+		files = append(files, File{Path: outputPath, Name: filepath.Base(outputPath)})
+	}
+
+	for _, p := range extra {
+		if _, err := os.Stat(p); err == nil {
+			files = append(files, File{Path: p, Name: filepath.Base(p)})
+		}
+	}
+	return files, nil
+}
+
+// WriteChecksums writes a sha256sum-compatible file covering files and returns it.
+func WriteChecksums(files []File, dest string) (File, error) {
+	var b strings.Builder
+	for _, f := range files {
+		sum, err := fsutil.SHA256File(f.Path)
+		if err != nil {
+			return File{}, fmt.Errorf("hashing %s: %w", f.Path, err)
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, f.Name)
+	}
+	if err := os.WriteFile(dest, []byte(b.String()), 0644); err != nil {
+		return File{}, fmt.Errorf("writing checksums: %w", err)
+	}
+	return File{Path: dest, Name: filepath.Base(dest)}, nil
+}
+
+// VerifyChecksums checks files against the sha256sum-compatible file at
+// sumsPath, as written by WriteChecksums. Every file must be listed there.
+func VerifyChecksums(sumsPath string, files []File) error {
+	data, err := os.ReadFile(sumsPath)
+	if err != nil {
+		return fmt.Errorf("reading checksums: %w", err)
+	}
+	listed := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if sum, name, ok := strings.Cut(line, "  "); ok {
+			listed[name] = sum
+		}
+	}
+	for _, f := range files {
+		want, ok := listed[f.Name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in %s", f.Name, sumsPath)
+		}
+		sum, err := fsutil.SHA256File(f.Path)
+		if err != nil {
+			return fmt.Errorf("hashing %s: %w", f.Path, err)
+		}
+		if sum != want {
+			return fmt.Errorf("%s has changed since %s was written", f.Name, sumsPath)
+		}
+	}
+	return nil
+}
+
+// Vars returns the placeholder values of a release of cfg to channel,
+// dated today. {version} is the image_version, not the schema version
+// the config's "version" key selects.
+func Vars(cfg *config.Config, channel string) map[string]string {
+	return map[string]string{
+		"name":    cfg.Name,
+		"version": cfg.ImageVersion,
+		"channel": channel,
+		"date":    time.Now().UTC().Format("20060102"),
+	}
+}
+
+// Upload publishes files to every target in order. vars supplies the
+// {name}, {version} and {channel} placeholders of the path template, and
+// {date} when set.
+func Upload(targets []config.Target, files []File, vars map[string]string) error {
+	for _, t := range targets {
+		ui.SubStep(fmt.Sprintf("Publishing to %s (%s)...", t.URL, t.Type))
+		for _, f := range files {
+			remote := remotePath(t.Path, vars, f.Name)
+			if err := withRetries(t.Retries, func() error { return uploadFile(t, f.Path, remote) }); err != nil {
+				return fmt.Errorf("publishing %s to %s: %w", f.Name, t.URL, err)
+			}
+			ui.Detail(remote)
+		}
+	}
+	return nil
+}
+
+// remotePath expands a target path template for one file. {date} is
+// today unless vars sets it.
+func remotePath(tmpl string, vars map[string]string, file string) string {
+	if tmpl == "" {
+		tmpl = defaultPathTemplate
+	}
+	date, ok := vars["date"]
+	if !ok {
+		date = time.Now().UTC().Format("20060102")
+	}
+	r := strings.NewReplacer(
+		"{name}", vars["name"],
+		"{version}", vars["version"],
+		"{channel}", vars["channel"],
+		"{date}", date,
+		"{file}", file,
+	)
+	return strings.TrimPrefix(path.Clean("/"+r.Replace(tmpl)), "/")
+}
+
+// withRetries calls fn up to attempts times with a linear backoff.
+func withRetries(attempts int, fn func() error) error {
+	if attempts <= 0 {
+		attempts = defaultRetries
+	}
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i < attempts {
+			ui.Warn(fmt.Sprintf("Upload failed (attempt %d/%d): %v", i, attempts, err))
+			time.Sleep(time.Duration(i) * 2 * time.Second)
+		}
+	}
+	return err
+}
+
+// uploadFile dispatches to the uploader for the target type.
+func uploadFile(t config.Target, local, remote string) error {
+	switch t.Type {
+	case "s3":
+		return uploadS3(t, local, remote)
+	case "sftp":
+		return uploadSFTP(t, local, remote)
+	default:
+		return uploadHTTP(t, local, remote)
+	}
+}
+
+// uploadHTTP PUTs the file to <url>/<remote>, with an optional bearer token.
+func uploadHTTP(t config.Target, local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(t.URL, "/")+"/"+remote, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if t.TokenEnv != "" {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv(t.TokenEnv))
+	}
+	return do(req)
+}
+
+// uploadSFTP copies the file with the host sftp client in batch mode, creating
+// parent directories first. Authentication uses the caller's SSH keys/agent.
+func uploadSFTP(t config.Target, local, remote string) error {
+	var batch strings.Builder
+	dirs := strings.Split(path.Dir(remote), "/")
+	for i := range dirs {
+		if dirs[i] == "." {
+			break
+		}
+		// A leading "-" tells sftp to ignore errors (directory exists)
+		fmt.Fprintf(&batch, "-mkdir %s\n", strings.Join(dirs[:i+1], "/"))
+	}
+	fmt.Fprintf(&batch, "put %q %q\n", local, remote)
+
+	cmd := exec.Command("sftp", "-b", "-", "-o", "BatchMode=yes", t.URL)
+	cmd.Stdin = strings.NewReader(batch.String())
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// do sends req and treats any non-2xx status as an error.
+func do(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
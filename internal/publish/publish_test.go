@@ -0,0 +1,41 @@
+package publish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+func TestVars_MigratedConfig(t *testing.T) {
+	old := `version: "1.0"
+name: demo
+distro:
+  base: alpine
+users:
+  - name: root
+    password: toor
+`
+	data, _, _, err := config.Migrate([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "distrorun.yaml")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != "2" {
+		t.Fatalf("version = %q, want the migrated 2", cfg.Version)
+	}
+
+	vars := Vars(cfg, "prod")
+	vars["date"] = "20261015"
+	if got, want := remotePath("{name}/{channel}/{version}/{file}", vars, "demo.iso"), "demo/prod/1.0/demo.iso"; got != want {
+		t.Errorf("remotePath = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// Release describes a release to create on a code forge.
+type Release struct {
+	Repo  string // "owner/name" (GitHub) or project path/ID (GitLab)
+	Tag   string
+	Name  string // release title; defaults to Tag
+	Notes string // Markdown body
+	Ref   string // GitLab only: commit or branch to tag if Tag does not exist yet
+	Token string
+	API   string // API base URL
+	Files []File
+}
+
+// GitHub creates (or reuses) the release for r.Tag and uploads every file
+// as a release asset.
+func GitHub(r Release) error {
+	if r.API == "" {
+		r.API = "https://api.github.com"
+	}
+	auth := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+	}
+
+	var rel struct {
+		ID        int64  `json:"id"`
+		UploadURL string `json:"upload_url"`
+		HTMLURL   string `json:"html_url"`
+	}
+
+	// Reuse an existing release so re-runs replace its assets.
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/releases/tags/%s", r.API, r.Repo, url.PathEscape(r.Tag)), nil)
+	auth(req)
+	err := doJSON(req, &rel)
+	if err != nil {
+		ui.SubStep("Creating GitHub release " + r.Tag + "...")
+		body, _ := json.Marshal(map[string]string{
+			"tag_name": r.Tag,
+			"name":     releaseName(r),
+			"body":     r.Notes,
+		})
+		req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("%s/repos/%s/releases", r.API, r.Repo), bytes.NewReader(body))
+		auth(req)
+		req.Header.Set("Content-Type", "application/json")
+		if err := doJSON(req, &rel); err != nil {
+			return fmt.Errorf("creating release: %w", err)
+		}
+	} else {
+		ui.SubStep("Using existing GitHub release " + r.Tag)
+		if err := deleteGitHubAssets(r, rel.ID, auth); err != nil {
+			return err
+		}
+	}
+
+	// upload_url is an RFC 6570 template: ".../assets{?name,label}"
+	uploadURL := rel.UploadURL
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	for _, f := range r.Files {
+		err := withRetries(0, func() error {
+			file, err := os.Open(f.Path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			req, _ := http.NewRequest(http.MethodPost, uploadURL+"?name="+url.QueryEscape(assetName(f)), file)
+			auth(req)
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.ContentLength = info.Size()
+			return do(req)
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", f.Name, err)
+		}
+		ui.Detail(assetName(f))
+	}
+
+	ui.URL(rel.HTMLURL)
+	return nil
+}
+
+// deleteGitHubAssets deletes the assets of release id that the files of r
+// would upload again: GitHub refuses an asset whose name is taken.
+func deleteGitHubAssets(r Release, id int64, auth func(*http.Request)) error {
+	names := map[string]bool{}
+	for _, f := range r.Files {
+		names[assetName(f)] = true
+	}
+	const perPage = 100
+	var stale []int64
+	for page := 1; ; page++ {
+		var assets []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		}
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/releases/%d/assets?per_page=%d&page=%d", r.API, r.Repo, id, perPage, page), nil)
+		auth(req)
+		if err := doJSON(req, &assets); err != nil {
+			return fmt.Errorf("listing release assets: %w", err)
+		}
+		for _, a := range assets {
+			if names[a.Name] {
+				stale = append(stale, a.ID)
+			}
+		}
+		if len(assets) < perPage {
+			break
+		}
+	}
+	for _, asset := range stale {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/repos/%s/releases/assets/%d", r.API, r.Repo, asset), nil)
+		auth(req)
+		if err := do(req); err != nil {
+			return fmt.Errorf("deleting release asset %d: %w", asset, err)
+		}
+	}
+	return nil
+}
+
+// GitLab uploads every file to the project's generic package registry and
+// creates a release linking to them.
+func GitLab(r Release) error {
+	if r.API == "" {
+		r.API = "https://gitlab.com/api/v4"
+	}
+	project := url.PathEscape(r.Repo)
+	auth := func(req *http.Request) {
+		req.Header.Set("PRIVATE-TOKEN", r.Token)
+	}
+
+	type link struct {
+		Name     string `json:"name"`
+		URL      string `json:"url"`
+		LinkType string `json:"link_type"`
+	}
+	var links []link
+
+	ui.SubStep("Uploading to GitLab package registry...")
+	for _, f := range r.Files {
+		name := assetName(f)
+		fileURL := fmt.Sprintf("%s/projects/%s/packages/generic/%s/%s/%s",
+			r.API, project, url.PathEscape(filepath.Base(r.Repo)), url.PathEscape(r.Tag), url.PathEscape(name))
+		err := withRetries(0, func() error {
+			file, err := os.Open(f.Path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			req, _ := http.NewRequest(http.MethodPut, fileURL, file)
+			auth(req)
+			req.ContentLength = info.Size()
+			return do(req)
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", f.Name, err)
+		}
+		ui.Detail(name)
+		links = append(links, link{Name: name, URL: fileURL, LinkType: "package"})
+	}
+
+	ui.SubStep("Creating GitLab release " + r.Tag + "...")
+	payload := map[string]any{
+		"tag_name":    r.Tag,
+		"name":        releaseName(r),
+		"description": r.Notes,
+		"assets":      map[string]any{"links": links},
+	}
+	if r.Ref != "" {
+		payload["ref"] = r.Ref
+	}
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/projects/%s/releases", r.API, project), bytes.NewReader(body))
+	auth(req)
+	req.Header.Set("Content-Type", "application/json")
+	var rel struct {
+		Links struct {
+			Self string `json:"self"`
+		} `json:"_links"`
+	}
+	if err := doJSON(req, &rel); err != nil {
+		return fmt.Errorf("creating release: %w", err)
+	}
+
+	ui.URL(rel.Links.Self)
+	return nil
+}
+
+// releaseName returns the release title, defaulting to the tag.
+func releaseName(r Release) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Tag
+}
+
+// assetName flattens a file name for forges that do not allow "/" in asset names.
+func assetName(f File) string {
+	return strings.ReplaceAll(f.Name, "/", "_")
+}
+
+// doJSON sends req and decodes a 2xx JSON response into v.
+func doJSON(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,96 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGitHubReplacesAssets(t *testing.T) {
+	var mu sync.Mutex
+	assets := map[int64]string{1: "image.iso", 2: "notes.txt", 3: "sbom_spdx.json"}
+	contents := map[string]string{}
+	next := int64(4)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/o/n/releases/tags/v1":
+			json.NewEncoder(w).Encode(map[string]any{"id": 7, "upload_url": srv.URL + "/upload/7/assets{?name,label}"})
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/o/n/releases/7/assets":
+			list := []map[string]any{}
+			if r.URL.Query().Get("page") == "1" {
+				for id, name := range assets {
+					list = append(list, map[string]any{"id": id, "name": name})
+				}
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/repos/o/n/releases/assets/"):
+			var id int64
+			fmt.Sscan(strings.TrimPrefix(r.URL.Path, "/repos/o/n/releases/assets/"), &id)
+			if _, ok := assets[id]; !ok {
+				http.NotFound(w, r)
+				return
+			}
+			delete(assets, id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/7/assets":
+			name := r.URL.Query().Get("name")
+			for _, taken := range assets {
+				if taken == name {
+					http.Error(w, `{"errors":[{"code":"already_exists"}]}`, http.StatusUnprocessableEntity)
+					return
+				}
+			}
+			data, _ := io.ReadAll(r.Body)
+			assets[next] = name
+			contents[name] = string(data)
+			next++
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "image.iso"), []byte("new iso"), 0644)
+	os.WriteFile(filepath.Join(dir, "sbom.spdx.json"), []byte("new sbom"), 0644)
+	err := GitHub(Release{
+		Repo: "o/n",
+		Tag:  "v1",
+		API:  srv.URL,
+		Files: []File{
+			{Path: filepath.Join(dir, "image.iso"), Name: "image.iso"},
+			{Path: filepath.Join(dir, "sbom.spdx.json"), Name: "sbom/spdx.json"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	for _, name := range assets {
+		if got[name] {
+			t.Errorf("asset %s is duplicated", name)
+		}
+		got[name] = true
+	}
+	for _, name := range []string{"image.iso", "sbom_spdx.json", "notes.txt"} {
+		if !got[name] {
+			t.Errorf("asset %s is missing: %v", name, assets)
+		}
+	}
+	if contents["image.iso"] != "new iso" || contents["sbom_spdx.json"] != "new sbom" {
+		t.Errorf("uploaded %v, want the new files", contents)
+	}
+}
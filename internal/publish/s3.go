@@ -0,0 +1,137 @@
+package publish
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fsutil"
+)
+
+// uploadS3 PUTs the file into an S3-compatible bucket using path-style URLs
+// (<url>/<bucket>/<key>) and AWS Signature Version 4. Credentials come from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optionally AWS_SESSION_TOKEN.
+func uploadS3(t config.Target, local, key string) error {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 targets")
+	}
+	region := t.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	payloadHash, err := fsutil.SHA256File(local)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(t.URL, "/"))
+	if err != nil {
+		return fmt.Errorf("parsing s3 url: %w", err)
+	}
+	canonicalURI := uriEncodePath(endpoint.Path + "/" + t.Bucket + "/" + key)
+
+	req, err := http.NewRequest(http.MethodPut, endpoint.Scheme+"://"+endpoint.Host+canonicalURI, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+
+	now := time.Now().UTC()
+	headers := map[string]string{
+		"host":                 endpoint.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	for k, v := range headers {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	req.Header.Set("Authorization", signV4(headers, canonicalURI, payloadHash, region, accessKey, secretKey, now))
+	return do(req)
+}
+
+// signV4 returns the Authorization header value for a PUT request with the
+// given lowercase headers, following the AWS SigV4 specification.
+func signV4(headers map[string]string, canonicalURI, payloadHash, region, accessKey, secretKey string, now time.Time) string {
+	keys := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signedHeaders := strings.Join(keys, ";")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		canonicalURI,
+		"", // no query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature)
+}
+
+// hmacSHA256 returns HMAC-SHA256(key, data).
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncodePath percent-encodes every byte of p except unreserved characters
+// and "/", as SigV4 requires for S3 object keys.
+func uriEncodePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// ConfigureAccessPoint turns the image into a WPA2 access point: hostapd
+// runs the wireless interface, which gets a static address, and dnsmasq
+// hands out DHCP leases on it. Wireless firmware is not installed; boards
+// that need it must list the matching linux-firmware-* package.
+func (r *Rootfs) ConfigureAccessPoint(ap config.AP) error {
+	iface := ap.WirelessInterface()
+	ui.SubStep(fmt.Sprintf("Configuring WiFi access point %q on %s...", ap.SSID, iface))
+
+	if err := r.InstallPackages([]string{"hostapd", "dnsmasq", "wireless-regdb"}); err != nil {
+		return err
+	}
+
+	mode := "g"
+	if ap.WirelessChannel() >= 36 {
+		mode = "a"
+	}
+	hostapd := fmt.Sprintf(`# Generated by DistroRun (ap)
+interface=%s
+driver=nl80211
+ssid=%s
+hw_mode=%s
+channel=%d
+ieee80211n=1
+wmm_enabled=1
+auth_algs=1
+wpa=2
+wpa_key_mgmt=WPA-PSK
+rsn_pairwise=CCMP
+wpa_passphrase=%s
+`, iface, ap.SSID, mode, ap.WirelessChannel(), ap.Passphrase)
+	if ap.Country != "" {
+		hostapd += fmt.Sprintf("country_code=%s\nieee80211d=1\n", ap.Country)
+	}
+	// The passphrase is in the file, so keep it from other users.
+	if err := r.writeFile("etc/hostapd/hostapd.conf", hostapd, 0600); err != nil {
+		return err
+	}
+
+	first, last := ap.Range()
+	dnsmasq := fmt.Sprintf("# Generated by DistroRun (ap)\ninterface=%s\nbind-dynamic\ndhcp-range=%s,%s,12h\n", iface, first, last)
+	if err := r.writeFile("etc/dnsmasq.d/distrorun-ap.conf", dnsmasq, 0644); err != nil {
+		return err
+	}
+	// Older dnsmasq packages do not read dnsmasq.d by default.
+	confDir := "conf-dir=/etc/dnsmasq.d/,*.conf"
+	data, _ := os.ReadFile(filepath.Join(r.Path, "etc", "dnsmasq.conf"))
+	if !slices.Contains(strings.Split(string(data), "\n"), confDir) {
+		if err := r.appendLine("etc/dnsmasq.conf", confDir); err != nil {
+			return err
+		}
+	}
+
+	stanza := fmt.Sprintf("\nauto %s\niface %s inet static\n    address %s", iface, iface, ap.CIDR())
+	if err := r.appendLine("etc/network/interfaces", stanza); err != nil {
+		return err
+	}
+
+	for _, svc := range []string{"hostapd", "dnsmasq"} {
+		ui.ServiceItem(svc)
+		if err := r.command("chroot", r.Path, "rc-update", "add", svc, "default").Run(); err != nil {
+			return fmt.Errorf("enabling service %s: %w", svc, err)
+		}
+	}
+	ui.Detail(fmt.Sprintf("%s: %s, channel %d, DHCP %s-%s", iface, ap.CIDR(), ap.WirelessChannel(), first, last))
+	return nil
+}
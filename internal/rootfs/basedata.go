@@ -0,0 +1,135 @@
+package rootfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// RefreshBaseData installs the CA certificates and time zone database at
+// the versions pinned in b, or at the newest version on the mirror when b
+// asks for a refresh. It runs after package installation in every build,
+// so a rootfs restored from a snapshot is brought up to date too. On
+// reproducible builds, unpinned packages stay at their locked versions.
+func (r *Rootfs) RefreshBaseData(b config.BaseData) error {
+	sep := "="
+	if r.distro == "fedora" {
+		sep = "-"
+	}
+	var pkgs []string
+	for _, name := range config.BaseDataPackages {
+		if v, ok := b.Versions[name]; ok {
+			pkgs = append(pkgs, name+sep+v)
+		} else if b.Refresh {
+			pkgs = append(pkgs, name)
+		}
+	}
+	if len(pkgs) == 0 {
+		return nil
+	}
+	ui.SubStep("Refreshing CA certificates and time zone data...")
+
+	switch r.distro {
+	case "fedora":
+		// dnf install upgrades installed packages and installs a pinned
+		// version even when it is older than the installed one.
+		return r.InstallPackages(pkgs)
+	case "debian":
+		// apt-get install upgrades installed packages, but refuses a pinned
+		// version older than the installed one without --allow-downgrades.
+		return r.aptInstall(pkgs, "--allow-downgrades")
+	}
+	w := &apkWriter{}
+	cmd := r.packageManager("chroot", r.apkUpgrade(pkgs...)...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return r.apkResult(pkgs, w, cmd.Run())
+}
+
+// CheckBaseDataAge fails if the CA certificates or the time zone database
+// in the rootfs were built more than maxAge ago. Packages that are not
+// installed are skipped.
+func (r *Rootfs) CheckBaseDataAge(maxAge time.Duration) error {
+	ui.SubStep("Checking the age of CA certificates and time zone data...")
+	var stale []string
+	for _, name := range config.BaseDataPackages {
+		built, ok, err := r.buildTime(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		age := time.Since(built)
+		if age > maxAge {
+			stale = append(stale, fmt.Sprintf("%s was built on %s, %d days ago", name, built.Format("2006-01-02"), int(age.Hours()/24)))
+			continue
+		}
+		ui.Detail(fmt.Sprintf("%s: built %s", name, built.Format("2006-01-02")))
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("base data is older than base_data.max_age (set base_data.refresh or update base_data.versions, and regenerate the lock file if the build is reproducible):\n  %s",
+			strings.Join(stale, "\n  "))
+	}
+	return nil
+}
+
+// buildTime returns when the installed package pkg was built: the build
+// timestamp in the apk database or the rpm header, or on Debian the time
+// of its changelog, which dpkg extracts with the package's own mtime.
+func (r *Rootfs) buildTime(pkg string) (time.Time, bool, error) {
+	switch r.distro {
+	case "alpine":
+		f, err := os.Open(filepath.Join(r.Path, "lib", "apk", "db", "installed"))
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("reading apk database: %w", err)
+		}
+		defer f.Close()
+		var name string
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "P:"):
+				name = line[2:]
+			case strings.HasPrefix(line, "t:") && name == pkg:
+				sec, err := strconv.ParseInt(line[2:], 10, 64)
+				if err != nil {
+					return time.Time{}, false, fmt.Errorf("apk database: %s has build time %q", pkg, line[2:])
+				}
+				return time.Unix(sec, 0), true, nil
+			case line == "":
+				name = ""
+			}
+		}
+		return time.Time{}, false, sc.Err()
+	case "fedora":
+		out, err := r.command("rpm", "--root", r.Path, "-q", "--qf", "%{BUILDTIME}", pkg).Output()
+		if err != nil {
+			// rpm -q fails for packages that are not installed.
+			return time.Time{}, false, nil
+		}
+		sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("rpm: %s has build time %q", pkg, out)
+		}
+		return time.Unix(sec, 0), true, nil
+	default:
+		info, err := os.Stat(filepath.Join(r.Path, "usr", "share", "doc", pkg, "changelog.Debian.gz"))
+		if os.IsNotExist(err) {
+			return time.Time{}, false, nil
+		}
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return info.ModTime(), true, nil
+	}
+}
@@ -0,0 +1,111 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/lockfile"
+)
+
+func TestApkUpgrade(t *testing.T) {
+	tests := map[string]struct {
+		r    *Rootfs
+		want string
+	}{
+		"plain": {
+			r:    &Rootfs{Path: "/r"},
+			want: "/r apk add --upgrade --no-cache tzdata",
+		},
+		"cached": {
+			r:    &Rootfs{Path: "/r", cacheDir: "/c"},
+			want: "/r apk add --upgrade tzdata",
+		},
+		"local mirror offline": {
+			r: &Rootfs{Path: "/r", localMirror: "/m", offline: true, alpineBranch: "v3.20"},
+			want: "/r apk --repositories-file /dev/null -X /media/distrorun-mirror/v3.20/main" +
+				" -X /media/distrorun-mirror/v3.20/community --no-network add --upgrade --no-cache tzdata",
+		},
+		"locked": {
+			r:    &Rootfs{Path: "/r", lock: &lockfile.File{Packages: map[string]string{"tzdata": "2024b-r0"}}},
+			want: "/r apk add --upgrade --no-cache tzdata=2024b-r0",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := strings.Join(tt.r.apkUpgrade("tzdata"), " "); got != tt.want {
+				t.Errorf("apkUpgrade = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApkUpgradeDoesNotAlias(t *testing.T) {
+	r := &Rootfs{Path: "/r", cacheDir: "/c"}
+	add := r.apkAdd("a")
+	r.apkUpgrade("b")
+	if want := []string{"/r", "apk", "add", "a"}; !slices.Equal(add, want) {
+		t.Errorf("apkAdd = %q, want %q", add, want)
+	}
+}
+
+func TestBuildTime(t *testing.T) {
+	built := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("alpine", func(t *testing.T) {
+		r := &Rootfs{Path: t.TempDir(), distro: "alpine"}
+		db := filepath.Join(r.Path, "lib", "apk", "db")
+		os.MkdirAll(db, 0755)
+		os.WriteFile(filepath.Join(db, "installed"), []byte(
+			"P:ca-certificates\nV:20240226-r0\nt:1000\n\nP:tzdata\nV:2024a-r0\nt:1709294400\n\n"), 0644)
+
+		got, ok, err := r.buildTime("tzdata")
+		if err != nil || !ok || !got.Equal(built) {
+			t.Errorf("buildTime(tzdata) = %v, %v, %v, want %v", got, ok, err, built)
+		}
+		if _, ok, err := r.buildTime("busybox"); ok || err != nil {
+			t.Errorf("buildTime(busybox) = %v, %v, want not installed", ok, err)
+		}
+	})
+
+	t.Run("debian", func(t *testing.T) {
+		r := &Rootfs{Path: t.TempDir(), distro: "debian"}
+		doc := filepath.Join(r.Path, "usr", "share", "doc", "tzdata")
+		os.MkdirAll(doc, 0755)
+		changelog := filepath.Join(doc, "changelog.Debian.gz")
+		os.WriteFile(changelog, nil, 0644)
+		os.Chtimes(changelog, built, built)
+
+		got, ok, err := r.buildTime("tzdata")
+		if err != nil || !ok || !got.Equal(built) {
+			t.Errorf("buildTime(tzdata) = %v, %v, %v, want %v", got, ok, err, built)
+		}
+		if _, ok, err := r.buildTime("ca-certificates"); ok || err != nil {
+			t.Errorf("buildTime(ca-certificates) = %v, %v, want not installed", ok, err)
+		}
+	})
+}
+
+func TestCheckBaseDataAge(t *testing.T) {
+	r := &Rootfs{Path: t.TempDir(), distro: "alpine"}
+	db := filepath.Join(r.Path, "lib", "apk", "db")
+	os.MkdirAll(db, 0755)
+	recent := time.Now().Add(-24 * time.Hour).Unix()
+	os.WriteFile(filepath.Join(db, "installed"), []byte(
+		"P:ca-certificates\nt:1000\n\nP:tzdata\nt:"+strconv.FormatInt(recent, 10)+"\n\n"), 0644)
+
+	err := r.CheckBaseDataAge(30 * 24 * time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "ca-certificates was built on 1970-01-01") {
+		t.Errorf("CheckBaseDataAge = %v, want ca-certificates reported stale", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "tzdata") {
+		t.Errorf("CheckBaseDataAge = %v, tzdata is recent", err)
+	}
+	if err := r.CheckBaseDataAge(time.Since(time.Unix(0, 0)) + time.Hour); err != nil {
+		t.Errorf("CheckBaseDataAge with a generous max age = %v", err)
+	}
+}
@@ -2,23 +2,33 @@
 package rootfs
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/confine"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/limits"
+	"github.com/talfaza/distrorun/internal/lockfile"
+	"github.com/talfaza/distrorun/internal/netcap"
+	"github.com/talfaza/distrorun/internal/templates"
 	"github.com/talfaza/distrorun/internal/ui"
 	"gopkg.in/yaml.v3"
 )
 
-// alpine base packages needed for a bootable system
+// alpine base packages needed for a bootable system, besides the kernel;
+// see alpinePackages.
 var alpineBasePackages = []string{
 	"alpine-base",
-	"linux-lts",
 	"linux-firmware-none",
 	"mkinitfs",
 	"openrc",
@@ -27,62 +37,237 @@ var alpineBasePackages = []string{
 	"shadow",
 }
 
-// minirootfsURL returns the download URL for the latest Alpine minirootfs.
-func minirootfsURL() string {
-	arch := runtime.GOARCH
-	if arch == "amd64" {
-		arch = "x86_64"
+// alpineVMPackages are added to alpineBasePackages for VM images: the guest
+// agent lets the hypervisor shut the VM down and query it.
+var alpineVMPackages = []string{"qemu-guest-agent"}
+
+// alpineContainerPackages replaces alpineBasePackages for container images,
+// which run on the host's kernel and need no kernel, initramfs or bootloader.
+var alpineContainerPackages = []string{
+	"alpine-base",
+	"bash",
+	"shadow",
+}
+
+// alpineMirror is the base URL of the Alpine package and release mirror
+// used unless the build names another.
+const alpineMirror = "https://dl-cdn.alpinelinux.org/alpine"
+
+// alpineBranchURL returns the mirror URL of the pinned Alpine branch.
+func (r *Rootfs) alpineBranchURL() string {
+	mirror := alpineMirror
+	if r.mirror != "" {
+		mirror = strings.TrimSuffix(r.mirror, "/")
+	}
+	return mirror + "/" + r.branchDir()
+}
+
+// branchDir returns the mirror directory of the release branch.
+func (r *Rootfs) branchDir() string {
+	if r.alpineBranch == "" {
+		return "latest-stable"
+	}
+	return r.alpineBranch
+}
+
+// hostArch returns the architecture of the host in Alpine's naming.
+func hostArch() string {
+	if runtime.GOARCH == "amd64" {
+		return "x86_64"
 	}
-	return fmt.Sprintf(
-		"https://dl-cdn.alpinelinux.org/alpine/latest-stable/releases/%s/latest-releases.yaml",
-		arch,
-	)
+	return runtime.GOARCH
 }
 
 // Rootfs holds the state for a rootfs build.
 type Rootfs struct {
-	Path    string // absolute path to the rootfs directory
-	WorkDir string // parent working directory
-	arch    string
-	distro  string // "alpine" or "fedora"
+	Path     string // absolute path to the rootfs directory
+	WorkDir  string // parent working directory
+	arch     string
+	distro   string // "alpine", "fedora" or "debian"
+	cacheDir string // persistent download cache; "" disables caching
+	ctx      context.Context
+
+	alpineBranch string // mirror branch, e.g. "v3.20"; "" means latest-stable
+	mirror       string // Alpine mirror base URL; "" means alpineMirror
+	repositories []config.Repository
+	localMirror  string // host directory apk installs main and community from; "" uses the mirror
+	offline      bool   // no network: the minirootfs comes from the cache
+	keyring      string // OpenPGP keyring for minirootfs signatures; "" skips the check
+	kernelFlavor string // Alpine kernel flavor installed; "" for a rootfs not bootstrapped here
+
+	lock            *lockfile.File // pinned minirootfs and packages; nil when not reproducible
+	nonfatalScripts []string       // apk packages whose script failures are only warned about
+	minirootfs      string         // minirootfs tarball file name
+	minirootfsSum   string         // its SHA-256
 }
 
-// Bootstrap creates a new Alpine rootfs by downloading the minirootfs tarball,
-// extracting it, setting up chroot mounts, and installing base system packages.
-func Bootstrap(name string) (*Rootfs, error) {
-	arch := runtime.GOARCH
-	if arch == "amd64" {
-		arch = "x86_64"
-	}
+// command returns a command bound to the build's context, so an
+// interrupted build kills it instead of letting it run on.
+func (r *Rootfs) command(name string, arg ...string) *audit.Cmd {
+	return audit.CommandContext(r.context(), name, arg...)
+}
+
+// packageManager is command for package manager runs, which do much of
+// a build's heavy lifting and so run with the limits of build.limits, and
+// in the network namespace of build.network.
+func (r *Rootfs) packageManager(name string, arg ...string) *audit.Cmd {
+	return limits.Apply(netcap.Apply(r.command(name, arg...)))
+}
 
-	workDir := filepath.Join(os.TempDir(), fmt.Sprintf("distrorun-%s", name))
-	rootfsPath := filepath.Join(workDir, "rootfs")
+// confined is command for host helper tools, which run with only the
+// capabilities in keep (see package confine).
+func (r *Rootfs) confined(keep []string, name string, arg ...string) *audit.Cmd {
+	return confine.Command(r.context(), keep, name, arg...)
+}
 
-	// Clean up any stale workdir from a previous (possibly failed) build.
-	if _, err := os.Stat(workDir); err == nil {
-		stale := &Rootfs{Path: rootfsPath, WorkDir: workDir}
-		stale.Unmount()
-		if err := os.RemoveAll(workDir); err != nil {
-			return nil, fmt.Errorf("removing stale workdir: %w", err)
-		}
+// chroot is command for a program of the rootfs, run inside it and in the
+// network namespace of build.network. Arguments reach the program as they
+// are, never through a shell; data for it, such as passwords, goes to its
+// Stdin.
+func (r *Rootfs) chroot(name string, arg ...string) *audit.Cmd {
+	return netcap.Apply(r.command("chroot", append([]string{r.Path, name}, arg...)...))
+}
+
+// context returns the build's context, or Background if it has none.
+func (r *Rootfs) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
 	}
+	return r.ctx
+}
 
-	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
-		return nil, fmt.Errorf("creating rootfs directory: %w", err)
+// systemd reports whether the rootfs uses systemd rather than OpenRC.
+func (r *Rootfs) systemd() bool {
+	return r.distro == "fedora" || r.distro == "debian"
+}
+
+// Options controls how a rootfs is bootstrapped.
+type Options struct {
+	// Context cancels the build: commands run in the rootfs are killed and
+	// no new ones start once it is done. Nil means never canceled.
+	Context context.Context
+
+	// CacheDir is a persistent directory for minirootfs tarballs and apk
+	// packages reused across builds. Empty disables caching.
+	CacheDir string
+
+	// AlpineBranch pins the Alpine release branch ("v3.20", "edge").
+	// Empty follows latest-stable.
+	AlpineBranch string
+
+	// Mirror replaces dl-cdn.alpinelinux.org as the source of the
+	// minirootfs and the main and community repositories, e.g.
+	// "https://mirror.example.com/alpine". Empty uses the CDN.
+	Mirror string
+
+	// Repositories are added to /etc/apk/repositories after main and
+	// community, and their keys installed so apk trusts them.
+	Repositories []config.Repository
+
+	// AlpineKeyring is the OpenPGP keyring a downloaded minirootfs must be
+	// signed by. It must exist, DefaultAlpineKeyring too; empty disables
+	// the check.
+	AlpineKeyring string
+
+	// ConfigHash identifies the configuration being built. It keys the
+	// workdir so concurrent builds never share one.
+	ConfigHash string
+
+	// WorkDir is the directory build workdirs are created in, which must
+	// hold the rootfs and its squashfs. Empty uses os.TempDir().
+	WorkDir string
+
+	// Disk prepares the rootfs to be installed directly onto a disk image
+	// (GRUB, a regular initramfs) instead of booting as a live CD.
+	Disk bool
+
+	// Cmdline holds the kernel parameters written to /etc/default/grub for
+	// disk images, e.g. "quiet".
+	Cmdline string
+
+	// Container prepares the rootfs for an OCI image: no kernel, initramfs
+	// or bootloader. Alpine only.
+	Container bool
+
+	// NonfatalScripts lists apk packages whose failing install scripts or
+	// triggers are reported as warnings instead of failing the install.
+	NonfatalScripts []string
+
+	// VM tunes the image for virtual machines: the linux-virt kernel, the
+	// QEMU guest agent, a getty on the serial console and an initramfs with
+	// only virtio and emulated CD-ROM drivers. Alpine only.
+	VM bool
+
+	// Kernel is the Alpine kernel flavor: "lts", "virt" or "edge". Empty
+	// means lts, or virt with VM, as linux-virt only carries the drivers of
+	// virtual hardware.
+	Kernel string
+
+	// Lock pins the minirootfs, the Alpine branch and every apk package to
+	// the versions of a lock file, for reproducible builds. Alpine only.
+	Lock *lockfile.File
+
+	// LocalMirror is a host directory laid out like an Alpine mirror that
+	// apk installs the main and community packages from, instead of the
+	// repositories the image's /etc/apk/repositories names.
+	LocalMirror string
+
+	// Offline builds without the network: the minirootfs is taken from
+	// the cache and apk never fetches. See OfflineMissing.
+	Offline bool
+}
+
+// Bootstrap creates a new Alpine rootfs by downloading the minirootfs tarball,
+// extracting it, setting up chroot mounts, and installing base system packages.
+func Bootstrap(name string, opts Options) (_ *Rootfs, err error) {
+	arch := hostArch()
+
+	workDir, rootfsPath, err := newWorkDir(opts.WorkDir, name, opts.ConfigHash)
+	if err != nil {
+		return nil, err
 	}
 
 	r := &Rootfs{
-		Path:    rootfsPath,
-		WorkDir: workDir,
-		arch:    arch,
-		distro:  "alpine",
+		Path:     rootfsPath,
+		WorkDir:  workDir,
+		arch:     arch,
+		distro:   "alpine",
+		cacheDir: opts.CacheDir,
+		ctx:      opts.Context,
+
+		alpineBranch: opts.AlpineBranch,
+		mirror:       opts.Mirror,
+		repositories: opts.Repositories,
+		localMirror:  opts.LocalMirror,
+		offline:      opts.Offline,
+		lock:         opts.Lock,
+		kernelFlavor: opts.KernelFlavor(),
+
+		nonfatalScripts: opts.NonfatalScripts,
+	}
+	// The caller can only clean up a rootfs it gets back: undo the mounts
+	// of one that fails part way.
+	defer func() {
+		if err != nil {
+			r.Cleanup(true)
+		}
+	}()
+	if opts.Lock != nil {
+		r.alpineBranch = opts.Lock.Branch
+	}
+	if r.keyring, err = keyringFor(opts.AlpineKeyring); err != nil {
+		return nil, err
 	}
 
-	// Step 1: Download minirootfs tarball
-	tarball := filepath.Join(workDir, "minirootfs.tar.gz")
-	if err := r.downloadMinirootfs(tarball); err != nil {
+	// Step 1: Download minirootfs tarball (or reuse a verified cached copy)
+	tarball, err := r.downloadMinirootfs(filepath.Join(workDir, "minirootfs.tar.gz"))
+	if err != nil {
 		return nil, err
 	}
+	r.minirootfs = filepath.Base(tarball)
+	if r.minirootfsSum, err = fsutil.SHA256File(tarball); err != nil {
+		return nil, fmt.Errorf("hashing minirootfs: %w", err)
+	}
 
 	// Step 2: Extract tarball
 	if err := r.extractTarball(tarball); err != nil {
@@ -94,13 +279,21 @@ func Bootstrap(name string) (*Rootfs, error) {
 		return nil, err
 	}
 
+	// Step 3b: Share the host apk cache and local mirror with the chroot
+	if err := r.mountApkCache(); err != nil {
+		return nil, err
+	}
+	if err := r.mountLocalMirror(); err != nil {
+		return nil, err
+	}
+
 	// Step 4: Copy DNS resolution config
 	if err := r.copyResolv(); err != nil {
 		return nil, err
 	}
 
 	// Step 5: Update apk repos and install base packages
-	if err := r.installBaseSystem(); err != nil {
+	if err := r.installBaseSystem(alpinePackages(opts)); err != nil {
 		return nil, err
 	}
 
@@ -112,8 +305,25 @@ func Bootstrap(name string) (*Rootfs, error) {
 	// Step 5c: Write custom /etc/os-release
 	r.configureOSRelease(name)
 
+	if opts.Container {
+		return r, nil
+	}
+	if opts.VM {
+		if err := r.configureVM(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Disk images boot the installed rootfs directly: no live init needed.
+	if opts.Disk {
+		if err := r.configureDiskBoot(opts.Cmdline, opts.VM); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
 	// Step 6: Configure mkinitfs for live CD and generate initramfs
-	if err := r.configureMkinitfs(); err != nil {
+	if err := r.configureMkinitfs(opts.VM); err != nil {
 		return nil, err
 	}
 	if err := r.generateInitramfs(); err != nil {
@@ -128,89 +338,181 @@ func Bootstrap(name string) (*Rootfs, error) {
 	return r, nil
 }
 
+// KernelFlavor returns the Alpine kernel flavor of opts.
+func (o Options) KernelFlavor() string {
+	switch {
+	case o.Kernel != "":
+		return o.Kernel
+	case o.VM:
+		return "virt"
+	default:
+		return "lts"
+	}
+}
+
+// alpinePackages returns the base system of an Alpine rootfs for opts.
+func alpinePackages(opts Options) []string {
+	if opts.Container {
+		return alpineContainerPackages
+	}
+	pkgs := slices.Concat(alpineBasePackages, []string{"linux-" + opts.KernelFlavor()})
+	if opts.VM {
+		pkgs = append(pkgs, alpineVMPackages...)
+	}
+	return pkgs
+}
+
 // alpineRelease represents one entry in Alpine's latest-releases.yaml.
 type alpineRelease struct {
 	Flavor string `yaml:"flavor"`
 	File   string `yaml:"file"`
+	Sha256 string `yaml:"sha256"`
 }
 
 // downloadMinirootfs fetches the Alpine minirootfs tarball by first querying
-// latest-releases.yaml to discover the current filename dynamically.
-func (r *Rootfs) downloadMinirootfs(dest string) error {
-	baseURL := fmt.Sprintf(
-		"https://dl-cdn.alpinelinux.org/alpine/latest-stable/releases/%s", r.arch)
+// latest-releases.yaml to discover the current filename dynamically, and
+// returns the path of the tarball to extract. A cached tarball whose SHA-256
+// matches the release index is reused; if the index cannot be fetched the
+// newest verified cached tarball is used so repeat builds work offline.
+// A lock file names the tarball and its checksum, and no index is fetched.
+func (r *Rootfs) downloadMinirootfs(dest string) (string, error) {
+	baseURL := fmt.Sprintf("%s/releases/%s", r.alpineBranchURL(), r.arch)
+	if r.lock != nil {
+		return r.fetchMinirootfs(baseURL, r.lock.Minirootfs, r.lock.MinirootfsSHA256, dest)
+	}
+	if r.offline {
+		// OfflineMissing made sure there is one.
+		cached := r.latestCachedMinirootfs()
+		if p, ok := r.cachedMinirootfs(cached, ""); ok {
+			ui.SubStep("Using cached minirootfs (offline)")
+			ui.Detail(p)
+			return p, nil
+		}
+		return "", fmt.Errorf("offline: no verified minirootfs of %s in the cache", r.branchDir())
+	}
 
 	// Fetch the releases index to find the minirootfs filename
 	releasesURL := baseURL + "/latest-releases.yaml"
 	ui.SubStep("Fetching release index...")
 	ui.URL(releasesURL)
 
-	resp, err := http.Get(releasesURL)
+	releases, err := fetchReleases(releasesURL)
 	if err != nil {
-		return fmt.Errorf("fetching releases index: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("fetching releases index: HTTP %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("reading releases index: %w", err)
-	}
-
-	var releases []alpineRelease
-	if err := yaml.Unmarshal(body, &releases); err != nil {
-		return fmt.Errorf("parsing releases index: %w", err)
+		if cached := r.latestCachedMinirootfs(); cached != "" {
+			if p, ok := r.cachedMinirootfs(cached, ""); ok {
+				ui.Warn("Release index unavailable, using cached " + cached)
+				return p, nil
+			}
+		}
+		return "", err
 	}
 
 	// Find the minirootfs entry
-	var filename string
+	var filename, sum string
 	for _, rel := range releases {
 		if rel.Flavor == "alpine-minirootfs" {
 			filename = rel.File
+			sum = rel.Sha256
 			break
 		}
 	}
 	if filename == "" {
-		return fmt.Errorf("minirootfs entry not found in releases index")
+		return "", fmt.Errorf("minirootfs entry not found in releases index")
+	}
+	if sum == "" {
+		return "", fmt.Errorf("releases index has no sha256 for %s", filename)
+	}
+	return r.fetchMinirootfs(baseURL, filename, sum, dest)
+}
+
+// fetchMinirootfs returns a cached copy of the minirootfs tarball filename
+// matching sum, or downloads it from baseURL to dest and verifies its
+// checksum and signature. Only verified tarballs are cached.
+func (r *Rootfs) fetchMinirootfs(baseURL, filename, sum, dest string) (string, error) {
+	if p, ok := r.cachedMinirootfs(filename, sum); ok {
+		ui.SubStep("Using cached minirootfs (sha256 verified)")
+		ui.Detail(p)
+		return p, nil
 	}
 
 	tarballURL := baseURL + "/" + filename
 	ui.SubStep("Downloading minirootfs...")
 	ui.URL(tarballURL)
 
-	resp2, err := http.Get(tarballURL)
+	resp, err := netcap.Client().Get(tarballURL)
 	if err != nil {
-		return fmt.Errorf("downloading minirootfs: %w", err)
+		return "", fmt.Errorf("downloading minirootfs: %w", err)
 	}
-	defer resp2.Body.Close()
+	defer resp.Body.Close()
 
-	if resp2.StatusCode != http.StatusOK {
-		return fmt.Errorf("downloading minirootfs: HTTP %d", resp2.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading minirootfs: HTTP %d", resp.StatusCode)
 	}
 
-	f, err := os.Create(dest)
+	f, err := audit.Create(dest)
 	if err != nil {
-		return fmt.Errorf("creating tarball file: %w", err)
+		return "", fmt.Errorf("creating tarball file: %w", err)
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(f, resp2.Body); err != nil {
-		return fmt.Errorf("writing tarball: %w", err)
+	progress := ui.NewTransfer(resp.ContentLength)
+	if _, err := io.Copy(f, io.TeeReader(resp.Body, progress)); err != nil {
+		return "", fmt.Errorf("writing tarball: %w", err)
 	}
+	progress.Done()
 
-	return nil
+	got, err := fsutil.SHA256File(dest)
+	if err != nil {
+		return "", fmt.Errorf("hashing tarball: %w", err)
+	}
+	if !strings.EqualFold(got, sum) {
+		return "", fmt.Errorf("minirootfs checksum mismatch: got %s, want %s", got, sum)
+	}
+	if err := r.verifySignature(dest, tarballURL); err != nil {
+		return "", err
+	}
+	r.storeMinirootfs(dest, filename, got)
+
+	return dest, nil
+}
+
+// fetchReleases downloads and parses an Alpine latest-releases.yaml index.
+func fetchReleases(url string) ([]alpineRelease, error) {
+	resp, err := netcap.Client().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching releases index: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching releases index: HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading releases index: %w", err)
+	}
+
+	var releases []alpineRelease
+	if err := yaml.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("parsing releases index: %w", err)
+	}
+	return releases, nil
 }
 
 // extractTarball extracts the minirootfs tarball into the rootfs directory.
 func (r *Rootfs) extractTarball(tarball string) error {
 	ui.SubStep("Extracting minirootfs...")
-	cmd := exec.Command("tar", "xzf", tarball, "-C", r.Path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("extracting tarball: %w", err)
+	}
+	if err := extractTar(gz, r.Path); err != nil {
 		return fmt.Errorf("extracting tarball: %w", err)
 	}
 	return nil
@@ -231,15 +533,15 @@ func (r *Rootfs) setupChrootMounts() error {
 	}
 
 	for _, m := range mounts {
-		if err := os.MkdirAll(m.target, 0755); err != nil {
+		if err := audit.MkdirAll(m.target, 0755); err != nil {
 			return fmt.Errorf("creating mount point %s: %w", m.target, err)
 		}
 
-		var cmd *exec.Cmd
+		var cmd *audit.Cmd
 		if m.fstype != "" {
-			cmd = exec.Command("mount", "-t", m.fstype, m.src, m.target)
+			cmd = r.command("mount", "-t", m.fstype, m.src, m.target)
 		} else {
-			cmd = exec.Command("mount", "--bind", m.src, m.target)
+			cmd = r.command("mount", "--bind", m.src, m.target)
 		}
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("mounting %s: %w", m.target, err)
@@ -259,38 +561,81 @@ func (r *Rootfs) copyResolv() error {
 		return fmt.Errorf("reading host resolv.conf: %w", err)
 	}
 
-	if err := os.WriteFile(dest, data, 0644); err != nil {
+	if err := audit.WriteFile(dest, data, 0644); err != nil {
 		return fmt.Errorf("writing rootfs resolv.conf: %w", err)
 	}
 
 	return nil
 }
 
+// installRepositoryKeys copies the signing keys of the extra repositories
+// to /etc/apk/keys under their own names, which is how apk finds them.
+func (r *Rootfs) installRepositoryKeys() error {
+	for _, repo := range r.repositories {
+		if repo.Key == "" {
+			continue
+		}
+		if err := audit.MkdirAll(filepath.Join(r.Path, "etc", "apk", "keys"), 0755); err != nil {
+			return fmt.Errorf("creating apk keys dir: %w", err)
+		}
+		dest := filepath.Join(r.Path, "etc", "apk", "keys", filepath.Base(repo.Key))
+		if err := fsutil.CopyFile(repo.Key, dest); err != nil {
+			return fmt.Errorf("installing key for %s: %w", repo.URL, err)
+		}
+		ui.Detail("Trusting " + filepath.Base(repo.Key) + " for " + repo.URL)
+	}
+	return nil
+}
+
+// repositoriesTemplate is the built-in /etc/apk/repositories: main and
+// community of the release branch, then the configured repositories.
+const repositoriesTemplate = `{{.Branch}}/main
+{{.Branch}}/community
+{{range .Extra}}{{.}}
+{{end}}`
+
 // installBaseSystem updates apk repositories and installs the base system packages.
-func (r *Rootfs) installBaseSystem() error {
+func (r *Rootfs) installBaseSystem(packages []string) error {
 	ui.SubStep("Installing base system packages...")
 
 	// Set up repositories
 	reposPath := filepath.Join(r.Path, "etc", "apk", "repositories")
-	repos := "https://dl-cdn.alpinelinux.org/alpine/latest-stable/main\nhttps://dl-cdn.alpinelinux.org/alpine/latest-stable/community\n"
-	if err := os.MkdirAll(filepath.Dir(reposPath), 0755); err != nil {
+	var extra []string
+	for _, repo := range r.repositories {
+		extra = append(extra, repo.URL)
+	}
+	repos, err := templates.Render(templates.Repositories, repositoriesTemplate, struct {
+		Branch string   // URL of the release branch, e.g. https://dl-cdn.alpinelinux.org/alpine/v3.20
+		Extra  []string // URLs of distro.repositories
+	}{r.alpineBranchURL(), extra})
+	if err != nil {
+		return err
+	}
+	if err := audit.MkdirAll(filepath.Dir(reposPath), 0755); err != nil {
 		return fmt.Errorf("creating apk dir: %w", err)
 	}
-	if err := os.WriteFile(reposPath, []byte(repos), 0644); err != nil {
+	if err := r.installRepositoryKeys(); err != nil {
+		return err
+	}
+	if err := audit.WriteFile(reposPath, []byte(repos), 0644); err != nil {
 		return fmt.Errorf("writing repositories: %w", err)
 	}
 
 	// apk update
-	cmd := exec.Command("chroot", r.Path, "apk", "update")
+	cmd := r.packageManager("chroot", r.apk("update")...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("apk update: %w", err)
+		if r.cacheDir == "" {
+			return fmt.Errorf("apk update: %w", err)
+		}
+		// The cache holds the last fetched APKINDEX, so apk can still
+		// resolve packages that were downloaded by a previous build.
+		ui.Warn("apk update failed, continuing with cached package index")
 	}
 
 	// Install base packages
-	args := append([]string{r.Path, "apk", "add", "--no-cache"}, alpineBasePackages...)
-	cmd = exec.Command("chroot", args...)
+	cmd = r.packageManager("chroot", r.apkAdd(packages...)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -312,20 +657,20 @@ auto eth0
 iface eth0 inet dhcp
 `
 	ifacePath := filepath.Join(r.Path, "etc", "network", "interfaces")
-	if err := os.MkdirAll(filepath.Dir(ifacePath), 0755); err != nil {
+	if err := audit.MkdirAll(filepath.Dir(ifacePath), 0755); err != nil {
 		return fmt.Errorf("creating network dir: %w", err)
 	}
-	if err := os.WriteFile(ifacePath, []byte(interfaces), 0644); err != nil {
+	if err := audit.WriteFile(ifacePath, []byte(interfaces), 0644); err != nil {
 		return fmt.Errorf("writing interfaces: %w", err)
 	}
 
 	// Write hostname from config name
 	hostnamePath := filepath.Join(r.Path, "etc", "hostname")
-	os.WriteFile(hostnamePath, []byte(name+"\n"), 0644)
+	audit.WriteFile(hostnamePath, []byte(name+"\n"), 0644)
 
 	// Enable networking and hostname services
 	for _, svc := range []string{"networking", "hostname"} {
-		cmd := exec.Command("chroot", r.Path, "rc-update", "add", svc, "boot")
+		cmd := r.command("chroot", r.Path, "rc-update", "add", svc, "boot")
 		_ = cmd.Run() // best-effort
 	}
 
@@ -345,32 +690,134 @@ PRETTY_NAME="%s (built with DistroRun)"
 HOME_URL="https://github.com/talfaza/distrorun"
 BUG_REPORT_URL="https://github.com/talfaza/distrorun/issues"
 `, name, id, name)
-	os.WriteFile(filepath.Join(r.Path, "etc", "os-release"), []byte(osRelease), 0644)
+	audit.WriteFile(filepath.Join(r.Path, "etc", "os-release"), []byte(osRelease), 0644)
 
 	// /etc/issue — the login banner (what shows "Welcome to ...")
 	issue := fmt.Sprintf("Welcome to %s (built with DistroRun)\nKernel \\r on \\m (\\l)\n\n", name)
-	os.WriteFile(filepath.Join(r.Path, "etc", "issue"), []byte(issue), 0644)
+	audit.WriteFile(filepath.Join(r.Path, "etc", "issue"), []byte(issue), 0644)
 
 	// /etc/motd — message after login
 	motd := fmt.Sprintf("\n  %s — Powered by DistroRun\n\n", name)
-	os.WriteFile(filepath.Join(r.Path, "etc", "motd"), []byte(motd), 0644)
+	audit.WriteFile(filepath.Join(r.Path, "etc", "motd"), []byte(motd), 0644)
 }
 
-// configureMkinitfs sets up mkinitfs.conf with features needed for live CD boot.
-func (r *Rootfs) configureMkinitfs() error {
-	ui.SubStep("Configuring mkinitfs for live CD...")
+// configureVM enables the QEMU guest agent and a login prompt on the first
+// serial port, where VMs are often reached before their network is up.
+func (r *Rootfs) configureVM() error {
+	ui.SubStep("Configuring for virtual machines (guest agent, serial console)...")
+	if err := r.command("chroot", r.Path, "rc-update", "add", "qemu-guest-agent", "default").Run(); err != nil {
+		return fmt.Errorf("enabling qemu-guest-agent: %w", err)
+	}
+	return r.appendLine("etc/inittab", "ttyS0::respawn:/sbin/getty -L 115200 ttyS0 vt100")
+}
 
-	// Features needed for live CD: cdrom, scsi, squashfs, loop, virtio
-	confPath := filepath.Join(r.Path, "etc", "mkinitfs", "mkinitfs.conf")
-	features := `features="ata base cdrom scsi squashfs usb virtio loop network"
+// mkinitfsLiveTemplate is the built-in mkinitfs.conf of live images. Live
+// CDs need cdrom, scsi, squashfs, loop, virtio, and ext4 for the
+// persistence partition. VMs attach the ISO as an IDE or virtio CD-ROM and
+// have no USB or SCSI disks to boot from.
+const mkinitfsLiveTemplate = `features="ata base cdrom ext4 {{if not .VM}}scsi {{end}}squashfs {{if not .VM}}usb {{end}}virtio loop network"
+`
+
+// mkinitfsDiskTemplate is the built-in mkinitfs.conf of disk images; VM
+// images only get the virtio drivers.
+const mkinitfsDiskTemplate = `{{if .VM}}features="base ext4 scsi virtio"{{else}}features="ata base ext4 keymap kms mmc nvme scsi usb virtio"{{end}}
 `
-	if err := os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+
+// writeMkinitfsConf renders the mkinitfs.conf template called name.
+func (r *Rootfs) writeMkinitfsConf(name, builtin string, vm bool) error {
+	conf, err := templates.Render(name, builtin, struct{ VM bool }{vm})
+	if err != nil {
+		return err
+	}
+	confPath := filepath.Join(r.Path, "etc", "mkinitfs", "mkinitfs.conf")
+	if err := audit.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
 		return fmt.Errorf("creating mkinitfs dir: %w", err)
 	}
-	if err := os.WriteFile(confPath, []byte(features), 0644); err != nil {
+	if err := audit.WriteFile(confPath, []byte(conf), 0644); err != nil {
 		return fmt.Errorf("writing mkinitfs.conf: %w", err)
 	}
+	return nil
+}
 
+// configureMkinitfs sets up mkinitfs.conf with features needed for live CD boot.
+func (r *Rootfs) configureMkinitfs(vm bool) error {
+	ui.SubStep("Configuring mkinitfs for live CD...")
+	return r.writeMkinitfsConf(templates.MkinitfsLive, mkinitfsLiveTemplate, vm)
+}
+
+// alpineDiskGrubDefaults is /etc/default/grub for disk images. Alpine's
+// initramfs only loads the modules listed in "modules=" before mounting root;
+// the user's kernel parameters follow them.
+const alpineDiskGrubDefaults = `GRUB_TIMEOUT=2
+GRUB_DISABLE_SUBMENU=y
+GRUB_DISABLE_RECOVERY=true
+GRUB_CMDLINE_LINUX_DEFAULT="modules=sd-mod,usb-storage,virtio_blk,ext4 %s"
+`
+
+// alpineVMGrubDefaults is alpineDiskGrubDefaults for VM images, which boot
+// from a virtio disk.
+const alpineVMGrubDefaults = `GRUB_TIMEOUT=2
+GRUB_DISABLE_SUBMENU=y
+GRUB_DISABLE_RECOVERY=true
+GRUB_CMDLINE_LINUX_DEFAULT="modules=sd-mod,virtio_blk,ext4 %s"
+`
+
+// configureDiskBoot installs GRUB and a regular (non-live) initramfs so the
+// rootfs can boot from a partition on a disk image. VM images only get the
+// virtio drivers.
+func (r *Rootfs) configureDiskBoot(cmdline string, vm bool) error {
+	ui.SubStep("Configuring disk boot (GRUB, mkinitfs)...")
+
+	grubDefaults := alpineDiskGrubDefaults
+	if vm {
+		grubDefaults = alpineVMGrubDefaults
+	}
+	if err := r.writeMkinitfsConf(templates.MkinitfsDisk, mkinitfsDiskTemplate, vm); err != nil {
+		return err
+	}
+
+	grubPath := filepath.Join(r.Path, "etc", "default", "grub")
+	if err := audit.MkdirAll(filepath.Dir(grubPath), 0755); err != nil {
+		return fmt.Errorf("creating /etc/default: %w", err)
+	}
+	if err := audit.WriteFile(grubPath, []byte(fmt.Sprintf(grubDefaults, cmdline)), 0644); err != nil {
+		return fmt.Errorf("writing /etc/default/grub: %w", err)
+	}
+
+	cmd := r.packageManager("chroot", r.apkAdd("grub", "grub-bios")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("installing grub: %w", err)
+	}
+
+	return r.generateInitramfs()
+}
+
+// setGrubCmdline sets GRUB_CMDLINE_LINUX_DEFAULT in /etc/default/grub, which
+// grub-mkconfig reads when the disk image is assembled. Other settings are
+// kept; the file is created if the distro ships none.
+func (r *Rootfs) setGrubCmdline(cmdline string) error {
+	grubPath := filepath.Join(r.Path, "etc", "default", "grub")
+	data, err := os.ReadFile(grubPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading /etc/default/grub: %w", err)
+	}
+	var lines []string
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			if !strings.HasPrefix(line, "GRUB_CMDLINE_LINUX_DEFAULT=") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(lines, `GRUB_CMDLINE_LINUX_DEFAULT="`+cmdline+`"`)
+	if err := audit.MkdirAll(filepath.Dir(grubPath), 0755); err != nil {
+		return fmt.Errorf("creating /etc/default: %w", err)
+	}
+	if err := audit.WriteFile(grubPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing /etc/default/grub: %w", err)
+	}
 	return nil
 }
 
@@ -378,28 +825,16 @@ func (r *Rootfs) configureMkinitfs() error {
 func (r *Rootfs) generateInitramfs() error {
 	ui.SubStep("Generating initramfs...")
 
-	// Find kernel version from /lib/modules/
-	modulesDir := filepath.Join(r.Path, "lib", "modules")
-	entries, err := os.ReadDir(modulesDir)
+	flavor, err := r.installedFlavor()
 	if err != nil {
-		return fmt.Errorf("reading modules directory: %w", err)
-	}
-
-	var kernelVersion string
-	for _, e := range entries {
-		if e.IsDir() && strings.Contains(e.Name(), "lts") {
-			kernelVersion = e.Name()
-			break
-		}
-	}
-	if kernelVersion == "" && len(entries) > 0 {
-		kernelVersion = entries[0].Name()
+		return err
 	}
-	if kernelVersion == "" {
-		return fmt.Errorf("no kernel modules found in %s", modulesDir)
+	kernelVersion, err := kernelRelease(filepath.Join(r.Path, "lib", "modules"), flavor)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command("chroot", r.Path, "mkinitfs", kernelVersion)
+	cmd := r.command("chroot", r.Path, "mkinitfs", kernelVersion)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -409,10 +844,65 @@ func (r *Rootfs) generateInitramfs() error {
 	return nil
 }
 
+// AlpineKernelFiles returns the flavor of the installed kernel ("lts",
+// "virt" or "edge") and the absolute paths of its vmlinuz and initramfs. Used by the
+// bootloader.
+func (r *Rootfs) AlpineKernelFiles() (flavor, vmlinuz, initramfs string, err error) {
+	if flavor, err = r.installedFlavor(); err != nil {
+		return "", "", "", err
+	}
+	bootDir := filepath.Join(r.Path, "boot")
+	vmlinuz = filepath.Join(bootDir, "vmlinuz-"+flavor)
+	if _, err := os.Stat(vmlinuz); err != nil {
+		return "", "", "", fmt.Errorf("vmlinuz not found: %w", err)
+	}
+	initramfs = filepath.Join(bootDir, "initramfs-"+flavor)
+	if _, err := os.Stat(initramfs); err != nil {
+		return "", "", "", fmt.Errorf("initramfs not found: %w", err)
+	}
+	return flavor, vmlinuz, initramfs, nil
+}
+
+// installedFlavor returns the flavor of the kernel to boot: the configured
+// one for a rootfs bootstrapped here, otherwise that of the first kernel
+// in /boot.
+func (r *Rootfs) installedFlavor() (string, error) {
+	if r.kernelFlavor != "" {
+		return r.kernelFlavor, nil
+	}
+	bootDir := filepath.Join(r.Path, "boot")
+	matches, _ := filepath.Glob(filepath.Join(bootDir, "vmlinuz-*"))
+	if len(matches) == 0 {
+		return "", fmt.Errorf("vmlinuz not found in %s", bootDir)
+	}
+	return strings.TrimPrefix(filepath.Base(matches[0]), "vmlinuz-"), nil
+}
+
+// kernelRelease returns the release of the installed kernel of flavor.
+// Module directories are named after the release, which ends in the
+// flavor, e.g. "6.6.30-0-lts".
+func kernelRelease(modulesDir, flavor string) (string, error) {
+	entries, err := os.ReadDir(modulesDir)
+	if err != nil {
+		return "", fmt.Errorf("reading modules directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasSuffix(e.Name(), "-"+flavor) {
+			return e.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no kernel modules for linux-%s found in %s", flavor, modulesDir)
+}
+
 // ChrootExec runs an arbitrary command inside the rootfs chroot.
 func (r *Rootfs) ChrootExec(name string, args ...string) error {
-	chrootArgs := append([]string{r.Path, name}, args...)
-	cmd := exec.Command("chroot", chrootArgs...)
+	return r.ChrootExecInput(nil, name, args...)
+}
+
+// ChrootExecInput is ChrootExec with stdin connected to the command.
+func (r *Rootfs) ChrootExecInput(stdin io.Reader, name string, args ...string) error {
+	cmd := r.chroot(name, args...)
+	cmd.Stdin = stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
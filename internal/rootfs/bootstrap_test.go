@@ -0,0 +1,98 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKernelFlavor(t *testing.T) {
+	tests := map[string]struct {
+		opts Options
+		want string
+	}{
+		"default":       {Options{}, "lts"},
+		"vm":            {Options{VM: true}, "virt"},
+		"configured":    {Options{Kernel: "edge"}, "edge"},
+		"configured vm": {Options{Kernel: "lts", VM: true}, "lts"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.opts.KernelFlavor(); got != tt.want {
+				t.Errorf("KernelFlavor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlpinePackages(t *testing.T) {
+	tests := map[string]struct {
+		opts      Options
+		want, not []string
+		container bool
+	}{
+		"iso":       {opts: Options{}, want: []string{"linux-lts"}, not: []string{"linux-virt", "qemu-guest-agent"}},
+		"vm":        {opts: Options{VM: true}, want: []string{"linux-virt", "qemu-guest-agent"}, not: []string{"linux-lts"}},
+		"edge":      {opts: Options{Kernel: "edge"}, want: []string{"linux-edge"}, not: []string{"linux-lts"}},
+		"container": {opts: Options{Container: true, Kernel: "edge"}, not: []string{"linux-edge", "linux-lts"}, container: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := alpinePackages(tt.opts)
+			for _, p := range tt.want {
+				if !slices.Contains(got, p) {
+					t.Errorf("alpinePackages = %v, want %s", got, p)
+				}
+			}
+			for _, p := range tt.not {
+				if slices.Contains(got, p) {
+					t.Errorf("alpinePackages = %v, want no %s", got, p)
+				}
+			}
+			if tt.container && !slices.Equal(got, alpineContainerPackages) {
+				t.Errorf("alpinePackages = %v, want %v", got, alpineContainerPackages)
+			}
+		})
+	}
+
+	// The kernel is appended to a copy, never to alpineBasePackages itself.
+	base := slices.Clone(alpineBasePackages)
+	alpinePackages(Options{VM: true})
+	if !slices.Equal(alpineBasePackages, base) {
+		t.Errorf("alpinePackages changed alpineBasePackages to %v", alpineBasePackages)
+	}
+}
+
+func TestKernelRelease(t *testing.T) {
+	r := &Rootfs{Path: t.TempDir()}
+	for _, d := range []string{"lib/modules/6.6.30-0-lts", "lib/modules/6.6.31-0-virt"} {
+		os.MkdirAll(filepath.Join(r.Path, d), 0755)
+	}
+	for _, f := range []string{"boot/vmlinuz-lts", "boot/vmlinuz-virt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(r.Path, f)), 0755)
+		os.WriteFile(filepath.Join(r.Path, f), nil, 0644)
+	}
+	modules := filepath.Join(r.Path, "lib", "modules")
+
+	for flavor, want := range map[string]string{"lts": "6.6.30-0-lts", "virt": "6.6.31-0-virt"} {
+		r.kernelFlavor = flavor
+		got, err := r.installedFlavor()
+		if err != nil || got != flavor {
+			t.Errorf("installedFlavor = %q, %v; want %q", got, err, flavor)
+		}
+		if got, err := kernelRelease(modules, got); err != nil || got != want {
+			t.Errorf("kernelRelease(%s) = %q, %v; want %q", flavor, got, err, want)
+		}
+	}
+	if _, err := kernelRelease(modules, "edge"); err == nil || !strings.Contains(err.Error(), "linux-edge") {
+		t.Errorf("kernelRelease(edge) = %v, want an error naming linux-edge", err)
+	}
+
+	// A rootfs not bootstrapped here boots the first kernel in /boot.
+	r.kernelFlavor = ""
+	if got, err := r.installedFlavor(); err != nil || got != "lts" {
+		t.Errorf("installedFlavor = %q, %v; want lts", got, err)
+	}
+}
@@ -0,0 +1,179 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+	"github.com/talfaza/distrorun/internal/vulnscan"
+)
+
+// DefaultCacheDir is the persistent cache shared by all builds on the host.
+const DefaultCacheDir = "/var/cache/distrorun"
+
+// apkCacheMount is where apk looks for its package cache inside the rootfs.
+// apk only caches when this directory exists.
+const apkCacheMount = "etc/apk/cache"
+
+// minirootfsCacheDir returns the directory holding cached minirootfs tarballs.
+func (r *Rootfs) minirootfsCacheDir() string {
+	return filepath.Join(r.cacheDir, "minirootfs", r.arch)
+}
+
+// cachedMinirootfs returns the cached tarball for filename if its SHA-256
+// matches want. An empty want accepts any tarball whose recorded checksum
+// still matches, which is what offline builds rely on.
+func (r *Rootfs) cachedMinirootfs(filename, want string) (string, bool) {
+	if r.cacheDir == "" {
+		return "", false
+	}
+	p := filepath.Join(r.minirootfsCacheDir(), filename)
+	if want == "" {
+		recorded, err := os.ReadFile(p + ".sha256")
+		if err != nil {
+			return "", false
+		}
+		want = strings.TrimSpace(string(recorded))
+	}
+	got, err := fsutil.SHA256File(p)
+	if err != nil || !strings.EqualFold(got, want) {
+		return "", false
+	}
+	return p, true
+}
+
+// latestCachedMinirootfs returns the filename of the newest cached tarball
+// of the pinned branch, or "" if the cache holds none.
+func (r *Rootfs) latestCachedMinirootfs() string {
+	pattern := "alpine-minirootfs-*.tar.gz"
+	if v, ok := strings.CutPrefix(r.alpineBranch, "v"); ok {
+		pattern = "alpine-minirootfs-" + v + ".*.tar.gz"
+	}
+	matches, _ := filepath.Glob(filepath.Join(r.minirootfsCacheDir(), pattern))
+	if len(matches) == 0 {
+		return ""
+	}
+	return filepath.Base(slices.MaxFunc(matches, func(a, b string) int {
+		return vulnscan.CompareVersions(minirootfsVersion(a), minirootfsVersion(b))
+	}))
+}
+
+// minirootfsVersion returns the Alpine release of a minirootfs tarball, e.g.
+// "3.20.3" for "alpine-minirootfs-3.20.3-x86_64.tar.gz".
+func minirootfsVersion(file string) string {
+	v := strings.TrimPrefix(filepath.Base(file), "alpine-minirootfs-")
+	v, _, _ = strings.Cut(v, "-")
+	return v
+}
+
+// storeMinirootfs copies a verified tarball into the cache and records its checksum.
+func (r *Rootfs) storeMinirootfs(src, filename, sum string) {
+	if r.cacheDir == "" {
+		return
+	}
+	dir := r.minirootfsCacheDir()
+	if err := audit.MkdirAll(dir, 0755); err != nil {
+		ui.Warn("Cannot create cache directory: " + err.Error())
+		return
+	}
+	dst := filepath.Join(dir, filename)
+	if err := fsutil.CopyFile(src, dst); err != nil {
+		ui.Warn("Cannot cache minirootfs: " + err.Error())
+		return
+	}
+	audit.WriteFile(dst+".sha256", []byte(sum+"\n"), 0644)
+}
+
+// mountApkCache bind-mounts the host apk cache into the rootfs so packages
+// downloaded by one build are reused by the next.
+func (r *Rootfs) mountApkCache() error {
+	if r.cacheDir == "" {
+		return nil
+	}
+	src := filepath.Join(r.cacheDir, "apk", r.arch)
+	target := filepath.Join(r.Path, apkCacheMount)
+	for _, d := range []string{src, target} {
+		if err := audit.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("creating %s: %w", d, err)
+		}
+	}
+	ui.SubStep("Mounting apk package cache...")
+	ui.Detail(src)
+	if err := r.command("mount", "--bind", src, target).Run(); err != nil {
+		return fmt.Errorf("mounting apk cache: %w", err)
+	}
+	return nil
+}
+
+// localMirrorMount is where the local mirror is mounted inside the rootfs
+// during the build.
+const localMirrorMount = "media/distrorun-mirror"
+
+// mountLocalMirror bind-mounts the local mirror read-only into the rootfs.
+func (r *Rootfs) mountLocalMirror() error {
+	if r.localMirror == "" {
+		return nil
+	}
+	target := filepath.Join(r.Path, localMirrorMount)
+	if err := audit.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", target, err)
+	}
+	ui.SubStep("Mounting local mirror...")
+	ui.Detail(r.localMirror)
+	if err := r.command("mount", "--bind", "-o", "ro", r.localMirror, target).Run(); err != nil {
+		return fmt.Errorf("mounting local mirror: %w", err)
+	}
+	return nil
+}
+
+// apk returns the chroot arguments for the apk command args. With a local
+// mirror, apk reads the main and community repositories from its mount
+// instead of /etc/apk/repositories, which keeps naming the image's mirror;
+// offline, it uses only the mirror and the cached indexes.
+func (r *Rootfs) apk(args ...string) []string {
+	out := []string{r.Path, "apk"}
+	if r.localMirror != "" {
+		branch := "/" + localMirrorMount + "/" + r.branchDir()
+		out = append(out, "--repositories-file", "/dev/null", "-X", branch+"/main", "-X", branch+"/community")
+		for _, repo := range r.repositories {
+			out = append(out, "-X", repo.URL)
+		}
+	}
+	if r.offline {
+		out = append(out, "--no-network")
+	}
+	return append(out, args...)
+}
+
+// apkAdd returns the chroot arguments for "apk add" of pkgs. The package
+// cache is only bypassed when no host cache is mounted. With a lock file,
+// each package is pinned to its locked version.
+func (r *Rootfs) apkAdd(pkgs ...string) []string {
+	return r.apkInstall([]string{"add"}, pkgs)
+}
+
+// apkUpgrade is apkAdd for packages that may already be installed: without
+// --upgrade, apk add leaves them at their current version.
+func (r *Rootfs) apkUpgrade(pkgs ...string) []string {
+	return r.apkInstall([]string{"add", "--upgrade"}, pkgs)
+}
+
+// apkInstall returns the chroot arguments for the apk command cmd with pkgs.
+func (r *Rootfs) apkInstall(cmd, pkgs []string) []string {
+	args := r.apk(cmd...)
+	if r.cacheDir == "" {
+		args = append(args, "--no-cache")
+	}
+	for _, p := range pkgs {
+		if v, ok := r.lockedVersion(p); ok {
+			p += "=" + v
+		}
+		args = append(args, p)
+	}
+	return args
+}
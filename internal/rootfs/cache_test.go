@@ -0,0 +1,32 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLatestCachedMinirootfs(t *testing.T) {
+	r := &Rootfs{cacheDir: t.TempDir(), arch: "x86_64"}
+	dir := r.minirootfsCacheDir()
+	os.MkdirAll(dir, 0755)
+	if got := r.latestCachedMinirootfs(); got != "" {
+		t.Errorf("empty cache: got %q", got)
+	}
+	for _, v := range []string{"3.9.6", "3.20.3", "3.20.10", "3.21.0_rc1", "3.2.0"} {
+		os.WriteFile(filepath.Join(dir, "alpine-minirootfs-"+v+"-x86_64.tar.gz"), nil, 0644)
+	}
+
+	if got, want := r.latestCachedMinirootfs(), "alpine-minirootfs-3.21.0_rc1-x86_64.tar.gz"; got != want {
+		t.Errorf("latest = %q, want %q", got, want)
+	}
+	r.alpineBranch = "v3.20"
+	if got, want := r.latestCachedMinirootfs(), "alpine-minirootfs-3.20.10-x86_64.tar.gz"; got != want {
+		t.Errorf("latest of v3.20 = %q, want %q", got, want)
+	}
+	os.Remove(filepath.Join(dir, "alpine-minirootfs-3.21.0_rc1-x86_64.tar.gz"))
+	r.alpineBranch = ""
+	if got, want := r.latestCachedMinirootfs(), "alpine-minirootfs-3.20.10-x86_64.tar.gz"; got != want {
+		t.Errorf("latest = %q, want %q, not 3.9.6", got, want)
+	}
+}
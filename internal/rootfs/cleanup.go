@@ -3,20 +3,35 @@ package rootfs
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
-// Unmount unmounts all chroot bind mounts (proc, dev, sys).
-// Safe to call multiple times.
+// Unmount unmounts everything mounted under the working directory: the
+// chroot bind mounts (proc, dev, sys), the apk cache and the local mirror. A mount that is
+// still busy is detached lazily, so it can no longer be reached through the
+// workdir. Safe to call multiple times, and deliberately not bound to the
+// build's context: it must still run after an interrupt.
 func (r *Rootfs) Unmount() {
+	for _, mp := range mountsUnder(r.WorkDir) {
+		if err := audit.Command("umount", mp).Run(); err == nil {
+			continue
+		}
+		if err := audit.Command("umount", "-l", mp).Run(); err != nil {
+			fmt.Printf("  Warning: failed to unmount %s: %v\n", mp, err)
+		}
+	}
+}
+
+// mountsUnder returns the mount points below dir, deepest first.
+func mountsUnder(dir string) []string {
 	data, err := os.ReadFile("/proc/mounts")
 	if err != nil {
-		return
+		return nil
 	}
 
 	var mountPoints []string
@@ -26,53 +41,74 @@ func (r *Rootfs) Unmount() {
 			continue
 		}
 		mp := fields[1]
-		if strings.HasPrefix(mp, r.Path+"/") {
+		if strings.HasPrefix(mp, dir+"/") {
 			mountPoints = append(mountPoints, mp)
 		}
 	}
 
 	// Sort in reverse order to unmount deepest first
 	sort.Sort(sort.Reverse(sort.StringSlice(mountPoints)))
-
-	for _, mp := range mountPoints {
-		cmd := exec.Command("umount", mp)
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("  Warning: failed to unmount %s: %v\n", mp, err)
-		}
-	}
+	return mountPoints
 }
 
 // Cleanup unmounts all chroot bind mounts and optionally removes the working directory.
+// The workdir is never removed while anything is still mounted below it:
+// RemoveAll would descend into the bind mounts and delete host /dev entries.
 func (r *Rootfs) Cleanup(removeWorkDir bool) {
 	ui.SubStep("Unmounting chroot mounts...")
 	r.Unmount()
 
 	if removeWorkDir {
+		if left := mountsUnder(r.WorkDir); len(left) > 0 {
+			ui.Warn(fmt.Sprintf("Keeping %s: %s is still mounted", r.WorkDir, left[0]))
+			return
+		}
 		ui.SubStep("Removing working directory...")
 		ui.Detail(r.WorkDir)
-		os.RemoveAll(r.WorkDir)
+		audit.RemoveAll(r.WorkDir)
 	}
 }
 
 // CleanupRootfs removes unnecessary files from the rootfs before packaging.
-// MUST be called AFTER Unmount() — otherwise it would delete host /dev entries.
+// It must be called after Unmount and fails without removing anything while
+// something is still mounted below the rootfs, as clearing /dev would then
+// delete host /dev entries.
 func (r *Rootfs) CleanupRootfs() error {
+	if left := mountsUnder(r.Path); len(left) > 0 {
+		return fmt.Errorf("%s is still mounted; not cleaning the rootfs", left[0])
+	}
 	ui.SubStep("Cleaning rootfs for packaging...")
 
 	// Clear package manager cache
 	if r.distro == "fedora" {
-		os.RemoveAll(filepath.Join(r.Path, "var", "cache", "dnf"))
-		os.RemoveAll(filepath.Join(r.Path, "var", "lib", "dnf", "history.sqlite"))
+		audit.RemoveAll(filepath.Join(r.Path, "var", "cache", "dnf"))
+		audit.RemoveAll(filepath.Join(r.Path, "var", "lib", "dnf", "history.sqlite"))
+	} else if r.distro == "debian" {
+		debs, _ := filepath.Glob(filepath.Join(r.Path, "var", "cache", "apt", "archives", "*.deb"))
+		for _, d := range debs {
+			audit.Remove(d)
+		}
+		lists, _ := filepath.Glob(filepath.Join(r.Path, "var", "lib", "apt", "lists", "*_*"))
+		for _, l := range lists {
+			audit.Remove(l)
+		}
 	} else {
-		os.RemoveAll(filepath.Join(r.Path, "var", "cache", "apk"))
+		audit.RemoveAll(filepath.Join(r.Path, "var", "cache", "apk"))
+		// Empty mount point of the host apk cache; its presence would make
+		// apk cache packages on the booted system.
+		audit.Remove(filepath.Join(r.Path, apkCacheMount))
+		audit.Remove(filepath.Join(r.Path, localMirrorMount))
+	}
+
+	if epoch, ok := sourceDateEpoch(); ok {
+		r.normalizeShadow(epoch)
 	}
 
 	// Clear /dev contents (will be populated at boot by devtmpfs)
-	// Only safe because Unmount() was called first
 	devPath := filepath.Join(r.Path, "dev")
 	entries, _ := os.ReadDir(devPath)
 	for _, e := range entries {
-		os.RemoveAll(filepath.Join(devPath, e.Name()))
+		audit.RemoveAll(filepath.Join(devPath, e.Name()))
 	}
 
 	return nil
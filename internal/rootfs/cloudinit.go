@@ -0,0 +1,94 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// tinyCloudServices are the OpenRC services of tiny-cloud and their
+// runlevels, as 'tiny-cloud --enable' adds them.
+var tinyCloudServices = [][2]string{
+	{"tiny-cloud-boot", "boot"},
+	{"tiny-cloud-early", "sysinit"},
+	{"tiny-cloud", "default"},
+	{"tiny-cloud-final", "default"},
+}
+
+// cloudInitUnits are the systemd units of cloud-init's boot stages. Newer
+// releases replace cloud-init.service with cloud-init-main and
+// cloud-init-network; whichever the package ships are enabled.
+var cloudInitUnits = []string{
+	"cloud-init-local", "cloud-init", "cloud-init-main", "cloud-init-network",
+	"cloud-config", "cloud-final",
+}
+
+// ConfigureCloudInit installs tool ("tiny-cloud" or "cloud-init"), points it
+// at datasources and enables it, so the image takes its users, SSH keys and
+// network settings from the cloud platform at boot.
+func (r *Rootfs) ConfigureCloudInit(tool string, datasources []string) error {
+	ui.SubStep(fmt.Sprintf("Configuring %s (%s)...", tool, strings.Join(datasources, ", ")))
+	if tool == "tiny-cloud" {
+		return r.configureTinyCloud(config.TinyCloudName(datasources[0]))
+	}
+
+	if err := r.InstallPackages([]string{"cloud-init"}); err != nil {
+		return err
+	}
+	if !slices.Contains(datasources, "None") {
+		// Boots without metadata instead of waiting for it forever.
+		datasources = append(datasources, "None")
+	}
+	cfg := "# Written by distrorun (cloud_init.datasources)\ndatasource_list: [ " + strings.Join(datasources, ", ") + " ]\n"
+	if err := r.writeFile("etc/cloud/cloud.cfg.d/90_distrorun.cfg", cfg, 0644); err != nil {
+		return err
+	}
+
+	if !r.systemd() {
+		// Alpine's cloud-init enables its OpenRC services with this script.
+		if err := r.command("chroot", r.Path, "setup-cloud-init").Run(); err != nil {
+			return fmt.Errorf("enabling cloud-init: %w", err)
+		}
+		ui.ServiceItem("cloud-init")
+		return nil
+	}
+	for _, unit := range cloudInitUnits {
+		found := false
+		for _, dir := range []string{"usr/lib/systemd/system", "lib/systemd/system"} {
+			if _, err := os.Stat(filepath.Join(r.Path, dir, unit+".service")); err == nil {
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		if err := r.command("chroot", r.Path, "systemctl", "enable", unit).Run(); err != nil {
+			return fmt.Errorf("enabling %s: %w", unit, err)
+		}
+		ui.ServiceItem(unit)
+	}
+	return nil
+}
+
+// configureTinyCloud installs Alpine's tiny-cloud for cloud, one of its
+// cloud names such as "nocloud" or "aws".
+func (r *Rootfs) configureTinyCloud(cloud string) error {
+	if err := r.InstallPackages([]string{"tiny-cloud", "tiny-cloud-openrc", "tiny-cloud-" + cloud}); err != nil {
+		return err
+	}
+	if err := r.appendLine("etc/tiny-cloud.conf", "CLOUD="+cloud); err != nil {
+		return err
+	}
+	for _, svc := range tinyCloudServices {
+		if err := r.command("chroot", r.Path, "rc-update", "add", svc[0], svc[1]).Run(); err != nil {
+			return fmt.Errorf("enabling %s: %w", svc[0], err)
+		}
+	}
+	ui.ServiceItem("tiny-cloud (" + cloud + ")")
+	return nil
+}
@@ -0,0 +1,252 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// debianSuite is the Debian release bootstrapped by debootstrap.
+const debianSuite = "bookworm"
+
+// debianMirror is the package mirror used for bootstrap and apt.
+const debianMirror = "http://deb.debian.org/debian"
+
+// debianServerPackages are the minimum packages for a headless/server Debian live ISO.
+// debootstrap --variant=minbase already provides apt, dpkg and coreutils.
+var debianServerPackages = []string{
+	// Base system
+	"systemd-sysv",
+	"udev",
+	"dbus",
+	"initramfs-tools",
+	"linux-image-amd64",
+	"grub-pc-bin",
+	"passwd",
+	"bash",
+	"busybox",
+	"sudo",
+	// Networking
+	"iproute2",     // ip, ss
+	"iputils-ping", // ping
+	"net-tools",    // netstat, ifconfig
+	"dnsutils",     // dig, nslookup
+	"openssh-server",
+	"openssh-client",
+	"ca-certificates",
+	// Filesystem & storage
+	"e2fsprogs",
+	"util-linux", // lsblk, fdisk, mount
+	// Common tools
+	"procps", // ps, top, kill
+	"less",
+	"tar",
+	"gzip",
+}
+
+// debianWorkstationPackages extend the server base with a graphical desktop.
+var debianWorkstationPackages = []string{
+	"network-manager",
+	"xserver-xorg",
+	"gdm3",
+	"gnome-shell",
+	"gnome-terminal",
+	"firefox-esr",
+}
+
+// debianInitramfsModules are forced into the initramfs so the live init can
+// find the boot medium and mount the squashfs.
+var debianInitramfsModules = []string{
+	"squashfs", "loop", "isofs", "overlay", "sr_mod", "cdrom",
+	"ata_piix", "ahci", "virtio_blk", "virtio_pci", "virtio_scsi",
+}
+
+// BootstrapDebian creates a new Debian rootfs with debootstrap.
+// distroType is "server" (default) or "workstation". opts.CacheDir keeps the
+// downloaded .deb files between builds; opts.Disk skips the live-CD initramfs.
+func BootstrapDebian(name, distroType string, opts Options) (*Rootfs, error) {
+	workDir, rootfsPath, err := newWorkDir(opts.WorkDir, name, opts.ConfigHash)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rootfs{
+		Path:     rootfsPath,
+		WorkDir:  workDir,
+		arch:     "x86_64",
+		distro:   "debian",
+		cacheDir: opts.CacheDir,
+		ctx:      opts.Context,
+	}
+
+	// Step 1: Bootstrap rootfs via debootstrap. It manages its own /proc
+	// mount during package configuration, so chroot mounts come after.
+	if err := r.installDebianBaseSystem(distroType); err != nil {
+		return nil, err
+	}
+
+	// Step 2: Mount /proc /dev /sys for later apt runs
+	if err := r.setupChrootMounts(); err != nil {
+		return nil, err
+	}
+
+	// Step 3: Copy DNS resolution config
+	if err := r.copyResolv(); err != nil {
+		return nil, err
+	}
+
+	// Step 4: Configure networking
+	if err := r.configureDebianNetwork(name, distroType); err != nil {
+		return nil, err
+	}
+
+	// Step 5: Write custom /etc/os-release (reuse Alpine helper)
+	r.configureOSRelease(name)
+
+	if opts.Disk {
+		// The kernel postinst already produced a regular initramfs; the disk
+		// image needs grub-install and update-grub inside the rootfs.
+		if err := r.InstallPackages([]string{"grub-pc"}); err != nil {
+			return nil, err
+		}
+		if err := r.setGrubCmdline(opts.Cmdline); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	// Step 6: Regenerate initramfs with live-boot modules (gzip for our patcher)
+	if err := r.generateDebianInitramfs(); err != nil {
+		return nil, err
+	}
+
+	// Step 7: Patch initramfs with live CD init + busybox
+	kver, err := r.kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.patchLiveInitramfs(filepath.Join(r.Path, "boot", "initrd.img-"+kver)); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// installDebianBaseSystem runs debootstrap on the host to create the rootfs.
+func (r *Rootfs) installDebianBaseSystem(distroType string) error {
+	pkgs := debianServerPackages
+	if distroType == "workstation" {
+		pkgs = append(append([]string{}, pkgs...), debianWorkstationPackages...)
+	}
+
+	ui.SubStep(fmt.Sprintf("Bootstrapping Debian %s %s rootfs via debootstrap...", debianSuite, distroType))
+
+	args := []string{
+		"--variant=minbase",
+		"--arch=amd64",
+		"--include=" + strings.Join(pkgs, ","),
+	}
+	if r.cacheDir != "" {
+		debDir := filepath.Join(r.cacheDir, "debian", debianSuite)
+		if err := audit.MkdirAll(debDir, 0755); err == nil {
+			args = append(args, "--cache-dir="+debDir)
+		}
+	}
+	args = append(args, debianSuite, r.Path, debianMirror)
+
+	cmd := r.packageManager("debootstrap", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debootstrap: %w", err)
+	}
+
+	return nil
+}
+
+// configureDebianNetwork sets up DHCP on all ethernet interfaces. Servers use
+// systemd-networkd; workstations get NetworkManager from the package list.
+func (r *Rootfs) configureDebianNetwork(name, distroType string) error {
+	ui.SubStep("Configuring network (systemd-networkd DHCP)...")
+
+	audit.WriteFile(filepath.Join(r.Path, "etc", "hostname"), []byte(name+"\n"), 0644)
+
+	if distroType == "workstation" {
+		r.command("chroot", r.Path, "systemctl", "enable", "NetworkManager").Run() // best-effort
+		return nil
+	}
+
+	networkDir := filepath.Join(r.Path, "etc", "systemd", "network")
+	if err := audit.MkdirAll(networkDir, 0755); err != nil {
+		return fmt.Errorf("creating systemd network dir: %w", err)
+	}
+
+	network := `[Match]
+Name=en* eth*
+
+[Network]
+DHCP=yes
+`
+	if err := audit.WriteFile(filepath.Join(networkDir, "20-dhcp.network"), []byte(network), 0644); err != nil {
+		return fmt.Errorf("writing network config: %w", err)
+	}
+
+	r.command("chroot", r.Path, "systemctl", "enable", "systemd-networkd").Run() // best-effort
+
+	return nil
+}
+
+// generateDebianInitramfs rebuilds the initramfs with update-initramfs,
+// forcing gzip and the modules the live init needs.
+func (r *Rootfs) generateDebianInitramfs() error {
+	ui.SubStep("Generating initramfs via update-initramfs...")
+
+	confDir := filepath.Join(r.Path, "etc", "initramfs-tools")
+	if err := audit.MkdirAll(filepath.Join(confDir, "conf.d"), 0755); err != nil {
+		return fmt.Errorf("creating initramfs-tools config: %w", err)
+	}
+	if err := audit.WriteFile(filepath.Join(confDir, "conf.d", "distrorun.conf"), []byte("COMPRESS=gzip\nMODULES=most\n"), 0644); err != nil {
+		return fmt.Errorf("writing initramfs-tools config: %w", err)
+	}
+
+	f, err := audit.OpenFile(filepath.Join(confDir, "modules"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening initramfs-tools modules: %w", err)
+	}
+	fmt.Fprintln(f, strings.Join(debianInitramfsModules, "\n"))
+	f.Close()
+
+	cmd := r.command("chroot", r.Path, "update-initramfs", "-u", "-k", "all")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("update-initramfs: %w", err)
+	}
+
+	return nil
+}
+
+// DebianKernelFiles returns the kernel version and the absolute paths of the
+// vmlinuz and initrd.img inside the rootfs. Used by the bootloader.
+func (r *Rootfs) DebianKernelFiles() (kver, vmlinuz, initramfs string, err error) {
+	kver, err = r.kernelVersion()
+	if err != nil {
+		return
+	}
+
+	vmlinuz = filepath.Join(r.Path, "boot", "vmlinuz-"+kver)
+	if _, err = os.Stat(vmlinuz); err != nil {
+		err = fmt.Errorf("vmlinuz not found: %w", err)
+		return
+	}
+	initramfs = filepath.Join(r.Path, "boot", "initrd.img-"+kver)
+	if _, err = os.Stat(initramfs); err != nil {
+		err = fmt.Errorf("initrd.img not found: %w", err)
+		return
+	}
+	return
+}
@@ -1,14 +1,13 @@
 package rootfs
 
 import (
-	"compress/gzip"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/cpio"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
@@ -73,23 +72,10 @@ var fedoraWorkstationPackages = []string{
 
 // BootstrapFedora creates a new Fedora rootfs using dnf --installroot.
 // distroType is "server" (default) or "workstation".
-func BootstrapFedora(name, distroType string) (*Rootfs, error) {
-	workDir := filepath.Join(os.TempDir(), fmt.Sprintf("distrorun-%s", name))
-	rootfsPath := filepath.Join(workDir, "rootfs")
-
-	// Clean up any stale workdir from a previous (possibly failed) build.
-	// Unmount first so we don't remove live bind mounts or a partial rootfs
-	// that dnf would then consider "already installed".
-	if _, err := os.Stat(workDir); err == nil {
-		stale := &Rootfs{Path: rootfsPath, WorkDir: workDir}
-		stale.Unmount()
-		if err := os.RemoveAll(workDir); err != nil {
-			return nil, fmt.Errorf("removing stale workdir: %w", err)
-		}
-	}
-
-	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
-		return nil, fmt.Errorf("creating rootfs directory: %w", err)
+func BootstrapFedora(name, distroType string, opts Options) (*Rootfs, error) {
+	workDir, rootfsPath, err := newWorkDir(opts.WorkDir, name, opts.ConfigHash)
+	if err != nil {
+		return nil, err
 	}
 
 	r := &Rootfs{
@@ -97,6 +83,7 @@ func BootstrapFedora(name, distroType string) (*Rootfs, error) {
 		WorkDir: workDir,
 		arch:    "x86_64",
 		distro:  "fedora",
+		ctx:     opts.Context,
 	}
 
 	// Step 1: Mount /proc /dev /sys before dnf --installroot so that RPM
@@ -140,20 +127,10 @@ func BootstrapFedora(name, distroType string) (*Rootfs, error) {
 // BootstrapFedoraDisk bootstraps a Fedora rootfs suitable for installation onto a raw
 // disk image. It skips live-CD initramfs generation and patching — the kernel's
 // %posttrans dracut scriptlet already produced a correct initramfs during dnf --installroot.
-func BootstrapFedoraDisk(name, distroType string) (*Rootfs, error) {
-	workDir := filepath.Join(os.TempDir(), fmt.Sprintf("distrorun-%s", name))
-	rootfsPath := filepath.Join(workDir, "rootfs")
-
-	if _, err := os.Stat(workDir); err == nil {
-		stale := &Rootfs{Path: rootfsPath, WorkDir: workDir}
-		stale.Unmount()
-		if err := os.RemoveAll(workDir); err != nil {
-			return nil, fmt.Errorf("removing stale workdir: %w", err)
-		}
-	}
-
-	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
-		return nil, fmt.Errorf("creating rootfs directory: %w", err)
+func BootstrapFedoraDisk(name, distroType string, opts Options) (*Rootfs, error) {
+	workDir, rootfsPath, err := newWorkDir(opts.WorkDir, name, opts.ConfigHash)
+	if err != nil {
+		return nil, err
 	}
 
 	r := &Rootfs{
@@ -161,6 +138,7 @@ func BootstrapFedoraDisk(name, distroType string) (*Rootfs, error) {
 		WorkDir: workDir,
 		arch:    "x86_64",
 		distro:  "fedora",
+		ctx:     opts.Context,
 	}
 
 	if err := r.setupChrootMounts(); err != nil {
@@ -176,6 +154,9 @@ func BootstrapFedoraDisk(name, distroType string) (*Rootfs, error) {
 		return nil, err
 	}
 	r.configureOSRelease(name)
+	if err := r.setGrubCmdline(opts.Cmdline); err != nil {
+		return nil, err
+	}
 
 	return r, nil
 }
@@ -201,7 +182,7 @@ func (r *Rootfs) installFedoraBaseSystem(distroType string) error {
 	}
 	args = append(args, pkgs...)
 
-	cmd := exec.Command("dnf", args...)
+	cmd := r.packageManager("dnf", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -216,7 +197,7 @@ func (r *Rootfs) configureFedoraNetwork(name string) error {
 	ui.SubStep("Configuring network (NetworkManager DHCP)...")
 
 	connDir := filepath.Join(r.Path, "etc", "NetworkManager", "system-connections")
-	if err := os.MkdirAll(connDir, 0700); err != nil {
+	if err := audit.MkdirAll(connDir, 0700); err != nil {
 		return fmt.Errorf("creating NM connections dir: %w", err)
 	}
 
@@ -232,16 +213,16 @@ method=auto
 method=auto
 `
 	connPath := filepath.Join(connDir, "dhcp.nmconnection")
-	if err := os.WriteFile(connPath, []byte(conn), 0600); err != nil {
+	if err := audit.WriteFile(connPath, []byte(conn), 0600); err != nil {
 		return fmt.Errorf("writing NM connection: %w", err)
 	}
 
 	// Write hostname
 	hostnamePath := filepath.Join(r.Path, "etc", "hostname")
-	os.WriteFile(hostnamePath, []byte(name+"\n"), 0644)
+	audit.WriteFile(hostnamePath, []byte(name+"\n"), 0644)
 
 	// Enable NetworkManager
-	cmd := exec.Command("chroot", r.Path, "systemctl", "enable", "NetworkManager")
+	cmd := r.command("chroot", r.Path, "systemctl", "enable", "NetworkManager")
 	_ = cmd.Run() // best-effort
 
 	return nil
@@ -251,14 +232,14 @@ method=auto
 func (r *Rootfs) generateFedoraInitramfs() error {
 	ui.SubStep("Generating initramfs via dracut...")
 
-	kver, err := r.fedoraKernelVersion()
+	kver, err := r.kernelVersion()
 	if err != nil {
 		return err
 	}
 
 	initramfsPath := fmt.Sprintf("/boot/initramfs-%s.img", kver)
 
-	cmd := exec.Command("chroot", r.Path,
+	cmd := r.command("chroot", r.Path,
 		"dracut",
 		"--force",
 		"--compress=gzip",
@@ -276,137 +257,65 @@ func (r *Rootfs) generateFedoraInitramfs() error {
 	return nil
 }
 
-// patchFedoraInitramfs extracts the dracut initramfs, injects busybox at /bin/busybox,
-// creates essential symlinks, replaces /init with the live-CD init script, and repacks.
+// patchFedoraInitramfs patches the dracut initramfs with the live-CD init.
 func (r *Rootfs) patchFedoraInitramfs() error {
-	ui.SubStep("Patching initramfs with live CD init...")
-
-	kver, err := r.fedoraKernelVersion()
+	kver, err := r.kernelVersion()
 	if err != nil {
 		return err
 	}
+	return r.patchLiveInitramfs(filepath.Join(r.Path, "boot", fmt.Sprintf("initramfs-%s.img", kver)))
+}
+
+// patchLiveInitramfs injects busybox at /bin/busybox into a gzip-compressed
+// initramfs, creates essential symlinks and replaces /init with the live-CD
+// init script.
+func (r *Rootfs) patchLiveInitramfs(initramfsPath string) error {
+	ui.SubStep("Patching initramfs with live CD init...")
 
-	initramfsPath := filepath.Join(r.Path, "boot", fmt.Sprintf("initramfs-%s.img", kver))
 	if _, err := os.Stat(initramfsPath); err != nil {
 		return fmt.Errorf("initramfs not found at %s: %w", initramfsPath, err)
 	}
-
-	workDir := filepath.Join(r.WorkDir, "initramfs-work")
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return fmt.Errorf("creating initramfs work dir: %w", err)
-	}
-	defer os.RemoveAll(workDir)
-
-	// Decompress gzip
-	gzFile, err := os.Open(initramfsPath)
+	a, err := readInitramfs(initramfsPath)
 	if err != nil {
-		return fmt.Errorf("opening initramfs: %w", err)
-	}
-	gz, err := gzip.NewReader(gzFile)
-	if err != nil {
-		gzFile.Close()
-		return fmt.Errorf("reading initramfs gzip: %w (was dracut --compress=gzip used?)", err)
-	}
-
-	cpioPath := filepath.Join(workDir, "initramfs.cpio")
-	cpioFile, err := os.Create(cpioPath)
-	if err != nil {
-		gz.Close()
-		gzFile.Close()
-		return fmt.Errorf("creating cpio file: %w", err)
-	}
-	if _, err := io.Copy(cpioFile, gz); err != nil {
-		cpioFile.Close()
-		gz.Close()
-		gzFile.Close()
-		return fmt.Errorf("decompressing initramfs: %w", err)
-	}
-	cpioFile.Close()
-	gz.Close()
-	gzFile.Close()
-
-	// Extract cpio archive
-	extractDir := filepath.Join(workDir, "extracted")
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		return fmt.Errorf("creating extract dir: %w", err)
-	}
-
-	cpioIn, err := os.Open(cpioPath)
-	if err != nil {
-		return fmt.Errorf("opening cpio: %w", err)
-	}
-	cpioCmd := exec.Command("cpio", "-idm", "--quiet")
-	cpioCmd.Dir = extractDir
-	cpioCmd.Stdin = cpioIn
-	cpioCmd.Stderr = os.Stderr
-	if err := cpioCmd.Run(); err != nil {
-		cpioIn.Close()
-		return fmt.Errorf("extracting cpio: %w", err)
+		return err
 	}
-	cpioIn.Close()
 
 	// Inject busybox into /bin/busybox inside the initramfs
-	busyboxSrc := findBusybox(r.Path)
-	if busyboxSrc != "" {
-		binDir := filepath.Join(extractDir, "bin")
-		os.MkdirAll(binDir, 0755)
-		if err := copyFilePath(busyboxSrc, filepath.Join(binDir, "busybox")); err == nil {
-			os.Chmod(filepath.Join(binDir, "busybox"), 0755)
-			// Create symlinks for applets our init script needs
-			applets := []string{"sh", "mount", "umount", "modprobe", "sleep", "echo", "cat"}
-			for _, a := range applets {
-				dst := filepath.Join(binDir, a)
-				if _, err := os.Lstat(dst); os.IsNotExist(err) {
-					os.Symlink("busybox", dst)
-				}
-			}
-			// switch_root lives in /sbin on most systems
-			sbinDir := filepath.Join(extractDir, "sbin")
-			os.MkdirAll(sbinDir, 0755)
-			if _, err := os.Lstat(filepath.Join(sbinDir, "switch_root")); os.IsNotExist(err) {
-				os.Symlink("../bin/busybox", filepath.Join(sbinDir, "switch_root"))
+	if busyboxSrc := findBusybox(r.Path); busyboxSrc != "" {
+		busybox, err := os.ReadFile(busyboxSrc)
+		if err != nil {
+			return fmt.Errorf("reading busybox: %w", err)
+		}
+		a.put("bin/busybox", cpio.TypeRegular|0755, busybox)
+		// Create symlinks for applets our init script needs
+		applets := []string{"sh", "mount", "umount", "modprobe", "sleep", "echo", "cat"}
+		for _, applet := range applets {
+			if a.lookup(a.resolve("bin/"+applet)) == nil {
+				a.put("bin/"+applet, cpio.TypeSymlink|0777, []byte("busybox"))
 			}
 		}
+		// switch_root lives in /sbin on most systems
+		if a.lookup(a.resolve("sbin/switch_root")) == nil {
+			a.put("sbin/switch_root", cpio.TypeSymlink|0777, []byte("/bin/busybox"))
+		}
 	}
 
 	// Replace /init with our live CD init script
-	initPath := filepath.Join(extractDir, "init")
-	if err := os.WriteFile(initPath, []byte(customInit), 0755); err != nil {
-		return fmt.Errorf("writing custom init: %w", err)
-	}
-
-	// Repack: cpio | gzip
-	newCpioPath := filepath.Join(workDir, "new-initramfs.cpio")
-	packCmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && find . | cpio -o -H newc --quiet > %s", extractDir, newCpioPath))
-	packCmd.Stderr = os.Stderr
-	if err := packCmd.Run(); err != nil {
-		return fmt.Errorf("creating new cpio: %w", err)
-	}
-
-	cpioData, err := os.ReadFile(newCpioPath)
+	script, err := liveInit()
 	if err != nil {
-		return fmt.Errorf("reading new cpio: %w", err)
-	}
-
-	outFile, err := os.Create(initramfsPath)
-	if err != nil {
-		return fmt.Errorf("creating new initramfs: %w", err)
+		return err
 	}
-	gzWriter := gzip.NewWriter(outFile)
-	if _, err := gzWriter.Write(cpioData); err != nil {
-		outFile.Close()
-		return fmt.Errorf("compressing initramfs: %w", err)
+	a.put("init", cpio.TypeRegular|0755, script)
+	if err := a.write(initramfsPath); err != nil {
+		return err
 	}
-	gzWriter.Close()
-	outFile.Close()
 
 	ui.SubStep("Initramfs patched successfully")
 	return nil
 }
 
-// fedoraKernelVersion finds the installed kernel version from /lib/modules/ in the rootfs.
-func (r *Rootfs) fedoraKernelVersion() (string, error) {
+// kernelVersion finds the installed kernel version from /lib/modules/ in the rootfs.
+func (r *Rootfs) kernelVersion() (string, error) {
 	modulesDir := filepath.Join(r.Path, "lib", "modules")
 	entries, err := os.ReadDir(modulesDir)
 	if err != nil {
@@ -435,26 +344,10 @@ func findBusybox(rootfsPath string) string {
 	return ""
 }
 
-// copyFilePath copies src to dst (plain file copy).
-func copyFilePath(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, in)
-	return err
-}
-
 // FedoraKernelFiles returns the absolute paths of the vmlinuz and initramfs
 // inside the rootfs, and the kernel version string. Used by the bootloader.
 func (r *Rootfs) FedoraKernelFiles() (kver, vmlinuz, initramfs string, err error) {
-	kver, err = r.fedoraKernelVersion()
+	kver, err = r.kernelVersion()
 	if err != nil {
 		return
 	}
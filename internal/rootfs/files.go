@@ -0,0 +1,208 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// InstallFiles copies overlay files and directory trees into the rootfs.
+// Destinations are resolved below an os.Root, so neither ".." nor a
+// symlink in the image, such as Debian's absolute /var/run -> /run, can
+// redirect a write to the host. Ownership is applied with chown inside the
+// chroot so that user and group names resolve against the image's
+// /etc/passwd, not the host's.
+func (r *Rootfs) InstallFiles(files []config.File) error {
+	root, err := audit.OpenRoot(r.Path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	for _, f := range files {
+		// Validated in config already, but ".." must never be clamped to
+		// the root silently.
+		name := strings.TrimPrefix(f.Path, "/")
+		if !path.IsAbs(f.Path) || !filepath.IsLocal(name) && name != "" {
+			return fmt.Errorf("overlay path %q must be absolute and inside the rootfs", f.Path)
+		}
+		name = path.Clean("./" + name)
+		if f.Source != "" {
+			ui.Detail(f.Source + " → " + f.Path)
+		} else {
+			ui.Detail("(inline) → " + f.Path)
+		}
+
+		if err := root.MkdirAll(path.Dir(name), 0755); err != nil {
+			return fmt.Errorf("creating parent of %s: %w", f.Path, err)
+		}
+
+		switch {
+		case f.Content != "":
+			if err := root.WriteFile(name, []byte(f.Content), 0644); err != nil {
+				return fmt.Errorf("writing %s: %w", f.Path, err)
+			}
+		default:
+			info, err := os.Stat(f.Source)
+			if err != nil {
+				return fmt.Errorf("overlay source: %w", err)
+			}
+			if info.IsDir() {
+				if err := copyTree(root, f.Source, name); err != nil {
+					return fmt.Errorf("copying %s: %w", f.Source, err)
+				}
+			} else {
+				if err := copyIntoRoot(root, f.Source, name, info); err != nil {
+					return fmt.Errorf("copying %s: %w", f.Source, err)
+				}
+			}
+		}
+
+		if f.Mode != "" {
+			mode, _ := strconv.ParseUint(f.Mode, 8, 32) // validated in config
+			if err := root.Chmod(name, os.FileMode(mode)); err != nil {
+				return fmt.Errorf("chmod %s: %w", f.Path, err)
+			}
+		}
+		if f.Owner != "" {
+			// The owner is validated not to start with "-"; "--" also
+			// keeps the path from being read as an option.
+			cmd := r.command("chroot", r.Path, "chown", "-R", "--", f.Owner, f.Path)
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("chown %s %s: %w", f.Owner, f.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyTree copies the host directory src to name in root, preserving
+// modes, owners, symlinks and modification times as "cp -a" does.
+func copyTree(root *audit.Root, src, name string) error {
+	type dirTime struct {
+		name string
+		info fs.FileInfo
+	}
+	var dirs []dirTime
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(name, filepath.ToSlash(rel))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := root.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if err := root.Chmod(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{dst, info})
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := removeNonDir(root, dst); err != nil {
+				return err
+			}
+			if err := root.Symlink(target, dst); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			return copyIntoRoot(root, p, dst, info)
+		default:
+			return fmt.Errorf("%s: not a regular file, directory or symlink", p)
+		}
+		return preserveOwner(root, dst, info)
+	})
+	if err != nil {
+		return err
+	}
+	// Last, as copying into a directory changes its modification time.
+	for _, d := range dirs {
+		if err := root.Chtimes(d.name, d.info.ModTime(), d.info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyIntoRoot copies the host file src, whose info is given, to name in
+// root with its mode, owner and modification time.
+func copyIntoRoot(root *audit.Root, src, name string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := removeNonDir(root, name); err != nil {
+		return err
+	}
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := preserveOwner(root, name, info); err != nil {
+		return err
+	}
+	// After chown, which clears the set-user-ID and set-group-ID bits.
+	if err := root.Chmod(name, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return root.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// preserveOwner gives name in root the numeric owner of the host file
+// described by info.
+func preserveOwner(root *audit.Root, name string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return root.Lchown(name, int(st.Uid), int(st.Gid))
+}
+
+// removeNonDir removes name from root unless it is missing, so a file or
+// symlink can be created in its place. A symlink is removed, not followed.
+func removeNonDir(root *audit.Root, name string) error {
+	fi, err := root.Lstat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: a directory is in the way", name)
+	}
+	return root.Remove(name)
+}
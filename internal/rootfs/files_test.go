@@ -0,0 +1,100 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+func TestInstallFiles(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "tree", "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "tree", "sub", "a.conf"), []byte("a"), 0640)
+	os.Symlink("sub/a.conf", filepath.Join(src, "tree", "link"))
+	os.WriteFile(filepath.Join(src, "motd"), []byte("welcome"), 0600)
+
+	r := &Rootfs{Path: t.TempDir()}
+	err := r.InstallFiles([]config.File{
+		{Path: "/etc/issue", Content: "distrorun"},
+		{Path: "/etc/motd", Source: filepath.Join(src, "motd"), Mode: "0644"},
+		{Path: "/opt/app", Source: filepath.Join(src, "tree")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"etc/issue": "distrorun", "etc/motd": "welcome", "opt/app/sub/a.conf": "a", "opt/app/link": "a"} {
+		if data, err := os.ReadFile(filepath.Join(r.Path, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(r.Path, "etc", "motd")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("mode of etc/motd = %v, %v; want 0644", fi.Mode(), err)
+	}
+	if fi, err := os.Lstat(filepath.Join(r.Path, "opt", "app", "link")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("opt/app/link was not copied as a symlink: %v", err)
+	}
+}
+
+func TestInstallFiles_Escape(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "payload"), []byte("x"), 0644)
+	os.MkdirAll(filepath.Join(src, "tree"), 0755)
+	os.WriteFile(filepath.Join(src, "tree", "payload"), []byte("x"), 0644)
+
+	for name, tt := range map[string]struct {
+		file    config.File
+		replace bool // the symlink itself is replaced, inside the rootfs
+	}{
+		"dot-dot content":       {file: config.File{Path: "/../outside/payload", Content: "x"}},
+		"dot-dot source":        {file: config.File{Path: "/etc/../../outside/payload", Source: filepath.Join(src, "payload")}},
+		"symlink content":       {file: config.File{Path: "/var/run/payload", Content: "x"}},
+		"symlink source":        {file: config.File{Path: "/var/run/payload", Source: filepath.Join(src, "payload")}},
+		"symlink tree":          {file: config.File{Path: "/var/run/tree", Source: filepath.Join(src, "tree")}},
+		"relative symlink":      {file: config.File{Path: "/up/outside/payload", Content: "x"}},
+		"final symlink content": {file: config.File{Path: "/etc/passwd", Content: "x"}},
+		"final symlink mode":    {file: config.File{Path: "/etc/shadow", Content: "x", Mode: "0777"}},
+		"final symlink source":  {file: config.File{Path: "/etc/passwd", Source: filepath.Join(src, "payload"), Mode: "0600"}, replace: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			outside := filepath.Join(parent, "outside")
+			os.MkdirAll(outside, 0755)
+			host := filepath.Join(outside, "passwd")
+			os.WriteFile(host, []byte("host"), 0644)
+
+			r := &Rootfs{Path: filepath.Join(parent, "rootfs")}
+			os.MkdirAll(filepath.Join(r.Path, "var"), 0755)
+			os.MkdirAll(filepath.Join(r.Path, "etc"), 0755)
+			// As Debian's /var/run -> /run, but pointing at the host.
+			os.Symlink(outside, filepath.Join(r.Path, "var", "run"))
+			os.Symlink("..", filepath.Join(r.Path, "up"))
+			os.Symlink(host, filepath.Join(r.Path, "etc", "passwd"))
+			os.Symlink("../../outside/passwd", filepath.Join(r.Path, "etc", "shadow"))
+
+			err := r.InstallFiles([]config.File{tt.file})
+			if tt.replace {
+				if fi, lerr := os.Lstat(filepath.Join(r.Path, "etc", "passwd")); err != nil || lerr != nil || !fi.Mode().IsRegular() {
+					t.Errorf("InstallFiles(%s) = %v; want the symlink replaced", tt.file.Path, err)
+				}
+			} else if err == nil {
+				t.Errorf("InstallFiles(%s) succeeded", tt.file.Path)
+			}
+
+			entries, _ := os.ReadDir(outside)
+			if len(entries) != 1 {
+				t.Errorf("files were created outside the rootfs: %v", entries)
+			}
+			if data, _ := os.ReadFile(host); string(data) != "host" {
+				t.Errorf("host file was overwritten: %q", data)
+			}
+			if fi, _ := os.Stat(host); fi.Mode().Perm() != 0644 {
+				t.Errorf("mode of host file was changed to %v", fi.Mode())
+			}
+			if _, err := os.Stat(filepath.Join(parent, "payload")); err == nil {
+				t.Error("payload was written next to the rootfs")
+			}
+		})
+	}
+}
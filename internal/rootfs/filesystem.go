@@ -0,0 +1,77 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// ConfigureRootFilesystem prepares the rootfs to boot from a non-ext4 root
+// filesystem on a disk image. It installs the userspace tools and makes sure
+// the initramfs can mount the root filesystem. ext4 needs no changes.
+func (r *Rootfs) ConfigureRootFilesystem(fstype string) error {
+	if fstype == "" || fstype == "ext4" {
+		return nil
+	}
+
+	ui.SubStep(fmt.Sprintf("Preparing rootfs for %s root...", fstype))
+	if err := r.InstallPackages([]string{fstype + "-progs"}); err != nil {
+		return err
+	}
+
+	if r.distro == "fedora" {
+		// The kernel %posttrans dracut run happened before the progs were
+		// installed, so rebuild every initramfs with the module forced in.
+		confPath := filepath.Join(r.Path, "etc", "dracut.conf.d", "distrorun-rootfs.conf")
+		conf := fmt.Sprintf("add_dracutmodules+=\" %s \"\nfilesystems+=\" %s \"\n", fstype, fstype)
+		if err := audit.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+			return fmt.Errorf("creating dracut.conf.d: %w", err)
+		}
+		if err := audit.WriteFile(confPath, []byte(conf), 0644); err != nil {
+			return fmt.Errorf("writing dracut config: %w", err)
+		}
+		cmd := r.command("chroot", r.Path, "dracut", "--force", "--regenerate-all", "--no-hostonly")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("dracut: %w", err)
+		}
+		return nil
+	}
+
+	if r.distro == "debian" {
+		// initramfs-tools picks up btrfs-progs' hook; rebuild to include it.
+		cmd := r.command("chroot", r.Path, "update-initramfs", "-u", "-k", "all")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("update-initramfs: %w", err)
+		}
+		return nil
+	}
+
+	// Alpine: add the filesystem to the mkinitfs feature list and regenerate.
+	confPath := filepath.Join(r.Path, "etc", "mkinitfs", "mkinitfs.conf")
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("reading mkinitfs.conf: %w", err)
+	}
+	conf := strings.Replace(string(data), `features="`, `features="`+fstype+" ", 1)
+	if err := audit.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("writing mkinitfs.conf: %w", err)
+	}
+
+	// The initramfs must also load the module before mounting root.
+	grubPath := filepath.Join(r.Path, "etc", "default", "grub")
+	if data, err := os.ReadFile(grubPath); err == nil {
+		grub := strings.Replace(string(data), ",ext4 ", ",ext4,"+fstype+" ", 1)
+		if err := audit.WriteFile(grubPath, []byte(grub), 0644); err != nil {
+			return fmt.Errorf("writing /etc/default/grub: %w", err)
+		}
+	}
+	return r.generateInitramfs()
+}
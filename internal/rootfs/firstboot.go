@@ -0,0 +1,290 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// firstbootDir holds the scripts run by first-boot services inside the image.
+const firstbootDir = "/usr/libexec/distrorun"
+
+// firstbootStateDir holds the marker files that keep first-boot services from
+// running more than once.
+const firstbootStateDir = "/var/lib/distrorun"
+
+// oneshotService describes a script that runs exactly once, on first boot.
+type oneshotService struct {
+	Name        string   // service and script name, e.g. "distrorun-growroot"
+	Description string   // human-readable description
+	Script      string   // POSIX shell script body
+	Before      []string // services that must start after this one (e.g. "sshd")
+	After       []string // services that must start before this one
+	Network     bool     // run once the network is up
+	Console     bool     // interactive: attach to /dev/tty1 once networking is up
+}
+
+// installOneshot writes the script and a systemd unit or OpenRC init script
+// for svc, and enables it. The service records a marker under
+// firstbootStateDir after a successful run and is skipped on later boots.
+func (r *Rootfs) installOneshot(svc oneshotService) error {
+	scriptPath := filepath.Join(r.Path, firstbootDir, svc.Name)
+	if err := audit.MkdirAll(filepath.Dir(scriptPath), 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", firstbootDir, err)
+	}
+	if err := audit.WriteFile(scriptPath, []byte(svc.Script), 0755); err != nil {
+		return fmt.Errorf("writing %s: %w", svc.Name, err)
+	}
+
+	marker := firstbootStateDir + "/" + svc.Name + ".done"
+	var cmd *audit.Cmd
+	if r.systemd() {
+		var before string
+		for _, b := range svc.Before {
+			before += " " + b + ".service"
+		}
+		after := "local-fs.target"
+		var wants, console string
+		if svc.Network {
+			after = "network-online.target"
+			wants = "Wants=network-online.target\n"
+		}
+		for _, a := range svc.After {
+			after += " " + a + ".service"
+		}
+		if svc.Console {
+			after = "network.target systemd-user-sessions.service"
+			before += " getty@tty1.service"
+			console = "StandardInput=tty\nStandardOutput=tty\nTTYPath=/dev/tty1\nTTYReset=yes\nTimeoutStartSec=0\n"
+		}
+		unit := fmt.Sprintf(`[Unit]
+Description=%s
+ConditionPathExists=!%s
+After=%s
+Before=%s
+%s
+[Service]
+Type=oneshot
+ExecStart=%s/%s
+ExecStartPost=/bin/sh -c 'mkdir -p %s && touch %s'
+RemainAfterExit=yes
+%s
+[Install]
+WantedBy=multi-user.target
+`, svc.Description, marker, after, strings.TrimSpace(before), wants, firstbootDir, svc.Name, firstbootStateDir, marker, console)
+		unitPath := filepath.Join(r.Path, "etc", "systemd", "system", svc.Name+".service")
+		if err := audit.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+			return fmt.Errorf("writing %s.service: %w", svc.Name, err)
+		}
+		cmd = r.chroot("systemctl", "enable", svc.Name)
+	} else {
+		deps := "need localmount\n\tbefore " + strings.Join(append(svc.Before, "net"), " ")
+		run := fmt.Sprintf("%s/%s", firstbootDir, svc.Name)
+		runlevel := "boot"
+		if svc.Network {
+			deps = "need localmount net"
+			if len(svc.Before) > 0 {
+				deps += "\n\tbefore " + strings.Join(svc.Before, " ")
+			}
+			runlevel = "default"
+		}
+		if len(svc.After) > 0 {
+			deps += "\n\tafter " + strings.Join(svc.After, " ")
+		}
+		if svc.Console {
+			// The default runlevel finishes before inittab spawns the
+			// getty on tty1, so the console is free.
+			deps = "need localmount\n\tafter net"
+			run += " </dev/tty1 >/dev/tty1 2>&1"
+			runlevel = "default"
+		}
+		initScript := fmt.Sprintf(`#!/sbin/openrc-run
+
+description="%s"
+
+depend() {
+	%s
+}
+
+start() {
+	[ -e %s ] && return 0
+	ebegin "%s"
+	%s && mkdir -p %s && touch %s
+	eend $?
+}
+`, svc.Description, deps, marker, svc.Description, run, firstbootStateDir, marker)
+		initPath := filepath.Join(r.Path, "etc", "init.d", svc.Name)
+		if err := audit.WriteFile(initPath, []byte(initScript), 0755); err != nil {
+			return fmt.Errorf("writing init.d/%s: %w", svc.Name, err)
+		}
+		cmd = r.chroot("rc-update", "add", svc.Name, runlevel)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("enabling %s: %w", svc.Name, err)
+	}
+	return nil
+}
+
+// growRootScript grows the partition holding / to the end of its disk and
+// then resizes the filesystem on it. growpart exits 1 when there is nothing
+// to grow, which is not an error here.
+const growRootScript = `#!/bin/sh
+# DistroRun first boot: grow the root partition and filesystem to fill the disk.
+set -e
+
+src=$(findmnt -n -o SOURCE /)
+src=${src%%\[*}
+fstype=$(findmnt -n -o FSTYPE /)
+disk=/dev/$(lsblk -n -o PKNAME "$src")
+part=$(cat "/sys/class/block/$(basename "$src")/partition")
+
+growpart "$disk" "$part" || [ $? -eq 1 ]
+
+case "$fstype" in
+    ext4)  resize2fs "$src" ;;
+    btrfs) btrfs filesystem resize max / ;;
+esac
+`
+
+// InstallGrowRoot installs a first-boot service that expands the root
+// partition and filesystem to fill the disk. Only meaningful for disk outputs:
+// cloud volumes and SD cards are almost always larger than the built image.
+func (r *Rootfs) InstallGrowRoot() error {
+	ui.SubStep("Installing first-boot root expansion...")
+
+	pkgs := []string{"cloud-utils-growpart"}
+	switch r.distro {
+	case "debian":
+		pkgs = []string{"cloud-guest-utils"}
+	case "alpine":
+		// BusyBox lacks findmnt/lsblk/sfdisk and resize2fs is split out
+		pkgs = append(pkgs, "findmnt", "lsblk", "sfdisk", "e2fsprogs-extra")
+	}
+	if err := r.InstallPackages(pkgs); err != nil {
+		return err
+	}
+
+	return r.installOneshot(oneshotService{
+		Name:        "distrorun-growroot",
+		Description: "Grow root filesystem to fill the disk",
+		Script:      growRootScript,
+	})
+}
+
+// identityFiles are per-machine secrets and identifiers that must not be
+// shared by every machine deployed from the same image. Globs are relative
+// to the rootfs.
+var identityFiles = []string{
+	"etc/ssh/ssh_host_*",
+	"var/lib/dbus/machine-id",
+	"var/lib/systemd/random-seed",
+	"var/lib/seedrng/seed.*",
+	"var/lib/misc/random-seed",
+}
+
+// identityScript regenerates the identity cleared by ResetIdentity.
+const identityScript = `#!/bin/sh
+# DistroRun first boot: give this machine its own identity.
+
+if [ -e /etc/machine-id ] && [ ! -s /etc/machine-id ]; then
+    if command -v systemd-machine-id-setup >/dev/null 2>&1; then
+        systemd-machine-id-setup
+    else
+        tr -d '-' < /proc/sys/kernel/random/uuid > /etc/machine-id
+    fi
+fi
+
+if command -v ssh-keygen >/dev/null 2>&1; then
+    ssh-keygen -A
+fi
+`
+
+// ResetIdentity removes machine-id, SSH host keys and random seeds from the
+// rootfs and installs a first-boot service that regenerates them, so clones
+// of one image do not share identities.
+func (r *Rootfs) ResetIdentity() error {
+	ui.SubStep("Clearing machine identity (machine-id, SSH host keys, seeds)...")
+
+	// An empty machine-id (rather than a missing one) tells systemd this is
+	// the first boot and keeps a read-only /etc bootable.
+	machineID := filepath.Join(r.Path, "etc", "machine-id")
+	if _, err := os.Stat(machineID); err == nil {
+		if err := audit.WriteFile(machineID, nil, 0444); err != nil {
+			return fmt.Errorf("truncating machine-id: %w", err)
+		}
+	}
+	for _, pattern := range identityFiles {
+		matches, _ := filepath.Glob(filepath.Join(r.Path, pattern))
+		for _, m := range matches {
+			if err := audit.Remove(m); err != nil {
+				return fmt.Errorf("removing %s: %w", m, err)
+			}
+		}
+	}
+
+	return r.installOneshot(oneshotService{
+		Name:        "distrorun-identity",
+		Description: "Regenerate machine-id and SSH host keys",
+		Script:      identityScript,
+		Before:      []string{"sshd"},
+	})
+}
+
+// InstallProvisioning installs scripts as first-boot services that run
+// once, in order. A script waiting for the network holds back the ones
+// after it. A script that fails runs again on the next boot.
+func (r *Rootfs) InstallProvisioning(scripts []config.ProvisionScript) error {
+	ui.SubStep(fmt.Sprintf("Installing %d first-boot provisioning script(s)...", len(scripts)))
+	var prev []string
+	network := false
+	for i, ps := range scripts {
+		body, err := os.ReadFile(ps.Script)
+		if err != nil {
+			return fmt.Errorf("reading provisioning script: %w", err)
+		}
+		if !strings.HasPrefix(string(body), "#!") {
+			body = append([]byte("#!/bin/sh\n"), body...)
+		}
+		// On OpenRC a script that waits for the network runs in the
+		// default runlevel, and so must every script after it.
+		network = network || ps.Network
+		name := fmt.Sprintf("distrorun-provision-%d-%s", i+1, serviceSlug(filepath.Base(ps.Script)))
+		ui.Detail(filepath.Base(ps.Script))
+		if err := r.installOneshot(oneshotService{
+			Name:        name,
+			Description: "Provisioning script " + filepath.Base(ps.Script),
+			Script:      string(body),
+			After:       prev,
+			Network:     network,
+		}); err != nil {
+			return err
+		}
+		prev = []string{name}
+	}
+	return nil
+}
+
+// serviceSlug turns a file name into a service name component: lower case
+// letters, digits and dashes, without the extension.
+func serviceSlug(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	slug := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return '-'
+	}, name)
+	if slug = strings.Trim(slug, "-"); slug == "" {
+		return "script"
+	}
+	return slug
+}
@@ -0,0 +1,55 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/netcap"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// RunHooks runs the user hook scripts for a pipeline stage in order.
+// Host hooks get the rootfs path in DISTRORUN_ROOTFS; chroot hooks are copied
+// into the rootfs and run there with ChrootExec. Every hook sees the stage
+// name in DISTRORUN_STAGE plus any extra "KEY=value" pairs in env.
+func (r *Rootfs) RunHooks(stage string, hooks []config.Hook, env ...string) error {
+	env = append([]string{"DISTRORUN_STAGE=" + stage}, env...)
+
+	for _, h := range hooks {
+		if h.Chroot {
+			ui.SubStep(fmt.Sprintf("Running %s hook (chroot): %s", stage, filepath.Base(h.Script)))
+			inRoot := "/tmp/distrorun-hook-" + filepath.Base(h.Script)
+			dst := filepath.Join(r.Path, inRoot)
+			if err := audit.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return fmt.Errorf("creating /tmp in rootfs: %w", err)
+			}
+			if err := fsutil.CopyFile(h.Script, dst); err != nil {
+				return fmt.Errorf("copying hook %s: %w", h.Script, err)
+			}
+			args := append(append([]string{"DISTRORUN_ROOTFS=/"}, env...), "/bin/sh", inRoot)
+			err := r.ChrootExec("env", args...)
+			audit.Remove(dst)
+			if err != nil {
+				return fmt.Errorf("%s hook %s: %w", stage, h.Script, err)
+			}
+			continue
+		}
+
+		ui.SubStep(fmt.Sprintf("Running %s hook: %s", stage, filepath.Base(h.Script)))
+		cmd := r.command("/bin/sh", h.Script)
+		cmd.Dir = filepath.Dir(h.Script)
+		cmd.Env = append(append(os.Environ(), "DISTRORUN_ROOTFS="+r.Path), env...)
+		cmd = netcap.Apply(cmd)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %s: %w", stage, h.Script, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package rootfs
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"slices"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// imageUpdateConfig is where the agent of updates.mode "image" finds its
+// manifest URL, reboot policy and the image version of the boot medium,
+// and imageUpdateKey the public key the manifest must be signed with.
+const (
+	imageUpdateConfig = "etc/distrorun/update.conf"
+	imageUpdateKey    = "etc/distrorun/update-key.pem"
+)
+
+// imageUpdateScript is the update agent of updates.mode "image". Run from
+// cron, it fetches the channel manifest, checks its Ed25519 signature and
+// compares the root filesystem checksum of the release with the one the
+// system runs. Only a release with a newer version than the running one
+// is installed, so a replayed older manifest, validly signed as it is,
+// cannot downgrade the system. It is downloaded to the persistence partition,
+// its ISO checksum verified, and its rootfs.squashfs copied into the A/B
+// slot not in use ("a" or "b" under distrorun/). The live init boots the
+// slot named in distrorun/active. A new slot is also marked pending: if
+// the system does not come up far enough to run "distrorun-update
+// confirm" (from the distrorun-update service), the next boot goes back
+// to the previous root filesystem.
+//
+// Only the root filesystem is replaced; the kernel and initramfs stay
+// those of the boot medium, so a release with another kernel is refused.
+const imageUpdateScript = `#!/bin/sh
+# DistroRun: image update agent (updates.mode: image).
+. /etc/distrorun/update.conf
+key=/etc/distrorun/update-key.pem
+exec >>/var/log/distrorun-update.log 2>&1
+echo "=== $(date) $*"
+
+persist=/run/distrorun-persist
+if ! mountpoint -q "$persist"; then
+    dev=$(findfs LABEL=distrorun-persis 2>/dev/null) || { echo "no distrorun-persis partition"; exit 1; }
+    mkdir -p "$persist" && mount -t ext4 "$dev" "$persist" || exit 1
+fi
+slots=$persist/distrorun
+mkdir -p "$slots"
+
+if [ "$1" = confirm ]; then
+    [ -f "$slots/pending" ] && echo "slot $(cat "$slots/pending") booted"
+    rm -f "$slots/pending" "$slots/tried"
+    exit 0
+fi
+if [ -f "$slots/pending" ]; then
+    echo "slot $(cat "$slots/pending") is waiting for a reboot"
+    exit 0
+fi
+
+work=$(mktemp -d)
+trap 'umount "$work/mnt" 2>/dev/null; rm -rf "$work" "$slots/download.iso"' EXIT
+mkdir -p "$work/mnt"
+
+wget -q -O "$work/channel.json" "$MANIFEST_URL" || { echo "cannot fetch $MANIFEST_URL"; exit 1; }
+wget -q -O "$work/channel.json.sig" "$MANIFEST_URL.sig" || { echo "cannot fetch $MANIFEST_URL.sig"; exit 1; }
+base64 -d "$work/channel.json.sig" > "$work/sig" &&
+    openssl pkeyutl -verify -pubin -inkey "$key" -rawin -in "$work/channel.json" -sigfile "$work/sig" >/dev/null ||
+    { echo "the manifest signature is invalid"; exit 1; }
+
+version=$(jq -r '.version // "?"' "$work/channel.json")
+entry=$(jq -c '[.files[] | select(.rootfs_sha256 != null)][0] // empty' "$work/channel.json")
+[ -n "$entry" ] || { echo "the manifest lists no ISO"; exit 1; }
+want=$(echo "$entry" | jq -r .rootfs_sha256)
+
+# The root filesystem and version running now: the active slot's, or the
+# boot medium's.
+active=$(cat "$slots/active" 2>/dev/null)
+if [ -n "$active" ]; then
+    current=$(cat "$slots/$active/rootfs.sha256" 2>/dev/null)
+    installed=$(cat "$slots/$active/version" 2>/dev/null)
+else
+    installed=$VERSION
+    current=$(cat "$slots/medium.sha256" 2>/dev/null)
+    medium=$(findfs LABEL=DISTRORUN 2>/dev/null)
+    if [ -z "$current" ] && [ -n "$medium" ] && mount -t iso9660 -o ro "$medium" "$work/mnt"; then
+        current=$(sha256sum "$work/mnt/rootfs.squashfs" | cut -d' ' -f1)
+        umount "$work/mnt"
+        echo "$current" > "$slots/medium.sha256"
+    fi
+fi
+if [ "$current" = "$want" ]; then
+    echo "up to date (version $version)"
+    exit 0
+fi
+if [ "$(apk version -t "$version" "$installed")" != ">" ]; then
+    echo "version $version is not newer than the running $installed, ignoring it"
+    exit 0
+fi
+if [ "$want" = "$(cat "$slots/failed.sha256" 2>/dev/null)" ]; then
+    echo "version $version did not boot before, waiting for the next release"
+    exit 0
+fi
+
+url=$(echo "$entry" | jq -r '.url // empty')
+[ -n "$url" ] || url="${MANIFEST_URL%/*}/$(echo "$entry" | jq -r .path)"
+echo "downloading version $version from $url"
+wget -q -O "$slots/download.iso" "$url" || { echo "download failed"; exit 1; }
+echo "$(echo "$entry" | jq -r .sha256)  $slots/download.iso" | sha256sum -c -s || { echo "the ISO does not match the manifest"; exit 1; }
+
+next=a
+[ "$active" = a ] && next=b
+rm -rf "${slots:?}/$next" && mkdir -p "$slots/$next" || exit 1
+mount -t iso9660 -o loop,ro "$slots/download.iso" "$work/mnt" || exit 1
+cp "$work/mnt/rootfs.squashfs" "$slots/$next/rootfs.squashfs" || { echo "not enough space on the persistence partition"; rm -rf "${slots:?}/$next"; exit 1; }
+umount "$work/mnt"
+rm -f "$slots/download.iso"
+echo "$want  $slots/$next/rootfs.squashfs" | sha256sum -c -s || { echo "the root filesystem does not match the manifest"; rm -rf "${slots:?}/$next"; exit 1; }
+
+mount -t squashfs -o loop,ro "$slots/$next/rootfs.squashfs" "$work/mnt" || { rm -rf "${slots:?}/$next"; exit 1; }
+if [ ! -d "$work/mnt/lib/modules/$(uname -r)" ]; then
+    echo "version $version has another kernel than $(uname -r): flash its ISO instead"
+    umount "$work/mnt"
+    rm -rf "${slots:?}/$next"
+    exit 1
+fi
+umount "$work/mnt"
+
+echo "$want" > "$slots/$next/rootfs.sha256"
+echo "$version" > "$slots/$next/version"
+echo "$active" > "$slots/previous"
+echo "$next" > "$slots/pending"
+echo "$next" > "$slots/active.new" && mv "$slots/active.new" "$slots/active"
+sync
+echo "version $version staged in slot $next"
+
+case "$REBOOT" in
+    always|if-needed) reboot ;;
+esac
+`
+
+// imageUpdateService confirms at every boot that a newly staged root
+// filesystem came up.
+const imageUpdateService = `#!/sbin/openrc-run
+description="Confirm the booted DistroRun image update"
+
+depend() {
+    need localmount
+}
+
+start() {
+    ebegin "Confirming image update"
+    ` + firstbootDir + `/distrorun-update confirm
+    eend $?
+}
+`
+
+// ed25519SPKIPrefix is the DER encoding of an Ed25519 SubjectPublicKeyInfo
+// up to the 32 key bytes, as openssl reads public keys.
+var ed25519SPKIPrefix = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+
+// installImageUpdates writes the configuration and public key of the
+// update agent and the service confirming updates at boot. version is the
+// image version being built, which releases must be newer than.
+func (r *Rootfs) installImageUpdates(u config.Updates, version string) error {
+	raw, err := base64.StdEncoding.DecodeString(u.PublicKey)
+	if err != nil {
+		return fmt.Errorf("decoding updates.public_key: %w", err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: slices.Concat(ed25519SPKIPrefix, raw)})
+	if err := r.writeFile(imageUpdateKey, string(key), 0644); err != nil {
+		return err
+	}
+	conf := fmt.Sprintf("MANIFEST_URL=%s\nREBOOT=%s\nVERSION=%s\n", shellQuote(u.Manifest), shellQuote(u.RebootPolicy()), shellQuote(version))
+	if err := r.writeFile(imageUpdateConfig, conf, 0644); err != nil {
+		return err
+	}
+	if err := r.writeFile("etc/init.d/distrorun-update", imageUpdateService, 0755); err != nil {
+		return err
+	}
+	ui.ServiceItem("distrorun-update")
+	if err := r.chroot("rc-update", "add", "distrorun-update", "default").Run(); err != nil {
+		return fmt.Errorf("enabling service distrorun-update: %w", err)
+	}
+	return nil
+}
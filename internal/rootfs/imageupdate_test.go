@@ -0,0 +1,113 @@
+package rootfs
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// imageUpdateStubs are the commands the agent runs that are stubbed out:
+// the persistence partition is a directory, wget serves files from $WEB
+// and apk compares versions with sort -V.
+var imageUpdateStubs = map[string]string{
+	"mountpoint": "#!/bin/sh\nexit 0\n",
+	"wget":       "#!/bin/sh\ncp \"$WEB/${4##*/}\" \"$3\"\n",
+	"apk": `#!/bin/sh
+if [ "$3" = "$4" ]; then echo "="
+elif [ "$(printf '%s\n%s\n' "$3" "$4" | sort -V | tail -n1)" = "$3" ]; then echo ">"
+else echo "<"; fi
+`,
+}
+
+func TestImageUpdateScript(t *testing.T) {
+	for _, tool := range []string{"sh", "jq", "openssl", "base64", "sha256sum", "sort"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	for name, tc := range map[string]struct {
+		version, rootfs string
+		key             ed25519.PrivateKey
+		active          string // slot running now, or the boot medium
+		want            string
+	}{
+		"older":         {version: "1.1", rootfs: "new", key: priv, active: "a", want: "version 1.1 is not newer than the running 1.2"},
+		"replayed":      {version: "1.2", rootfs: "new", key: priv, active: "a", want: "version 1.2 is not newer than the running 1.2"},
+		"older medium":  {version: "0.9", rootfs: "new", key: priv, want: "version 0.9 is not newer than the running 1.0"},
+		"up to date":    {version: "1.2", rootfs: "running", key: priv, active: "a", want: "up to date (version 1.2)"},
+		"newer":         {version: "1.10", rootfs: "new", key: priv, active: "a", want: "downloading version 1.10"},
+		"newer medium":  {version: "1.1", rootfs: "new", key: priv, want: "downloading version 1.1"},
+		"bad signature": {version: "2.0", rootfs: "new", key: otherKey, active: "a", want: "the manifest signature is invalid"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			web, bin, persist := filepath.Join(dir, "web"), filepath.Join(dir, "bin"), filepath.Join(dir, "persist")
+			slots := filepath.Join(persist, "distrorun")
+			for _, d := range []string{web, bin, filepath.Join(slots, "a")} {
+				if err := os.MkdirAll(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for tool, script := range imageUpdateStubs {
+				if err := os.WriteFile(filepath.Join(bin, tool), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			key := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: slices.Concat(ed25519SPKIPrefix, pub)})
+			conf := "MANIFEST_URL='http://updates.example/stable/channel.json'\nREBOOT='never'\nVERSION='1.0'\n"
+			manifest, _ := json.Marshal(map[string]any{
+				"version": tc.version,
+				"files":   []map[string]string{{"path": "os.iso", "sha256": "iso", "rootfs_sha256": tc.rootfs}},
+			})
+			files := map[string]string{
+				filepath.Join(dir, "update.conf"):       conf,
+				filepath.Join(dir, "update-key.pem"):    string(key),
+				filepath.Join(web, "channel.json"):      string(manifest),
+				filepath.Join(web, "channel.json.sig"):  base64.StdEncoding.EncodeToString(ed25519.Sign(tc.key, manifest)),
+				filepath.Join(slots, "medium.sha256"):   "medium\n",
+				filepath.Join(slots, "a/rootfs.sha256"): "running\n",
+				filepath.Join(slots, "a/version"):       "1.2\n",
+			}
+			if tc.active != "" {
+				files[filepath.Join(slots, "active")] = tc.active + "\n"
+			}
+			for path, content := range files {
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			script := strings.NewReplacer(
+				"/etc/distrorun/update.conf", filepath.Join(dir, "update.conf"),
+				"/etc/distrorun/update-key.pem", filepath.Join(dir, "update-key.pem"),
+				"/var/log/distrorun-update.log", filepath.Join(dir, "update.log"),
+				"persist=/run/distrorun-persist", "persist="+persist,
+			).Replace(imageUpdateScript)
+			cmd := exec.Command("sh", "-c", script, "distrorun-update")
+			cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "WEB="+web)
+			cmd.Run()
+
+			log, _ := os.ReadFile(filepath.Join(dir, "update.log"))
+			if !strings.Contains(string(log), tc.want) {
+				t.Errorf("log does not say %q:\n%s", tc.want, log)
+			}
+			if active, _ := os.ReadFile(filepath.Join(slots, "active")); strings.TrimSpace(string(active)) != tc.active {
+				t.Errorf("active slot = %q, want %q", active, tc.active)
+			}
+		})
+	}
+}
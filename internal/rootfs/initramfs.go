@@ -1,19 +1,37 @@
 package rootfs
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/compress"
+	"github.com/talfaza/distrorun/internal/cpio"
+	"github.com/talfaza/distrorun/internal/templates"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
 // customInit is the init script for live CD booting.
-// It mounts the CD-ROM, finds rootfs.squashfs, and creates a writable
-// overlay using tmpfs so the system behaves like a normal writable OS.
+// It finds the boot medium (CD-ROM, USB stick or virtual drive) holding
+// rootfs.squashfs, mounts it, and creates a writable
+// overlay so the system behaves like a normal writable OS. Netboot images
+// fetch it from the distrorun.squashfs URL instead, or find it embedded in
+// the initramfs. The upper layer is tmpfs, or with distrorun.persist on the
+// kernel command line an ext4 partition labeled distrorun-persis, so
+// changes survive reboots. With
+// distrorun.toram the squashfs is copied into memory first. A root
+// filesystem the image update agent staged on the persistence partition
+// is booted instead of the one on the boot medium.
 const customInit = `#!/bin/sh
 # DistroRun Live CD Init
 
@@ -28,49 +46,160 @@ mount -t proc proc /proc
 mount -t sysfs sysfs /sys
 
 # Load kernel modules for CD-ROM, squashfs, and overlay
-for mod in loop squashfs isofs overlay sr_mod cdrom ata_piix ahci virtio_blk virtio_pci virtio_scsi virtio_net e1000 8139cp 8139too; do
+for mod in loop squashfs isofs overlay ext4 sd_mod usb_storage uas xhci_pci ehci_pci mmc_block nvme sr_mod cdrom ata_piix ahci virtio_blk virtio_pci virtio_scsi virtio_net e1000 8139cp 8139too; do
     modprobe $mod 2>/dev/null
 done
 
-# Wait for CD-ROM device to appear (up to 10 seconds)
-echo "DistroRun: Waiting for CD-ROM..."
-i=0
-while [ ! -b /dev/sr0 ] && [ $i -lt 10 ]; do
-    sleep 1
-    i=$((i + 1))
+# Netboot: iPXE passes distrorun.squashfs=<url> on the kernel command line
+squashfs_url=
+serial=
+persist=
+toram=
+for arg in $(cat /proc/cmdline); do
+    case "$arg" in
+        distrorun.squashfs=*) squashfs_url="${arg#distrorun.squashfs=}" ;;
+        distrorun.persist) persist=1 ;;
+        distrorun.toram) toram=1 ;;
+        console=ttyS*) serial="${arg#console=}"; serial="${serial%%,*}" ;;
+    esac
 done
 
-if [ ! -b /dev/sr0 ]; then
-    echo "ERROR: CD-ROM device /dev/sr0 not found"
+if [ -f /rootfs.squashfs ]; then
+    # Netboot with the squashfs embedded in the initramfs
+    squashfs=/rootfs.squashfs
+elif [ -n "$squashfs_url" ]; then
+    echo "DistroRun: Configuring network for netboot..."
+    for dev in /sys/class/net/*; do
+        iface=${dev##*/}
+        [ "$iface" = "lo" ] && continue
+        ip link set "$iface" up
+        udhcpc -i "$iface" -n -q -t 5 -s /distrorun-udhcpc.script && break
+    done
+
+    echo "DistroRun: Fetching $squashfs_url..."
+    mkdir -p /media/netboot
+    mount -t tmpfs tmpfs /media/netboot
+    squashfs=/media/netboot/rootfs.squashfs
+    if ! wget -q -O "$squashfs" "$squashfs_url"; then
+        echo "ERROR: could not download $squashfs_url"
+        echo "Dropping to emergency shell..."
+        exec /bin/sh
+    fi
+else
+    # Find the boot medium: the ISO9660 filesystem holding rootfs.squashfs,
+    # trying the DISTRORUN volume label first and then every block device
+    # and partition. USB sticks and SCSI drives can take a while to appear,
+    # so keep retrying for 30 seconds.
+    echo "DistroRun: Looking for boot medium..."
+    mkdir -p /media/cdrom
+    squashfs=
+    i=0
+    while [ -z "$squashfs" ] && [ $i -lt 30 ]; do
+        for dev in $(findfs LABEL=DISTRORUN 2>/dev/null) $(ls -d /sys/block/*/ /sys/block/*/*/partition 2>/dev/null); do
+            case "$dev" in
+                /sys/*)
+                    dev=${dev%/}
+                    dev=${dev%/partition}
+                    dev=/dev/${dev##*/}
+                    ;;
+            esac
+            case "$dev" in /dev/loop*|/dev/ram*|/dev/zram*) continue ;; esac
+            [ -b "$dev" ] || continue
+            mount -t iso9660 -o ro "$dev" /media/cdrom 2>/dev/null || continue
+            if [ -f /media/cdrom/rootfs.squashfs ]; then
+                echo "DistroRun: Booting from $dev"
+                squashfs=/media/cdrom/rootfs.squashfs
+                break
+            fi
+            umount /media/cdrom
+        done
+        [ -n "$squashfs" ] && break
+        sleep 1
+        i=$((i + 1))
+    done
+
+    if [ -z "$squashfs" ]; then
+        echo "ERROR: no boot medium with rootfs.squashfs found"
+        echo "Dropping to emergency shell..."
+        exec /bin/sh
+    fi
+fi
+
+if [ ! -f "$squashfs" ]; then
+    echo "ERROR: rootfs.squashfs not found"
     echo "Dropping to emergency shell..."
     exec /bin/sh
 fi
 
-# Mount the CD-ROM (ISO9660)
-mkdir -p /media/cdrom
-mount -t iso9660 -o ro /dev/sr0 /media/cdrom
+# Writable upper layer: the persistence partition when requested and
+# present (USB sticks may take a few seconds to appear), tmpfs otherwise
+mkdir -p /upper
+persist_dev=
+persisted=
+if [ -n "$persist" ]; then
+    echo "DistroRun: Looking for persistence partition..."
+    i=0
+    while [ $i -lt 5 ]; do
+        persist_dev=$(findfs LABEL=distrorun-persis 2>/dev/null) && break
+        sleep 1
+        i=$((i + 1))
+    done
+fi
+if [ -n "$persist_dev" ] && mount -t ext4 "$persist_dev" /upper; then
+    echo "DistroRun: Persisting changes to $persist_dev"
+    persisted=1
+else
+    [ -n "$persist" ] && echo "DistroRun: No distrorun-persis partition, changes will be lost at reboot"
+fi
 
-if [ ! -f /media/cdrom/rootfs.squashfs ]; then
-    echo "ERROR: rootfs.squashfs not found on CD"
-    echo "Dropping to emergency shell..."
-    exec /bin/sh
+` + initSlots + `# Copy to RAM: the boot medium can be removed once the system is up. A
+# netboot squashfs is in memory already. The copy needs to leave 256 MiB
+# for the system, and the tmpfs is sized for it, as the default of half
+# the memory may be too small.
+if [ -n "$toram" ] && [ -z "$squashfs_url" ]; then
+    size_kb=$(( ($(stat -c %s "$squashfs") + 1023) / 1024 ))
+    avail_kb=$(awk '/^MemAvailable:/ { print $2 }' /proc/meminfo)
+    if [ "$avail_kb" -lt $((size_kb + 262144)) ]; then
+        echo "DistroRun: rootfs.squashfs needs $((size_kb / 1024)) MiB plus 256 MiB, only $((avail_kb / 1024)) MiB of memory free"
+        echo "DistroRun: Not enough memory, running from the boot medium"
+        toram=
+    fi
+fi
+if [ -n "$toram" ] && [ -z "$squashfs_url" ]; then
+    echo "DistroRun: Copying rootfs.squashfs to RAM..."
+    mkdir -p /media/ram
+    mount -t tmpfs -o size=$((size_kb + 1024))k tmpfs /media/ram
+    if cp "$squashfs" /media/ram/rootfs.squashfs; then
+        umount /media/cdrom
+        squashfs=/media/ram/rootfs.squashfs
+        echo "DistroRun: The boot medium can be removed"
+    else
+        echo "DistroRun: Not enough memory, running from the boot medium"
+        umount /media/ram
+    fi
 fi
 
 # Mount squashfs as read-only lower layer
 mkdir -p /lower
-mount -t squashfs -o ro,loop /media/cdrom/rootfs.squashfs /lower
+mount -t squashfs -o ro,loop "$squashfs" /lower
 
-# Create tmpfs for writable upper layer
-mkdir -p /upper
-mount -t tmpfs tmpfs /upper
-mkdir -p /upper/upper /upper/work
+if [ -z "$persisted" ]; then
+    mount -t tmpfs tmpfs /upper
+fi
+mkdir -p "$upper" "$work"
 
-# Create overlay: writable root = tmpfs on top of squashfs
+# Create overlay: writable root = upper layer on top of squashfs
 mkdir -p /sysroot
 mount -t overlay overlay \
-    -o lowerdir=/lower,upperdir=/upper/upper,workdir=/upper/work \
+    -o lowerdir=/lower,upperdir="$upper",workdir="$work" \
     /sysroot
 
+# Serial console requested: give it a login prompt. systemd starts
+# serial-getty@ by itself; BusyBox init needs an inittab entry.
+if [ -n "$serial" ] && [ -f /sysroot/etc/inittab ] && ! grep -q "^$serial:" /sysroot/etc/inittab; then
+    echo "$serial::respawn:/sbin/getty -L 115200 $serial vt100" >> /sysroot/etc/inittab
+fi
+
 # Create dirs systemd expects before switch_root
 mkdir -p /sysroot/dev /sysroot/proc /sysroot/sys /sysroot/run
 
@@ -83,125 +212,398 @@ echo "DistroRun: Switching to root filesystem..."
 exec switch_root /sysroot /sbin/init
 `
 
+// initSlots is the part of customInit that picks the root filesystem and
+// the overlay upper layer to boot: the boot medium's, or those of the
+// update slot the image update agent made active.
+const initSlots = `# A root filesystem staged by the image update agent (updates.mode: image)
+# in slot a or b of the persistence partition replaces the boot medium's.
+# A pending slot gets one boot to be confirmed by the agent; if it was
+# tried before without that, go back to the previous root filesystem.
+# Every slot keeps its changes in an overlay upper layer of its own, so a
+# new slot does not start on top of the changes made to the previous one.
+upper=/upper/upper
+work=/upper/work
+slots=/upper/distrorun
+if [ -n "$persisted" ] && [ -z "$squashfs_url" ] && [ -f "$slots/active" ]; then
+    if [ -f "$slots/pending" ] && [ -f "$slots/tried" ]; then
+        failed=$(cat "$slots/active")
+        echo "DistroRun: Update in slot $failed did not boot, rolling back"
+        cp "$slots/$failed/rootfs.sha256" "$slots/failed.sha256" 2>/dev/null
+        previous=$(cat "$slots/previous" 2>/dev/null)
+        if [ -n "$previous" ]; then
+            echo "$previous" > "$slots/active"
+        else
+            rm -f "$slots/active"
+        fi
+        rm -f "$slots/pending" "$slots/tried"
+    elif [ -f "$slots/pending" ]; then
+        touch "$slots/tried"
+    fi
+    slot=$(cat "$slots/active" 2>/dev/null)
+    if [ -n "$slot" ] && [ -f "$slots/$slot/rootfs.squashfs" ]; then
+        echo "DistroRun: Booting the root filesystem of update slot $slot"
+        squashfs=$slots/$slot/rootfs.squashfs
+        upper=$slots/$slot/upper
+        work=$slots/$slot/work
+    fi
+    sync
+fi
+
+`
+
+// udhcpcScript configures the interface from a DHCP lease inside the
+// initramfs, where BusyBox's default udhcpc script is not available.
+const udhcpcScript = `#!/bin/sh
+case "$1" in
+    bound|renew)
+        ip addr flush dev "$interface"
+        ip addr add "$ip/${mask:-24}" dev "$interface"
+        [ -n "$router" ] && ip route add default via "${router%% *}" dev "$interface"
+        : > /etc/resolv.conf
+        for d in $dns; do echo "nameserver $d" >> /etc/resolv.conf; done
+        ;;
+esac
+`
+
+// liveInit returns the /init script of live initramfs images: customInit,
+// or the template overriding it.
+func liveInit() ([]byte, error) {
+	script, err := templates.Render(templates.Init, customInit, nil)
+	return []byte(script), err
+}
+
+// mkinitfsFeatures matches the feature list of mkinitfs.conf.
+var mkinitfsFeatures = regexp.MustCompile(`features="([^"]*)"`)
+
+// AddInitramfsFeatures adds the mkinitfs features features to the
+// mkinitfs.conf of an Alpine rootfs and regenerates the initramfs; with
+// live, the live init is put into it again. The bootstrap generated the
+// initramfs before the packages were installed, and features such as lvm
+// take their tools from those.
+func (r *Rootfs) AddInitramfsFeatures(features []string, live bool) error {
+	if len(features) == 0 {
+		return nil
+	}
+	ui.SubStep("Adding initramfs features: " + strings.Join(features, ", ") + "...")
+	featuresDir := filepath.Join(r.Path, "etc", "mkinitfs", "features.d")
+	for _, f := range features {
+		_, errModules := os.Stat(filepath.Join(featuresDir, f+".modules"))
+		_, errFiles := os.Stat(filepath.Join(featuresDir, f+".files"))
+		if errModules != nil && errFiles != nil {
+			return fmt.Errorf("initramfs feature %q is unknown to mkinitfs: no %s.modules or %s.files in /etc/mkinitfs/features.d (is its package in packages?)", f, f, f)
+		}
+	}
+
+	confPath := filepath.Join(r.Path, "etc", "mkinitfs", "mkinitfs.conf")
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("reading mkinitfs.conf: %w", err)
+	}
+	m := mkinitfsFeatures.FindSubmatchIndex(data)
+	if m == nil {
+		return fmt.Errorf("mkinitfs.conf has no features= line")
+	}
+	list := strings.Fields(string(data[m[2]:m[3]]))
+	for _, f := range features {
+		if !slices.Contains(list, f) {
+			list = append(list, f)
+		}
+	}
+	conf := string(data[:m[2]]) + strings.Join(list, " ") + string(data[m[3]:])
+	if err := audit.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("writing mkinitfs.conf: %w", err)
+	}
+
+	if err := r.generateInitramfs(); err != nil {
+		return err
+	}
+	if live {
+		return r.PatchInitramfs()
+	}
+	return nil
+}
+
 // PatchInitramfs replaces the /init script inside the generated initramfs
 // with our custom live CD init. The initramfs is a gzip-compressed cpio archive.
 func (r *Rootfs) PatchInitramfs() error {
 	ui.SubStep("Patching initramfs with live CD init...")
 
-	bootDir := filepath.Join(r.Path, "boot")
-
-	// Find the initramfs file
-	initramfsPath := filepath.Join(bootDir, "initramfs-lts")
-	if _, err := os.Stat(initramfsPath); os.IsNotExist(err) {
-		// Try glob
-		matches, _ := filepath.Glob(filepath.Join(bootDir, "initramfs-*"))
-		if len(matches) == 0 {
-			return fmt.Errorf("initramfs not found in %s", bootDir)
-		}
-		initramfsPath = matches[0]
+	flavor, err := r.installedFlavor()
+	if err != nil {
+		return err
 	}
+	initramfsPath := filepath.Join(r.Path, "boot", "initramfs-"+flavor)
 
-	// Create temp working directory
-	workDir := filepath.Join(r.WorkDir, "initramfs-work")
-	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return fmt.Errorf("creating initramfs work dir: %w", err)
+	script, err := liveInit()
+	if err != nil {
+		return err
 	}
-	defer os.RemoveAll(workDir)
-
-	// Decompress gzip
-	compressedData, err := os.ReadFile(initramfsPath)
+	a, err := readInitramfs(initramfsPath)
 	if err != nil {
-		return fmt.Errorf("reading initramfs: %w", err)
+		return err
+	}
+	a.put("init", cpio.TypeRegular|0755, script)
+	a.put("distrorun-udhcpc.script", cpio.TypeRegular|0755, []byte(udhcpcScript))
+	if err := a.write(initramfsPath); err != nil {
+		return err
 	}
 
-	cpioPath := filepath.Join(workDir, "initramfs.cpio")
+	ui.SubStep("Initramfs patched successfully")
+	return nil
+}
+
+// initramfsArchive is the cpio archive of an initramfs, held in memory
+// while it is patched.
+type initramfsArchive struct {
+	early   []byte // plain archives ahead of the compressed one, kept as they are
+	entries []*initramfsEntry
+	now     int64 // mtime of added entries
+}
+
+// initramfsEntry is one entry of an initramfsArchive.
+type initramfsEntry struct {
+	cpio.Header
+	data []byte
+}
 
-	// Open the gzip stream
-	gzFile, err := os.Open(initramfsPath)
+// readInitramfs reads the initramfs file, a sequence of cpio archives,
+// each plain or gzip-compressed. Plain archives ahead of the first
+// compressed one, such as early microcode, are kept byte for byte: the
+// kernel only finds microcode uncompressed at the start of the file. The
+// entries of the other archives are merged, later ones replacing earlier
+// ones as when the kernel unpacks them. Data it cannot read fails.
+func readInitramfs(file string) (*initramfsArchive, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		return fmt.Errorf("opening initramfs: %w", err)
+		return nil, fmt.Errorf("opening initramfs: %w", err)
 	}
-	defer gzFile.Close()
+	a := &initramfsArchive{now: time.Now().Unix()}
+	src := bytes.NewReader(data)
+	br := bufio.NewReader(src)
+	compressed := false
+	for {
+		magic, err := skipPadding(br)
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading initramfs %s: %w", filepath.Base(file), err)
+		}
+		if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+			if !compressed {
+				compressed = true
+				a.early = data[:len(data)-src.Len()-br.Buffered()]
+				a.entries = nil
+			}
+			err = a.readCompressed(br)
+		} else {
+			err = a.readArchive(br)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading initramfs %s: %w", filepath.Base(file), err)
+		}
+	}
+}
 
-	gz, err := gzip.NewReader(gzFile)
+// readCompressed reads the archives of one gzip member of an initramfs.
+func (a *initramfsArchive) readCompressed(r *bufio.Reader) error {
+	gz, err := gzip.NewReader(r)
 	if err != nil {
-		// Might not be gzip — try as raw cpio
-		cpioPath = initramfsPath
-		goto extractCpio
+		return err
 	}
 	defer gz.Close()
+	// Stop at the end of the member, so padding after it is skipped
+	// rather than read as another gzip header.
+	gz.Multistream(false)
+	br := bufio.NewReader(gz)
+	for {
+		if _, err := skipPadding(br); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := a.readArchive(br); err != nil {
+			return err
+		}
+	}
+}
 
-	{
-		cpioFile, err := os.Create(cpioPath)
+// readArchive reads one cpio archive up to its trailer, merging its
+// entries into a. The archive's inodes are moved past those of earlier
+// archives, as hard links do not span archives.
+func (a *initramfsArchive) readArchive(r *bufio.Reader) error {
+	if magic, _ := r.Peek(6); !bytes.HasPrefix(magic, []byte("07070")) {
+		return fmt.Errorf("unsupported data (magic %x): only plain and gzip-compressed cpio archives can be patched", magic)
+	}
+	base := a.freeInode() - 1
+	cr := cpio.NewReader(r)
+	for {
+		h, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(cr)
 		if err != nil {
-			return fmt.Errorf("creating cpio file: %w", err)
+			return err
 		}
-		if _, err := io.Copy(cpioFile, gz); err != nil {
-			cpioFile.Close()
-			return fmt.Errorf("decompressing initramfs: %w", err)
+		h.Ino += base
+		e := &initramfsEntry{Header: *h, data: data}
+		if old := a.lookup(h.Name); old != nil {
+			*old = *e
+		} else {
+			a.entries = append(a.entries, e)
 		}
-		cpioFile.Close()
 	}
+}
 
-extractCpio:
-	_ = compressedData // used only for size awareness
-
-	// Extract cpio archive
-	extractDir := filepath.Join(workDir, "extracted")
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		return fmt.Errorf("creating extract dir: %w", err)
+// skipPadding discards the zeros archives are padded with and returns the
+// magic of what follows, or io.EOF at the end of r.
+func skipPadding(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != 0 {
+			break
+		}
+		r.Discard(1)
 	}
+	magic, _ := r.Peek(6)
+	return magic, nil
+}
 
-	cpioIn, err := os.Open(cpioPath)
-	if err != nil {
-		return fmt.Errorf("opening cpio: %w", err)
-	}
-	cmd := exec.Command("cpio", "-idm", "--quiet")
-	cmd.Dir = extractDir
-	cmd.Stdin = cpioIn
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		cpioIn.Close()
-		return fmt.Errorf("extracting cpio: %w", err)
+// cleanName returns an archive name without the leading "./" or "/"
+// archivers write.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// lookup returns the entry named name, or nil.
+func (a *initramfsArchive) lookup(name string) *initramfsEntry {
+	name = cleanName(name)
+	for _, e := range a.entries {
+		if cleanName(e.Name) == name {
+			return e
+		}
 	}
-	cpioIn.Close()
+	return nil
+}
 
-	// Replace /init with our custom init
-	initPath := filepath.Join(extractDir, "init")
-	if err := os.WriteFile(initPath, []byte(customInit), 0755); err != nil {
-		return fmt.Errorf("writing custom init: %w", err)
+// resolve follows symlinks in the directories of name, as dracut's
+// "bin -> usr/bin", so entries are added where the kernel would find them.
+func (a *initramfsArchive) resolve(name string) string {
+	dir, base := path.Split(cleanName(name))
+	resolved := ""
+	parts := strings.Split(strings.Trim(dir, "/"), "/")
+	for hops := 0; len(parts) > 0 && hops < 40; {
+		p := parts[0]
+		parts = parts[1:]
+		if p == "" {
+			continue
+		}
+		next := cleanName(path.Join(resolved, p))
+		if e := a.lookup(next); e != nil && e.Type() == cpio.TypeSymlink {
+			hops++
+			target := string(e.data)
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			parts = append(strings.Split(cleanName(target), "/"), parts...)
+			resolved = ""
+			continue
+		}
+		resolved = next
 	}
+	return cleanName(path.Join(resolved, base))
+}
 
-	// Repack: cpio | gzip
-	newCpioPath := filepath.Join(workDir, "new-initramfs.cpio")
+// put sets the mode and data of the entry named name, adding it and its
+// missing parent directories as needed.
+func (a *initramfsArchive) put(name string, mode uint32, data []byte) {
+	name = a.resolve(name)
+	if dir := path.Dir(name); dir != "." && a.lookup(dir) == nil {
+		a.put(dir, cpio.TypeDir|0755, nil)
+	}
+	e := a.lookup(name)
+	if e == nil {
+		e = &initramfsEntry{Header: cpio.Header{Name: name}}
+		a.entries = append(a.entries, e)
+	}
+	// A fresh inode, so a hard link the name had keeps the old data.
+	e.Ino, e.Nlink = a.freeInode(), 1
+	if mode&cpio.TypeMask == cpio.TypeDir {
+		e.Nlink = 2
+	}
+	e.Mode, e.Mtime, e.Size, e.data = mode, a.now, int64(len(data)), data
+}
 
-	// Create new cpio archive
-	findCmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && find . | cpio -o -H newc --quiet > %s", extractDir, newCpioPath))
-	findCmd.Stderr = os.Stderr
-	if err := findCmd.Run(); err != nil {
-		return fmt.Errorf("creating new cpio: %w", err)
+// freeInode returns an inode number no entry uses.
+func (a *initramfsArchive) freeInode() uint32 {
+	var top uint32
+	for _, e := range a.entries {
+		top = max(top, e.Ino)
 	}
+	return top + 1
+}
 
-	// Gzip compress
-	cpioData, err := os.ReadFile(newCpioPath)
-	if err != nil {
-		return fmt.Errorf("reading new cpio: %w", err)
+// write replaces the initramfs file with the early archives followed by
+// the archive, gzip-compressed.
+// For reproducible builds every entry is stamped with SOURCE_DATE_EPOCH and
+// the archive is written in sorted order with renumbered inodes and no
+// device numbers, as cpio --reproducible does, so the same files always
+// give the same bytes.
+func (a *initramfsArchive) write(file string) error {
+	entries := a.entries
+	if epoch, ok := sourceDateEpoch(); ok {
+		entries = slices.Clone(entries)
+		slices.SortStableFunc(entries, func(x, y *initramfsEntry) int {
+			return strings.Compare(cleanName(x.Name), cleanName(y.Name))
+		})
+		inodes := map[[3]uint32]uint32{}
+		for _, e := range entries {
+			key := [3]uint32{e.DevMajor, e.DevMinor, e.Ino}
+			if _, ok := inodes[key]; !ok {
+				inodes[key] = uint32(len(inodes) + 1)
+			}
+			e.Ino, e.DevMajor, e.DevMinor, e.Mtime = inodes[key], 0, 0, epoch
+		}
 	}
 
-	outFile, err := os.Create(initramfsPath)
+	out, err := audit.Create(file)
 	if err != nil {
 		return fmt.Errorf("creating new initramfs: %w", err)
 	}
-
-	gzWriter := gzip.NewWriter(outFile)
-	if _, err := gzWriter.Write(cpioData); err != nil {
-		outFile.Close()
+	if _, err := out.Write(a.early); err != nil {
+		out.Close()
+		return fmt.Errorf("writing initramfs: %w", err)
+	}
+	gz, err := compress.NewWriter(out, "gzip")
+	if err != nil {
+		out.Close()
+		return err
+	}
+	cw := cpio.NewWriter(gz)
+	for _, e := range entries {
+		if err := cw.WriteHeader(&e.Header); err != nil {
+			out.Close()
+			return fmt.Errorf("writing initramfs: %w", err)
+		}
+		if _, err := cw.Write(e.data); err != nil {
+			out.Close()
+			return fmt.Errorf("writing initramfs: %w", err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("writing initramfs: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
 		return fmt.Errorf("compressing initramfs: %w", err)
 	}
-	gzWriter.Close()
-	outFile.Close()
-
-	ui.SubStep("Initramfs patched successfully")
-	return nil
+	return out.Close()
 }
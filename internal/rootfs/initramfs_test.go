@@ -0,0 +1,295 @@
+package rootfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/cpio"
+	"github.com/talfaza/distrorun/internal/flash"
+)
+
+func TestPersistLabel(t *testing.T) {
+	// The partition is made by flash -persist and test -persistent-disk.
+	want := "findfs LABEL=" + flash.PersistLabel + " "
+	for name, script := range map[string]string{"init": customInit, "image update agent": imageUpdateScript} {
+		if !strings.Contains(script, want) {
+			t.Errorf("the %s does not look for the partition with %q", name, want)
+		}
+	}
+}
+
+func TestInitSlots(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	for name, tc := range map[string]struct {
+		state     map[string]string // files under distrorun/ on the partition
+		persisted bool
+		want      string          // squashfs and upper layer booted
+		wantState map[string]bool // files left behind
+	}{
+		"no update": {
+			persisted: true,
+			want:      "/medium/rootfs.squashfs /upper/upper",
+		},
+		"not persisted": {
+			state: map[string]string{"active": "a", "a/rootfs.squashfs": ""},
+			want:  "/medium/rootfs.squashfs /upper/upper",
+		},
+		"confirmed slot": {
+			state:     map[string]string{"active": "b", "b/rootfs.squashfs": ""},
+			persisted: true,
+			want:      "/upper/distrorun/b/rootfs.squashfs /upper/distrorun/b/upper",
+			wantState: map[string]bool{"tried": false},
+		},
+		"pending slot": {
+			state:     map[string]string{"active": "b", "previous": "a", "pending": "b", "a/rootfs.squashfs": "", "b/rootfs.squashfs": ""},
+			persisted: true,
+			want:      "/upper/distrorun/b/rootfs.squashfs /upper/distrorun/b/upper",
+			wantState: map[string]bool{"pending": true, "tried": true},
+		},
+		"rollback": {
+			state:     map[string]string{"active": "b", "previous": "a", "pending": "b", "tried": "", "a/rootfs.squashfs": "", "b/rootfs.squashfs": "", "b/rootfs.sha256": "bad"},
+			persisted: true,
+			want:      "/upper/distrorun/a/rootfs.squashfs /upper/distrorun/a/upper",
+			wantState: map[string]bool{"pending": false, "tried": false, "failed.sha256": true},
+		},
+		"rollback to the medium": {
+			state:     map[string]string{"active": "a", "pending": "a", "tried": "", "a/rootfs.squashfs": ""},
+			persisted: true,
+			want:      "/medium/rootfs.squashfs /upper/upper",
+			wantState: map[string]bool{"active": false},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, content := range tc.state {
+				path := filepath.Join(dir, "distrorun", file)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			persisted := ""
+			if tc.persisted {
+				persisted = "1"
+			}
+			script := "squashfs=/medium/rootfs.squashfs\npersisted=" + persisted + "\n" +
+				strings.ReplaceAll(initSlots, "/upper/", dir+"/") + `echo "$squashfs $upper"` + "\n"
+			out, err := exec.Command("sh", "-c", script).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			got := strings.ReplaceAll(lines[len(lines)-1], dir+"/", "/upper/")
+			if got != tc.want {
+				t.Errorf("booted %q, want %q", got, tc.want)
+			}
+			for file, want := range tc.wantState {
+				if _, err := os.Stat(filepath.Join(dir, "distrorun", file)); (err == nil) != want {
+					t.Errorf("%s exists: %v, want %v", file, err == nil, want)
+				}
+			}
+		})
+	}
+}
+
+// cpioArchive returns a newc archive of regular files, name → contents.
+func cpioArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		h := &cpio.Header{Name: files[i], Ino: uint32(i/2 + 1), Mode: cpio.TypeRegular | 0644, Nlink: 1, Size: int64(len(files[i+1]))}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadInitramfs(t *testing.T) {
+	microcode := cpioArchive(t, "kernel/x86/microcode/GenuineIntel.bin", "ucode")
+	main := cpioArchive(t, "init", "old init", "etc/fstab", "fstab")
+	extra := cpioArchive(t, "init", "new init")
+
+	for name, tc := range map[string]struct {
+		data      []byte
+		wantEarly []byte
+		want      map[string]string
+	}{
+		"compressed": {
+			data: gzipped(t, main),
+			want: map[string]string{"init": "old init", "etc/fstab": "fstab"},
+		},
+		"early microcode": {
+			data:      slices.Concat(microcode, gzipped(t, main)),
+			wantEarly: microcode,
+			want:      map[string]string{"init": "old init", "etc/fstab": "fstab"},
+		},
+		"plain archives": {
+			data: slices.Concat(main, extra),
+			want: map[string]string{"init": "new init", "etc/fstab": "fstab"},
+		},
+		"two gzip members with padding": {
+			data:      slices.Concat(microcode, gzipped(t, main), make([]byte, 3), gzipped(t, extra), make([]byte, 8)),
+			wantEarly: microcode,
+			want:      map[string]string{"init": "new init", "etc/fstab": "fstab"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "initramfs")
+			os.WriteFile(file, tc.data, 0644)
+			a, err := readInitramfs(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(a.early, tc.wantEarly) {
+				t.Errorf("early archives = %d bytes, want %d", len(a.early), len(tc.wantEarly))
+			}
+			got := map[string]string{}
+			for _, e := range a.entries {
+				got[e.Name] = string(e.data)
+			}
+			if len(got) != len(a.entries) || len(got) != len(tc.want) {
+				t.Errorf("entries = %v, want %v", got, tc.want)
+			}
+			for name, data := range tc.want {
+				if got[name] != data {
+					t.Errorf("%s = %q, want %q", name, got[name], data)
+				}
+			}
+
+			// Writing keeps the early archives in front, uncompressed.
+			a.put("init", cpio.TypeRegular|0755, []byte("live init"))
+			if err := a.write(file); err != nil {
+				t.Fatal(err)
+			}
+			written, _ := os.ReadFile(file)
+			if !bytes.HasPrefix(written, tc.wantEarly) {
+				t.Error("the early archives were not written first")
+			}
+			b, err := readInitramfs(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.early, tc.wantEarly) {
+				t.Errorf("rewritten early archives = %d bytes, want %d", len(b.early), len(tc.wantEarly))
+			}
+			if e := b.lookup("init"); e == nil || string(e.data) != "live init" {
+				t.Errorf("rewritten init = %v, want the live init", e)
+			}
+		})
+	}
+}
+
+func TestInitramfsReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	// write builds an initramfs of the same files in another order, with
+	// other inode numbers and times, and patches it as a build does.
+	write := func(names []string, ino uint32, mtime int64) []byte {
+		var buf bytes.Buffer
+		w := cpio.NewWriter(&buf)
+		for i, name := range names {
+			w.WriteHeader(&cpio.Header{Name: name, Ino: ino + uint32(i), Mode: cpio.TypeRegular | 0644, Nlink: 1, Mtime: mtime, Size: int64(len(name))})
+			w.Write([]byte(name))
+		}
+		w.Close()
+		file := filepath.Join(t.TempDir(), "initramfs")
+		os.WriteFile(file, gzipped(t, buf.Bytes()), 0644)
+
+		a, err := readInitramfs(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.put("init", cpio.TypeRegular|0755, []byte("live init"))
+		if err := a.write(file); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(file)
+		return data
+	}
+
+	first := write([]string{"etc/fstab", "init", "sbin/modprobe"}, 1, 1710000000)
+	second := write([]string{"sbin/modprobe", "etc/fstab", "init"}, 300, 1720000000)
+	if !bytes.Equal(first, second) {
+		t.Error("two initramfs images of the same files differ despite SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestReadInitramfsUnsupported(t *testing.T) {
+	main := cpioArchive(t, "init", "init")
+	for name, data := range map[string][]byte{
+		"zstd":          {0x28, 0xb5, 0x2f, 0xfd, 0, 0},
+		"zstd after":    slices.Concat(gzipped(t, main), []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}),
+		"truncated":     main[:100],
+		"garbage in gz": gzipped(t, slices.Concat(main, []byte("garbage"))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "initramfs")
+			os.WriteFile(file, data, 0644)
+			if _, err := readInitramfs(file); err == nil {
+				t.Error("readInitramfs succeeded")
+			}
+		})
+	}
+}
+
+func TestAddInitramfsFeatures(t *testing.T) {
+	const conf = "features=\"ata base ext4\"\ndisable_trigger=yes\n"
+	for name, tc := range map[string]struct {
+		features []string
+		conf     string
+		want     string // mkinitfs.conf afterwards
+		wantErr  string
+	}{
+		"none":             {conf: conf, want: conf},
+		"added":            {features: []string{"lvm", "base"}, conf: conf, want: "features=\"ata base ext4 lvm\"\ndisable_trigger=yes\n"},
+		"unknown":          {features: []string{"zfs"}, conf: conf, want: conf, wantErr: `feature "zfs" is unknown`},
+		"no features line": {features: []string{"lvm"}, conf: "disable_trigger=yes\n", want: "disable_trigger=yes\n", wantErr: "no features= line"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := &Rootfs{Path: t.TempDir()}
+			dir := filepath.Join(r.Path, "etc", "mkinitfs")
+			os.MkdirAll(filepath.Join(dir, "features.d"), 0755)
+			for _, f := range []string{"ata.modules", "base.files", "ext4.modules", "lvm.files"} {
+				os.WriteFile(filepath.Join(dir, "features.d", f), nil, 0644)
+			}
+			os.WriteFile(filepath.Join(dir, "mkinitfs.conf"), []byte(tc.conf), 0644)
+
+			// There is no kernel to run mkinitfs for, so even a feature
+			// list that was written fails at the initramfs generation.
+			err := r.AddInitramfsFeatures(tc.features, false)
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("AddInitramfsFeatures = %v, want an error saying %q", err, tc.wantErr)
+			}
+			if tc.features == nil && err != nil {
+				t.Errorf("AddInitramfsFeatures without features = %v", err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dir, "mkinitfs.conf")); string(got) != tc.want {
+				t.Errorf("mkinitfs.conf = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package rootfs
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// inputScript loads the keymap and console font chosen in the boot menu,
+// passed as keymap= and font= on the kernel command line. Alpine's binary
+// keymaps are loaded with busybox loadkmap, other keymaps with loadkeys.
+const inputScript = `#!/bin/sh
+for arg in $(cat /proc/cmdline); do
+    case "$arg" in
+    keymap=*) keymap=${arg#keymap=} ;;
+    font=*) font=${arg#font=} ;;
+    esac
+done
+
+if [ -n "$keymap" ]; then
+    map=$(find /usr/share/bkeymaps -name "$keymap.bmap.gz" 2>/dev/null | head -n 1)
+    if [ -n "$map" ]; then
+        zcat "$map" | loadkmap
+    else
+        loadkeys "$keymap"
+    fi
+fi
+if [ -n "$font" ]; then
+    for tty in /dev/tty[1-6]; do
+        setfont -C "$tty" "$font"
+    done
+fi
+exit 0
+`
+
+// inputInit is the OpenRC service running inputScript on every boot.
+const inputInit = `#!/sbin/openrc-run
+
+description="Load the keymap and console font chosen in the boot menu"
+
+depend() {
+	need localmount
+	after loadkmap consolefont
+}
+
+start() {
+	ebegin "Loading boot menu keymap and font"
+	` + firstbootDir + `/distrorun-input
+	eend $?
+}
+`
+
+// inputUnit is the systemd service running inputScript on every boot,
+// after systemd-vconsole-setup has loaded /etc/vconsole.conf.
+const inputUnit = `[Unit]
+Description=Load the keymap and console font chosen in the boot menu
+After=systemd-vconsole-setup.service
+Before=getty.target
+
+[Service]
+Type=oneshot
+ExecStart=` + firstbootDir + `/distrorun-input
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// InstallInputSwitcher installs the console keymaps and fonts of the
+// live.input boot menu entries and a service that, on every boot, loads
+// the ones the chosen entry names.
+func (r *Rootfs) InstallInputSwitcher(locales []config.InputLocale) error {
+	ui.SubStep(fmt.Sprintf("Installing %d boot menu keyboard layouts...", len(locales)))
+	fonts := false
+	for _, in := range locales {
+		fonts = fonts || in.Font != ""
+	}
+	var pkgs []string
+	switch r.distro {
+	case "alpine":
+		// busybox loads the binary keymaps; kbd brings setfont and
+		// kbd-misc the fonts.
+		pkgs = []string{"kbd-bkeymaps"}
+		if fonts {
+			pkgs = append(pkgs, "kbd", "kbd-misc")
+		}
+	case "debian":
+		pkgs = []string{"kbd", "console-data"} // Debian's kbd ships no keymaps
+	default:
+		pkgs = []string{"kbd"}
+	}
+	if err := r.InstallPackages(pkgs); err != nil {
+		return err
+	}
+	if r.distro == "alpine" {
+		for _, in := range locales {
+			matches, _ := filepath.Glob(filepath.Join(r.Path, "usr", "share", "bkeymaps", "*", in.Keymap+".bmap.gz"))
+			if len(matches) == 0 {
+				return fmt.Errorf("unknown keymap %q: not in /usr/share/bkeymaps", in.Keymap)
+			}
+		}
+	}
+
+	if err := r.writeFile(firstbootDir[1:]+"/distrorun-input", inputScript, 0755); err != nil {
+		return err
+	}
+	if r.systemd() {
+		if err := r.writeFile("etc/systemd/system/distrorun-input.service", inputUnit, 0644); err != nil {
+			return err
+		}
+		if err := r.command("chroot", r.Path, "systemctl", "enable", "distrorun-input").Run(); err != nil {
+			return fmt.Errorf("enabling distrorun-input: %w", err)
+		}
+	} else {
+		if err := r.writeFile("etc/init.d/distrorun-input", inputInit, 0755); err != nil {
+			return err
+		}
+		if err := r.command("chroot", r.Path, "rc-update", "add", "distrorun-input", "boot").Run(); err != nil {
+			return fmt.Errorf("enabling distrorun-input: %w", err)
+		}
+	}
+	for _, in := range locales {
+		ui.Detail(in.MenuLabel())
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// HostSecurity describes the Linux security modules enforcing policy on the
+// build host. Their denials surface as bare "Permission denied" errors from
+// mount and chroot, which say nothing about where they come from.
+type HostSecurity struct {
+	SELinux  string // "enforcing", "permissive", or "" when SELinux is off
+	AppArmor string // enforcing profile confining this process, or ""
+}
+
+// DetectHostSecurity reports the SELinux mode and the AppArmor profile of
+// the running process.
+func DetectHostSecurity() HostSecurity {
+	var h HostSecurity
+	if data, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil {
+		h.SELinux = "permissive"
+		if strings.TrimSpace(string(data)) == "1" {
+			h.SELinux = "enforcing"
+		}
+	}
+	if data, err := os.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(data)) == "Y" {
+		h.AppArmor = apparmorProfile()
+	}
+	return h
+}
+
+// apparmorProfile returns the profile confining this process if it is in
+// enforce mode, e.g. "/usr/bin/distrorun" for "/usr/bin/distrorun (enforce)".
+func apparmorProfile() string {
+	for _, p := range []string{"/proc/self/attr/apparmor/current", "/proc/self/attr/current"} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		label := strings.TrimRight(string(data), "\x00\n")
+		if profile, ok := strings.CutSuffix(label, " (enforce)"); ok {
+			return profile
+		}
+		return ""
+	}
+	return ""
+}
+
+// Enforcing reports whether a security module can deny build operations.
+func (h HostSecurity) Enforcing() bool {
+	return h.SELinux == "enforcing" || h.AppArmor != ""
+}
+
+// Explain adds to err what to check when a build step fails on a host with
+// an enforcing security module. Other errors are returned unchanged.
+func (h HostSecurity) Explain(err error) error {
+	if err == nil || !h.Enforcing() {
+		return err
+	}
+	var hints []string
+	if h.SELinux == "enforcing" {
+		hints = append(hints,
+			"SELinux is enforcing: list recent denials with 'ausearch -m avc -ts recent'; 'setenforce 0' confirms whether SELinux is the cause")
+	}
+	if h.AppArmor != "" {
+		hints = append(hints, fmt.Sprintf(
+			"AppArmor confines distrorun with profile %q: look for DENIED in 'journalctl -k'; 'aa-complain %s' confirms whether AppArmor is the cause",
+			h.AppArmor, h.AppArmor))
+	}
+	return fmt.Errorf("%w\n  if the output above shows \"Permission denied\":\n  - %s", err, strings.Join(hints, "\n  - "))
+}
+
+// labelWorkDir gives a new workdir the SELinux type of the root directory.
+// A fresh directory under /tmp gets a tmp type, which policies do not allow
+// mounting on, so the chroot's bind mounts would be denied. Files created
+// later inherit the type from the directory.
+func labelWorkDir(dir string) error {
+	if DetectHostSecurity().SELinux == "" {
+		return nil
+	}
+	if out, err := audit.Command("chcon", "--reference=/", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("labeling %s for SELinux: %v: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
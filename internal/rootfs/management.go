@@ -0,0 +1,156 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// avahiService advertises a TCP service over mDNS/DNS-SD; %[1]s is the
+// service type, %[2]d the port. "%h" is expanded by avahi to the hostname.
+const avahiService = `<?xml version="1.0" standalone='no'?>
+<!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+<!-- Generated by DistroRun (management) -->
+<service-group>
+  <name replace-wildcards="yes">%%h</name>
+  <service>
+    <type>%[1]s</type>
+    <port>%[2]d</port>
+  </service>
+</service-group>
+`
+
+// acfHTTPDConf serves the Alpine Configuration Framework over HTTPS, as
+// setup-acf does.
+const acfHTTPDConf = `# Generated by DistroRun (management.web_admin)
+nochroot
+dir=/usr/share/acf/www
+cgipat=cgi-bin**
+certfile=/etc/ssl/mini_httpd/server.pem
+port=443
+ssl
+`
+
+// acfCertScript gives every machine its own self-signed certificate for the
+// web admin instead of one baked into the image.
+const acfCertScript = `#!/bin/sh
+# DistroRun first boot: create the web admin TLS certificate.
+set -e
+
+mkdir -p /etc/ssl/mini_httpd
+[ -s /etc/ssl/mini_httpd/server.pem ] && exit 0
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 \
+    -subj "/CN=$(hostname)" \
+    -keyout /etc/ssl/mini_httpd/server.pem -out /etc/ssl/mini_httpd/server.pem
+chmod 600 /etc/ssl/mini_httpd/server.pem
+`
+
+// ConfigureManagement makes a headless machine reachable right after its
+// first boot: avahi announces it on the LAN as <hostname>.local, sshd
+// accepts logins, and a web admin runs (Cockpit on port 9090 on Fedora and
+// Debian, the Alpine Configuration Framework on port 443 on Alpine).
+func (r *Rootfs) ConfigureManagement(m config.Management) error {
+	ui.SubStep("Configuring remote management...")
+
+	var pkgs, services []string
+	if m.MDNS {
+		switch r.distro {
+		case "alpine":
+			pkgs = append(pkgs, "avahi", "dbus")
+			services = append(services, "dbus", "avahi-daemon")
+		case "fedora":
+			pkgs = append(pkgs, "avahi", "nss-mdns")
+			services = append(services, "avahi-daemon")
+		default:
+			pkgs = append(pkgs, "avahi-daemon", "libnss-mdns")
+			services = append(services, "avahi-daemon")
+		}
+	}
+	if m.SSH {
+		switch r.distro {
+		case "alpine":
+			pkgs = append(pkgs, "openssh")
+			services = append(services, "sshd")
+		case "fedora":
+			pkgs = append(pkgs, "openssh-server")
+			services = append(services, "sshd")
+		default:
+			pkgs = append(pkgs, "openssh-server")
+			services = append(services, "ssh")
+		}
+	}
+	webPort := 9090
+	if m.WebAdmin {
+		if r.distro == "alpine" {
+			webPort = 443
+			pkgs = append(pkgs, "acf-core", "acf-alpine-baselayout", "acf-apk-tools", "mini_httpd", "openssl")
+			if m.SSH {
+				pkgs = append(pkgs, "acf-openssh")
+			}
+			services = append(services, "mini_httpd")
+		} else {
+			pkgs = append(pkgs, "cockpit")
+			services = append(services, "cockpit.socket")
+		}
+	}
+	if err := r.InstallPackages(pkgs); err != nil {
+		return err
+	}
+
+	if m.WebAdmin && r.distro == "alpine" {
+		if err := r.configureACF(); err != nil {
+			return err
+		}
+	}
+
+	if m.MDNS {
+		if m.SSH {
+			if err := r.writeFile("etc/avahi/services/ssh.service", fmt.Sprintf(avahiService, "_ssh._tcp", 22), 0644); err != nil {
+				return err
+			}
+		}
+		if m.WebAdmin {
+			if err := r.writeFile("etc/avahi/services/distrorun-admin.service", fmt.Sprintf(avahiService, "_https._tcp", webPort), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := r.EnableServices(services); err != nil {
+		return err
+	}
+
+	hostname, _ := os.ReadFile(filepath.Join(r.Path, "etc", "hostname"))
+	host := strings.TrimSpace(string(hostname))
+	if m.MDNS && host != "" {
+		host += ".local"
+		ui.Detail("Reachable as " + host)
+	}
+	if m.WebAdmin && host != "" {
+		ui.Detail(fmt.Sprintf("Web admin at https://%s:%d/", host, webPort))
+	}
+	return nil
+}
+
+// configureACF sets up the Alpine Configuration Framework the way setup-acf
+// does, minus starting the server: mini_httpd serves it over HTTPS and root
+// logs in with the system password.
+func (r *Rootfs) configureACF() error {
+	if err := r.writeFile("etc/mini_httpd/mini_httpd.conf", acfHTTPDConf, 0644); err != nil {
+		return err
+	}
+	// "x" makes ACF check the password against /etc/shadow.
+	if err := r.writeFile("etc/acf/passwd", "root:x:Admin account:ADMIN\n", 0600); err != nil {
+		return err
+	}
+	return r.installOneshot(oneshotService{
+		Name:        "distrorun-webadmin-cert",
+		Description: "Create the web admin TLS certificate",
+		Script:      acfCertScript,
+		Before:      []string{"mini_httpd"},
+	})
+}
@@ -0,0 +1,157 @@
+package rootfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// ConfigureInterfaces replaces the default DHCP-on-eth0 /etc/network/interfaces
+// with the given interfaces. Bonds, bridges and VLANs need ifupdown-ng and
+// iproute2, which are installed only when one is configured; busybox ifupdown
+// handles plain ethernet interfaces. A wireless interface is associated by
+// wpa_supplicant before networking brings it up.
+func (r *Rootfs) ConfigureInterfaces(ifaces []config.Interface) error {
+	if len(ifaces) == 0 {
+		return nil
+	}
+	ui.SubStep(fmt.Sprintf("Configuring %d network interfaces...", len(ifaces)))
+
+	for _, iface := range ifaces {
+		if t := iface.InterfaceType(); t != "ethernet" && t != "wireless" {
+			if err := r.InstallPackages([]string{"ifupdown-ng", "iproute2"}); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	for _, iface := range ifaces {
+		if iface.InterfaceType() == "wireless" {
+			if err := r.configureWPASupplicant(iface); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := r.writeFile("etc/network/interfaces", renderInterfaces(ifaces), 0644); err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		ui.Detail(describeInterface(iface))
+	}
+	return nil
+}
+
+// configureWPASupplicant stores the credentials of a wireless interface and
+// starts wpa_supplicant on it at boot. Wireless firmware is not installed;
+// boards that need it must list the matching linux-firmware-* package.
+func (r *Rootfs) configureWPASupplicant(iface config.Interface) error {
+	if err := r.InstallPackages([]string{"wpa_supplicant", "wireless-regdb"}); err != nil {
+		return err
+	}
+	auth := "    key_mgmt=NONE\n"
+	if iface.Passphrase != "" {
+		auth = fmt.Sprintf("    psk=\"%s\"\n", iface.Passphrase)
+	}
+	conf := fmt.Sprintf("# Generated by DistroRun (network.interfaces)\nctrl_interface=/run/wpa_supplicant\n\nnetwork={\n    ssid=\"%s\"\n%s}\n", iface.SSID, auth)
+	// The passphrase is in the file, so keep it from other users.
+	if err := r.writeFile("etc/wpa_supplicant/wpa_supplicant.conf", conf, 0600); err != nil {
+		return err
+	}
+	args := fmt.Sprintf("wpa_supplicant_args=\"-i %s\"\n", iface.Name)
+	if err := r.writeFile("etc/conf.d/wpa_supplicant", args, 0644); err != nil {
+		return err
+	}
+	if err := r.command("chroot", r.Path, "rc-update", "add", "wpa_supplicant", "boot").Run(); err != nil {
+		return fmt.Errorf("enabling service wpa_supplicant: %w", err)
+	}
+	return nil
+}
+
+// ConfigureDNS writes the nameservers to /etc/resolv.conf and keeps the
+// busybox DHCP client from replacing them with those of the lease.
+func (r *Rootfs) ConfigureDNS(servers []string) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	ui.SubStep("Configuring DNS servers...")
+	var b strings.Builder
+	b.WriteString("# Generated by DistroRun (network.dns)\n")
+	for _, ns := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if err := r.writeFile("etc/resolv.conf", b.String(), 0644); err != nil {
+		return err
+	}
+	if err := r.writeFile("etc/udhcpc/udhcpc.conf", "# Generated by DistroRun (network.dns)\nRESOLV_CONF=\"no\"\n", 0644); err != nil {
+		return err
+	}
+	ui.Detail(strings.Join(servers, ", "))
+	return nil
+}
+
+// renderInterfaces renders ifaces in ifupdown-ng syntax, which also accepts
+// the classic "iface X inet METHOD" form understood by busybox ifupdown.
+func renderInterfaces(ifaces []config.Interface) string {
+	var b strings.Builder
+	b.WriteString("# Generated by DistroRun (network.interfaces)\nauto lo\niface lo inet loopback\n")
+	for _, iface := range ifaces {
+		method := "manual"
+		switch {
+		case iface.DHCP:
+			method = "dhcp"
+		case iface.Address != "":
+			method = "static"
+		}
+		fmt.Fprintf(&b, "\nauto %s\niface %s inet %s\n", iface.Name, iface.Name, method)
+
+		switch iface.InterfaceType() {
+		case "bond":
+			fmt.Fprintf(&b, "    use bond\n    bond-members %s\n    bond-mode %s\n", strings.Join(iface.BondMembers, " "), iface.Mode())
+			if iface.Mode() == "802.3ad" {
+				b.WriteString("    bond-miimon 100\n")
+			}
+		case "bridge":
+			b.WriteString("    use bridge\n")
+			if len(iface.BridgePorts) > 0 {
+				fmt.Fprintf(&b, "    bridge-ports %s\n", strings.Join(iface.BridgePorts, " "))
+			}
+		case "vlan":
+			fmt.Fprintf(&b, "    use vlan\n    vlan-id %d\n    vlan-raw-device %s\n", iface.VLANID, iface.VLANLink)
+		}
+		if iface.Address != "" {
+			fmt.Fprintf(&b, "    address %s\n", iface.Address)
+		}
+		if iface.Gateway != "" {
+			fmt.Fprintf(&b, "    gateway %s\n", iface.Gateway)
+		}
+	}
+	return b.String()
+}
+
+// describeInterface returns a one-line summary of iface for the build log.
+func describeInterface(iface config.Interface) string {
+	desc := iface.Name + " (" + iface.InterfaceType()
+	switch iface.InterfaceType() {
+	case "bond":
+		desc += " " + iface.Mode() + " of " + strings.Join(iface.BondMembers, ", ")
+	case "bridge":
+		if len(iface.BridgePorts) > 0 {
+			desc += " of " + strings.Join(iface.BridgePorts, ", ")
+		}
+	case "vlan":
+		desc += fmt.Sprintf(" %d on %s", iface.VLANID, iface.VLANLink)
+	case "wireless":
+		desc += fmt.Sprintf(" %q", iface.SSID)
+	}
+	desc += ")"
+	switch {
+	case iface.DHCP:
+		desc += ": dhcp"
+	case iface.Address != "":
+		desc += ": " + iface.Address
+	}
+	return desc
+}
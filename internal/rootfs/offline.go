@@ -0,0 +1,43 @@
+package rootfs
+
+import (
+	"path/filepath"
+)
+
+// OfflineMissing returns what an offline build with opts needs but does
+// not have, one line each; nil when it can start. bootstrap reports
+// whether the build bootstraps rather than restoring a snapshot, which
+// leaves out the minirootfs.
+func OfflineMissing(opts Options, bootstrap bool) []string {
+	r := &Rootfs{arch: hostArch(), cacheDir: opts.CacheDir, alpineBranch: opts.AlpineBranch}
+	if opts.Lock != nil {
+		r.alpineBranch = opts.Lock.Branch
+	}
+	var missing []string
+	if opts.CacheDir == "" {
+		missing = append(missing, "the download cache (do not use -no-cache)")
+	} else if bootstrap {
+		switch {
+		case opts.Lock != nil:
+			if _, ok := r.cachedMinirootfs(opts.Lock.Minirootfs, opts.Lock.MinirootfsSHA256); !ok {
+				missing = append(missing, "minirootfs: "+filepath.Join(r.minirootfsCacheDir(), opts.Lock.Minirootfs)+" (locked)")
+			}
+		default:
+			if _, ok := r.cachedMinirootfs(r.latestCachedMinirootfs(), ""); !ok {
+				missing = append(missing, "minirootfs: a verified tarball of "+r.branchDir()+" in "+r.minirootfsCacheDir())
+			}
+		}
+	}
+	if opts.LocalMirror != "" {
+		for _, repo := range []string{"main", "community"} {
+			index := filepath.Join(opts.LocalMirror, r.branchDir(), repo, r.arch, "APKINDEX.tar.gz")
+			if !isFile(index) {
+				missing = append(missing, "local mirror: "+index)
+			}
+		}
+	}
+	for _, repo := range opts.Repositories {
+		missing = append(missing, "distro.repositories: "+repo.URL+" cannot be reached offline")
+	}
+	return missing
+}
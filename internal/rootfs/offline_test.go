@@ -0,0 +1,145 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/lockfile"
+)
+
+func TestOfflineMissing(t *testing.T) {
+	const tarball = "alpine-minirootfs-3.20.3-" + "x86_64" + ".tar.gz"
+	// cache returns a download cache, with a minirootfs whose recorded
+	// checksum is right when verified is set.
+	cache := func(t *testing.T, minirootfs, verified bool) (string, string) {
+		dir := t.TempDir()
+		r := &Rootfs{cacheDir: dir, arch: hostArch()}
+		p := filepath.Join(r.minirootfsCacheDir(), strings.Replace(tarball, "x86_64", hostArch(), 1))
+		if !minirootfs {
+			return dir, ""
+		}
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte("minirootfs"), 0644)
+		sum, _ := fsutil.SHA256File(p)
+		recorded := sum
+		if !verified {
+			recorded = "0000"
+		}
+		os.WriteFile(p+".sha256", []byte(recorded+"\n"), 0644)
+		return dir, sum
+	}
+	mirror := func(t *testing.T, repos ...string) string {
+		dir := t.TempDir()
+		for _, repo := range repos {
+			p := filepath.Join(dir, "v3.20", repo, hostArch(), "APKINDEX.tar.gz")
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, nil, 0644)
+		}
+		return dir
+	}
+
+	for name, tc := range map[string]struct {
+		opts      func(t *testing.T) Options
+		bootstrap bool
+		want      []string // what the missing lines say, in order
+	}{
+		"cached minirootfs": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20"}
+			},
+			bootstrap: true,
+		},
+		"no minirootfs": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, false, false)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20"}
+			},
+			bootstrap: true,
+			want:      []string{"minirootfs: a verified tarball of v3.20"},
+		},
+		"unverified minirootfs": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, false)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20"}
+			},
+			bootstrap: true,
+			want:      []string{"minirootfs: a verified tarball"},
+		},
+		"other branch": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				return Options{CacheDir: dir, AlpineBranch: "v3.21"}
+			},
+			bootstrap: true,
+			want:      []string{"minirootfs: a verified tarball of v3.21"},
+		},
+		"snapshot restored": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, false, false)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20"}
+			},
+		},
+		"locked tarball": {
+			opts: func(t *testing.T) Options {
+				dir, sum := cache(t, true, true)
+				name := strings.Replace(tarball, "x86_64", hostArch(), 1)
+				return Options{CacheDir: dir, Lock: &lockfile.File{Branch: "v3.20", Minirootfs: name, MinirootfsSHA256: sum}}
+			},
+			bootstrap: true,
+		},
+		"locked tarball changed": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				name := strings.Replace(tarball, "x86_64", hostArch(), 1)
+				return Options{CacheDir: dir, Lock: &lockfile.File{Branch: "v3.20", Minirootfs: name, MinirootfsSHA256: "1111"}}
+			},
+			bootstrap: true,
+			want:      []string{"minirootfs: "},
+		},
+		"local mirror": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20", LocalMirror: mirror(t, "main", "community")}
+			},
+			bootstrap: true,
+		},
+		"local mirror without community": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20", LocalMirror: mirror(t, "main")}
+			},
+			bootstrap: true,
+			want:      []string{"/v3.20/community/"},
+		},
+		"repositories": {
+			opts: func(t *testing.T) Options {
+				dir, _ := cache(t, true, true)
+				return Options{CacheDir: dir, AlpineBranch: "v3.20", Repositories: []config.Repository{{URL: "https://repo.example/alpine"}}}
+			},
+			bootstrap: true,
+			want:      []string{"distro.repositories: https://repo.example/alpine"},
+		},
+		"no cache": {
+			opts:      func(t *testing.T) Options { return Options{AlpineBranch: "v3.20"} },
+			bootstrap: true,
+			want:      []string{"the download cache"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := OfflineMissing(tc.opts(t), tc.bootstrap)
+			if len(got) != len(tc.want) {
+				t.Fatalf("missing = %q, want %q", got, tc.want)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("missing[%d] = %q, want it to say %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -15,9 +15,26 @@ import (
 // apkLineRegex parses lines like "( 3/28) Installing nginx (1.26.3-r0)"
 var apkLineRegex = regexp.MustCompile(`^\(\s*(\d+)/(\d+)\)\s+Installing\s+(\S+)\s+\(([^)]+)\)`)
 
-// apkWriter is a custom io.Writer that parses apk output and renders it styled.
+// apkScriptRegex parses script and trigger failures like
+// "ERROR: nginx-1.26.3-r0.post-install: script exited with error 1".
+var apkScriptRegex = regexp.MustCompile(`^ERROR: (\S+)-(\d\S*)\.(pre-install|post-install|pre-upgrade|post-upgrade|pre-deinstall|post-deinstall|trigger): (?:script )?(.+)$`)
+
+// scriptFailure is a package script or trigger that failed during apk add.
+type scriptFailure struct {
+	pkg, version, script, reason string
+}
+
+func (f scriptFailure) String() string {
+	return fmt.Sprintf("%s-%s %s: %s", f.pkg, f.version, f.script, f.reason)
+}
+
+// apkWriter is a custom io.Writer that parses apk output and renders it
+// styled. It receives both output streams and records which package
+// scripts failed and any other errors apk reported.
 type apkWriter struct {
-	buf bytes.Buffer
+	buf     bytes.Buffer
+	scripts []scriptFailure
+	errors  []string
 }
 
 func (w *apkWriter) Write(p []byte) (int, error) {
@@ -30,6 +47,7 @@ func (w *apkWriter) Write(p []byte) (int, error) {
 			w.buf.WriteString(line)
 			break
 		}
+		indented := strings.HasPrefix(line, " ")
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
@@ -43,14 +61,22 @@ func (w *apkWriter) Write(p []byte) (int, error) {
 			version := matches[4]
 			ui.PackageItem(idx, total, name, version)
 		}
-		// Skip non-install lines (triggers, OK messages, etc.)
+		if m := apkScriptRegex.FindStringSubmatch(line); m != nil {
+			w.scripts = append(w.scripts, scriptFailure{pkg: m[1], version: m[2], script: m[3], reason: m[4]})
+		} else if msg, ok := strings.CutPrefix(line, "ERROR: "); ok {
+			w.errors = append(w.errors, msg)
+		} else if indented && len(w.errors) > 0 {
+			// Details of the last error, e.g. "foo (no such package):"
+			w.errors[len(w.errors)-1] += "\n    " + line
+		}
+		// Skip other lines (triggers, OK messages, etc.)
 	}
 
 	return len(p), nil
 }
 
 // InstallPackages installs user-specified packages inside the chroot.
-// Uses apk for Alpine and dnf for Fedora.
+// Uses apk for Alpine, dnf for Fedora and apt-get for Debian.
 func (r *Rootfs) InstallPackages(pkgs []string) error {
 	if len(pkgs) == 0 {
 		ui.Detail("No additional packages to install")
@@ -72,7 +98,7 @@ func (r *Rootfs) InstallPackages(pkgs []string) error {
 			"-y",
 		}
 		args = append(args, pkgs...)
-		cmd := exec.Command("dnf", args...)
+		cmd := r.packageManager("dnf", args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
@@ -81,13 +107,65 @@ func (r *Rootfs) InstallPackages(pkgs []string) error {
 		return nil
 	}
 
-	args := append([]string{r.Path, "apk", "add", "--no-cache"}, pkgs...)
-	cmd := exec.Command("chroot", args...)
-	cmd.Stdout = &apkWriter{}
-	cmd.Stderr = nil
-	if err := cmd.Run(); err != nil {
+	if r.distro == "debian" {
+		return r.aptInstall(pkgs)
+	}
+
+	w := &apkWriter{}
+	cmd := r.packageManager("chroot", r.apkAdd(pkgs...)...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	return r.apkResult(pkgs, w, err)
+}
+
+// apkResult reports each failed package script. apk exits non-zero when
+// any script fails; the install still succeeds if every failure belongs to
+// a package listed in build.nonfatal_scripts and apk reported nothing else.
+func (r *Rootfs) apkResult(pkgs []string, w *apkWriter, err error) error {
+	var fatal []string
+	for _, f := range w.scripts {
+		if slices.Contains(r.nonfatalScripts, f.pkg) {
+			ui.Warn("Ignoring failed script " + f.String())
+			continue
+		}
+		fatal = append(fatal, f.String())
+	}
+	fatal = append(fatal, w.errors...)
+	if err == nil {
+		return nil
+	}
+	if len(fatal) == 0 && len(w.scripts) > 0 {
+		return nil // only non-fatal script failures
+	}
+	if len(fatal) == 0 {
 		return fmt.Errorf("apk add %s: %w", strings.Join(pkgs, " "), err)
 	}
+	return fmt.Errorf("apk add %s: %w:\n  %s", strings.Join(pkgs, " "), err, strings.Join(fatal, "\n  "))
+}
 
+// aptInstall installs Debian packages with apt-get inside the chroot,
+// passing flags to apt-get install. The package lists are refreshed first
+// because debootstrap leaves them empty.
+func (r *Rootfs) aptInstall(pkgs []string, flags ...string) error {
+	env := []string{"DEBIAN_FRONTEND=noninteractive"}
+
+	update := r.packageManager("chroot", r.Path, "apt-get", "update", "-q")
+	update.Env = append(os.Environ(), env...)
+	update.Stderr = os.Stderr
+	if err := update.Run(); err != nil {
+		return fmt.Errorf("apt-get update: %w", err)
+	}
+
+	args := []string{r.Path, "apt-get", "install", "-y", "-q", "--no-install-recommends"}
+	args = append(args, flags...)
+	args = append(args, pkgs...)
+	cmd := r.packageManager("chroot", args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("apt-get install %s: %w", strings.Join(pkgs, " "), err)
+	}
 	return nil
 }
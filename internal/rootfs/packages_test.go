@@ -0,0 +1,58 @@
+package rootfs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestApkScriptRegex(t *testing.T) {
+	for line, want := range map[string]*scriptFailure{
+		"ERROR: nginx-1.26.3-r0.post-install: script exited with error 1": {"nginx", "1.26.3-r0", "post-install", "exited with error 1"},
+		"ERROR: busybox-1.36.1-r29.trigger: script exited with error 127": {"busybox", "1.36.1-r29", "trigger", "exited with error 127"},
+		"ERROR: py3-setuptools-70.3.0-r0.pre-upgrade: killed by signal 9": {"py3-setuptools", "70.3.0-r0", "pre-upgrade", "killed by signal 9"},
+		// Digits after a dash in the name are not taken for the version.
+		"ERROR: font-6x13-1.0-r0.post-deinstall: script exited with error 2": {"font-6x13", "1.0-r0", "post-deinstall", "exited with error 2"},
+		"ERROR: gtk+3.0-3.24.41-r0.post-upgrade: script exited with error 1": {"gtk+3.0", "3.24.41-r0", "post-upgrade", "exited with error 1"},
+		"ERROR: unable to select packages:":                                  nil,
+		"ERROR: nginx-1.26.3-r0: package mentioned in index not found":       nil,
+		"ERROR: nginx-1.26.3-r0.post-install":                                nil,
+		"(1/2) Installing nginx (1.26.3-r0)":                                 nil,
+	} {
+		m := apkScriptRegex.FindStringSubmatch(line)
+		if want == nil {
+			if m != nil {
+				t.Errorf("%q matched as %q", line, m[1:])
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%q did not match", line)
+			continue
+		}
+		if got := (scriptFailure{m[1], m[2], m[3], m[4]}); got != *want {
+			t.Errorf("%q = %+v, want %+v", line, got, *want)
+		}
+	}
+}
+
+func TestApkWriter(t *testing.T) {
+	var w apkWriter
+	// Output arrives in pieces that split lines.
+	for _, chunk := range []string{
+		"(1/2) Installing nginx (1.26.3-r0)\nExecuting nginx-1.26.3-r0.post-install\nERROR: nginx-1.26",
+		".3-r0.post-install: script exited with error 1\n",
+		"ERROR: unable to select packages:\n  nginx-extra (no such package):\n    required by: world[nginx-extra]\n",
+		"OK: 12 MiB in 30 packages\n",
+	} {
+		w.Write([]byte(chunk))
+	}
+
+	want := []scriptFailure{{"nginx", "1.26.3-r0", "post-install", "exited with error 1"}}
+	if !slices.Equal(w.scripts, want) {
+		t.Errorf("scripts = %+v, want %+v", w.scripts, want)
+	}
+	wantErrors := []string{"unable to select packages:\n    nginx-extra (no such package):\n    required by: world[nginx-extra]"}
+	if !slices.Equal(w.errors, wantErrors) {
+		t.Errorf("errors = %q, want %q", w.errors, wantErrors)
+	}
+}
@@ -0,0 +1,76 @@
+package rootfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/talfaza/distrorun/internal/audit"
+)
+
+// packageManagers recognize the distribution of an existing rootfs.
+var packageManagers = []struct {
+	path, distro string
+}{
+	{"sbin/apk", "alpine"},
+	{"usr/bin/dpkg", "debian"},
+	{"usr/bin/rpm", "fedora"},
+}
+
+// Open returns the root filesystem unpacked from an existing image into
+// workDir/rootfs, for 'distrorun patch'. The distribution is recognized by
+// its package manager. Nothing is mounted until packages are installed.
+func Open(ctx context.Context, workDir string) (*Rootfs, error) {
+	r := &Rootfs{
+		Path:    filepath.Join(workDir, "rootfs"),
+		WorkDir: workDir,
+		arch:    hostArch(),
+		ctx:     ctx,
+	}
+	for _, pm := range packageManagers {
+		if _, err := os.Lstat(filepath.Join(r.Path, pm.path)); err == nil {
+			r.distro = pm.distro
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no apk, dpkg or rpm found, cannot tell the distribution", r.Path)
+}
+
+// Distro returns the distribution of the rootfs: "alpine", "fedora" or
+// "debian".
+func (r *Rootfs) Distro() string {
+	return r.distro
+}
+
+// PatchPackages installs pkgs into an opened rootfs. The chroot mounts and
+// the host's resolv.conf are set up for the package manager, and the
+// image's own resolv.conf is put back afterwards. The caller unmounts.
+func (r *Rootfs) PatchPackages(pkgs []string) error {
+	if err := r.setupChrootMounts(); err != nil {
+		return err
+	}
+
+	resolv := filepath.Join(r.Path, "etc", "resolv.conf")
+	saved := resolv + ".distrorun"
+	_, err := os.Lstat(resolv)
+	hadResolv := err == nil
+	if hadResolv {
+		// Renamed rather than copied: it is often a symlink into /run.
+		if err := audit.Rename(resolv, saved); err != nil {
+			return fmt.Errorf("saving resolv.conf: %w", err)
+		}
+	}
+	installErr := r.copyResolv()
+	if installErr == nil {
+		installErr = r.InstallPackages(pkgs)
+	}
+
+	audit.Remove(resolv)
+	if hadResolv {
+		if err := audit.Rename(saved, resolv); err != nil && installErr == nil {
+			installErr = fmt.Errorf("restoring resolv.conf: %w", err)
+		}
+	}
+	return installErr
+}
@@ -0,0 +1,80 @@
+package rootfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	for name, tc := range map[string]struct {
+		files []string
+		want  string
+	}{
+		"alpine":  {files: []string{"sbin/apk"}, want: "alpine"},
+		"debian":  {files: []string{"usr/bin/dpkg"}, want: "debian"},
+		"fedora":  {files: []string{"usr/bin/rpm"}, want: "fedora"},
+		"unknown": {files: []string{"usr/bin/pacman"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			workDir := t.TempDir()
+			for _, f := range tc.files {
+				p := filepath.Join(workDir, "rootfs", f)
+				os.MkdirAll(filepath.Dir(p), 0755)
+				os.WriteFile(p, nil, 0755)
+			}
+			r, err := Open(context.Background(), workDir)
+			if tc.want == "" {
+				if err == nil || !strings.Contains(err.Error(), "cannot tell the distribution") {
+					t.Errorf("Open = %v, want an error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Distro() != tc.want || r.Path != filepath.Join(workDir, "rootfs") {
+				t.Errorf("Open = %s at %s, want %s", r.Distro(), r.Path, tc.want)
+			}
+		})
+	}
+}
+
+func TestPatchPackagesRestoresResolv(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	if _, err := os.Stat("/etc/resolv.conf"); err != nil {
+		t.Skip("the host has no resolv.conf")
+	}
+	workDir := t.TempDir()
+	apk := filepath.Join(workDir, "rootfs", "sbin", "apk")
+	os.MkdirAll(filepath.Dir(apk), 0755)
+	os.WriteFile(apk, nil, 0755)
+	os.MkdirAll(filepath.Join(workDir, "rootfs", "etc"), 0755)
+	resolv := filepath.Join(workDir, "rootfs", "etc", "resolv.conf")
+	os.Symlink("../run/resolv.conf", resolv)
+
+	r, err := Open(context.Background(), workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Unmount)
+	// There is no apk to run in the chroot, so the installation fails,
+	// after the mounts are set up and resolv.conf replaced.
+	err = r.PatchPackages([]string{"vim"})
+	if err != nil && strings.Contains(err.Error(), "mounting") {
+		t.Skipf("cannot mount here: %v", err)
+	}
+	if err == nil {
+		t.Fatal("PatchPackages succeeded without apk")
+	}
+	if target, err := os.Readlink(resolv); err != nil || target != "../run/resolv.conf" {
+		t.Errorf("resolv.conf -> %q, %v; want the image's symlink back", target, err)
+	}
+	if _, err := os.Lstat(resolv + ".distrorun"); !os.IsNotExist(err) {
+		t.Errorf("the saved resolv.conf was left behind: %v", err)
+	}
+}
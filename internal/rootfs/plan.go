@@ -0,0 +1,115 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/apkindex"
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/netcap"
+)
+
+// PlannedPackages returns the packages a build with opts asks the package
+// manager for: the base system of the distro, then packages. The features
+// of the config (network, VPN, management and so on) add a few more while
+// they are set up.
+func PlannedPackages(distro string, opts Options, packages []string) []string {
+	if distro != "alpine" {
+		return slices.Clone(packages)
+	}
+	return slices.Concat(alpinePackages(opts), packages)
+}
+
+// apkInstalling matches the lines "apk add --simulate" prints for every
+// package it would install, e.g. "(3/18) Installing musl (1.2.5-r0)".
+var apkInstalling = regexp.MustCompile(`^\(\d+/\d+\) Installing (\S+) \((\S+)\)`)
+
+// ResolvePackages resolves packages against the Alpine repositories of
+// opts with the host's apk in simulation mode, and returns every package
+// the build would install as "name version", in install order. Versions
+// pinned by opts.Lock are asked for. apk works in an empty temporary root
+// that is removed again; nothing of the host or the cache is touched.
+func ResolvePackages(opts Options, packages []string) ([]string, error) {
+	apk, err := exec.LookPath("apk")
+	if err != nil {
+		if apk, err = exec.LookPath("apk.static"); err != nil {
+			return nil, errors.New("apk is not installed on the host (install apk-tools to resolve versions)")
+		}
+	}
+	root, err := audit.MkdirTemp("", "distrorun-plan-")
+	if err != nil {
+		return nil, err
+	}
+	defer audit.RemoveAll(root)
+
+	r := &Rootfs{ctx: opts.Context, alpineBranch: opts.AlpineBranch, mirror: opts.Mirror, lock: opts.Lock}
+	args := []string{"add", "--simulate", "--root", root, "--initdb", "--no-cache", "--allow-untrusted",
+		"--arch", hostArch(),
+		"--repository", r.alpineBranchURL() + "/main",
+		"--repository", r.alpineBranchURL() + "/community"}
+	for _, repo := range opts.Repositories {
+		args = append(args, "--repository", repo.URL)
+	}
+	for _, p := range packages {
+		if v, ok := r.lockedVersion(p); ok {
+			p += "=" + v
+		}
+		args = append(args, p)
+	}
+	cmd := exec.CommandContext(r.context(), apk, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("apk add --simulate: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("apk add --simulate: %w", err)
+	}
+
+	var resolved []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := apkInstalling.FindStringSubmatch(line); m != nil {
+			resolved = append(resolved, m[1]+" "+m[2])
+		}
+	}
+	return resolved, nil
+}
+
+// FetchIndex downloads the indexes of the Alpine repositories of opts, main
+// and community and then the extra ones, for the host's architecture. The
+// signatures are not checked: the index only informs, nothing is installed
+// from it.
+func FetchIndex(opts Options) (*apkindex.Index, error) {
+	r := &Rootfs{ctx: opts.Context, alpineBranch: opts.AlpineBranch, mirror: opts.Mirror}
+	repos := []string{r.alpineBranchURL() + "/main", r.alpineBranchURL() + "/community"}
+	for _, repo := range opts.Repositories {
+		repos = append(repos, strings.TrimSuffix(repo.URL, "/"))
+	}
+	ix := apkindex.New()
+	for _, repo := range repos {
+		url := repo + "/" + hostArch() + "/APKINDEX.tar.gz"
+		req, err := http.NewRequestWithContext(r.context(), http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := netcap.Client().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", url, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: HTTP %d", url, resp.StatusCode)
+		}
+		err = ix.Read(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+	}
+	return ix, nil
+}
@@ -0,0 +1,132 @@
+package rootfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/lockfile"
+	"github.com/talfaza/distrorun/internal/templates"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// sourceDateEpoch returns SOURCE_DATE_EPOCH, which a reproducible build
+// sets for itself and every tool it runs.
+func sourceDateEpoch() (int64, bool) {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	return epoch, err == nil && epoch > 0
+}
+
+// lockedVersion returns the locked version of an apk package.
+func (r *Rootfs) lockedVersion(pkg string) (string, bool) {
+	if r.lock == nil {
+		return "", false
+	}
+	v, ok := r.lock.Packages[pkg]
+	return v, ok
+}
+
+// InstalledPackages returns the name → version map of the apk packages
+// installed in the rootfs, read from the apk database.
+func (r *Rootfs) InstalledPackages() (map[string]string, error) {
+	f, err := os.Open(filepath.Join(r.Path, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return nil, fmt.Errorf("reading apk database: %w", err)
+	}
+	defer f.Close()
+
+	pkgs := make(map[string]string)
+	var name string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "P:"):
+			name = line[2:]
+		case strings.HasPrefix(line, "V:") && name != "":
+			pkgs[name] = line[2:]
+		case line == "":
+			name = ""
+		}
+	}
+	return pkgs, sc.Err()
+}
+
+// Templates returns the rootfs templates in use, built-in or overridden,
+// by name, for lock files to record the checksums of.
+func Templates() map[string]string {
+	return map[string]string{
+		templates.Init:         templates.Text(templates.Init, customInit),
+		templates.MkinitfsLive: templates.Text(templates.MkinitfsLive, mkinitfsLiveTemplate),
+		templates.MkinitfsDisk: templates.Text(templates.MkinitfsDisk, mkinitfsDiskTemplate),
+		templates.Repositories: templates.Text(templates.Repositories, repositoriesTemplate),
+	}
+}
+
+// LockFile returns the lock file pinning this rootfs: its minirootfs, its
+// release branch and every installed package, stamped with epoch.
+func (r *Rootfs) LockFile(epoch int64) (*lockfile.File, error) {
+	branch := r.alpineBranch
+	if branch == "" {
+		var err error
+		if branch, err = r.releaseBranch(); err != nil {
+			return nil, err
+		}
+		if branch == "" {
+			branch = "edge"
+		}
+	}
+	pkgs, err := r.InstalledPackages()
+	if err != nil {
+		return nil, err
+	}
+	return &lockfile.File{
+		Branch:           branch,
+		Minirootfs:       r.minirootfs,
+		MinirootfsSHA256: r.minirootfsSum,
+		SourceDateEpoch:  epoch,
+		Packages:         pkgs,
+	}, nil
+}
+
+// VerifyLock fails if the installed packages differ from the lock file,
+// e.g. because a dependency resolved to a newer version on the mirror.
+func (r *Rootfs) VerifyLock() error {
+	if r.lock == nil {
+		return nil
+	}
+	ui.SubStep("Verifying packages against the lock file...")
+	pkgs, err := r.InstalledPackages()
+	if err != nil {
+		return err
+	}
+	if diffs := r.lock.Diff(pkgs); len(diffs) > 0 {
+		return fmt.Errorf("installed packages differ from the lock file (regenerate it with 'distrorun lock'):\n  %s", strings.Join(diffs, "\n  "))
+	}
+	ui.Detail(fmt.Sprintf("%d packages match", len(pkgs)))
+	return nil
+}
+
+// normalizeShadow sets the last password change of every account to the
+// day of epoch; chpasswd records the day the image was built.
+func (r *Rootfs) normalizeShadow(epoch int64) {
+	path := filepath.Join(r.Path, "etc", "shadow")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	day := strconv.FormatInt(epoch/86400, 10)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[2] != "" {
+			fields[2] = day
+			lines[i] = strings.Join(fields, ":")
+		}
+	}
+	audit.WriteFile(path, []byte(strings.Join(lines, "\n")), 0640)
+}
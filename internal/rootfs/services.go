@@ -2,31 +2,92 @@ package rootfs
 
 import (
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
 // EnableServices activates services to start at boot.
-// Uses rc-update for Alpine (OpenRC) and systemctl for Fedora (systemd).
+// Uses rc-update for Alpine (OpenRC) and systemctl for Fedora and Debian (systemd).
 func (r *Rootfs) EnableServices(services []string) error {
-	if len(services) == 0 {
+	return r.ConfigureServices(config.Services{Enable: services})
+}
+
+// ConfigureServices enables the services of s, in their runlevels on
+// OpenRC, and disables those it lists to disable. Every service must be
+// installed; all are checked before any is changed.
+func (r *Rootfs) ConfigureServices(s config.Services) error {
+	if len(s.Enable) == 0 && len(s.Disable) == 0 {
 		ui.Detail("No services to enable")
 		return nil
 	}
 
-	for _, svc := range services {
+	for _, svc := range slices.Concat(s.Enable, s.Disable) {
+		if !r.serviceInstalled(svc) {
+			if r.systemd() {
+				return fmt.Errorf("service %s is not installed: no %s unit in the rootfs (add the package that provides it)", svc, svc)
+			}
+			return fmt.Errorf("service %s is not installed: no /etc/init.d/%s in the rootfs (add the package that provides it)", svc, svc)
+		}
+	}
+
+	for _, svc := range s.Enable {
 		ui.ServiceItem(svc)
-		var cmd *exec.Cmd
-		if r.distro == "fedora" {
-			cmd = exec.Command("chroot", r.Path, "systemctl", "enable", svc)
+		var cmd *audit.Cmd
+		if r.systemd() {
+			cmd = r.chroot("systemctl", "enable", svc)
 		} else {
-			cmd = exec.Command("chroot", r.Path, "rc-update", "add", svc, "default")
+			cmd = r.chroot("rc-update", "add", svc, s.Runlevel(svc))
 		}
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("enabling service %s: %w", svc, err)
 		}
 	}
 
+	for _, svc := range s.Disable {
+		ui.Detail("Disabling " + svc)
+		var cmd *audit.Cmd
+		if r.systemd() {
+			cmd = r.chroot("systemctl", "disable", svc)
+		} else {
+			// --all removes it from every runlevel it was added to.
+			cmd = r.chroot("rc-update", "--all", "del", svc)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("disabling service %s: %w: %s", svc, err, out)
+		}
+	}
+
 	return nil
 }
+
+// serviceInstalled reports whether the rootfs has an OpenRC init script or
+// a systemd unit for svc.
+func (r *Rootfs) serviceInstalled(svc string) bool {
+	paths := []string{filepath.Join("etc", "init.d", svc)}
+	if r.systemd() {
+		unit := svc
+		if filepath.Ext(unit) == "" {
+			unit += ".service"
+		}
+		// An instance such as getty@tty2 comes from the getty@ template.
+		if prefix, instance, ok := strings.Cut(unit, "@"); ok {
+			unit = prefix + "@" + filepath.Ext(instance)
+		}
+		paths = nil
+		for _, dir := range []string{"etc/systemd/system", "usr/lib/systemd/system", "lib/systemd/system"} {
+			paths = append(paths, filepath.Join(dir, unit))
+		}
+	}
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(r.Path, p)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/netcap"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// DefaultAlpineKeyring is the OpenPGP keyring checked for the Alpine
+// release signing keys. Create it from the key published on
+// https://alpinelinux.org/downloads/ with:
+//
+//	gpg --no-default-keyring --keyring ./alpine.gpg --import ncopa.asc
+//	install -D -m 644 alpine.gpg /etc/distrorun/alpine-keyring.gpg
+const DefaultAlpineKeyring = "/etc/distrorun/alpine-keyring.gpg"
+
+// keyringFor returns the keyring minirootfs signatures are checked with.
+// The keyring must exist, the default one included: a build without it
+// fails rather than trusting an unsigned download. Only an empty path
+// disables the check, which is recorded as a degradation.
+func keyringFor(path string) (string, error) {
+	if path == "" {
+		ui.Degrade("minirootfs signature check", "disabled with -alpine-keyring=")
+		return "", nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if path == DefaultAlpineKeyring && errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("alpine keyring: %s does not exist: create it (see distrorun(1)), or pass -alpine-keyring= to skip the minirootfs signature check", path)
+		}
+		return "", fmt.Errorf("alpine keyring: %w", err)
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return "", fmt.Errorf("gpgv not found: it verifies the minirootfs signature (install gnupg or gpgv, or pass -alpine-keyring= to skip the check)")
+	}
+	return filepath.Abs(path)
+}
+
+// verifySignature checks the detached signature published next to a
+// downloaded minirootfs, url + ".asc", against r.keyring.
+func (r *Rootfs) verifySignature(tarball, url string) error {
+	if r.keyring == "" {
+		return nil
+	}
+	resp, err := netcap.Client().Get(url + ".asc")
+	if err != nil {
+		return fmt.Errorf("downloading minirootfs signature: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading minirootfs signature: HTTP %d", resp.StatusCode)
+	}
+	sig := tarball + ".asc"
+	f, err := audit.Create(sig)
+	if err != nil {
+		return fmt.Errorf("creating signature file: %w", err)
+	}
+	_, err = io.Copy(f, io.LimitReader(resp.Body, 64<<10))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing signature: %w", err)
+	}
+	defer audit.Remove(sig)
+
+	out, err := r.confined(nil, "gpgv", "--keyring", r.keyring, sig, tarball).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("minirootfs signature does not verify against %s: %s", r.keyring, strings.TrimSpace(string(out)))
+	}
+	ui.Detail("Signature verified with " + r.keyring)
+	return nil
+}
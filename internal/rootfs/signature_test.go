@@ -0,0 +1,90 @@
+package rootfs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyringFor(t *testing.T) {
+	if got, err := keyringFor(""); got != "" || err != nil {
+		t.Errorf(`keyringFor("") = %q, %v; want the check disabled`, got, err)
+	}
+	if _, err := keyringFor(filepath.Join(t.TempDir(), "missing.gpg")); err == nil {
+		t.Error("keyringFor accepted a keyring that does not exist")
+	}
+	if _, err := os.Stat(DefaultAlpineKeyring); os.IsNotExist(err) {
+		// A missing default keyring fails too, rather than skipping the check.
+		if _, err := keyringFor(DefaultAlpineKeyring); err == nil || !strings.Contains(err.Error(), "-alpine-keyring=") {
+			t.Errorf("keyringFor(default) = %v, want an error naming -alpine-keyring=", err)
+		}
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv not found")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "alpine.gpg"), nil, 0644)
+	t.Chdir(dir)
+	if got, err := keyringFor("alpine.gpg"); err != nil || got != filepath.Join(dir, "alpine.gpg") {
+		t.Errorf("keyringFor = %q, %v; want the absolute path", got, err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	for _, tool := range []string{"gpg", "gpgv"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not found")
+		}
+	}
+	dir := t.TempDir()
+	gpg := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("gpg", append([]string{"--homedir", filepath.Join(dir, "gnupg"), "--batch", "--quiet", "--passphrase", ""}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("gpg %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "gnupg"), 0700)
+	t.Cleanup(func() { exec.Command("gpgconf", "--homedir", filepath.Join(dir, "gnupg"), "--kill", "all").Run() })
+	gpg("--quick-gen-key", "Test <test@example.com>", "ed25519", "sign", "never")
+	keyring := filepath.Join(dir, "alpine.gpg")
+	gpg("--output", keyring, "--export")
+
+	tarball := filepath.Join(dir, "minirootfs.tar.gz")
+	os.WriteFile(tarball, []byte("minirootfs"), 0644)
+	gpg("--output", filepath.Join(dir, "good.asc"), "--armor", "--detach-sign", tarball)
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, []byte("something else"), 0644)
+	gpg("--output", filepath.Join(dir, "bad.asc"), "--armor", "--detach-sign", other)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	for name, tc := range map[string]struct {
+		keyring, url string
+		wantErr      string
+	}{
+		"good":      {keyring: keyring, url: srv.URL + "/good"},
+		"bad":       {keyring: keyring, url: srv.URL + "/bad", wantErr: "does not verify"},
+		"unsigned":  {keyring: keyring, url: srv.URL + "/unsigned", wantErr: "HTTP 404"},
+		"unchecked": {url: srv.URL + "/unsigned"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := &Rootfs{keyring: tc.keyring}
+			err := r.verifySignature(tarball, tc.url)
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("verifySignature = %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("verifySignature = %v, want an error saying %q", err, tc.wantErr)
+			}
+			if _, err := os.Stat(tarball + ".asc"); !os.IsNotExist(err) {
+				t.Errorf("the signature was left next to the tarball: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/templates"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// snapshotFormat is part of every snapshot key. Bump it whenever
+// bootstrapping or package installation changes what they leave in the
+// rootfs, so snapshots taken by older builds are not reused.
+const snapshotFormat = 2
+
+// SnapshotKeys identify the rootfs states a build can reuse from the
+// snapshot cache, by hashes of the config sections that produce them.
+type SnapshotKeys struct {
+	Base     string // after bootstrapping: name, distro, release, mirrors, output mode, target, referenced files
+	Packages string // after package installation: Base plus the package set
+
+	// inputs maps every hashed input to its JSON encoding, for Changed to
+	// tell which one invalidated a snapshot.
+	inputs map[string]string
+}
+
+// movingBranch reports whether the Alpine branch of opts is updated in
+// place: edge, and latest-stable, which also moves on to the next release.
+// Snapshots of such builds are keyed by the day they were taken, so stale
+// package sets are restored for a day at most. Pinned releases keep their
+// snapshots.
+func movingBranch(opts Options) bool {
+	return opts.AlpineBranch == "" || opts.AlpineBranch == "edge"
+}
+
+// SnapshotKeysFor returns the snapshot keys of a build of cfg with opts.
+func SnapshotKeysFor(cfg *config.Config, opts Options) (SnapshotKeys, error) {
+	// The keys of extra repositories are installed during bootstrap, so
+	// their contents count, not their paths.
+	var repoKeys []string
+	for _, repo := range opts.Repositories {
+		sum := ""
+		if repo.Key != "" {
+			var err error
+			if sum, err = fsutil.SHA256File(repo.Key); err != nil {
+				return SnapshotKeys{}, fmt.Errorf("hashing repository key: %w", err)
+			}
+		}
+		repoKeys = append(repoKeys, repo.URL+" "+sum)
+	}
+	// Only overridden templates are hashed, so that keys of builds with
+	// the built-ins stay valid.
+	tmpls := map[string]string{}
+	for _, name := range templates.Overridden() {
+		sum := sha256.Sum256([]byte(templates.Text(name, "")))
+		tmpls[name] = hex.EncodeToString(sum[:])
+	}
+	// Editing a file the config refers to invalidates the snapshots like
+	// editing the config, even where it is applied after them.
+	sources := map[string]string{}
+	for _, ref := range referencedFiles(cfg) {
+		sum, err := hashSource(ref.path)
+		if err != nil {
+			return SnapshotKeys{}, fmt.Errorf("hashing %s: %w", ref.path, err)
+		}
+		sources[ref.kind+" "+ref.path] = sum
+	}
+	base := struct {
+		Format       int
+		Arch         string
+		Name         string
+		Distro       string
+		Type         string
+		Branch       string
+		Mirror       string
+		Repositories []string
+		Disk         bool
+		Container    bool
+		VM           bool
+		Kernel       string `json:",omitempty"`
+		Cmdline      string
+		Day          string            `json:",omitempty"`
+		Templates    map[string]string `json:",omitempty"`
+		Sources      map[string]string `json:",omitempty"`
+	}{
+		Format:       snapshotFormat,
+		Arch:         hostArch(),
+		Name:         cfg.Name,
+		Distro:       cfg.Distro.Base,
+		Type:         cfg.Distro.Type,
+		Branch:       opts.AlpineBranch,
+		Mirror:       opts.Mirror,
+		Repositories: repoKeys,
+		Disk:         opts.Disk,
+		Container:    opts.Container,
+		VM:           opts.VM,
+		Kernel:       opts.Kernel,
+		Templates:    tmpls,
+		Sources:      sources,
+	}
+	if cfg.Distro.Base == "alpine" && movingBranch(opts) {
+		base.Day = time.Now().UTC().Format(time.DateOnly)
+	}
+	if opts.Disk {
+		// Only disk bootstraps write the command line (/etc/default/grub).
+		base.Cmdline = opts.Cmdline
+	}
+	baseKey, err := hashJSON(base)
+	if err != nil {
+		return SnapshotKeys{}, err
+	}
+	pkgs := struct {
+		Base            string
+		Packages        []string
+		NonfatalScripts []string
+	}{baseKey, cfg.Packages, opts.NonfatalScripts}
+	pkgKey, err := hashJSON(pkgs)
+	if err != nil {
+		return SnapshotKeys{}, err
+	}
+
+	inputs := map[string]string{}
+	if err := flattenJSON(inputs, base); err != nil {
+		return SnapshotKeys{}, err
+	}
+	if err := flattenJSON(inputs, pkgs); err != nil {
+		return SnapshotKeys{}, err
+	}
+	delete(inputs, "Base")
+	delete(inputs, "Templates")
+	delete(inputs, "Sources")
+	for name, sum := range tmpls {
+		inputs["template "+name] = sum
+	}
+	maps.Copy(inputs, sources)
+	return SnapshotKeys{Base: baseKey, Packages: pkgKey, inputs: inputs}, nil
+}
+
+// reference is a host file or directory a config refers to, of kind
+// "file" (a files source) or "script" (a hook or first-boot script).
+type reference struct {
+	kind, path string
+}
+
+// referencedFiles returns the host files and directories cfg refers to
+// that end up in the image or change it.
+func referencedFiles(cfg *config.Config) []reference {
+	var refs []reference
+	for _, f := range cfg.Files {
+		if f.Source != "" {
+			refs = append(refs, reference{"file", f.Source})
+		}
+	}
+	if cfg.Hooks != nil {
+		for _, stage := range [][]config.Hook{cfg.Hooks.PostPackages, cfg.Hooks.PreISO, cfg.Hooks.PostBuild} {
+			for _, h := range stage {
+				if h.Script != "" {
+					refs = append(refs, reference{"script", h.Script})
+				}
+			}
+		}
+	}
+	if cfg.Provision != nil {
+		for _, ps := range cfg.Provision.FirstBoot {
+			if ps.Script != "" {
+				refs = append(refs, reference{"script", ps.Script})
+			}
+		}
+	}
+	return refs
+}
+
+// hashSource returns the hex SHA-256 of the file at path, or for a
+// directory of the names, modes, link targets and contents of everything
+// below it.
+func hashSource(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fsutil.SHA256File(path)
+	}
+	h := sha256.New()
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(path, p)
+		fmt.Fprintf(h, "%s %v\n", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s\n", target)
+		case info.Mode().IsRegular():
+			sum, err := fsutil.SHA256File(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\n", sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// flattenJSON adds the fields of the JSON encoding of struct v to inputs.
+func flattenJSON(inputs map[string]string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for k, raw := range fields {
+		inputs[k] = string(raw)
+	}
+	return nil
+}
+
+// Changed returns the inputs that differ from those of the last snapshot
+// saved for the same image name in cacheDir, sorted; nil when there is no
+// such snapshot.
+func (k SnapshotKeys) Changed(cacheDir string) []string {
+	files, _ := filepath.Glob(filepath.Join(cacheDir, "rootfs", hostArch(), "*.json"))
+	var last map[string]string
+	var lastTime time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().After(lastTime) {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var inputs map[string]string
+		if json.Unmarshal(data, &inputs) != nil || inputs["Name"] != k.inputs["Name"] {
+			continue
+		}
+		last, lastTime = inputs, info.ModTime()
+	}
+	if last == nil {
+		return nil
+	}
+	var changed []string
+	for name, v := range k.inputs {
+		if last[name] != v {
+			changed = append(changed, name)
+		}
+	}
+	for name := range last {
+		if _, ok := k.inputs[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// SaveInputs records the inputs of the snapshot saved under key next to
+// it, for Changed. Like SaveSnapshot, it only warns on failure.
+func (k SnapshotKeys) SaveInputs(cacheDir, key string) {
+	data, err := json.MarshalIndent(k.inputs, "", "  ")
+	if err == nil {
+		err = audit.WriteFile(inputsPath(cacheDir, key), append(data, '\n'), 0600)
+	}
+	if err != nil {
+		ui.Warn("Cannot save snapshot inputs: " + err.Error())
+	}
+}
+
+// hashJSON returns the hex SHA-256 of the JSON encoding of v.
+func hashJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// isFile reports whether p is an existing regular file.
+func isFile(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// snapshotPath returns the snapshot tarball for key in the cache.
+func snapshotPath(cacheDir, key string) string {
+	return filepath.Join(cacheDir, "rootfs", hostArch(), key+".tar")
+}
+
+// inputsPath returns the inputs of the snapshot for key in the cache. It
+// shares the tarball's base name, so 'distrorun prune -cache' keeps or
+// removes both together.
+func inputsPath(cacheDir, key string) string {
+	return strings.TrimSuffix(snapshotPath(cacheDir, key), ".tar") + ".json"
+}
+
+// SaveSnapshot stores the rootfs in the cache cacheDir under key. What is mounted
+// below the rootfs (proc, dev, sys, the apk cache) is left out; Restore
+// mounts it again. Extended attributes such as file capabilities are
+// kept. The rootfs holds host keys and password hashes, so only root may
+// read its snapshots. A failure only costs the next build its reuse, so it
+// is reported as a warning.
+func (r *Rootfs) SaveSnapshot(cacheDir, key string) {
+	dst := snapshotPath(cacheDir, key)
+	dir := filepath.Dir(dst)
+	if err := audit.MkdirAll(dir, 0700); err != nil {
+		ui.Warn("Cannot create snapshot directory: " + err.Error())
+		return
+	}
+	// Older builds created the directory readable by everyone.
+	if err := audit.Chmod(dir, 0700); err != nil {
+		ui.Warn("Cannot create snapshot directory: " + err.Error())
+		return
+	}
+	ui.SubStep("Saving rootfs snapshot...")
+	// tar keeps the mode of an existing archive, so it never exists
+	// readable by others, even for a moment.
+	if isFile(dst + ".tmp") {
+		audit.Remove(dst + ".tmp")
+	}
+	f, err := audit.OpenFile(dst+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		ui.Warn("Cannot save rootfs snapshot: " + err.Error())
+		return
+	}
+	f.Close()
+	args := []string{"-cf", dst + ".tmp", "-C", r.Path, "--numeric-owner", "--xattrs", "--xattrs-include=*", "--anchored"}
+	for _, mp := range mountsUnder(r.Path) {
+		rel, _ := filepath.Rel(r.Path, mp)
+		args = append(args, "--exclude=./"+rel+"/*")
+	}
+	cmd := r.command("tar", append(args, ".")...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		audit.Remove(dst + ".tmp")
+		ui.Warn("Cannot save rootfs snapshot: " + err.Error())
+		return
+	}
+	if err := audit.Rename(dst+".tmp", dst); err != nil {
+		ui.Warn("Cannot save rootfs snapshot: " + err.Error())
+		return
+	}
+	ui.Detail(dst)
+}
+
+// FindSnapshot returns the first of keys with a snapshot in cacheDir, or
+// "" if there is none.
+func FindSnapshot(cacheDir string, keys ...string) string {
+	for _, k := range keys {
+		if isFile(snapshotPath(cacheDir, k)) {
+			return k
+		}
+	}
+	return ""
+}
+
+// RestoreSnapshot creates the rootfs for a build of name from the snapshot
+// stored in cacheDir under key, and prepares it the way Bootstrap leaves a
+// rootfs: chroot mounts, apk cache and resolv.conf in place.
+func RestoreSnapshot(name, distro, cacheDir, key string, opts Options) (*Rootfs, error) {
+	snapshot := snapshotPath(cacheDir, key)
+	workDir, rootfsPath, err := newWorkDir(opts.WorkDir, name, opts.ConfigHash)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rootfs{
+		Path:     rootfsPath,
+		WorkDir:  workDir,
+		arch:     hostArch(),
+		distro:   distro,
+		cacheDir: opts.CacheDir,
+		ctx:      opts.Context,
+
+		alpineBranch: opts.AlpineBranch,
+		mirror:       opts.Mirror,
+		repositories: opts.Repositories,
+		localMirror:  opts.LocalMirror,
+		offline:      opts.Offline,
+
+		nonfatalScripts: opts.NonfatalScripts,
+	}
+	if distro == "alpine" {
+		r.kernelFlavor = opts.KernelFlavor()
+	} else {
+		r.arch = "x86_64"
+	}
+
+	ui.SubStep("Restoring rootfs snapshot...")
+	ui.Detail(snapshot)
+	if err := r.extractSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	// Touched so that 'distrorun prune -cache -keep-last N' keeps the
+	// snapshots in use.
+	now := time.Now()
+	audit.Chtimes(snapshot, now, now)
+	audit.Chtimes(inputsPath(cacheDir, key), now, now)
+
+	if err := r.setupChrootMounts(); err != nil {
+		return nil, err
+	}
+	if distro == "alpine" {
+		if err := r.mountApkCache(); err != nil {
+			return nil, err
+		}
+		if err := r.mountLocalMirror(); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.copyResolv(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// extractSnapshot unpacks the snapshot tarball into the rootfs, with the
+// owners, modes and extended attributes SaveSnapshot stored.
+func (r *Rootfs) extractSnapshot(snapshot string) error {
+	cmd := r.command("tar", "-xpf", snapshot, "-C", r.Path, "--numeric-owner", "--xattrs", "--xattrs-include=*")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("extracting snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package rootfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+func TestSnapshot(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not found")
+	}
+	src := &Rootfs{Path: t.TempDir()}
+	ping := filepath.Join(src.Path, "bin/ping")
+	os.MkdirAll(filepath.Dir(ping), 0755)
+	if err := os.WriteFile(ping, []byte("ping"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(src.Path, "ssh_host_ed25519_key"), []byte("secret"), 0600)
+	xattrs := map[string][]byte{"user.distrorun": []byte("kept")}
+	if os.Geteuid() == 0 {
+		// cap_net_raw+ep, as Alpine's iputils gives ping.
+		caps := make([]byte, 20)
+		binary.LittleEndian.PutUint32(caps, 0x02000001)
+		binary.LittleEndian.PutUint32(caps[4:], 1<<13)
+		xattrs["security.capability"] = caps
+	}
+	for name, value := range xattrs {
+		if err := syscall.Setxattr(ping, name, value, 0); err != nil {
+			t.Skipf("cannot set %s: %v", name, err)
+		}
+	}
+
+	cacheDir := t.TempDir()
+	src.SaveSnapshot(cacheDir, "k")
+	snapshot := snapshotPath(cacheDir, "k")
+	if FindSnapshot(cacheDir, "other", "k") != "k" {
+		t.Fatal("the saved snapshot is not found")
+	}
+	// The rootfs holds host keys: only root may read the snapshot.
+	for path, want := range map[string]os.FileMode{snapshot: 0600, filepath.Dir(snapshot): 0700 | os.ModeDir} {
+		if info, err := os.Stat(path); err != nil || info.Mode() != want {
+			t.Errorf("%s: mode %v, %v; want %v", path, info.Mode(), err, want)
+		}
+	}
+
+	dst := &Rootfs{Path: t.TempDir()}
+	if err := dst.extractSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dst.Path, "bin/ping")
+	if data, err := os.ReadFile(restored); err != nil || string(data) != "ping" {
+		t.Fatalf("restored ping = %q, %v", data, err)
+	}
+	for name, want := range xattrs {
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(restored, name, buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Errorf("restored %s = %x, %v; want %x", name, buf[:max(n, 0)], err, want)
+		}
+	}
+}
+
+func TestSnapshotKeysMovingBranch(t *testing.T) {
+	cfg := &config.Config{Name: "demo", Distro: config.Distro{Base: "alpine"}}
+	for branch, moving := range map[string]bool{"": true, "edge": true, "v3.20": false} {
+		keys, err := SnapshotKeysFor(cfg, Options{AlpineBranch: branch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Snapshots of moving branches are only reused on the day they
+		// were taken.
+		if _, ok := keys.inputs["Day"]; ok != moving {
+			t.Errorf("branch %q: keyed by the day: %v, want %v", branch, ok, moving)
+		}
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	inputs := map[string]string{"Name": "old"}
+	v := struct {
+		Name     string
+		Packages []string
+		Kernel   string `json:",omitempty"`
+	}{"demo", []string{"curl"}, ""}
+	if err := flattenJSON(inputs, v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Name": `"demo"`, "Packages": `["curl"]`}
+	if !maps.Equal(inputs, want) {
+		t.Errorf("inputs = %q, want %q", inputs, want)
+	}
+	if err := flattenJSON(inputs, []string{"not", "a", "struct"}); err == nil {
+		t.Error("expected an error for a value that is not an object")
+	}
+}
+
+func TestSnapshotChanged(t *testing.T) {
+	cacheDir := t.TempDir()
+	if got := inputsPath(cacheDir, "k"); got != filepath.Join(cacheDir, "rootfs", hostArch(), "k.json") {
+		t.Errorf("inputsPath = %q", got)
+	}
+	os.MkdirAll(filepath.Join(cacheDir, "rootfs", hostArch()), 0700)
+
+	overlay := filepath.Join(t.TempDir(), "motd")
+	os.WriteFile(overlay, []byte("hello\n"), 0644)
+	cfg := &config.Config{
+		Name:     "demo",
+		Distro:   config.Distro{Base: "alpine"},
+		Packages: []string{"curl"},
+		Files:    []config.File{{Path: "/etc/motd", Source: overlay}},
+	}
+	opts := Options{AlpineBranch: "v3.20"}
+	keys := func() SnapshotKeys {
+		k, err := SnapshotKeysFor(cfg, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	first := keys()
+	if got := first.Changed(cacheDir); got != nil {
+		t.Errorf("Changed without snapshots = %q", got)
+	}
+	// Two snapshots of the image, the second one newer: builds compare
+	// with the last.
+	first.SaveInputs(cacheDir, first.Base)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(inputsPath(cacheDir, first.Base), old, old)
+	cfg.Packages = []string{"curl", "jq"}
+	second := keys()
+	second.SaveInputs(cacheDir, second.Packages)
+	if info, err := os.Stat(inputsPath(cacheDir, second.Packages)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("inputs file: %v, %v; want mode 0600", info, err)
+	}
+	// Another image's snapshot is never compared with.
+	other := *cfg
+	other.Name, other.Packages = "other", nil
+	k, _ := SnapshotKeysFor(&other, opts)
+	k.SaveInputs(cacheDir, k.Base)
+	os.Chtimes(inputsPath(cacheDir, k.Base), old, old)
+
+	if got := keys().Changed(cacheDir); len(got) != 0 {
+		t.Errorf("Changed for the last saved inputs = %q", got)
+	}
+	os.WriteFile(overlay, []byte("edited\n"), 0644)
+	cfg.Packages = []string{"curl"}
+	edited := keys()
+	if edited.Base == first.Base {
+		t.Error("editing a files source did not change the base key")
+	}
+	want := []string{"Packages", "file " + overlay}
+	if got := edited.Changed(cacheDir); !slices.Equal(got, want) {
+		t.Errorf("Snapshot invalidated by %q, want %q", got, want)
+	}
+}
+
+func TestHashSource(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "bin/setup.sh")
+	os.MkdirAll(filepath.Dir(script), 0755)
+	os.WriteFile(script, []byte("#!/bin/sh\n"), 0644)
+	hash := func() string {
+		sum, err := hashSource(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	seen := map[string]string{}
+	for _, change := range []struct {
+		name string
+		do   func()
+	}{
+		{"initial", func() {}},
+		{"content", func() { os.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0644) }},
+		{"mode", func() { os.Chmod(script, 0755) }},
+		{"new file", func() { os.WriteFile(filepath.Join(dir, "motd"), nil, 0644) }},
+		{"symlink", func() { os.Symlink("motd", filepath.Join(dir, "issue")) }},
+	} {
+		change.do()
+		sum := hash()
+		if prev, ok := seen[sum]; ok {
+			t.Errorf("%s: same hash as %s", change.name, prev)
+		}
+		seen[sum] = change.name
+	}
+	if _, err := hashSource(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
@@ -0,0 +1,153 @@
+package rootfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Space is the disk space a build needs, in bytes: in the workdir for the
+// rootfs and its squashfs, and next to the output path for the image.
+type Space struct {
+	WorkDir int64
+	Output  int64
+}
+
+// baseRootfsSize is about what a freshly bootstrapped rootfs of each distro
+// takes, and packageSize what a configured package adds on average.
+var baseRootfsSize = map[string]int64{
+	"alpine": 250 << 20,
+	"debian": 700 << 20,
+	"fedora": 1200 << 20,
+}
+
+const (
+	containerRootfsSize = 20 << 20
+	packageSize         = 15 << 20
+)
+
+// EstimateSpace returns about the space a build of distro with opts and
+// the given number of configured packages needs, before anything is built.
+// Package sizes vary a lot; the estimate only catches filesystems that are
+// plainly too small, such as a tmpfs /tmp for a desktop image.
+func EstimateSpace(distro string, opts Options, packages int) Space {
+	size := baseRootfsSize[distro]
+	if opts.Container {
+		size = containerRootfsSize
+	}
+	return spaceFor(size+int64(packages)*packageSize, opts)
+}
+
+// RemainingSpace returns the space the rest of a build needs once the
+// rootfs is complete: its squashfs, and the image built from it.
+func (r *Rootfs) RemainingSpace(opts Options) (Space, error) {
+	size, err := treeSize(r.Path)
+	if err != nil {
+		return Space{}, err
+	}
+	need := spaceFor(size, opts)
+	need.WorkDir -= size
+	return need, nil
+}
+
+// spaceFor returns the space a build with a rootfs of size bytes needs.
+// Squashfs, ISOs and OCI layers are taken to compress to half the rootfs;
+// disk images hold it uncompressed.
+func spaceFor(size int64, opts Options) Space {
+	switch {
+	case opts.Container:
+		return Space{WorkDir: size, Output: size / 2}
+	case opts.Disk:
+		return Space{WorkDir: size, Output: size}
+	default:
+		return Space{WorkDir: size + size/2, Output: size / 2}
+	}
+}
+
+// CheckSpace fails if the filesystem of workParent (os.TempDir() when
+// empty), where workdirs are created, or that of outputDir has less free
+// space than need. A filesystem holding both must hold the sum.
+func CheckSpace(workParent, outputDir string, need Space) error {
+	if workParent == "" {
+		workParent = os.TempDir()
+	}
+	workDev, workFree, err := freeSpace(workParent)
+	if err != nil {
+		return err
+	}
+	outDev, outFree, err := freeSpace(outputDir)
+	if err != nil {
+		return err
+	}
+	if workDev == outDev {
+		need.WorkDir += need.Output
+		need.Output = 0
+	}
+	if need.WorkDir > workFree {
+		return fmt.Errorf("%s has %s free, the build needs about %s there: point -workdir or DISTRORUN_WORKDIR at a larger filesystem",
+			workParent, humanSize(workFree), humanSize(need.WorkDir))
+	}
+	if need.Output > outFree {
+		return fmt.Errorf("%s has %s free, the image needs about %s: write it to a larger filesystem with -o",
+			outputDir, humanSize(outFree), humanSize(need.Output))
+	}
+	return nil
+}
+
+// freeSpace returns the device of the filesystem holding dir and the bytes
+// free on it for unprivileged users.
+func freeSpace(dir string) (dev uint64, free int64, err error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, fmt.Errorf("checking free space of %s: %w", dir, err)
+	}
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &sfs); err != nil {
+		return 0, 0, fmt.Errorf("checking free space of %s: %w", dir, err)
+	}
+	return st.Dev, int64(sfs.Bavail) * sfs.Bsize, nil
+}
+
+// treeSize returns the bytes used by the files below root, counting hard
+// links once.
+func treeSize(root string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !d.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measuring rootfs: %w", err)
+	}
+	return size, nil
+}
+
+// humanSize formats n bytes like "14.9 GiB".
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
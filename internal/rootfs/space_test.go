@@ -0,0 +1,100 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEstimateSpace(t *testing.T) {
+	const mib = 1 << 20
+	tests := map[string]struct {
+		distro   string
+		opts     Options
+		packages int
+		want     Space
+	}{
+		"alpine iso":   {"alpine", Options{}, 2, Space{WorkDir: 420 * mib, Output: 140 * mib}},
+		"debian disk":  {"debian", Options{Disk: true}, 0, Space{WorkDir: 700 * mib, Output: 700 * mib}},
+		"container":    {"alpine", Options{Container: true}, 2, Space{WorkDir: 50 * mib, Output: 25 * mib}},
+		"fedora iso":   {"fedora", Options{}, 10, Space{WorkDir: 2025 * mib, Output: 675 * mib}},
+		"unknown base": {"gentoo", Options{}, 0, Space{}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := EstimateSpace(tt.distro, tt.opts, tt.packages); got != tt.want {
+				t.Errorf("EstimateSpace = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemainingSpace(t *testing.T) {
+	r := &Rootfs{Path: t.TempDir()}
+	os.MkdirAll(filepath.Join(r.Path, "bin"), 0755)
+	os.WriteFile(filepath.Join(r.Path, "bin", "busybox"), make([]byte, 3000), 0755)
+	// A hard link takes no more space.
+	os.Link(filepath.Join(r.Path, "bin", "busybox"), filepath.Join(r.Path, "bin", "sh"))
+	os.WriteFile(filepath.Join(r.Path, "hostname"), make([]byte, 1000), 0644)
+
+	size, err := treeSize(r.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := size - 4000 // directories count too
+	if files < 0 || files > 2*4096 {
+		t.Fatalf("treeSize = %d, want 4000 bytes of files and two directories", size)
+	}
+
+	// The rootfs is already there: only the squashfs is left to write.
+	got, err := r.RemainingSpace(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Space{WorkDir: size / 2, Output: size / 2}); got != want {
+		t.Errorf("RemainingSpace = %+v, want %+v", got, want)
+	}
+	if got, _ := r.RemainingSpace(Options{Disk: true}); got != (Space{Output: size}) {
+		t.Errorf("RemainingSpace for a disk = %+v, want %d bytes of output", got, size)
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	work, out := t.TempDir(), t.TempDir()
+	_, free, err := freeSpace(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckSpace(work, out, Space{WorkDir: 1 << 20, Output: 1 << 20}); err != nil {
+		t.Errorf("CheckSpace for 2 MiB = %v", err)
+	}
+	err = CheckSpace(work, out, Space{WorkDir: free + 1<<30})
+	if err == nil || !strings.Contains(err.Error(), "DISTRORUN_WORKDIR") {
+		t.Errorf("CheckSpace for more than is free = %v, want an error pointing at DISTRORUN_WORKDIR", err)
+	}
+	// Both halves fit alone, but share the one filesystem.
+	if err := CheckSpace(work, out, Space{WorkDir: free/2 + 1<<30, Output: free/2 + 1<<30}); err == nil {
+		t.Error("CheckSpace did not add up the workdir and output of one filesystem")
+	}
+
+	// No workdir means the directory workdirs are created in by default.
+	t.Setenv("TMPDIR", filepath.Join(work, "missing"))
+	if err := CheckSpace("", out, Space{}); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("CheckSpace without a workdir = %v, want it to check TMPDIR", err)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for n, want := range map[int64]string{
+		512:            "512 B",
+		1536:           "1.5 KiB",
+		250 << 20:      "250.0 MiB",
+		15<<30 + 1<<29: "15.5 GiB",
+	} {
+		if got := humanSize(n); got != want {
+			t.Errorf("humanSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package rootfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// FetchSyslinux downloads the Alpine syslinux package and unpacks its boot
+// files (isolinux.bin, ldlinux.c32, isohdpfx.bin, ...) into dest, for hosts
+// without syslinux installed. The package is only downloaded, not installed
+// into the image. Alpine only; the rootfs must still be mounted.
+func (r *Rootfs) FetchSyslinux(dest string) error {
+	ui.SubStep("Fetching syslinux from the Alpine repositories...")
+	const dl = "/tmp/distrorun-syslinux"
+	hostDL := filepath.Join(r.Path, dl)
+	if err := audit.MkdirAll(hostDL, 0755); err != nil {
+		return fmt.Errorf("creating download directory: %w", err)
+	}
+	defer audit.RemoveAll(hostDL)
+
+	if out, err := r.packageManager("chroot", r.apk("fetch", "--quiet", "-o", dl, "syslinux")...).CombinedOutput(); err != nil {
+		return fmt.Errorf("apk fetch syslinux: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	apks, _ := filepath.Glob(filepath.Join(hostDL, "syslinux-*.apk"))
+	if len(apks) != 1 {
+		return fmt.Errorf("apk fetch syslinux: expected one package, found %d", len(apks))
+	}
+
+	// An apk is a concatenation of gzip-compressed tar segments, which tar
+	// reads as a single archive. The files live in /usr/share/syslinux.
+	if err := audit.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", dest, err)
+	}
+	out, err := r.command("tar", "xzf", apks[0], "-C", dest, "--warning=no-unknown-keyword",
+		"--strip-components=3", "usr/share/syslinux").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unpacking %s: %v: %s", filepath.Base(apks[0]), err, strings.TrimSpace(string(out)))
+	}
+	ui.Detail(strings.TrimSuffix(filepath.Base(apks[0]), ".apk"))
+	return nil
+}
@@ -0,0 +1,149 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/fsutil"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// SetHostname writes /etc/hostname and maps the name to a loopback address
+// in /etc/hosts, so programs resolving their own name (sudo, mail daemons)
+// do not wait for DNS.
+func (r *Rootfs) SetHostname(name string) error {
+	if err := r.writeFile("etc/hostname", name+"\n", 0644); err != nil {
+		return err
+	}
+	hosts, _ := os.ReadFile(filepath.Join(r.Path, "etc", "hosts"))
+	for _, line := range strings.Split(string(hosts), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && slices.Contains(fields[1:], name) {
+			return nil
+		}
+	}
+	return r.appendLine("etc/hosts", "127.0.1.1\t"+name)
+}
+
+// SetBanners replaces the login banner /etc/issue and the message of the
+// day /etc/motd written at bootstrap with issue and motd, keeping those
+// that are "".
+func (r *Rootfs) SetBanners(issue, motd string) error {
+	for rel, content := range map[string]string{"etc/issue": issue, "etc/motd": motd} {
+		if content == "" {
+			continue
+		}
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		if err := r.writeFile(rel, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTimezone points /etc/localtime at the zone's tzdata file, installing
+// tzdata first if the rootfs lacks the zone. Alpine and Debian also record
+// the name in /etc/timezone.
+func (r *Rootfs) SetTimezone(tz string) error {
+	ui.SubStep("Setting time zone " + tz + "...")
+	zone := filepath.Join("/usr/share/zoneinfo", tz)
+	if _, err := os.Stat(filepath.Join(r.Path, zone)); err != nil {
+		if err := r.InstallPackages([]string{"tzdata"}); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(r.Path, zone)); err != nil {
+			return fmt.Errorf("unknown time zone %q: %s is not in tzdata", tz, zone)
+		}
+	}
+
+	link := filepath.Join(r.Path, "etc", "localtime")
+	if err := audit.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("replacing /etc/localtime: %w", err)
+	}
+	if err := audit.Symlink(zone, link); err != nil {
+		return fmt.Errorf("linking /etc/localtime: %w", err)
+	}
+	if r.distro != "fedora" {
+		return r.writeFile("etc/timezone", tz+"\n", 0644)
+	}
+	return nil
+}
+
+// SetKeymap makes the console load keymap at boot: through the loadkmap
+// service with a binary keymap from kbd-bkeymaps on Alpine, and through
+// /etc/vconsole.conf on the systemd distros.
+func (r *Rootfs) SetKeymap(keymap string) error {
+	ui.SubStep("Setting console keymap " + keymap + "...")
+	if r.systemd() {
+		pkgs := []string{"kbd"}
+		if r.distro == "debian" {
+			pkgs = append(pkgs, "console-data") // Debian's kbd ships no keymaps
+		}
+		if err := r.InstallPackages(pkgs); err != nil {
+			return err
+		}
+		return r.writeFile("etc/vconsole.conf", "KEYMAP="+keymap+"\n", 0644)
+	}
+
+	// busybox-openrc ships the loadkmap init script.
+	if err := r.InstallPackages([]string{"kbd-bkeymaps", "busybox-openrc"}); err != nil {
+		return err
+	}
+	matches, _ := filepath.Glob(filepath.Join(r.Path, "usr", "share", "bkeymaps", "*", keymap+".bmap.gz"))
+	if len(matches) == 0 {
+		return fmt.Errorf("unknown keymap %q: not in /usr/share/bkeymaps", keymap)
+	}
+	dest := "etc/keymap/" + keymap + ".bmap.gz"
+	if err := audit.MkdirAll(filepath.Join(r.Path, "etc", "keymap"), 0755); err != nil {
+		return fmt.Errorf("creating /etc/keymap: %w", err)
+	}
+	if err := fsutil.CopyFile(matches[0], filepath.Join(r.Path, dest)); err != nil {
+		return fmt.Errorf("copying keymap: %w", err)
+	}
+	if err := r.writeFile("etc/conf.d/loadkmap", "KEYMAP=/"+dest+"\n", 0644); err != nil {
+		return err
+	}
+	if err := r.command("chroot", r.Path, "rc-update", "add", "loadkmap", "boot").Run(); err != nil {
+		return fmt.Errorf("enabling loadkmap: %w", err)
+	}
+	return nil
+}
+
+// autologinDropIn replaces the getty on tty1 with one logging %s in.
+const autologinDropIn = `[Service]
+ExecStart=
+ExecStart=-/sbin/agetty --autologin %s --noclear %%I $TERM
+`
+
+// SetAutologin logs user in on tty1 without a password: through the
+// inittab entry of tty1 on Alpine, and a getty@tty1 drop-in on the systemd
+// distros.
+func (r *Rootfs) SetAutologin(user string) error {
+	ui.SubStep("Logging " + user + " in on tty1...")
+	if r.systemd() {
+		return r.writeFile("etc/systemd/system/getty@tty1.service.d/distrorun-autologin.conf", fmt.Sprintf(autologinDropIn, user), 0644)
+	}
+
+	inittab := filepath.Join(r.Path, "etc", "inittab")
+	data, err := os.ReadFile(inittab)
+	if err != nil {
+		return fmt.Errorf("reading /etc/inittab: %w", err)
+	}
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "tty1:") {
+			lines[i] = "tty1::respawn:/bin/login -f " + user
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("/etc/inittab has no tty1 entry")
+	}
+	return r.writeFile("etc/inittab", strings.Join(lines, "\n"), 0644)
+}
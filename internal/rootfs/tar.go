@@ -0,0 +1,160 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// extractTar extracts the tar stream in into the directory dest with the
+// numeric owners, modes and modification times it records, as
+// "tar -xp --numeric-owner" does as root. Entries are written below an
+// os.Root, so neither their names nor symlinks extracted earlier can
+// redirect writes out of dest.
+func extractTar(in io.Reader, dest string) error {
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	type dirTime struct {
+		name  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+	tr := tar.NewReader(in)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(h.Name)
+		if name == "." || name == "/" {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("tar entry %q escapes the archive", h.Name)
+		}
+		if dir := path.Dir(name); dir != "." {
+			if err := root.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		mode := h.FileInfo().Mode()
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			// Times of directories are set last: extracting into one
+			// changes its modification time.
+			dirs = append(dirs, dirTime{name, h.ModTime})
+		case tar.TypeReg:
+			if err := writeTarFile(root, name, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := replace(root, name); err != nil {
+				return err
+			}
+			if err := root.Symlink(h.Linkname, name); err != nil {
+				return err
+			}
+			if err := root.Lchown(name, h.Uid, h.Gid); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			target := path.Clean(h.Linkname)
+			if !filepath.IsLocal(target) {
+				return fmt.Errorf("tar entry %q links out of the archive", h.Name)
+			}
+			if err := replace(root, name); err != nil {
+				return err
+			}
+			if err := root.Link(target, name); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := replace(root, name); err != nil {
+				return err
+			}
+			// os.Root cannot create device nodes. The parent was created
+			// through it, so it resolves to a directory inside dest.
+			kind := map[byte]uint32{tar.TypeChar: syscall.S_IFCHR, tar.TypeBlock: syscall.S_IFBLK, tar.TypeFifo: syscall.S_IFIFO}[h.Typeflag]
+			dev := int((h.Devmajor&0xfff)<<8 | h.Devminor&0xff | (h.Devminor&^0xff)<<12)
+			if err := syscall.Mknod(filepath.Join(dest, name), kind|uint32(mode.Perm()), dev); err != nil {
+				return fmt.Errorf("creating %s: %w", name, err)
+			}
+		default:
+			// Extended headers are consumed by tar.Reader; anything else,
+			// such as GNU sparse files, does not occur in a minirootfs.
+			return fmt.Errorf("tar entry %q has unsupported type %q", h.Name, h.Typeflag)
+		}
+
+		if err := root.Lchown(name, h.Uid, h.Gid); err != nil {
+			return err
+		}
+		// After chown, which clears the set-user-ID and set-group-ID bits.
+		if err := root.Chmod(name, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeDir {
+			if err := root.Chtimes(name, h.ModTime, h.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range slices.Backward(dirs) {
+		if err := root.Chtimes(d.name, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTarFile writes the data of a regular file entry to name.
+func writeTarFile(root *os.Root, name string, data io.Reader) error {
+	if err := replace(root, name); err != nil {
+		return err
+	}
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replace removes name, unless it is a directory, so a later entry of the
+// same name takes its place as with tar.
+func replace(root *os.Root, name string) error {
+	fi, err := root.Lstat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: a directory is in the way", name)
+	}
+	return root.Remove(name)
+}
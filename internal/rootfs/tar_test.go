@@ -0,0 +1,148 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarball returns a tar stream of headers, each regular file with its
+// name as content.
+func tarball(t *testing.T, headers ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range headers {
+		h.ModTime = time.Unix(1700000000, 0)
+		h.Uid, h.Gid = os.Getuid(), os.Getgid()
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		var data []byte
+		if h.Typeflag == tar.TypeReg {
+			data = []byte(h.Name)
+			h.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	dest := t.TempDir()
+	err := extractTar(tarball(t,
+		tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "./etc/hostname", Typeflag: tar.TypeReg},
+		tar.Header{Name: "./bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+		tar.Header{Name: "./bin/ash", Typeflag: tar.TypeSymlink, Linkname: "sh"},
+		tar.Header{Name: "./bin/busybox", Typeflag: tar.TypeLink, Linkname: "./bin/sh"},
+	), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "bin", "ash")); err != nil || string(data) != "./bin/sh" {
+		t.Errorf("bin/ash = %q, %v", data, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "bin", "busybox")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("bin/busybox: %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "etc")); err != nil || !fi.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("etc: %v, %v; want the modification time of the archive", fi, err)
+	}
+}
+
+// OUTSIDE in a link name stands for the absolute path of a host directory
+// next to dest.
+func TestExtractTar_Escape(t *testing.T) {
+	for name, headers := range map[string][]tar.Header{
+		"dot-dot": {
+			{Name: "../escaped", Typeflag: tar.TypeReg},
+		},
+		"dot-dot inside": {
+			{Name: "etc/../../escaped", Typeflag: tar.TypeReg},
+		},
+		"absolute": {
+			{Name: "/escaped", Typeflag: tar.TypeReg},
+		},
+		"write through symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			{Name: "link/escaped", Typeflag: tar.TypeReg},
+		},
+		"write through absolute symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "link/escaped", Typeflag: tar.TypeReg},
+		},
+		"file through symlink": {
+			{Name: "escaped", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/escaped"},
+			{Name: "escaped/x", Typeflag: tar.TypeReg},
+		},
+		"hardlink out": {
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../outside/passwd"},
+		},
+		"hardlink absolute": {
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "OUTSIDE/passwd"},
+		},
+		"hardlink through symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "link/passwd"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			outside := filepath.Join(parent, "outside")
+			dest := filepath.Join(parent, "dest")
+			os.Mkdir(outside, 0755)
+			os.Mkdir(dest, 0755)
+			passwd := filepath.Join(outside, "passwd")
+			os.WriteFile(passwd, []byte("host"), 0644)
+
+			for i := range headers {
+				if rest, ok := strings.CutPrefix(headers[i].Linkname, "OUTSIDE"); ok {
+					headers[i].Linkname = outside + rest
+				}
+			}
+			if err := extractTar(tarball(t, headers...), dest); err == nil {
+				t.Error("extractTar succeeded")
+			}
+
+			entries, _ := os.ReadDir(outside)
+			if len(entries) != 1 {
+				t.Errorf("files were created outside dest: %v", entries)
+			}
+			if data, _ := os.ReadFile(passwd); string(data) != "host" {
+				t.Errorf("host file was overwritten: %q", data)
+			}
+			for _, p := range []string{filepath.Join(parent, "escaped"), "/escaped"} {
+				if _, err := os.Lstat(p); err == nil {
+					t.Errorf("%s was created", p)
+				}
+			}
+			// A hardlink to a host file would share its inode.
+			filepath.Walk(dest, func(p string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode().IsRegular() && os.SameFile(fi, mustStat(t, passwd)) {
+					t.Errorf("%s is a hardlink to a host file", p)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func mustStat(t *testing.T, name string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
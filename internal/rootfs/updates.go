@@ -0,0 +1,122 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// upgradeScript runs apk upgrade from cron; %s is the reboot policy. A
+// kernel upgrade removes the running kernel's modules directory, which is
+// what "if-needed" checks for.
+const upgradeScript = `#!/bin/sh
+# DistroRun: unattended apk upgrade (updates.mode: unattended).
+exec >>/var/log/distrorun-upgrade.log 2>&1
+echo "=== $(date)"
+
+before=$(apk info -v 2>/dev/null | sort | md5sum)
+apk upgrade --update-cache --no-interactive || exit 1
+after=$(apk info -v 2>/dev/null | sort | md5sum)
+[ "$before" = "$after" ] && exit 0
+
+case "%s" in
+    always)    reboot ;;
+    if-needed) [ -d "/lib/modules/$(uname -r)" ] || reboot ;;
+esac
+`
+
+// ConfigureUpdates applies the upgrade policy. All modes pin
+// /etc/apk/repositories to the image's release branch, so neither a cron
+// job nor a manual "apk upgrade" moves the system to a new Alpine release.
+// Unattended mode adds a cron job running apk upgrade with the configured
+// reboot policy; image mode adds the update agent, which replaces the whole
+// root filesystem with new releases from a channel; frozen mode adds
+// nothing and the system changes only when an operator upgrades it.
+// version is the image version of the build, which image mode only
+// updates to newer releases than.
+func (r *Rootfs) ConfigureUpdates(u config.Updates, version string) error {
+	ui.SubStep(fmt.Sprintf("Configuring updates (%s)...", u.Mode))
+
+	if err := r.pinRepositories(); err != nil {
+		return err
+	}
+	if u.Mode == "frozen" {
+		ui.Detail("No automatic upgrades")
+		return nil
+	}
+
+	// busybox-openrc ships the init script for the busybox crond applet.
+	packages := []string{"busybox-openrc"}
+	script := firstbootDir + "/distrorun-upgrade"
+	content := fmt.Sprintf(upgradeScript, u.RebootPolicy())
+	if u.Mode == "image" {
+		// jq reads the manifest and openssl checks its signature.
+		packages = append(packages, "jq", "openssl", "ca-certificates")
+		script = firstbootDir + "/distrorun-update"
+		content = imageUpdateScript
+	}
+	if err := r.InstallPackages(packages); err != nil {
+		return err
+	}
+	if err := r.writeFile(strings.TrimPrefix(script, "/"), content, 0755); err != nil {
+		return err
+	}
+	if u.Mode == "image" {
+		if err := r.installImageUpdates(u, version); err != nil {
+			return err
+		}
+	}
+	if err := r.appendLine("etc/crontabs/root", u.CronSchedule()+"\t"+script); err != nil {
+		return err
+	}
+	ui.ServiceItem("crond")
+	if err := r.command("chroot", r.Path, "rc-update", "add", "crond", "default").Run(); err != nil {
+		return fmt.Errorf("enabling service crond: %w", err)
+	}
+	if u.Mode == "image" {
+		ui.Detail(fmt.Sprintf("Image updates from %s at %q, reboot %s", u.Manifest, u.CronSchedule(), u.RebootPolicy()))
+	} else {
+		ui.Detail(fmt.Sprintf("apk upgrade at %q, reboot %s", u.CronSchedule(), u.RebootPolicy()))
+	}
+	return nil
+}
+
+// releaseBranch returns the release branch installed in the rootfs, e.g.
+// v3.20, or "" for an edge snapshot.
+func (r *Rootfs) releaseBranch() (string, error) {
+	release, err := os.ReadFile(filepath.Join(r.Path, "etc", "alpine-release"))
+	if err != nil {
+		return "", fmt.Errorf("reading /etc/alpine-release: %w", err)
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(release)), ".", 3)
+	if len(parts) < 2 || strings.Contains(parts[1], "_") {
+		return "", nil // edge snapshot, e.g. "3.21_alpha20240807"
+	}
+	return "v" + parts[0] + "." + parts[1], nil
+}
+
+// pinRepositories replaces latest-stable in /etc/apk/repositories with the
+// release branch installed in the rootfs, e.g. v3.20. Edge is left alone.
+func (r *Rootfs) pinRepositories() error {
+	branch, err := r.releaseBranch()
+	if err != nil || branch == "" {
+		return err
+	}
+
+	reposPath := filepath.Join(r.Path, "etc", "apk", "repositories")
+	repos, err := os.ReadFile(reposPath)
+	if err != nil {
+		return fmt.Errorf("reading repositories: %w", err)
+	}
+	pinned := strings.ReplaceAll(string(repos), "/latest-stable/", "/"+branch+"/")
+	if err := audit.WriteFile(reposPath, []byte(pinned), 0644); err != nil {
+		return fmt.Errorf("writing repositories: %w", err)
+	}
+	ui.Detail("Repositories pinned to " + branch)
+	return nil
+}
@@ -2,16 +2,22 @@ package rootfs
 
 import (
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/talfaza/distrorun/internal/audit"
 	"github.com/talfaza/distrorun/internal/config"
 	"github.com/talfaza/distrorun/internal/ui"
 )
 
 // SetupUsers creates system users and sets their passwords.
-// Passwords are hashed by chpasswd (SHA-512 on Alpine) — plain text is never
-// stored in the final image.
+// Passwords are hashed by chpasswd (SHA-512 on Alpine), or written as given
+// in password_hash — plain text is never stored in the final image. Login
+// shells, supplementary groups, SSH keys and privilege escalation are
+// configured per user.
 func (r *Rootfs) SetupUsers(users []config.User) error {
+	var admins []config.User
 	for _, u := range users {
 		if u.Name == "root" {
 			ui.UserItem(u.Name, "password update")
@@ -19,31 +25,262 @@ func (r *Rootfs) SetupUsers(users []config.User) error {
 			ui.UserItem(u.Name, "new user")
 		}
 
+		shell := u.LoginShell()
+		if _, err := os.Stat(filepath.Join(r.Path, shell)); err != nil {
+			return fmt.Errorf("shell %s for user %s is not installed (add it to packages)", shell, u.Name)
+		}
+
 		if u.Name != "root" {
-			var cmd *exec.Cmd
-			if r.distro == "fedora" {
-				// useradd is the standard tool on Fedora/systemd distros
-				cmd = exec.Command("chroot", r.Path, "useradd", "-m", "-s", "/bin/bash", u.Name)
+			var cmd *audit.Cmd
+			if r.systemd() {
+				// useradd is the standard tool on Fedora/Debian
+				cmd = r.chroot("useradd", "-m", "-s", shell, u.Name)
 			} else {
 				// adduser is Alpine's BusyBox variant
-				cmd = exec.Command("chroot", r.Path, "adduser", "-D", "-s", "/bin/bash", u.Name)
+				cmd = r.chroot("adduser", "-D", "-s", shell, u.Name)
 			}
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("creating user %s: %w", u.Name, err)
 			}
-		} else {
-			// Set root's shell to bash (best-effort on both distros)
-			cmd := exec.Command("chroot", r.Path, "sed", "-i", `s|^root:(.*):/bin/sh$|root:\1:/bin/bash|`, "/etc/passwd")
-			_ = cmd.Run()
+		} else if err := r.setLoginShell(u.Name, shell); err != nil {
+			return err
+		}
+
+		if u.PasswordHash != "" {
+			if err := r.setPasswordField(u.Name, u.PasswordHash); err != nil {
+				return err
+			}
+		} else if u.HasPassword() {
+			password, err := userPassword(u)
+			if err != nil {
+				return err
+			}
+			// chpasswd hashes it with SHA-512. It reads the password from
+			// stdin, so it shows up in neither the process list nor the
+			// audit log.
+			cmd := r.chroot("chpasswd")
+			cmd.Stdin = strings.NewReader(u.Name + ":" + password + "\n")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("setting password for %s: %w: %s", u.Name, err, strings.TrimSpace(string(out)))
+			}
+		} else if u.Name != "root" {
+			// Key-only user: "*" disables password login without locking
+			// the account, which would also make sshd refuse public keys.
+			if err := r.setPasswordField(u.Name, "*"); err != nil {
+				return err
+			}
+		}
+
+		for _, g := range u.Groups {
+			if err := r.addToGroup(u.Name, g); err != nil {
+				return err
+			}
+		}
+
+		if len(u.SSHAuthorizedKeys) > 0 {
+			if err := r.writeAuthorizedKeys(u.Name, u.SSHAuthorizedKeys); err != nil {
+				return err
+			}
+			ui.Detail(fmt.Sprintf("%d SSH key(s) authorized", len(u.SSHAuthorizedKeys)))
+		}
+
+		if u.Sudo && u.Name != "root" {
+			admins = append(admins, u)
+		}
+	}
+
+	return r.configurePrivilege(admins)
+}
+
+// userPassword returns the plain-text password of u, reading it from the
+// environment or its password file when it is given that way.
+func userPassword(u config.User) (string, error) {
+	password := u.Password
+	switch {
+	case u.PasswordEnv != "":
+		password = os.Getenv(u.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("password of %s: environment variable %s is not set", u.Name, u.PasswordEnv)
+		}
+	case u.PasswordFile != "":
+		data, err := os.ReadFile(u.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("password of %s: %w", u.Name, err)
+		}
+		password = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		if password == "" {
+			return "", fmt.Errorf("password of %s: %s is empty", u.Name, u.PasswordFile)
+		}
+	}
+	if strings.ContainsAny(password, "\n\r") {
+		return "", fmt.Errorf("password of %s must be a single line", u.Name)
+	}
+	return password, nil
+}
+
+// addToGroup adds user to a supplementary group, creating the group first
+// if no package provided it.
+func (r *Rootfs) addToGroup(user, group string) error {
+	var create, add *audit.Cmd
+	if r.systemd() {
+		create = r.chroot("groupadd", "-f", group)
+		add = r.chroot("usermod", "-aG", group, user)
+	} else {
+		create = r.chroot("addgroup", group)
+		add = r.chroot("addgroup", user, group)
+	}
+	if !r.groupExists(group) {
+		if err := create.Run(); err != nil {
+			return fmt.Errorf("creating group %s: %w", group, err)
 		}
+	}
+	if err := add.Run(); err != nil {
+		return fmt.Errorf("adding %s to group %s: %w", user, group, err)
+	}
+	return nil
+}
 
-		// Set password via chpasswd (hashes with SHA-512)
-		cmd := exec.Command("chroot", r.Path, "sh", "-c",
-			fmt.Sprintf("echo '%s:%s' | chpasswd", u.Name, u.Password))
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("setting password for %s: %w", u.Name, err)
+// groupExists reports whether /etc/group in the rootfs defines group.
+func (r *Rootfs) groupExists(group string) bool {
+	data, err := os.ReadFile(filepath.Join(r.Path, "etc", "group"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, group+":") {
+			return true
 		}
 	}
+	return false
+}
+
+// writeAuthorizedKeys installs keys as ~/.ssh/authorized_keys owned by user,
+// with the permissions sshd's StrictModes requires.
+func (r *Rootfs) writeAuthorizedKeys(user string, keys []string) error {
+	entry, err := r.passwdEntry(user)
+	if err != nil {
+		return err
+	}
+	home := entry[5]
 
+	sshDir := filepath.Join(r.Path, home, ".ssh")
+	if err := audit.MkdirAll(sshDir, 0700); err != nil {
+		return fmt.Errorf("creating %s/.ssh: %w", home, err)
+	}
+	content := strings.Join(keys, "\n") + "\n"
+	if err := audit.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte(content), 0600); err != nil {
+		return fmt.Errorf("writing authorized_keys for %s: %w", user, err)
+	}
+
+	cmd := r.chroot("chown", "-R", user+":", home+"/.ssh")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("chown %s/.ssh: %w: %s", home, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// configurePrivilege lets admins run commands as root: doas on Alpine, sudo
+// on Fedora and Debian. Either is installed here, as not every package set
+// pulls it in (the Fedora workstation one does not). Users without a
+// password are not asked for one.
+func (r *Rootfs) configurePrivilege(admins []config.User) error {
+	if len(admins) == 0 {
+		return nil
+	}
+
+	tool := "doas"
+	if r.systemd() {
+		tool = "sudo"
+	}
+	ui.SubStep("Installing " + tool + "...")
+	if err := r.InstallPackages([]string{tool}); err != nil {
+		return err
+	}
+
+	var rules strings.Builder
+	var confPath string
+	if r.systemd() {
+		confPath = filepath.Join(r.Path, "etc", "sudoers.d", "distrorun")
+		for _, u := range admins {
+			if !u.HasPassword() {
+				fmt.Fprintf(&rules, "%s ALL=(ALL:ALL) NOPASSWD: ALL\n", u.Name)
+			} else {
+				fmt.Fprintf(&rules, "%s ALL=(ALL:ALL) ALL\n", u.Name)
+			}
+		}
+	} else {
+		confPath = filepath.Join(r.Path, "etc", "doas.d", "distrorun.conf")
+		for _, u := range admins {
+			if !u.HasPassword() {
+				fmt.Fprintf(&rules, "permit nopass %s as root\n", u.Name)
+			} else {
+				fmt.Fprintf(&rules, "permit persist %s as root\n", u.Name)
+			}
+		}
+	}
+
+	if err := audit.MkdirAll(filepath.Dir(confPath), 0750); err != nil {
+		return fmt.Errorf("creating %s: %w", filepath.Dir(confPath), err)
+	}
+	// sudo and doas both refuse rule files writable by anyone but root.
+	if err := audit.WriteFile(confPath, []byte(rules.String()), 0440); err != nil {
+		return fmt.Errorf("writing privilege rules: %w", err)
+	}
+	return nil
+}
+
+// setLoginShell rewrites the shell field of user in /etc/passwd.
+func (r *Rootfs) setLoginShell(user, shell string) error {
+	return r.editPasswdFile("passwd", user, 6, shell)
+}
+
+// setPasswordField rewrites the password hash field of user in /etc/shadow.
+func (r *Rootfs) setPasswordField(user, hash string) error {
+	return r.editPasswdFile("shadow", user, 1, hash)
+}
+
+// passwdEntry returns the colon-separated /etc/passwd fields of user.
+func (r *Rootfs) passwdEntry(user string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(r.Path, "etc", "passwd"))
+	if err != nil {
+		return nil, fmt.Errorf("reading /etc/passwd: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == user {
+			return fields, nil
+		}
+	}
+	return nil, fmt.Errorf("user %s not found in /etc/passwd", user)
+}
+
+// editPasswdFile sets field index of user's line in /etc/<file>.
+func (r *Rootfs) editPasswdFile(file, user string, index int, value string) error {
+	p := filepath.Join(r.Path, "etc", file)
+	info, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("reading /etc/%s: %w", file, err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("reading /etc/%s: %w", file, err)
+	}
+
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if fields[0] == user && len(fields) > index {
+			fields[index] = value
+			lines[i] = strings.Join(fields, ":")
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("user %s not found in /etc/%s", user, file)
+	}
+	if err := audit.WriteFile(p, []byte(strings.Join(lines, "\n")), info.Mode()); err != nil {
+		return fmt.Errorf("writing /etc/%s: %w", file, err)
+	}
 	return nil
 }
@@ -0,0 +1,115 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// panicSysctl reboots the machine 10 seconds after a kernel panic, and turns
+// oopses into panics so a half-dead kernel does not linger.
+const panicSysctl = `# Generated by DistroRun (system.watchdog)
+kernel.panic = 10
+kernel.panic_on_oops = 1
+`
+
+// ConfigureWatchdog loads the watchdog driver at boot, starts a daemon that
+// feeds it, and reboots on kernel panics. On systemd distros systemd itself
+// feeds the watchdog (RuntimeWatchdogSec); on Alpine the busybox watchdog
+// daemon does. With RestartServices, the given services are restarted by
+// their supervisor when they crash.
+func (r *Rootfs) ConfigureWatchdog(w config.Watchdog, services []string) error {
+	module, timeout := w.KernelModule(), w.TimeoutSeconds()
+	ui.SubStep(fmt.Sprintf("Configuring watchdog (%s, %ds timeout)...", module, timeout))
+
+	if err := r.writeFile("etc/sysctl.d/90-distrorun-watchdog.conf", panicSysctl, 0644); err != nil {
+		return err
+	}
+
+	if r.systemd() {
+		if err := r.writeFile("etc/modules-load.d/distrorun-watchdog.conf", module+"\n", 0644); err != nil {
+			return err
+		}
+		manager := fmt.Sprintf("[Manager]\nRuntimeWatchdogSec=%ds\nRebootWatchdogSec=10min\n", timeout)
+		if err := r.writeFile("etc/systemd/system.conf.d/distrorun-watchdog.conf", manager, 0644); err != nil {
+			return err
+		}
+	} else {
+		// busybox-openrc ships the init script for the busybox watchdog applet.
+		if err := r.InstallPackages([]string{"busybox-openrc"}); err != nil {
+			return err
+		}
+		if err := r.appendLine("etc/modules", module); err != nil {
+			return err
+		}
+		// The busybox daemon feeds the device every timeout/4 seconds.
+		conf := fmt.Sprintf("WATCHDOG_OPTS=\"-T %d -t %d\"\nWATCHDOG_DEV=\"/dev/watchdog\"\n", timeout, max(timeout/4, 1))
+		if err := r.writeFile("etc/conf.d/watchdog", conf, 0644); err != nil {
+			return err
+		}
+		for _, svc := range []string{"modules", "sysctl"} {
+			_ = r.command("chroot", r.Path, "rc-update", "add", svc, "boot").Run() // best-effort
+		}
+		if err := r.command("chroot", r.Path, "rc-update", "add", "watchdog", "default").Run(); err != nil {
+			return fmt.Errorf("enabling watchdog service: %w", err)
+		}
+	}
+
+	if !w.RestartServices {
+		return nil
+	}
+	for _, svc := range services {
+		ui.ServiceItem(svc + " (restart on crash)")
+		if r.systemd() {
+			name := strings.TrimSuffix(svc, ".service")
+			if strings.Contains(name, ".") {
+				continue // sockets, timers and the like are not restarted
+			}
+			dropIn := "[Unit]\nStartLimitIntervalSec=0\n\n[Service]\nRestart=on-failure\nRestartSec=2s\n"
+			if err := r.writeFile("etc/systemd/system/"+name+".service.d/distrorun-restart.conf", dropIn, 0644); err != nil {
+				return err
+			}
+		} else {
+			// Only takes effect for init scripts that use command= rather
+			// than their own start().
+			if err := r.appendLine("etc/conf.d/"+svc, "supervisor=supervise-daemon\nrespawn_delay=2\nrespawn_max=0"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFile writes content to rel inside the rootfs, creating parent directories.
+func (r *Rootfs) writeFile(rel, content string, mode os.FileMode) error {
+	p := filepath.Join(r.Path, rel)
+	if err := audit.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", filepath.Dir(rel), err)
+	}
+	if err := audit.WriteFile(p, []byte(content), mode); err != nil {
+		return fmt.Errorf("writing /%s: %w", rel, err)
+	}
+	return nil
+}
+
+// appendLine appends line to rel inside the rootfs, creating the file if needed.
+func (r *Rootfs) appendLine(rel, line string) error {
+	p := filepath.Join(r.Path, rel)
+	if err := audit.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", filepath.Dir(rel), err)
+	}
+	f, err := audit.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening /%s: %w", rel, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("writing /%s: %w", rel, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// wgQuickInit is the OpenRC service bringing a wg-quick interface up once
+// networking is available. Alpine's wireguard-tools ship no init script.
+const wgQuickInit = `#!/sbin/openrc-run
+
+description="WireGuard interface %[1]s"
+
+depend() {
+	need net
+	after dns
+}
+
+start() {
+	ebegin "Starting WireGuard interface %[1]s"
+	wg-quick up %[1]s
+	eend $?
+}
+
+stop() {
+	ebegin "Stopping WireGuard interface %[1]s"
+	wg-quick down %[1]s
+	eend $?
+}
+`
+
+// ConfigureWireGuard installs wireguard-tools, writes the wg-quick
+// configuration to /etc/wireguard/<iface>.conf (readable by root only) and
+// brings the interface up at boot.
+func (r *Rootfs) ConfigureWireGuard(wg config.WireGuard) error {
+	iface := wg.InterfaceName()
+	ui.SubStep(fmt.Sprintf("Configuring WireGuard interface %s...", iface))
+
+	conf, err := renderWireGuard(wg)
+	if err != nil {
+		return err
+	}
+
+	pkgs := []string{"wireguard-tools"}
+	if r.distro == "alpine" {
+		pkgs = append(pkgs, "iproute2") // wg-quick needs more than busybox ip
+	}
+	if len(wg.DNS) > 0 || strings.Contains(conf, "\nDNS") {
+		if r.distro != "fedora" { // systemd-resolved provides resolvconf on Fedora
+			pkgs = append(pkgs, "openresolv")
+		}
+	}
+	if err := r.InstallPackages(pkgs); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(r.Path, "etc", "wireguard")
+	if err := audit.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating /etc/wireguard: %w", err)
+	}
+	if err := audit.Chmod(dir, 0700); err != nil {
+		return fmt.Errorf("securing /etc/wireguard: %w", err)
+	}
+	if err := r.writeFile("etc/wireguard/"+iface+".conf", conf, 0600); err != nil {
+		return err
+	}
+
+	var cmd *audit.Cmd
+	if r.systemd() {
+		cmd = r.command("chroot", r.Path, "systemctl", "enable", "wg-quick@"+iface)
+	} else {
+		svc := "wg-quick." + iface
+		if err := r.writeFile("etc/init.d/"+svc, fmt.Sprintf(wgQuickInit, iface), 0755); err != nil {
+			return err
+		}
+		cmd = r.command("chroot", r.Path, "rc-update", "add", svc, "default")
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("enabling WireGuard interface %s: %w", iface, err)
+	}
+	ui.ServiceItem("wg-quick " + iface)
+	return nil
+}
+
+// renderWireGuard returns the wg-quick configuration: the contents of
+// ConfigFile, or the inline interface and peers.
+func renderWireGuard(wg config.WireGuard) (string, error) {
+	if wg.ConfigFile != "" {
+		data, err := os.ReadFile(wg.ConfigFile)
+		if err != nil {
+			return "", fmt.Errorf("reading WireGuard config: %w", err)
+		}
+		return string(data), nil
+	}
+
+	key := wg.PrivateKey
+	if wg.PrivateKeyFile != "" {
+		data, err := os.ReadFile(wg.PrivateKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("reading WireGuard private key: %w", err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by DistroRun (vpn.wireguard)\n[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", key)
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(wg.Address, ", "))
+	if len(wg.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(wg.DNS, ", "))
+	}
+	if wg.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", wg.ListenPort)
+	}
+	for _, p := range wg.Peers {
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\n", p.PublicKey)
+		if p.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", p.Endpoint)
+		}
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(p.AllowedIPs, ", "))
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,270 @@
+package rootfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// wizardMessages is the wizard's message catalog, keyed by language and then
+// by message ID. Every language must define every ID used by wizardTemplate.
+var wizardMessages = map[string]map[string]string{
+	"en": {
+		"title":        "First boot setup",
+		"welcome":      "Welcome! This wizard sets up the basics of this system. It runs only once.",
+		"hostname":     "Hostname for this machine:",
+		"password":     "New password for root:",
+		"password2":    "Repeat the password:",
+		"mismatch":     "The passwords do not match. Please try again.",
+		"network":      "How should the network be configured?",
+		"dhcp":         "Automatic (DHCP)",
+		"static":       "Manual (static address)",
+		"address":      "IP address with prefix length (e.g. 192.168.1.10/24):",
+		"gateway":      "Default gateway:",
+		"dns":          "DNS server:",
+		"keyboard":     "Keyboard layout (e.g. us, de, fr):",
+		"done":         "Setup is complete. The system will now continue booting.",
+		"skipped_pass": "Password unchanged.",
+	},
+	"de": {
+		"title":        "Ersteinrichtung",
+		"welcome":      "Willkommen! Dieser Assistent richtet die Grundeinstellungen dieses Systems ein. Er läuft nur einmal.",
+		"hostname":     "Rechnername:",
+		"password":     "Neues Passwort für root:",
+		"password2":    "Passwort wiederholen:",
+		"mismatch":     "Die Passwörter stimmen nicht überein. Bitte erneut versuchen.",
+		"network":      "Wie soll das Netzwerk eingerichtet werden?",
+		"dhcp":         "Automatisch (DHCP)",
+		"static":       "Manuell (statische Adresse)",
+		"address":      "IP-Adresse mit Präfixlänge (z. B. 192.168.1.10/24):",
+		"gateway":      "Standard-Gateway:",
+		"dns":          "DNS-Server:",
+		"keyboard":     "Tastaturbelegung (z. B. de, us, fr):",
+		"done":         "Die Einrichtung ist abgeschlossen. Das System startet jetzt weiter.",
+		"skipped_pass": "Passwort unverändert.",
+	},
+	"fr": {
+		"title":        "Configuration initiale",
+		"welcome":      "Bienvenue ! Cet assistant configure les réglages de base de ce système. Il ne s'exécute qu'une fois.",
+		"hostname":     "Nom de la machine :",
+		"password":     "Nouveau mot de passe pour root :",
+		"password2":    "Répétez le mot de passe :",
+		"mismatch":     "Les mots de passe ne correspondent pas. Veuillez réessayer.",
+		"network":      "Comment configurer le réseau ?",
+		"dhcp":         "Automatique (DHCP)",
+		"static":       "Manuel (adresse statique)",
+		"address":      "Adresse IP avec longueur de préfixe (ex. 192.168.1.10/24) :",
+		"gateway":      "Passerelle par défaut :",
+		"dns":          "Serveur DNS :",
+		"keyboard":     "Disposition du clavier (ex. fr, us, de) :",
+		"done":         "La configuration est terminée. Le démarrage va se poursuivre.",
+		"skipped_pass": "Mot de passe inchangé.",
+	},
+	"es": {
+		"title":        "Configuración inicial",
+		"welcome":      "¡Bienvenido! Este asistente configura lo básico de este sistema. Solo se ejecuta una vez.",
+		"hostname":     "Nombre del equipo:",
+		"password":     "Nueva contraseña para root:",
+		"password2":    "Repita la contraseña:",
+		"mismatch":     "Las contraseñas no coinciden. Inténtelo de nuevo.",
+		"network":      "¿Cómo se debe configurar la red?",
+		"dhcp":         "Automática (DHCP)",
+		"static":       "Manual (dirección estática)",
+		"address":      "Dirección IP con longitud de prefijo (p. ej. 192.168.1.10/24):",
+		"gateway":      "Puerta de enlace predeterminada:",
+		"dns":          "Servidor DNS:",
+		"keyboard":     "Distribución del teclado (p. ej. es, us, de):",
+		"done":         "La configuración ha terminado. El sistema continuará arrancando.",
+		"skipped_pass": "Contraseña sin cambios.",
+	},
+}
+
+// WizardLanguages returns the languages the first-boot wizard is available in.
+func WizardLanguages() []string {
+	langs := make([]string, 0, len(wizardMessages))
+	for l := range wizardMessages {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// wizardTemplate renders the first-boot wizard. It uses whiptail dialogs when
+// available and falls back to plain prompts on a bare console. Network
+// settings are written in the format of the image's network stack.
+var wizardTemplate = template.Must(template.New("wizard").Funcs(template.FuncMap{
+	"quote": shellQuote,
+}).Parse(`#!/bin/sh
+# DistroRun first boot: interactive setup wizard (generated, language: {{.Language}}).
+export LANG=C.UTF-8
+{{range $id, $text := .Messages}}msg_{{$id}}={{quote $text}}
+{{end}}
+if command -v whiptail >/dev/null 2>&1; then
+    ui=whiptail
+else
+    ui=plain
+fi
+
+say() {
+    if [ $ui = whiptail ]; then
+        whiptail --title "$msg_title" --msgbox "$1" 10 70
+    else
+        printf '\n%s\n' "$1"
+    fi
+}
+
+# ask PROMPT DEFAULT — prints the answer
+ask() {
+    if [ $ui = whiptail ]; then
+        whiptail --title "$msg_title" --inputbox "$1" 10 70 "$2" 3>&1 1>&2 2>&3 || echo "$2"
+    else
+        printf '%s [%s] ' "$1" "$2" >&2
+        read -r answer
+        echo "${answer:-$2}"
+    fi
+}
+
+# askpass PROMPT — prints the answer without echoing it while typed
+askpass() {
+    if [ $ui = whiptail ]; then
+        whiptail --title "$msg_title" --passwordbox "$1" 10 70 3>&1 1>&2 2>&3
+    else
+        printf '%s ' "$1" >&2
+        stty -echo; read -r answer; stty echo
+        printf '\n' >&2
+        echo "$answer"
+    fi
+}
+
+# choose PROMPT TAG1 ITEM1 TAG2 ITEM2 — prints the chosen tag
+choose() {
+    prompt=$1; shift
+    if [ $ui = whiptail ]; then
+        whiptail --title "$msg_title" --menu "$prompt" 12 70 2 "$@" 3>&1 1>&2 2>&3 || echo "$1"
+    else
+        printf '%s\n  1) %s\n  2) %s\n' "$prompt" "$2" "$4" >&2
+        read -r answer
+        [ "$answer" = 2 ] && echo "$3" || echo "$1"
+    fi
+}
+
+say "$msg_welcome"
+
+# Hostname
+name=$(ask "$msg_hostname" "$(cat /etc/hostname 2>/dev/null)")
+if [ -n "$name" ]; then
+    echo "$name" > /etc/hostname
+    hostname "$name"
+fi
+
+# Root password
+while :; do
+    pass=$(askpass "$msg_password")
+    [ -z "$pass" ] && { say "$msg_skipped_pass"; break; }
+    pass2=$(askpass "$msg_password2")
+    if [ "$pass" = "$pass2" ]; then
+        echo "root:$pass" | chpasswd
+        break
+    fi
+    say "$msg_mismatch"
+done
+
+# Network
+mode=$(choose "$msg_network" dhcp "$msg_dhcp" static "$msg_static")
+if [ "$mode" = static ]; then
+    addr=$(ask "$msg_address" "")
+    gw=$(ask "$msg_gateway" "")
+    dns=$(ask "$msg_dns" "$gw")
+{{- if eq .Distro "alpine"}}
+    cat > /etc/network/interfaces <<EOF
+auto lo
+iface lo inet loopback
+
+auto eth0
+iface eth0 inet static
+    address $addr
+    gateway $gw
+EOF
+    echo "nameserver $dns" > /etc/resolv.conf
+    rc-service networking restart >/dev/null 2>&1
+{{- else if eq .Distro "debian"}}
+    cat > /etc/systemd/network/20-dhcp.network <<EOF
+[Match]
+Name=en* eth*
+
+[Network]
+Address=$addr
+Gateway=$gw
+DNS=$dns
+EOF
+    echo "nameserver $dns" > /etc/resolv.conf
+    systemctl restart systemd-networkd >/dev/null 2>&1
+{{- else}}
+    nmcli connection modify dhcp ipv4.method manual ipv4.addresses "$addr" \
+        ipv4.gateway "$gw" ipv4.dns "$dns" && nmcli connection up dhcp >/dev/null
+{{- end}}
+fi
+
+# Keyboard
+layout=$(ask "$msg_keyboard" "us")
+if [ -n "$layout" ]; then
+{{- if eq .Distro "alpine"}}
+    setup-keymap "$layout" "$layout" >/dev/null 2>&1
+{{- else}}
+    localectl set-keymap "$layout" 2>/dev/null || echo "KEYMAP=$layout" > /etc/vconsole.conf
+{{- end}}
+fi
+
+say "$msg_done"
+exit 0
+`))
+
+// InstallWizard installs the interactive first-boot wizard in the given
+// language. It runs once on tty1 before the login prompt appears.
+func (r *Rootfs) InstallWizard(language string) error {
+	if language == "" {
+		language = "en"
+	}
+	messages, ok := wizardMessages[language]
+	if !ok {
+		return fmt.Errorf("first-boot wizard is not available in %q (available: %s)", language, strings.Join(WizardLanguages(), ", "))
+	}
+
+	ui.SubStep(fmt.Sprintf("Installing first-boot wizard (%s)...", language))
+
+	pkgs := []string{"newt"} // provides whiptail
+	switch r.distro {
+	case "debian":
+		pkgs = []string{"whiptail"}
+	case "alpine":
+		pkgs = append(pkgs, "kbd-bkeymaps")
+	}
+	if err := r.InstallPackages(pkgs); err != nil {
+		return err
+	}
+
+	var script strings.Builder
+	err := wizardTemplate.Execute(&script, struct {
+		Language string
+		Distro   string
+		Messages map[string]string
+	}{language, r.distro, messages})
+	if err != nil {
+		return fmt.Errorf("rendering wizard: %w", err)
+	}
+
+	return r.installOneshot(oneshotService{
+		Name:        "distrorun-wizard",
+		Description: "First boot setup wizard",
+		Script:      script.String(),
+		Console:     true,
+	})
+}
+
+// shellQuote quotes s as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,120 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"github.com/talfaza/distrorun/internal/audit"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// workDirSuffix matches what newWorkDir appends to "distrorun-<name>-":
+// the shortened config hash and the random os.MkdirTemp suffix. Matching it
+// exactly keeps a build of "web" from touching the workdirs of "web-proxy".
+var workDirSuffix = regexp.MustCompile(`^[0-9a-f]{12}-[0-9]+$`)
+
+// lockDir holds the build locks. Lock creates it accessible to the
+// building user only, so no one else can plant a lock file or a symlink
+// in its place.
+var lockDir = "/run/distrorun"
+
+// BuildLock is an advisory lock held for the duration of a build.
+type BuildLock struct {
+	f *os.File
+}
+
+// Lock takes the build lock for an image name, waiting for any other build
+// of the same name to finish. The lock is released by Unlock or when the
+// process exits, so a crashed build never leaves it stuck.
+func Lock(name string) (*BuildLock, error) {
+	if err := checkLockDir(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(lockDir, name+".lock")
+	f, err := audit.OpenFile(path, os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		ui.Warn(fmt.Sprintf("Another build of %q is running — waiting for it to finish", name))
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+	}
+	return &BuildLock{f: f}, nil
+}
+
+// checkLockDir creates lockDir if needed and makes sure it is a directory,
+// not a symlink, owned by the current user and writable by no one else.
+func checkLockDir() error {
+	if err := audit.MkdirAll(lockDir, 0700); err != nil {
+		return fmt.Errorf("creating lock directory: %w", err)
+	}
+	info, err := os.Lstat(lockDir)
+	if err != nil {
+		return fmt.Errorf("checking lock directory: %w", err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(st.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("lock directory %s must be a directory owned by uid %d and writable by it only", lockDir, os.Geteuid())
+	}
+	return nil
+}
+
+// Unlock releases the build lock.
+func (l *BuildLock) Unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
+
+// newWorkDir removes workdirs left behind by earlier builds of name in
+// parent (os.TempDir() when empty) and creates a fresh one there, keyed by
+// the config hash plus a random suffix, with an empty rootfs directory
+// inside. The caller must hold the build lock for name, which guarantees
+// every other workdir of that name is stale.
+func newWorkDir(parent, name, configHash string) (workDir, rootfsPath string, err error) {
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	prefix := fmt.Sprintf("distrorun-%s-", name)
+	matches, _ := filepath.Glob(filepath.Join(parent, prefix+"*"))
+	for _, dir := range matches {
+		if !workDirSuffix.MatchString(filepath.Base(dir)[len(prefix):]) {
+			continue
+		}
+		// Unmount first so we don't remove live bind mounts.
+		stale := &Rootfs{Path: filepath.Join(dir, "rootfs"), WorkDir: dir}
+		stale.Unmount()
+		if left := mountsUnder(dir); len(left) > 0 {
+			return "", "", fmt.Errorf("stale workdir %s: %s is still mounted", dir, left[0])
+		}
+		if err := audit.RemoveAll(dir); err != nil {
+			return "", "", fmt.Errorf("removing stale workdir: %w", err)
+		}
+	}
+
+	key := configHash
+	if len(key) < 12 {
+		key = "000000000000"
+	}
+	workDir, err = audit.MkdirTemp(parent, prefix+key[:12]+"-")
+	if err != nil {
+		return "", "", fmt.Errorf("creating workdir: %w", err)
+	}
+	// MkdirTemp creates 0700; the rootfs must stay traversable for chroot users.
+	audit.Chmod(workDir, 0755)
+	if err := labelWorkDir(workDir); err != nil {
+		return "", "", err
+	}
+
+	rootfsPath = filepath.Join(workDir, "rootfs")
+	if err := audit.MkdirAll(rootfsPath, 0755); err != nil {
+		return "", "", fmt.Errorf("creating rootfs directory: %w", err)
+	}
+	return workDir, rootfsPath, nil
+}
@@ -0,0 +1,97 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	lockDir = filepath.Join(dir, "locks")
+	t.Cleanup(func() { lockDir = "/run/distrorun" })
+
+	l, err := Lock("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+	info, err := os.Stat(lockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("lock directory mode = %04o, want 0700", perm)
+	}
+
+	// A symlink planted in place of the lock file is not followed.
+	target := filepath.Join(dir, "target")
+	if err := os.Symlink(target, filepath.Join(lockDir, "planted.lock")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock("planted"); err == nil {
+		t.Error("Lock followed a symlinked lock file")
+	}
+	if _, err := os.Lstat(target); err == nil {
+		t.Error("Lock created the symlink target")
+	}
+
+	// Nor is a lock directory others can write to, or a symlink to one.
+	for name, setup := range map[string]func(string) error{
+		"writable": func(p string) error {
+			if err := os.Mkdir(p, 0700); err != nil {
+				return err
+			}
+			return os.Chmod(p, 0777)
+		},
+		"symlink": func(p string) error { return os.Symlink(dir, p) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			lockDir = filepath.Join(dir, name)
+			if err := setup(lockDir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Lock("demo"); err == nil {
+				t.Error("Lock accepted the lock directory")
+			}
+		})
+	}
+}
+
+func TestNewWorkDir(t *testing.T) {
+	hash := "0123456789abcdef"
+	for name, parent := range map[string]string{"workdir": t.TempDir(), "default": ""} {
+		t.Run(name, func(t *testing.T) {
+			dir := parent
+			if dir == "" {
+				dir = t.TempDir()
+				t.Setenv("TMPDIR", dir)
+			}
+			stale := filepath.Join(dir, "distrorun-web-0123456789ab-12345")
+			other := filepath.Join(dir, "distrorun-web-proxy-0123456789ab-12345")
+			for _, d := range []string{stale, other} {
+				os.MkdirAll(filepath.Join(d, "rootfs"), 0755)
+			}
+
+			workDir, rootfsPath, err := newWorkDir(parent, "web", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Dir(workDir) != dir || rootfsPath != filepath.Join(workDir, "rootfs") {
+				t.Errorf("newWorkDir = %s, %s; want a workdir in %s", workDir, rootfsPath, dir)
+			}
+			if !workDirSuffix.MatchString(filepath.Base(workDir)[len("distrorun-web-"):]) {
+				t.Errorf("workdir %s is not one newWorkDir recognizes as stale later", workDir)
+			}
+			if info, err := os.Stat(rootfsPath); err != nil || !info.IsDir() {
+				t.Errorf("rootfs directory: %v", err)
+			}
+			if _, err := os.Stat(stale); !os.IsNotExist(err) {
+				t.Errorf("stale workdir of web was kept: %v", err)
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("workdir of web-proxy was removed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package sbom
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// apkPackage is what the apk database records about an installed package.
+type apkPackage struct {
+	name    string
+	version string
+	license string
+	files   []string // relative to the root, e.g. "usr/bin/env"
+}
+
+// readApkDB reads /lib/apk/db/installed, the database "apk info" prints
+// from, in the order apk lists the packages. Reading it directly rather
+// than running apk in the rootfs needs neither root nor binaries that run
+// on the host, so images can be scanned wherever they were extracted.
+func readApkDB(rootfsPath string) ([]*apkPackage, error) {
+	f, err := os.Open(filepath.Join(rootfsPath, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return nil, fmt.Errorf("reading apk database: %w", err)
+	}
+	defer f.Close()
+
+	var pkgs []*apkPackage
+	var cur *apkPackage
+	var dir string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			// A blank line ends the package.
+			cur, dir = nil, ""
+			continue
+		}
+		switch key {
+		case "P":
+			cur = &apkPackage{name: value}
+			pkgs = append(pkgs, cur)
+		case "V":
+			if cur != nil {
+				cur.version = value
+			}
+		case "L":
+			if cur != nil {
+				cur.license = value
+			}
+		case "F":
+			dir = value
+		case "R":
+			if cur != nil {
+				cur.files = append(cur.files, path.Join(dir, value))
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading apk database: %w", err)
+	}
+	return pkgs, nil
+}
+
+// licenseID matches an SPDX license identifier or exception.
+var licenseID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+-]*$`)
+
+// spdxLicense turns the license of an apk package into an SPDX license
+// expression. Older packages list several licenses separated by spaces,
+// which all apply; licenses that are no SPDX identifiers, such as
+// "custom", make it NOASSERTION.
+func spdxLicense(apk string) string {
+	fields := strings.Fields(apk)
+	if len(fields) == 0 {
+		return "NOASSERTION"
+	}
+	expression := slices.ContainsFunc(fields, func(f string) bool {
+		return f == "AND" || f == "OR" || f == "WITH"
+	})
+	for _, f := range fields {
+		f = strings.Trim(f, "()")
+		if f == "AND" || f == "OR" || f == "WITH" {
+			continue
+		}
+		if !licenseID.MatchString(f) || strings.EqualFold(f, "custom") {
+			return "NOASSERTION"
+		}
+	}
+	if expression {
+		return strings.Join(fields, " ")
+	}
+	if len(fields) > 1 {
+		return "(" + strings.Join(fields, " AND ") + ")"
+	}
+	return fields[0]
+}
+
+// analyzeFiles hashes the regular files among files, which belong to the
+// package pkgID, and returns their SPDX entries with the package
+// verification code computed over them. Files the package installed but
+// the image no longer has, and symlinks, are left out.
+func analyzeFiles(rootfsPath, pkgID string, files []string) ([]SPDXFile, string, error) {
+	var entries []SPDXFile
+	var sha1s []string
+	for i, name := range files {
+		p := filepath.Join(rootfsPath, name)
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		s1, s256, err := hashFile(p)
+		if err != nil {
+			return nil, "", err
+		}
+		sha1s = append(sha1s, s1)
+		entries = append(entries, SPDXFile{
+			SPDXID:   fmt.Sprintf("%s-File-%d", pkgID, i),
+			FileName: "./" + name,
+			Checksums: []SPDXChecksum{
+				{Algorithm: "SHA1", Value: s1},
+				{Algorithm: "SHA256", Value: s256},
+			},
+			LicenseConcluded: "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		})
+	}
+	// SPDX 2.3 section 7.9: the SHA1 of the sorted file SHA1s.
+	slices.Sort(sha1s)
+	code := sha1.Sum([]byte(strings.Join(sha1s, "")))
+	return entries, hex.EncodeToString(code[:]), nil
+}
+
+// hashFile returns the hex SHA1 and SHA256 digests of the file at p.
+func hashFile(p string) (string, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	h1, h256 := sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h1, h256), f); err != nil {
+		return "", "", fmt.Errorf("hashing %s: %w", p, err)
+	}
+	return hex.EncodeToString(h1.Sum(nil)), hex.EncodeToString(h256.Sum(nil)), nil
+}
@@ -0,0 +1,135 @@
+package sbom
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// installedDB is an apk database with a package of several directories,
+// one without a license and one listing two licenses.
+const installedDB = `C:Q1abc=
+P:busybox
+V:1.36.1-r29
+A:x86_64
+L:GPL-2.0-only
+F:bin
+R:busybox
+R:sh
+F:etc
+R:securetty
+
+P:tzdata
+V:2024a-r0
+
+P:zlib
+V:1.3.1-r1
+L:Zlib MIT
+F:lib
+R:libz.so.1
+`
+
+// rootfs writes files and, unless db is empty, the apk database db into a
+// new rootfs.
+func rootfs(t *testing.T, db string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if db != "" {
+		files["lib/apk/db/installed"] = db
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadApkDB(t *testing.T) {
+	pkgs, err := readApkDB(rootfs(t, installedDB, map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []apkPackage{
+		{name: "busybox", version: "1.36.1-r29", license: "GPL-2.0-only", files: []string{"bin/busybox", "bin/sh", "etc/securetty"}},
+		{name: "tzdata", version: "2024a-r0"},
+		{name: "zlib", version: "1.3.1-r1", license: "Zlib MIT", files: []string{"lib/libz.so.1"}},
+	}
+	if len(pkgs) != len(want) {
+		t.Fatalf("read %d packages, want %d", len(pkgs), len(want))
+	}
+	for i, w := range want {
+		p := pkgs[i]
+		if p.name != w.name || p.version != w.version || p.license != w.license || !slices.Equal(p.files, w.files) {
+			t.Errorf("package %d = %+v, want %+v", i, *p, w)
+		}
+	}
+
+	if _, err := readApkDB(t.TempDir()); err == nil || !strings.Contains(err.Error(), "reading apk database") {
+		t.Errorf("readApkDB without a database = %v", err)
+	}
+}
+
+func TestSpdxLicense(t *testing.T) {
+	for apk, want := range map[string]string{
+		"":                                     "NOASSERTION",
+		"MIT":                                  "MIT",
+		"GPL-2.0-or-later":                     "GPL-2.0-or-later",
+		"Zlib MIT":                             "(Zlib AND MIT)",
+		"MIT OR Apache-2.0":                    "MIT OR Apache-2.0",
+		"(MIT OR Apache-2.0) AND BSD-3-Clause": "(MIT OR Apache-2.0) AND BSD-3-Clause",
+		"GPL-2.0-only WITH Linux-syscall-note": "GPL-2.0-only WITH Linux-syscall-note",
+		"custom":                               "NOASSERTION",
+		"MIT custom":                           "NOASSERTION",
+		"BSD/MIT":                              "NOASSERTION",
+	} {
+		if got := spdxLicense(apk); got != want {
+			t.Errorf("spdxLicense(%q) = %q, want %q", apk, got, want)
+		}
+	}
+}
+
+func TestAnalyzeFiles(t *testing.T) {
+	dir := rootfs(t, "", map[string]string{"bin/busybox": "busybox binary", "etc/securetty": "console\n"})
+	os.Symlink("busybox", filepath.Join(dir, "bin", "sh"))
+
+	// bin/sh is a symlink and usr/bin/gone was removed from the image.
+	entries, code, err := analyzeFiles(dir, "SPDXRef-Package-0", []string{"bin/busybox", "bin/sh", "usr/bin/gone", "etc/securetty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sha1s []string
+	for i, f := range []struct{ id, name, data string }{
+		{"SPDXRef-Package-0-File-0", "./bin/busybox", "busybox binary"},
+		{"SPDXRef-Package-0-File-3", "./etc/securetty", "console\n"},
+	} {
+		if i >= len(entries) {
+			t.Fatalf("got %d files, want 2", len(entries))
+		}
+		s1, s256 := sha1.Sum([]byte(f.data)), sha256.Sum256([]byte(f.data))
+		sha1s = append(sha1s, hex.EncodeToString(s1[:]))
+		e := entries[i]
+		if e.SPDXID != f.id || e.FileName != f.name {
+			t.Errorf("file %d = %s %s, want %s %s", i, e.SPDXID, e.FileName, f.id, f.name)
+		}
+		want := []SPDXChecksum{{"SHA1", hex.EncodeToString(s1[:])}, {"SHA256", hex.EncodeToString(s256[:])}}
+		if !slices.Equal(e.Checksums, want) {
+			t.Errorf("%s checksums = %v, want %v", f.name, e.Checksums, want)
+		}
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files, want 2", len(entries))
+	}
+	slices.Sort(sha1s)
+	sum := sha1.Sum([]byte(strings.Join(sha1s, "")))
+	if want := hex.EncodeToString(sum[:]); code != want {
+		t.Errorf("verification code = %s, want %s", code, want)
+	}
+}
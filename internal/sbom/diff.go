@@ -0,0 +1,132 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ReadPackages returns the name → version map of all packages in an SPDX
+// JSON document, skipping the operating-system entry. Works for both
+// DistroRun- and Trivy-generated SBOMs.
+func ReadPackages(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SBOM: %w", err)
+	}
+	var doc SPDXDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing SBOM %s: %w", path, err)
+	}
+
+	pkgs := make(map[string]string, len(doc.Packages))
+	for _, p := range doc.Packages {
+		if p.PrimaryPurpose == "OPERATING-SYSTEM" {
+			continue
+		}
+		pkgs[p.Name] = p.VersionInfo
+	}
+	return pkgs, nil
+}
+
+// ReadFiles returns the path → SHA-256 map of the files listed in an SPDX
+// JSON document, such as those of "distrorun sbom -files". Paths are
+// absolute, as in the image.
+func ReadFiles(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SBOM: %w", err)
+	}
+	var doc SPDXDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing SBOM %s: %w", path, err)
+	}
+
+	files := make(map[string]string, len(doc.Files))
+	for _, f := range doc.Files {
+		for _, c := range f.Checksums {
+			if c.Algorithm == "SHA256" {
+				files["/"+strings.TrimPrefix(strings.TrimPrefix(f.FileName, "./"), "/")] = c.Value
+			}
+		}
+	}
+	return files, nil
+}
+
+// ReleaseNotes renders Markdown release notes listing the packages added,
+// removed and updated between two SBOMs. An empty prevPath produces a plain
+// package list for a first release.
+func ReleaseNotes(prevPath, curPath string) (string, error) {
+	cur, err := ReadPackages(curPath)
+	if err != nil {
+		return "", err
+	}
+	var prev map[string]string
+	if prevPath != "" {
+		if prev, err = ReadPackages(prevPath); err != nil {
+			return "", err
+		}
+	}
+	return PackageNotes(prev, cur), nil
+}
+
+// PackageNotes renders the release notes of ReleaseNotes from the
+// name → version maps of two releases. A nil prev produces the package
+// list of a first release.
+func PackageNotes(prev, cur map[string]string) string {
+	var b strings.Builder
+	if prev == nil {
+		fmt.Fprintf(&b, "## Packages (%d)\n\n", len(cur))
+		for _, name := range sortedNames(cur) {
+			fmt.Fprintf(&b, "- %s %s\n", name, cur[name])
+		}
+		return b.String()
+	}
+
+	var added, removed, updated []string
+	for _, name := range sortedNames(cur) {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			added = append(added, fmt.Sprintf("- %s %s", name, cur[name]))
+		case old != cur[name]:
+			updated = append(updated, fmt.Sprintf("- %s %s → %s", name, old, cur[name]))
+		}
+	}
+	for _, name := range sortedNames(prev) {
+		if _, ok := cur[name]; !ok {
+			removed = append(removed, fmt.Sprintf("- %s %s", name, prev[name]))
+		}
+	}
+
+	b.WriteString("## Package changes\n")
+	if len(added)+len(removed)+len(updated) == 0 {
+		b.WriteString("\nNo package changes.\n")
+	}
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"Added", added},
+		{"Updated", updated},
+		{"Removed", removed},
+	} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n### %s (%d)\n\n%s\n", section.title, len(section.lines), strings.Join(section.lines, "\n"))
+	}
+	return b.String()
+}
+
+// sortedNames returns the keys of pkgs in lexical order.
+func sortedNames(pkgs map[string]string) []string {
+	names := make([]string, 0, len(pkgs))
+	for n := range pkgs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,30 @@
+package sbom
+
+import "testing"
+
+func TestPackageNotes(t *testing.T) {
+	cur := map[string]string{"musl": "1.2.5-r1", "curl": "8.9.0-r0", "busybox": "1.36.1-r29"}
+	for name, tc := range map[string]struct {
+		prev map[string]string
+		want string
+	}{
+		"first release": {
+			want: "## Packages (3)\n\n- busybox 1.36.1-r29\n- curl 8.9.0-r0\n- musl 1.2.5-r1\n",
+		},
+		"changes": {
+			prev: map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.1-r29", "wget": "1.24.5-r0"},
+			want: "## Package changes\n" +
+				"\n### Added (1)\n\n- curl 8.9.0-r0\n" +
+				"\n### Updated (1)\n\n- musl 1.2.5-r0 → 1.2.5-r1\n" +
+				"\n### Removed (1)\n\n- wget 1.24.5-r0\n",
+		},
+		"unchanged": {
+			prev: cur,
+			want: "## Package changes\n\nNo package changes.\n",
+		},
+	} {
+		if got := PackageNotes(tc.prev, cur); got != tc.want {
+			t.Errorf("%s: notes =\n%s\nwant\n%s", name, got, tc.want)
+		}
+	}
+}
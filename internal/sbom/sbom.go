@@ -22,6 +22,7 @@ type SPDXDocument struct {
 	Namespace     string             `json:"documentNamespace"`
 	CreationInfo  SPDXCreationInfo   `json:"creationInfo"`
 	Packages      []SPDXPackage      `json:"packages"`
+	Files         []SPDXFile         `json:"files,omitempty"`
 	Relationships []SPDXRelationship `json:"relationships"`
 }
 
@@ -39,10 +40,36 @@ type SPDXPackage struct {
 	Supplier         string            `json:"supplier,omitempty"`
 	DownloadLocation string            `json:"downloadLocation"`
 	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	VerificationCode *SPDXVerification `json:"packageVerificationCode,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded,omitempty"`
+	LicenseDeclared  string            `json:"licenseDeclared,omitempty"`
+	CopyrightText    string            `json:"copyrightText,omitempty"`
+	HasFiles         []string          `json:"hasFiles,omitempty"`
 	ExternalRefs     []SPDXExternalRef `json:"externalRefs,omitempty"`
 	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
 }
 
+// SPDXVerification is the package verification code of a package whose
+// files were analyzed.
+type SPDXVerification struct {
+	Value string `json:"packageVerificationCodeValue"`
+}
+
+// SPDXFile is a file of an analyzed package.
+type SPDXFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []SPDXChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+// SPDXChecksum is a digest of a file.
+type SPDXChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
 // SPDXExternalRef is a package URL reference.
 type SPDXExternalRef struct {
 	ReferenceCategory string `json:"referenceCategory"`
@@ -58,15 +85,20 @@ type SPDXRelationship struct {
 }
 
 // Generate creates an SPDX 2.3 JSON SBOM from the packages installed in the rootfs.
-// Uses Trivy if available (guaranteed compatibility), falls back to apk-based generation.
-func Generate(rootfsPath, configName, outputPath string) error {
+// Uses Trivy if available (guaranteed compatibility), falls back to apk- or
+// dpkg-based generation depending on the rootfs. With files, the files of
+// each apk package are listed with their hashes, which Trivy does not do.
+func Generate(rootfsPath, configName, outputPath string, files bool) error {
 	// Try Trivy first — produces a perfectly compatible SBOM
-	if trivyPath, err := exec.LookPath("trivy"); err == nil {
+	if trivyPath, err := exec.LookPath("trivy"); err == nil && !files {
 		return generateWithTrivy(trivyPath, rootfsPath, outputPath)
 	}
 
-	// Fallback: generate from apk info
-	return generateFromApk(rootfsPath, configName, outputPath)
+	// Fallback: generate from the package database
+	if _, err := os.Stat(filepath.Join(rootfsPath, "etc", "debian_version")); err == nil {
+		return generateFromDpkg(rootfsPath, configName, outputPath)
+	}
+	return generateFromApk(rootfsPath, configName, outputPath, files)
 }
 
 // generateWithTrivy uses `trivy rootfs` to scan the rootfs and produce an SPDX JSON SBOM.
@@ -88,21 +120,20 @@ func generateWithTrivy(trivyPath, rootfsPath, outputPath string) error {
 	return nil
 }
 
-// generateFromApk builds an SPDX 2.3 JSON SBOM by reading apk package info.
-func generateFromApk(rootfsPath, configName, outputPath string) error {
+// generateFromApk builds an SPDX 2.3 JSON SBOM by reading apk package info,
+// with licenses from the apk database and, with files, the hashed files of
+// each package.
+func generateFromApk(rootfsPath, configName, outputPath string, files bool) error {
 	ui.SubStep("Scanning installed packages (apk)...")
 
 	alpineVersionFull := detectAlpineVersionFull(rootfsPath)
 	alpineVersion := detectAlpineVersion(rootfsPath)
 
-	cmd := exec.Command("chroot", rootfsPath, "apk", "info", "-v")
-	output, err := cmd.Output()
+	pkgs, err := readApkDB(rootfsPath)
 	if err != nil {
-		return fmt.Errorf("listing packages: %w", err)
+		return err
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-
 	doc := SPDXDocument{
 		SPDXVersion: "SPDX-2.3",
 		DataLicense: "CC0-1.0",
@@ -139,13 +170,8 @@ func generateFromApk(rootfsPath, configName, outputPath string) error {
 		},
 	})
 
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		name, version := parseApkPackage(line)
+	for i, info := range pkgs {
+		name, version := info.name, info.version
 		spdxID := fmt.Sprintf("SPDXRef-Package-%d", i)
 
 		pkg := SPDXPackage{
@@ -164,6 +190,21 @@ func generateFromApk(rootfsPath, configName, outputPath string) error {
 				},
 			},
 		}
+		pkg.LicenseDeclared = spdxLicense(info.license)
+		pkg.LicenseConcluded = "NOASSERTION"
+		pkg.CopyrightText = "NOASSERTION"
+		if files {
+			entries, code, err := analyzeFiles(rootfsPath, spdxID, info.files)
+			if err != nil {
+				return fmt.Errorf("analyzing files of %s: %w", name, err)
+			}
+			pkg.FilesAnalyzed = true
+			pkg.VerificationCode = &SPDXVerification{Value: code}
+			for _, f := range entries {
+				pkg.HasFiles = append(pkg.HasFiles, f.SPDXID)
+			}
+			doc.Files = append(doc.Files, entries...)
+		}
 		doc.Packages = append(doc.Packages, pkg)
 
 		doc.Relationships = append(doc.Relationships, SPDXRelationship{
@@ -182,22 +223,15 @@ func generateFromApk(rootfsPath, configName, outputPath string) error {
 		return fmt.Errorf("writing SBOM: %w", err)
 	}
 
-	ui.SubStep(fmt.Sprintf("SBOM written with %d packages (Alpine %s)", len(lines), alpineVersion))
+	if files {
+		ui.SubStep(fmt.Sprintf("SBOM written with %d packages and %d files (Alpine %s)", len(pkgs), len(doc.Files), alpineVersion))
+	} else {
+		ui.SubStep(fmt.Sprintf("SBOM written with %d packages (Alpine %s)", len(pkgs), alpineVersion))
+	}
 	ui.InfoPath("SBOM", outputPath)
 	return nil
 }
 
-// parseApkPackage splits an "apk info -v" line (e.g. "busybox-1.36.1-r1")
-// into name and version by finding the last hyphen that precedes a digit.
-func parseApkPackage(s string) (name, version string) {
-	for i := len(s) - 1; i >= 0; i-- {
-		if s[i] == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' {
-			return s[:i], s[i+1:]
-		}
-	}
-	return s, "unknown"
-}
-
 // detectAlpineVersionFull reads /etc/alpine-release and returns the full version (e.g. "3.23.3").
 func detectAlpineVersionFull(rootfsPath string) string {
 	data, err := os.ReadFile(filepath.Join(rootfsPath, "etc", "alpine-release"))
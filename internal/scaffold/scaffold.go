@@ -0,0 +1,308 @@
+// Package scaffold writes starter configuration files, either with default
+// settings or from the answers to an interactive interview.
+package scaffold
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+// Bases and Outputs are the choices offered for distro.base and build.output.
+var (
+	Bases   = []string{"alpine", "fedora", "debian"}
+	Outputs = []string{"iso", "qcow2", "raw", "netboot", "oci"}
+)
+
+// Answers are the settings of a new configuration.
+type Answers struct {
+	Name     string
+	Base     string
+	Packages []string
+	Users    []config.User
+	Services []string
+	Output   string
+}
+
+// Defaults returns the settings of a starter configuration: an Alpine ISO
+// with SSH and a root user with a placeholder password.
+func Defaults(name string) Answers {
+	return Answers{
+		Name:     name,
+		Base:     "alpine",
+		Packages: defaultPackages("alpine"),
+		Users:    []config.User{{Name: "root", Password: "changeme"}},
+		Services: defaultServices("alpine"),
+		Output:   "iso",
+	}
+}
+
+// defaultPackages returns the SSH server package of a distribution.
+func defaultPackages(base string) []string {
+	if base == "alpine" {
+		return []string{"openssh"}
+	}
+	return []string{"openssh-server"}
+}
+
+// defaultServices returns the SSH service name of a distribution.
+func defaultServices(base string) []string {
+	if base == "debian" {
+		return []string{"ssh"}
+	}
+	return []string{"sshd"}
+}
+
+// Prompter asks questions on out and reads the answers from in.
+type Prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// readPassword reads one line without echoing it.
+	readPassword func() (string, error)
+}
+
+// NewPrompter returns a Prompter reading from in and writing to out.
+// Passwords are read with readPassword, which should turn off echo on a
+// terminal, or from in like other answers if it is nil.
+func NewPrompter(in io.Reader, out io.Writer, readPassword func() (string, error)) *Prompter {
+	p := &Prompter{in: bufio.NewReader(in), out: out, readPassword: readPassword}
+	if p.readPassword == nil {
+		p.readPassword = p.line
+	}
+	return p
+}
+
+// line reads one answer, without its line ending.
+func (p *Prompter) line() (string, error) {
+	s, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || s == "") {
+		if err == io.EOF {
+			return "", errors.New("input ended before the configuration was complete")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// Ask returns the answer to question, or def if the answer is empty.
+func (p *Prompter) Ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	s, err := p.line()
+	if s == "" {
+		s = def
+	}
+	return s, err
+}
+
+// Choose asks until the answer is one of choices.
+func (p *Prompter) Choose(question string, choices []string, def string) (string, error) {
+	for {
+		s, err := p.Ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", ")), def)
+		if err != nil || slices.Contains(choices, s) {
+			return s, err
+		}
+		fmt.Fprintf(p.out, "  %q is not one of %s\n", s, strings.Join(choices, ", "))
+	}
+}
+
+// List asks for a comma- or space-separated list; "-" answers an empty one.
+func (p *Prompter) List(question string, def []string) ([]string, error) {
+	d := strings.Join(def, ", ")
+	if d == "" {
+		d = "-"
+	}
+	s, err := p.Ask(question, d)
+	if err != nil || s == "-" {
+		return nil, err
+	}
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }), nil
+}
+
+// Confirm asks a yes/no question.
+func (p *Prompter) Confirm(question string, def bool) (bool, error) {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	for {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, d)
+		s, err := p.line()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(s) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// Password asks for a password twice without echo until both entries
+// match and are not empty.
+func (p *Prompter) Password(question string) (string, error) {
+	for {
+		fmt.Fprintf(p.out, "%s: ", question)
+		pw, err := p.readPassword()
+		fmt.Fprintln(p.out)
+		if err != nil {
+			return "", err
+		}
+		if pw == "" {
+			fmt.Fprintln(p.out, "  the password must not be empty")
+			continue
+		}
+		fmt.Fprint(p.out, "Repeat the password: ")
+		again, err := p.readPassword()
+		fmt.Fprintln(p.out)
+		if err != nil {
+			return "", err
+		}
+		if pw == again {
+			return pw, nil
+		}
+		fmt.Fprintln(p.out, "  the passwords do not match")
+	}
+}
+
+// Interview asks for the settings of a new configuration, offering those
+// of def as defaults.
+func Interview(p *Prompter, def Answers) (Answers, error) {
+	var a Answers
+	var err error
+	for a.Name == "" {
+		if a.Name, err = p.Ask("Image name", def.Name); err != nil {
+			return a, err
+		}
+	}
+	if a.Base, err = p.Choose("Base distribution", Bases, def.Base); err != nil {
+		return a, err
+	}
+	if a.Packages, err = p.List("Packages to install", defaultPackages(a.Base)); err != nil {
+		return a, err
+	}
+
+	pw, err := p.Password("Root password")
+	if err != nil {
+		return a, err
+	}
+	a.Users = []config.User{{Name: "root", Password: pw}}
+	for {
+		more, err := p.Confirm("Add another user?", false)
+		if err != nil {
+			return a, err
+		}
+		if !more {
+			break
+		}
+		u, err := p.askUser()
+		if err != nil {
+			return a, err
+		}
+		a.Users = append(a.Users, u)
+	}
+
+	if a.Services, err = p.List("Services to enable at boot", defaultServices(a.Base)); err != nil {
+		return a, err
+	}
+	a.Output, err = p.Choose("Output format", Outputs, def.Output)
+	return a, err
+}
+
+// askUser asks for the name, password and root access of a login user.
+func (p *Prompter) askUser() (config.User, error) {
+	var u config.User
+	var err error
+	for u.Name == "" {
+		if u.Name, err = p.Ask("  User name", ""); err != nil {
+			return u, err
+		}
+	}
+	if u.Password, err = p.Password("  Password for " + u.Name); err != nil {
+		return u, err
+	}
+	u.Sudo, err = p.Confirm("  Allow "+u.Name+" to become root?", true)
+	return u, err
+}
+
+// file is the subset of config.Config a starter configuration sets.
+type file struct {
+	Version  string    `yaml:"version"`
+	Name     string    `yaml:"name"`
+	Distro   distro    `yaml:"distro"`
+	Packages []string  `yaml:"packages,omitempty"`
+	Users    []user    `yaml:"users"`
+	Services *services `yaml:"services,omitempty"`
+	Build    build     `yaml:"build"`
+}
+
+type distro struct {
+	Base string `yaml:"base"`
+}
+
+type user struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Sudo     bool   `yaml:"sudo,omitempty"`
+}
+
+type services struct {
+	Enable []string `yaml:"enable"`
+}
+
+type build struct {
+	Output string `yaml:"output"`
+}
+
+// Render returns the configuration file for a, after checking that it is
+// valid.
+func Render(a Answers) ([]byte, error) {
+	f := file{
+		Version:  strconv.Itoa(config.CurrentVersion),
+		Name:     a.Name,
+		Distro:   distro{Base: a.Base},
+		Packages: a.Packages,
+		Build:    build{Output: a.Output},
+	}
+	for _, u := range a.Users {
+		f.Users = append(f.Users, user{Name: u.Name, Password: u.Password, Sudo: u.Sudo})
+	}
+	if len(a.Services) > 0 {
+		f.Services = &services{Enable: a.Services}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	var cfg config.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	header := "# Generated by 'distrorun init'. See distrorun(1) and sample.distrorun.yaml\n" +
+		"# for every option. Passwords are stored in plain text: keep this file private.\n"
+	return append([]byte(header), data...), nil
+}
@@ -0,0 +1,83 @@
+package scaffold
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+)
+
+func TestInterview(t *testing.T) {
+	input := strings.Join([]string{
+		"web",         // name
+		"ubuntu",      // not a base: asked again
+		"debian",      // base
+		"nginx, curl", // packages
+		"secret",      // root password
+		"secret",      //   repeated
+		"y",           // another user
+		"admin",       //   name
+		"one",         //   password
+		"two",         //   mismatch: asked again
+		"pw",          //   password
+		"pw",          //   repeated
+		"",            //   sudo, default yes
+		"n",           // no more users
+		"",            // services, default
+		"qcow2",       // output
+	}, "\n") + "\n"
+	p := NewPrompter(strings.NewReader(input), io.Discard, nil)
+	a, err := Interview(p, Defaults("my-os"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "web" || a.Base != "debian" || a.Output != "qcow2" {
+		t.Errorf("got name %q base %q output %q", a.Name, a.Base, a.Output)
+	}
+	if got := strings.Join(a.Packages, ","); got != "nginx,curl" {
+		t.Errorf("Packages = %q", got)
+	}
+	if got := strings.Join(a.Services, ","); got != "ssh" {
+		t.Errorf("Services = %q, want the debian default ssh", got)
+	}
+	if len(a.Users) != 2 || a.Users[0].Password != "secret" || a.Users[1].Name != "admin" || a.Users[1].Password != "pw" || !a.Users[1].Sudo {
+		t.Errorf("Users = %+v", a.Users)
+	}
+
+	// The rendered file loads as a valid configuration.
+	data, err := Render(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "web.yaml")
+	os.WriteFile(path, data, 0600)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v\n%s", err, data)
+	}
+	if cfg.Distro.Base != "debian" || cfg.OutputMode() != "disk" || !cfg.Users[1].Sudo {
+		t.Errorf("loaded %+v", cfg)
+	}
+}
+
+func TestInterviewEndOfInput(t *testing.T) {
+	p := NewPrompter(strings.NewReader("web\n"), io.Discard, nil)
+	if _, err := Interview(p, Defaults("my-os")); err == nil || !strings.Contains(err.Error(), "input ended") {
+		t.Errorf("expected end of input error, got: %v", err)
+	}
+}
+
+func TestRenderDefaults(t *testing.T) {
+	data, err := Render(Defaults("my-os"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"name: my-os", "base: alpine", "password: changeme", "- sshd", "output: iso"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("missing %q in:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package templates lets a directory of files replace the built-in
+// templates distrorun renders into images: the live init script, the boot
+// menus, mkinitfs.conf and the apk repositories. Every template is a Go
+// text/template; the built-ins stay in the packages that render them and
+// are used for every name without an override.
+package templates
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Names of the templates that can be overridden.
+const (
+	Init         = "init"               // live init script of the initramfs
+	Isolinux     = "isolinux.cfg"       // BIOS boot menu of ISOs
+	Grub         = "grub.cfg"           // GRUB boot menu of Fedora and UEFI ISOs
+	MkinitfsLive = "mkinitfs-live.conf" // Alpine mkinitfs.conf of live images
+	MkinitfsDisk = "mkinitfs-disk.conf" // Alpine mkinitfs.conf of disk images
+	Repositories = "repositories"       // Alpine /etc/apk/repositories
+)
+
+// overrides holds the templates loaded by Load, by name.
+var overrides = map[string]string{}
+
+// Load reads the templates of dir, each file named after the template it
+// replaces, and uses them instead of the built-ins from now on. Files with
+// other names and templates that do not parse are errors.
+func Load(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading templates: %w", err)
+	}
+	names := []string{Init, Isolinux, Grub, MkinitfsLive, MkinitfsDisk, Repositories}
+	loaded := map[string]string{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !slices.Contains(names, e.Name()) {
+			return fmt.Errorf("templates: unknown template %q in %s (known: %s)", e.Name(), dir, strings.Join(names, ", "))
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("reading templates: %w", err)
+		}
+		if _, err := template.New(e.Name()).Parse(string(data)); err != nil {
+			return fmt.Errorf("templates: %w", err)
+		}
+		loaded[e.Name()] = string(data)
+	}
+	maps.Copy(overrides, loaded)
+	return nil
+}
+
+// Overridden returns the names of the templates loaded by Load, sorted.
+func Overridden() []string {
+	return slices.Sorted(maps.Keys(overrides))
+}
+
+// Text returns the template called name: the override loaded by Load, or
+// builtin.
+func Text(name, builtin string) string {
+	if t, ok := overrides[name]; ok {
+		return t
+	}
+	return builtin
+}
+
+// Render executes the template called name, or builtin when it is not
+// overridden, with data.
+func Render(name, builtin string, data any) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(Text(name, builtin))
+	if err != nil {
+		return "", fmt.Errorf("template %s: %w", name, err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("template %s: %w", name, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,64 @@
+package templates
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderBuiltin(t *testing.T) {
+	got, err := Render(Repositories, "{{.Branch}}/main\n{{range .Extra}}{{.}}\n{{end}}", struct {
+		Branch string
+		Extra  []string
+	}{"https://mirror/v3.20", []string{"https://extra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://mirror/v3.20/main\nhttps://extra\n"; got != want {
+		t.Errorf("Render = %q, want %q", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Cleanup(func() { overrides = map[string]string{} })
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, Init), []byte("#!/bin/sh\nexec /sbin/init\n"), 0644)
+	os.WriteFile(filepath.Join(dir, Isolinux), []byte("DEFAULT {{(index .Entries 0).Name}}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, ".README.swp"), []byte("ignored"), 0644)
+	if err := Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := Overridden(); !reflect.DeepEqual(got, []string{Init, Isolinux}) {
+		t.Errorf("Overridden = %q", got)
+	}
+	if got := Text(Init, "builtin"); got != "#!/bin/sh\nexec /sbin/init\n" {
+		t.Errorf("Text(init) = %q", got)
+	}
+	if got := Text(Grub, "builtin"); got != "builtin" {
+		t.Errorf("Text(grub.cfg) = %q, want the built-in", got)
+	}
+	got, err := Render(Isolinux, "builtin", struct{ Entries []struct{ Name string } }{[]struct{ Name string }{{"linux"}}})
+	if err != nil || got != "DEFAULT linux\n" {
+		t.Errorf("Render(isolinux.cfg) = %q, %v", got, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Cleanup(func() { overrides = map[string]string{} })
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "inittab"), []byte("x"), 0644)
+	if err := Load(dir); err == nil || !strings.Contains(err.Error(), `unknown template "inittab"`) {
+		t.Errorf("expected unknown template error, got: %v", err)
+	}
+
+	dir = t.TempDir()
+	os.WriteFile(filepath.Join(dir, Grub), []byte("set default={{.Default"), 0644)
+	if err := Load(dir); err == nil || !strings.Contains(err.Error(), "grub.cfg") {
+		t.Errorf("expected parse error, got: %v", err)
+	}
+	if len(Overridden()) != 0 {
+		t.Errorf("a failed Load overrode %q", Overridden())
+	}
+}
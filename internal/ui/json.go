@@ -0,0 +1,129 @@
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// jsonOut receives newline-delimited JSON events instead of styled text when
+// JSON output is enabled. nil means text output.
+var jsonOut io.Writer
+
+// current is the step announced by the last StepHeader, closed by the next
+// StepHeader, the summary, or an error. It is tracked in every output format
+// so the observer sees step timings too.
+var current struct {
+	step, total int
+	name        string
+	start       time.Time
+	open        bool
+}
+
+// Event is one JSON output record. Only the fields relevant to the event
+// type are set.
+type Event struct {
+	Time      string            `json:"time"`
+	Event     string            `json:"event"` // step_start, step_end, log, info, error, build_end
+	Step      int               `json:"step,omitempty"`
+	Total     int               `json:"total,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Status    string            `json:"status,omitempty"` // ok, failed
+	Duration  float64           `json:"duration_seconds,omitempty"`
+	Level     string            `json:"level,omitempty"` // info, detail, success, warn
+	Message   string            `json:"message,omitempty"`
+	Label     string            `json:"label,omitempty"`
+	Value     string            `json:"value,omitempty"`
+	Path      string            `json:"path,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+
+	// Degradations are the optional features the build skipped
+	// (build_end).
+	Degradations []Degradation `json:"degradations,omitempty"`
+}
+
+// SetLogFormat selects "text" (default) or "json" output. In JSON mode every
+// message becomes an event on stdout, and os.Stdout is pointed at stderr so
+// external tools that write to it cannot corrupt the event stream.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		return nil
+	case "json":
+		jsonOut = os.Stdout
+		os.Stdout = os.Stderr
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q: must be \"text\" or \"json\"", format)
+	}
+}
+
+// emit writes e as one JSON line.
+func emit(e Event) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	data, _ := json.Marshal(e)
+	jsonOut.Write(append(data, '\n'))
+}
+
+// Observer is notified of build progress whatever the output format.
+type Observer interface {
+	StepEnd(name, status string, elapsed time.Duration)
+	BuildEnd(status string, artifacts map[string]string)
+}
+
+// observer receives step and build results; nil disables it.
+var observer Observer
+
+// SetObserver registers o to be notified when steps and the build end,
+// including when Error aborts the build.
+func SetObserver(o Observer) {
+	observer = o
+}
+
+// startStep opens a step, closing the previous one.
+func startStep(step, total int, name string) {
+	endStep("ok", nil)
+	current.step, current.total, current.name = step, total, name
+	current.start, current.open = time.Now(), true
+}
+
+// endStep closes the current step, if any, with the given status.
+func endStep(status string, err error) {
+	if !current.open {
+		return
+	}
+	current.open = false
+	if observer != nil {
+		observer.StepEnd(current.name, status, time.Since(current.start))
+	}
+	if jsonOut == nil {
+		return
+	}
+	e := Event{
+		Event:    "step_end",
+		Step:     current.step,
+		Total:    current.total,
+		Name:     current.name,
+		Status:   status,
+		Duration: time.Since(current.start).Seconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	emit(e)
+}
+
+// endBuild notifies the observer that the build ended.
+func endBuild(status string, artifacts map[string]string) {
+	if observer != nil {
+		observer.BuildEnd(status, artifacts)
+	}
+}
+
+// logEvent emits a free-form message at the given level.
+func logEvent(level, msg string) {
+	emit(Event{Event: "log", Step: current.step, Level: level, Message: msg})
+}
@@ -0,0 +1,86 @@
+package ui
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONEvents(t *testing.T) {
+	var buf bytes.Buffer
+	jsonOut = &buf
+	defer func() { jsonOut = nil }()
+
+	StepHeader(1, 2, "Parsing configuration...")
+	Info("Config", "demo")
+	StepHeader(2, 2, "Building ISO...")
+	Degrade("isohybrid", "isohdpfx.bin not found")
+	Degrade("isohybrid", "isohdpfx.bin not found")
+	defer func() { degradations = nil }()
+	PrintSummary("/out/demo.iso", "", "", 3*time.Second)
+
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Event)
+	}
+	want := "step_start info step_end step_start log step_end build_end"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Fatalf("events = %s, want %s", got, want)
+	}
+	if e := events[2]; e.Step != 1 || e.Status != "ok" {
+		t.Errorf("unexpected step_end: %+v", e)
+	}
+	if e := events[4]; e.Level != "warn" || e.Message != "isohybrid skipped: isohdpfx.bin not found" {
+		t.Errorf("unexpected warning: %+v", e)
+	}
+	if e := events[6]; e.Artifacts["output"] != "/out/demo.iso" || e.Duration != 3 || len(e.Degradations) != 1 || e.Degradations[0].Feature != "isohybrid" {
+		t.Errorf("unexpected build_end: %+v", e)
+	}
+}
+
+func TestSetLogFormat_Unknown(t *testing.T) {
+	if err := SetLogFormat("xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+type recorder struct {
+	steps  []string
+	status string
+}
+
+func (r *recorder) StepEnd(name, status string, _ time.Duration) {
+	r.steps = append(r.steps, name+":"+status)
+}
+
+func (r *recorder) BuildEnd(status string, _ map[string]string) {
+	r.status = status
+}
+
+func TestObserver(t *testing.T) {
+	var r recorder
+	SetObserver(&r)
+	defer SetObserver(nil)
+
+	StepHeader(1, 2, "Parsing configuration...")
+	StepHeader(2, 2, "Building ISO...")
+	PrintSummary("/out/demo.iso", "", "", time.Second)
+
+	if got := strings.Join(r.steps, " "); got != "Parsing configuration...:ok Building ISO...:ok" {
+		t.Errorf("steps = %s", got)
+	}
+	if r.status != "ok" {
+		t.Errorf("build status = %q, want ok", r.status)
+	}
+}
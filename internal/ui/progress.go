@@ -0,0 +1,133 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+)
+
+// redrawInterval is how often a Transfer redraws its line on a terminal.
+const redrawInterval = 100 * time.Millisecond
+
+// Transfer shows the progress of a download or of a long operation that
+// reports a percentage. On a terminal it redraws a bar with the size, the
+// rate and the time left; otherwise, as in CI logs, it prints a line at
+// every quarter; JSON output only reports the end. Its Write counts the
+// bytes written, so a download can be copied through it with io.TeeReader.
+type Transfer struct {
+	total, done int64 // bytes, or percent for NewPercentage
+	percent     bool
+	tty         bool
+	start       time.Time
+	drawn       time.Time
+	quarters    int64 // quarters logged without a terminal
+}
+
+// NewTransfer returns a Transfer of total bytes; a total of 0 or less, as
+// for a response without Content-Length, shows the bytes and rate only.
+func NewTransfer(total int64) *Transfer {
+	return &Transfer{total: total, tty: term.IsTerminal(os.Stdout.Fd()), start: time.Now()}
+}
+
+// NewPercentage returns a Transfer counting from 0 to 100 percent.
+func NewPercentage() *Transfer {
+	t := NewTransfer(100)
+	t.percent = true
+	return t
+}
+
+// Write counts len(p) bytes done.
+func (t *Transfer) Write(p []byte) (int, error) {
+	t.Set(t.done + int64(len(p)))
+	return len(p), nil
+}
+
+// Set reports the bytes, or the percent, done so far.
+func (t *Transfer) Set(done int64) {
+	t.done = done
+	if jsonOut != nil {
+		return
+	}
+	if t.tty {
+		if time.Since(t.drawn) >= redrawInterval {
+			t.draw()
+		}
+		return
+	}
+	if t.total <= 0 {
+		return
+	}
+	if q := min(t.done*4/t.total, 3); q > t.quarters {
+		t.quarters = q
+		Detail(strings.TrimSpace(t.status(t.done)))
+	}
+}
+
+// Done ends the progress line with the time taken.
+func (t *Transfer) Done() {
+	if t.total > 0 {
+		t.done = t.total
+	}
+	elapsed := time.Since(t.start).Round(100 * time.Millisecond)
+	switch {
+	case jsonOut != nil && !t.percent:
+		logEvent("detail", fmt.Sprintf("%.1f MB in %s", float64(t.done)/1024/1024, elapsed))
+	case jsonOut != nil:
+	case t.tty:
+		t.draw()
+		fmt.Println()
+	case t.percent:
+		Detail(fmt.Sprintf("100%% in %s", elapsed))
+	default:
+		Detail(fmt.Sprintf("%.1f MB in %s", float64(t.done)/1024/1024, elapsed))
+	}
+}
+
+// draw redraws the progress line.
+func (t *Transfer) draw() {
+	t.drawn = time.Now()
+	line := "\r    "
+	if t.total > 0 {
+		line += progressBar(t.done, t.total) + " "
+	}
+	fmt.Print(line + DimTextStyle.Render(t.status(t.done)) + "\033[K")
+}
+
+// status describes done: the percent, the size and rate of a download, and
+// the time left.
+func (t *Transfer) status(done int64) string {
+	elapsed := time.Since(t.start)
+	var s string
+	if t.total > 0 {
+		s = fmt.Sprintf("%3d%%", min(done*100/t.total, 100))
+	}
+	if !t.percent {
+		if t.total > 0 {
+			s += fmt.Sprintf("  %.1f / %.1f MB", float64(done)/1024/1024, float64(t.total)/1024/1024)
+		} else {
+			s += fmt.Sprintf("%.1f MB", float64(done)/1024/1024)
+		}
+		if secs := elapsed.Seconds(); secs >= 1 {
+			s += fmt.Sprintf("  %.1f MB/s", float64(done)/1024/1024/secs)
+		}
+	}
+	if t.total > 0 && done > 0 && done < t.total && elapsed >= time.Second {
+		if left := time.Duration(float64(elapsed) * float64(t.total-done) / float64(done)); left >= time.Second {
+			s += "  ETA " + left.Round(time.Second).String()
+		}
+	}
+	return s
+}
+
+// progressBar renders done of total as a bar of 30 cells.
+func progressBar(done, total int64) string {
+	const width = 30
+	filled := 0
+	if total > 0 {
+		filled = int(min(done, total) * width / total)
+	}
+	return SizeStyle.Render(strings.Repeat("█", filled)) + DimTextStyle.Render(strings.Repeat("░", width-filled))
+}
@@ -102,6 +102,9 @@ const banner = `
 
 // PrintBanner prints the DistroRun ASCII art banner with version.
 func PrintBanner(version string) {
+	if jsonOut != nil {
+		return
+	}
 	fmt.Println(BannerStyle.Render(banner))
 	fmt.Println(VersionStyle.Render(fmt.Sprintf("  Custom Linux OS Builder — v%s", version)))
 	fmt.Println()
@@ -111,6 +114,11 @@ func PrintBanner(version string) {
 
 // StepHeader prints a styled step header like: [3/9] Installing packages...
 func StepHeader(step, total int, msg string) {
+	startStep(step, total, msg)
+	if jsonOut != nil {
+		emit(Event{Event: "step_start", Step: step, Total: total, Name: msg})
+		return
+	}
 	badge := StepBadgeStyle.Render(fmt.Sprintf(" %d/%d ", step, total))
 	text := StepTextStyle.Render(msg)
 	fmt.Printf("\n%s %s\n", badge, text)
@@ -120,18 +128,46 @@ func StepHeader(step, total int, msg string) {
 
 // Success prints a green checkmark with message.
 func Success(msg string) {
+	if jsonOut != nil {
+		logEvent("success", msg)
+		return
+	}
 	fmt.Println("  " + SuccessStyle.Render("✓") + " " + msg)
 }
 
-// Error prints a styled error and exits.
+// atExit holds the functions Error runs before exiting.
+var atExit []func()
+
+// AtExit registers fn to run when Error exits the process, which skips
+// deferred calls. Functions run most recently registered first.
+func AtExit(fn func()) {
+	atExit = append(atExit, fn)
+}
+
+// Error prints a styled error, runs the AtExit functions and exits.
 func Error(msg string, err error) {
-	errBadge := ErrorStyle.Render(" ERROR ")
-	fmt.Fprintf(os.Stderr, "\n%s %s: %v\n\n", errBadge, msg, err)
+	endStep("failed", err)
+	endBuild("failed", nil)
+	if jsonOut != nil {
+		emit(Event{Event: "error", Step: current.step, Message: msg, Error: fmt.Sprint(err)})
+	} else {
+		errBadge := ErrorStyle.Render(" ERROR ")
+		fmt.Fprintf(os.Stderr, "\n%s %s: %v\n\n", errBadge, msg, err)
+	}
+	fns := atExit
+	atExit = nil
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
 	os.Exit(1)
 }
 
 // Warn prints a yellow warning.
 func Warn(msg string) {
+	if jsonOut != nil {
+		logEvent("warn", msg)
+		return
+	}
 	fmt.Println("  " + WarnStyle.Render("⚠") + " " + msg)
 }
 
@@ -139,11 +175,19 @@ func Warn(msg string) {
 
 // Info prints a labeled value like:  Config: my-alpine-server
 func Info(label, value string) {
+	if jsonOut != nil {
+		emit(Event{Event: "info", Step: current.step, Label: label, Value: value})
+		return
+	}
 	fmt.Printf("  %s %s\n", LabelStyle.Render(label+":"), ValueStyle.Render(value))
 }
 
 // InfoPath prints a path value.
 func InfoPath(label, path string) {
+	if jsonOut != nil {
+		emit(Event{Event: "info", Step: current.step, Label: label, Path: path})
+		return
+	}
 	fmt.Printf("  %s %s\n", LabelStyle.Render(label+":"), PathStyle.Render(path))
 }
 
@@ -178,21 +222,37 @@ var (
 
 // SubStep prints a styled sub-step line: ▸ Downloading minirootfs...
 func SubStep(msg string) {
+	if jsonOut != nil {
+		logEvent("info", msg)
+		return
+	}
 	fmt.Printf("  %s %s\n", ArrowStyle.Render("▸"), SubStepStyle.Render(msg))
 }
 
 // Detail prints a dimmed detail line.
 func Detail(msg string) {
+	if jsonOut != nil {
+		logEvent("detail", msg)
+		return
+	}
 	fmt.Printf("    %s\n", DimTextStyle.Render(msg))
 }
 
 // URL prints a styled URL.
 func URL(url string) {
+	if jsonOut != nil {
+		logEvent("detail", url)
+		return
+	}
 	fmt.Printf("    %s\n", UrlStyle.Render(url))
 }
 
 // PackageItem prints a styled package with index like: (3/28) nginx 1.26.3-r0
 func PackageItem(index, total int, name, version string) {
+	if jsonOut != nil {
+		logEvent("detail", fmt.Sprintf("(%d/%d) %s %s", index, total, name, version))
+		return
+	}
 	counter := DimTextStyle.Render(fmt.Sprintf("(%d/%d)", index, total))
 	pkg := PkgNameStyle.Render(name)
 	ver := PkgVersionStyle.Render(version)
@@ -201,14 +261,43 @@ func PackageItem(index, total int, name, version string) {
 
 // SizeInfo prints a size with label like: Squashfs size: 179.6 MB
 func SizeInfo(label string, sizeMB float64) {
+	if jsonOut != nil {
+		emit(Event{Event: "info", Step: current.step, Label: label, Value: fmt.Sprintf("%.1f MB", sizeMB)})
+		return
+	}
 	fmt.Printf("  %s %s %s\n",
 		ArrowStyle.Render("▸"),
 		LabelStyle.Render(label+":"),
 		SizeStyle.Render(fmt.Sprintf("%.1f MB", sizeMB)))
 }
 
+// Progress redraws a progress line like: [████░░░░] 45%  123.4 / 274.2 MB,
+// ending the line once done reaches total. JSON output only reports the end.
+func Progress(done, total int64) {
+	if jsonOut != nil {
+		if done >= total {
+			logEvent("detail", fmt.Sprintf("%.1f MB", float64(total)/1024/1024))
+		}
+		return
+	}
+	bar := progressBar(done, total)
+	pct := 100
+	if total > 0 {
+		pct = int(done * 100 / total)
+	}
+	fmt.Printf("\r    %s %3d%%  %s", bar, pct,
+		DimTextStyle.Render(fmt.Sprintf("%.1f / %.1f MB", float64(done)/1024/1024, float64(total)/1024/1024)))
+	if done >= total {
+		fmt.Println()
+	}
+}
+
 // UserItem prints a styled user line.
 func UserItem(name, role string) {
+	if jsonOut != nil {
+		logEvent("detail", fmt.Sprintf("%s (%s)", name, role))
+		return
+	}
 	user := PkgNameStyle.Render(name)
 	r := PkgVersionStyle.Render("(" + role + ")")
 	fmt.Printf("    %s %s %s\n", DimTextStyle.Render("•"), user, r)
@@ -216,14 +305,67 @@ func UserItem(name, role string) {
 
 // ServiceItem prints a styled service line.
 func ServiceItem(name string) {
+	if jsonOut != nil {
+		logEvent("detail", name)
+		return
+	}
 	svc := PkgNameStyle.Render(name)
 	fmt.Printf("    %s %s → %s\n", DimTextStyle.Render("•"), svc, DimTextStyle.Render("default runlevel"))
 }
 
 // ── Build Summary ────────────────────────────────────────────────────────────
 
+// extraArtifacts are listed by PrintSummary after the output and SBOM.
+var extraArtifacts []struct{ kind, label, path string }
+
+// AddArtifact adds a file to the build summary and the build_end event
+// under kind, e.g. "audit". label is shown in the text summary.
+func AddArtifact(kind, label, path string) {
+	extraArtifacts = append(extraArtifacts, struct{ kind, label, path string }{kind, label, path})
+}
+
+// Degradation is an optional feature a build went without, because the
+// host lacks what it needs.
+type Degradation struct {
+	Feature string `json:"feature"` // e.g. "isohybrid"
+	Reason  string `json:"reason"`  // what is missing and what the image lacks as a result
+}
+
+// degradations are the features Degrade was called for, in order.
+var degradations []Degradation
+
+// Degrade warns that feature was skipped and why, and records it for
+// Degradations and the build summary. A feature is recorded once.
+func Degrade(feature, reason string) {
+	for _, d := range degradations {
+		if d.Feature == feature {
+			return
+		}
+	}
+	degradations = append(degradations, Degradation{Feature: feature, Reason: reason})
+	Warn(feature + " skipped: " + reason)
+}
+
+// Degradations returns the features skipped so far.
+func Degradations() []Degradation {
+	return degradations
+}
+
 // PrintSummary prints the final build summary in a styled box.
 func PrintSummary(isoPath, sbomPath, qemuCmd string, elapsed time.Duration) {
+	endStep("ok", nil)
+	artifacts := map[string]string{"output": isoPath}
+	if sbomPath != "" {
+		artifacts["sbom"] = sbomPath
+	}
+	for _, a := range extraArtifacts {
+		artifacts[a.kind] = a.path
+	}
+	endBuild("ok", artifacts)
+	if jsonOut != nil {
+		emit(Event{Event: "build_end", Status: "ok", Duration: elapsed.Seconds(), Artifacts: artifacts, Degradations: degradations})
+		return
+	}
 	var lines []string
 
 	// Round to nearest second
@@ -243,6 +385,16 @@ func PrintSummary(isoPath, sbomPath, qemuCmd string, elapsed time.Duration) {
 	if sbomPath != "" {
 		lines = append(lines, LabelStyle.Render("SBOM ")+"  "+PathStyle.Render(sbomPath))
 	}
+	for _, a := range extraArtifacts {
+		lines = append(lines, LabelStyle.Render(fmt.Sprintf("%-5s", a.label))+"  "+PathStyle.Render(a.path))
+	}
+	if len(degradations) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, WarnStyle.Render(fmt.Sprintf("Degraded (%d):", len(degradations))))
+		for _, d := range degradations {
+			lines = append(lines, "  "+WarnStyle.Render("⚠")+" "+d.Feature+": "+DimTextStyle.Render(d.Reason))
+		}
+	}
 	lines = append(lines, "")
 	lines = append(lines, LabelStyle.Render("Test:")+"  "+CommandStyle.Render(qemuCmd))
 
@@ -258,11 +410,27 @@ func PrintUsage(version string) {
 
 	fmt.Println(lipgloss.NewStyle().Bold(true).Foreground(White).Render("Usage:"))
 	fmt.Println()
-	fmt.Println("  " + CommandStyle.Render("distrorun build") + " " + ArgStyle.Render("<config.yaml>") + " " + ArgStyle.Render("[-o output.iso]"))
-	fmt.Println("  " + CommandStyle.Render("distrorun test") + "  " + ArgStyle.Render("<iso-file>") + " " + ArgStyle.Render("[-r RAM_MB] [-d DISK_SIZE]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun build") + " " + ArgStyle.Render("<config.yaml>") + " " + ArgStyle.Render("[-o output.iso] [-cache-dir DIR] [-no-cache] [-rebuild] [-mirror URL] [-offline] [-retries N] [-alpine-keyring FILE] [-bundle FILE] [-test] [-log-format json] [-metrics-file FILE] [-nice N] [-cpus LIST] [-memory SIZE] [-io idle|low] [-channel NAME] [-dry-run] [-locked] [-require-version=false] [-workdir DIR] [-templates DIR] [-strict]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun init") + "  " + ArgStyle.Render("[-interactive] [-o config.yaml] [-force]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun validate") + " " + ArgStyle.Render("<config.yaml>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun lint") + "  " + ArgStyle.Render("[-format text|json] [-disable RULE]... [-resolve] [-rules]") + " " + ArgStyle.Render("<config.yaml>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun migrate") + "  " + ArgStyle.Render("[-o FILE]") + " " + ArgStyle.Render("<config.yaml>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun publish") + " " + ArgStyle.Render("<github|gitlab>") + " " + ArgStyle.Render("-tag TAG <artifact>..."))
+	fmt.Println("  " + CommandStyle.Render("distrorun promote") + " " + ArgStyle.Render("-to CHANNEL") + " " + ArgStyle.Render("<config.yaml> <artifact>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun prune") + " " + ArgStyle.Render("[-keep-last N] [-max-age AGE] [-pin GLOB] [-cache] [dir...]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun bundle") + " " + ArgStyle.Render("<config.yaml>") + " " + ArgStyle.Render("[-o bundle.tar.gz] [-mirror URL]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun lock") + "  " + ArgStyle.Render("<config.yaml>") + " " + ArgStyle.Render("[-o config.lock] [-mirror URL] [-templates DIR]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun add-on install") + " " + ArgStyle.Render("[-registry URL] [-key FILE] [-dir DIR]") + " " + ArgStyle.Render("<name>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun test") + "  " + ArgStyle.Render("<iso-file>") + " " + ArgStyle.Render("[-r RAM_MB] [-d DISK_SIZE] [-persistent-disk SIZE] [-check]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun extract") + " " + ArgStyle.Render("<iso-file> [dest]"))
+	fmt.Println("  " + CommandStyle.Render("distrorun sbom") + "  " + ArgStyle.Render("[-o out.spdx.json] [-name NAME] [-files]") + " " + ArgStyle.Render("<iso-file|rootfs-dir>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun patch") + " " + ArgStyle.Render("-config delta.yaml [-o output.iso]") + " " + ArgStyle.Render("<iso-file>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun drift") + " " + ArgStyle.Render("-ssh HOST [-path DIR]...") + " " + ArgStyle.Render("<sbom.spdx.json>"))
+	fmt.Println("  " + CommandStyle.Render("distrorun flash") + " " + ArgStyle.Render("[-yes] [-force] [-no-verify] [-persist]") + " " + ArgStyle.Render("<iso-file> <device>") + " " + ArgStyle.Render("| -list"))
 	fmt.Println("  " + CommandStyle.Render("distrorun version"))
 	fmt.Println("  " + CommandStyle.Render("distrorun help"))
 	fmt.Println()
 	fmt.Println(LabelStyle.Render("  The build command must be run as root (uses chroot, mount)."))
+	fmt.Println(LabelStyle.Render("  The validate command checks a config without root and without building."))
 	fmt.Println()
 }
@@ -0,0 +1,223 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/talfaza/distrorun/internal/cpio"
+)
+
+// decompressors are the host tools used for initramfs compressions the
+// standard library cannot read, by magic number.
+var decompressors = []struct {
+	magic []byte
+	tool  string
+}{
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zstd"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "xz"},
+	{[]byte{0x02, 0x21, 0x4c, 0x18}, "lz4"},
+}
+
+// extractInitramfs unpacks an initramfs into the new directory dest. An
+// initramfs is a sequence of cpio archives, each plain or compressed, such
+// as an uncompressed microcode archive followed by the compressed main one.
+// It returns the number of entries skipped: device nodes and FIFOs.
+func extractInitramfs(initramfs, dest string) (int, error) {
+	f, err := os.Open(initramfs)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return 0, err
+	}
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+	x := &cpioExtractor{root: root, links: make(map[string]string)}
+	if err := x.stream(bufio.NewReader(f), 0); err != nil {
+		return x.skipped, fmt.Errorf("%s: %w", filepath.Base(initramfs), err)
+	}
+	return x.skipped, nil
+}
+
+// cpioExtractor writes the entries of newc cpio archives below root, which
+// keeps symlinks in the archive from redirecting writes out of it.
+type cpioExtractor struct {
+	root    *os.Root
+	links   map[string]string // "archive:inode" → first path, for hard links
+	archive int               // number of the archive being read
+	skipped int
+}
+
+// stream reads the archives in r until it ends. Compressed archives are
+// read through a decompressor, which may itself yield several archives.
+func (x *cpioExtractor) stream(r *bufio.Reader, depth int) error {
+	if depth > 4 {
+		return errors.New("compressed archives nested too deeply")
+	}
+	for {
+		// Archives are padded with zeros to a multiple of 4 or 512 bytes.
+		for {
+			b, err := r.Peek(1)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if b[0] != 0 {
+				break
+			}
+			r.Discard(1)
+		}
+		magic, _ := r.Peek(6)
+		switch {
+		case bytes.HasPrefix(magic, []byte("07070")):
+			x.archive++
+			if err := x.archiveEntries(r); err != nil {
+				return err
+			}
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return err
+			}
+			return x.stream(bufio.NewReader(gz), depth+1)
+		default:
+			for _, d := range decompressors {
+				if bytes.HasPrefix(magic, d.magic) {
+					return x.decompress(d.tool, r, depth)
+				}
+			}
+			return fmt.Errorf("unknown data at the end of the initramfs (magic %x)", magic)
+		}
+	}
+}
+
+// decompress pipes the rest of r through a host decompressor.
+func (x *cpioExtractor) decompress(tool string, r io.Reader, depth int) error {
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("the initramfs is %s-compressed and %s is not installed", tool, tool)
+	}
+	cmd := exec.Command(tool, "-dc")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	serr := x.stream(bufio.NewReader(out), depth+1)
+	io.Copy(io.Discard, out)
+	if err := cmd.Wait(); err != nil && serr == nil {
+		serr = fmt.Errorf("%s: %w", tool, err)
+	}
+	return serr
+}
+
+// archiveEntries reads one newc archive up to its trailer.
+func (x *cpioExtractor) archiveEntries(r *bufio.Reader) error {
+	cr := cpio.NewReader(r)
+	for {
+		h, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.entry(h.Name, h, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// entry writes one cpio entry.
+func (x *cpioExtractor) entry(name string, h *cpio.Header, data io.Reader) error {
+	name = filepath.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." {
+		return nil
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("cpio entry %q escapes the archive", name)
+	}
+	perm := os.FileMode(h.Mode & 0o777)
+	switch h.Type() {
+	case cpio.TypeDir:
+		if err := x.root.MkdirAll(name, 0755); err != nil {
+			return err
+		}
+		return x.root.Chmod(name, perm|0700)
+	case cpio.TypeSymlink:
+		target, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		if err := x.parent(name); err != nil {
+			return err
+		}
+		x.root.Remove(name) // later archives override earlier ones
+		return x.root.Symlink(string(target), name)
+	case cpio.TypeRegular:
+		if err := x.parent(name); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%d:%d", x.archive, h.Ino)
+		if first, ok := x.links[key]; ok && h.Nlink > 1 {
+			// newc stores the data of hard-linked files with the last name.
+			if h.Size > 0 {
+				if err := x.writeFile(first, data, perm); err != nil {
+					return err
+				}
+			}
+			x.root.Remove(name)
+			return x.root.Link(first, name)
+		}
+		if h.Nlink > 1 {
+			x.links[key] = name
+		}
+		return x.writeFile(name, data, perm)
+	default: // device nodes, FIFOs and sockets
+		x.skipped++
+		return nil
+	}
+}
+
+// parent creates the directory holding name.
+func (x *cpioExtractor) parent(name string) error {
+	if dir := filepath.Dir(name); dir != "." {
+		return x.root.MkdirAll(dir, 0755)
+	}
+	return nil
+}
+
+// writeFile replaces name with the contents of data.
+func (x *cpioExtractor) writeFile(name string, data io.Reader, perm os.FileMode) error {
+	if fi, err := x.root.Lstat(name); err == nil && !fi.Mode().IsRegular() {
+		if err := x.root.Remove(name); err != nil {
+			return err
+		}
+	}
+	out, err := x.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, data)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,419 @@
+package unpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const sectorSize = 2048
+
+// maxDirSize bounds the directories read into memory; real ones take a few
+// sectors.
+const maxDirSize = 16 << 20
+
+// isoImage reads the directory tree of an ISO9660 image. Rock Ridge names,
+// modes and symlinks are used when the image has them, as every image
+// xorriso writes does.
+type isoImage struct {
+	r        io.ReaderAt
+	rr       bool // Rock Ridge entries are present
+	suspSkip int  // bytes before the SUSP entries of each record (SP entry)
+}
+
+// extent is a contiguous run of a file's data. Files of 4 GiB or more are
+// stored as several extents.
+type extent struct {
+	lba  uint32
+	size uint32
+}
+
+// isoEntry is one directory record, with its Rock Ridge attributes.
+type isoEntry struct {
+	name     string
+	dir      bool
+	mode     fs.FileMode // permission bits; 0 without Rock Ridge
+	link     string      // symlink target
+	extents  []extent
+	moved    bool // a relocated directory (RE), listed where CL points at it
+	childLBA int64
+}
+
+// openISO reads the primary volume descriptor and detects Rock Ridge.
+func openISO(r io.ReaderAt) (*isoImage, *isoEntry, error) {
+	img := &isoImage{r: r}
+	for sector := int64(16); ; sector++ {
+		vd := make([]byte, sectorSize)
+		if _, err := r.ReadAt(vd, sector*sectorSize); err != nil {
+			return nil, nil, fmt.Errorf("reading volume descriptors: %w", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, nil, errors.New("not an ISO9660 image")
+		}
+		switch vd[0] {
+		case 1: // primary volume descriptor
+			root, err := img.parseRecord(vd[156 : 156+34])
+			if err != nil {
+				return nil, nil, err
+			}
+			root.dir = true
+			if err := img.detectRockRidge(root); err != nil {
+				return nil, nil, err
+			}
+			return img, root, nil
+		case 255:
+			return nil, nil, errors.New("ISO has no primary volume descriptor")
+		}
+	}
+}
+
+// detectRockRidge looks for the SP entry in the "." record of the root.
+func (img *isoImage) detectRockRidge(root *isoEntry) error {
+	sector := make([]byte, sectorSize)
+	if _, err := img.r.ReadAt(sector, int64(root.extents[0].lba)*sectorSize); err != nil {
+		return fmt.Errorf("reading root directory: %w", err)
+	}
+	n := int(sector[0])
+	if n < 34 || n > len(sector) {
+		return errors.New("malformed root directory")
+	}
+	su := systemUse(sector[:n])
+	if len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF {
+		img.rr = true
+		img.suspSkip = int(su[6])
+	}
+	return nil
+}
+
+// systemUse returns the system use area of a directory record.
+func systemUse(rec []byte) []byte {
+	start := 33 + int(rec[32])
+	if start%2 == 1 {
+		start++
+	}
+	if start > len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// parseRecord decodes a directory record and its Rock Ridge entries.
+func (img *isoImage) parseRecord(rec []byte) (*isoEntry, error) {
+	if len(rec) < 34 || int(rec[0]) > len(rec) || 33+int(rec[32]) > int(rec[0]) {
+		return nil, errors.New("malformed directory record")
+	}
+	rec = rec[:rec[0]]
+	e := &isoEntry{
+		dir:     rec[25]&0x02 != 0,
+		extents: []extent{{binary.LittleEndian.Uint32(rec[2:]), binary.LittleEndian.Uint32(rec[10:])}},
+	}
+	id := string(rec[33 : 33+int(rec[32])])
+	switch id {
+	case "\x00":
+		e.name = "."
+	case "\x01":
+		e.name = ".."
+	default:
+		// Plain ISO9660 names are upper case with a ";1" version.
+		id, _, _ = strings.Cut(id, ";")
+		e.name = strings.ToLower(strings.TrimSuffix(id, "."))
+	}
+	if img.rr {
+		su := systemUse(rec)
+		if img.suspSkip <= len(su) {
+			if err := img.parseSUSP(e, su[img.suspSkip:], 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseSUSP applies the Rock Ridge entries in area to e, following
+// continuation areas (CE) up to a fixed depth.
+func (img *isoImage) parseSUSP(e *isoEntry, area []byte, depth int) error {
+	var name strings.Builder
+	var rrName bool
+	for len(area) >= 4 {
+		sig, n := string(area[0:2]), int(area[2])
+		if n < 4 || n > len(area) {
+			break
+		}
+		data := area[4:n]
+		switch sig {
+		case "NM":
+			if len(data) >= 1 && data[0]&0x06 == 0 {
+				name.Write(data[1:])
+				rrName = true
+			}
+		case "PX":
+			if len(data) >= 4 {
+				e.mode = fs.FileMode(binary.LittleEndian.Uint32(data) & 0o7777)
+			}
+		case "SL":
+			if len(data) >= 1 {
+				e.link += symlinkTarget(data[1:], e.link != "")
+			}
+		case "CL":
+			if len(data) >= 4 {
+				e.childLBA = int64(binary.LittleEndian.Uint32(data))
+			}
+		case "RE":
+			e.moved = true
+		case "CE":
+			if len(data) >= 24 && depth < 8 {
+				lba := int64(binary.LittleEndian.Uint32(data[0:]))
+				off := int64(binary.LittleEndian.Uint32(data[8:]))
+				size := binary.LittleEndian.Uint32(data[16:])
+				if size > sectorSize {
+					return errors.New("malformed Rock Ridge continuation area")
+				}
+				cont := make([]byte, size)
+				if _, err := img.r.ReadAt(cont, lba*sectorSize+off); err != nil {
+					return fmt.Errorf("reading Rock Ridge continuation area: %w", err)
+				}
+				if err := img.parseSUSP(e, cont, depth+1); err != nil {
+					return err
+				}
+			}
+		case "ST":
+			area = nil
+			continue
+		}
+		area = area[n:]
+	}
+	if rrName {
+		e.name = name.String()
+	}
+	return nil
+}
+
+// symlinkTarget decodes the component records of an SL entry. more is set
+// when the target continues an earlier SL entry.
+func symlinkTarget(comps []byte, more bool) string {
+	var b strings.Builder
+	sep := more
+	for len(comps) >= 2 {
+		flags, n := comps[0], int(comps[1])
+		if 2+n > len(comps) {
+			break
+		}
+		if sep {
+			b.WriteByte('/')
+		}
+		switch {
+		case flags&0x02 != 0:
+			b.WriteString(".")
+		case flags&0x04 != 0:
+			b.WriteString("..")
+		case flags&0x08 != 0:
+			// The root: the separator written before the next component
+			// makes the path absolute.
+		default:
+			b.Write(comps[2 : 2+n])
+		}
+		sep = flags&0x01 == 0
+		comps = comps[2+n:]
+	}
+	return b.String()
+}
+
+// readDir returns the entries of a directory, without "." and "..", with
+// relocated directories in place of their child links.
+func (img *isoImage) readDir(dir *isoEntry) ([]*isoEntry, error) {
+	if dir.childLBA != 0 {
+		// A child link points at the relocated directory; its "." record
+		// has the size.
+		self, err := img.readSelf(dir.childLBA)
+		if err != nil {
+			return nil, err
+		}
+		dir = self
+	}
+	x := dir.extents[0]
+	if x.size > maxDirSize {
+		return nil, errors.New("malformed directory: too large")
+	}
+	data := make([]byte, x.size)
+	if _, err := img.r.ReadAt(data, int64(x.lba)*sectorSize); err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	var entries []*isoEntry
+	var last *isoEntry
+	for off := 0; off < len(data); {
+		n := int(data[off])
+		if n == 0 {
+			// Records do not cross sectors; the rest of this one is padding.
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		if off+n > len(data) {
+			return nil, errors.New("malformed directory record")
+		}
+		e, err := img.parseRecord(data[off : off+n])
+		if err != nil {
+			return nil, err
+		}
+		off += n
+		if e.name == "." || e.name == ".." || e.moved {
+			continue
+		}
+		// Files of 4 GiB or more continue in records with the same name.
+		if last != nil && last.name == e.name && !e.dir && !last.dir && last.link == "" {
+			last.extents = append(last.extents, e.extents...)
+			continue
+		}
+		if e.childLBA != 0 {
+			e.dir = true
+		}
+		entries = append(entries, e)
+		last = e
+	}
+	return entries, nil
+}
+
+// readSelf returns the "." record of the directory at lba.
+func (img *isoImage) readSelf(lba int64) (*isoEntry, error) {
+	sector := make([]byte, sectorSize)
+	if _, err := img.r.ReadAt(sector, lba*sectorSize); err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+	e, err := img.parseRecord(sector)
+	if err != nil {
+		return nil, err
+	}
+	e.dir = true
+	return e, nil
+}
+
+// extractISO copies the tree of the ISO at isoPath into the new directory dest.
+func extractISO(isoPath, dest string) error {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, root, err := openISO(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", isoPath, err)
+	}
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return err
+	}
+	return img.extractDir(root, dest, 0)
+}
+
+// CopyISOFile copies the file name from the root directory of the ISO at
+// isoPath to w, without extracting anything else.
+func CopyISOFile(isoPath, name string, w io.Writer) error {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, root, err := openISO(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", isoPath, err)
+	}
+	entries, err := img.readDir(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.name != name || e.dir || e.link != "" {
+			continue
+		}
+		for _, x := range e.extents {
+			if _, err := io.Copy(w, io.NewSectionReader(img.r, int64(x.lba)*sectorSize, int64(x.size))); err != nil {
+				return fmt.Errorf("reading %s from %s: %w", name, isoPath, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s has no %s: %w", isoPath, name, fs.ErrNotExist)
+}
+
+// maxDepth bounds directory nesting, so a looping image cannot recurse
+// forever.
+const maxDepth = 64
+
+// extractDir writes the entries of dir below target, which exists.
+func (img *isoImage) extractDir(dir *isoEntry, target string, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%s: directories nested too deeply", target)
+	}
+	entries, err := img.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !isPlainName(e.name) {
+			return fmt.Errorf("ISO entry %q in %s is not a plain file name", e.name, target)
+		}
+		p := filepath.Join(target, e.name)
+		switch {
+		case e.link != "":
+			if err := os.Symlink(e.link, p); err != nil {
+				return err
+			}
+		case e.dir:
+			if err := os.Mkdir(p, 0755); err != nil {
+				return err
+			}
+			if err := img.extractDir(e, p, depth+1); err != nil {
+				return err
+			}
+			// Applied once the children exist; the owner keeps write
+			// access so the tree can be removed again.
+			if err := os.Chmod(p, modeOr(e.mode, 0755)|0700); err != nil {
+				return err
+			}
+		default:
+			if err := img.extractFile(e, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractFile writes the data of e to the new file p.
+func (img *isoImage) extractFile(e *isoEntry, p string) error {
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, modeOr(e.mode, 0644))
+	if err != nil {
+		return err
+	}
+	for _, x := range e.extents {
+		_, err = io.Copy(out, io.NewSectionReader(img.r, int64(x.lba)*sectorSize, int64(x.size)))
+		if err != nil {
+			break
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("extracting %s: %w", p, err)
+	}
+	return nil
+}
+
+// isPlainName reports whether name is a single path component.
+func isPlainName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsRune(name, '/') && path.Clean(name) == name
+}
+
+// modeOr returns the permission bits of mode, or def when there are none.
+func modeOr(mode, def fs.FileMode) fs.FileMode {
+	if mode.Perm() == 0 {
+		return def
+	}
+	return mode.Perm()
+}
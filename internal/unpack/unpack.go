@@ -0,0 +1,128 @@
+// Package unpack extracts built artifacts into plain directory trees for
+// inspection: the files of an ISO, the root filesystem in its squashfs and
+// the contents of its initramfs. ISO images and gzip-compressed initramfs
+// archives are read natively; squashfs images need unsquashfs, and other
+// initramfs compressions the matching host decompressor.
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Layout of an extracted ISO below the destination directory.
+const (
+	ISODir       = "iso"       // the files of the ISO
+	RootfsDir    = "rootfs"    // the unpacked squashfs
+	InitramfsDir = "initramfs" // one directory per initramfs, named after it
+)
+
+// Result lists what ISO extracted.
+type Result struct {
+	Squashfs  string   // squashfs image in the ISO, relative to its root; "" if none
+	Initramfs []string // initramfs images in the ISO, relative to its root
+
+	// Skipped counts the device nodes, FIFOs and sockets of the initramfs
+	// images, which are not recreated.
+	Skipped int
+
+	// Incomplete is set when unsquashfs could not create some files, such
+	// as device nodes when not run as root.
+	Incomplete bool
+}
+
+// ISO extracts the ISO at isoPath into dest, which must not exist or be
+// empty: its files into dest/iso, the root filesystem into dest/rootfs and
+// each initramfs into dest/initramfs/<name>.
+func ISO(isoPath, dest string) (*Result, error) {
+	if err := prepareDest(dest); err != nil {
+		return nil, err
+	}
+	isoDir := filepath.Join(dest, ISODir)
+	if err := Files(isoPath, isoDir); err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	err := filepath.WalkDir(isoDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(isoDir, p)
+		switch name := d.Name(); {
+		case strings.HasSuffix(name, ".squashfs") || name == "squashfs.img":
+			if res.Squashfs == "" {
+				res.Squashfs = rel
+			}
+		case strings.HasPrefix(name, "initramfs-") || strings.HasPrefix(name, "initrd"):
+			res.Initramfs = append(res.Initramfs, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Squashfs != "" {
+		if res.Incomplete, err = Squashfs(filepath.Join(isoDir, res.Squashfs), filepath.Join(dest, RootfsDir)); err != nil {
+			return nil, err
+		}
+	}
+	if len(res.Initramfs) > 0 {
+		if err := os.Mkdir(filepath.Join(dest, InitramfsDir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, rel := range res.Initramfs {
+		n, err := extractInitramfs(filepath.Join(isoDir, rel), filepath.Join(dest, InitramfsDir, filepath.Base(rel)))
+		res.Skipped += n
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Files extracts only the files of the ISO at isoPath, without unpacking
+// the images among them, into the new directory dest.
+func Files(isoPath, dest string) error {
+	return extractISO(isoPath, dest)
+}
+
+// prepareDest creates dest, or accepts it if it is an empty directory.
+func prepareDest(dest string) error {
+	entries, err := os.ReadDir(dest)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return os.MkdirAll(dest, 0755)
+	case err != nil:
+		return err
+	case len(entries) > 0:
+		return fmt.Errorf("%s is not empty", dest)
+	}
+	return nil
+}
+
+// Squashfs unpacks a squashfs image into the new directory dest with
+// unsquashfs. It reports whether some files could not be created, which
+// unsquashfs treats as non-fatal.
+func Squashfs(image, dest string) (incomplete bool, err error) {
+	if _, err := exec.LookPath("unsquashfs"); err != nil {
+		return false, fmt.Errorf("unsquashfs not found: it unpacks the root filesystem (install squashfs-tools)")
+	}
+	cmd := exec.Command("unsquashfs", "-no-progress", "-no-xattrs", "-d", dest, image)
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 2 {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unsquashfs: %w", err)
+	}
+	return false, nil
+}
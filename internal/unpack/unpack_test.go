@@ -0,0 +1,219 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newc returns a newc cpio archive of the given entries, with its trailer.
+func newc(entries ...cpioTestEntry) []byte {
+	var b bytes.Buffer
+	for i, e := range append(entries, cpioTestEntry{name: "TRAILER!!!"}) {
+		fmt.Fprintf(&b, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			i+1, e.mode, 0, 0, 1, 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0)
+		b.WriteString(e.name + "\x00")
+		b.Write(make([]byte, pad4(110+len(e.name)+1)))
+		b.WriteString(e.data)
+		b.Write(make([]byte, pad4(len(e.data))))
+	}
+	return b.Bytes()
+}
+
+type cpioTestEntry struct {
+	name string
+	mode uint32
+	data string
+}
+
+// initramfs returns an uncompressed microcode archive followed by a
+// gzip-compressed main archive, as dracut writes them.
+func initramfs(t *testing.T) []byte {
+	t.Helper()
+	early := newc(
+		cpioTestEntry{"kernel/x86/microcode/GenuineIntel.bin", 0o100644, "ucode"},
+	)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(newc(
+		cpioTestEntry{"bin", 0o40755, ""},
+		cpioTestEntry{"bin/busybox", 0o100755, "#!busybox"},
+		cpioTestEntry{"bin/sh", 0o120777, "busybox"},
+		cpioTestEntry{"dev/console", 0o20600, ""},
+		cpioTestEntry{"init", 0o100755, "#!/bin/sh\n"},
+	))
+	w.Close()
+	padded := append(early, make([]byte, 512-len(early)%512)...)
+	return append(padded, gz.Bytes()...)
+}
+
+// isoRecord returns a directory record with Rock Ridge entries su.
+func isoRecord(id string, lba, size uint32, dir bool, su []byte) []byte {
+	n := 33 + len(id)
+	if n%2 == 1 {
+		n++
+	}
+	n += len(su)
+	if n%2 == 1 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	binary.LittleEndian.PutUint32(r[2:], lba)
+	binary.BigEndian.PutUint32(r[6:], lba)
+	binary.LittleEndian.PutUint32(r[10:], size)
+	binary.BigEndian.PutUint32(r[14:], size)
+	if dir {
+		r[25] = 0x02
+	}
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	copy(r[33+len(id)+(33+len(id))%2:], su)
+	return r
+}
+
+func susp(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func nm(name string) []byte { return susp("NM", append([]byte{0}, name...)...) }
+
+func px(mode uint32) []byte {
+	d := make([]byte, 32)
+	binary.LittleEndian.PutUint32(d, mode)
+	return susp("PX", d...)
+}
+
+// sl returns an SL entry for a relative symlink target.
+func sl(components ...string) []byte {
+	data := []byte{0}
+	for _, c := range components {
+		data = append(append(data, 0, byte(len(c))), c...)
+	}
+	return susp("SL", data...)
+}
+
+// testISO builds a small Rock Ridge image: a README with a long name, a
+// boot directory with an initramfs, and a symlink to it.
+func testISO(t *testing.T, initrd []byte) []byte {
+	t.Helper()
+	const rootLBA, bootLBA, readmeLBA, initrdLBA = 18, 19, 20, 21
+	img := make([]byte, (initrdLBA+1)*sectorSize+len(initrd))
+
+	pvd := img[16*sectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], isoRecord("\x00", rootLBA, sectorSize, true, nil))
+	term := img[17*sectorSize:]
+	term[0] = 255
+	copy(term[1:], "CD001")
+
+	readme := "built by distrorun\n"
+	root := bytes.Join([][]byte{
+		isoRecord("\x00", rootLBA, sectorSize, true, susp("SP", 0xBE, 0xEF, 0)),
+		isoRecord("\x01", rootLBA, sectorSize, true, nil),
+		isoRecord("BOOT", bootLBA, sectorSize, true, append(nm("boot"), px(0o40755)...)),
+		isoRecord("LATEST.;1", 0, 0, false, append(nm("latest"), sl("boot", "initramfs-lts")...)),
+		isoRecord("README.TXT;1", readmeLBA, uint32(len(readme)), false, append(nm("Read me first.txt"), px(0o100600)...)),
+	}, nil)
+	copy(img[rootLBA*sectorSize:], root)
+	boot := bytes.Join([][]byte{
+		isoRecord("\x00", bootLBA, sectorSize, true, nil),
+		isoRecord("\x01", rootLBA, sectorSize, true, nil),
+		isoRecord("INITRAMF.;1", initrdLBA, uint32(len(initrd)), false, nm("initramfs-lts")),
+	}, nil)
+	copy(img[bootLBA*sectorSize:], boot)
+	copy(img[readmeLBA*sectorSize:], readme)
+	copy(img[initrdLBA*sectorSize:], initrd)
+	return img
+}
+
+func TestISO(t *testing.T) {
+	dir := t.TempDir()
+	isoPath := filepath.Join(dir, "os.iso")
+	if err := os.WriteFile(isoPath, testISO(t, initramfs(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "out")
+	res, err := ISO(isoPath, dest)
+	if err != nil {
+		t.Fatalf("ISO: %v", err)
+	}
+	if res.Squashfs != "" || len(res.Initramfs) != 1 || res.Initramfs[0] != "boot/initramfs-lts" || res.Skipped != 1 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	readme := filepath.Join(dest, ISODir, "Read me first.txt")
+	if data, err := os.ReadFile(readme); err != nil || string(data) != "built by distrorun\n" {
+		t.Errorf("Rock Ridge name not used: %q, %v", data, err)
+	}
+	if fi, err := os.Stat(readme); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("Rock Ridge mode not applied: %v", fi.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(dest, ISODir, "latest")); err != nil || target != "boot/initramfs-lts" {
+		t.Errorf("symlink = %q, %v", target, err)
+	}
+
+	ird := filepath.Join(dest, InitramfsDir, "initramfs-lts")
+	for name, want := range map[string]string{
+		"kernel/x86/microcode/GenuineIntel.bin": "ucode",
+		"bin/busybox":                           "#!busybox",
+		"init":                                  "#!/bin/sh\n",
+	} {
+		if data, err := os.ReadFile(filepath.Join(ird, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(ird, "bin/sh")); err != nil || target != "busybox" {
+		t.Errorf("bin/sh = %q, %v", target, err)
+	}
+
+	if _, err := ISO(isoPath, dest); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("extracting into a non-empty directory should fail, got: %v", err)
+	}
+}
+
+func TestCopyISOFile(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "os.iso")
+	if err := os.WriteFile(isoPath, testISO(t, initramfs(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := CopyISOFile(isoPath, "Read me first.txt", &b); err != nil || b.String() != "built by distrorun\n" {
+		t.Errorf("CopyISOFile = %q, %v", b.String(), err)
+	}
+	if err := CopyISOFile(isoPath, "boot", &b); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("copying a directory should fail with ErrNotExist, got: %v", err)
+	}
+}
+
+func TestInitramfsRejectsEscapes(t *testing.T) {
+	dir := t.TempDir()
+	for name, archive := range map[string][]byte{
+		"dotdot":  newc(cpioTestEntry{"../evil", 0o100644, "x"}),
+		"symlink": newc(cpioTestEntry{"etc", 0o120777, "/etc"}, cpioTestEntry{"etc/passwd", 0o100644, "x"}),
+	} {
+		p := filepath.Join(dir, name+".cpio")
+		if err := os.WriteFile(p, archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := extractInitramfs(p, filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("entry escaped the destination")
+	}
+}
+
+// pad4 returns the padding after n bytes to the next multiple of 4.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
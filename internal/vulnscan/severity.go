@@ -0,0 +1,116 @@
+package vulnscan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// nvdURL is the NVD CVE API. secdb carries no severities, so they are looked
+// up here by CVE ID.
+const nvdURL = "https://services.nvd.nist.gov/rest/json/cves/2.0"
+
+// nvdDelay keeps unauthenticated requests under NVD's limit of 5 per 30
+// seconds. With NVD_API_KEY set the limit is 50 and the delay is shortened.
+var nvdDelay = 6 * time.Second
+
+// lastNVDRequest is when the NVD API was last called, for rate limiting.
+var lastNVDRequest time.Time
+
+// nvdResponse is the subset of an NVD API response that is used.
+type nvdResponse struct {
+	Vulnerabilities []struct {
+		CVE struct {
+			Metrics map[string][]struct {
+				BaseSeverity string `json:"baseSeverity"` // CVSS v2
+				CVSSData     struct {
+					BaseSeverity string `json:"baseSeverity"` // CVSS v3 and v4
+				} `json:"cvssData"`
+			} `json:"metrics"`
+		} `json:"cve"`
+	} `json:"vulnerabilities"`
+}
+
+// severity returns the lower-cased CVSS severity of id, preferring CVSS v3.1,
+// or "unknown". Results are cached under cacheDir/nvd.
+func severity(id, cacheDir string) string {
+	if !strings.HasPrefix(id, "CVE-") {
+		return "unknown"
+	}
+	var cachePath string
+	if cacheDir != "" {
+		cachePath = filepath.Join(cacheDir, "nvd", id)
+		if data, err := os.ReadFile(cachePath); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+
+	s, err := lookupNVD(id)
+	if err != nil {
+		return "unknown"
+	}
+	if cachePath != "" {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			os.WriteFile(cachePath, []byte(s+"\n"), 0644)
+		}
+	}
+	return s
+}
+
+// lookupNVD queries the NVD API for the severity of a CVE.
+func lookupNVD(id string) (string, error) {
+	key := os.Getenv("NVD_API_KEY")
+	delay := nvdDelay
+	if key != "" {
+		delay = nvdDelay / 10
+	}
+	if wait := delay - time.Since(lastNVDRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	lastNVDRequest = time.Now()
+
+	req, err := http.NewRequest(http.MethodGet, nvdURL+"?cveId="+id, nil)
+	if err != nil {
+		return "", err
+	}
+	if key != "" {
+		req.Header.Set("apiKey", key)
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("NVD lookup of %s: HTTP %d", id, resp.StatusCode)
+	}
+
+	var r nvdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("parsing NVD response for %s: %w", id, err)
+	}
+	if len(r.Vulnerabilities) == 0 {
+		return "", fmt.Errorf("%s not found in NVD", id)
+	}
+	metrics := r.Vulnerabilities[0].CVE.Metrics
+	for _, version := range []string{"cvssMetricV31", "cvssMetricV30", "cvssMetricV40", "cvssMetricV2"} {
+		for _, m := range metrics[version] {
+			s := m.CVSSData.BaseSeverity
+			if s == "" {
+				s = m.BaseSeverity
+			}
+			if s == "NONE" {
+				return "low", nil
+			}
+			if s != "" {
+				return strings.ToLower(s), nil
+			}
+		}
+	}
+	// Newly published CVEs are not yet rated; do not cache that.
+	return "", fmt.Errorf("%s has no CVSS rating yet", id)
+}
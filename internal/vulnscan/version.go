@@ -0,0 +1,95 @@
+package vulnscan
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// suffixOrder ranks apk version suffixes. Pre-release suffixes sort before
+// the plain release (rank 0), post-release ones after it.
+var suffixOrder = map[string]int{
+	"alpha": -4,
+	"beta":  -3,
+	"pre":   -2,
+	"rc":    -1,
+	"cvs":   1,
+	"svn":   2,
+	"git":   3,
+	"hg":    4,
+	"p":     5,
+}
+
+// apkVersion is a parsed apk version such as "1.2.3a_rc1_p2-r4".
+type apkVersion struct {
+	numbers  []int
+	letter   byte
+	suffixes [][2]int // rank, number
+	revision int
+}
+
+// parseVersion parses an apk version. Unparseable trailing parts (e.g. a
+// "~hash" commit suffix) are ignored.
+func parseVersion(s string) apkVersion {
+	var v apkVersion
+	if i := strings.LastIndex(s, "-r"); i >= 0 {
+		v.revision, _ = strconv.Atoi(s[i+2:])
+		s = s[:i]
+	}
+	s, _, _ = strings.Cut(s, "~")
+
+	main, suffixes, _ := strings.Cut(s, "_")
+	for part := range strings.SplitSeq(main, ".") {
+		digits := strings.TrimRightFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		n, _ := strconv.Atoi(digits)
+		v.numbers = append(v.numbers, n)
+		if len(part) > len(digits) {
+			v.letter = part[len(digits)]
+		}
+	}
+	if suffixes != "" {
+		for suf := range strings.SplitSeq(suffixes, "_") {
+			name := strings.TrimRightFunc(suf, func(r rune) bool { return r >= '0' && r <= '9' })
+			n, _ := strconv.Atoi(suf[len(name):])
+			v.suffixes = append(v.suffixes, [2]int{suffixOrder[name], n})
+		}
+	}
+	return v
+}
+
+// CompareVersions returns -1, 0 or 1 as apk version a is older than, equal
+// to or newer than b.
+func CompareVersions(a, b string) int {
+	va, vb := parseVersion(a), parseVersion(b)
+	for i := 0; i < max(len(va.numbers), len(vb.numbers)); i++ {
+		// A missing component is older: 1.2 < 1.2.0 < 1.2.1.
+		if i >= len(va.numbers) {
+			return -1
+		}
+		if i >= len(vb.numbers) {
+			return 1
+		}
+		if c := cmp.Compare(va.numbers[i], vb.numbers[i]); c != 0 {
+			return c
+		}
+	}
+	if c := cmp.Compare(int(va.letter), int(vb.letter)); c != 0 {
+		return c
+	}
+	for i := 0; i < max(len(va.suffixes), len(vb.suffixes)); i++ {
+		var sa, sb [2]int // a missing suffix ranks as the plain release
+		if i < len(va.suffixes) {
+			sa = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			sb = vb.suffixes[i]
+		}
+		if c := cmp.Compare(sa[0], sb[0]); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(sa[1], sb[1]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(va.revision, vb.revision)
+}
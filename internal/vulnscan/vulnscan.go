@@ -0,0 +1,339 @@
+// Package vulnscan matches the packages installed in an Alpine rootfs against
+// the Alpine security database (secdb) and reports known vulnerabilities.
+package vulnscan
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/talfaza/distrorun/internal/netcap"
+	"github.com/talfaza/distrorun/internal/ui"
+)
+
+// secdbURL is the base URL of the Alpine security database.
+const secdbURL = "https://secdb.alpinelinux.org"
+
+// secdbRepos are the repositories whose secdb files are matched.
+var secdbRepos = []string{"main", "community"}
+
+// Severities from most to least severe. "unknown" is used when no CVSS
+// rating could be looked up.
+var Severities = []string{"critical", "high", "medium", "low", "unknown"}
+
+// httpClient returns the client of all downloads: the build's, so they go
+// through its network capture and allowlist, with a timeout, as secdb and
+// NVD are slow at times but should never hang a build. Failures are
+// retried.
+func httpClient() *http.Client {
+	c := *netcap.Client()
+	c.Timeout = 60 * time.Second
+	return &c
+}
+
+// Vulnerability is one CVE affecting an installed source package.
+type Vulnerability struct {
+	ID        string   `json:"id"`
+	Severity  string   `json:"severity"`
+	Origin    string   `json:"origin"`   // source package the fix is tracked under
+	Packages  []string `json:"packages"` // installed binary packages built from Origin
+	Installed string   `json:"installed"`
+	Fixed     string   `json:"fixed"`
+}
+
+// Report is the result of a scan.
+type Report struct {
+	Image           string          `json:"image"`
+	Branch          string          `json:"branch"` // secdb branch, e.g. "v3.20"
+	Scanned         string          `json:"scanned"`
+	Packages        int             `json:"packages"`
+	Summary         map[string]int  `json:"summary"` // severity → count
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+// secdb is the subset of a secdb JSON file that is used.
+type secdb struct {
+	Packages []struct {
+		Pkg struct {
+			Name     string              `json:"name"`
+			Secfixes map[string][]string `json:"secfixes"` // fixed version → CVEs
+		} `json:"pkg"`
+	} `json:"packages"`
+}
+
+// installedPackage is an entry of the apk installed database.
+type installedPackage struct {
+	Name, Version, Origin string
+}
+
+// Scan matches the rootfs against the secdb of its Alpine release. The secdb
+// and looked-up severities are cached under cacheDir; "" disables caching.
+func Scan(rootfsPath, image, cacheDir string) (*Report, error) {
+	branch, err := detectBranch(rootfsPath)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := readInstalled(filepath.Join(rootfsPath, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return nil, err
+	}
+
+	ui.SubStep(fmt.Sprintf("Loading Alpine secdb (%s)...", branch))
+	fixes := make(map[string]map[string][]string)
+	for _, repo := range secdbRepos {
+		db, err := loadSecdb(branch, repo, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range db.Packages {
+			if fixes[p.Pkg.Name] == nil {
+				fixes[p.Pkg.Name] = make(map[string][]string)
+			}
+			for v, ids := range p.Pkg.Secfixes {
+				fixes[p.Pkg.Name][v] = append(fixes[p.Pkg.Name][v], ids...)
+			}
+		}
+	}
+
+	ui.SubStep(fmt.Sprintf("Matching %d packages...", len(pkgs)))
+	vulns := match(pkgs, fixes)
+	if len(vulns) > 0 {
+		ui.SubStep(fmt.Sprintf("Looking up severity of %d vulnerabilities...", len(vulns)))
+		for i := range vulns {
+			vulns[i].Severity = severity(vulns[i].ID, cacheDir)
+		}
+	}
+	sort.Slice(vulns, func(i, j int) bool {
+		si, sj := slices.Index(Severities, vulns[i].Severity), slices.Index(Severities, vulns[j].Severity)
+		if si != sj {
+			return si < sj
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+
+	r := &Report{
+		Image:           image,
+		Branch:          branch,
+		Scanned:         time.Now().UTC().Format(time.RFC3339),
+		Packages:        len(pkgs),
+		Summary:         make(map[string]int),
+		Vulnerabilities: vulns,
+	}
+	for _, s := range Severities {
+		r.Summary[s] = 0
+	}
+	for _, v := range vulns {
+		r.Summary[v.Severity]++
+	}
+	return r, nil
+}
+
+// match returns the vulnerabilities fixed in a later version of an installed
+// package's origin. Fixes recorded under version "0" mark CVEs that never
+// affected Alpine's build of the package.
+func match(pkgs []installedPackage, fixes map[string]map[string][]string) []Vulnerability {
+	var vulns []Vulnerability
+	seen := make(map[string]int) // origin/CVE → index in vulns
+	for _, p := range pkgs {
+		for fixed, ids := range fixes[p.Origin] {
+			if fixed == "0" || CompareVersions(p.Version, fixed) >= 0 {
+				continue
+			}
+			for _, id := range ids {
+				id, _, _ = strings.Cut(id, " ") // entries may list aliases after the ID
+				key := p.Origin + "/" + id
+				if i, ok := seen[key]; ok {
+					if !slices.Contains(vulns[i].Packages, p.Name) {
+						vulns[i].Packages = append(vulns[i].Packages, p.Name)
+					}
+					continue
+				}
+				seen[key] = len(vulns)
+				vulns = append(vulns, Vulnerability{
+					ID:        id,
+					Origin:    p.Origin,
+					Packages:  []string{p.Name},
+					Installed: p.Version,
+					Fixed:     fixed,
+				})
+			}
+		}
+	}
+	return vulns
+}
+
+// readInstalled parses the apk installed database.
+func readInstalled(path string) ([]installedPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading apk database: %w", err)
+	}
+	defer f.Close()
+
+	var pkgs []installedPackage
+	var cur installedPackage
+	flush := func() {
+		if cur.Name != "" {
+			if cur.Origin == "" {
+				cur.Origin = cur.Name
+			}
+			pkgs = append(pkgs, cur)
+		}
+		cur = installedPackage{}
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			cur.Name = value
+		case "V":
+			cur.Version = value
+		case "o":
+			cur.Origin = value
+		}
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading apk database: %w", err)
+	}
+	return pkgs, nil
+}
+
+// detectBranch returns the secdb branch of the rootfs, e.g. "v3.20" for
+// Alpine 3.20.3 and "edge" for development snapshots.
+func detectBranch(rootfsPath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(rootfsPath, "etc", "alpine-release"))
+	if err != nil {
+		return "", fmt.Errorf("vulnerability scanning supports Alpine only: %w", err)
+	}
+	release := strings.TrimSpace(string(data))
+	if strings.Contains(release, "_") {
+		return "edge", nil // e.g. "3.21_alpha20240807"
+	}
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("unrecognized Alpine release %q", release)
+	}
+	return "v" + parts[0] + "." + parts[1], nil
+}
+
+// MissingSecdb returns the secdb files of branch (e.g. "v3.20") that are
+// not cached under cacheDir, for offline builds to report before they
+// start.
+func MissingSecdb(cacheDir, branch string) []string {
+	var missing []string
+	for _, repo := range secdbRepos {
+		p := filepath.Join(cacheDir, "secdb", branch, repo+".json")
+		if _, err := os.Stat(p); err != nil {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// loadSecdb downloads a secdb file, falling back to the cached copy when the
+// download fails.
+func loadSecdb(branch, repo, cacheDir string) (*secdb, error) {
+	url := fmt.Sprintf("%s/%s/%s.json", secdbURL, branch, repo)
+	var cachePath string
+	if cacheDir != "" {
+		cachePath = filepath.Join(cacheDir, "secdb", branch, repo+".json")
+	}
+
+	data, err := download(url)
+	if err != nil {
+		if cachePath == "" {
+			return nil, fmt.Errorf("downloading secdb: %w", err)
+		}
+		cached, cerr := os.ReadFile(cachePath)
+		if cerr != nil {
+			return nil, fmt.Errorf("downloading secdb: %w (no cached copy)", err)
+		}
+		ui.Warn(fmt.Sprintf("Cannot download %s — using the cached copy", url))
+		data = cached
+	} else if cachePath != "" {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			os.WriteFile(cachePath, data, 0644)
+		}
+	}
+
+	var db secdb
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", url, err)
+	}
+	return &db, nil
+}
+
+// download returns the body of a GET request.
+func download(url string) ([]byte, error) {
+	resp, err := httpClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: HTTP %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// AtOrAbove returns the vulnerabilities at least as severe as level.
+// Vulnerabilities of unknown severity are always included, so a policy is
+// never passed just because the severity could not be looked up.
+func (r *Report) AtOrAbove(level string) []Vulnerability {
+	limit := slices.Index(Severities, level)
+	var out []Vulnerability
+	for _, v := range r.Vulnerabilities {
+		if i := slices.Index(Severities, v.Severity); i <= limit || v.Severity == "unknown" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Write saves the report as indented JSON.
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling report: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	return nil
+}
+
+// Print shows a human-readable summary of the report.
+func (r *Report) Print() {
+	if len(r.Vulnerabilities) == 0 {
+		ui.SubStep(fmt.Sprintf("No known vulnerabilities in %d packages (secdb %s)", r.Packages, r.Branch))
+		return
+	}
+	var counts []string
+	for _, s := range Severities {
+		if n := r.Summary[s]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, s))
+		}
+	}
+	ui.Warn(fmt.Sprintf("%d vulnerabilities in %d packages: %s", len(r.Vulnerabilities), r.Packages, strings.Join(counts, ", ")))
+	for _, v := range r.Vulnerabilities {
+		ui.Detail(fmt.Sprintf("%-8s %s  %s %s → %s", v.Severity, v.ID, v.Origin, v.Installed, v.Fixed))
+	}
+}
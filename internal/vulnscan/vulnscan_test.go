@@ -0,0 +1,107 @@
+package vulnscan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/netcap"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.36.1-r29", "1.36.1-r29", 0},
+		{"1.36.1-r28", "1.36.1-r29", -1},
+		{"3.1.4-r0", "3.1.10-r0", -1},
+		{"1.2", "1.2.1", -1},
+		{"1.2a", "1.2", 1},
+		{"2.0_rc1-r0", "2.0-r0", -1},
+		{"2.0_beta2", "2.0_rc1", -1},
+		{"2.0_p1", "2.0", 1},
+		{"8.4_p1-r1", "8.4_p2-r0", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestReadInstalledAndMatch(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "installed")
+	content := "P:libcrypto3\nV:3.3.0-r2\no:openssl\n\nP:libssl3\nV:3.3.0-r2\no:openssl\n\nP:busybox\nV:1.36.1-r29\n\n"
+	if err := os.WriteFile(db, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := readInstalled(db)
+	if err != nil {
+		t.Fatalf("readInstalled: %v", err)
+	}
+	if len(pkgs) != 3 || pkgs[2].Origin != "busybox" {
+		t.Fatalf("unexpected packages: %+v", pkgs)
+	}
+
+	fixes := map[string]map[string][]string{
+		"openssl": {
+			"3.3.0-r3": {"CVE-2024-4741"},
+			"3.3.0-r0": {"CVE-2024-2511"},
+			"0":        {"CVE-2023-0001"},
+		},
+		"busybox": {"1.36.1-r29": {"CVE-2023-42363 GHSA-xxxx"}},
+	}
+	vulns := match(pkgs, fixes)
+	if len(vulns) != 1 {
+		t.Fatalf("expected 1 vulnerability, got %+v", vulns)
+	}
+	v := vulns[0]
+	if v.ID != "CVE-2024-4741" || v.Fixed != "3.3.0-r3" || len(v.Packages) != 2 {
+		t.Errorf("unexpected vulnerability: %+v", v)
+	}
+}
+
+func TestDetectBranch(t *testing.T) {
+	for release, want := range map[string]string{"3.20.3\n": "v3.20", "3.21_alpha20240807\n": "edge"} {
+		root := t.TempDir()
+		os.MkdirAll(filepath.Join(root, "etc"), 0755)
+		os.WriteFile(filepath.Join(root, "etc", "alpine-release"), []byte(release), 0644)
+		if got, err := detectBranch(root); err != nil || got != want {
+			t.Errorf("detectBranch(%q) = %q, %v; want %q", release, got, err, want)
+		}
+	}
+}
+
+func TestAtOrAbove(t *testing.T) {
+	r := &Report{Vulnerabilities: []Vulnerability{
+		{ID: "a", Severity: "critical"},
+		{ID: "b", Severity: "high"},
+		{ID: "c", Severity: "low"},
+		{ID: "d", Severity: "unknown"},
+	}}
+	if got := len(r.AtOrAbove("critical")); got != 2 {
+		t.Errorf("critical: got %d, want 2 (critical + unknown)", got)
+	}
+	if got := len(r.AtOrAbove("high")); got != 3 {
+		t.Errorf("high: got %d, want 3", got)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	// Downloads go through the build's client, so build.network captures
+	// and filters them, but never wait forever.
+	c := httpClient()
+	if c.Transport != netcap.Client().Transport {
+		t.Error("the client does not use the transport of netcap.Client")
+	}
+	if c.Timeout == 0 {
+		t.Error("the client has no timeout")
+	}
+	if netcap.Client().Timeout != 0 {
+		t.Error("setting the timeout changed netcap.Client")
+	}
+}
@@ -2,25 +2,73 @@
 //
 // Usage:
 //
-//	distrorun build <config.yaml> [-o output.iso]
+//	distrorun build <config.yaml> [-o output.iso] [-dry-run]
+//	distrorun validate <config.yaml>
+//	distrorun lint [-format text|json] [-disable RULE]... [-resolve] [-rules] <config.yaml>
+//	distrorun publish <github|gitlab> -tag <tag> <artifact>...
+//	distrorun promote -to <channel> <config.yaml> <artifact>
+//	distrorun prune [-keep-last N] [-max-age AGE] [-pin GLOB] [-cache] [dir...]
+//	distrorun bundle <config.yaml> [-o bundle.tar.gz]
+//	distrorun lock <config.yaml> [-o config.lock]
+//	distrorun extract <iso> [dest]
+//	distrorun sbom [-o out.spdx.json] [-name NAME] [-files] <iso|rootfs-dir>
+//	distrorun patch -config <delta.yaml> [-o output.iso] <iso>
+//	distrorun drift -ssh <host> [-path DIR]... <sbom.spdx.json>
+//	distrorun flash [-persist] <iso> <device>
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/charmbracelet/x/term"
+
+	"github.com/talfaza/distrorun/internal/addon"
+	"github.com/talfaza/distrorun/internal/audit"
 	"github.com/talfaza/distrorun/internal/bootloader"
+	"github.com/talfaza/distrorun/internal/boottest"
+	"github.com/talfaza/distrorun/internal/bundle"
+	"github.com/talfaza/distrorun/internal/compress"
 	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/confine"
 	"github.com/talfaza/distrorun/internal/disk"
+	"github.com/talfaza/distrorun/internal/drift"
+	"github.com/talfaza/distrorun/internal/fetch"
+	"github.com/talfaza/distrorun/internal/flash"
 	"github.com/talfaza/distrorun/internal/iso"
+	"github.com/talfaza/distrorun/internal/limits"
+	"github.com/talfaza/distrorun/internal/lint"
+	"github.com/talfaza/distrorun/internal/lockfile"
+	"github.com/talfaza/distrorun/internal/metrics"
+	"github.com/talfaza/distrorun/internal/netboot"
+	"github.com/talfaza/distrorun/internal/netcap"
+	"github.com/talfaza/distrorun/internal/oci"
+	"github.com/talfaza/distrorun/internal/policy"
+	"github.com/talfaza/distrorun/internal/provenance"
+	"github.com/talfaza/distrorun/internal/prune"
+	"github.com/talfaza/distrorun/internal/publish"
 	"github.com/talfaza/distrorun/internal/rootfs"
 	"github.com/talfaza/distrorun/internal/sbom"
+	"github.com/talfaza/distrorun/internal/scaffold"
+	"github.com/talfaza/distrorun/internal/templates"
 	"github.com/talfaza/distrorun/internal/ui"
+	"github.com/talfaza/distrorun/internal/unpack"
+	"github.com/talfaza/distrorun/internal/vulnscan"
 )
 
 const version = "0.1.0"
@@ -34,8 +82,38 @@ func main() {
 	switch os.Args[1] {
 	case "build":
 		runBuild(os.Args[2:])
+	case "validate":
+		runValidate(os.Args[2:])
+	case "lint":
+		runLint(os.Args[2:])
+	case "publish":
+		runPublish(os.Args[2:])
+	case "promote":
+		runPromote(os.Args[2:])
+	case "prune":
+		runPrune(os.Args[2:])
+	case "bundle":
+		runBundle(os.Args[2:])
+	case "lock":
+		runLock(os.Args[2:])
+	case "add-on":
+		runAddon(os.Args[2:])
+	case "init":
+		runInit(os.Args[2:])
+	case "migrate":
+		runMigrate(os.Args[2:])
 	case "test":
 		runTest(os.Args[2:])
+	case "extract":
+		runExtract(os.Args[2:])
+	case "sbom":
+		runSBOM(os.Args[2:])
+	case "patch":
+		runPatch(os.Args[2:])
+	case "drift":
+		runDrift(os.Args[2:])
+	case "flash":
+		runFlash(os.Args[2:])
 	case "version":
 		ui.PrintBanner(version)
 	case "help", "--help", "-h":
@@ -50,23 +128,66 @@ func main() {
 func runBuild(args []string) {
 	fs := flag.NewFlagSet("build", flag.ExitOnError)
 	output := fs.String("o", "", "Output ISO path (default: <name>.iso)")
+	cacheDir := fs.String("cache-dir", rootfs.DefaultCacheDir, "Persistent download cache directory")
+	noCache := fs.Bool("no-cache", false, "Disable the download cache")
+	rebuild := fs.Bool("rebuild", false, "Bootstrap and install packages from scratch instead of restoring rootfs snapshots")
+	mirror := fs.String("mirror", "", "Alpine mirror base URL, overriding distro.mirror")
+	offline := fs.Bool("offline", false, "Build without network access, from the download cache and distro.local_mirror (or -bundle); fails before starting if something is missing")
+	retries := fs.Int("retries", fetch.Retries, "Retries of failed or broken downloads, with exponential backoff from 1s; broken ones resume where they stopped")
+	keyring := fs.String("alpine-keyring", rootfs.DefaultAlpineKeyring, "OpenPGP keyring the downloaded minirootfs must be signed by (empty: do not check)")
+	bundlePath := fs.String("bundle", "", "Build from a bundle created by 'distrorun bundle' instead of the cache")
+	bootTest := fs.Bool("test", false, "Boot the ISO under QEMU after building and fail if it does not reach a login prompt")
+	logFormat := fs.String("log-format", "text", "Progress output: text, or json for one machine-readable event per line")
+	metricsFile := fs.String("metrics-file", "", "Write Prometheus metrics for the build to this file (e.g. for the node_exporter textfile collector)")
+	nice := fs.Int("nice", 0, "Niceness (1-19) of mksquashfs, xorriso and the package managers, overriding build.limits.nice")
+	cpus := fs.String("cpus", "", "CPUs they may run on, e.g. 0-3, overriding build.limits.cpus")
+	memory := fs.String("memory", "", "Memory limit for them, e.g. 4G, overriding build.limits.memory")
+	ioClass := fs.String("io", "", "Their I/O priority, idle or low, overriding build.limits.io")
+	channel := fs.String("channel", "dev", "Release channel published to, the {channel} of publish paths")
+	dryRun := fs.Bool("dry-run", false, "Print the build plan (steps, packages, outputs) without building; does not need root")
+	workDir := fs.String("workdir", os.Getenv("DISTRORUN_WORKDIR"), "Directory to create the build workdir in, which holds the rootfs and squashfs (default: $DISTRORUN_WORKDIR, or the system temporary directory)")
+	templatesDir := fs.String("templates", "", "Directory of templates replacing the built-in ones of the same name (init, isolinux.cfg, grub.cfg, mkinitfs-live.conf, mkinitfs-disk.conf, repositories)")
+	locked := fs.Bool("locked", false, "Install the package versions of the config's lock file (distrorun lock) and fail if the image's packages differ from it; build.reproducible implies it")
+	requireVersion := fs.Bool("require-version", true, "Refuse to build from a lock file written by another distrorun version or with other built-in templates (-require-version=false: only warn)")
+	strict := fs.Bool("strict", false, "Fail the build, before testing and publishing, when an optional feature was skipped for lack of host support (e.g. isohybrid without isohdpfx.bin)")
 	fs.Parse(args)
 
 	if fs.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: distrorun build <config.yaml> [-o output.iso]")
+		fmt.Fprintln(os.Stderr, "Usage: distrorun build <config.yaml> [-o output.iso] [-cache-dir DIR] [-no-cache] [-rebuild] [-mirror URL] [-offline] [-retries N] [-alpine-keyring FILE] [-bundle FILE] [-test] [-log-format text|json] [-metrics-file FILE] [-nice N] [-cpus LIST] [-memory SIZE] [-io idle|low] [-channel NAME] [-dry-run] [-locked] [-require-version=false] [-workdir DIR] [-templates DIR] [-strict]")
+		os.Exit(1)
+	}
+	if err := ui.SetLogFormat(*logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := publish.CheckChannel(*channel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *retries < 0 {
+		fmt.Fprintln(os.Stderr, "-retries must not be negative")
 		os.Exit(1)
 	}
+	fetch.Retries = *retries
 
 	configPath := fs.Arg(0)
+	ctx := interruptContext()
+	if *metricsFile != "" && !*dryRun {
+		stem := strings.TrimSuffix(filepath.Base(configPath), filepath.Ext(configPath))
+		ui.SetObserver(metrics.NewRecorder(*metricsFile, stem))
+	}
 
 	// Print banner
 	buildStart := time.Now()
 	ui.PrintBanner(version)
 
 	// Prelude: check root
-	if os.Getuid() != 0 {
+	if os.Getuid() != 0 && !*dryRun {
 		ui.Error("This command must be run as root", fmt.Errorf("run with: sudo distrorun build ..."))
 	}
+	if err := confine.CheckEngine(); err != nil && !*dryRun {
+		ui.Error("Insufficient privileges", err)
+	}
 
 	// ── Step 1: Parse config ─────────────────────────────────────────────
 	ui.StepHeader(1, 9, "Parsing configuration...")
@@ -74,68 +195,327 @@ func runBuild(args []string) {
 	if err != nil {
 		ui.Error("Configuration error", err)
 	}
+	setMirror(cfg, *mirror)
+	setLimits(cfg, *nice, *cpus, *memory, *ioClass)
+	loadTemplates(*templatesDir)
 	ui.Info("Config", fmt.Sprintf("%s (base: %s)", cfg.Name, cfg.Distro.Base))
+	warnOutdated(cfg, configPath)
+	if cfg.Distro.Version != "" {
+		ui.Info("Release", cfg.Distro.AlpineBranch())
+	}
+	if cfg.Distro.Mirror != "" {
+		ui.Info("Mirror", cfg.Distro.Mirror)
+	}
 	ui.Info("Packages", strings.Join(cfg.Packages, ", "))
 	ui.Info("Users", fmt.Sprintf("%d defined", len(cfg.Users)))
 
-	totalSteps := 8
-	if cfg.SBOMEnabled() {
-		totalSteps = 9
+	if *bootTest && cfg.OutputMode() != "iso" {
+		ui.Error("Invalid flags", fmt.Errorf("-test only supports ISO output, not %s", cfg.OutputMode()))
 	}
+	totalSteps := buildSteps(cfg, *bootTest)
 
 	// Determine output path — override with -o, default based on output mode
 	outputPath := *output
 	if outputPath == "" {
-		if cfg.OutputMode() == "disk" {
-			outputPath = cfg.Name + ".qcow2"
-		} else {
+		switch cfg.OutputMode() {
+		case "disk":
+			if cfg.DiskFormat() == "raw" {
+				outputPath = cfg.Name + ".img"
+			} else {
+				outputPath = cfg.Name + ".qcow2"
+			}
+		case "netboot":
+			outputPath = cfg.Name + "-netboot"
+		case "oci":
+			outputPath = cfg.Name + "-oci.tar"
+		default:
 			outputPath = cfg.Name + ".iso"
 		}
 	}
 
+	// Every privileged operation of this build is recorded next to the output.
+	auditPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-audit.jsonl"
+	provenancePath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-provenance.json"
+	outputs := []string{outputPath, auditPath, provenancePath}
+	seedPath := ""
+	if cfg.CloudInitEnabled() && cfg.CloudInit.Seed != nil {
+		seedPath = strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-seed.iso"
+		outputs = append(outputs, seedPath)
+	}
+	networkPath := ""
+	if cfg.Build != nil && cfg.Build.Network != nil {
+		networkPath = strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-network.jsonl"
+		outputs = append(outputs, networkPath)
+	}
+	if err := checkOutputPaths(configPath, outputs...); err != nil {
+		ui.Error("Invalid output path", err)
+	}
+	menu, err := bootMenu(cfg)
+	if err != nil {
+		ui.Error("Invalid boot menu", err)
+	}
+	if *locked && cfg.Distro.Base != "alpine" {
+		ui.Error("Locked build", fmt.Errorf("-locked is only supported for distro.base \"alpine\""))
+	}
+	if *offline {
+		if cfg.Distro.Base != "alpine" {
+			ui.Error("Offline build", fmt.Errorf("-offline is only supported for distro.base \"alpine\""))
+		}
+		if networkPath != "" {
+			ui.Error("Offline build", fmt.Errorf("build.network captures network access, which -offline rules out: remove one of them"))
+		}
+	}
+	if *dryRun {
+		printBuildPlan(cfg, configPath, outputPath, *bootTest, *channel, *locked, *requireVersion)
+		return
+	}
+	if err := audit.Open(auditPath); err != nil {
+		ui.Error("Creating audit log", err)
+	}
+	defer audit.Close()
+	ui.AddArtifact("audit", "Audit", auditPath)
+	if cfg.Build != nil {
+		compress.SetWorkers(cfg.Build.CompressThreads)
+	}
+	if cfg.Build != nil && cfg.Build.Limits != nil {
+		applyLimits(cfg.Build.Limits)
+		defer limits.Close()
+		ui.AtExit(func() { limits.Close() })
+	}
+
 	// ── Step 2: Check host dependencies ──────────────────────────────────
 	ui.StepHeader(2, totalSteps, "Checking host dependencies...")
-	if cfg.Distro.Base == "fedora" {
-		if cfg.OutputMode() == "disk" {
-			if err := disk.CheckDiskDeps(); err != nil {
-				ui.Error("Missing dependency", err)
-			}
-		} else {
-			if err := iso.CheckFedoraDeps(); err != nil {
-				ui.Error("Missing dependency", err)
-			}
-		}
-	} else {
-		if err := iso.CheckHostDeps(); err != nil {
+	if err := checkBuildDeps(cfg); err != nil {
+		ui.Error("Missing dependency", err)
+	}
+	hostSec := rootfs.DetectHostSecurity()
+	if hostSec.SELinux != "" {
+		ui.Info("SELinux", hostSec.SELinux+" (workdir labeled like /)")
+	}
+	if hostSec.AppArmor != "" {
+		ui.Warn(fmt.Sprintf("AppArmor profile %q confines this process — it must allow mount and chroot", hostSec.AppArmor))
+	}
+	if *offline {
+		if err := netcap.Offline(); err != nil {
 			ui.Error("Missing dependency", err)
 		}
 	}
 	ui.Success("All dependencies found")
+	if *offline {
+		ui.Info("Network", "offline")
+	}
+
+	// Package managers and hooks reach the network through the capture
+	// proxy until the image is built.
+	var capture *netcap.Capture
+	if networkPath != "" {
+		capture, err = netcap.Start(networkPath, cfg.Build.Network.Allow)
+		if err != nil {
+			ui.Error("Build network", err)
+		}
+		defer capture.Close()
+		ui.AtExit(func() { capture.Close() })
+		ui.AddArtifact("network", "Network log", networkPath)
+		if allow := cfg.Build.Network.Allow; len(allow) > 0 {
+			ui.Info("Network", "captured, limited to "+strings.Join(allow, ", "))
+		} else {
+			ui.Info("Network", "captured")
+		}
+	}
 
 	// ── Step 3: Bootstrap rootfs ─────────────────────────────────────────
+	// Serialize builds of the same image; each build still gets its own workdir.
+	lock, err := rootfs.Lock(cfg.Name)
+	if err != nil {
+		ui.Error("Acquiring build lock", err)
+	}
+	defer lock.Unlock()
+
+	configHash, err := fileHash(configPath)
+	if err != nil {
+		ui.Error("Reading configuration", err)
+	}
+	opts := rootfs.Options{
+		Context:         ctx,
+		CacheDir:        *cacheDir,
+		AlpineBranch:    cfg.Distro.AlpineBranch(),
+		Mirror:          cfg.Distro.Mirror,
+		Repositories:    cfg.Distro.Repositories,
+		AlpineKeyring:   *keyring,
+		ConfigHash:      configHash,
+		WorkDir:         *workDir,
+		Disk:            cfg.OutputMode() == "disk",
+		Container:       cfg.OutputMode() == "oci",
+		VM:              cfg.Target == "vm",
+		Kernel:          cfg.Distro.Kernel,
+		Cmdline:         cfg.KernelCmdline(),
+		NonfatalScripts: cfg.NonfatalScripts(),
+		LocalMirror:     cfg.Distro.LocalMirror,
+		Offline:         *offline,
+	}
+	if *noCache {
+		opts.CacheDir = ""
+	}
+	if *workDir != "" {
+		if fi, err := os.Stat(*workDir); err != nil || !fi.IsDir() {
+			ui.Error("Invalid workdir", fmt.Errorf("%s is not a directory", *workDir))
+		}
+		ui.InfoPath("Workdir", *workDir)
+	}
+	if err := rootfs.CheckSpace(opts.WorkDir, filepath.Dir(outputPath), rootfs.EstimateSpace(cfg.Distro.Base, opts, len(cfg.Packages))); err != nil {
+		ui.Error("Not enough disk space", err)
+	}
+	if cfg.Reproducible() || *locked {
+		lockPath := lockfile.Path(configPath)
+		lf, err := lockfile.Read(lockPath)
+		if err != nil {
+			ui.Error("Locked build", fmt.Errorf("%w (create it with: distrorun lock %s)", err, configPath))
+		}
+		checkLockEngine(lf, configPath, *requireVersion)
+		opts.Lock = lf
+		ui.InfoPath("Lock file", lockPath)
+	}
+	if cfg.Reproducible() {
+		// An epoch set by the caller wins, as with any other tool.
+		if os.Getenv("SOURCE_DATE_EPOCH") == "" {
+			os.Setenv("SOURCE_DATE_EPOCH", strconv.FormatInt(opts.Lock.SourceDateEpoch, 10))
+		}
+		ui.Info("Timestamp", "SOURCE_DATE_EPOCH="+os.Getenv("SOURCE_DATE_EPOCH"))
+	}
+	if *bundlePath != "" {
+		ui.SubStep("Unpacking bundle " + *bundlePath + "...")
+		bundleDir, err := os.MkdirTemp("", "distrorun-bundle-")
+		if err != nil {
+			ui.Error("Creating bundle directory", err)
+		}
+		defer os.RemoveAll(bundleDir)
+		ui.AtExit(func() { os.RemoveAll(bundleDir) })
+		m, err := bundle.Extract(*bundlePath, bundleDir)
+		if err != nil {
+			ui.Error("Invalid bundle", err)
+		}
+		if m.Distro != cfg.Distro.Base {
+			ui.Error("Invalid bundle", fmt.Errorf("bundle is for %s, config uses %s", m.Distro, cfg.Distro.Base))
+		}
+		if m.Name != cfg.Name {
+			ui.Warn(fmt.Sprintf("Bundle was created for %q, building %q", m.Name, cfg.Name))
+		}
+		opts.CacheDir = filepath.Join(bundleDir, bundle.CacheDir)
+		bootloader.AddSearchPath(filepath.Join(bundleDir, bundle.SyslinuxDir))
+	}
+
+	// Unchanged bootstrap and package steps are restored from snapshots
+	// taken by earlier builds. Bundles and lock files pin their own
+	// inputs, so builds from them always start from scratch.
+	snapshotDir := opts.CacheDir
+	if *bundlePath != "" || opts.Lock != nil {
+		snapshotDir = ""
+	}
+	keys, err := rootfs.SnapshotKeysFor(cfg, opts)
+	if err != nil {
+		ui.Error("Bootstrap failed", err)
+	}
+	restored := ""
+	if snapshotDir != "" && !*rebuild {
+		restored = rootfs.FindSnapshot(snapshotDir, keys.Packages, keys.Base)
+		if restored != keys.Packages {
+			if changed := keys.Changed(snapshotDir); len(changed) > 0 {
+				ui.Info("Snapshot invalidated by", strings.Join(changed, ", "))
+			}
+		}
+	}
+	if *offline {
+		checkOffline(cfg, opts, restored == "", *bundlePath != "")
+	}
+
 	var rfs *rootfs.Rootfs
-	if cfg.Distro.Base == "fedora" {
+	if restored != "" {
+		ui.StepHeader(3, totalSteps, "Restoring rootfs from snapshot...")
+		rfs, err = rootfs.RestoreSnapshot(cfg.Name, cfg.Distro.Base, snapshotDir, restored, opts)
+	} else if cfg.Distro.Base == "fedora" {
 		if cfg.OutputMode() == "disk" {
 			ui.StepHeader(3, totalSteps, "Bootstrapping Fedora rootfs (disk mode)...")
-			rfs, err = rootfs.BootstrapFedoraDisk(cfg.Name, cfg.Distro.Type)
+			rfs, err = rootfs.BootstrapFedoraDisk(cfg.Name, cfg.Distro.Type, opts)
 		} else {
 			ui.StepHeader(3, totalSteps, "Bootstrapping Fedora rootfs...")
-			rfs, err = rootfs.BootstrapFedora(cfg.Name, cfg.Distro.Type)
+			rfs, err = rootfs.BootstrapFedora(cfg.Name, cfg.Distro.Type, opts)
 		}
 	} else {
-		ui.StepHeader(3, totalSteps, "Bootstrapping Alpine rootfs...")
-		rfs, err = rootfs.Bootstrap(cfg.Name)
+		distroName := "Alpine"
+		if cfg.Distro.Base == "debian" {
+			distroName = "Debian"
+		}
+		if opts.Disk {
+			ui.StepHeader(3, totalSteps, "Bootstrapping "+distroName+" rootfs (disk mode)...")
+		} else if opts.Container {
+			ui.StepHeader(3, totalSteps, "Bootstrapping "+distroName+" rootfs (container mode)...")
+		} else {
+			ui.StepHeader(3, totalSteps, "Bootstrapping "+distroName+" rootfs...")
+		}
+		if cfg.Distro.Base == "debian" {
+			rfs, err = rootfs.BootstrapDebian(cfg.Name, cfg.Distro.Type, opts)
+		} else {
+			rfs, err = rootfs.Bootstrap(cfg.Name, opts)
+		}
 	}
 	if err != nil {
-		ui.Error("Bootstrap failed", err)
+		ui.Error("Bootstrap failed", hostSec.Explain(err))
 	}
 	defer rfs.Cleanup(true)
+	ui.AtExit(func() { rfs.Cleanup(true) })
 	ui.InfoPath("Rootfs", rfs.Path)
+	if restored == "" && snapshotDir != "" {
+		rfs.SaveSnapshot(snapshotDir, keys.Base)
+		keys.SaveInputs(snapshotDir, keys.Base)
+	}
 
 	// ── Step 4: Install packages ─────────────────────────────────────────
 	ui.StepHeader(4, totalSteps, "Installing packages...")
-	if err := rfs.InstallPackages(cfg.Packages); err != nil {
-		ui.Error("Package installation failed", err)
+	if restored == keys.Packages {
+		ui.Detail("Package set unchanged: installed packages restored from snapshot")
+	} else {
+		if err := rfs.InstallPackages(cfg.Packages); err != nil {
+			ui.Error("Package installation failed", hostSec.Explain(err))
+		}
+		if snapshotDir != "" {
+			rfs.SaveSnapshot(snapshotDir, keys.Packages)
+			keys.SaveInputs(snapshotDir, keys.Packages)
+		}
+	}
+	if cfg.BaseData != nil {
+		if err := rfs.RefreshBaseData(*cfg.BaseData); err != nil {
+			ui.Error("Base data refresh failed", hostSec.Explain(err))
+		}
+		if cfg.BaseData.MaxAge != "" {
+			maxAge, _ := config.ParseAge(cfg.BaseData.MaxAge)
+			if err := rfs.CheckBaseDataAge(maxAge); err != nil {
+				ui.Error("Base data is stale", err)
+			}
+		}
+	}
+	if cfg.Hooks != nil {
+		if err := rfs.RunHooks("post_packages", cfg.Hooks.PostPackages); err != nil {
+			ui.Error("Hook failed", err)
+		}
+	}
+	if cfg.Distro.Base == "alpine" && cfg.OutputMode() == "iso" && !bootloader.Available() {
+		// The host has no syslinux: take it from Alpine while the rootfs
+		// can still reach the repositories.
+		dir := filepath.Join(rfs.WorkDir, "syslinux")
+		if err := rfs.FetchSyslinux(dir); err != nil {
+			ui.Error("syslinux is not installed on the host and could not be fetched", hostSec.Explain(err))
+		}
+		bootloader.AddSearchPath(dir)
+	}
+	if cfg.OutputMode() == "disk" {
+		if err := rfs.ConfigureRootFilesystem(cfg.RootFilesystem()); err != nil {
+			ui.Error("Root filesystem setup failed", err)
+		}
+	}
+	if cfg.Boot != nil {
+		if err := rfs.AddInitramfsFeatures(cfg.Boot.InitramfsFeatures, cfg.OutputMode() != "disk"); err != nil {
+			ui.Error("Initramfs setup failed", err)
+		}
 	}
 	ui.Success("Packages installed")
 
@@ -144,143 +524,1778 @@ func runBuild(args []string) {
 	if err := rfs.SetupUsers(cfg.Users); err != nil {
 		ui.Error("User setup failed", err)
 	}
-	// Set hostname to the first user's name
-	if len(cfg.Users) > 0 {
-		hostname := cfg.Users[0].Name
-		os.WriteFile(filepath.Join(rfs.Path, "etc", "hostname"), []byte(hostname+"\n"), 0644)
-		ui.Info("Hostname", hostname)
+	if err := rfs.SetHostname(cfg.Hostname()); err != nil {
+		ui.Error("Hostname setup failed", err)
+	}
+	ui.Info("Hostname", cfg.Hostname())
+	issue, motd, err := cfg.Banners()
+	if err != nil {
+		ui.Error("Branding setup failed", err)
+	}
+	if err := rfs.SetBanners(issue, motd); err != nil {
+		ui.Error("Branding setup failed", err)
+	}
+	if cfg.System != nil && cfg.System.Timezone != "" {
+		if err := rfs.SetTimezone(cfg.System.Timezone); err != nil {
+			ui.Error("Time zone setup failed", err)
+		}
+	}
+	if cfg.System != nil && cfg.System.Keymap != "" {
+		if err := rfs.SetKeymap(cfg.System.Keymap); err != nil {
+			ui.Error("Keymap setup failed", err)
+		}
+	}
+	if cfg.Live != nil && len(cfg.Live.Input) > 0 {
+		if err := rfs.InstallInputSwitcher(cfg.Live.Input); err != nil {
+			ui.Error("Keyboard layout setup failed", err)
+		}
+	}
+	if cfg.System != nil && cfg.System.Autologin != "" {
+		if err := rfs.SetAutologin(cfg.System.Autologin); err != nil {
+			ui.Error("Autologin setup failed", err)
+		}
 	}
 	ui.Success("Users configured (passwords hashed with SHA-512)")
 
 	// ── Step 6: Enable services ──────────────────────────────────────────
 	ui.StepHeader(6, totalSteps, "Enabling services...")
+	if cfg.Network != nil {
+		if err := rfs.ConfigureInterfaces(cfg.Network.Interfaces); err != nil {
+			ui.Error("Network setup failed", err)
+		}
+	}
+	if cfg.AP != nil {
+		if err := rfs.ConfigureAccessPoint(*cfg.AP); err != nil {
+			ui.Error("Access point setup failed", err)
+		}
+	}
+	if cfg.VPN != nil && cfg.VPN.WireGuard != nil {
+		if err := rfs.ConfigureWireGuard(*cfg.VPN.WireGuard); err != nil {
+			ui.Error("WireGuard setup failed", err)
+		}
+	}
+	if cfg.ManagementEnabled() {
+		if err := rfs.ConfigureManagement(*cfg.Management); err != nil {
+			ui.Error("Remote management setup failed", err)
+		}
+	}
+	if cfg.CloudInitEnabled() {
+		if err := rfs.ConfigureCloudInit(cfg.CloudTool(), cfg.CloudInit.CloudDatasources()); err != nil {
+			ui.Error("cloud-init setup failed", err)
+		}
+	}
 	if cfg.Services != nil {
-		if err := rfs.EnableServices(cfg.Services.Enable); err != nil {
+		if err := rfs.ConfigureServices(*cfg.Services); err != nil {
 			ui.Error("Service enablement failed", err)
 		}
 	}
+	if cfg.WatchdogEnabled() {
+		var services []string
+		if cfg.Services != nil {
+			services = cfg.Services.Enable
+		}
+		if err := rfs.ConfigureWatchdog(*cfg.System.Watchdog, services); err != nil {
+			ui.Error("Watchdog setup failed", err)
+		}
+	}
+	if cfg.Updates != nil {
+		if err := rfs.ConfigureUpdates(*cfg.Updates, cfg.ImageVersion); err != nil {
+			ui.Error("Update policy setup failed", err)
+		}
+	}
+	if cfg.OutputMode() == "disk" {
+		if err := rfs.InstallGrowRoot(); err != nil {
+			ui.Error("Root expansion setup failed", err)
+		}
+	}
+	if cfg.ResetIdentity() {
+		if err := rfs.ResetIdentity(); err != nil {
+			ui.Error("Identity reset failed", err)
+		}
+	}
+	if cfg.WizardEnabled() {
+		if err := rfs.InstallWizard(cfg.Firstboot.Language); err != nil {
+			ui.Error("First-boot wizard setup failed", err)
+		}
+	}
+	if cfg.Provision != nil && len(cfg.Provision.FirstBoot) > 0 {
+		if err := rfs.InstallProvisioning(cfg.Provision.FirstBoot); err != nil {
+			ui.Error("Provisioning setup failed", err)
+		}
+	}
+	// Last, so the package installs above still resolve through the
+	// host's DNS servers.
+	if cfg.Network != nil {
+		if err := rfs.ConfigureDNS(cfg.Network.DNS); err != nil {
+			ui.Error("DNS setup failed", err)
+		}
+	}
 	ui.Success("Services configured")
 
 	// Track current step
 	currentStep := 7
 
-	// ── Step 7 (optional): Generate SBOM ─────────────────────────────────
+	// ── Step 7 (optional): Install overlay files ─────────────────────────
+	// Runs after users exist so overlay owners can reference them.
+	if len(cfg.Files) > 0 {
+		ui.StepHeader(currentStep, totalSteps, "Installing overlay files...")
+		if err := rfs.InstallFiles(cfg.Files); err != nil {
+			ui.Error("Overlay installation failed", err)
+		}
+		ui.Success(fmt.Sprintf("%d overlay entries installed", len(cfg.Files)))
+		currentStep++
+	}
+
+	// ── Step N-2 (optional): Generate SBOM ─────────────────────────────────
 	if cfg.SBOMEnabled() {
 		ui.StepHeader(currentStep, totalSteps, "Generating SBOM (SPDX JSON)...")
 		sbomPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-sbom.spdx.json"
-		if err := sbom.Generate(rfs.Path, cfg.Name, sbomPath); err != nil {
+		if err := sbom.Generate(rfs.Path, cfg.Name, sbomPath, cfg.SBOMFiles()); err != nil {
 			ui.Error("SBOM generation failed", err)
 		}
 		ui.Success("SBOM generated")
 		currentStep++
 	}
 
+	// ── Step N-2 (optional): Vulnerability scan ──────────────────────────
+	vulnsPath := ""
+	if cfg.VulnScanEnabled() {
+		ui.StepHeader(currentStep, totalSteps, "Scanning for known vulnerabilities...")
+		report, err := vulnscan.Scan(rfs.Path, cfg.Name, opts.CacheDir)
+		if err != nil {
+			if cfg.Build.FailOn != "" {
+				ui.Error("Vulnerability scan failed", err)
+			}
+			ui.Warn("Vulnerability scan failed: " + err.Error())
+		} else {
+			vulnsPath = strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-vulns.json"
+			if err := report.Write(vulnsPath); err != nil {
+				ui.Error("Writing vulnerability report failed", err)
+			}
+			report.Print()
+			ui.InfoPath("Report", vulnsPath)
+			if level := cfg.Build.FailOn; level != "" {
+				if found := report.AtOrAbove(level); len(found) > 0 {
+					ui.Error("Vulnerability policy violated", fmt.Errorf("%d vulnerabilities at or above build.fail_on: %s (or of unknown severity)", len(found), level))
+				}
+			}
+			ui.Success("Vulnerability scan complete")
+		}
+		currentStep++
+	}
+
+	// pre_iso hooks run while the chroot mounts are still live.
+	if cfg.Hooks != nil {
+		if err := rfs.RunHooks("pre_iso", cfg.Hooks.PreISO); err != nil {
+			ui.Error("Hook failed", err)
+		}
+	}
+
 	// ── Step N-1: Setup bootloader / prepare artifact ────────────────────
+	if err := rfs.VerifyLock(); err != nil {
+		ui.Error("Locked build", err)
+	}
+
 	// Always unmount and clean rootfs before packaging.
 	rfs.Unmount()
-	rfs.CleanupRootfs()
+	if err := rfs.CleanupRootfs(); err != nil {
+		ui.Error("Cleaning rootfs failed", err)
+	}
+	need, err := rfs.RemainingSpace(opts)
+	if err != nil {
+		ui.Error("Checking disk space", err)
+	}
+	if err := rootfs.CheckSpace(opts.WorkDir, filepath.Dir(outputPath), need); err != nil {
+		ui.Error("Not enough disk space", err)
+	}
+
+	// ── Step N-2 (optional): Check assertions on the finished rootfs ─────
+	if cfg.Assertions != nil {
+		ui.StepHeader(currentStep, totalSteps, "Checking image assertions...")
+		failures, err := policy.Check(rfs.Path, *cfg.Assertions)
+		if err != nil {
+			ui.Error("Checking assertions failed", err)
+		}
+		if len(failures) > 0 {
+			ui.Error("Image assertions failed", fmt.Errorf("%d problems:\n  - %s", len(failures), strings.Join(failures, "\n  - ")))
+		}
+		ui.Success("All assertions hold")
+		currentStep++
+	}
 
 	var stagingDir string
 
 	if cfg.OutputMode() == "disk" {
 		ui.StepHeader(currentStep, totalSteps, "Building disk image...")
-		if err := disk.Build(rfs.Path, outputPath, cfg.DiskSize()); err != nil {
-			ui.Error("Disk build failed", err)
+		opts := disk.Options{
+			Format:      cfg.DiskFormat(),
+			Size:        cfg.DiskSize(),
+			Filesystem:  cfg.RootFilesystem(),
+			Compression: cfg.RootCompression(),
+		}
+		if err := disk.Build(ctx, rfs.Path, outputPath, opts); err != nil {
+			ui.Error("Disk build failed", hostSec.Explain(err))
 		}
 		ui.Success("Disk image built")
+	} else if cfg.OutputMode() == "oci" {
+		ui.StepHeader(currentStep, totalSteps, "Building OCI image...")
+		if err := oci.Build(ctx, rfs.Path, outputPath, cfg.ImageRef(), cfg.LayerCompression()); err != nil {
+			ui.Error("OCI image build failed", err)
+		}
+		ui.Success("OCI image built")
+	} else if cfg.OutputMode() == "netboot" {
+		// Netboot needs no bootloader: iPXE loads the kernel directly.
+		ui.StepHeader(currentStep, totalSteps, "Creating squashfs image...")
+		stagingDir = filepath.Join(rfs.WorkDir, "staging")
+		if err := audit.MkdirAll(stagingDir, 0755); err != nil {
+			ui.Error("Creating staging directory", err)
+		}
+		if err := iso.MakeSquashfs(ctx, rfs.Path, filepath.Join(stagingDir, "rootfs.squashfs"), squashfsOptions(cfg)); err != nil {
+			ui.Error("Squashfs build failed", err)
+		}
+		ui.Success("Squashfs created")
 	} else {
 		ui.StepHeader(currentStep, totalSteps, "Setting up bootloader...")
 
 		stagingDir = filepath.Join(rfs.WorkDir, "staging")
-		if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		if err := audit.MkdirAll(stagingDir, 0755); err != nil {
 			ui.Error("Creating staging directory", err)
 		}
 
-		if cfg.Distro.Base == "fedora" {
-			kver, vmlinuz, initramfsFile, kErr := rfs.FedoraKernelFiles()
-			if kErr != nil {
-				ui.Error("Finding Fedora kernel files", kErr)
-			}
-			kf := bootloader.KernelFiles{
-				Version:   kver,
-				Vmlinuz:   vmlinuz,
-				Initramfs: initramfsFile,
-			}
-			if err := bootloader.SetupGrub(rfs.Path, stagingDir, kf); err != nil {
+		kernelFiles := rfs.AlpineKernelFiles
+		switch cfg.Distro.Base {
+		case "fedora":
+			kernelFiles = rfs.FedoraKernelFiles
+		case "debian":
+			kernelFiles = rfs.DebianKernelFiles
+		}
+		kver, vmlinuz, initramfsFile, kErr := kernelFiles()
+		if kErr != nil {
+			ui.Error("Finding kernel files", kErr)
+		}
+		kf := bootloader.KernelFiles{
+			Version:   kver,
+			Vmlinuz:   vmlinuz,
+			Initramfs: initramfsFile,
+		}
+		if cfg.Distro.Base == "fedora" || cfg.Distro.Base == "debian" {
+			if err := bootloader.SetupGrub(ctx, rfs.Path, stagingDir, kf, menu); err != nil {
 				ui.Error("Bootloader setup failed", err)
 			}
 		} else {
-			if err := bootloader.Setup(rfs.Path, stagingDir); err != nil {
+			if err := bootloader.Setup(rfs.Path, stagingDir, kf, menu); err != nil {
 				ui.Error("Bootloader setup failed", err)
 			}
 		}
+		if cfg.Boot != nil && cfg.Boot.UEFI {
+			if err := bootloader.SetupEFI(ctx, stagingDir, kf, menu); err != nil {
+				ui.Error("UEFI boot setup failed", err)
+			}
+		}
 		ui.Success("Bootloader configured")
 	}
 	currentStep++
 
 	// ── Step N: Build ISO (skipped in disk mode — already built above) ───
-	if cfg.OutputMode() != "disk" {
+	if cfg.OutputMode() == "netboot" {
+		ui.StepHeader(currentStep, totalSteps, "Building netboot layout...")
+		_, vmlinuz, initramfsFile, err := rfs.AlpineKernelFiles()
+		if err != nil {
+			ui.Error("Finding kernel files", err)
+		}
+		artifacts := netboot.Artifacts{
+			Kernel:    vmlinuz,
+			Initramfs: initramfsFile,
+			Squashfs:  filepath.Join(stagingDir, "rootfs.squashfs"),
+			Embed:     cfg.Build.NetbootEmbed,
+		}
+		if err := netboot.Build(artifacts, outputPath, cfg.Name, cfg.Build.NetbootBaseURL, cfg.KernelCmdline()); err != nil {
+			ui.Error("Netboot build failed", err)
+		}
+	} else if cfg.OutputMode() == "oci" {
+		if cfg.Build.Push {
+			ui.StepHeader(currentStep, totalSteps, "Pushing OCI image...")
+			if err := oci.Push(ctx, outputPath, cfg.ImageRef()); err != nil {
+				ui.Error("Image push failed", err)
+			}
+		}
+	} else if cfg.OutputMode() != "disk" {
 		ui.StepHeader(currentStep, totalSteps, "Building ISO...")
-		if cfg.Distro.Base == "fedora" {
-			if err := iso.BuildFedora(rfs.Path, stagingDir, outputPath); err != nil {
+		if cfg.Distro.Base == "fedora" || cfg.Distro.Base == "debian" {
+			if err := iso.BuildGrub(ctx, rfs.Path, stagingDir, outputPath, squashfsOptions(cfg)); err != nil {
 				ui.Error("ISO build failed", err)
 			}
 		} else {
-			if err := iso.Build(rfs.Path, stagingDir, outputPath); err != nil {
+			if err := iso.Build(ctx, rfs.Path, stagingDir, outputPath, squashfsOptions(cfg)); err != nil {
 				ui.Error("ISO build failed", err)
 			}
 		}
 	}
 
-	// ── Done ─────────────────────────────────────────────────────────────
+	if seedPath != "" {
+		files, err := cloudSeedFiles(cfg)
+		if err != nil {
+			ui.Error("Reading cloud-init seed", err)
+		}
+		if err := iso.BuildSeed(rfs.WorkDir, files, seedPath); err != nil {
+			ui.Error("Seed ISO build failed", err)
+		}
+		ui.AddArtifact("seed", "Seed ISO", seedPath)
+	}
+
+	if cfg.Hooks != nil {
+		if err := rfs.RunHooks("post_build", cfg.Hooks.PostBuild, "DISTRORUN_OUTPUT="+outputPath); err != nil {
+			ui.Error("Hook failed", err)
+		}
+	}
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			ui.Warn(err.Error())
+		}
+		requests, denied, hosts := capture.Summary()
+		ui.Info("Network", fmt.Sprintf("%d requests to %d hosts: %s", requests, len(hosts), strings.Join(hosts, ", ")))
+		if denied > 0 {
+			ui.Warn(fmt.Sprintf("%d requests refused by build.network.allow (see %s)", denied, networkPath))
+		}
+	}
+
+	// The host tools and files the build used, to explain images that
+	// differ between build machines.
+	prov, err := provenance.Collect(version, audit.Tools(), bootloader.HostFiles())
+	if err == nil {
+		prov.ImageVersion = cfg.ImageVersion
+		prov.Degradations = ui.Degradations()
+		err = prov.Write(provenancePath)
+	}
+	if err != nil {
+		// The image is finished; without provenance it is only harder to
+		// compare with other builds. A provenance left by an earlier build
+		// would describe the wrong one.
+		os.Remove(provenancePath)
+		ui.Degrade("provenance", err.Error())
+	} else {
+		ui.AddArtifact("provenance", "Provenance", provenancePath)
+	}
+	if d := ui.Degradations(); *strict && len(d) > 0 {
+		var features []string
+		for _, f := range d {
+			features = append(features, f.Feature)
+		}
+		ui.Error("Strict build", fmt.Errorf("optional features were skipped: %s (see %s)", strings.Join(features, ", "), provenancePath))
+	}
+
 	sbomPath := ""
 	if cfg.SBOMEnabled() {
 		sbomPath = strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-sbom.spdx.json"
 	}
+
+	// ── Step N+1 (optional): Boot test ───────────────────────────────────
+	// Runs before publishing so a broken image is never uploaded.
+	if *bootTest {
+		currentStep++
+		ui.StepHeader(currentStep, totalSteps, "Boot testing ISO under QEMU...")
+		logPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-console.log"
+		if err := boottest.Run(outputPath, boottest.Options{LogPath: logPath}); err != nil {
+			ui.InfoPath("Console log", logPath)
+			ui.Error("Boot test failed", err)
+		}
+		ui.Success("Boot test passed")
+	}
+
+	// ── Step N+2 (optional): Publish artifacts ───────────────────────────
+	if len(cfg.Publish) > 0 {
+		currentStep++
+		ui.StepHeader(currentStep, totalSteps, "Publishing artifacts...")
+		files, err := publish.Collect(outputPath, sbomPath, vulnsPath, auditPath, provenancePath, networkPath)
+		if err != nil {
+			ui.Error("Collecting artifacts failed", err)
+		}
+		sums, err := publish.WriteChecksums(files, outputPath+".sha256")
+		if err != nil {
+			ui.Error("Writing checksums failed", err)
+		}
+		files = append(files, sums)
+		vars := publish.Vars(cfg, *channel)
+		if err := publish.Upload(cfg.Publish, files, vars); err != nil {
+			ui.Error("Publishing failed", err)
+		}
+		if err := publish.UploadManifest(publish.ChannelTargets(cfg.Publish), files, vars); err != nil {
+			ui.Error("Publishing failed", err)
+		}
+		ui.Success(fmt.Sprintf("%d files published to %d targets", len(files), len(cfg.Publish)))
+	}
+
+	// ── Done ─────────────────────────────────────────────────────────────
 	var qemuCmd string
-	if cfg.OutputMode() == "disk" {
-		qemuCmd = "qemu-system-x86_64 -hda " + outputPath + " -m 1024 -enable-kvm"
-	} else {
+	switch cfg.OutputMode() {
+	case "disk":
+		qemuCmd = "qemu-system-x86_64 -drive file=" + outputPath + ",format=" + cfg.DiskFormat() + " -m 1024 -enable-kvm"
+	case "netboot":
+		qemuCmd = "serve " + outputPath + "/ over HTTP and chain boot.ipxe"
+	case "oci":
+		qemuCmd = "docker load -i " + outputPath + " && docker run -it --rm " + cfg.ImageRef()
+	default:
 		qemuCmd = "qemu-system-x86_64 -cdrom " + outputPath + " -m 512"
 	}
 	elapsed := time.Since(buildStart)
 	ui.PrintSummary(outputPath, sbomPath, qemuCmd, elapsed)
 }
 
-func runTest(args []string) {
-	fs := flag.NewFlagSet("test", flag.ExitOnError)
-	ram := fs.String("r", "512", "RAM in MB (default: 512)")
-	disk := fs.String("d", "", "Create and attach a virtual disk of this size (e.g. 8G)")
-	fs.Parse(args)
-
-	if fs.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: distrorun test <iso-file> [-r RAM_MB] [-d DISK_SIZE]")
-		os.Exit(1)
+// checkOffline fails the build before it starts when an offline build of
+// cfg with opts would need the network, listing everything missing.
+// bootstrap reports whether the rootfs is bootstrapped rather than
+// restored from a snapshot; a bundle brings its own package cache.
+func checkOffline(cfg *config.Config, opts rootfs.Options, bootstrap, fromBundle bool) {
+	if missing := offlineMissing(cfg, opts, bootstrap, fromBundle); len(missing) > 0 {
+		ui.Error("Offline build", fmt.Errorf("cannot build without the network:\n  %s", strings.Join(missing, "\n  ")))
 	}
+	ui.Success("Everything the offline build needs is available")
+}
 
-	isoPath := fs.Arg(0)
-	ui.PrintBanner(version)
-
-	// Check ISO exists
-	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
-		ui.Error("ISO not found", fmt.Errorf("%s does not exist", isoPath))
+// offlineMissing returns what checkOffline reports missing, one line each.
+func offlineMissing(cfg *config.Config, opts rootfs.Options, bootstrap, fromBundle bool) []string {
+	missing := rootfs.OfflineMissing(opts, bootstrap)
+	if opts.LocalMirror == "" && !fromBundle {
+		missing = append(missing, "distro.local_mirror: a local copy of the Alpine mirror to install packages from")
 	}
-
-	// Check QEMU is installed
-	qemuBin, err := exec.LookPath("qemu-system-x86_64")
-	if err != nil {
-		ui.Error("QEMU not found", fmt.Errorf("install with: sudo dnf install qemu-system-x86 (or sudo apt install qemu-system-x86)"))
+	branch := cfg.Distro.AlpineBranch()
+	if opts.Lock != nil {
+		branch = opts.Lock.Branch
 	}
+	if cfg.VulnScanEnabled() && opts.CacheDir != "" && strings.HasPrefix(branch, "v") {
+		for _, p := range vulnscan.MissingSecdb(opts.CacheDir, branch) {
+			missing = append(missing, "secdb: "+p)
+		}
+	}
+	if len(cfg.Publish) > 0 {
+		missing = append(missing, "publish: uploading needs the network")
+	}
+	if cfg.Build != nil && cfg.Build.Push {
+		missing = append(missing, "build.push: pushing needs the network")
+	}
+	return missing
+}
 
-	ui.StepHeader(1, 1, "Launching QEMU...")
-	ui.Info("ISO", isoPath)
-	ui.Info("RAM", *ram+" MB")
-
-	qemuArgs := []string{
-		"-cdrom", isoPath,
-		"-m", *ram,
-		"-boot", "d",
-		"-enable-kvm",
+// checkBuildDeps checks that the host has the tools a build of cfg runs.
+func checkBuildDeps(cfg *config.Config) error {
+	var err error
+	switch {
+	case cfg.OutputMode() == "disk":
+		err = disk.CheckDiskDeps(cfg.RootFilesystem())
+	case cfg.OutputMode() == "oci":
+		// The image is written with tar; only pushing needs another tool.
+		if cfg.Build.Push {
+			err = oci.CheckPushDeps()
+		}
+	case cfg.Distro.Base == "fedora":
+		err = iso.CheckFedoraDeps()
+	case cfg.Distro.Base == "debian":
+		err = iso.CheckDebianDeps()
+	default:
+		err = iso.CheckHostDeps()
+	}
+	if err == nil && cfg.Boot != nil && cfg.Boot.UEFI {
+		err = bootloader.CheckEFIDeps()
+	}
+	if err == nil && cfg.Build != nil && cfg.Build.Network != nil {
+		err = netcap.CheckDeps()
+	}
+	return err
+}
+
+// printBuildPlan prints what a build of cfg would do — its steps, the
+// packages it installs and the files it writes — without building,
+// mounting or writing anything.
+func printBuildPlan(cfg *config.Config, configPath, outputPath string, bootTest bool, channel string, locked, requireVersion bool) {
+	ui.StepHeader(1, 4, "Checking host dependencies...")
+	if err := checkBuildDeps(cfg); err != nil {
+		ui.Warn(err.Error())
+	} else {
+		ui.Success("All dependencies found")
+	}
+	if os.Getuid() != 0 {
+		ui.Detail("The build itself must run as root")
+	}
+
+	ui.StepHeader(2, 4, "Pipeline...")
+	distroName := map[string]string{"alpine": "Alpine", "debian": "Debian", "fedora": "Fedora"}[cfg.Distro.Base]
+	steps := []string{"Parse configuration", "Check host dependencies"}
+	switch cfg.OutputMode() {
+	case "disk":
+		steps = append(steps, "Bootstrap "+distroName+" rootfs (disk mode)")
+	case "oci":
+		steps = append(steps, "Bootstrap "+distroName+" rootfs (container mode)")
+	default:
+		steps = append(steps, "Bootstrap "+distroName+" rootfs")
+	}
+	steps = append(steps, "Install packages", "Set up users", "Enable services")
+	if len(cfg.Files) > 0 {
+		steps = append(steps, fmt.Sprintf("Install %d overlay entries", len(cfg.Files)))
+	}
+	if cfg.SBOMEnabled() {
+		steps = append(steps, "Generate SBOM")
+	}
+	if cfg.VulnScanEnabled() {
+		steps = append(steps, "Scan for known vulnerabilities")
+	}
+	if cfg.Assertions != nil {
+		steps = append(steps, "Check image assertions")
+	}
+	switch cfg.OutputMode() {
+	case "disk":
+		steps = append(steps, "Build "+cfg.DiskFormat()+" disk image")
+	case "oci":
+		steps = append(steps, "Build OCI image "+cfg.ImageRef())
+		if cfg.Build.Push {
+			steps = append(steps, "Push OCI image "+cfg.ImageRef())
+		}
+	case "netboot":
+		steps = append(steps, "Create squashfs image", "Build netboot layout")
+	default:
+		steps = append(steps, "Set up bootloader", "Build ISO")
+	}
+	if bootTest {
+		steps = append(steps, "Boot test the ISO under QEMU")
+	}
+	if len(cfg.Publish) > 0 {
+		steps = append(steps, fmt.Sprintf("Publish to %d targets (channel %s)", len(cfg.Publish), channel))
+	}
+	for i, step := range steps {
+		ui.Detail(fmt.Sprintf("%2d. %s", i+1, step))
+	}
+
+	ui.StepHeader(3, 4, "Packages...")
+	opts := rootfs.Options{
+		Context:      interruptContext(),
+		AlpineBranch: cfg.Distro.AlpineBranch(),
+		Mirror:       cfg.Distro.Mirror,
+		Repositories: cfg.Distro.Repositories,
+		Container:    cfg.OutputMode() == "oci",
+		VM:           cfg.Target == "vm",
+		Kernel:       cfg.Distro.Kernel,
+	}
+	if cfg.Reproducible() || locked {
+		lf, err := lockfile.Read(lockfile.Path(configPath))
+		if err != nil {
+			ui.Error("Locked build", fmt.Errorf("%w (create it with: distrorun lock %s)", err, configPath))
+		}
+		checkLockEngine(lf, configPath, requireVersion)
+		opts.Lock = lf
+	}
+	packages := rootfs.PlannedPackages(cfg.Distro.Base, opts, cfg.Packages)
+	var resolved []string
+	if cfg.Distro.Base == "alpine" {
+		var err error
+		if resolved, err = rootfs.ResolvePackages(opts, packages); err != nil {
+			ui.Warn("Versions not resolved: " + err.Error())
+		}
+	}
+	if resolved != nil {
+		for _, p := range resolved {
+			ui.Detail(p)
+		}
+		ui.Success(fmt.Sprintf("%d packages resolved from %d requested", len(resolved), len(packages)))
+	} else {
+		for _, p := range packages {
+			ui.Detail(p)
+		}
+		ui.Success(fmt.Sprintf("%d packages requested", len(packages)))
+	}
+
+	ui.StepHeader(4, 4, "Outputs...")
+	stem := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	ui.InfoPath("Output", outputPath)
+	ui.InfoPath("Audit", stem+"-audit.jsonl")
+	ui.InfoPath("Provenance", stem+"-provenance.json")
+	if cfg.CloudInitEnabled() && cfg.CloudInit.Seed != nil {
+		ui.InfoPath("Seed ISO", stem+"-seed.iso")
+	}
+	if cfg.SBOMEnabled() {
+		ui.InfoPath("SBOM", stem+"-sbom.spdx.json")
+	}
+	if cfg.VulnScanEnabled() {
+		ui.InfoPath("Vulnerabilities", stem+"-vulns.json")
+	}
+	if cfg.Build != nil && cfg.Build.Network != nil {
+		ui.InfoPath("Network log", stem+"-network.jsonl")
+	}
+	if bootTest {
+		ui.InfoPath("Console log", stem+"-console.log")
+	}
+	if len(cfg.Publish) > 0 {
+		ui.InfoPath("Checksums", outputPath+".sha256")
+	}
+	ui.Success("Dry run complete — nothing was built")
+}
+
+// runLock resolves every package a build of the config installs and
+// records the exact versions, with the minirootfs and a build timestamp, in
+// the lock file that build.reproducible builds follow.
+func runLock(args []string) {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	output := fs.String("o", "", "Lock file path (default: the config path with a .lock extension)")
+	mirror := fs.String("mirror", "", "Alpine mirror base URL, overriding distro.mirror")
+	templatesDir := fs.String("templates", "", "Directory of templates the builds from the lock use (see build -templates)")
+	keyring := fs.String("alpine-keyring", rootfs.DefaultAlpineKeyring, "OpenPGP keyring the downloaded minirootfs must be signed by (empty: do not check)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun lock <config.yaml> [-o config.lock] [-mirror URL] [-templates DIR] [-alpine-keyring FILE]")
+		os.Exit(1)
+	}
+
+	configPath := fs.Arg(0)
+	ui.PrintBanner(version)
+
+	if os.Getuid() != 0 {
+		ui.Error("This command must be run as root", fmt.Errorf("run with: sudo distrorun lock ..."))
+	}
+	if err := confine.CheckEngine(); err != nil {
+		ui.Error("Insufficient privileges", err)
+	}
+
+	ui.StepHeader(1, 3, "Parsing configuration...")
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	setMirror(cfg, *mirror)
+	loadTemplates(*templatesDir)
+	if cfg.Distro.Base != "alpine" {
+		ui.Error("Unsupported distro", fmt.Errorf("lock files are only supported for alpine, not %s", cfg.Distro.Base))
+	}
+	outputPath := *output
+	if outputPath == "" {
+		outputPath = lockfile.Path(configPath)
+	}
+	if err := checkOutputPaths(configPath, outputPath); err != nil {
+		ui.Error("Invalid output path", err)
+	}
+	epoch := time.Now().Unix()
+	if v, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil && v > 0 {
+		epoch = v
+	}
+	ui.Info("Config", cfg.Name)
+
+	// Resolve packages the way a build does, against the current mirror.
+	ui.StepHeader(2, 3, "Resolving packages...")
+	ctx := interruptContext()
+	lock, err := rootfs.Lock(cfg.Name)
+	if err != nil {
+		ui.Error("Acquiring build lock", err)
+	}
+	defer lock.Unlock()
+	configHash, err := fileHash(configPath)
+	if err != nil {
+		ui.Error("Reading configuration", err)
+	}
+	rfs, err := rootfs.Bootstrap(cfg.Name, rootfs.Options{
+		Context:         ctx,
+		CacheDir:        rootfs.DefaultCacheDir,
+		AlpineBranch:    cfg.Distro.AlpineBranch(),
+		Mirror:          cfg.Distro.Mirror,
+		Repositories:    cfg.Distro.Repositories,
+		AlpineKeyring:   *keyring,
+		ConfigHash:      configHash,
+		WorkDir:         os.Getenv("DISTRORUN_WORKDIR"),
+		Disk:            cfg.OutputMode() == "disk",
+		Container:       cfg.OutputMode() == "oci",
+		VM:              cfg.Target == "vm",
+		Kernel:          cfg.Distro.Kernel,
+		Cmdline:         cfg.KernelCmdline(),
+		NonfatalScripts: cfg.NonfatalScripts(),
+		LocalMirror:     cfg.Distro.LocalMirror,
+	})
+	if err != nil {
+		ui.Error("Bootstrap failed", err)
+	}
+	defer rfs.Cleanup(true)
+	ui.AtExit(func() { rfs.Cleanup(true) })
+	installConfigured(rfs, cfg)
+	if cfg.Hooks != nil {
+		if err := rfs.RunHooks("post_packages", cfg.Hooks.PostPackages); err != nil {
+			ui.Error("Hook failed", err)
+		}
+	}
+	lf, err := rfs.LockFile(epoch)
+	if err != nil {
+		ui.Error("Reading installed packages", err)
+	}
+	lf.DistroRun = version
+	lf.Templates = lockfile.HashTemplates(engineTemplates())
+	ui.Success(fmt.Sprintf("%d packages resolved", len(lf.Packages)))
+
+	ui.StepHeader(3, 3, "Writing lock file...")
+	if err := lf.Write(outputPath); err != nil {
+		ui.Error("Writing lock file", err)
+	}
+	ui.Info("Branch", lf.Branch)
+	ui.Info("Minirootfs", lf.Minirootfs)
+	ui.InfoPath("Lock file", outputPath)
+	ui.Success("Lock file ready — set build.reproducible: true and build with: distrorun build " + configPath)
+}
+
+// engineTemplates returns the built-in templates of this distrorun whose
+// checksums lock files record.
+func engineTemplates() map[string]string {
+	templates := rootfs.Templates()
+	maps.Copy(templates, bootloader.Templates())
+	return templates
+}
+
+// checkLockEngine stops a reproducible build whose lock file was written
+// by another distrorun version or with other built-in templates, which
+// would change the image as much as another package version. With require
+// false the differences are only warned about.
+func checkLockEngine(lf *lockfile.File, configPath string, require bool) {
+	if lf.DistroRun == "" {
+		ui.Warn("The lock file does not record the distrorun version; regenerate it with: distrorun lock " + configPath)
+		return
+	}
+	diffs := lf.CheckEngine(version, lockfile.HashTemplates(engineTemplates()))
+	if len(diffs) == 0 {
+		return
+	}
+	if require {
+		ui.Error("Reproducible build", fmt.Errorf("the lock file does not match this distrorun: %s (regenerate it with: distrorun lock %s, or pass -require-version=false)", strings.Join(diffs, "; "), configPath))
+	}
+	for _, d := range diffs {
+		ui.Warn("Lock file: " + d)
+	}
+}
+
+// bootEntries returns the boot menu of a live image: a single entry, or
+// one per live.input keyboard layout, and with boot.toram the default
+// entry once more, copying the root filesystem into memory, and with
+// boot.serial_console once more on the serial console.
+func bootEntries(cfg *config.Config) []bootloader.Entry {
+	label := func(detail string) string {
+		if detail == "" {
+			return "DistroRun Live"
+		}
+		return "DistroRun Live (" + detail + ")"
+	}
+	cmdline := cfg.KernelCmdline()
+	var details, cmdlines []string
+	if cfg.Live == nil || len(cfg.Live.Input) == 0 {
+		details, cmdlines = []string{""}, []string{cmdline}
+	} else {
+		for _, in := range cfg.Live.Input {
+			c := cmdline + " keymap=" + in.Keymap
+			if in.Font != "" {
+				c += " font=" + in.Font
+			}
+			details = append(details, in.MenuLabel())
+			cmdlines = append(cmdlines, c)
+		}
+	}
+	var entries []bootloader.Entry
+	for i := range details {
+		entries = append(entries, bootloader.Entry{Label: label(details[i]), Cmdline: cmdlines[i]})
+	}
+	if cfg.Boot != nil && cfg.Boot.Toram {
+		detail := "copy to RAM"
+		if details[0] != "" {
+			detail = details[0] + ", " + detail
+		}
+		entries = append(entries, bootloader.Entry{Label: label(detail), Cmdline: cmdlines[0] + " distrorun.toram"})
+	}
+	if cfg.Boot != nil && cfg.Boot.SerialConsole {
+		detail := "serial console"
+		if details[0] != "" {
+			detail = details[0] + ", " + detail
+		}
+		entries = append(entries, bootloader.Entry{Label: label(detail), Cmdline: cmdlines[0] + " console=ttyS0,115200", Serial: true})
+	}
+	return entries
+}
+
+// bootMenu returns the boot menu of a live image: the entries of
+// bootEntries, then those of boot.menu, with its title, timeout and
+// default entry.
+func bootMenu(cfg *config.Config) (bootloader.Menu, error) {
+	m := bootloader.Menu{Entries: bootEntries(cfg)}
+	if b := cfg.Branding; b != nil {
+		m.Splash = b.Splash
+		if b.Colors != nil {
+			m.Colors = bootloader.Colors(*b.Colors)
+		}
+	}
+	if cfg.Boot == nil || cfg.Boot.Menu == nil {
+		return m, nil
+	}
+	bm := cfg.Boot.Menu
+	m.Title, m.Timeout = bm.Title, bm.Timeout
+	cmdline := cfg.KernelCmdline()
+	for _, e := range bm.Entries {
+		c := cmdline
+		if e.Cmdline != "" {
+			c += " " + e.Cmdline
+		}
+		m.Entries = append(m.Entries, bootloader.Entry{Label: e.Label, Cmdline: c})
+	}
+	if bm.Default == "" {
+		return m, nil
+	}
+	var labels []string
+	for i, e := range m.Entries {
+		if e.Label == bm.Default {
+			m.Default = i
+			return m, nil
+		}
+		labels = append(labels, strconv.Quote(e.Label))
+	}
+	return m, fmt.Errorf("boot.menu.default %q is not an entry of the menu: %s", bm.Default, strings.Join(labels, ", "))
+}
+
+// squashfsOptions returns the mksquashfs settings of build.squashfs.
+func squashfsOptions(cfg *config.Config) iso.SquashfsOptions {
+	sq := cfg.SquashfsSettings()
+	return iso.SquashfsOptions{Compression: sq.Compression, Level: sq.Level, Threads: sq.Threads}
+}
+
+// cloudSeedFiles returns the files of the NoCloud seed ISO of cfg: its
+// user-data and network-config, and meta-data naming the instance after
+// the image.
+func cloudSeedFiles(cfg *config.Config) (map[string][]byte, error) {
+	seed := cfg.CloudInit.Seed
+	userData, err := os.ReadFile(seed.UserData)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{
+		"user-data": userData,
+		"meta-data": fmt.Appendf(nil, "instance-id: %s\nlocal-hostname: %s\n", cfg.Name, cfg.Hostname()),
+	}
+	if seed.NetworkConfig != "" {
+		if files["network-config"], err = os.ReadFile(seed.NetworkConfig); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// installConfigured installs every package a build of cfg installs, in the
+// same order, without the rest of the build. It is how bundle and lock
+// resolve the package set of a configuration.
+func installConfigured(rfs *rootfs.Rootfs, cfg *config.Config) {
+	if err := rfs.InstallPackages(cfg.Packages); err != nil {
+		ui.Error("Package installation failed", err)
+	}
+	if cfg.BaseData != nil {
+		if err := rfs.RefreshBaseData(*cfg.BaseData); err != nil {
+			ui.Error("Base data refresh failed", err)
+		}
+	}
+	if err := rfs.SetupUsers(cfg.Users); err != nil {
+		ui.Error("User setup failed", err)
+	}
+	if cfg.OutputMode() == "disk" {
+		if err := rfs.ConfigureRootFilesystem(cfg.RootFilesystem()); err != nil {
+			ui.Error("Root filesystem setup failed", err)
+		}
+		if err := rfs.InstallGrowRoot(); err != nil {
+			ui.Error("Root expansion setup failed", err)
+		}
+	}
+	if cfg.WizardEnabled() {
+		if err := rfs.InstallWizard(cfg.Firstboot.Language); err != nil {
+			ui.Error("First-boot wizard setup failed", err)
+		}
+	}
+	if cfg.System != nil && cfg.System.Timezone != "" {
+		if err := rfs.SetTimezone(cfg.System.Timezone); err != nil {
+			ui.Error("Time zone setup failed", err)
+		}
+	}
+	if cfg.System != nil && cfg.System.Keymap != "" {
+		if err := rfs.SetKeymap(cfg.System.Keymap); err != nil {
+			ui.Error("Keymap setup failed", err)
+		}
+	}
+	if cfg.Live != nil && len(cfg.Live.Input) > 0 {
+		if err := rfs.InstallInputSwitcher(cfg.Live.Input); err != nil {
+			ui.Error("Keyboard layout setup failed", err)
+		}
+	}
+	// Network, access point, VPN, management, watchdog and update setup
+	// install packages of their own.
+	if cfg.Network != nil {
+		if err := rfs.ConfigureInterfaces(cfg.Network.Interfaces); err != nil {
+			ui.Error("Network setup failed", err)
+		}
+	}
+	if cfg.AP != nil {
+		if err := rfs.ConfigureAccessPoint(*cfg.AP); err != nil {
+			ui.Error("Access point setup failed", err)
+		}
+	}
+	if cfg.VPN != nil && cfg.VPN.WireGuard != nil {
+		if err := rfs.ConfigureWireGuard(*cfg.VPN.WireGuard); err != nil {
+			ui.Error("WireGuard setup failed", err)
+		}
+	}
+	if cfg.ManagementEnabled() {
+		if err := rfs.ConfigureManagement(*cfg.Management); err != nil {
+			ui.Error("Remote management setup failed", err)
+		}
+	}
+	if cfg.CloudInitEnabled() {
+		if err := rfs.ConfigureCloudInit(cfg.CloudTool(), cfg.CloudInit.CloudDatasources()); err != nil {
+			ui.Error("cloud-init setup failed", err)
+		}
+	}
+	if cfg.WatchdogEnabled() {
+		if err := rfs.ConfigureWatchdog(*cfg.System.Watchdog, nil); err != nil {
+			ui.Error("Watchdog setup failed", err)
+		}
+	}
+	if cfg.Updates != nil {
+		if err := rfs.ConfigureUpdates(*cfg.Updates, cfg.ImageVersion); err != nil {
+			ui.Error("Update policy setup failed", err)
+		}
+	}
+}
+
+// interruptContext returns a context canceled by the first SIGINT or
+// SIGTERM. Canceling kills the command running in the rootfs, so the step
+// fails and ui.Error runs the cleanup registered with ui.AtExit: mounts are
+// undone before the workdir is removed. A second signal exits at once and
+// leaves the workdir for the next build to clean up.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		ui.Warn(fmt.Sprintf("Received %s, stopping the build (repeat to exit immediately)", sig))
+		cancel()
+		<-sigs
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// fileHash returns the hex SHA-256 of a file's contents.
+func fileHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadTemplates applies the -templates flag: the files of dir replace the
+// built-in templates of the same name.
+func loadTemplates(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := templates.Load(dir); err != nil {
+		ui.Error("Invalid templates", err)
+	}
+	ui.Info("Templates", strings.Join(templates.Overridden(), ", ")+" from "+dir)
+}
+
+// setMirror applies the -mirror flag, which overrides distro.mirror.
+func setMirror(cfg *config.Config, mirror string) {
+	if mirror == "" {
+		return
+	}
+	cfg.Distro.Mirror = mirror
+	if err := cfg.Validate(); err != nil {
+		ui.Error("Invalid -mirror", err)
+	}
+}
+
+// setLimits applies the -nice, -cpus, -memory and -io flags, which override
+// the fields of build.limits.
+func setLimits(cfg *config.Config, nice int, cpus, memory, ioClass string) {
+	if nice == 0 && cpus == "" && memory == "" && ioClass == "" {
+		return
+	}
+	if cfg.Build == nil {
+		cfg.Build = &config.Build{}
+	}
+	if cfg.Build.Limits == nil {
+		cfg.Build.Limits = &config.Limits{}
+	}
+	l := cfg.Build.Limits
+	if nice != 0 {
+		l.Nice = nice
+	}
+	if cpus != "" {
+		l.CPUs = cpus
+	}
+	if memory != "" {
+		l.Memory = memory
+	}
+	if ioClass != "" {
+		l.IO = ioClass
+	}
+	if err := cfg.Validate(); err != nil {
+		ui.Error("Invalid resource limit flags", err)
+	}
+}
+
+// applyLimits makes the helper processes of the build run with l, which
+// Validate has checked.
+func applyLimits(l *config.Limits) {
+	var set limits.Limits
+	var desc []string
+	if l.Nice != 0 {
+		set.Nice = l.Nice
+		desc = append(desc, fmt.Sprintf("nice %d", l.Nice))
+	}
+	if l.CPUs != "" {
+		set.CPUs, _ = config.ParseCPUList(l.CPUs)
+		desc = append(desc, "CPUs "+l.CPUs)
+	}
+	if l.Memory != "" {
+		set.Memory, _ = config.ParseSize(l.Memory)
+		desc = append(desc, "memory "+l.Memory)
+	}
+	if l.IO != "" {
+		set.IO = l.IO
+		desc = append(desc, "I/O "+l.IO)
+	}
+	if err := limits.Set(set); err != nil {
+		ui.Error("Applying build.limits", err)
+	}
+	if len(desc) > 0 {
+		ui.Info("Limits", strings.Join(desc, ", "))
+	}
+}
+
+// checkOutputPaths makes sure no file a command writes is its own config
+// file or another of its outputs, e.g. after "-o distrorun.yaml" or
+// "-o web-audit.jsonl". Paths are compared after resolving them, and by
+// inode when they exist.
+func checkOutputPaths(configPath string, outputs ...string) error {
+	all := append([]string{configPath}, outputs...)
+	for i, p := range all {
+		for _, q := range all[:i] {
+			if samePath(p, q) {
+				if q == configPath {
+					return fmt.Errorf("%s would overwrite the config file %s", p, configPath)
+				}
+				return fmt.Errorf("%s would be written twice; choose another output path", p)
+			}
+		}
+	}
+	return nil
+}
+
+// samePath reports whether a and b name the same file.
+func samePath(a, b string) bool {
+	if ai, err := os.Stat(a); err == nil {
+		if bi, err := os.Stat(b); err == nil {
+			return os.SameFile(ai, bi)
+		}
+	}
+	aa, err1 := filepath.Abs(a)
+	ba, err2 := filepath.Abs(b)
+	return err1 == nil && err2 == nil && aa == ba
+}
+
+// runValidate loads and validates a config without building anything.
+// It does not require root, so it can run early in CI pipelines.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun validate <config.yaml>")
+		os.Exit(1)
+	}
+
+	configPath := fs.Arg(0)
+
+	unknown, err := config.UnknownKeys(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	for _, key := range unknown {
+		ui.Warn(fmt.Sprintf("unknown key %q (ignored)", key))
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	warnOutdated(cfg, configPath)
+	for _, svc := range cfg.UnknownServices() {
+		ui.Warn(fmt.Sprintf("service %q is not one distrorun translates between distributions: it must be the name of its init script or unit on %s", svc, cfg.Distro.Base))
+	}
+	ui.Success(fmt.Sprintf("%s is valid (%s, base: %s)", configPath, cfg.Name, cfg.Distro.Base))
+}
+
+// runLint checks a config against the best-practice rules of package lint,
+// and exits 1 when it breaks any.
+func runLint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format: text, or json for a findings document on stdout")
+	var disable stringList
+	fs.Var(&disable, "disable", "Do not check this rule (repeatable), besides those of lint.disable")
+	listRules := fs.Bool("rules", false, "List the rules and exit")
+	resolve := fs.Bool("resolve", false, "Fetch the Alpine package indexes to check the size of every package's dependencies")
+	fs.Parse(args)
+
+	if *listRules {
+		for _, r := range lint.Rules {
+			fmt.Printf("%-20s %s\n", r.Name, r.Description)
+		}
+		return
+	}
+	if fs.NArg() != 1 || (*format != "text" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun lint [-format text|json] [-disable RULE]... [-resolve] [-rules] <config.yaml>")
+		os.Exit(1)
+	}
+	configPath := fs.Arg(0)
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	_, err = os.Stat(lockfile.Path(configPath))
+	lintOpts := lint.Options{Locked: err == nil, Disable: disable}
+	if *resolve && cfg.Distro.Base == "alpine" {
+		opts := rootfs.Options{
+			Context:      interruptContext(),
+			AlpineBranch: cfg.Distro.AlpineBranch(),
+			Mirror:       cfg.Distro.Mirror,
+			Repositories: cfg.Distro.Repositories,
+			Container:    cfg.OutputMode() == "oci",
+			VM:           cfg.Target == "vm",
+			Kernel:       cfg.Distro.Kernel,
+		}
+		if lintOpts.Index, err = rootfs.FetchIndex(opts); err != nil {
+			ui.Error("Fetching the package indexes", err)
+		}
+		lintOpts.Base = rootfs.PlannedPackages(cfg.Distro.Base, opts, nil)
+	}
+	findings, err := lint.Run(cfg, lintOpts)
+	if err != nil {
+		ui.Error("Lint failed", err)
+	}
+
+	if *format == "json" {
+		if findings == nil {
+			findings = []lint.Finding{} // "findings": [] rather than null
+		}
+		data, err := json.MarshalIndent(struct {
+			Findings []lint.Finding `json:"findings"`
+		}{findings}, "", "  ")
+		if err != nil {
+			ui.Error("Lint failed", err)
+		}
+		fmt.Println(string(data))
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	for _, f := range findings {
+		ui.Warn(f.Message + " [" + f.Rule + "]")
+	}
+	if len(findings) > 0 {
+		ui.Error("Lint", fmt.Errorf("%s breaks %d best-practice rules (disable one with -disable or lint.disable)", configPath, len(findings)))
+	}
+	ui.Success(configPath + " follows every lint rule")
+}
+
+// warnOutdated warns if the config uses an older schema version, which
+// builds upgrade in memory on every run.
+func warnOutdated(cfg *config.Config, configPath string) {
+	from, notes, outdated := cfg.Outdated()
+	if !outdated {
+		return
+	}
+	ui.Warn(fmt.Sprintf("config version %d is outdated (current: %d); upgrade it with 'distrorun migrate %s'", from, config.CurrentVersion, configPath))
+	for _, n := range notes {
+		ui.Detail(n)
+	}
+}
+
+// runMigrate upgrades a config file to the current schema version, keeping
+// the original as <config>.bak.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	output := fs.String("o", "", "Write the upgraded config here instead of replacing the file (- for stdout)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun migrate [-o FILE] <config.yaml>")
+		os.Exit(1)
+	}
+	configPath := fs.Arg(0)
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		ui.Error("Reading configuration", err)
+	}
+	upgraded, from, notes, err := config.Migrate(data)
+	if err != nil {
+		ui.Error("Migration failed", err)
+	}
+	if *output == "-" {
+		os.Stdout.Write(upgraded)
+		return
+	}
+	if from == config.CurrentVersion && *output == "" {
+		ui.Success(fmt.Sprintf("%s is already at config version %d", configPath, config.CurrentVersion))
+		return
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		ui.Error("Reading configuration", err)
+	}
+	dest := *output
+	if dest == "" {
+		dest = configPath
+		if err := os.WriteFile(configPath+".bak", data, info.Mode().Perm()); err != nil {
+			ui.Error("Writing backup", err)
+		}
+		ui.InfoPath("Backup", configPath+".bak")
+	}
+	if err := os.WriteFile(dest, upgraded, info.Mode().Perm()); err != nil {
+		ui.Error("Writing configuration", err)
+	}
+	for _, n := range notes {
+		ui.Detail(n)
+	}
+	ui.Success(fmt.Sprintf("Upgraded %s from config version %d to %d", dest, from, config.CurrentVersion))
+}
+
+// runInit writes a starter configuration, asking for its settings with
+// -interactive.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("o", "distrorun.yaml", "Configuration file to write")
+	interactive := fs.Bool("interactive", false, "Ask for the image name, packages, users, services and output format")
+	force := fs.Bool("force", false, "Overwrite an existing file")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun init [-interactive] [-o config.yaml] [-force]")
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*output); err == nil && !*force {
+		ui.Error("Not overwriting "+*output, fmt.Errorf("pass -force to replace it"))
+	}
+
+	answers := scaffold.Defaults("my-os")
+	if *interactive {
+		var readPassword func() (string, error)
+		if term.IsTerminal(os.Stdin.Fd()) {
+			readPassword = func() (string, error) {
+				pw, err := term.ReadPassword(os.Stdin.Fd())
+				return string(pw), err
+			}
+		}
+		var err error
+		answers, err = scaffold.Interview(scaffold.NewPrompter(os.Stdin, os.Stdout, readPassword), answers)
+		if err != nil {
+			ui.Error("Interview aborted", err)
+		}
+		fmt.Println()
+	}
+
+	data, err := scaffold.Render(answers)
+	if err != nil {
+		ui.Error("Invalid configuration", err)
+	}
+	// The file holds passwords.
+	if err := os.WriteFile(*output, data, 0600); err != nil {
+		ui.Error("Writing configuration", err)
+	}
+	ui.Success("Wrote " + *output)
+	if !*interactive {
+		ui.Detail("change the root password before building")
+	}
+	ui.Detail("build it with: sudo distrorun build " + *output)
+}
+
+// runAddon dispatches the add-on subcommands.
+func runAddon(args []string) {
+	if len(args) < 1 || args[0] != "install" {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun add-on install [-registry URL] [-key FILE] [-dir DIR] <name>")
+		os.Exit(1)
+	}
+	runAddonInstall(args[1:])
+}
+
+// runAddonInstall downloads a signed add-on from a registry into the add-on
+// directory next to the configuration.
+func runAddonInstall(args []string) {
+	fs := flag.NewFlagSet("add-on install", flag.ExitOnError)
+	registry := fs.String("registry", os.Getenv(addon.RegistryEnv), "Registry URL (default: $"+addon.RegistryEnv+")")
+	var keys stringList
+	fs.Var(&keys, "key", "Trusted public key file or directory (repeatable; default: "+addon.DefaultKeyDir+")")
+	dir := fs.String("dir", config.AddonDir, "Directory add-ons are installed into")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun add-on install [-registry URL] [-key FILE] [-dir DIR] <name>")
+		os.Exit(1)
+	}
+	name := fs.Arg(0)
+	if *registry == "" {
+		ui.Error("No registry", fmt.Errorf("pass -registry URL or set %s", addon.RegistryEnv))
+	}
+	if len(keys) == 0 {
+		keys = stringList{addon.DefaultKeyDir}
+	}
+
+	trusted, err := addon.LoadKeys(keys...)
+	if err != nil {
+		ui.Error("Loading trusted keys", err)
+	}
+	ui.SubStep(fmt.Sprintf("Downloading %s from %s...", name, *registry))
+	archive, sig, err := addon.Fetch(*registry, name)
+	if err != nil {
+		ui.Error("Download failed", err)
+	}
+	if err := addon.Verify(archive, sig, trusted); err != nil {
+		ui.Error("Signature check failed", err)
+	}
+	ui.Detail("signature verified")
+	a, err := addon.Install(archive, name, *dir)
+	if err != nil {
+		ui.Error("Install failed", err)
+	}
+	installed := a.Name
+	if a.Version != "" {
+		installed += " " + a.Version
+	}
+	ui.Success(fmt.Sprintf("Installed add-on %s into %s", installed, filepath.Join(*dir, a.Name)))
+	if a.Description != "" {
+		ui.Detail(a.Description)
+	}
+	ui.Detail(fmt.Sprintf("enable it by adding %q to \"addons\" in the configuration", a.Name))
+}
+
+// runPublish uploads artifacts to a GitHub or GitLab release, with release
+// notes generated from the package diff between two SBOMs.
+func runPublish(args []string) {
+	usage := "Usage: distrorun publish <github|gitlab> -tag <tag> [-repo REPO] [-previous-sbom FILE] <artifact>..."
+	if len(args) < 1 || (args[0] != "github" && args[0] != "gitlab") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	forge := args[0]
+
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	tag := fs.String("tag", "", "Release tag (required)")
+	name := fs.String("name", "", "Release title (default: tag)")
+	repo := fs.String("repo", "", "owner/name on GitHub or project path on GitLab (default: from CI environment)")
+	sbomFile := fs.String("sbom", "", "SBOM of this release (default: the *-sbom.spdx.json artifact)")
+	prevSBOM := fs.String("previous-sbom", "", "SBOM of the previous release, for the package diff")
+	ref := fs.String("ref", os.Getenv("CI_COMMIT_SHA"), "GitLab: commit to tag if the tag does not exist")
+	fs.Parse(args[1:])
+
+	if *tag == "" || fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	ui.PrintBanner(version)
+
+	rel := publish.Release{Repo: *repo, Tag: *tag, Name: *name, Ref: *ref}
+	if forge == "github" {
+		rel.Token = os.Getenv("GITHUB_TOKEN")
+		rel.API = os.Getenv("GITHUB_API_URL")
+		if rel.Repo == "" {
+			rel.Repo = os.Getenv("GITHUB_REPOSITORY")
+		}
+	} else {
+		rel.Token = os.Getenv("GITLAB_TOKEN")
+		rel.API = os.Getenv("CI_API_V4_URL")
+		if rel.Repo == "" {
+			rel.Repo = os.Getenv("CI_PROJECT_PATH")
+		}
+	}
+	if rel.Token == "" {
+		ui.Error("Missing token", fmt.Errorf("set %s_TOKEN in the environment", strings.ToUpper(forge)))
+	}
+	if rel.Repo == "" {
+		ui.Error("Missing repository", fmt.Errorf("pass -repo or run inside %s CI", forge))
+	}
+
+	for _, p := range fs.Args() {
+		files, err := publish.Collect(p)
+		if err != nil {
+			ui.Error("Collecting artifacts failed", err)
+		}
+		rel.Files = append(rel.Files, files...)
+		if *sbomFile == "" && strings.HasSuffix(p, "-sbom.spdx.json") {
+			*sbomFile = p
+		}
+	}
+
+	if *sbomFile != "" {
+		notes, err := sbom.ReleaseNotes(*prevSBOM, *sbomFile)
+		if err != nil {
+			ui.Error("Generating release notes failed", err)
+		}
+		rel.Notes = notes
+	} else {
+		ui.Warn("No SBOM among the artifacts — release notes will be empty")
+	}
+
+	var err error
+	if forge == "github" {
+		err = publish.GitHub(rel)
+	} else {
+		err = publish.GitLab(rel)
+	}
+	if err != nil {
+		ui.Error("Publishing release failed", err)
+	}
+	ui.Success(fmt.Sprintf("%d artifacts published to %s release %s", len(rel.Files), forge, *tag))
+}
+
+// publishedSuffixes name the files a build publishes next to its
+// artifact, after the artifact's name without its extension: the SBOM,
+// vulnerability report, audit log, provenance and network log.
+var publishedSuffixes = []string{"-sbom.spdx.json", "-vulns.json", "-audit.jsonl", "-provenance.json", "-network.jsonl"}
+
+// runPromote publishes an already built artifact to another release
+// channel: to the {channel} paths of the config's publish targets, with
+// the channel manifest pointing at it.
+func runPromote(args []string) {
+	usage := "Usage: distrorun promote -to <channel> <config.yaml> <artifact>"
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	to := fs.String("to", "", "Channel to promote the artifact to, e.g. prod (required)")
+	fs.Parse(args)
+	if *to == "" || fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if err := publish.CheckChannel(*to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	configPath, artifact := fs.Arg(0), fs.Arg(1)
+
+	ui.PrintBanner(version)
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	targets := publish.ChannelTargets(cfg.Publish)
+	if len(targets) == 0 {
+		ui.Error("Nothing to promote to", fmt.Errorf("no publish target of %s has a {channel} placeholder in its path", configPath))
+	}
+
+	// The artifact goes out with the files published next to it by the
+	// build, and only if they still match its checksums.
+	stem := strings.TrimSuffix(artifact, filepath.Ext(artifact))
+	var extra []string
+	for _, suffix := range publishedSuffixes {
+		extra = append(extra, stem+suffix)
+	}
+	files, err := publish.Collect(artifact, extra...)
+	if err != nil {
+		ui.Error("Collecting artifacts failed", err)
+	}
+	if _, err := os.Stat(artifact + ".sha256"); err == nil {
+		if err := publish.VerifyChecksums(artifact+".sha256", files); err != nil {
+			ui.Error("Artifact does not match its checksums", err)
+		}
+	}
+	sums, err := publish.WriteChecksums(files, artifact+".sha256")
+	if err != nil {
+		ui.Error("Writing checksums failed", err)
+	}
+	files = append(files, sums)
+
+	ui.StepHeader(1, 1, fmt.Sprintf("Promoting %s to %s...", filepath.Base(artifact), *to))
+	vars := publish.PromoteVars(cfg, *to, stem+"-provenance.json")
+	if err := publish.Upload(targets, files, vars); err != nil {
+		ui.Error("Promotion failed", err)
+	}
+	if err := publish.UploadManifest(targets, files, vars); err != nil {
+		ui.Error("Promotion failed", err)
+	}
+	ui.Success(fmt.Sprintf("%s promoted to %s on %d targets", filepath.Base(artifact), *to, len(targets)))
+}
+
+// runPrune removes old artifacts from output directories and the download
+// cache according to a retention policy.
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	keepLast := fs.Int("keep-last", 0, "Keep the N newest artifacts")
+	maxAge := fs.String("max-age", "", "Keep artifacts younger than AGE (e.g. 72h, 30d)")
+	var pins stringList
+	fs.Var(&pins, "pin", "Keep artifacts whose name matches GLOB (repeatable)")
+	withCache := fs.Bool("cache", false, "Also prune the download cache")
+	cacheDir := fs.String("cache-dir", rootfs.DefaultCacheDir, "Download cache directory")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be removed")
+	fs.Parse(args)
+
+	policy := prune.Policy{KeepLast: *keepLast, Pins: pins}
+	if *maxAge != "" {
+		d, err := config.ParseAge(*maxAge)
+		if err != nil {
+			ui.Error("Invalid -max-age", err)
+		}
+		policy.MaxAge = d
+	}
+
+	dirs := fs.Args()
+	var cacheDirs []string
+	if *withCache {
+		// Each cache subdirectory (e.g. minirootfs/x86_64, apk/x86_64)
+		// is pruned on its own so one kind of artifact cannot evict another.
+		cacheDirs, _ = filepath.Glob(filepath.Join(*cacheDir, "*", "*"))
+		dirs = append(dirs, cacheDirs...)
+	}
+	if len(dirs) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun prune [-keep-last N] [-max-age AGE] [-pin GLOB] [-cache] [-dry-run] [dir...]")
+		os.Exit(1)
+	}
+
+	var freed int64
+	var removed int
+	for _, dir := range dirs {
+		plan := prune.Plan
+		if slices.Contains(cacheDirs, dir) {
+			plan = prune.PlanCache
+		}
+		groups, err := plan(dir, policy, time.Now())
+		if err != nil {
+			ui.Error("Prune failed", err)
+		}
+		if len(groups) == 0 {
+			continue
+		}
+		ui.SubStep(dir)
+		for _, g := range groups {
+			ui.Detail(fmt.Sprintf("%s (%.1f MB, %s)", g.Name, float64(g.Size)/1024/1024, g.ModTime.Format("2006-01-02")))
+			freed += g.Size
+			removed++
+		}
+		if !*dryRun {
+			if err := prune.Remove(groups); err != nil {
+				ui.Error("Prune failed", err)
+			}
+		}
+	}
+
+	if *dryRun {
+		ui.Success(fmt.Sprintf("Would remove %d artifacts (%.1f MB)", removed, float64(freed)/1024/1024))
+	} else {
+		ui.Success(fmt.Sprintf("Removed %d artifacts (%.1f MB)", removed, float64(freed)/1024/1024))
+	}
+}
+
+func runBundle(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	output := fs.String("o", "", "Bundle path (default: <name>-bundle.tar.gz)")
+	mirror := fs.String("mirror", "", "Alpine mirror base URL, overriding distro.mirror")
+	keyring := fs.String("alpine-keyring", rootfs.DefaultAlpineKeyring, "OpenPGP keyring the downloaded minirootfs must be signed by (empty: do not check)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun bundle <config.yaml> [-o bundle.tar.gz] [-mirror URL] [-alpine-keyring FILE]")
+		os.Exit(1)
+	}
+
+	configPath := fs.Arg(0)
+	ui.PrintBanner(version)
+
+	if os.Getuid() != 0 {
+		ui.Error("This command must be run as root", fmt.Errorf("run with: sudo distrorun bundle ..."))
+	}
+	if err := confine.CheckEngine(); err != nil {
+		ui.Error("Insufficient privileges", err)
+	}
+
+	ui.StepHeader(1, 4, "Parsing configuration...")
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		ui.Error("Configuration error", err)
+	}
+	setMirror(cfg, *mirror)
+	if cfg.Distro.Base != "alpine" {
+		ui.Error("Unsupported distro", fmt.Errorf("bundles are only supported for alpine, not %s", cfg.Distro.Base))
+	}
+	outputPath := *output
+	if outputPath == "" {
+		outputPath = cfg.Name + "-bundle.tar.gz"
+	}
+	if err := checkOutputPaths(configPath, outputPath); err != nil {
+		ui.Error("Invalid output path", err)
+	}
+	ui.Info("Config", cfg.Name)
+
+	stageDir, err := os.MkdirTemp("", "distrorun-bundle-")
+	if err != nil {
+		ui.Error("Creating staging directory", err)
+	}
+	defer os.RemoveAll(stageDir)
+	ui.AtExit(func() { os.RemoveAll(stageDir) })
+
+	// Resolve packages the same way a build does: bootstrap a throwaway
+	// rootfs against an empty cache so every downloaded file lands in it.
+	ui.StepHeader(2, 4, "Downloading minirootfs and packages...")
+	ctx := interruptContext()
+	lock, err := rootfs.Lock(cfg.Name)
+	if err != nil {
+		ui.Error("Acquiring build lock", err)
+	}
+	configHash, err := fileHash(configPath)
+	if err != nil {
+		ui.Error("Reading configuration", err)
+	}
+	rfs, err := rootfs.Bootstrap(cfg.Name, rootfs.Options{
+		Context:         ctx,
+		CacheDir:        filepath.Join(stageDir, bundle.CacheDir),
+		AlpineBranch:    cfg.Distro.AlpineBranch(),
+		Mirror:          cfg.Distro.Mirror,
+		Repositories:    cfg.Distro.Repositories,
+		AlpineKeyring:   *keyring,
+		ConfigHash:      configHash,
+		WorkDir:         os.Getenv("DISTRORUN_WORKDIR"),
+		Disk:            cfg.OutputMode() == "disk",
+		Container:       cfg.OutputMode() == "oci",
+		VM:              cfg.Target == "vm",
+		Kernel:          cfg.Distro.Kernel,
+		Cmdline:         cfg.KernelCmdline(),
+		NonfatalScripts: cfg.NonfatalScripts(),
+	})
+	if err != nil {
+		ui.Error("Bootstrap failed", err)
+	}
+	ui.AtExit(func() { rfs.Cleanup(true) })
+	installConfigured(rfs, cfg)
+	if cfg.Hooks != nil && len(cfg.Hooks.PostPackages) > 0 {
+		ui.Warn("post_packages hooks are not run; packages they install are not bundled")
+	}
+	if !bootloader.Available() {
+		syslinuxDir, err := os.MkdirTemp("", "distrorun-syslinux-")
+		if err != nil {
+			ui.Error("Creating syslinux directory", err)
+		}
+		defer os.RemoveAll(syslinuxDir)
+		ui.AtExit(func() { os.RemoveAll(syslinuxDir) })
+		if err := rfs.FetchSyslinux(syslinuxDir); err != nil {
+			ui.Error("syslinux is not installed on the host and could not be fetched", err)
+		}
+		bootloader.AddSearchPath(syslinuxDir)
+	}
+	rfs.Cleanup(true)
+	lock.Unlock()
+	ui.Success("Packages cached")
+
+	ui.StepHeader(3, 4, "Collecting boot assets...")
+	syslinux, err := bootloader.SyslinuxAssets()
+	if err != nil {
+		ui.Error("Collecting syslinux files", err)
+	}
+	if err := bundle.CopyAssets(filepath.Join(stageDir, bundle.SyslinuxDir), syslinux); err != nil {
+		ui.Error("Collecting syslinux files", err)
+	}
+	if ovmf := bundle.OVMFAssets(); len(ovmf) > 0 {
+		if err := bundle.CopyAssets(filepath.Join(stageDir, bundle.OVMFDir), ovmf); err != nil {
+			ui.Error("Collecting OVMF firmware", err)
+		}
+	} else {
+		ui.Degrade("UEFI firmware", "OVMF not found on the host: testing UEFI boot will need it installed")
+	}
+	ui.Success("Boot assets collected")
+
+	ui.StepHeader(4, 4, "Writing bundle...")
+	if err := bundle.Create(stageDir, outputPath, bundle.Manifest{Name: cfg.Name, Distro: cfg.Distro.Base}); err != nil {
+		ui.Error("Bundle creation failed", err)
+	}
+	if info, err := os.Stat(outputPath); err == nil {
+		ui.SizeInfo("Bundle", float64(info.Size())/1024/1024)
+	}
+	ui.InfoPath("Bundle", outputPath)
+	ui.InfoPath("Checksum", outputPath+".sha256")
+	ui.Success("Bundle ready — build offline with: distrorun build " + configPath + " -bundle " + outputPath)
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func runTest(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	ram := fs.String("r", "512", "RAM in MB (default: 512)")
+	disk := fs.String("d", "", "Create and attach a virtual disk of this size (e.g. 8G)")
+	check := fs.Bool("check", false, "Boot headless and report pass/fail instead of opening a VM window")
+	timeout := fs.Duration("timeout", boottest.DefaultTimeout, "With -check: how long to wait for the marker")
+	marker := fs.String("marker", boottest.DefaultMarker, "With -check: serial console text that means the boot succeeded")
+	logPath := fs.String("log", "", "With -check: write the serial console to this file")
+	persistSize := fs.String("persistent-disk", "", "Create and attach a disk of this size (e.g. 2G) with a "+flash.PersistLabel+" partition, for boot.persistence")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun test <iso-file> [-r RAM_MB] [-d DISK_SIZE] [-persistent-disk SIZE] [-check [-timeout DUR] [-marker TEXT] [-log FILE]]")
+		os.Exit(1)
+	}
+
+	isoPath := fs.Arg(0)
+	ui.PrintBanner(version)
+
+	// Check ISO exists
+	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
+		ui.Error("ISO not found", fmt.Errorf("%s does not exist", isoPath))
+	}
+
+	// The persistence disk is kept between runs, so changes made in one
+	// boot show up in the next.
+	var persistPath string
+	if *persistSize != "" {
+		size, err := config.ParseSize(*persistSize)
+		if err != nil {
+			ui.Error("Invalid -persistent-disk", err)
+		}
+		persistPath = strings.TrimSuffix(isoPath, filepath.Ext(isoPath)) + "-persist.qcow2"
+		if _, err := os.Stat(persistPath); os.IsNotExist(err) {
+			if err := flash.CheckPersistDiskDeps(); err != nil {
+				ui.Error("Missing dependency", err)
+			}
+			ui.SubStep("Creating persistence disk: " + *persistSize)
+			if err := flash.CreatePersistDisk(context.Background(), persistPath, size); err != nil {
+				ui.Error("Failed to create persistence disk", err)
+			}
+		} else {
+			ui.SubStep("Using existing persistence disk: " + persistPath)
+		}
+	}
+
+	if *check {
+		ui.StepHeader(1, 1, "Boot testing under QEMU...")
+		opts := boottest.Options{RAM: *ram, Timeout: *timeout, Marker: *marker, LogPath: *logPath, PersistDisk: persistPath}
+		if err := boottest.Run(isoPath, opts); err != nil {
+			ui.Error("Boot test failed", err)
+		}
+		ui.Success("Boot test passed")
+		return
+	}
+
+	// Check QEMU is installed
+	qemuBin, err := exec.LookPath("qemu-system-x86_64")
+	if err != nil {
+		ui.Error("QEMU not found", fmt.Errorf("install with: sudo dnf install qemu-system-x86 (or sudo apt install qemu-system-x86)"))
+	}
+
+	ui.StepHeader(1, 1, "Launching QEMU...")
+	ui.Info("ISO", isoPath)
+	ui.Info("RAM", *ram+" MB")
+
+	qemuArgs := []string{
+		"-cdrom", isoPath,
+		"-m", *ram,
+		"-boot", "d",
+		"-enable-kvm",
 	}
 
 	// Create a virtual disk if requested
@@ -302,6 +2317,10 @@ func runTest(args []string) {
 		ui.Info("Disk", diskPath+" ("+*disk+")")
 		qemuArgs = append(qemuArgs, "-hda", diskPath)
 	}
+	if persistPath != "" {
+		ui.Info("Persistence disk", persistPath)
+		qemuArgs = append(qemuArgs, "-drive", "file="+persistPath+",format=qcow2,media=disk")
+	}
 
 	ui.Success("Starting virtual machine...")
 
@@ -330,3 +2349,463 @@ func runTest(args []string) {
 		}
 	}
 }
+
+func runExtract(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun extract <iso> [dest]")
+		os.Exit(1)
+	}
+
+	isoPath := fs.Arg(0)
+	dest := fs.Arg(1)
+	if dest == "" {
+		dest = strings.TrimSuffix(filepath.Base(isoPath), filepath.Ext(isoPath)) + "-extracted"
+	}
+	ui.PrintBanner(version)
+	ui.InfoPath("ISO", isoPath)
+	ui.InfoPath("Destination", dest)
+
+	res, err := unpack.ISO(isoPath, dest)
+	if err != nil {
+		ui.Error("Extraction failed", err)
+	}
+	ui.InfoPath("Files", filepath.Join(dest, unpack.ISODir))
+	if res.Squashfs != "" {
+		ui.InfoPath("Root filesystem", filepath.Join(dest, unpack.RootfsDir))
+	}
+	for _, rel := range res.Initramfs {
+		ui.InfoPath("Initramfs", filepath.Join(dest, unpack.InitramfsDir, filepath.Base(rel)))
+	}
+	if res.Skipped > 0 {
+		ui.Warn(fmt.Sprintf("%d device nodes, FIFOs and sockets of the initramfs were not recreated", res.Skipped))
+	}
+	if res.Incomplete {
+		ui.Warn("unsquashfs could not create some files of the root filesystem (run as root to keep device nodes)")
+	}
+	ui.Success("Extracted " + isoPath + " into " + dest)
+}
+
+// runSBOM writes the SBOM of an image that is already built, such as a
+// release from before SBOMs were generated: an ISO, whose root filesystem
+// is unpacked for the scan, or a rootfs directory.
+func runSBOM(args []string) {
+	fs := flag.NewFlagSet("sbom", flag.ExitOnError)
+	output := fs.String("o", "", "output path (default <name>-sbom.spdx.json)")
+	name := fs.String("name", "", "name recorded in the SBOM (default: the image file name)")
+	files := fs.Bool("files", false, "list the files of each apk package with their hashes")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun sbom [-o out.spdx.json] [-name NAME] [-files] <iso|rootfs-dir>")
+		os.Exit(1)
+	}
+
+	image := fs.Arg(0)
+	fi, err := os.Stat(image)
+	if err != nil {
+		ui.Error("Reading image", err)
+	}
+	stem := strings.TrimSuffix(filepath.Base(filepath.Clean(image)), filepath.Ext(image))
+	if *name == "" {
+		*name = stem
+	}
+	if *output == "" {
+		*output = stem + "-sbom.spdx.json"
+	}
+	ui.PrintBanner(version)
+	ui.InfoPath("Image", image)
+
+	rootfsPath := image
+	if !fi.IsDir() {
+		workDir, err := os.MkdirTemp("", "distrorun-sbom-")
+		if err != nil {
+			ui.Error("Creating working directory", err)
+		}
+		defer os.RemoveAll(workDir)
+		ui.AtExit(func() { os.RemoveAll(workDir) })
+
+		ui.SubStep("Unpacking root filesystem...")
+		res, err := unpack.ISO(image, workDir)
+		if err != nil {
+			ui.Error("Unpacking ISO failed", err)
+		}
+		if res.Squashfs == "" {
+			ui.Error("Unpacking ISO failed", fmt.Errorf("%s has no squashfs root filesystem", image))
+		}
+		rootfsPath = filepath.Join(workDir, unpack.RootfsDir)
+	}
+
+	if err := sbom.Generate(rootfsPath, *name, *output, *files); err != nil {
+		ui.Error("SBOM generation failed", err)
+	}
+	ui.Success("SBOM of " + image + " written to " + *output)
+}
+
+// runDrift compares a deployed system, over ssh, with the SBOM of the image
+// it was built from, and exits 1 when they differ.
+func runDrift(args []string) {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	host := fs.String("ssh", "", "System to check, as for ssh: [user@]host (required)")
+	var paths stringList
+	fs.Var(&paths, "path", "Only compare the files under this directory (repeatable; default: every file the SBOM hashes)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *host == "" {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun drift -ssh HOST [-path DIR]... <sbom.spdx.json>")
+		os.Exit(1)
+	}
+	sbomPath := fs.Arg(0)
+	ui.PrintBanner(version)
+	ui.InfoPath("SBOM", sbomPath)
+	ui.Info("System", *host)
+
+	want, err := drift.Expected(sbomPath, paths)
+	if err != nil {
+		ui.Error("Reading SBOM", err)
+	}
+	if len(want.Files) == 0 {
+		ui.Warn("the SBOM has no file hashes (build with sbom.files, or use distrorun sbom -files): comparing packages only")
+	}
+	ui.SubStep(fmt.Sprintf("Collecting %d packages and %d file hashes...", len(want.Packages), len(want.Files)))
+	got, err := drift.CollectSSH(context.Background(), *host, slices.Sorted(maps.Keys(want.Files)))
+	if err != nil {
+		ui.Error("Collecting system state failed", err)
+	}
+
+	r := drift.Compare(want, got)
+	if r.Empty() {
+		ui.Success(*host + " matches its image")
+		return
+	}
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"packages installed since", r.Added},
+		{"packages removed", r.Removed},
+		{"packages changed", changeLines(r.Changed)},
+		{"files modified", r.Modified},
+		{"files missing", r.Missing},
+	} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		ui.Warn(fmt.Sprintf("%d %s", len(section.lines), section.title))
+		for _, l := range section.lines {
+			ui.Detail(l)
+		}
+	}
+	ui.Error("Drift detected", fmt.Errorf("%s differs from its image in %d packages and %d files",
+		*host, len(r.Added)+len(r.Removed)+len(r.Changed), len(r.Modified)+len(r.Missing)))
+}
+
+// changeLines returns changes as "name image → system" lines.
+func changeLines(changes []drift.Change) []string {
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.Name+" "+c.Image+" → "+c.System)
+	}
+	return lines
+}
+
+// runPatch applies a small delta to an existing distrorun ISO — files,
+// packages, the kernel command line — and repacks it, instead of
+// rebuilding the image from scratch.
+func runPatch(args []string) {
+	fs := flag.NewFlagSet("patch", flag.ExitOnError)
+	patchPath := fs.String("config", "", "Patch file listing the files, packages and kernel command line to change (required)")
+	output := fs.String("o", "", "Output ISO path (default: <iso>-patched.iso)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *patchPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun patch -config delta.yaml [-o output.iso] <iso-file>")
+		os.Exit(1)
+	}
+
+	isoPath := fs.Arg(0)
+	outputPath := *output
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(isoPath, filepath.Ext(isoPath)) + "-patched.iso"
+	}
+	ctx := interruptContext()
+	start := time.Now()
+	ui.PrintBanner(version)
+
+	if os.Getuid() != 0 {
+		ui.Error("This command must be run as root", fmt.Errorf("run with: sudo distrorun patch ..."))
+	}
+	if err := confine.CheckEngine(); err != nil {
+		ui.Error("Insufficient privileges", err)
+	}
+
+	// ── Step 1: Parse patch ──────────────────────────────────────────────
+	patch, err := config.LoadPatch(*patchPath)
+	if err != nil {
+		ui.Error("Patch error", err)
+	}
+	totalSteps := patchSteps(patch)
+	ui.StepHeader(1, totalSteps, "Parsing patch...")
+	ui.InfoPath("ISO", isoPath)
+	ui.Info("Files", fmt.Sprintf("%d entries", len(patch.Files)))
+	ui.Info("Packages", strings.Join(patch.Packages, ", "))
+
+	if _, err := os.Stat(isoPath); err != nil {
+		ui.Error("ISO not found", err)
+	}
+	auditPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-audit.jsonl"
+	if err := checkOutputPaths(*patchPath, outputPath, auditPath); err != nil {
+		ui.Error("Invalid output path", err)
+	}
+	if samePath(isoPath, outputPath) {
+		ui.Error("Invalid output path", fmt.Errorf("%s would overwrite the ISO being patched", outputPath))
+	}
+	if err := iso.CheckHostDeps(); err != nil {
+		ui.Error("Missing dependency", err)
+	}
+	if err := audit.Open(auditPath); err != nil {
+		ui.Error("Creating audit log", err)
+	}
+	defer audit.Close()
+	ui.Success("Patch is valid")
+
+	// ── Step 2: Unpack ISO ───────────────────────────────────────────────
+	ui.StepHeader(2, totalSteps, "Unpacking ISO...")
+	workDir, err := os.MkdirTemp("", "distrorun-patch-")
+	if err != nil {
+		ui.Error("Creating working directory", err)
+	}
+	// Replaced by the rootfs cleanup once it exists: that one unmounts
+	// the chroot mounts before removing anything.
+	cleanup := func() { audit.RemoveAll(workDir) }
+	defer func() { cleanup() }()
+	ui.AtExit(func() { cleanup() })
+
+	stagingDir := filepath.Join(workDir, unpack.ISODir)
+	if err := unpack.Files(isoPath, stagingDir); err != nil {
+		ui.Error("Unpacking ISO failed", err)
+	}
+	squashfsPath := filepath.Join(stagingDir, "rootfs.squashfs")
+	var rfs *rootfs.Rootfs
+	if patch.ChangesRootfs() {
+		ui.SubStep("Unpacking root filesystem...")
+		incomplete, err := unpack.Squashfs(squashfsPath, filepath.Join(workDir, unpack.RootfsDir))
+		if err != nil {
+			ui.Error("Unpacking root filesystem failed", err)
+		}
+		if incomplete {
+			ui.Error("Unpacking root filesystem failed", fmt.Errorf("unsquashfs could not create every file"))
+		}
+		if rfs, err = rootfs.Open(ctx, workDir); err != nil {
+			ui.Error("Unpacking root filesystem failed", err)
+		}
+		cleanup = func() { rfs.Cleanup(true) }
+		ui.Info("Distro", rfs.Distro())
+	}
+	ui.Success("ISO unpacked")
+	currentStep := 3
+
+	// ── Step 3 (optional): Patch root filesystem ─────────────────────────
+	if rfs != nil {
+		ui.StepHeader(currentStep, totalSteps, "Patching root filesystem...")
+		// Packages first, so overlay owners can be users they create.
+		if len(patch.Packages) > 0 {
+			if err := rfs.PatchPackages(patch.Packages); err != nil {
+				ui.Error("Package installation failed", err)
+			}
+		}
+		if err := rfs.InstallFiles(patch.Files); err != nil {
+			ui.Error("Overlay installation failed", err)
+		}
+		// Keep the compression the image was built with.
+		comp, err := iso.SquashfsCompression(squashfsPath)
+		if err != nil {
+			ui.Error("Reading root filesystem failed", err)
+		}
+		rfs.Unmount()
+		if err := rfs.CleanupRootfs(); err != nil {
+			ui.Error("Cleaning rootfs failed", err)
+		}
+		if err := iso.MakeSquashfs(ctx, rfs.Path, squashfsPath, iso.SquashfsOptions{Compression: comp}); err != nil {
+			ui.Error("Squashfs build failed", err)
+		}
+		ui.Success("Root filesystem patched")
+		currentStep++
+	}
+
+	// ── Step 4 (optional): Change kernel command line ────────────────────
+	if patch.Cmdline != "" {
+		ui.StepHeader(currentStep, totalSteps, "Changing kernel command line...")
+		old, err := bootloader.SetCmdline(stagingDir, patch.Cmdline)
+		if err != nil {
+			ui.Error("Changing kernel command line failed", err)
+		}
+		ui.Detail("was: " + old)
+		ui.Success("Kernel command line set to: " + patch.Cmdline)
+		currentStep++
+	}
+
+	// ── Step N: Repack ISO ───────────────────────────────────────────────
+	ui.StepHeader(currentStep, totalSteps, "Repacking ISO...")
+	if err := iso.Repack(ctx, stagingDir, outputPath); err != nil {
+		ui.Error("ISO build failed", err)
+	}
+
+	ui.PrintSummary(outputPath, "", "qemu-system-x86_64 -cdrom "+outputPath+" -m 512", time.Since(start))
+}
+
+// buildSteps returns the number of steps runBuild takes for cfg, with
+// bootTest for -test: eight, less the push of an OCI image that is not
+// pushed, and one for each optional step cfg enables.
+func buildSteps(cfg *config.Config, bootTest bool) int {
+	steps := 8
+	if cfg.OutputMode() == "oci" && !cfg.Build.Push {
+		steps--
+	}
+	if len(cfg.Files) > 0 {
+		steps++
+	}
+	if cfg.SBOMEnabled() {
+		steps++
+	}
+	if cfg.VulnScanEnabled() {
+		steps++
+	}
+	if cfg.Assertions != nil {
+		steps++
+	}
+	if len(cfg.Publish) > 0 {
+		steps++
+	}
+	if bootTest {
+		steps++
+	}
+	return steps
+}
+
+// patchSteps returns the number of steps runPatch takes for p: parsing,
+// unpacking and repacking, and patching the root filesystem and the kernel
+// command line when p changes them.
+func patchSteps(p *config.Patch) int {
+	steps := 3
+	if p.ChangesRootfs() {
+		steps++
+	}
+	if p.Cmdline != "" {
+		steps++
+	}
+	return steps
+}
+
+// runFlash writes an ISO to a USB stick or other disk, after the user
+// confirms by typing the device name, and reads it back to verify it.
+func runFlash(args []string) {
+	fs := flag.NewFlagSet("flash", flag.ExitOnError)
+	list := fs.Bool("list", false, "List the disks that can be written to and exit")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation before erasing the device")
+	force := fs.Bool("force", false, "Allow writing to a disk that is not removable")
+	noVerify := fs.Bool("no-verify", false, "Do not read the device back after writing")
+	persist := fs.Bool("persist", false, "Add a "+flash.PersistLabel+" partition in the space behind the ISO (for boot.persistence)")
+	fs.Parse(args)
+
+	if *list {
+		devices, err := flash.ListDevices()
+		if err != nil {
+			ui.Error("Listing devices failed", err)
+		}
+		if len(devices) == 0 {
+			fmt.Println("No disks found.")
+		}
+		for _, d := range devices {
+			fmt.Println(d.Describe())
+		}
+		return
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: distrorun flash [-yes] [-force] [-no-verify] [-persist] <iso-file> <device>")
+		fmt.Fprintln(os.Stderr, "       distrorun flash -list")
+		os.Exit(1)
+	}
+
+	isoPath, devPath := fs.Arg(0), fs.Arg(1)
+	ctx := interruptContext()
+	start := time.Now()
+	ui.PrintBanner(version)
+
+	totalSteps := 2
+	if !*noVerify {
+		totalSteps++
+	}
+	if *persist {
+		totalSteps++
+	}
+
+	// ── Step 1: Check device ─────────────────────────────────────────────
+	ui.StepHeader(1, totalSteps, "Checking device...")
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		ui.Error("ISO not found", err)
+	}
+	dev, err := flash.Lookup(devPath)
+	if err != nil {
+		ui.Error("Invalid device", err)
+	}
+	ui.InfoPath("ISO", isoPath)
+	ui.Info("Device", dev.Describe())
+	if len(dev.Mounts) > 0 {
+		ui.Error("Device is in use", fmt.Errorf("%s is mounted on %s: unmount it first", dev.Path, strings.Join(dev.Mounts, ", ")))
+	}
+	if !dev.Removable && !*force {
+		ui.Error("Device is not removable", fmt.Errorf("%s looks like an internal disk: pass -force to write to it anyway", dev.Path))
+	}
+	if info.Size() > dev.Size {
+		ui.Error("Device too small", fmt.Errorf("the ISO needs %.1f MB", float64(info.Size())/1024/1024))
+	}
+	if *persist {
+		if err := flash.CheckPersistDeps(); err != nil {
+			ui.Error("Missing dependency", err)
+		}
+	}
+	if !*yes {
+		ui.Warn("Everything on " + dev.Path + " will be erased.")
+		fmt.Printf("  Type %q to continue: ", dev.Name)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != dev.Name {
+			ui.Error("Aborted", fmt.Errorf("the answer did not match %q; nothing was written", dev.Name))
+		}
+	}
+	ui.Success("Device ready")
+
+	// ── Step 2: Write ISO ────────────────────────────────────────────────
+	ui.StepHeader(2, totalSteps, "Writing ISO...")
+	if err := flash.Write(ctx, isoPath, dev, ui.Progress); err != nil {
+		ui.Error("Writing failed", err)
+	}
+	ui.Success(fmt.Sprintf("Wrote %.1f MB to %s", float64(info.Size())/1024/1024, dev.Path))
+	currentStep := 3
+
+	// ── Step 3 (optional): Verify ────────────────────────────────────────
+	if !*noVerify {
+		ui.StepHeader(currentStep, totalSteps, "Verifying...")
+		if err := flash.Verify(ctx, isoPath, dev, ui.Progress); err != nil {
+			ui.Error("Verification failed", err)
+		}
+		ui.Success("Device matches the ISO")
+		currentStep++
+	}
+
+	// ── Step 4 (optional): Persistence partition ─────────────────────────
+	if *persist {
+		ui.StepHeader(currentStep, totalSteps, "Creating persistence partition...")
+		part, err := flash.AddPersistence(ctx, dev, info.Size())
+		if err != nil {
+			ui.Error("Creating persistence partition failed", err)
+		}
+		ui.Detail(part)
+		ui.Success("Persistence partition " + flash.PersistLabel + " created")
+	}
+
+	ui.Success(fmt.Sprintf("%s is ready to boot (%s)", dev.Path, time.Since(start).Round(time.Second)))
+}
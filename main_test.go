@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/talfaza/distrorun/internal/config"
+	"github.com/talfaza/distrorun/internal/rootfs"
+)
+
+func TestOfflineMissing(t *testing.T) {
+	// A cache with the secdb files of v3.20, and no minirootfs: the cases
+	// restore a snapshot, so that is not missing.
+	cacheDir := t.TempDir()
+	for _, repo := range []string{"main", "community"} {
+		p := filepath.Join(cacheDir, "secdb", "v3.20", repo+".json")
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte("{}"), 0644)
+	}
+	mirror := t.TempDir()
+	for name, tc := range map[string]struct {
+		cfg        config.Config
+		opts       rootfs.Options
+		fromBundle bool
+		want       []string // what the missing lines say, in order
+	}{
+		"empty local mirror": {
+			opts: rootfs.Options{CacheDir: cacheDir, LocalMirror: mirror, AlpineBranch: "v3.20"},
+			want: []string{"local mirror: " + mirror + "/v3.20/main/", "local mirror: " + mirror + "/v3.20/community/"},
+		},
+		"no local mirror": {
+			opts: rootfs.Options{CacheDir: cacheDir, AlpineBranch: "v3.20"},
+			want: []string{"distro.local_mirror"},
+		},
+		"bundle": {
+			opts:       rootfs.Options{CacheDir: cacheDir, AlpineBranch: "v3.20"},
+			fromBundle: true,
+		},
+		"secdb cached": {
+			cfg:        config.Config{Distro: config.Distro{Version: "3.20"}, Build: &config.Build{VulnScan: true}},
+			opts:       rootfs.Options{CacheDir: cacheDir, AlpineBranch: "v3.20"},
+			fromBundle: true,
+		},
+		"secdb missing": {
+			cfg:        config.Config{Distro: config.Distro{Version: "3.21"}, Build: &config.Build{VulnScan: true}},
+			opts:       rootfs.Options{CacheDir: cacheDir, AlpineBranch: "v3.21"},
+			fromBundle: true,
+			want:       []string{"secdb: ", "secdb: "},
+		},
+		"publish and push": {
+			cfg:        config.Config{Publish: []config.Target{{Type: "http"}}, Build: &config.Build{Push: true}},
+			opts:       rootfs.Options{CacheDir: cacheDir},
+			fromBundle: true,
+			want:       []string{"publish: ", "build.push: "},
+		},
+		"no cache": {
+			opts:       rootfs.Options{},
+			fromBundle: true,
+			want:       []string{"the download cache (do not use -no-cache)"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := offlineMissing(&tc.cfg, tc.opts, false, tc.fromBundle)
+			if len(got) != len(tc.want) {
+				t.Fatalf("missing = %q, want %q", got, tc.want)
+			}
+			for i, want := range tc.want {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("missing[%d] = %q, want it to say %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBootMenu(t *testing.T) {
+	for name, tc := range map[string]struct {
+		boot        *config.Boot
+		wantLabels  []string
+		wantDefault int
+		wantErr     string
+	}{
+		"defaults": {
+			wantLabels: []string{"DistroRun Live"},
+		},
+		"built-in default": {
+			boot:        &config.Boot{Toram: true, Menu: &config.BootMenu{Default: "DistroRun Live (copy to RAM)"}},
+			wantLabels:  []string{"DistroRun Live", "DistroRun Live (copy to RAM)"},
+			wantDefault: 1,
+		},
+		"extra entries": {
+			boot: &config.Boot{Menu: &config.BootMenu{
+				Title:   "Example OS",
+				Timeout: 10,
+				Default: "Safe graphics",
+				Entries: []config.MenuEntry{{Label: "Rescue"}, {Label: "Safe graphics", Cmdline: "nomodeset"}},
+			}},
+			wantLabels:  []string{"DistroRun Live", "Rescue", "Safe graphics"},
+			wantDefault: 2,
+		},
+		"unknown default": {
+			boot:    &config.Boot{Menu: &config.BootMenu{Default: "Missing"}},
+			wantErr: `boot.menu.default "Missing" is not an entry of the menu: "DistroRun Live"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := bootMenu(&config.Config{Boot: tc.boot})
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("bootMenu error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, e := range m.Entries {
+				labels = append(labels, e.Label)
+			}
+			if !slices.Equal(labels, tc.wantLabels) {
+				t.Errorf("labels = %q, want %q", labels, tc.wantLabels)
+			}
+			if m.Default != tc.wantDefault {
+				t.Errorf("default = %d, want %d", m.Default, tc.wantDefault)
+			}
+		})
+	}
+
+	m, _ := bootMenu(&config.Config{Boot: &config.Boot{Cmdline: "quiet splash", Menu: &config.BootMenu{
+		Title: "Example OS", Timeout: 10,
+		Entries: []config.MenuEntry{{Label: "Rescue"}, {Label: "Safe graphics", Cmdline: "nomodeset"}},
+	}}})
+	if m.Title != "Example OS" || m.Timeout != 10 {
+		t.Errorf("title, timeout = %q, %d, want Example OS, 10", m.Title, m.Timeout)
+	}
+	if got := m.Entries[1].Cmdline; got != "quiet splash" {
+		t.Errorf("Rescue cmdline = %q, want the image's", got)
+	}
+	if got := m.Entries[2].Cmdline; got != "quiet splash nomodeset" {
+		t.Errorf("Safe graphics cmdline = %q, want the image's and nomodeset", got)
+	}
+}
+
+func TestPatchSteps(t *testing.T) {
+	for name, tc := range map[string]struct {
+		patch config.Patch
+		want  int
+	}{
+		"cmdline":            {patch: config.Patch{Cmdline: "quiet"}, want: 4},
+		"packages":           {patch: config.Patch{Packages: []string{"vim"}}, want: 4},
+		"files":              {patch: config.Patch{Files: []config.File{{Path: "/etc/motd"}}}, want: 4},
+		"rootfs and cmdline": {patch: config.Patch{Packages: []string{"vim"}, Cmdline: "quiet"}, want: 5},
+	} {
+		if got := patchSteps(&tc.patch); got != tc.want {
+			t.Errorf("%s: patchSteps = %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+func TestBuildSteps(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg      config.Config
+		bootTest bool
+		want     int
+	}{
+		"iso":        {want: 8},
+		"iso tested": {bootTest: true, want: 9},
+		"oci":        {cfg: config.Config{Build: &config.Build{Output: "oci"}}, want: 7},
+		"oci pushed": {cfg: config.Config{Build: &config.Build{Output: "oci", Push: true}}, want: 8},
+		"sbom and publish": {
+			cfg:  config.Config{Build: &config.Build{SBOM: true}, Publish: []config.Target{{Type: "http"}}},
+			want: 10,
+		},
+	} {
+		if got := buildSteps(&tc.cfg, tc.bootTest); got != tc.want {
+			t.Errorf("%s: buildSteps = %d, want %d", name, got, tc.want)
+		}
+	}
+}